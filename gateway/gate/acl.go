@@ -0,0 +1,226 @@
+package gateway
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// What a rule of the ACL is for
+const (
+	aclPublish   = "publish"
+	aclSubscribe = "subscribe"
+	aclAll       = "all"
+)
+
+// Which topics each client may publish to, its will among them,
+// and which filters it may subscribe to, from acl-file, a rule a
+// line:
+//
+//	# client   action     filter               decision
+//	sensor-*   publish    site42/sensors/%c/#  allow
+//	sensor-*   subscribe  site42/cmd/%c/#      allow
+//	*          all        #                    deny
+//
+// client is an id or a pattern as path.Match has them, action
+// publish, subscribe or all, and filter a topic filter in which
+// %c stands for the client's id; a rule with %c is passed over
+// for an id with a /, + or # in it. The first rule whose client,
+// action and filter match decides; a topic matched by none is
+// allowed or denied as acl-default has it. An allow rule matches
+// a subscription its filter covers every topic of, and a deny
+// rule one that may match any topic its filter does. Blank lines
+// and lines starting with # are ignored.
+type acl struct {
+	rules []aclRule
+	allow bool // what is matched by no rule
+}
+
+type aclRule struct {
+	client  string
+	action  string
+	filter  string
+	allow   bool
+	pattern bool // client is a pattern rather than an id
+}
+
+// The ACL gc configures, reading acl-file; nil, allowing
+// everything, unless it gives acl-file
+func newACL(gc *GatewayConfig) (*acl, error) {
+	if gc.aclfile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(gc.aclfile)
+	if err != nil {
+		ERROR.Printf("Cannot read the ACL from %s: %v", gc.aclfile, err)
+		return nil, err
+	}
+	defer f.Close()
+	a := &acl{allow: gc.acldefaultallow}
+	scanner := bufio.NewScanner(f)
+	var lineno int
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		r, ok := parseACLRule(line)
+		if !ok {
+			ERROR.Printf("Invalid ACL rule on line %d of %s: \"%s\"", lineno, gc.aclfile, line)
+			return nil, ErrInvalidACL
+		}
+		a.rules = append(a.rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	INFO.Printf("loaded %d ACL rules from %s\n", len(a.rules), gc.aclfile)
+	return a, nil
+}
+
+func parseACLRule(line string) (aclRule, bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return aclRule{}, false
+	}
+	r := aclRule{client: fields[0], action: fields[1], filter: fields[2]}
+	if _, err := path.Match(r.client, ""); err != nil {
+		return r, false
+	}
+	r.pattern = strings.ContainsAny(r.client, `*?[\`)
+	switch r.action {
+	case aclPublish, aclSubscribe, aclAll:
+	default:
+		return r, false
+	}
+	if _, err := ValidateTopicFilter(r.filter); err != nil {
+		return r, false
+	}
+	switch fields[3] {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return r, false
+	}
+	return r, true
+}
+
+// Whether the client with id may publish to topic, or subscribe
+// to it as a filter, as action has it; everything is allowed if
+// a is nil
+func (a *acl) allows(id, action, topic string) bool {
+	if a == nil {
+		return true
+	}
+	for _, r := range a.rules {
+		if r.action != aclAll && r.action != action {
+			continue
+		}
+		if r.pattern {
+			if ok, _ := path.Match(r.client, id); !ok {
+				continue
+			}
+		} else if r.client != id {
+			continue
+		}
+		filter := r.filter
+		if strings.Contains(filter, "%c") {
+			if id == "" || strings.ContainsAny(id, "/+#") {
+				continue
+			}
+			filter = strings.ReplaceAll(filter, "%c", id)
+		}
+		switch {
+		case action == aclPublish && !TopicMatches(filter, topic):
+			continue
+		case action == aclSubscribe && r.allow && !filterCovers(filter, topic):
+			continue
+		case action == aclSubscribe && !r.allow && !filtersOverlap(filter, topic):
+			continue
+		}
+		return r.allow
+	}
+	return a.allow
+}
+
+// Whether every topic sub matches is matched by filter
+func filterCovers(filter, sub string) bool {
+	flevels := strings.Split(filter, "/")
+	slevels := strings.Split(sub, "/")
+	if strings.HasPrefix(sub, "$") && (flevels[0] == "#" || flevels[0] == "+") {
+		return false
+	}
+	for i, level := range flevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(slevels) || slevels[i] == "#" {
+			return false
+		}
+		if level != "+" && (slevels[i] == "+" || level != slevels[i]) {
+			return false
+		}
+	}
+	return len(flevels) == len(slevels)
+}
+
+// Whether some topic is matched by both a and b
+func filtersOverlap(a, b string) bool {
+	alevels := strings.Split(a, "/")
+	blevels := strings.Split(b, "/")
+	wild := func(level string) bool { return level == "#" || level == "+" }
+	if strings.HasPrefix(a, "$") && wild(blevels[0]) || strings.HasPrefix(b, "$") && wild(alevels[0]) {
+		return false
+	}
+	for i := 0; ; i++ {
+		switch {
+		case i == len(alevels) && i == len(blevels):
+			return true
+		case i == len(alevels):
+			return blevels[i] == "#"
+		case i == len(blevels):
+			return alevels[i] == "#"
+		}
+		al, bl := alevels[i], blevels[i]
+		if al == "#" || bl == "#" {
+			return true
+		}
+		if al != "+" && bl != "+" && al != bl {
+			return false
+		}
+	}
+}
+
+// Read the ACL gc configures, acl-file again among it, and check
+// what clients do from now on against it. The ACL already loaded
+// is kept if the file cannot be read.
+func (g *core) loadACL(gc *GatewayConfig) error {
+	a, err := newACL(gc)
+	if err != nil {
+		return err
+	}
+	g.acl.Store(a)
+	return nil
+}
+
+// Whether client may publish to topic, or subscribe to it as a
+// filter, as action has it, counting and logging it if not
+func (g *core) authorized(client *Client, action, topic string) bool {
+	if g.acl.Load().allows(client.ClientId, action, topic) {
+		return true
+	}
+	WARN.Log(action+" denied by the ACL", coreLog, logClient(client), logTopic(topic))
+	atomic.AddUint64(&g.aclDenied, 1)
+	client.deniedByACL()
+	return false
+}
+
+// The number of PUBLISHes, REGISTERs, SUBSCRIBEs and wills the
+// ACL has denied
+func (g *core) ACLDenied() uint64 {
+	return atomic.LoadUint64(&g.aclDenied)
+}
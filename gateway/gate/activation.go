@@ -0,0 +1,84 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// The UDP socket systemd passed, if any, which must be of the
+// family addr is
+func inheritedUDP(addr string) (*net.UDPConn, error) {
+	f := inherited("udp")
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := pc.(*net.UDPConn)
+	if !ok || !sameFamily(network(addr), conn.LocalAddr()) {
+		pc.Close()
+		return nil, fmt.Errorf("socket %v passed by systemd for %s: %v", pc.LocalAddr(), addr, ErrActivationMismatch)
+	}
+	return conn, nil
+}
+
+// The TCP socket systemd passed, if any, like inheritedUDP
+func inheritedTCP(addr string) (net.Listener, error) {
+	f := inherited("tcp")
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ln.(*net.TCPListener); !ok || !sameFamily(tcpNetwork(addr), ln.Addr()) {
+		ln.Close()
+		return nil, fmt.Errorf("socket %v passed by systemd for %s: %v", ln.Addr(), addr, ErrActivationMismatch)
+	}
+	return ln, nil
+}
+
+// The unix datagram socket systemd passed, if any, which must be
+// at path
+func inheritedUnix(path string) (*net.UnixConn, error) {
+	f := inherited("unix")
+	if f == nil {
+		return nil, nil
+	}
+	defer f.Close()
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := pc.(*net.UnixConn)
+	if !ok || conn.LocalAddr().String() != path {
+		pc.Close()
+		return nil, fmt.Errorf("socket %v passed by systemd for %s: %v", pc.LocalAddr(), path, ErrActivationMismatch)
+	}
+	return conn, nil
+}
+
+// Whether a is of the family of nw, "udp4" or "tcp6" say; "udp"
+// or "tcp" is either
+func sameFamily(nw string, a net.Addr) bool {
+	var ip net.IP
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	switch {
+	case strings.HasSuffix(nw, "4"):
+		return ip.To4() != nil
+	case strings.HasSuffix(nw, "6"):
+		return ip.To4() == nil
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// The first file descriptor systemd passes, SD_LISTEN_FDS_START
+var listenFdsStart = 3
+
+// The sockets systemd passed the gateway by socket activation
+// (LISTEN_FDS), read from the environment once, each taken by
+// the listener it is for
+var activation struct {
+	sync.Mutex
+	read  bool
+	files map[string]*os.File
+}
+
+// The socket systemd passed for kind, "udp", "tcp" or "unix", if
+// any. A socket is for the kind it is named after in
+// LISTEN_FDNAMES (FileDescriptorName= in the socket unit), or,
+// named otherwise, for the kind of socket it is.
+func inherited(kind string) *os.File {
+	defer activation.Unlock()
+	activation.Lock()
+	if !activation.read {
+		activation.read = true
+		activation.files = listenFds()
+	}
+	f := activation.files[kind]
+	delete(activation.files, kind)
+	return f
+}
+
+func listenFds() map[string]*os.File {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	files := make(map[string]*os.File)
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		unix.CloseOnExec(fd)
+		kind := socketKind(fd)
+		if i < len(names) && (names[i] == "udp" || names[i] == "tcp" || names[i] == "unix") {
+			kind = names[i]
+		}
+		if kind == "" || files[kind] != nil {
+			ERROR.Printf("ignoring socket %d passed by systemd\n", fd)
+			continue
+		}
+		files[kind] = os.NewFile(uintptr(fd), "systemd:"+kind)
+	}
+	return files
+}
+
+// "udp", "tcp" or "unix" for an internet datagram or stream
+// socket or a unix datagram socket, "" for anything else
+func socketKind(fd int) string {
+	sotype, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		return ""
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return ""
+	}
+	switch sa.(type) {
+	case *unix.SockaddrInet4, *unix.SockaddrInet6:
+		if sotype == unix.SOCK_DGRAM {
+			return "udp"
+		} else if sotype == unix.SOCK_STREAM {
+			return "tcp"
+		}
+	case *unix.SockaddrUnix:
+		if sotype == unix.SOCK_DGRAM {
+			return "unix"
+		}
+	}
+	return ""
+}
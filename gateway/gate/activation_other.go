@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package gateway
+
+import "os"
+
+// Socket activation is systemd's, so Linux only
+func inherited(kind string) *os.File {
+	return nil
+}
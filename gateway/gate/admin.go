@@ -0,0 +1,266 @@
+package gateway
+
+import (
+	"context"
+	"crypto/subtle"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// The HTTP listener operators ask the gateway about, off unless
+// admin-address is given, requiring token as a bearer token if
+// it is given. Handlers are added to mux when the gateway is
+// made; the listener serves them while the gateway is started.
+type admin struct {
+	sync.Mutex
+	address string
+	token   string
+	mux     *http.ServeMux
+	server  *http.Server
+	addr    net.Addr
+}
+
+func newAdmin(address, token string) *admin {
+	return &admin{address: address, token: token, mux: http.NewServeMux()}
+}
+
+// Serve the handlers, if an address is given
+func (a *admin) start() error {
+	if a.address == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", a.address)
+	if err != nil {
+		return err
+	}
+	defer a.Unlock()
+	a.Lock()
+	a.server = &http.Server{Handler: a.authorize(a.mux), ReadHeaderTimeout: 10 * time.Second}
+	a.addr = l.Addr()
+	go a.server.Serve(l)
+	INFO.Printf("admin listening on %s\n", a.addr)
+	if a.token == "" && !loopback(a.address) {
+		WARN.Println("admin listener not on loopback and no admin-token given, requests to change anything refused")
+	}
+	return nil
+}
+
+func (a *admin) stop(ctx context.Context) error {
+	defer a.Unlock()
+	a.Lock()
+	if a.server == nil {
+		return nil
+	}
+	err := a.server.Shutdown(ctx)
+	a.server, a.addr = nil, nil
+	return err
+}
+
+// Refuse requests without the token, if one is required. If
+// none is, a listener on loopback alone takes requests that
+// change anything, such as POST /publish; anyone who can reach
+// one elsewhere may only look.
+func (a *admin) authorize(h http.Handler) http.Handler {
+	if a.token == "" && loopback(a.address) {
+		return h
+	}
+	if a.token == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				http.Error(w, "admin-token required", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	expected := []byte("Bearer " + a.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == healthzPath || r.URL.Path == readyzPath {
+			// for probes that cannot carry a token
+			h.ServeHTTP(w, r)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// The address the listener is bound to, nil unless it is
+// serving
+func (a *admin) Addr() net.Addr {
+	defer a.Unlock()
+	a.Lock()
+	return a.addr
+}
+
+// Serve vars at /debug/vars, under "gnatt" after the variables
+// published with expvar, cmdline and memstats among them, as
+// expvar's own handler does. The gateway's are not published
+// with expvar, which would allow only one gateway a process.
+func (a *admin) publishVars(vars *expvar.Map) {
+	a.mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\n")
+		expvar.Do(func(kv expvar.KeyValue) {
+			fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+		})
+		fmt.Fprintf(w, "%q: %s\n}\n", "gnatt", vars)
+	})
+}
+
+// Serve net/http/pprof's profiles under /debug/pprof/: the CPU
+// profile, the execution trace and the goroutine, heap, mutex
+// and block profiles among them. Mutex contention is profiled 1
+// event in mutexFraction, and blocking 1 event in each
+// blockRate nanoseconds blocked, none if 0; each is set for the
+// process as a whole.
+func (a *admin) servePprof(mutexFraction, blockRate int) {
+	runtime.SetMutexProfileFraction(mutexFraction)
+	runtime.SetBlockProfileRate(blockRate)
+	a.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	a.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	a.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	a.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	a.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// The variables of what both gateways have: their clients and
+// topics, the traffic of each listener and in all, the limits
+// and how near they are, what was dropped and how long packets
+// and messages take
+func (g *core) vars(listeners func() []ListenerStats) *expvar.Map {
+	m := new(expvar.Map).Init()
+	m.Set("clients", expvar.Func(func() interface{} {
+		return g.clients.Len()
+	}))
+	m.Set("topics", expvar.Func(func() interface{} {
+		return g.tIndex.len()
+	}))
+	m.Set("listeners", expvar.Func(func() interface{} {
+		return listeners()
+	}))
+	m.Set("traffic", expvar.Func(func() interface{} {
+		var total ListenerStats
+		for _, s := range listeners() {
+			total.PacketsIn += s.PacketsIn
+			total.BytesIn += s.BytesIn
+			total.PacketsOut += s.PacketsOut
+			total.BytesOut += s.BytesOut
+		}
+		return map[string]uint64{
+			"packets_in":  total.PacketsIn,
+			"bytes_in":    total.BytesIn,
+			"packets_out": total.PacketsOut,
+			"bytes_out":   total.BytesOut,
+		}
+	}))
+	m.Set("limits", expvar.Func(func() interface{} {
+		return g.limitUsage()
+	}))
+	m.Set("dropped", expvar.Func(func() interface{} {
+		var queued, oversized uint64
+		g.clients.Range(func(sc SNClient) {
+			queued += sc.base().QueueDrops()
+			oversized += sc.base().Oversized()
+		})
+		flood := g.Flood()
+		var rateLimited uint64
+		for _, n := range g.RateLimitedSources() {
+			rateLimited += n
+		}
+		return map[string]uint64{
+			"oversized_packets":   g.OversizedPackets(),
+			"transform":           g.TransformDrops(),
+			"rate_limited":        rateLimited,
+			"client_queue":        queued,
+			"client_oversized":    oversized,
+			"client_rate_limited": g.PublishLimited(),
+			"log_lines":           LogDropped(),
+			"capture":             captureDropped(),
+			"audit":               g.audit.droppedCount(),
+			"source_filter":       g.filter.Load().droppedCount(),
+			"unconnected":         flood.OverPacketRate + flood.OverAddressRate,
+		}
+	}))
+	m.Set("unconnected", expvar.Func(func() interface{} {
+		return g.Flood()
+	}))
+	m.Set("source_rules", expvar.Func(func() interface{} {
+		if f := g.filter.Load(); f != nil {
+			return f.hits()
+		}
+		return []sourceRuleHits{}
+	}))
+	m.Set("refused", expvar.Func(func() interface{} {
+		return map[string]uint64{
+			"not_allowed":   g.NotAllowedConnects(),
+			"acl_denied":    g.ACLDenied(),
+			"authenticator": g.AuthRefused(),
+		}
+	}))
+	m.Set("latency", expvar.Func(func() interface{} {
+		return g.latency.snapshot()
+	}))
+	return m
+}
+
+// The aggregating gateway's variables, with the state of its
+// connection to each broker and what it holds while one is down
+func (ag *AGateway) vars() *expvar.Map {
+	m := ag.core.vars(ag.Listeners)
+	m.Set("brokers", expvar.Func(func() interface{} {
+		var brokers []map[string]interface{}
+		for _, s := range ag.BrokerStates() {
+			b := map[string]interface{}{
+				"upstream": s.Upstream,
+				"state":    s.State,
+				"since":    s.Since,
+			}
+			if s.LastError != nil {
+				b["last_error"] = s.LastError.Error()
+			}
+			brokers = append(brokers, b)
+		}
+		return brokers
+	}))
+	m.Set("broker", expvar.Func(func() interface{} {
+		return map[string]interface{}{
+			"degraded":            ag.Degraded(),
+			"reconnects":          ag.BrokerReconnects(),
+			"offline_queue":       ag.OfflineQueueDepth(),
+			"offline_queue_drops": ag.OfflineQueueDrops(),
+			"offline_rejects":     ag.OfflineConnectRejects(),
+			"echoes_suppressed":   ag.EchoesSuppressed(),
+		}
+	}))
+	m.Set("events", expvar.Func(func() interface{} {
+		published, dropped := ag.events.counts()
+		return map[string]uint64{
+			"published": published,
+			"dropped":   dropped,
+		}
+	}))
+	return m
+}
+
+// The transparent gateway's variables, with its connections to
+// the broker, one a client
+func (t *TGateway) vars() *expvar.Map {
+	m := t.core.vars(t.Listeners)
+	m.Set("broker", expvar.Func(func() interface{} {
+		return map[string]interface{}{
+			"connections": t.BrokerConnections(),
+		}
+	}))
+	return m
+}
@@ -0,0 +1,471 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// A client as the admin API lists it; the detail, its
+// subscriptions and topics, only when it is asked for alone
+type clientInfo struct {
+	Id          string             `json:"id"`
+	Address     string             `json:"address"`
+	Listener    string             `json:"listener"`
+	State       string             `json:"state"`
+	KeepAlive   string             `json:"keepalive"`
+	LastSeen    time.Time          `json:"last_seen"`
+	Queued      int                `json:"queued"`
+	QueuedBytes int                `json:"queued_bytes"`
+	Inflight    int                `json:"inflight"`
+	Oversized   uint64             `json:"oversized"`
+	QueueDrops  uint64             `json:"queue_drops"`
+	ACLDenials  uint64             `json:"acl_denials"`
+	Metadata    map[string]string  `json:"metadata,omitempty"`
+	RateLimit   *publishLimitInfo  `json:"rate_limit,omitempty"`
+	Subscribed  map[string]byte    `json:"subscriptions,omitempty"`
+	Registered  map[uint16]string  `json:"registered_topics,omitempty"`
+	RegisterRTT *histogramSnapshot `json:"register_rtt,omitempty"`
+}
+
+// A topic id the gateway has given, or one pre-defined
+type topicInfo struct {
+	Id         uint16 `json:"id"`
+	Name       string `json:"name"`
+	Predefined bool   `json:"predefined"`
+}
+
+// Whether packets are dumped, and whose
+type packetDumpInfo struct {
+	Enabled bool   `json:"enabled"`
+	Client  string `json:"client,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+func currentPacketDump() packetDumpInfo {
+	d := packetDumps.Load()
+	if d == nil {
+		return packetDumpInfo{}
+	}
+	return packetDumpInfo{true, d.clientId, d.address}
+}
+
+// Whether packets are captured, to which file and until when
+type captureInfo struct {
+	Active   bool       `json:"active"`
+	File     string     `json:"file,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+	Captured uint64     `json:"captured"`
+	Dropped  uint64     `json:"dropped"`
+}
+
+func currentCapture() captureInfo {
+	c := captures.Load()
+	if c == nil {
+		return captureInfo{}
+	}
+	info := captureInfo{Active: true, File: c.conf.path}
+	if !c.until.IsZero() {
+		info.Until = &c.until
+	}
+	info.Captured, info.Dropped = c.counts()
+	return info
+}
+
+// A message to publish to the clients as though from the broker
+type publishRequest struct {
+	Topic    string `json:"topic"`
+	Payload  string `json:"payload"`
+	Encoding string `json:"encoding"`
+	Qos      byte   `json:"qos"`
+	Retain   bool   `json:"retain"`
+}
+
+// A message the admin API publishes, the broker having sent
+// nothing
+type injectedMessage struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+func (m injectedMessage) Duplicate() bool   { return false }
+func (m injectedMessage) Qos() byte         { return m.qos }
+func (m injectedMessage) Retained() bool    { return m.retain }
+func (m injectedMessage) Topic() string     { return m.topic }
+func (m injectedMessage) MessageID() uint16 { return 0 }
+func (m injectedMessage) Payload() []byte   { return m.payload }
+
+func (c *Client) info(detail bool) clientInfo {
+	queued, queuedBytes, inflight := c.usage()
+	defer c.RUnlock()
+	c.RLock()
+	ci := clientInfo{
+		Id:          c.ClientId,
+		Address:     c.Address.String(),
+		Listener:    c.Conn.Listener(),
+		State:       stateNames[c.state],
+		KeepAlive:   c.keepAlive.String(),
+		LastSeen:    c.lastSeen,
+		Queued:      queued,
+		QueuedBytes: queuedBytes,
+		Inflight:    inflight,
+		Oversized:   c.oversized,
+		QueueDrops:  c.queueDrops,
+		ACLDenials:  c.aclDenials,
+	}
+	if c.publishLimit != nil {
+		ci.RateLimit = c.publishLimit.info(time.Now())
+	}
+	if detail {
+		ci.Subscribed = make(map[string]byte, len(c.subscriptions))
+		for filter, qos := range c.subscriptions {
+			ci.Subscribed[filter] = qos
+		}
+		if len(c.metadata) > 0 {
+			ci.Metadata = make(map[string]string, len(c.metadata))
+			for key, value := range c.metadata {
+				ci.Metadata[key] = value
+			}
+		}
+		ci.Registered = make(map[uint16]string, len(c.registeredTopics))
+		for id, topic := range c.registeredTopics {
+			ci.Registered[id] = topic
+		}
+		if c.registerRTT != nil {
+			rtt := c.registerRTT.snapshot()
+			ci.RegisterRTT = &rtt
+		}
+	}
+	return ci
+}
+
+// Serve what the gateway g knows of its clients and topics, and
+// the clients subscribed to each filter as subscriptions has
+// them, as JSON; and act on its clients, publishing to them with
+// publish as though the broker had:
+//
+//	GET /clients       every client
+//	GET /clients/{id}  one, with its subscriptions and topics
+//	POST /clients/{id}/disconnect?will=false&ban=10m
+//	                   disconnect it, without publishing its will
+//	                   and refusing its id and address for 10m
+//	GET /topics        the topic ids given and pre-defined
+//	GET /subscriptions the ids of the clients of each filter
+//	POST /publish      {"topic", "payload", "encoding", "qos",
+//	                   "retain"}, the payload utf8 or, given
+//	                   "encoding": "base64", base64; answering
+//	                   {"targeted"}, the number of clients it is for
+//	GET /debug/packets whether packets are dumped, and whose
+//	POST /debug/packets?enable=true&client=id&address=host
+//	                   dump them, of the client and address if
+//	                   given, or stop with enable=false
+//	GET /debug/capture whether packets are captured, and how many
+//	POST /debug/capture?enable=true&duration=1m
+//	                   capture them to capture-file, for a minute
+//	                   or until stopped with enable=false
+//	GET /debug/trace   the clients traced, and until when
+//	POST /debug/trace?client=id&enable=true&duration=30m
+//	                   trace the client, for 30m or as long as
+//	                   log-trace-duration has it, or stop with
+//	                   enable=false
+//	GET /audit?n=100   the latest entries of the audit file, 100
+//	                   or all of the last 1000 kept if not given
+//
+// Each is answered from snapshots, never holding up the
+// packets being handled.
+func (a *admin) serveAPI(g *core, subscriptions func() map[string][]string, publish func(MQTT.Message) int) {
+	a.mux.HandleFunc("/clients", get(func(w http.ResponseWriter, r *http.Request) {
+		clients := []clientInfo{}
+		g.clients.Range(func(sc SNClient) {
+			clients = append(clients, sc.base().info(false))
+		})
+		sort.Slice(clients, func(i, j int) bool {
+			return clients[i].Id < clients[j].Id
+		})
+		writeJSON(w, clients)
+	}))
+	a.mux.HandleFunc("/clients/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/clients/")
+		if id, ok := strings.CutSuffix(id, "/disconnect"); ok {
+			post(disconnect(g, id))(w, r)
+			return
+		}
+		get(func(w http.ResponseWriter, r *http.Request) {
+			client := g.clientById(id)
+			if client == nil {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, client.info(true))
+		})(w, r)
+	})
+	a.mux.HandleFunc("/topics", get(func(w http.ResponseWriter, r *http.Request) {
+		contents, predefined := g.tIndex.snapshot()
+		topics := []topicInfo{}
+		for id, name := range contents {
+			topics = append(topics, topicInfo{id, name, false})
+		}
+		for id, name := range predefined {
+			topics = append(topics, topicInfo{id, name, true})
+		}
+		sort.Slice(topics, func(i, j int) bool {
+			if topics[i].Predefined != topics[j].Predefined {
+				return topics[i].Predefined
+			}
+			return topics[i].Id < topics[j].Id
+		})
+		writeJSON(w, topics)
+	}))
+	a.mux.HandleFunc("/subscriptions", get(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, subscriptions())
+	}))
+	a.mux.HandleFunc("/debug/packets", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, currentPacketDump())
+		case http.MethodPost:
+			query := r.URL.Query()
+			switch query.Get("enable") {
+			case "true":
+				setPacketDump(newPacketDump(query.Get("client"), query.Get("address")))
+			case "false":
+				setPacketDump(nil)
+			default:
+				http.Error(w, "enable must be true or false", http.StatusBadRequest)
+				return
+			}
+			dump := currentPacketDump()
+			INFO.Log("packet dump set", adminLog, Field{"caller", r.RemoteAddr}, Field{"enabled", dump.Enabled}, logClientId(dump.Client), Field{"address", dump.Address})
+			g.audit.admin("packet-dump", r.RemoteAddr, dump.Client, map[string]interface{}{"enabled": dump.Enabled, "address": dump.Address})
+			writeJSON(w, dump)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	a.mux.HandleFunc("/debug/capture", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, currentCapture())
+		case http.MethodPost:
+			query := r.URL.Query()
+			switch query.Get("enable") {
+			case "true":
+				var d time.Duration
+				if value := query.Get("duration"); value != "" {
+					var err error
+					if d, err = time.ParseDuration(value); err != nil || d <= 0 {
+						http.Error(w, "invalid duration", http.StatusBadRequest)
+						return
+					}
+				}
+				conf := g.config.Load().captureConfig()
+				if conf.path == "" {
+					http.Error(w, "no capture-file configured", http.StatusConflict)
+					return
+				}
+				if err := startCapture(conf, d); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			case "false":
+				stopCapture()
+			default:
+				http.Error(w, "enable must be true or false", http.StatusBadRequest)
+				return
+			}
+			info := currentCapture()
+			INFO.Log("capture set", adminLog, Field{"caller", r.RemoteAddr}, Field{"active", info.Active}, Field{"duration", query.Get("duration")})
+			g.audit.admin("capture", r.RemoteAddr, "", map[string]interface{}{"active": info.Active, "duration": query.Get("duration")})
+			writeJSON(w, info)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	a.mux.HandleFunc("/debug/trace", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, traces.list())
+		case http.MethodPost:
+			query := r.URL.Query()
+			id := query.Get("client")
+			if id == "" {
+				http.Error(w, "client must be given", http.StatusBadRequest)
+				return
+			}
+			d := g.config.Load().traceDuration()
+			if value := query.Get("duration"); value != "" {
+				var err error
+				if d, err = time.ParseDuration(value); err != nil || d <= 0 {
+					http.Error(w, "invalid duration", http.StatusBadRequest)
+					return
+				}
+			}
+			var until time.Time
+			switch query.Get("enable") {
+			case "true":
+				until = traces.set(id, d)
+			case "false":
+				traces.clear(id)
+			default:
+				http.Error(w, "enable must be true or false", http.StatusBadRequest)
+				return
+			}
+			enabled := !until.IsZero()
+			INFO.Log("trace set", adminLog, Field{"caller", r.RemoteAddr}, logClientId(id), Field{"enabled", enabled}, Field{"duration", d.String()})
+			g.audit.admin("trace", r.RemoteAddr, id, map[string]interface{}{"enabled": enabled, "duration": d.String()})
+			writeJSON(w, traces.list())
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	a.mux.HandleFunc("/publish", post(func(w http.ResponseWriter, r *http.Request) {
+		var req publishRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := ValidateTopicName(req.Topic); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Qos > 2 {
+			http.Error(w, "invalid qos", http.StatusBadRequest)
+			return
+		}
+		payload := []byte(req.Payload)
+		switch req.Encoding {
+		case "", "utf8":
+		case "base64":
+			var err error
+			if payload, err = base64.StdEncoding.DecodeString(req.Payload); err != nil {
+				http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "invalid encoding", http.StatusBadRequest)
+			return
+		}
+		targeted := publish(injectedMessage{req.Topic, payload, req.Qos, req.Retain})
+		INFO.Log("message published", adminLog, logTopic(req.Topic), Field{"caller", r.RemoteAddr}, Field{"qos", req.Qos}, Field{"targeted", targeted})
+		g.audit.admin("publish", r.RemoteAddr, "", map[string]interface{}{"topic": req.Topic, "qos": req.Qos, "retain": req.Retain, "targeted": targeted})
+		writeJSON(w, map[string]int{"targeted": targeted})
+	}))
+	a.mux.HandleFunc("/audit", get(func(w http.ResponseWriter, r *http.Request) {
+		if g.audit == nil {
+			http.Error(w, "no audit-file configured", http.StatusConflict)
+			return
+		}
+		var n int
+		if value := r.URL.Query().Get("n"); value != "" {
+			var err error
+			if n, err = strconv.Atoi(value); err != nil || n <= 0 {
+				http.Error(w, "invalid n", http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, g.audit.tail(n))
+	}))
+}
+
+// Disconnect the client with id, publishing its will unless
+// will=false is given and banning it for ban if given, logging
+// who asked
+func disconnect(g *core, id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		will := query.Get("will") != "false"
+		var ban time.Duration
+		if value := query.Get("ban"); value != "" {
+			var err error
+			if ban, err = time.ParseDuration(value); err != nil || ban <= 0 {
+				http.Error(w, "invalid ban duration", http.StatusBadRequest)
+				return
+			}
+		}
+		if !g.kickById(id, will, ban) {
+			http.NotFound(w, r)
+			return
+		}
+		INFO.Log("client disconnected", adminLog, logClientId(id), Field{"caller", r.RemoteAddr}, Field{"will", will}, Field{"ban", ban.String()})
+		g.audit.admin("disconnect", r.RemoteAddr, id, map[string]interface{}{"will": will, "ban": ban.String()})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Answer GET requests with h, and refuse others
+func get(h http.HandlerFunc) http.HandlerFunc {
+	return only(http.MethodGet, h)
+}
+
+// Answer POST requests with h, and refuse others
+func post(h http.HandlerFunc) http.HandlerFunc {
+	return only(http.MethodPost, h)
+}
+
+func only(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// The client with id, nil if there is none
+func (g *core) clientById(id string) *Client {
+	var found *Client
+	g.clients.Range(func(sc SNClient) {
+		if c := sc.base(); found == nil && c.ClientId == id {
+			found = c
+		}
+	})
+	return found
+}
+
+// The ids of the clients subscribed to each filter, from the
+// gateway's subscription tree
+func (ag *AGateway) subscriptions() map[string][]string {
+	subs := make(map[string][]string)
+	ag.tTree.Walk(func(filter string, clients []*Client) {
+		for _, c := range clients {
+			subs[filter] = append(subs[filter], c.ClientId)
+		}
+	})
+	return subs
+}
+
+// The ids of the clients subscribed to each filter, each
+// through its own broker connection
+func (t *TGateway) subscriptions() map[string][]string {
+	subs := make(map[string][]string)
+	t.clients.Range(func(sc SNClient) {
+		c := sc.base()
+		for _, filter := range c.Filters() {
+			subs[filter] = append(subs[filter], c.ClientId)
+		}
+	})
+	for _, ids := range subs {
+		sort.Strings(ids)
+	}
+	return subs
+}
@@ -1,11 +1,11 @@
 package gateway
 
 import (
-	"bytes"
-	"log"
+	"context"
+	"crypto/tls"
 	"net"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
@@ -14,22 +14,147 @@ import (
 )
 
 type AGateway struct {
-	mqttclient *MQTT.Client
-	stopsig    chan os.Signal
-	port       int
-	tIndex     topicNames
-	tTree      *TopicTree
-	clients    Clients
-	handler    MQTT.MessageHandler
-}
-
-func NewAGateway(gc *GatewayConfig, stopsig chan os.Signal) *AGateway {
-	MQTT.WARN = log.New(os.Stdout, "", 0)
-	MQTT.DEBUG = log.New(os.Stdout, "", 0)
-	MQTT.CRITICAL = log.New(os.Stdout, "", 0)
-	MQTT.ERROR = log.New(os.Stdout, "", 0)
+	core
+	mqttclient       mqttClient
+	address          string
+	readers          int
+	maxMessageSize   int
+	tTree            *TopicTree
+	handler          MQTT.MessageHandler
+	disconnectOnStop bool
+	oversizePolicy   string
+	oversizeLogged   sync.Map // topic => struct{}
+	listener         *listener
+	hooks            Hooks
+	hookq            *hookQueue
+	events           *events
+	upstream         *upstream
+	status           *status
+	qos              *qosMap
+	prefix           topicPrefix
+	share            *sharing
+	routing          routing
+	tlsErr           error
+	relays           *brokerRelays
+	transports
+}
+
+func NewAGateway(gc *GatewayConfig) *AGateway {
+	MQTT.WARN = libraryLogger(1)
+	MQTT.DEBUG = libraryLogger(3)
+	MQTT.CRITICAL = libraryLogger(0)
+	MQTT.ERROR = libraryLogger(0)
+	st := gc.status()
+	var will *Will
+	if st != nil {
+		will = &Will{st.topic, []byte(st.offline), st.qos, true}
+	}
+	// a broker whose TLS settings cannot be read is reported by
+	// Start
+	tlsConfig, tlsErr := gc.brokerTLS().config()
+	if tlsErr != nil {
+		ERROR.Printf("broker TLS: %v\n", tlsErr)
+	}
+	relays := newBrokerRelays(gc, tlsConfig)
+	var ag *AGateway
+	distribute := func(msg MQTT.Message) {
+		ag.distribute(msg)
+	}
+	client := newBrokerClient(gc, gc.mqttbroker, will, tlsConfig, relays, func(err error) {
+		ag.brokerLost(err)
+	}, distribute)
+	ag = &AGateway{
+		newCore(),
+		client,
+		gc.listenAddress(),
+		gc.udpreaders,
+		gc.maxMessageSize(),
+		NewTopicTree(),
+		nil,
+		gc.disconnectonstop,
+		gc.oversizePolicy(),
+		sync.Map{},
+		nil,
+		Hooks{},
+		newHookQueue(),
+		newEvents(gc),
+		newUpstream(gc),
+		st,
+		gc.qosMap(),
+		topicPrefix(gc.topicprefix),
+		gc.sharing(),
+		routing{},
+		tlsErr,
+		relays,
+		newTransports(gc),
+	}
+	ag.routing = newRouting(gc, ag.upstream, func(u *upstream, broker string) mqttClient {
+		return newBrokerClient(gc, broker, nil, tlsConfig, relays, func(err error) {
+			ag.upstreamLost(u, err)
+		}, distribute)
+	})
+	ag.backend = ag
+	ag.config.Store(gc)
+	if ag.events != nil {
+		ag.events.publish = func(payload []byte) {
+			ag.mqttclient.Publish(ag.events.topic, ag.events.qos, false, payload)
+		}
+	}
+	ag.audit = newAudit(gc)
+	ag.hooks = ag.ownHooks()
+	ag.discovery = newDiscovery(gc)
+	ag.sys = newSysTopics(gc)
+	ag.admin = newAdmin(gc.adminaddress, gc.admintoken)
+	ag.admin.publishVars(ag.vars())
+	ag.admin.serveAPI(&ag.core, ag.subscriptions, ag.distribute)
+	ag.admin.serveHealth(&ag.core, ag.notReady)
+	if gc.adminpprof {
+		ag.admin.servePprof(gc.adminpprofmutex, gc.adminpprofblock)
+	}
+	ag.sources.Store(newSourceLimiter(gc))
+	ag.filter.Store(newSourceFilter(gc))
+	ag.flood.Store(newFloodGuard(gc))
+	ag.tIndex.addPredefined(gc.predefined)
+	ag.faults = gc.faults()
+	ag.timers = gc.protocolTimers()
+	ag.latency.registerRTT = gc.latencyregisterrtt
+	ag.setLimits(gc)
+	ag.echoes = newEchoes(gc.echoPolicy())
+	if gc.upstreaminflight > 1 {
+		ag.window = newPublishWindow(gc.upstreaminflight, gc.upstreamqueue, ag.issue)
+	}
+
+	ag.handler = func(client *MQTT.Client, msg MQTT.Message) {
+		ag.distribute(msg)
+	}
+
+	return ag
+}
+
+// A client for the aggregating gateway's connection to broker,
+// with will if not nil, calling lost when the connection is lost
+// and distribute with what the broker sends. A v3 client reaches
+// a websocket broker with headers through relays.
+func newBrokerClient(gc *GatewayConfig, broker string, will *Will, tlsConfig *tls.Config, relays *brokerRelays, lost func(error), distribute func(MQTT.Message)) mqttClient {
+	if m5 := gc.mqtt5(); m5 != nil {
+		return newMQTT5Client(mqtt5Options{
+			mqtt5Config:    m5,
+			broker:         broker,
+			clientID:       gc.mqttclientid,
+			username:       gc.mqttuser,
+			password:       gc.mqttpassword,
+			cleanSession:   !gc.mqttsession,
+			keepAlive:      gc.brokerKeepAlive(),
+			connectTimeout: gc.brokerConnectTimeout(),
+			will:           will,
+			tlsConfig:      tlsConfig,
+			headers:        gc.mqttheaders,
+			noLocal:        gc.echoPolicy() == echoDrop,
+			lost:           lost,
+		})
+	}
 	opts := MQTT.NewClientOptions()
-	opts.AddBroker(gc.mqttbroker)
+	opts.AddBroker(relays.url(broker))
 	if gc.mqttuser != "" {
 		opts.SetUsername(gc.mqttuser)
 	}
@@ -39,399 +164,664 @@ func NewAGateway(gc *GatewayConfig, stopsig chan os.Signal) *AGateway {
 	if gc.mqttclientid != "" {
 		opts.SetClientID(gc.mqttclientid)
 	}
-	if gc.mqtttimeout > 0 {
-		opts.SetKeepAlive(time.Duration(gc.mqtttimeout))
+	opts.SetKeepAlive(gc.brokerKeepAlive())
+	if gc.mqttversion > 0 && gc.mqttversion < 5 {
+		opts.SetProtocolVersion(uint(gc.mqttversion))
 	}
-	client := MQTT.NewClient(opts)
-	ag := &AGateway{
-		client,
-		stopsig,
-		gc.port,
-		topicNames{
-			sync.RWMutex{},
-			make(map[uint16]string),
-			0,
-		},
-		NewTopicTree(),
-		Clients{
-			sync.RWMutex{},
-			make(map[string]SNClient),
-		},
-		nil,
+	opts.SetCleanSession(!gc.mqttsession)
+	if will != nil {
+		opts.SetBinaryWill(will.Topic, will.Data, will.Qos, will.Retain)
 	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	opts.SetConnectionLostHandler(func(c *MQTT.Client, err error) {
+		lost(err)
+	})
+	if gc.sharing() != nil {
+		// messages for a shared subscription do not match its
+		// filter, so are left to the default handler
+		opts.SetDefaultPublishHandler(func(c *MQTT.Client, msg MQTT.Message) {
+			distribute(msg)
+		})
+	}
+	return MQTT.NewClient(opts)
+}
 
-	ag.handler = func(client *MQTT.Client, msg MQTT.Message) {
-		ag.distribute(msg)
+// Set the callbacks for gateway events, called before the
+// gateway's own publishing the clients' events to events-topic
+// and recording them in the audit file. Must be called before
+// Start.
+func (ag *AGateway) SetHooks(h Hooks) {
+	ag.hooks = h.and(ag.ownHooks())
+}
+
+// The gateway's own hooks, publishing the clients' events and
+// recording their sessions in the audit file
+func (ag *AGateway) ownHooks() Hooks {
+	return ag.events.hooks().and(ag.audit.hooks())
+}
+
+// Read client-allow-file, acl-file, auth-registry-file, and the
+// DTLS keys and certificates, again; none are used unless all can
+// be read. Clients already connected keep the sessions they have,
+// their subscriptions among them.
+func (ag *AGateway) Reload() error {
+	return ag.reloadFiles(ag.readFiles)
+}
+
+// Read the files gc names and the DTLS keys and certificates,
+// returning what puts them to use
+func (ag *AGateway) readFiles(gc *GatewayConfig) (func(), error) {
+	apply, err := ag.core.readFiles(gc)
+	if err != nil {
+		return nil, err
 	}
+	dtls, err := ag.transports.read()
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		apply()
+		dtls()
+	}, nil
+}
 
-	return ag
+// Reload, and apply the options of gc, the gateway's
+// configuration read again, that can be changed while it runs,
+// logging the changes to the rest
+func (ag *AGateway) ReloadConfig(gc *GatewayConfig) error {
+	return ag.reloadConfig(gc, ag.readFiles)
+}
+
+// Serve the clients of t as well, until the gateway stops.
+// Must be called after Start.
+func (ag *AGateway) Serve(t Transport) {
+	ag.transports.serve(t, ag)
+}
+
+// The address the gateway listens on; once started, the
+// address it is bound to
+func (ag *AGateway) Addr() string {
+	if l := ag.listener; l != nil {
+		return l.String()
+	}
+	return ag.address
+}
+
+// What each listener has handled
+func (ag *AGateway) Listeners() []ListenerStats {
+	return listenerStats(&ag.core, ag.listener, &ag.transports)
 }
 
+// The addresses the gateway is bound to once started, the UDP
+// listener's first, with the ports the system chose for any
+// configured as 0. Start returns only once they are all bound,
+// so clients can connect to them at once.
+func (ag *AGateway) Addrs() []net.Addr {
+	return listenerAddrs(ag.listener, &ag.transports)
+}
+
+// The UDP port the gateway listens on; once started, the port
+// it is bound to, which the system chose if configured as 0
 func (ag *AGateway) Port() int {
-	return ag.port
+	if l := ag.listener; l != nil {
+		return l.port()
+	}
+	return addrPort(ag.address)
 }
 
-func (ag *AGateway) Start() {
-	go ag.awaitStop()
+// Connect to the broker and start listening for MQTT-SN
+// clients. Start returns once the gateway is serving.
+func (ag *AGateway) Start() error {
 	INFO.Println("Aggregating Gateway is starting")
-	if token := ag.mqttclient.Connect(); token.Wait() && token.Error() != nil {
-		ERROR.Println(token.Error())
-		return
+	if ag.tlsErr != nil {
+		return ag.tlsErr
+	}
+	gc := ag.config.Load()
+	if err := ag.loadAllowlist(gc); err != nil {
+		return err
+	}
+	if err := ag.loadACL(gc); err != nil {
+		return err
+	}
+	if err := ag.loadRegistry(gc); err != nil {
+		return err
+	}
+	if err := ag.audit.start(); err != nil {
+		return err
 	}
+	for i, u := range ag.upstreams() {
+		if err := ag.connectUpstream(u); err != nil {
+			ag.disconnectUpstreams(ag.upstreams()[:i])
+			ag.audit.stop()
+			return err
+		}
+	}
+	ag.publishSaved()
+	l, err := listen(ag.address, ag.readers, ag.maxMessageSize, ag.faults, ag)
+	if err != nil {
+		ag.disconnectUpstreams(ag.upstreams())
+		ag.audit.stop()
+		return err
+	}
+	l.counters.setOutbound(ag.transports.outbound)
+	if err := ag.transports.start(ag); err != nil {
+		l.stop(context.Background())
+		ag.disconnectUpstreams(ag.upstreams())
+		ag.audit.stop()
+		return err
+	}
+	if err := ag.admin.start(); err != nil {
+		ag.transports.stop(context.Background())
+		l.stop(context.Background())
+		ag.disconnectUpstreams(ag.upstreams())
+		ag.audit.stop()
+		return err
+	}
+	if err := ag.discovery.start(); err != nil {
+		// clients can still be told where the gateway is
+		ERROR.Println(err)
+	}
+	ag.startCapture()
+	ag.listener = l
+	for _, u := range ag.upstreams() {
+		u.start()
+	}
+	if ag.window != nil {
+		// what clients published meanwhile is queued
+		ag.window.start()
+	}
+	ag.hookq.start()
+	ag.sys.start(ag.sysStats(), ag.deliver)
+	ag.announce(true)
+	ag.setLife(lifeServing)
 	INFO.Println("Aggregating Gateway is started")
-	listen(ag)
+	return nil
+}
+
+// Optionally send a DISCONNECT to every client, stop listening,
+// wait for the packets being handled (or for ctx to be done),
+// forget all clients and disconnect from the broker. The gateway
+// may be started again afterwards.
+func (ag *AGateway) Stop(ctx context.Context) error {
+	return ag.stop(ctx, ag.disconnectOnStop)
 }
 
-// This does NOT WORK on Windows using Cygwin, however
-// it does work using cmd.exe
-func (ag *AGateway) awaitStop() {
-	<-ag.stopsig
+func (ag *AGateway) stop(ctx context.Context, disconnect bool) error {
 	INFO.Println("Aggregating Gateway is stopping")
-	ag.mqttclient.Disconnect(500)
-	time.Sleep(500) //give broker some time to process DISCONNECT
+	ag.setLife(lifeStopping)
+	if disconnect {
+		ag.clients.Range(func(c SNClient) {
+			if err := c.(*Client).Write(NewMessage(DISCONNECT)); err != nil {
+				ERROR.Println(err)
+			}
+		})
+	}
+	ag.discovery.stop()
+	ag.sys.stop()
+	var err error
+	if ag.listener != nil {
+		err = ag.listener.stop(ctx)
+		ag.listener = nil
+	}
+	if terr := ag.transports.stop(ctx); err == nil {
+		err = terr
+	}
+	// what is held is answered before the window waits for it
+	for _, u := range ag.upstreams() {
+		u.stop()
+	}
+	if ag.window != nil {
+		ag.window.stop()
+	}
+	ag.clients.Range(func(c SNClient) {
+		client := c.(*Client)
+		client.Close()
+		ag.disconnected(client, DisconnectStopped)
+	})
+	ag.clients.Clear()
+	ag.tTree = NewTopicTree()
+	for _, u := range ag.upstreams() {
+		session := u.takeSession()
+		if !ag.brokerOf(u).IsConnected() {
+			continue
+		}
+		if u.keepSession {
+			// the clients are forgotten, so the broker need not
+			// keep what matches their subscriptions
+			var filters []string
+			for filter := range session {
+				filters = append(filters, filter)
+			}
+			ag.unsubscribeBroker(u, filters)
+		}
+		if u == ag.upstream {
+			// a clean disconnect discards the will
+			ag.announce(false)
+		}
+	}
+	ag.disconnectUpstreams(ag.upstreams())
+	ag.relays.close()
+	ag.hookq.stop()
+	// after the hooks, which record the clients' disconnects
+	ag.audit.stop()
+	stopCapture()
+	// the health checks answer until the end
+	if aerr := ag.admin.stop(ctx); err == nil {
+		err = aerr
+	}
+	ag.setLife(lifeStopped)
 	INFO.Println("Aggregating Gateway is stopped")
+	return err
+}
+
+// Stop accepting new clients, answering their CONNECTs with
+// congestion, while serving the existing ones until they have
+// all disconnected or deadline has passed. Then send a DISCONNECT
+// to any that remain and stop the gateway.
+func (ag *AGateway) Drain(deadline time.Duration) error {
+	INFO.Printf("Aggregating Gateway is draining %d clients\n", ag.clients.Len())
+	ag.setLife(lifeDraining)
+	expired := time.After(deadline)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for ag.clients.Len() > 0 {
+		select {
+		case <-expired:
+			INFO.Printf("drain deadline passed with %d clients connected\n", ag.clients.Len())
+			return ag.stop(context.Background(), true)
+		case <-ticker.C:
+		}
+	}
+	return ag.stop(context.Background(), false)
+}
+
+// Whether the gateway is draining, for health checks
+func (ag *AGateway) Draining() bool {
+	return atomic.LoadInt32(&ag.life) == lifeDraining
+}
 
-	// TODO: cleanly close down other goroutines
+// What to do with a message from the broker too large for some
+// of the clients it is for; it is never cut short
+const (
+	oversizeFit  = "fit"  // deliver it to those it fits
+	oversizeDrop = "drop" // deliver it to none of them
+)
 
-	os.Exit(0)
+// Publish msg from the broker to the clients subscribed to it,
+// returning how many it is for
+func (ag *AGateway) distribute(msg MQTT.Message) int {
+	arrived := time.Now()
+	topic, ok := ag.prefix.downstream(msg.Topic())
+	if !ok {
+		ERROR.Log("message outside the topic prefix", aggregatingLog, logTopic(msg.Topic()))
+		return 0
+	}
+	publisher, echo := ag.echoes.echo(topic, msg.Payload())
+	if echo && ag.echoes.policy == echoDrop {
+		DEBUG.Log("dropping the echo of a message", aggregatingLog, logTopic(topic))
+		return 0
+	}
+	if ag.downTransform != nil {
+		t, payload, err := ag.transform(ag.downTransform, topic, msg.Payload())
+		if err != nil {
+			ERROR.Log("dropping a message: "+err.Error(), aggregatingLog, logTopic(topic))
+			return 0
+		}
+		msg = rewrittenMessage{msg, t, payload}
+	} else if topic != msg.Topic() {
+		msg = rewrittenMessage{msg, topic, msg.Payload()}
+	}
+	if !echo {
+		publisher = nil
+	}
+	n := ag.publishAll(msg, publisher)
+	ag.latency.distribute.observe(time.Since(arrived))
+	return n
+}
+
+// Publish msg to the clients subscribed to it, as though from
+// the broker, returning how many it is for
+func (ag *AGateway) deliver(msg MQTT.Message) int {
+	return ag.publishAll(msg, nil)
 }
 
-func (ag *AGateway) distribute(msg MQTT.Message) {
+// Publish msg to the clients subscribed to it but publisher, if
+// given, returning how many it is for
+func (ag *AGateway) publishAll(msg MQTT.Message, publisher *Client) int {
 	topic := msg.Topic()
-	INFO.Printf("AG distributing a msg for topic \"%s\"\n", topic)
+	DEBUG.Log("distributing", aggregatingLog, logTopic(topic))
 
 	// collect a list of clients to which msg should be
 	// published
 	// then publish msg to those clients (async)
 
 	if clients, e := ag.tTree.SubscribersOf(topic); e != nil {
-		ERROR.Println(e)
+		ERROR.Log(e.Error(), aggregatingLog, logTopic(topic))
+		return 0
 	} else {
+		// publish synchronously so that each client sees
+		// messages in the order the broker sent them, and
+		// only once however many of its subscriptions match
+		seen := make(map[*Client]bool)
+		if publisher != nil {
+			// what the client published itself
+			seen[publisher] = true
+		}
+		var subscribers []*Client
 		for _, client := range clients {
-			go ag.publish(msg, client)
+			if !seen[client] {
+				seen[client] = true
+				subscribers = append(subscribers, client)
+			}
 		}
-	}
-}
-
-func (ag *AGateway) publish(msg MQTT.Message, client *Client) {
-	INFO.Printf("publish to client \"%s\"... ", client.ClientId)
-	topicid := ag.tIndex.getId(msg.Topic())
-	// topicidtype := byte(0x00) // todo: pre-defined (1) and shortname (2)
-	// msgid := uint16(0x00) // todo: what should this be??
-	pm := NewPublishMessage(topicid, 0x00, msg.Payload(), msg.Qos(), 0x00, msg.Retained(), msg.Duplicate())
-
-	if client.Registered(topicid) {
-		INFO.Printf("client \"%s\" already registered to %d, publish ahoy!\n", client, topicid)
-		if err := client.Write(pm); err != nil {
-			ERROR.Println(err)
-		} else {
-			INFO.Printf("published a message to \"%s\"\n", client)
+		if ag.oversizePolicy == oversizeDrop && !ag.fitsAll(msg, subscribers) {
+			return 0
 		}
-	} else {
-		INFO.Printf("client \"%s\" is not registered to %d, must REGISTER first\n", client, topicid)
-		rm := NewRegisterMessage(topicid, 0x00, []byte(msg.Topic()))
-		client.AddPendingMessage(pm)
-		if err := client.Write(rm); err != nil {
-			ERROR.Printf("error writing REGISTER to \"%s\"\n", client)
-		} else {
-			INFO.Printf("sent REGISTER to \"%s\" for %d (%d bytes)\n", client, topicid, rm.Length)
+		for _, client := range subscribers {
+			ag.publish(msg, client)
 		}
+		return len(subscribers)
 	}
 }
 
-func (ag *AGateway) OnPacket(nbytes int, buffer []byte, con *net.UDPConn, addr *net.UDPAddr) {
-	INFO.Printf("OnPacket!  - bytes: %s\n", string(buffer[0:nbytes]))
-
-	buf := bytes.NewBuffer(buffer)
-	rawmsg, _ := ReadPacket(buf)
-	INFO.Printf("rawmsg.MessageType(): %s\n", rawmsg.MessageType())
-
-	switch msg := rawmsg.(type) {
-	case *AdvertiseMessage:
-		ag.handle_ADVERTISE(msg, addr)
-	case *SearchGwMessage:
-		ag.handle_SEARCHGW(msg, addr)
-	case *GwInfoMessage:
-		ag.handle_GWINFO(msg, addr)
-	case *ConnectMessage:
-		ag.handle_CONNECT(msg, con, addr)
-	case *ConnackMessage:
-		ag.handle_CONNACK(msg, addr)
-	case *WillTopicReqMessage:
-		ag.handle_WILLTOPICREQ(msg, addr)
-	case *WillTopicMessage:
-		ag.handle_WILLTOPIC(msg, addr)
-	case *WillMsgReqMessage:
-		ag.handle_WILLMSGREQ(msg, addr)
-	case *WillMsgMessage:
-		ag.handle_WILLMSG(msg, addr)
-	case *RegisterMessage:
-		ag.handle_REGISTER(msg, con, addr)
-	case *RegackMessage:
-		ag.handle_REGACK(msg, addr)
-	case *PublishMessage:
-		ag.handle_PUBLISH(msg, addr)
-	case *PubackMessage:
-		ag.handle_PUBACK(msg, addr)
-	case *PubcompMessage:
-		ag.handle_PUBCOMP(msg, addr)
-	case *PubrecMessage:
-		ag.handle_PUBREC(msg, addr)
-	case *PubrelMessage:
-		ag.handle_PUBREL(msg, addr)
-	case *SubscribeMessage:
-		ag.handle_SUBSCRIBE(msg, con, addr)
-	case *SubackMessage:
-		ag.handle_SUBACK(msg, addr)
-	case *UnsubscribeMessage:
-		ag.handle_UNSUBSCRIBE(msg, addr)
-	case *UnsubackMessage:
-		ag.handle_UNSUBACK(msg, addr)
-	case *PingreqMessage:
-		ag.handle_PINGREQ(msg, con, addr)
-	case *PingrespMessage:
-		ag.handle_PINGRESP(msg, addr)
-	case *DisconnectMessage:
-		ag.handle_DISCONNECT(msg, addr)
-	case *WillTopicUpdateMessage:
-		ag.handle_WILLTOPICUPD(msg, addr)
-	case *WillTopicRespMessage:
-		ag.handle_WILLTOPICRESP(msg, addr)
-	case *WillMsgUpdateMessage:
-		ag.handle_WILLMSGUPD(msg, addr)
-	case *WillMsgRespMessage:
-		ag.handle_WILLMSGRESP(msg, addr)
-	default:
-		ERROR.Printf("Unknown Message Type %T\n", msg)
-	}
-}
-
-func (ag *AGateway) handle_ADVERTISE(m *AdvertiseMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-}
-
-func (ag *AGateway) handle_SEARCHGW(m *SearchGwMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-}
-
-func (ag *AGateway) handle_GWINFO(m *GwInfoMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-}
-
-func (ag *AGateway) handle_CONNECT(m *ConnectMessage, c *net.UDPConn, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-
-	if clientid, e := validateClientId(m.ClientId); e != nil {
-		ERROR.Println(e)
-	} else {
-		INFO.Printf("clientid: %s\n", clientid)
-		INFO.Printf("remoteaddr: %s\n", r)
-		INFO.Printf("will: %v\n", m.Will)
-
-		if m.Will {
-			// todo: do something about that
-		}
-
-		client := NewClient(clientid, c, r)
-		ag.clients.AddClient(client)
-
-		ca := NewMessage(CONNACK).(*ConnackMessage) // todo: 0 ?
-		ca.ReturnCode = 0
-		if ioerr := client.Write(ca); ioerr != nil {
-			ERROR.Println(ioerr)
-		} else {
-			INFO.Println("CONNACK was sent")
+// Whether msg fits every one of clients; if not, it is counted
+// as dropped for all of them
+func (ag *AGateway) fitsAll(msg MQTT.Message, clients []*Client) bool {
+	for _, client := range clients {
+		if !client.Fits(ag.publishMessage(msg, client)) {
+			ag.logOversized(msg.Topic(), client)
+			for _, c := range clients {
+				c.DropOversized()
+			}
+			return false
 		}
 	}
+	return true
 }
 
-func (ag *AGateway) handle_CONNACK(m *ConnackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-}
-
-func (ag *AGateway) handle_WILLTOPICREQ(m *WillTopicReqMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-}
-
-func (ag *AGateway) handle_WILLTOPIC(m *WillTopicMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) publish(msg MQTT.Message, client *Client) {
+	DEBUG.Log("publishing", aggregatingLog, logClient(client), logTopic(msg.Topic()))
+	pm := ag.publishMessage(msg, client)
+	if pm.TopicId == 0 {
+		ERROR.Log("no topic id left, PUBLISH dropped", aggregatingLog, logClient(client), logTopic(msg.Topic()))
+		return
+	}
+	if !client.Fits(pm) {
+		ag.logOversized(msg.Topic(), client)
+		client.DropOversized()
+		return
+	}
+	client.Deliver(pm, msg.Topic())
 }
 
-func (ag *AGateway) handle_WILLMSGREQ(m *WillMsgReqMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+// The PUBLISH of msg for client
+func (ag *AGateway) publishMessage(msg MQTT.Message, client *Client) *PublishMessage {
+	topicid, topicidtype := ag.tIndex.publishId(msg.Topic())
+	qos := msg.Qos()
+	if granted := client.GrantedQos(msg.Topic()); granted < qos {
+		qos = granted
+	}
+	return NewPublishMessage(topicid, topicidtype, msg.Payload(), qos, 0x00, msg.Retained(), msg.Duplicate())
 }
 
-func (ag *AGateway) handle_WILLMSG(m *WillMsgMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+// Log a message on topic dropped for being too large for client,
+// only the first on the topic, as a topic's messages are mostly
+// alike and a busy one would flood the log
+func (ag *AGateway) logOversized(topic string, client *Client) {
+	if _, logged := ag.oversizeLogged.LoadOrStore(topic, struct{}{}); !logged {
+		ERROR.Log("PUBLISH too large, dropped, as later ones too large will be without logging", aggregatingLog, logClient(client), logTopic(topic))
+	}
 }
 
-func (ag *AGateway) handle_REGISTER(m *RegisterMessage, c *net.UDPConn, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-	topic := string(m.TopicName)
-	INFO.Printf("msg id: %d\n", m.MessageId)
-	INFO.Printf("topic name: %s\n", topic)
-
-	var topicid uint16
-	if !ag.tIndex.containsTopic(topic) {
-		topicid = ag.tIndex.putTopic(topic)
-	} else {
-		topicid = ag.tIndex.getId(topic)
+func (ag *AGateway) handle_CONNECT(m *ConnectMessage, c uConn, r uAddr) {
+	clientid, e := validateConnect(m)
+	DEBUG.Log("received", aggregatingLog, logMsgType(m.MessageType()), logClientId(clientid), logRemote(r), Field{"will", m.Will})
+	if e == nil && ag.Draining() && ag.clients.GetClient(r) == nil {
+		ERROR.Log("draining, not accepting new clients", aggregatingLog, logClientId(clientid), logRemote(r))
+		e = ErrDraining
+	}
+	if e == nil && ag.clients.GetClient(r) == nil {
+		if e = ag.upstream.admit(); e != nil {
+			ERROR.Log("broker unreachable, not accepting new clients", aggregatingLog, logClientId(clientid), logRemote(r))
+		}
+	}
+	if e == nil && ag.tooManyClients(r) {
+		e = ErrTooManyClients
+	}
+	var metadata map[string]string
+	if e == nil {
+		metadata, e = ag.authenticate(clientid, c, r)
+	}
+	if e != nil {
+		ERROR.Log(e.Error(), aggregatingLog, logClientId(clientid), logRemote(r))
+		sendConnack(c, r, connackCode(e))
+		return
 	}
 
-	client := ag.clients.GetClient(r).(*Client)
-	client.Register(topicid, topic)
-
-	INFO.Printf("ag topicid: %d\n", topicid)
-
-	ra := NewRegackMessage(topicid, m.MessageId, 0)
-	INFO.Printf("ra.MsgId: %d\n", ra.MessageId)
-
-	if err := client.Write(ra); err != nil {
-		ERROR.Println(err)
-	} else {
-		INFO.Println("REGACK sent")
+	if old := ag.clients.GetClient(r); old != nil {
+		// a new session replaces the old one, its subscriptions
+		// and retransmissions with it
+		ag.disconnect(old, DisconnectReplaced)
 	}
-}
+	client := NewClient(clientid, c, r)
+	client.setMetadata(metadata)
+	ag.configureClient(client)
+	if ag.hooks.OnDeliver != nil {
+		client.onDeliver = func(client *Client, topic string) {
+			ag.hookq.push(func() { ag.hooks.OnDeliver(client, topic) })
+		}
+	}
+	client.onUnreachable = func() {
+		if ag.clients.GetClient(client.Address) == SNClient(client) {
+			ag.lost(client)
+		}
+	}
+	ag.clients.AddClient(client)
 
-func (ag *AGateway) handle_REGACK(m *RegackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-	// the gateway sends a register when there is a message
-	// that needs to be published, so we do that now
-	topicid := m.TopicId
-	client := ag.clients.GetClient(r).(*Client)
-	pm := client.FetchPendingMessage(topicid)
-	if pm == nil {
-		ERROR.Printf("no pending message for %s id %d\n", client, topicid)
-	} else {
-		if err := client.Write(pm); err != nil {
-			ERROR.Println(err)
+	if m.Will {
+		// the CONNACK is sent once the will exchange completes
+		client.SetState(CONNECTING)
+		if ioerr := client.Write(NewMessage(WILLTOPICREQ)); ioerr != nil {
+			ERROR.Log(ioerr.Error(), aggregatingLog, logClient(client))
 		} else {
-			INFO.Printf("published a pending message to \"%s\"\n", client)
+			DEBUG.Log("sent", aggregatingLog, logMsgType(WILLTOPICREQ), logClient(client))
 		}
+		return
+	}
+	ag.connack(client)
+}
+
+// Accept the client's CONNECT, unless the OnConnect hook
+// refuses it
+func (ag *AGateway) connack(client *Client) {
+	if ag.hooks.OnConnect != nil {
+		if err := ag.hooks.OnConnect(client); err != nil {
+			ERROR.Log("refused: "+err.Error(), aggregatingLog, logClient(client), logRemote(client.Address))
+			ag.clients.RemoveClient(client.Address)
+			sendConnack(client.Conn, client.Address, connackCode(err))
+			return
+		}
+	}
+	client.SetState(ACTIVE)
+	ca := NewMessage(CONNACK).(*ConnackMessage)
+	ca.ReturnCode = ACCEPTED
+	if ioerr := client.Write(ca); ioerr != nil {
+		ERROR.Log(ioerr.Error(), aggregatingLog, logClient(client))
+	} else {
+		DEBUG.Log("sent", aggregatingLog, logMsgType(CONNACK), logClient(client))
+	}
+	if ag.hooks.OnConnected != nil {
+		ag.hookq.push(func() { ag.hooks.OnConnected(client) })
 	}
 }
 
-func (ag *AGateway) handle_PUBLISH(m *PublishMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-
-	INFO.Printf("m.TopicId: %d\n", m.TopicId)
-	INFO.Printf("m.Data: %s\n", string(m.Data))
-
-	topic := ag.tIndex.getTopic(m.TopicId)
-
-	// TODO: what should the MQTT-QoS be set as? In case of MQTTSN-QoS -1 ?
-	if token := ag.mqttclient.Publish(topic, m.Qos, m.Retain, m.Data); token.WaitTimeout(2000) && token.Error() != nil {
-		ERROR.Println("Error publishing message", token.Error())
-	}
-	INFO.Println("Message Published")
+func (ag *AGateway) accept(sc SNClient) {
+	ag.connack(sc.base())
 }
 
-func (ag *AGateway) handle_PUBACK(m *PubackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+// Publish m for the client, or hold it if the broker is
+// unreachable and there is room to
+func (ag *AGateway) publishUpstream(sc SNClient, topic string, m *PublishMessage) error {
+	wait, _ := ag.issue(topic, m)
+	return wait()
 }
 
-func (ag *AGateway) handle_PUBCOMP(m *PubcompMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) publishConnectionless(topic string, m *PublishMessage) error {
+	wait, _ := ag.issue(topic, m)
+	return wait()
 }
 
-func (ag *AGateway) handle_PUBREC(m *PubrecMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+// Send m to the broker topic is routed to, or hold it, returning
+// what waits for the outcome and whether m is in flight rather
+// than held
+func (ag *AGateway) issue(topic string, m *PublishMessage) (func() error, bool) {
+	if wait, held := ag.upstreamOf(topic).hold(topic, m); held {
+		return wait, false
+	}
+	return ag.issueBroker(topic, m), true
 }
 
-func (ag *AGateway) handle_PUBREL(m *PubrelMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) publishBroker(topic string, m *PublishMessage) error {
+	return ag.issueBroker(topic, m)()
 }
 
-func (ag *AGateway) handle_SUBSCRIBE(m *SubscribeMessage, c *net.UDPConn, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-	INFO.Printf("m.TopicIdType: %d\n", m.TopicIdType)
-	topic := string(m.TopicName)
-	var topicid uint16
-	if m.TopicIdType == 0 {
-		INFO.Printf("m.TopicName: %s\n", topic)
-		if !ContainsWildcard(topic) {
-			topicid = ag.tIndex.getId(topic)
-			if topicid == 0 {
-				topicid = ag.tIndex.putTopic(topic)
-			}
-		} else {
-			// todo: if topic contains wildcard, something about REGISTER
-			// at a later time, but send topic id 0x0000 for now
+func (ag *AGateway) issueBroker(topic string, m *PublishMessage) func() error {
+	u := ag.upstreamOf(topic)
+	sent := time.Now()
+	token := ag.brokerOf(u).Publish(ag.prefix.upstream(topic), ag.qos.upstream(topic, m.Qos), m.Retain, m.Data)
+	return func() error {
+		if !token.WaitTimeout(u.publishTimeout) {
+			return ErrPublishTimeout
 		}
-	} // todo: other topic id types
-
-	client := ag.clients.GetClient(r).(*Client)
-	if first, err := ag.tTree.AddSubscription(client, topic); err != nil {
-		INFO.Println("error adding subscription: %v\n", err)
-		// todo: suback an error message?
-	} else {
-		if first {
-			INFO.Println("first subscriber of subscription, subscribbing via MQTT")
-			if token := ag.mqttclient.Subscribe(topic, 2, ag.handler); token.WaitTimeout(2000) && token.Error() != nil {
-				ERROR.Println("Error subscribing,", token.Error())
-			}
+		ag.latency.upstream.observe(time.Since(sent))
+		if token.Error() != nil {
+			return token.Error()
 		}
-		// AG is subscribed at this point
-		client.Register(topicid, topic)
-		suba := NewSubackMessage(topicid, m.MessageId, m.Qos, 0)
-		var buf bytes.Buffer
-		suba.Write(&buf)
-		if nbytes, err := c.WriteToUDP(buf.Bytes(), r); err != nil {
-			ERROR.Println(err)
-		} else {
-			INFO.Printf("SUBACK sent %d bytes\n", nbytes)
+		if ag.hooks.OnPublishUpstream != nil {
+			ag.hookq.push(func() { ag.hooks.OnPublishUpstream(topic, m.Data) })
 		}
+		return nil
 	}
 }
 
-func (ag *AGateway) handle_SUBACK(m *SubackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+// The gateway subscribes to each filter once, for all of its
+// subscribers
+func (ag *AGateway) subscribeUpstream(sc SNClient, topic string, qos byte) (byte, error) {
+	client := sc.base()
+	if client.Subscribed(topic) {
+		// a resent SUBSCRIBE (the SUBACK was probably lost),
+		// the gateway is already subscribed
+		DEBUG.Log("already subscribed", aggregatingLog, logClient(client), logTopic(topic))
+	} else if first, err := ag.tTree.AddSubscription(client, topic); err != nil {
+		ERROR.Log("error adding subscription: "+err.Error(), aggregatingLog, logClient(client), logTopic(topic))
+		return 0, err
+	} else if first {
+		DEBUG.Log("first subscriber, subscribing via MQTT", aggregatingLog, logClient(client), logTopic(topic))
+		if err := ag.subscribeBrokers(topic); err != nil {
+			ERROR.Log("error subscribing: "+err.Error(), aggregatingLog, logTopic(topic))
+		}
+	}
+	if ag.hooks.OnSubscribe != nil {
+		ag.hookq.push(func() { ag.hooks.OnSubscribe(client, topic, qos) })
+	}
+	return qos, nil
 }
 
-func (ag *AGateway) handle_UNSUBSCRIBE(m *UnsubscribeMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+// filter, as the gateway subscribes to it on the broker
+func (ag *AGateway) brokerFilter(filter string) string {
+	if ag.share.shares(filter) {
+		return "$share/" + ag.share.group + "/" + ag.prefix.upstream(filter)
+	}
+	return ag.prefix.upstream(filter)
 }
 
-func (ag *AGateway) handle_UNSUBACK(m *UnsubackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+// Subscribe the gateway to filter on every broker the topics it
+// matches are published to, returning the first error
+func (ag *AGateway) subscribeBrokers(filter string) error {
+	var err error
+	for _, u := range ag.upstreamsOf(filter) {
+		if uerr := ag.subscribeBroker(u, filter); uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+	return err
 }
 
-func (ag *AGateway) handle_PINGREQ(m *PingreqMessage, c *net.UDPConn, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-	resp := NewMessage(PINGRESP)
+// Subscribe the gateway to filter on u's broker, recording it in
+// its session there once the broker has it
+func (ag *AGateway) subscribeBroker(u *upstream, filter string) error {
+	token := ag.brokerOf(u).Subscribe(ag.brokerFilter(filter), 2, ag.handler)
+	if !token.WaitTimeout(brokerTimeout) {
+		return ErrBrokerTimeout
+	} else if token.Error() != nil {
+		return token.Error()
+	}
+	u.subscribed(filter)
+	return nil
+}
 
-	var buf bytes.Buffer
-	resp.Write(&buf)
+// Unsubscribe the gateway from filters it no longer needs on u's
+// broker
+func (ag *AGateway) unsubscribeBroker(u *upstream, filters []string) {
+	if len(filters) == 0 {
+		return
+	}
+	topics := make([]string, len(filters))
+	for i, filter := range filters {
+		topics[i] = ag.brokerFilter(filter)
+	}
+	token := ag.brokerOf(u).Unsubscribe(topics...)
+	if !token.WaitTimeout(brokerTimeout) {
+		ERROR.Printf("could not unsubscribe from %q: %v\n", filters, ErrBrokerTimeout)
+	} else if token.Error() != nil {
+		ERROR.Printf("could not unsubscribe from %q: %v\n", filters, token.Error())
+	}
+}
 
-	if nbytes, err := c.WriteToUDP(buf.Bytes(), r); err != nil {
-		ERROR.Println(err)
-	} else {
-		INFO.Printf("PINGRESP sent %d bytes\n", nbytes)
+// The gateway stays subscribed to the filter, whether or not
+// other clients are
+func (ag *AGateway) unsubscribeUpstream(sc SNClient, topic string) {
+	if err := ag.tTree.RemoveSubscription(sc.base(), topic); err != nil {
+		ERROR.Log(err.Error(), aggregatingLog, logClient(sc.base()), logTopic(topic))
 	}
 }
 
-func (ag *AGateway) handle_PINGRESP(m *PingrespMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+// The gateway holds the will itself, so there is nothing more
+// to do
+func (ag *AGateway) updateWill(sc SNClient) byte {
+	return ACCEPTED
 }
 
-func (ag *AGateway) handle_DISCONNECT(m *DisconnectMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
-	INFO.Printf("duration: %d\n", m.Duration)
-	// todo: cleanup the client
+func (ag *AGateway) disconnect(sc SNClient, reason string) {
+	client := sc.base()
+	for _, filter := range client.Filters() {
+		ag.tTree.RemoveSubscription(client, filter)
+	}
+	client.Close()
+	ag.clients.RemoveClient(client.Address)
+	ag.disconnected(client, reason)
 }
 
-func (ag *AGateway) handle_WILLTOPICUPD(m *WillTopicUpdateMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) lost(sc SNClient) {
+	ag.disconnect(sc, DisconnectLost)
 }
 
-func (ag *AGateway) handle_WILLTOPICRESP(m *WillTopicRespMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+// The gateway publishes no will of its clients'
+func (ag *AGateway) kick(sc SNClient, will bool) {
+	ag.disconnect(sc, DisconnectKicked)
 }
 
-func (ag *AGateway) handle_WILLMSGUPD(m *WillMsgUpdateMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) asleep(sc SNClient, d time.Duration) {
+	if ag.hooks.OnSleep != nil {
+		client := sc.base()
+		ag.hookq.push(func() { ag.hooks.OnSleep(client, d) })
+	}
 }
 
-func (ag *AGateway) handle_WILLMSGRESP(m *WillMsgRespMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", m.MessageType(), r)
+func (ag *AGateway) disconnected(client *Client, reason string) {
+	if ag.hooks.OnDisconnect != nil {
+		ag.hookq.push(func() { ag.hooks.OnDisconnect(client, reason) })
+	}
 }
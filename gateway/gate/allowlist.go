@@ -0,0 +1,100 @@
+package gateway
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// The client ids the gateway takes CONNECTs from, if not every
+// one: those client-allow gives, and those of client-allow-file
+// a line each, blank lines and lines starting with # ignored.
+// Each is an id or a pattern as path.Match has them, sensor-*
+// matching every id starting with sensor- but for those with a
+// / after it. A CONNECT with any other id is answered "rejected:
+// not supported" before a session is made for it, and counted.
+type allowlist struct {
+	exact    map[string]bool
+	patterns []string
+}
+
+// The allowlist gc configures, reading client-allow-file; nil
+// unless it gives client-allow or client-allow-file
+func newAllowlist(gc *GatewayConfig) (*allowlist, error) {
+	if len(gc.clientallow) == 0 && gc.clientallowfile == "" {
+		return nil, nil
+	}
+	a := &allowlist{exact: make(map[string]bool)}
+	for _, id := range gc.clientallow {
+		a.add(id)
+	}
+	if gc.clientallowfile == "" {
+		return a, nil
+	}
+	f, err := os.Open(gc.clientallowfile)
+	if err != nil {
+		ERROR.Printf("Cannot read the allowed client ids from %s: %v", gc.clientallowfile, err)
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var lineno int
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			ERROR.Printf("Invalid client id pattern on line %d of %s: \"%s\"", lineno, gc.clientallowfile, line)
+			return nil, ErrInvalidClientAllow
+		}
+		a.add(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	INFO.Printf("allowing %d client ids and %d patterns\n", len(a.exact), len(a.patterns))
+	return a, nil
+}
+
+func (a *allowlist) add(id string) {
+	if strings.ContainsAny(id, `*?[\`) {
+		a.patterns = append(a.patterns, id)
+	} else {
+		a.exact[id] = true
+	}
+}
+
+// Whether a CONNECT with id is taken, as it is from every id if
+// a is nil
+func (a *allowlist) allows(id string) bool {
+	if a == nil || a.exact[id] {
+		return true
+	}
+	for _, p := range a.patterns {
+		if ok, _ := path.Match(p, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Read the allowlist gc configures, client-allow-file again
+// among it, and check the CONNECTs from now on against it. The
+// allowlist already loaded is kept if the file cannot be read.
+func (g *core) loadAllowlist(gc *GatewayConfig) error {
+	a, err := newAllowlist(gc)
+	if err != nil {
+		return err
+	}
+	g.allowed.Store(a)
+	return nil
+}
+
+// The number of CONNECTs refused for a client id not allowed
+func (g *core) NotAllowedConnects() uint64 {
+	return atomic.LoadUint64(&g.notAllowed)
+}
@@ -0,0 +1,199 @@
+package gateway
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many entries are held for the audit file before those
+// beyond are dropped, and how many of the latest are kept for
+// the admin API
+const (
+	auditBuffer = 1024
+	auditTail   = 1000
+)
+
+// What the audit file has besides the clients' events
+const (
+	auditSubscribed = "subscribed"
+	auditAdmin      = "admin"
+)
+
+// An entry of the audit file, a line of JSON each:
+//
+//	{"time": "2026-10-16T09:00:00.123Z", "event": "subscribed",
+//	 "client_id": "sensor-1", "address": "192.0.2.1:5000",
+//	 "filter": "config/sensor-1/#", "qos": 1}
+//
+// event is connected, disconnected (with reason), asleep or lost
+// as events-topic has them, subscribed (with filter and qos), or
+// admin for what the admin API was asked to do: action is
+// disconnect, publish, packet-dump, capture or trace, caller the
+// address it was asked from and detail what it was given. time
+// is in UTC.
+type auditEntry struct {
+	Time     time.Time              `json:"time"`
+	Event    string                 `json:"event"`
+	ClientId string                 `json:"client_id,omitempty"`
+	Address  string                 `json:"address,omitempty"`
+	Reason   string                 `json:"reason,omitempty"`
+	Filter   string                 `json:"filter,omitempty"`
+	Qos      *byte                  `json:"qos,omitempty"`
+	Action   string                 `json:"action,omitempty"`
+	Caller   string                 `json:"caller,omitempty"`
+	Detail   map[string]interface{} `json:"detail,omitempty"`
+}
+
+// A record of the sessions of the gateway's clients and of what
+// operators asked of it, kept apart from its log and whatever
+// the log-level, in a file rotated as the log file is. Entries
+// are handed to a goroutine writing them, so neither the packet
+// path nor the hooks wait on the file: those it has no room for
+// are dropped and counted. The latest are kept for the admin
+// API.
+type audit struct {
+	conf    logFileConfig
+	entries chan auditEntry
+	dropped uint64
+	file    *logFile
+	done    chan struct{}
+	wg      sync.WaitGroup
+	sync.Mutex
+	recent []auditEntry // the latest auditTail, a ring
+	next   int          // where the next goes once it is full
+}
+
+// The audit gc configures, nil unless it gives audit-file
+func newAudit(gc *GatewayConfig) *audit {
+	if gc.auditfile == "" {
+		return nil
+	}
+	return &audit{conf: gc.auditFile(), entries: make(chan auditEntry, auditBuffer)}
+}
+
+// Open the file and write the entries to it until stopped
+func (a *audit) start() error {
+	if a == nil {
+		return nil
+	}
+	f, err := openFile(a.conf, &a.dropped)
+	if err != nil {
+		ERROR.Printf("Cannot write the audit to %s: %v", a.conf.path, err)
+		return err
+	}
+	a.file, a.done = f, make(chan struct{})
+	a.wg.Add(1)
+	go a.run()
+	return nil
+}
+
+// Write out what is held, and close the file
+func (a *audit) stop() {
+	if a == nil || a.done == nil {
+		return
+	}
+	close(a.done)
+	a.wg.Wait()
+	a.file.Close()
+	a.done = nil
+}
+
+// Hand e to the writer, timed now, unless it is full
+func (a *audit) record(e auditEntry) {
+	if a == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	select {
+	case a.entries <- e:
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+// Record what the admin API was asked to do, from caller
+func (a *audit) admin(action, caller, clientId string, detail map[string]interface{}) {
+	a.record(auditEntry{Event: auditAdmin, Action: action, Caller: caller, ClientId: clientId, Detail: detail})
+}
+
+func (a *audit) run() {
+	defer a.wg.Done()
+	for {
+		select {
+		case e := <-a.entries:
+			a.write(e)
+		case <-a.done:
+			for {
+				select {
+				case e := <-a.entries:
+					a.write(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *audit) write(e auditEntry) {
+	line, _ := json.Marshal(e)
+	a.file.Write(append(line, '\n'))
+	defer a.Unlock()
+	a.Lock()
+	if len(a.recent) < auditTail {
+		a.recent = append(a.recent, e)
+		return
+	}
+	a.recent[a.next] = e
+	a.next = (a.next + 1) % auditTail
+}
+
+// The latest n entries written, oldest first
+func (a *audit) tail(n int) []auditEntry {
+	defer a.Unlock()
+	a.Lock()
+	if n <= 0 || n > len(a.recent) {
+		n = len(a.recent)
+	}
+	ordered := append(append([]auditEntry(nil), a.recent[a.next:]...), a.recent[:a.next]...)
+	return ordered[len(ordered)-n:]
+}
+
+// The entries dropped, for want of room or of the disk, none if
+// a is nil
+func (a *audit) droppedCount() uint64 {
+	if a == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&a.dropped)
+}
+
+// The hooks recording the clients' sessions, none if a is nil
+func (a *audit) hooks() Hooks {
+	if a == nil {
+		return Hooks{}
+	}
+	session := func(client *Client, event, reason string) {
+		a.record(auditEntry{Event: event, ClientId: client.ClientId, Address: client.Address.String(), Reason: reason})
+	}
+	return Hooks{
+		OnConnected: func(client *Client) {
+			session(client, eventConnected, "")
+		},
+		OnDisconnect: func(client *Client, reason string) {
+			if reason == DisconnectLost {
+				session(client, eventLost, "")
+			} else {
+				session(client, eventDisconnected, reason)
+			}
+		},
+		OnSleep: func(client *Client, duration time.Duration) {
+			session(client, eventAsleep, "")
+		},
+		OnSubscribe: func(client *Client, filter string, qos byte) {
+			a.record(auditEntry{Event: auditSubscribed, ClientId: client.ClientId, Address: client.Address.String(), Filter: filter, Qos: &qos})
+		},
+	}
+}
@@ -0,0 +1,232 @@
+package gateway
+
+import (
+	"bufio"
+	"crypto/x509"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// Decides whether a client's CONNECT is accepted. MQTT-SN has
+// no credentials, so an Authenticator goes by what else is known
+// of the client: its id, where it connects from and through
+// which listener, and the certificate it presented to a DTLS
+// listener. It is called on the packet path, after the client id
+// is checked against client-allow, so must return quickly.
+type Authenticator interface {
+	// An error refuses the CONNECT as the gateway being
+	// congested, for the client to try again later
+	Authenticate(ctx ConnectContext) (Decision, error)
+}
+
+// What an Authenticator is told of a CONNECT
+type ConnectContext struct {
+	ClientId string
+	Addr     net.Addr
+	// The name of the listener the CONNECT came through
+	Listener string
+	// The certificate the client presented, and the names in
+	// it, if it connected through DTLS with one
+	PeerCertificate *x509.Certificate
+	PeerNames       []string
+}
+
+// An Authenticator's answer to a CONNECT
+type Decision struct {
+	Accept bool
+	// The return code a refused CONNECT is answered with,
+	// REJ_NOT_SUPORTED if ACCEPTED
+	ReturnCode byte
+	// Kept in the client's metadata if accepted, see
+	// Client.Metadata
+	Metadata map[string]string
+}
+
+// A decision accepting the client with metadata, which may be
+// nil
+func Accept(metadata map[string]string) Decision {
+	return Decision{true, ACCEPTED, metadata}
+}
+
+// A decision refusing the client with return code rc
+func Reject(rc byte) Decision {
+	return Decision{false, rc, nil}
+}
+
+// The Authenticator accepting every client, the default
+type AllowAll struct{}
+
+func (AllowAll) Authenticate(ctx ConnectContext) (Decision, error) {
+	return Accept(nil), nil
+}
+
+// An Authenticator accepting the clients a registry file lists,
+// a line each of a client id or a pattern as path.Match has
+// them, and the metadata the client is given as key=value pairs:
+//
+//	# client    metadata
+//	sensor-17   tenant=acme role=admin
+//	sensor-*    tenant=acme role=sensor
+//
+// The first line matching a client's id decides; a client
+// matched by none is refused. Blank lines and lines starting
+// with # are ignored.
+type RegistryAuthenticator struct {
+	file    string
+	entries []registryEntry
+}
+
+type registryEntry struct {
+	client   string
+	metadata map[string]string
+	pattern  bool // client is a pattern rather than an id
+}
+
+// The registry read from file
+func NewRegistryAuthenticator(file string) (*RegistryAuthenticator, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		ERROR.Printf("Cannot read the client registry from %s: %v", file, err)
+		return nil, err
+	}
+	defer f.Close()
+	r := &RegistryAuthenticator{file: file}
+	scanner := bufio.NewScanner(f)
+	var lineno int
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		e, ok := parseRegistryEntry(line)
+		if !ok {
+			ERROR.Printf("Invalid registry entry on line %d of %s: \"%s\"", lineno, file, line)
+			return nil, ErrInvalidRegistry
+		}
+		r.entries = append(r.entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	INFO.Printf("loaded %d registry entries from %s\n", len(r.entries), file)
+	return r, nil
+}
+
+func parseRegistryEntry(line string) (registryEntry, bool) {
+	fields := strings.Fields(line)
+	e := registryEntry{client: fields[0]}
+	if _, err := path.Match(e.client, ""); err != nil {
+		return e, false
+	}
+	e.pattern = strings.ContainsAny(e.client, `*?[\`)
+	for _, kv := range fields[1:] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return e, false
+		}
+		if e.metadata == nil {
+			e.metadata = make(map[string]string)
+		}
+		e.metadata[k] = v
+	}
+	return e, true
+}
+
+// Accept the client if the registry lists its id, with the
+// metadata given for it
+func (r *RegistryAuthenticator) Authenticate(ctx ConnectContext) (Decision, error) {
+	for _, e := range r.entries {
+		if e.pattern {
+			if ok, _ := path.Match(e.client, ctx.ClientId); !ok {
+				continue
+			}
+		} else if e.client != ctx.ClientId {
+			continue
+		}
+		return Accept(e.metadata), nil
+	}
+	return Reject(REJ_NOT_SUPORTED), nil
+}
+
+// A CONNECT the Authenticator refused, answered with the return
+// code it gave
+type authRefused byte
+
+func (rc authRefused) Error() string {
+	return "refused by the authenticator"
+}
+
+// Set the Authenticator CONNECTs are decided by, in place of
+// the registry of auth-registry-file if there is one. Must be
+// called before Start.
+func (g *core) SetAuthenticator(a Authenticator) {
+	g.auth = a
+}
+
+// Read the registry of auth-registry-file, as gc has it, and
+// decide the CONNECTs from now on by it. The registry already
+// loaded is kept if the file cannot be read.
+func (g *core) loadRegistry(gc *GatewayConfig) error {
+	r, err := newRegistry(gc)
+	if err != nil {
+		return err
+	}
+	g.registry.Store(r)
+	return nil
+}
+
+// The registry of auth-registry-file, as gc has it, nil if it
+// names none
+func newRegistry(gc *GatewayConfig) (*RegistryAuthenticator, error) {
+	if gc.authregistryfile == "" {
+		return nil, nil
+	}
+	return NewRegistryAuthenticator(gc.authregistryfile)
+}
+
+func (g *core) authenticator() Authenticator {
+	if g.auth != nil {
+		return g.auth
+	}
+	if r := g.registry.Load(); r != nil {
+		return r
+	}
+	return AllowAll{}
+}
+
+// Ask the Authenticator about the CONNECT of clientid from r,
+// returning the metadata the client is to have, or the error it
+// is refused for, counted
+func (g *core) authenticate(clientid string, c uConn, r uAddr) (map[string]string, error) {
+	ctx := ConnectContext{ClientId: clientid, Addr: r.r, Listener: c.Listener()}
+	if s, ok := c.c.(dtlsSession); ok && s.peer != nil {
+		ctx.PeerCertificate = s.peer
+		ctx.PeerNames = certificateNames(s.peer)
+	}
+	d, err := g.authenticator().Authenticate(ctx)
+	switch {
+	case err != nil:
+		ERROR.Log("authenticator failed: "+err.Error(), coreLog, logClientId(clientid), logRemote(r))
+		atomic.AddUint64(&g.authRefused, 1)
+		return nil, ErrAuthenticator
+	case !d.Accept:
+		atomic.AddUint64(&g.authRefused, 1)
+		if d.ReturnCode == ACCEPTED {
+			return nil, authRefused(REJ_NOT_SUPORTED)
+		}
+		return nil, authRefused(d.ReturnCode)
+	}
+	return d.Metadata, nil
+}
+
+// The number of CONNECTs the Authenticator has refused, or
+// failed to decide
+func (g *core) AuthRefused() uint64 {
+	return atomic.LoadUint64(&g.authRefused)
+}
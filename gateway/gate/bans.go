@@ -0,0 +1,53 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+)
+
+// The client ids and addresses banned for a time, the admin API
+// having disconnected their client: a CONNECT with one of the
+// ids, or from one of the addresses, is refused until the ban
+// expires. An address is banned by its IP, whatever its port.
+type bans struct {
+	sync.Mutex
+	ids   map[string]time.Time
+	addrs map[string]time.Time
+}
+
+func newBans() *bans {
+	return &bans{ids: make(map[string]time.Time), addrs: make(map[string]time.Time)}
+}
+
+// Ban id and a until until
+func (b *bans) ban(id string, a uAddr, until time.Time) {
+	defer b.Unlock()
+	b.Lock()
+	b.ids[id] = until
+	b.addrs[a.host()] = until
+}
+
+// Whether id or a is banned at now, forgetting the bans that
+// have expired
+func (b *bans) banned(id string, a uAddr, now time.Time) bool {
+	defer b.Unlock()
+	b.Lock()
+	if len(b.ids) == 0 {
+		return false
+	}
+	banned := false
+	for _, m := range []map[string]time.Time{b.ids, b.addrs} {
+		for key, until := range m {
+			if !now.Before(until) {
+				delete(m, key)
+			}
+		}
+	}
+	if _, ok := b.ids[id]; ok {
+		banned = true
+	}
+	if _, ok := b.addrs[a.host()]; ok {
+		banned = true
+	}
+	return banned
+}
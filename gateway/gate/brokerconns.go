@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+)
+
+// How often a client waiting for a broker connection looks
+// again when the connect rate, not the ceiling, holds it back
+const brokerConnsPoll = 50 * time.Millisecond
+
+// The broker connections the transparent gateway holds for its
+// clients. At most max are held at once (no limit if 0), and at
+// most rate are made each second (no limit if 0). A client
+// that arrives at the limit waits for a connection if queue is
+// set, otherwise it is refused.
+type brokerConns struct {
+	sync.Mutex
+	max     int
+	n       int
+	limiter *rateLimiter
+	queue   bool
+	freed   chan struct{}
+}
+
+func newBrokerConns(max, rate int, queue bool) *brokerConns {
+	b := &brokerConns{max: max, queue: queue, freed: make(chan struct{}, 1)}
+	if rate > 0 {
+		b.limiter = &rateLimiter{
+			rate:    float64(rate),
+			burst:   float64(rate),
+			buckets: make(map[string]*bucket),
+		}
+	}
+	return b
+}
+
+func (b *brokerConns) take() bool {
+	defer b.Unlock()
+	b.Lock()
+	if b.max > 0 && b.n >= b.max {
+		return false
+	}
+	if b.limiter != nil && !b.limiter.allow("", time.Now()) {
+		return false
+	}
+	b.n++
+	return true
+}
+
+// Take a broker connection, waiting at most timeout for one if
+// the gateway queues clients
+func (b *brokerConns) acquire(timeout time.Duration) bool {
+	if b.take() {
+		return true
+	}
+	if !b.queue {
+		return false
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(brokerConnsPoll)
+	defer poll.Stop()
+	for {
+		select {
+		case <-deadline.C:
+			return false
+		case <-b.freed:
+		case <-poll.C:
+		}
+		if b.take() {
+			return true
+		}
+	}
+}
+
+func (b *brokerConns) release() {
+	b.Lock()
+	b.n--
+	b.Unlock()
+	select {
+	case b.freed <- struct{}{}:
+	default:
+	}
+}
+
+// The broker connections held
+func (b *brokerConns) Len() int {
+	defer b.Unlock()
+	b.Lock()
+	return b.n
+}
@@ -0,0 +1,172 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The MQTT v3 client dials a websocket broker without HTTP
+// headers, so a websocket broker with mqtt-header is reached
+// through a relay on the loopback, which the client dials over
+// tcp and which dials the broker with the headers.
+type brokerRelays struct {
+	sync.Mutex
+	tlsConfig *tls.Config
+	headers   http.Header
+	timeout   time.Duration
+	relays    map[string]*brokerRelay
+}
+
+// The relays for the configured headers, nil if there are none
+func newBrokerRelays(gc *GatewayConfig, tlsConfig *tls.Config) *brokerRelays {
+	if len(gc.mqttheaders) == 0 {
+		return nil
+	}
+	return &brokerRelays{
+		tlsConfig: tlsConfig,
+		headers:   gc.mqttheaders,
+		timeout:   gc.brokerConnectTimeout(),
+		relays:    make(map[string]*brokerRelay),
+	}
+}
+
+// The URL for the v3 client to dial broker with: broker itself
+// unless it is a websocket broker with headers to send
+func (rs *brokerRelays) url(broker string) string {
+	if rs == nil {
+		return broker
+	}
+	u, err := url.Parse(broker)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+		return broker
+	}
+	rs.Lock()
+	defer rs.Unlock()
+	r, ok := rs.relays[broker]
+	if !ok {
+		if r, err = newBrokerRelay(broker, rs); err != nil {
+			ERROR.Printf("relay to %s: %v, connecting without mqtt-header\n", broker, err)
+			return broker
+		}
+		rs.relays[broker] = r
+	}
+	return "tcp://" + r.ln.Addr().String()
+}
+
+// Stop the relays, closing the connections through them
+func (rs *brokerRelays) close() {
+	if rs == nil {
+		return
+	}
+	rs.Lock()
+	defer rs.Unlock()
+	for broker, r := range rs.relays {
+		r.close()
+		delete(rs.relays, broker)
+	}
+}
+
+type brokerRelay struct {
+	sync.Mutex
+	broker string
+	rs     *brokerRelays
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+func newBrokerRelay(broker string, rs *brokerRelays) (*brokerRelay, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	r := &brokerRelay{
+		broker: broker,
+		rs:     rs,
+		ln:     ln,
+		conns:  make(map[net.Conn]struct{}),
+	}
+	r.wg.Add(1)
+	go r.serve()
+	return r, nil
+}
+
+func (r *brokerRelay) serve() {
+	defer r.wg.Done()
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		if !r.track(conn, true) {
+			conn.Close()
+			return
+		}
+		r.wg.Add(1)
+		go r.relay(conn)
+	}
+}
+
+// Add conn to or remove it from the connections to close with
+// the relay, false if the relay is closed
+func (r *brokerRelay) track(conn net.Conn, add bool) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.conns == nil {
+		return false
+	}
+	if add {
+		r.conns[conn] = struct{}{}
+	} else {
+		delete(r.conns, conn)
+	}
+	return true
+}
+
+// Copy between conn and a connection to the broker until
+// either side closes
+func (r *brokerRelay) relay(conn net.Conn) {
+	defer r.wg.Done()
+	defer conn.Close()
+	defer r.track(conn, false)
+	ctx, cancel := context.WithTimeout(context.Background(), r.rs.timeout)
+	broker, err := dialBroker(ctx, r.broker, r.rs.tlsConfig, r.rs.headers)
+	cancel()
+	if err != nil {
+		ERROR.Printf("relay to %s: %v\n", r.broker, err)
+		return
+	}
+	if !r.track(broker, true) {
+		broker.Close()
+		return
+	}
+	defer r.track(broker, false)
+	defer broker.Close()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(broker, conn)
+		broker.Close()
+		close(done)
+	}()
+	io.Copy(conn, broker)
+	conn.Close()
+	<-done
+}
+
+func (r *brokerRelay) close() {
+	r.ln.Close()
+	r.Lock()
+	conns := r.conns
+	r.conns = nil
+	r.Unlock()
+	for conn := range conns {
+		conn.Close()
+	}
+	r.wg.Wait()
+}
@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// What the broker connection is secured with when the broker is
+// at a tls://, ssl://, tcps:// or wss:// URI: the CA bundle its
+// certificate is verified against (the system's if none), a
+// certificate and key for the gateway to present, and the name
+// its certificate must have if not the URI's host. insecure
+// skips verifying the broker's certificate, which is only fit
+// for a lab.
+type brokerTLS struct {
+	ca         string
+	cert       string
+	key        string
+	serverName string
+	insecure   bool
+}
+
+// Read the files and make the configuration for the broker
+// connection, nil if nothing is configured so that the defaults
+// apply
+func (b brokerTLS) config() (*tls.Config, error) {
+	if b == (brokerTLS{}) {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName:         b.serverName,
+		InsecureSkipVerify: b.insecure,
+	}
+	if b.insecure {
+		ERROR.Println("not verifying the broker's certificate, mqtt-insecure-skip-verify is set")
+	}
+	if b.ca != "" {
+		pem, err := ioutil.ReadFile(b.ca)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt-ca-file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			ERROR.Printf("No certificates in %s\n", b.ca)
+			return nil, ErrInvalidBrokerCA
+		}
+	}
+	if b.cert != "" || b.key != "" {
+		if b.cert == "" || b.key == "" {
+			return nil, ErrIncompleteBrokerCert
+		}
+		cert, err := tls.LoadX509KeyPair(b.cert, b.key)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt-cert-file %s, mqtt-key-file %s: %v", b.cert, b.key, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
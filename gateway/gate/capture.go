@@ -0,0 +1,272 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many packets are held for the capture file before those
+// beyond are dropped
+const captureBuffer = 1024
+
+// How large a capture file grows before it rolls over, and how
+// many rolled over are kept, unless configured otherwise
+const (
+	defaultCaptureMaxSize    = 64 << 20
+	defaultCaptureMaxBackups = 1
+)
+
+// The pcap file packets are captured to, how large it grows
+// before it rolls over and how many of those rolled over are
+// kept
+type captureConfig struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+}
+
+// A packet received or sent, and when
+type capturedPacket struct {
+	at       time.Time
+	src, dst net.Addr
+	data     []byte
+}
+
+// Every packet received and sent, written to a pcap file as a
+// UDP datagram between the client's address and the gateway's,
+// whatever it came over, for Wireshark to read. Packets are
+// handed to a goroutine writing them, so the listeners never
+// wait on the file: those it has no room for are dropped and
+// counted. Like the packet dump it is the process's.
+type capture struct {
+	conf     captureConfig
+	packets  chan capturedPacket
+	captured uint64
+	dropped  uint64
+	until    time.Time
+	file     *os.File
+	w        *bufio.Writer
+	size     int64
+	stop     chan struct{}
+	timer    *time.Timer
+	wg       sync.WaitGroup
+}
+
+var captures atomic.Pointer[capture]
+
+// Start capturing to conf's file, for d if it is not 0, in
+// place of any capture already running
+func startCapture(conf captureConfig, d time.Duration) error {
+	c := &capture{conf: conf, packets: make(chan capturedPacket, captureBuffer), stop: make(chan struct{})}
+	if err := c.open(); err != nil {
+		return err
+	}
+	c.wg.Add(1)
+	go c.run()
+	if d > 0 {
+		c.until = time.Now().Add(d)
+		c.timer = time.AfterFunc(d, func() {
+			if captures.CompareAndSwap(c, nil) {
+				c.close()
+			}
+		})
+	}
+	if old := captures.Swap(c); old != nil {
+		old.close()
+	}
+	INFO.Printf("capturing packets to %s\n", conf.path)
+	return nil
+}
+
+// Capture packets from the start if configured to; the gateway
+// serves its clients all the same if it cannot
+func (g *core) startCapture() {
+	gc := g.config.Load()
+	if !gc.capture {
+		return
+	}
+	if err := startCapture(gc.captureConfig(), 0); err != nil {
+		ERROR.Printf("cannot capture packets: %v\n", err)
+	}
+}
+
+// Stop capturing, writing out what is held
+func stopCapture() {
+	if c := captures.Swap(nil); c != nil {
+		c.close()
+	}
+}
+
+// Hand a packet from src to dst to the writer, unless it is
+// full. data is copied, belonging to the caller.
+func (c *capture) packet(src, dst net.Addr, data []byte) {
+	p := capturedPacket{time.Now(), src, dst, append([]byte(nil), data...)}
+	select {
+	case c.packets <- p:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+// The packets written and those dropped for want of room
+func (c *capture) counts() (captured, dropped uint64) {
+	return atomic.LoadUint64(&c.captured), atomic.LoadUint64(&c.dropped)
+}
+
+// The packets the capture running has dropped, 0 if none is
+func captureDropped() uint64 {
+	if c := captures.Load(); c != nil {
+		_, dropped := c.counts()
+		return dropped
+	}
+	return 0
+}
+
+func (c *capture) close() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	close(c.stop)
+	c.wg.Wait()
+	captured, dropped := c.counts()
+	INFO.Printf("captured %d packets to %s, dropped %d\n", captured, c.conf.path, dropped)
+}
+
+// Write the packets as they come, flushing the file whenever
+// none are waiting, until stopped; what is held then is written
+// before the file is closed
+func (c *capture) run() {
+	defer c.wg.Done()
+	for {
+		select {
+		case p := <-c.packets:
+			c.write(p)
+		case <-c.stop:
+			for {
+				select {
+				case p := <-c.packets:
+					c.write(p)
+				default:
+					if c.file != nil {
+						c.w.Flush()
+						c.file.Close()
+					}
+					return
+				}
+			}
+		}
+		if len(c.packets) == 0 && c.file != nil {
+			c.w.Flush()
+		}
+	}
+}
+
+// The pcap file header: the magic number for timestamps in
+// nanoseconds, version 2.4, no time zone, the largest snapshot
+// length and raw IP packets, IPv4 or IPv6
+var pcapHeader = []byte{
+	0x4d, 0x3c, 0xb2, 0xa1,
+	2, 0, 4, 0,
+	0, 0, 0, 0,
+	0, 0, 0, 0,
+	0xff, 0xff, 0, 0,
+	101, 0, 0, 0,
+}
+
+// Create the file, its header written. Once the writer is
+// running, only it may call this.
+func (c *capture) open() error {
+	file, err := os.OpenFile(c.conf.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	c.file, c.w = file, bufio.NewWriter(file)
+	c.w.Write(pcapHeader)
+	c.size = int64(len(pcapHeader))
+	return nil
+}
+
+func (c *capture) write(p capturedPacket) {
+	packet := ipPacket(p.src, p.dst, p.data)
+	if c.file != nil && c.conf.maxSize > 0 && c.size > int64(len(pcapHeader)) && c.size+16+int64(len(packet)) > c.conf.maxSize {
+		c.w.Flush()
+		c.file.Close()
+		c.file = nil
+		rotateFile(c.conf.path, c.conf.maxBackups, 0)
+	}
+	if c.file == nil && c.open() != nil {
+		atomic.AddUint64(&c.dropped, 1)
+		return
+	}
+	var record [16]byte
+	binary.LittleEndian.PutUint32(record[0:], uint32(p.at.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(p.at.Nanosecond()))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	c.w.Write(record[:])
+	c.w.Write(packet)
+	c.size += int64(len(record) + len(packet))
+	atomic.AddUint64(&c.captured, 1)
+}
+
+// The IP address and port of addr, the unspecified address and
+// port 0 for one that has neither, a serial line or a socket
+// path
+func ipPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	}
+	return net.IPv4zero, 0
+}
+
+// data as a UDP datagram from src to dst in an IPv4 packet, or
+// IPv6 if either address is
+func ipPacket(src, dst net.Addr, data []byte) []byte {
+	srcIP, srcPort := ipPort(src)
+	dstIP, dstPort := ipPort(dst)
+	udp := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint16(udp[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], data)
+
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+		ip := make([]byte, 20, 20+len(udp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64
+		ip[9] = 17
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip))
+		return append(ip, udp...)
+	}
+	ip := make([]byte, 40, 40+len(udp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6] = 17
+	ip[7] = 64
+	copy(ip[8:], srcIP.To16())
+	copy(ip[24:], dstIP.To16())
+	return append(ip, udp...)
+}
+
+// The checksum of an IPv4 header
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
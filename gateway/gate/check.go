@@ -0,0 +1,142 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+)
+
+// Resolves the brokers' hosts when checking, replaced by tests
+var lookupHost = net.LookupHost
+
+// Check what the configuration refers to without listening for
+// clients or connecting to a broker: that the brokers' hosts
+// resolve and the files it names can be read and hold what they
+// should. Nothing is written but a summary of what would be
+// served, to w, if there are no problems, which are returned as
+// ConfigErrors otherwise.
+func (gc *GatewayConfig) Check(w io.Writer) error {
+	var es ConfigErrors
+	problem := func(key string, err error) {
+		es = append(es, &ConfigError{key, err})
+	}
+
+	brokers := []upstreamConfig{{"mqtt-broker", gc.mqttbroker}}
+	for _, uc := range gc.upstreams {
+		brokers = append(brokers, upstreamConfig{"upstream-broker " + uc.name, uc.broker})
+	}
+	for _, b := range brokers {
+		if err := resolveBroker(b.broker); err != nil {
+			problem(b.name, err)
+		}
+	}
+
+	if _, err := gc.brokerTLS().config(); err != nil {
+		problem("mqtt-broker", err)
+	}
+	if gc.dtlsport != 0 {
+		if _, err := gc.dtlsFiles().config(); err != nil {
+			problem("dtls-port", err)
+		}
+	}
+	for _, lc := range gc.listeners {
+		if lc.kind != "dtls" {
+			continue
+		}
+		if _, err := gc.dtlsFiles().with(lc.dtls).config(); err != nil {
+			problem("listener "+lc.String(), err)
+		}
+	}
+	if gc.clientallowfile != "" {
+		if _, err := newAllowlist(gc); err != nil {
+			problem("client-allow-file", err)
+		}
+	}
+	if gc.aclfile != "" {
+		if _, err := newACL(gc); err != nil {
+			problem("acl-file", err)
+		}
+	}
+	if gc.authregistryfile != "" {
+		if _, err := NewRegistryAuthenticator(gc.authregistryfile); err != nil {
+			problem("auth-registry-file", err)
+		}
+	}
+	if gc.credentialsfile != "" {
+		if _, err := loadCredentials(gc.credentialsfile); err != nil {
+			problem("credentials-file", err)
+		}
+	}
+	var held []*heldPublish
+	if gc.offlinequeuefile != "" {
+		var err error
+		if held, err = loadHeld(gc.offlinequeuefile); err != nil {
+			problem("broker-offline-queue-file", err)
+		}
+	}
+
+	if len(es) > 0 {
+		return es
+	}
+	gc.summarize(w, len(held))
+	return nil
+}
+
+// Resolve the host of the broker at uri, unless it is an address
+func resolveBroker(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ErrInvalidBrokerURL
+	}
+	if parseIP(u.Hostname()) != nil {
+		return nil
+	}
+	if _, err := lookupHost(u.Hostname()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Write what the gateway would serve, held being the PUBLISHes
+// saved when it last stopped
+func (gc *GatewayConfig) summarize(w io.Writer, held int) {
+	mode := "transparent"
+	if gc.IsAggregating() {
+		mode = "aggregating"
+	}
+	fmt.Fprintf(w, "mode: %s\n", mode)
+	fmt.Fprintf(w, "broker: %s\n", gc.mqttbroker)
+	for _, uc := range gc.upstreams {
+		fmt.Fprintf(w, "upstream broker %s: %s\n", uc.name, uc.broker)
+	}
+	listening := []string{"udp://" + gc.listenAddress()}
+	if a := gc.dtlsAddress(); a != "" {
+		listening = append(listening, "dtls://"+a)
+	}
+	if a := gc.tcpAddress(); a != "" {
+		listening = append(listening, "tcp://"+a)
+	}
+	if gc.unixsocket != "" {
+		listening = append(listening, "unix://"+gc.unixsocket)
+	}
+	if gc.serialdevice != "" {
+		listening = append(listening, "serial://"+gc.serialdevice)
+	}
+	for _, lc := range gc.listeners {
+		listening = append(listening, lc.String())
+	}
+	for _, l := range listening {
+		fmt.Fprintf(w, "listener: %s\n", l)
+	}
+	if gc.adminaddress != "" {
+		fmt.Fprintf(w, "admin: http://%s\n", gc.adminaddress)
+		if gc.adminpprof {
+			fmt.Fprintf(w, "pprof: http://%s/debug/pprof/\n", gc.adminaddress)
+		}
+	}
+	if gc.offlinequeuefile != "" {
+		fmt.Fprintf(w, "held PUBLISHes: %d in %s\n", held, gc.offlinequeuefile)
+	}
+	fmt.Fprintln(w, "configuration OK")
+}
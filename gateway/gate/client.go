@@ -1,49 +1,296 @@
 package gateway
 
 import (
-	"bytes"
-	"net"
+	"crypto/x509"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	. "github.com/alsm/gnatt/packets"
 )
 
+// The specification's T_retry and N_retry: how long to wait for
+// an acknowledgement before resending a REGISTER, PUBLISH or
+// PUBREL, and how many times to resend before giving up on it
+const (
+	defaultRetryInterval = 10 * time.Second
+	defaultRetryCount    = 3
+)
+
+// How many times its keepalive, or its sleep duration while it
+// sleeps, a client may be silent for before it is lost
+const defaultSupervisionGrace = 1.5
+
+// The timers of the exchanges with a client, as the timers
+// options have them
+type protocolTimers struct {
+	retryInterval  time.Duration
+	retryCount     int
+	keepAliveGrace float64
+	sleepGrace     float64
+}
+
+func defaultTimers() protocolTimers {
+	return protocolTimers{
+		defaultRetryInterval,
+		defaultRetryCount,
+		defaultSupervisionGrace,
+		defaultSupervisionGrace,
+	}
+}
+
+// How many writes to a client in a row may fail before it is
+// taken to be unreachable
+const maxSendFailures = 3
+
+// How many times a PUBLISH is resent after the client rejects
+// its topic id
+const maxRecoveries = 2
+
+// Client states
+const (
+	CONNECTING byte = iota // CONNECT received, will exchange in progress
+	ACTIVE
+	ASLEEP // messages are buffered until the client wakes
+	AWAKE  // buffered messages are being delivered, PINGRESP follows
+)
+
+// The names of the client states
+var stateNames = [...]string{"connecting", "active", "asleep", "awake"}
+
 type SNClient interface {
 	AddrString() string
+	base() *Client
 }
 
 type Client struct {
 	sync.RWMutex
 	ClientId         string
-	Conn             *net.UDPConn
-	Address          *net.UDPAddr
+	Conn             uConn
+	Address          uAddr
 	registeredTopics map[uint16]string
-	pendingMessages  map[uint16]*PublishMessage
+	subscriptions    map[string]byte
+	registering      map[uint16]*retransmission
+	outbound         []queued
+	inflight         map[uint16]*retransmission
+	received         map[uint16]bool
+	limits           clientLimits
+	nextMessageId    uint16
+	state            byte
+	will             *Will
+	onDeliver        func(*Client, string)
+	onUnreachable    func()
+	sendFailures     int32
+	keepAlive        time.Duration
+	supervisor       *time.Timer
+	maxMessageSize   int
+	oversized        uint64
+	queueDrops       uint64
+	aclDenials       uint64
+	metadata         map[string]string
+	publishLimit     *publishBucket
+	timers           protocolTimers
+	lastSeen         time.Time
+	registerRTT      *histogram
+}
+
+// The will a client asked for at CONNECT, to be published
+// on its behalf if it is lost
+type Will struct {
+	Topic  string
+	Data   []byte
+	Qos    byte
+	Retain bool
+}
+
+// A PUBLISH waiting to be sent to the client. recoveries
+// counts the times it has been requeued because the client
+// had forgotten its topic id.
+type queued struct {
+	pm         *PublishMessage
+	topic      string
+	recoveries int
+}
+
+// A message sent to the client that is resent every retry
+// interval until it is acknowledged
+type retransmission struct {
+	m       Message
+	timer   *time.Timer
+	retries int
+	done    bool
+	q       *queued   // for a PUBLISH, where it came from
+	sent    time.Time // for a REGISTER, when first sent, if timed
 }
 
-func NewClient(ClientId string, Conn *net.UDPConn, Address *net.UDPAddr) *Client {
-	INFO.Printf("NewClient, id: \"%s\"\n", ClientId)
+func NewClient(ClientId string, Conn uConn, Address uAddr) *Client {
+	INFO.Log("new client", clientLog, logClientId(ClientId), logRemote(Address))
 	return &Client{
-		sync.RWMutex{},
-		ClientId,
-		Conn,
-		Address,
-		make(map[uint16]string),
-		make(map[uint16]*PublishMessage),
+		ClientId:         ClientId,
+		Conn:             Conn,
+		Address:          Address,
+		registeredTopics: make(map[uint16]string),
+		subscriptions:    make(map[string]byte),
+		registering:      make(map[uint16]*retransmission),
+		inflight:         make(map[uint16]*retransmission),
+		received:         make(map[uint16]bool),
+		limits:           defaultClientLimits(),
+		state:            ACTIVE,
+		timers:           defaultTimers(),
+		lastSeen:         time.Now(),
 	}
 }
 
+// A write to a client that failed
+type SendError struct {
+	ClientId string
+	Address  uAddr
+	Err      error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("sending to \"%s\" at %v: %v", e.ClientId, e.Address, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Write m to the client. Once maxSendFailures writes in a row
+// have failed, as they do when ICMP reports the client's port
+// unreachable, or once one to a connection of its own has,
+// which has closed, onUnreachable is called.
 func (c *Client) Write(m Message) error {
-	var buf bytes.Buffer
-	m.Write(&buf)
-	_, e := c.Conn.WriteToUDP(buf.Bytes(), c.Address)
-	return e
+	err := c.Conn.WriteTo(m, c.Address)
+	if err == nil {
+		atomic.StoreInt32(&c.sendFailures, 0)
+		return nil
+	} else if err == ErrMessageTooLarge {
+		return err
+	}
+	err = &SendError{c.ClientId, c.Address, err}
+	n := atomic.AddInt32(&c.sendFailures, 1)
+	if (n == maxSendFailures || n == 1 && c.Conn.stream()) && c.onUnreachable != nil {
+		ERROR.Log("unreachable: "+err.Error(), clientLog, logClient(c), logRemote(c.Address))
+		// the caller may hold the client's lock
+		go c.onUnreachable()
+	}
+	return err
+}
+
+// The certificate the client presented for its DTLS session, nil
+// if it presented none or is not using DTLS
+func (c *Client) PeerCertificate() *x509.Certificate {
+	if s, ok := c.Conn.c.(dtlsSession); ok {
+		return s.peer
+	}
+	return nil
+}
+
+// The names in the client's certificate, its subject's common
+// name first then its subject alternative names, to check the
+// client id against
+func (c *Client) PeerNames() []string {
+	if cert := c.PeerCertificate(); cert != nil {
+		return certificateNames(cert)
+	}
+	return nil
+}
+
+// The name of the listener the client came through, for
+// policies that differ between them
+func (c *Client) Listener() string {
+	return c.Conn.Listener()
+}
+
+// The value of the client's metadata key, "" if it has none:
+// what the Authenticator gave it, or hooks have set since
+func (c *Client) Metadata(key string) string {
+	defer c.RUnlock()
+	c.RLock()
+	return c.metadata[key]
+}
+
+// Set the client's metadata key to value
+func (c *Client) SetMetadata(key, value string) {
+	defer c.Unlock()
+	c.Lock()
+	if c.metadata == nil {
+		c.metadata = make(map[string]string)
+	}
+	c.metadata[key] = value
+}
+
+// Set the client's metadata to a copy of metadata
+func (c *Client) setMetadata(metadata map[string]string) {
+	for key, value := range metadata {
+		c.SetMetadata(key, value)
+	}
+}
+
+func (c *Client) State() byte {
+	defer c.RUnlock()
+	c.RLock()
+	return c.state
+}
+
+func (c *Client) SetState(state byte) {
+	defer c.Unlock()
+	c.Lock()
+	c.setState(state)
+}
+
+// Must be called with the lock held.
+func (c *Client) setState(state byte) {
+	DEBUG.Log("state", clientLog, logClient(c), Field{"from", stateNames[c.state]}, Field{"to", stateNames[state]})
+	c.state = state
+}
+
+func (c *Client) SetWillTopic(topic string, qos byte, retain bool) {
+	defer c.Unlock()
+	c.Lock()
+	c.will = &Will{Topic: topic, Qos: qos, Retain: retain}
+}
+
+// Set the message of the will begun by SetWillTopic. Return
+// false if there is no will topic.
+func (c *Client) SetWillMessage(data []byte) bool {
+	defer c.Unlock()
+	c.Lock()
+	if c.will == nil {
+		return false
+	}
+	c.will.Data = data
+	return true
+}
+
+// Change the topic of the client's will, keeping its message.
+// An empty topic removes the will.
+func (c *Client) UpdateWillTopic(topic string, qos byte, retain bool) {
+	defer c.Unlock()
+	c.Lock()
+	if topic == "" {
+		c.will = nil
+		return
+	}
+	var data []byte
+	if c.will != nil {
+		data = c.will.Data
+	}
+	c.will = &Will{topic, data, qos, retain}
+}
+
+func (c *Client) Will() *Will {
+	defer c.RUnlock()
+	c.RLock()
+	return c.will
 }
 
 func (c *Client) Register(topicId uint16, topic string) {
 	defer c.Unlock()
 	c.Lock()
-	INFO.Printf("client %s registered topicId %d\n", c.ClientId, topicId)
+	DEBUG.Log("registered", clientLog, logClient(c), logTopic(topic), logTopicId(topicId))
 	c.registeredTopics[topicId] = topic
 }
 
@@ -54,18 +301,593 @@ func (c *Client) Registered(topicId uint16) bool {
 	return ok
 }
 
-func (c *Client) AddPendingMessage(p *PublishMessage) {
+// Record that the client is subscribed to filter with qos,
+// replacing the QoS of an existing subscription. Return true
+// if the client was not already subscribed to filter.
+func (c *Client) Subscribe(filter string, qos byte) bool {
+	defer c.Unlock()
+	c.Lock()
+	_, exists := c.subscriptions[filter]
+	c.subscriptions[filter] = qos
+	return !exists
+}
+
+func (c *Client) Subscribed(filter string) bool {
+	defer c.RUnlock()
+	c.RLock()
+	_, ok := c.subscriptions[filter]
+	return ok
+}
+
+// The topic filters the client is subscribed to
+func (c *Client) Filters() []string {
+	defer c.RUnlock()
+	c.RLock()
+	filters := make([]string, 0, len(c.subscriptions))
+	for filter := range c.subscriptions {
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// The highest QoS of the client's subscriptions matching
+// topic; false if none does
+func (c *Client) matching(topic string) (byte, bool) {
+	defer c.RUnlock()
+	c.RLock()
+	var qos byte
+	matched := false
+	for filter, q := range c.subscriptions {
+		if TopicMatches(filter, topic) {
+			matched = true
+			if q > qos {
+				qos = q
+			}
+		}
+	}
+	return qos, matched
+}
+
+// Forget the client's subscription to filter. Return false
+// if it was not subscribed.
+func (c *Client) Unsubscribe(filter string) bool {
+	defer c.Unlock()
+	c.Lock()
+	_, ok := c.subscriptions[filter]
+	delete(c.subscriptions, filter)
+	return ok
+}
+
+// The highest QoS granted to the client by any of its
+// subscriptions matching topic
+func (c *Client) GrantedQos(topic string) byte {
+	defer c.RUnlock()
+	c.RLock()
+	var qos byte
+	for filter, q := range c.subscriptions {
+		if q > qos && TopicMatches(filter, topic) {
+			qos = q
+		}
+	}
+	return qos
+}
+
+// Limit the packets sent to the client to n bytes where its
+// path allows less than its listener, as a radio's frames may;
+// 0 leaves the listener's limit. May be set from OnConnect.
+func (c *Client) SetMaxMessageSize(n int) {
+	defer c.Unlock()
+	c.Lock()
+	c.maxMessageSize = n
+}
+
+// Whether m is small enough to be sent to the client, by its
+// own limit and its connection's
+func (c *Client) Fits(m Message) bool {
+	defer c.RUnlock()
+	c.RLock()
+	return c.fits(m)
+}
+
+func (c *Client) fits(m Message) bool {
+	if c.maxMessageSize > 0 && c.Conn.size(m, c.Address) > c.maxMessageSize {
+		return false
+	}
+	return c.Conn.fits(m, c.Address)
+}
+
+// Count a PUBLISH for the client dropped for being too large
+func (c *Client) DropOversized() {
+	defer c.Unlock()
+	c.Lock()
+	c.oversized++
+}
+
+// How many PUBLISHes for the client have been dropped for being
+// too large for it
+func (c *Client) Oversized() uint64 {
+	defer c.RUnlock()
+	c.RLock()
+	return c.oversized
+}
+
+// How many of the client's PUBLISHes, REGISTERs, SUBSCRIBEs and
+// wills the ACL has denied
+func (c *Client) ACLDenials() uint64 {
+	defer c.RUnlock()
+	c.RLock()
+	return c.aclDenials
+}
+
+func (c *Client) deniedByACL() {
 	defer c.Unlock()
 	c.Lock()
-	c.pendingMessages[p.TopicId] = p
+	c.aclDenials++
 }
 
-func (c *Client) FetchPendingMessage(topicId uint16) *PublishMessage {
+// Queue pm for delivery to the client. Messages are delivered
+// in the order they are queued: a message whose topic the
+// client has not registered yet holds back everything queued
+// after it until the REGACK arrives, and QoS 1 and 2 messages
+// are only sent while there is room in the in-flight window.
+// At most one REGISTER is outstanding per topic. Nothing is
+// sent to a sleeping client, and a PUBLISH too large for the
+// client is dropped and counted, never cut short, as is one
+// beyond what its limits let be queued for it.
+func (c *Client) Deliver(pm *PublishMessage, topic string) {
 	defer c.Unlock()
 	c.Lock()
-	pm := c.pendingMessages[topicId]
-	delete(c.pendingMessages, topicId)
-	return pm
+	if !c.fits(pm) {
+		ERROR.Log("PUBLISH too large, dropped", clientLog, logClient(c), logTopic(topic))
+		c.oversized++
+		return
+	}
+	if c.limits.queue > 0 && len(c.outbound) >= c.limits.queue ||
+		c.limits.queueBytes > 0 && c.queuedBytes()+len(pm.Data) > c.limits.queueBytes {
+		ERROR.Log("queue full, PUBLISH dropped", clientLog, logClient(c), logTopic(topic))
+		c.queueDrops++
+		return
+	}
+	c.outbound = append(c.outbound, queued{pm, topic, 0})
+	DEBUG.Log("queued", clientLog, logClient(c), logTopic(topic), Field{"queued", len(c.outbound)})
+	if c.state == ASLEEP {
+		return
+	}
+	c.register(pm, topic)
+	c.flush()
+}
+
+// The bytes of the payloads queued for the client. Must be
+// called with the lock held.
+func (c *Client) queuedBytes() int {
+	n := 0
+	for _, q := range c.outbound {
+		n += len(q.pm.Data)
+	}
+	return n
+}
+
+// How many PUBLISHes for the client have been dropped for its
+// queue being full
+func (c *Client) QueueDrops() uint64 {
+	defer c.RUnlock()
+	c.RLock()
+	return c.queueDrops
+}
+
+// The PUBLISHes queued for the client, the bytes of their
+// payloads and those in flight
+func (c *Client) usage() (queued, queuedBytes, inflight int) {
+	defer c.RUnlock()
+	c.RLock()
+	return len(c.outbound), c.queuedBytes(), len(c.inflight)
+}
+
+// The client is going to sleep; buffer its messages until
+// it wakes
+func (c *Client) Sleep() {
+	defer c.Unlock()
+	c.Lock()
+	INFO.Log("asleep", clientLog, logClient(c))
+	c.state = ASLEEP
+}
+
+// Deliver the messages buffered while the client slept, then
+// send it a PINGRESP and let it sleep again. A REGISTER needed
+// on the way is completed before the PINGRESP; if the client
+// stops answering, it is taken to be asleep again and the
+// messages not yet delivered stay buffered.
+func (c *Client) Wake() {
+	defer c.Unlock()
+	c.Lock()
+	INFO.Log("awake", clientLog, logClient(c), Field{"buffered", len(c.outbound)})
+	c.state = AWAKE
+	for _, q := range c.outbound {
+		c.register(q.pm, q.topic)
+	}
+	c.flush()
+}
+
+// Handle a REGACK from the client, releasing the messages that
+// were waiting on it. Return false if it does not answer the
+// REGISTER in flight for its topic id.
+func (c *Client) AckRegister(m *RegackMessage) bool {
+	defer c.Unlock()
+	c.Lock()
+	rt := c.registering[m.TopicId]
+	if rt == nil || rt.m.(*RegisterMessage).MessageId != m.MessageId {
+		return false
+	}
+	rt.stop()
+	delete(c.registering, m.TopicId)
+	if c.registerRTT != nil && rt.retries == 0 {
+		// a REGACK to a REGISTER resent may answer any of them
+		c.registerRTT.observe(time.Since(rt.sent))
+	}
+	if m.ReturnCode == ACCEPTED {
+		DEBUG.Log("registered", clientLog, logClient(c), logTopicId(m.TopicId), logMsgId(m.MessageId))
+		c.registeredTopics[m.TopicId] = string(rt.m.(*RegisterMessage).TopicName)
+	} else {
+		ERROR.Log(fmt.Sprintf("REGISTER rejected (rc %d)", m.ReturnCode), clientLog, logClient(c), logTopicId(m.TopicId), logMsgId(m.MessageId))
+		c.dropOutbound(m.TopicId)
+	}
+	c.flush()
+	return true
+}
+
+// Handle a PUBACK or PUBCOMP from the client, freeing a slot
+// in the in-flight window. Return false if no PUBLISH with
+// msgId was awaiting acknowledgement.
+func (c *Client) AckPublish(msgId uint16) bool {
+	defer c.Unlock()
+	c.Lock()
+	rt := c.inflight[msgId]
+	if rt == nil {
+		return false
+	}
+	rt.stop()
+	delete(c.inflight, msgId)
+	c.flush()
+	return true
+}
+
+// Handle a PUBACK rejecting a PUBLISH because the client does
+// not know its topic id, as happens when it has restarted. The
+// topic is registered again and the PUBLISH resent, at most
+// maxRecoveries times. Return false if no PUBLISH with msgId
+// was awaiting acknowledgement.
+func (c *Client) PublishRejected(msgId uint16) bool {
+	defer c.Unlock()
+	c.Lock()
+	rt := c.inflight[msgId]
+	if rt == nil || rt.q == nil {
+		return false
+	}
+	rt.stop()
+	delete(c.inflight, msgId)
+	q := *rt.q
+	delete(c.registeredTopics, q.pm.TopicId)
+	if q.pm.TopicIdType == topicIdPredefined {
+		ERROR.Log("predefined topic id unknown to the client, dropping the message", clientLog, logClient(c), logTopic(q.topic), logTopicId(q.pm.TopicId))
+	} else if q.recoveries >= maxRecoveries {
+		ERROR.Log("topic id rejected again, dropping the message", clientLog, logClient(c), logTopic(q.topic), logTopicId(q.pm.TopicId))
+	} else {
+		DEBUG.Log("topic id forgotten, registering it again", clientLog, logClient(c), logTopic(q.topic), logTopicId(q.pm.TopicId))
+		q.recoveries++
+		q.pm.Dup = false
+		c.outbound = append([]queued{q}, c.outbound...)
+		c.register(q.pm, q.topic)
+	}
+	c.flush()
+	return true
+}
+
+// Handle a PUBREC from the client by answering with a PUBREL,
+// which is resent until the PUBCOMP arrives. Return false if
+// no QoS 2 PUBLISH with msgId was in flight.
+func (c *Client) PublishReceived(msgId uint16) bool {
+	defer c.Unlock()
+	c.Lock()
+	rt := c.inflight[msgId]
+	if rt == nil {
+		return false
+	}
+	rt.stop()
+	pr := NewMessage(PUBREL).(*PubrelMessage)
+	pr.MessageId = msgId
+	c.inflight[msgId] = c.startRetransmission(pr, func() {
+		delete(c.inflight, msgId)
+	})
+	if err := c.Write(pr); err != nil {
+		ERROR.Log(err.Error(), clientLog, logClient(c), logMsgId(msgId))
+	}
+	return true
+}
+
+// Record a QoS 2 PUBLISH from the client. Return false if it
+// has arrived already and is still awaiting its PUBREL, when it
+// must not be passed on again.
+func (c *Client) Received(msgId uint16) bool {
+	defer c.Unlock()
+	c.Lock()
+	if c.received[msgId] {
+		return false
+	}
+	c.received[msgId] = true
+	return true
+}
+
+// Handle a PUBREL from the client, completing a QoS 2 PUBLISH.
+// Return false if none with msgId was awaiting it.
+func (c *Client) Released(msgId uint16) bool {
+	defer c.Unlock()
+	c.Lock()
+	if !c.received[msgId] {
+		return false
+	}
+	delete(c.received, msgId)
+	return true
+}
+
+// Send whatever can be sent from the head of the outbound
+// queue, and answer an awake client's PINGREQ once everything
+// has been delivered. Must be called with the lock held.
+func (c *Client) flush() {
+	if c.state == ASLEEP {
+		return
+	}
+	c.sendQueued()
+	if c.state == AWAKE && len(c.outbound) == 0 && len(c.inflight) == 0 && len(c.registering) == 0 {
+		c.setState(ASLEEP)
+		if err := c.Write(NewMessage(PINGRESP)); err != nil {
+			ERROR.Log(err.Error(), clientLog, logClient(c))
+		} else {
+			DEBUG.Log("sent", clientLog, logMsgType(PINGRESP), logClient(c))
+		}
+	}
+}
+
+// Must be called with the lock held.
+func (c *Client) sendQueued() {
+	for len(c.outbound) > 0 {
+		q := c.outbound[0]
+		pm := q.pm
+		if c.needsRegister(pm) {
+			return
+		}
+		if pm.Qos > 0 {
+			if len(c.inflight) >= c.limits.inflight {
+				return
+			}
+			pm.MessageId = c.messageId()
+			msgId := pm.MessageId
+			rt := c.startRetransmission(pm, func() {
+				delete(c.inflight, msgId)
+				if c.state == AWAKE {
+					// keep it for the next time the client wakes
+					c.setState(ASLEEP)
+					c.outbound = append([]queued{q}, c.outbound...)
+				}
+			})
+			rt.q = &q
+			c.inflight[msgId] = rt
+		}
+		c.outbound = c.outbound[1:]
+		if err := c.Write(pm); err != nil {
+			ERROR.Log(err.Error(), clientLog, logClient(c), logTopic(q.topic))
+		} else {
+			DEBUG.Log("sent", clientLog, logMsgType(PUBLISH), logClient(c), logTopic(q.topic), logMsgId(pm.MessageId))
+			if c.onDeliver != nil {
+				c.onDeliver(c, q.topic)
+			}
+		}
+	}
+}
+
+// Remove every queued message for topicId. Must be called
+// with the lock held.
+func (c *Client) dropOutbound(topicId uint16) {
+	kept := c.outbound[:0]
+	for _, q := range c.outbound {
+		if q.pm.TopicId != topicId {
+			kept = append(kept, q)
+		}
+	}
+	if dropped := len(c.outbound) - len(kept); dropped > 0 {
+		ERROR.Log(fmt.Sprintf("dropping %d queued messages", dropped), clientLog, logClient(c), logTopicId(topicId))
+	}
+	c.outbound = kept
+}
+
+// Send a REGISTER for the topic id of pm unless it needs none
+// or one is already in flight. Must be called with the lock
+// held.
+func (c *Client) register(pm *PublishMessage, topic string) {
+	if !c.needsRegister(pm) {
+		return
+	}
+	if _, ok := c.registering[pm.TopicId]; ok {
+		return
+	}
+	c.sendRegister(pm.TopicId, topic)
+}
+
+// Whether pm's topic id must be registered before it is sent,
+// one pre-defined needing no REGISTER. Must be called with the
+// lock held.
+func (c *Client) needsRegister(pm *PublishMessage) bool {
+	if pm.TopicIdType == topicIdPredefined {
+		return false
+	}
+	_, ok := c.registeredTopics[pm.TopicId]
+	return !ok
+}
+
+// Must be called with the lock held.
+func (c *Client) sendRegister(topicId uint16, topic string) {
+	rm := NewRegisterMessage(topicId, c.messageId(), []byte(topic))
+	rt := c.startRetransmission(rm, func() {
+		delete(c.registering, topicId)
+		if c.state == AWAKE {
+			// keep the messages for the next time the client wakes
+			c.setState(ASLEEP)
+		} else {
+			c.dropOutbound(topicId)
+		}
+	})
+	if c.registerRTT != nil {
+		rt.sent = time.Now()
+	}
+	c.registering[topicId] = rt
+	if err := c.Write(rm); err != nil {
+		ERROR.Log("error writing REGISTER: "+err.Error(), clientLog, logClient(c), logTopic(topic))
+	} else {
+		DEBUG.Log("sent", clientLog, logMsgType(REGISTER), logClient(c), logTopic(topic), logTopicId(topicId), logMsgId(rm.MessageId))
+	}
+}
+
+// Must be called with the lock held.
+func (c *Client) messageId() uint16 {
+	c.nextMessageId++
+	if c.nextMessageId == 0 {
+		c.nextMessageId++
+	}
+	return c.nextMessageId
+}
+
+// Arrange for m to be resent until stopped. After the client's
+// retry count of resends giveUp is called, with the lock held, and the
+// outbound queue is flushed.
+func (c *Client) startRetransmission(m Message, giveUp func()) *retransmission {
+	rt := &retransmission{m: m}
+	rt.timer = time.AfterFunc(c.timers.retryInterval, func() {
+		c.Lock()
+		defer c.Unlock()
+		if rt.done {
+			return
+		}
+		if rt.retries >= c.timers.retryCount {
+			ERROR.Log("no acknowledgement, giving up", clientLog, logMsgType(m.MessageType()), logClient(c))
+			rt.done = true
+			giveUp()
+			c.flush()
+			return
+		}
+		rt.retries++
+		if pm, ok := m.(*PublishMessage); ok {
+			pm.Dup = true
+		}
+		rt.timer.Reset(c.timers.retryInterval)
+		DEBUG.Log("resending", clientLog, logMsgType(m.MessageType()), logClient(c), Field{"attempt", rt.retries + 1})
+		if err := c.Write(m); err != nil {
+			ERROR.Log(err.Error(), clientLog, logMsgType(m.MessageType()), logClient(c))
+		}
+	})
+	return rt
+}
+
+// Must be called with the owning client's lock held.
+func (rt *retransmission) stop() {
+	rt.done = true
+	rt.timer.Stop()
+}
+
+// What is kept of a client's session between connections when
+// it connects with CleanSession unset
+type session struct {
+	registeredTopics map[uint16]string
+	subscriptions    map[string]byte
+}
+
+func (c *Client) session() *session {
+	defer c.RUnlock()
+	c.RLock()
+	s := &session{make(map[uint16]string), make(map[string]byte)}
+	for id, topic := range c.registeredTopics {
+		s.registeredTopics[id] = topic
+	}
+	for filter, qos := range c.subscriptions {
+		s.subscriptions[filter] = qos
+	}
+	return s
+}
+
+// Carry on from a previous session
+func (c *Client) resume(s *session) {
+	defer c.Unlock()
+	c.Lock()
+	for id, topic := range s.registeredTopics {
+		c.registeredTopics[id] = topic
+	}
+	for filter, qos := range s.subscriptions {
+		c.subscriptions[filter] = qos
+	}
+}
+
+// Call lost if nothing is heard from the client for d, which
+// starts as its keepalive and becomes its sleep duration while
+// it sleeps, times the grace its timers give either
+func (c *Client) Supervise(d time.Duration, lost func()) {
+	defer c.Unlock()
+	c.Lock()
+	if c.supervisor != nil {
+		c.supervisor.Stop()
+	}
+	c.keepAlive = d
+	c.supervisor = time.AfterFunc(c.silence(), lost)
+}
+
+// Change the duration the client is supervised with
+func (c *Client) SetKeepAlive(d time.Duration) {
+	defer c.Unlock()
+	c.Lock()
+	c.keepAlive = d
+	if c.supervisor != nil {
+		c.supervisor.Reset(c.silence())
+	}
+}
+
+// Record that the client has been heard from
+func (c *Client) Touch() {
+	defer c.Unlock()
+	c.Lock()
+	c.lastSeen = time.Now()
+	if c.supervisor != nil {
+		c.supervisor.Reset(c.silence())
+	}
+}
+
+// How long the client may be silent for before it is lost. Must
+// be called with the lock held.
+func (c *Client) silence() time.Duration {
+	grace := c.timers.keepAliveGrace
+	if c.state == ASLEEP || c.state == AWAKE {
+		grace = c.timers.sleepGrace
+	}
+	return time.Duration(float64(c.keepAlive) * grace)
+}
+
+// Stop all retransmissions to the client, abandoning whatever
+// is queued or in flight, and stop supervising it
+func (c *Client) Close() {
+	defer c.Unlock()
+	c.Lock()
+	if c.supervisor != nil {
+		c.supervisor.Stop()
+	}
+	for _, rt := range c.registering {
+		rt.stop()
+	}
+	for _, rt := range c.inflight {
+		rt.stop()
+	}
+	c.registering = make(map[uint16]*retransmission)
+	c.inflight = make(map[uint16]*retransmission)
+	c.outbound = nil
+}
+
+func (c *Client) base() *Client {
+	return c
 }
 
 func (c *Client) AddrString() string {
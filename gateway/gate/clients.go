@@ -1,7 +1,6 @@
 package gateway
 
 import (
-	"net"
 	"sync"
 )
 
@@ -11,7 +10,7 @@ type Clients struct {
 	clients map[string]SNClient
 }
 
-func (c *Clients) GetClient(addr *net.UDPAddr) SNClient {
+func (c *Clients) GetClient(addr uAddr) SNClient {
 	defer c.RUnlock()
 	c.RLock()
 	return c.clients[addr.String()]
@@ -25,20 +24,46 @@ func (c *Clients) AddClient(client SNClient) bool {
 	defer c.Unlock()
 	c.Lock()
 	addr := client.AddrString()
-	INFO.Println("AddClient(%s - %s)", client, addr)
+	INFO.Printf("AddClient(%s - %s)\n", client, addr)
 	isNew := false
 	if c.clients[addr] == nil {
 		isNew = true
 	}
-	//todo: what to do if clientid is in use?
-	//     is there some cleanup involved in topictree?
+	// the session of a client already at addr must have been
+	// ended, its subscriptions removed, before it is replaced
 	c.clients[addr] = client
 	return isNew
 }
 
-func (c *Clients) RemoveClient(id string) {
+func (c *Clients) RemoveClient(addr uAddr) {
 	defer c.Unlock()
 	c.Lock()
-	INFO.Println("RemoveClient(%s)", id)
-	delete(c.clients, id)
+	INFO.Printf("RemoveClient(%s)\n", addr)
+	delete(c.clients, addr.String())
+}
+
+func (c *Clients) Len() int {
+	defer c.RUnlock()
+	c.RLock()
+	return len(c.clients)
+}
+
+// Call f for each client. f is called on a snapshot, so it
+// may use the other methods of Clients.
+func (c *Clients) Range(f func(SNClient)) {
+	c.RLock()
+	clients := make([]SNClient, 0, len(c.clients))
+	for _, client := range c.clients {
+		clients = append(clients, client)
+	}
+	c.RUnlock()
+	for _, client := range clients {
+		f(client)
+	}
+}
+
+func (c *Clients) Clear() {
+	defer c.Unlock()
+	c.Lock()
+	c.clients = make(map[string]SNClient)
 }
@@ -4,8 +4,15 @@ import (
 	"bufio"
 	"bytes"
 	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type GatewayConfig struct {
@@ -15,25 +22,679 @@ type GatewayConfig struct {
 	mqttuser     string
 	mqttpassword string
 	mqttclientid string
-	mqtttimeout  int
+	mqttcafile   string
+	mqttcertfile string
+	mqttkeyfile  string
+	mqttsni      string
+	mqttinsecure bool
+	mqttheaders  http.Header
+	mqtttimeout  time.Duration
+	mqttversion  int
+	mqttsession  bool
+	maxclients   int
+	maxtopics    int
+	clientqueue  int
+	clientbytes  int
+	clientwindow int
+	publishrate  int
+	publishbytes int
+	publishlimit []publishLimit
+	violations   int
+	bindaddress  string
+	udpreaders   int
+	maxmsgsize   int
+	maxoutbound  int
+	oversize     string
+	dtlsport     int
+	tcpport      int
+	unixsocket   string
+	unixmode     os.FileMode
+	serialdevice string
+	serialbaud   int
+	listeners    []listenerConfig
+
+	sourcerate      int
+	sourceburst     int
+	sourceexempt    []*net.IPNet
+	sourceaddresses int
+	sourceallow     []*net.IPNet
+	sourcedeny      []*net.IPNet
+	sourcedenylog   int
+
+	unconnectedrate   int
+	unconnectedaddrs  int
+	unknowndisconnect time.Duration
+
+	faultloss      float64
+	faultduplicate float64
+	faultdelay     time.Duration
+	faultjitter    time.Duration
+	faultreorder   int
+	faultseed      int
+
+	tcpidletimeout time.Duration
+	idletimeout    time.Duration
+	maxconnections int
+
+	disconnectonstop bool
+	draintimeout     time.Duration
+
+	clientidprefix   string
+	clientidmaxlen   int
+	clientidoverflow string
+
+	credentialsfile     string
+	credentialsrequired bool
+	clientallow         []string
+	clientallowfile     string
+	aclfile             string
+	acldefaultallow     bool
+	authregistryfile    string
+	connecttimeout      time.Duration
+	publishtimeout      time.Duration
+
+	maxbrokerconns     int
+	brokerconnectrate  int
+	brokerconnectqueue bool
+	brokerreconnects   int
+	offlinequeue       int
+	offlinequeueqos0   int
+	offlineackearly    bool
+	offlinequeuefile   string
+	offlineconnect     string
+
+	upstreamqos      *qosMap
+	upstreaminflight int
+	upstreamqueue    int
+	topicprefix      string
+	sharegroup       string
+	shareprefixes    []string
+	upstreamechoes   string
+	upstreams        []upstreamConfig
+	routes           []routeConfig
+	predefined       []predefinedTopic
+
+	statustopic   string
+	eventstopic   string
+	eventsqos     int
+	eventsrate    int
+	statusonline  string
+	statusoffline string
+	statusqos     int
+
+	sessionexpiry int
+	topicaliases  int
+	messageexpiry []expiryRule
+
+	keepalivemultiplier int
+	keepalivemax        time.Duration
+	keepalivedefault    time.Duration
+
+	gatewayid          int
+	advertiseinterval  time.Duration
+	multicastgroup     string
+	multicastinterface string
+	multicastloopback  bool
+	searchgwdelay      time.Duration
+
+	retryinterval  time.Duration
+	retrycount     int
+	keepalivegrace float64
+	sleepgrace     float64
+
+	dtlspskfile            string
+	dtlscertfile           string
+	dtlskeyfile            string
+	dtlsclientcafile       string
+	dtlsclientcertrequired bool
+
+	loglevel        string
+	logformat       string
+	logdestination  string
+	logmaxsize      int
+	logmaxbackups   int
+	logmaxage       time.Duration
+	logsync         string
+	auditfile       string
+	auditmaxsize    int
+	auditmaxbackups int
+	auditsync       string
+	logsyslogaddr   string
+	logsyslogtag    string
+	logpackets      bool
+	logpacketsid    string
+	logpacketsaddr  string
+	tracedclients   []string
+	traceduration   time.Duration
+
+	adminaddress     string
+	admintoken       string
+	adminpprof       bool
+	adminpprofpublic bool
+	adminpprofmutex  int
+	adminpprofblock  int
+	adminreadyany    bool
+
+	sysinterval time.Duration
+	sysprefix   string
+
+	capture           bool
+	capturefile       string
+	capturemaxsize    int
+	capturemaxbackups int
+
+	latencyregisterrtt bool
+
+	layers configLayers
 }
 
 func (gc *GatewayConfig) IsAggregating() bool {
 	return gc.aggregating
 }
 
+// How long a drain waits for clients to disconnect, 60
+// seconds unless configured
+func (gc *GatewayConfig) DrainTimeout() time.Duration {
+	if gc.draintimeout > 0 {
+		return gc.draintimeout
+	}
+	return 60 * time.Second
+}
+
+// How often the gateway advertises itself,
+// defaultAdvertiseInterval unless configured
+func (gc *GatewayConfig) advertiseInterval() time.Duration {
+	if gc.advertiseinterval > 0 {
+		return gc.advertiseinterval
+	}
+	return defaultAdvertiseInterval
+}
+
+// The address to listen on: the bind address, with the port
+// unless it has its own
+func (gc *GatewayConfig) listenAddress() string {
+	switch {
+	case gc.bindaddress == "":
+		return port2str(gc.port)
+	case parseIP(gc.bindaddress) != nil:
+		return net.JoinHostPort(gc.bindaddress, strconv.Itoa(gc.port))
+	default:
+		return gc.bindaddress
+	}
+}
+
+// The address to listen for DTLS clients on: the host of the
+// bind address with the DTLS port, none without a DTLS port
+func (gc *GatewayConfig) dtlsAddress() string {
+	return gc.portAddress(gc.dtlsport)
+}
+
+// The address to listen for TCP clients on, like dtlsAddress
+func (gc *GatewayConfig) tcpAddress() string {
+	return gc.portAddress(gc.tcpport)
+}
+
+// The host of the bind address with port, none if port is 0
+func (gc *GatewayConfig) portAddress(port int) string {
+	if port == 0 {
+		return ""
+	}
+	host := gc.bindaddress
+	if parseIP(host) == nil {
+		host, _, _ = net.SplitHostPort(gc.bindaddress)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// The mode of the unix socket, 0660 unless configured
+func (gc *GatewayConfig) unixSocketMode() os.FileMode {
+	if gc.unixmode != 0 {
+		return gc.unixmode
+	}
+	return 0660
+}
+
+// The baud rate of the serial device, 115200 unless configured
+func (gc *GatewayConfig) serialBaud() int {
+	if gc.serialbaud > 0 {
+		return gc.serialbaud
+	}
+	return defaultSerialBaud
+}
+
+// How long a TCP connection may be idle, as long as any
+// connection unless configured
+func (gc *GatewayConfig) tcpIdleTimeout() time.Duration {
+	if gc.tcpidletimeout > 0 {
+		return gc.tcpidletimeout
+	}
+	return gc.connectionIdleTimeout()
+}
+
+// How long a TCP connection or DTLS session may be idle, before
+// its client connects or after, 5 minutes unless configured
+func (gc *GatewayConfig) connectionIdleTimeout() time.Duration {
+	if gc.idletimeout > 0 {
+		return gc.idletimeout
+	}
+	return defaultIdleTimeout
+}
+
+// How many TCP connections and DTLS sessions may be open at
+// once, 10000 unless configured
+func (gc *GatewayConfig) maxConnections() int {
+	if gc.maxconnections > 0 {
+		return gc.maxconnections
+	}
+	return defaultMaxConnections
+}
+
+// The largest packet sent or received, 1400 bytes unless
+// configured
+func (gc *GatewayConfig) maxMessageSize() int {
+	if gc.maxmsgsize > 0 {
+		return gc.maxmsgsize
+	}
+	return defaultMaxMessageSize
+}
+
+// The keepalive of the aggregating gateway's broker connection,
+// defaultMQTTKeepAlive unless configured
+func (gc *GatewayConfig) brokerKeepAlive() time.Duration {
+	if gc.mqtttimeout > 0 {
+		return gc.mqtttimeout
+	}
+	return defaultMQTTKeepAlive
+}
+
+// How long connecting to the broker may take,
+// defaultConnectTimeout unless configured
+func (gc *GatewayConfig) brokerConnectTimeout() time.Duration {
+	if gc.connecttimeout > 0 {
+		return gc.connecttimeout
+	}
+	return defaultConnectTimeout
+}
+
+// How long the aggregating gateway waits for the broker to have
+// a message it publishes, brokerTimeout unless configured
+func (gc *GatewayConfig) publishTimeout() time.Duration {
+	if gc.publishtimeout > 0 {
+		return gc.publishtimeout
+	}
+	return brokerTimeout
+}
+
+// What is done with new clients while the broker is unreachable,
+// offlineBuffer unless configured
+func (gc *GatewayConfig) offlineConnects() string {
+	if gc.offlineconnect != "" {
+		return gc.offlineconnect
+	}
+	return offlineBuffer
+}
+
+// What is done with the messages the broker sends back that the
+// gateway published itself, echoOthers unless configured
+func (gc *GatewayConfig) echoPolicy() string {
+	if gc.upstreamechoes != "" {
+		return gc.upstreamechoes
+	}
+	return echoOthers
+}
+
+// What is logged, levelInfo unless configured
+func (gc *GatewayConfig) logLevel() string {
+	if gc.loglevel != "" {
+		return gc.loglevel
+	}
+	return levelInfo
+}
+
+// How lines are logged, logText unless configured
+func (gc *GatewayConfig) logFormat() string {
+	if gc.logformat != "" {
+		return gc.logformat
+	}
+	return logText
+}
+
+// Where lines are logged, logStdout unless configured
+func (gc *GatewayConfig) logDestination() string {
+	if gc.logdestination != "" {
+		return gc.logdestination
+	}
+	return logStdout
+}
+
+// What lines sent to syslog are tagged with, defaultSyslogTag
+// unless configured
+func (gc *GatewayConfig) logSyslogTag() string {
+	if gc.logsyslogtag != "" {
+		return gc.logsyslogtag
+	}
+	return defaultSyslogTag
+}
+
+// The topics the gateway's statistics are published under
+func (gc *GatewayConfig) sysPrefix() string {
+	if gc.sysprefix != "" {
+		return gc.sysprefix
+	}
+	return defaultSysPrefix
+}
+
+// Whether /readyz waits for the broker
+func (gc *GatewayConfig) readyBroker() bool {
+	return !gc.adminreadyany
+}
+
+// The file packets are captured to, and how it rolls over
+func (gc *GatewayConfig) captureConfig() captureConfig {
+	conf := captureConfig{gc.capturefile, int64(gc.capturemaxsize), gc.capturemaxbackups}
+	if conf.maxSize == 0 {
+		conf.maxSize = defaultCaptureMaxSize
+	}
+	if conf.maxBackups == 0 {
+		conf.maxBackups = defaultCaptureMaxBackups
+	}
+	return conf
+}
+
+// The packets dumped, nil unless log-packets is given
+func (gc *GatewayConfig) packetDump() *packetDump {
+	if !gc.logpackets {
+		return nil
+	}
+	return newPacketDump(gc.logpacketsid, gc.logpacketsaddr)
+}
+
+// How long a client is traced for, unless the admin API asks
+// for longer or shorter
+// How long after a DISCONNECT to an address with no session
+// another is held back, 0 for never
+func (gc *GatewayConfig) unknownDisconnectInterval() time.Duration {
+	switch {
+	case gc.unknowndisconnect < 0:
+		return 0
+	case gc.unknowndisconnect == 0:
+		return defaultUnknownDisconnectInterval
+	}
+	return gc.unknowndisconnect
+}
+
+func (gc *GatewayConfig) traceDuration() time.Duration {
+	if gc.traceduration <= 0 {
+		return defaultTraceDuration
+	}
+	return gc.traceduration
+}
+
+// The file logged to, and how it rotates and is synced
+func (gc *GatewayConfig) logFile() logFileConfig {
+	lf := logFileConfig{
+		gc.logDestination(),
+		int64(gc.logmaxsize),
+		gc.logmaxbackups,
+		gc.logmaxage,
+		false,
+		0,
+	}
+	lf.syncLine, lf.syncEvery = syncPolicy(gc.logsync)
+	return lf
+}
+
+// The audit file, synced after every entry unless audit-sync
+// says otherwise
+func (gc *GatewayConfig) auditFile() logFileConfig {
+	lf := logFileConfig{
+		gc.auditfile,
+		int64(gc.auditmaxsize),
+		gc.auditmaxbackups,
+		0,
+		true,
+		0,
+	}
+	if gc.auditsync != "" {
+		lf.syncLine, lf.syncEvery = syncPolicy(gc.auditsync)
+	}
+	return lf
+}
+
+// Whether a file is synced after every line, or how often, as
+// sync, none, line or a duration, has it
+func syncPolicy(sync string) (line bool, every time.Duration) {
+	switch sync {
+	case "", logSyncNone:
+		return false, 0
+	case logSyncLine:
+		return true, 0
+	}
+	every, _ = time.ParseDuration(sync)
+	return false, every
+}
+
+// What is done with a message from the broker too large for
+// some of the clients it is for, oversizeFit unless configured
+func (gc *GatewayConfig) oversizePolicy() string {
+	if gc.oversize != "" {
+		return gc.oversize
+	}
+	return oversizeFit
+}
+
+// The timers of the exchanges with clients, the specification's
+// defaults unless configured
+func (gc *GatewayConfig) protocolTimers() protocolTimers {
+	t := defaultTimers()
+	if gc.retryinterval > 0 {
+		t.retryInterval = gc.retryinterval
+	}
+	if gc.retrycount > 0 {
+		t.retryCount = gc.retrycount
+	}
+	if gc.keepalivegrace > 0 {
+		t.keepAliveGrace = gc.keepalivegrace
+	}
+	if gc.sleepgrace > 0 {
+		t.sleepGrace = gc.sleepgrace
+	}
+	return t
+}
+
+// The limits of what is kept for each client, the defaults
+// unless configured
+func (gc *GatewayConfig) clientLimits() clientLimits {
+	l := defaultClientLimits()
+	if gc.clientqueue > 0 {
+		l.queue = gc.clientqueue
+	}
+	l.queueBytes = gc.clientbytes
+	if gc.clientwindow > 0 {
+		l.inflight = gc.clientwindow
+	}
+	return l
+}
+
+func (gc *GatewayConfig) publishLimits() publishLimits {
+	return publishLimits{
+		gc.publishlimit,
+		publishLimit{"", gc.publishrate, gc.publishbytes},
+		gc.violations,
+	}
+}
+
+// The faults to inject into the packets the gateway listens
+// for, nil unless any are configured. Without a seed the time
+// is used, the faults being logged with it.
+func (gc *GatewayConfig) faults() *Faults {
+	if gc.faultloss == 0 && gc.faultduplicate == 0 && gc.faultdelay == 0 && gc.faultjitter == 0 && gc.faultreorder == 0 {
+		return nil
+	}
+	f := &Faults{
+		gc.faultloss,
+		gc.faultduplicate,
+		gc.faultdelay,
+		gc.faultjitter,
+		gc.faultreorder,
+		int64(gc.faultseed),
+	}
+	if f.Seed == 0 {
+		f.Seed = time.Now().UnixNano()
+	}
+	return f
+}
+
+// What the broker connections carry for an MQTT v5 broker, nil
+// for a v3 one. A session a client asks to keep is kept a day,
+// and up to 32 topic aliases are used, unless configured.
+func (gc *GatewayConfig) mqtt5() *mqtt5Config {
+	if gc.mqttversion != 5 {
+		return nil
+	}
+	m := &mqtt5Config{defaultSessionExpiry, defaultTopicAliases, gc.messageexpiry}
+	if gc.sessionexpiry > 0 {
+		m.sessionExpiry = uint32(gc.sessionexpiry)
+	}
+	switch {
+	case gc.topicaliases < 0:
+		// configured as 0
+		m.topicAliases = 0
+	case gc.topicaliases > 0:
+		m.topicAliases = uint16(gc.topicaliases)
+	}
+	return m
+}
+
+// The QoS each PUBLISH is sent to the broker with, the client's
+// own unless configured
+func (gc *GatewayConfig) qosMap() *qosMap {
+	if gc.upstreamqos != nil {
+		return gc.upstreamqos
+	}
+	return newQosMap()
+}
+
+// The shared subscriptions the aggregating gateway makes, nil
+// unless upstream-share-group is configured
+func (gc *GatewayConfig) sharing() *sharing {
+	if gc.sharegroup == "" {
+		return nil
+	}
+	return &sharing{gc.sharegroup, gc.shareprefixes}
+}
+
+// Where the aggregating gateway publishes its availability, nil
+// unless status-topic is configured. It is "online" or
+// "offline" at QoS 1 unless configured.
+func (gc *GatewayConfig) status() *status {
+	if gc.statustopic == "" {
+		return nil
+	}
+	st := &status{gc.statustopic, "online", "offline", 1}
+	if gc.statusonline != "" {
+		st.online = gc.statusonline
+	}
+	if gc.statusoffline != "" {
+		st.offline = gc.statusoffline
+	}
+	switch {
+	case gc.statusqos < 0:
+		// configured as 0
+		st.qos = 0
+	case gc.statusqos > 0:
+		st.qos = byte(gc.statusqos)
+	}
+	return st
+}
+
+func (gc *GatewayConfig) brokerTLS() brokerTLS {
+	return brokerTLS{
+		gc.mqttcafile,
+		gc.mqttcertfile,
+		gc.mqttkeyfile,
+		gc.mqttsni,
+		gc.mqttinsecure,
+	}
+}
+
+func (gc *GatewayConfig) dtlsFiles() dtlsFiles {
+	return dtlsFiles{
+		gc.dtlspskfile,
+		gc.dtlscertfile,
+		gc.dtlskeyfile,
+		gc.dtlsclientcafile,
+		gc.dtlsclientcertrequired,
+	}
+}
+
+// Parse a configuration file, in the format its name or content
+// suggests, and validate it
 func ParseConfigFile(file string) (*GatewayConfig, error) {
+	return LoadConfig([]string{file}, "", nil)
+}
+
+// Parse a configuration file in format, plain, json or yaml, or
+// in the format its name or content suggests if format is "",
+// and validate it
+func ParseConfigFileFormat(file, format string) (*GatewayConfig, error) {
+	return LoadConfig([]string{file}, format, nil)
+}
+
+// The configuration of files, each in format as
+// ParseConfigFileFormat has it and overriding those before it,
+// overridden by the environment and then by flags, if not nil,
+// and validated. Without a file the flags and environment must
+// at least give a broker and port.
+func LoadConfig(files []string, format string, flags *ConfigFlags) (*GatewayConfig, error) {
 	gc := &GatewayConfig{}
-	if bytes, rerr := ioutil.ReadFile(file); rerr != nil {
-		return nil, rerr
-	} else {
-		if perr := gc.parseConfig(string(bytes)); perr != nil {
-			return nil, perr
+	for _, file := range files {
+		if err := gc.parseLayer(file, format); err != nil {
+			return nil, err
+		}
+	}
+	gc.beginLayer()
+	if err := gc.SetEnvironment(); err != nil {
+		return nil, err
+	}
+	if flags != nil {
+		gc.beginLayer()
+		if err := flags.Apply(gc); err != nil {
+			return nil, err
 		}
 	}
+	gc.layers = configLayers{}
+	if len(files) == 0 && !gc.isUsable() {
+		ERROR.Println("No configuration file, nor a broker and port")
+		return nil, ErrNoConfiguration
+	}
+	if err := gc.Validate(); err != nil {
+		return nil, err
+	}
 	return gc, nil
 }
 
+// Set the options of file, in format
+func (gc *GatewayConfig) parseFile(file, format string) error {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if format == "" {
+		format = configFormat(file, bytes)
+	}
+	switch format {
+	case configPlain:
+		return gc.parseConfig(string(bytes))
+	case configJSON:
+		return gc.UnmarshalJSON(bytes)
+	case configYAML:
+		return gc.parseYAML(bytes)
+	}
+	ERROR.Printf("Invalid configuration format (not plain, json or yaml): \"%s\"", format)
+	return ErrInvalidConfigFormat
+}
+
 func (gc *GatewayConfig) parseConfig(config string) error {
 	scanner := bufio.NewScanner(bytes.NewReader([]byte(config)))
 	scanner.Split(bufio.ScanLines)
@@ -79,6 +740,100 @@ func (gc *GatewayConfig) setOption(key, value string) error {
 		gc.aggregating, e = checkMode(value)
 	case "port":
 		gc.port, e = checkNum("port", value)
+	case "bind-address":
+		gc.bindaddress, e = checkBindAddress(value)
+	case "max-message-size":
+		gc.maxmsgsize, e = checkMessageSize("max-message-size", value)
+	case "max-outbound-size":
+		gc.maxoutbound, e = checkMessageSize("max-outbound-size", value)
+	case "oversize-policy":
+		gc.oversize, e = checkOversizePolicy(value)
+	case "udp-readers":
+		gc.udpreaders, e = checkNum("udp-readers", value)
+	case "source-rate-limit":
+		gc.sourcerate, e = checkNum("source-rate-limit", value)
+	case "source-rate-burst":
+		gc.sourceburst, e = checkNum("source-rate-burst", value)
+	case "source-rate-exempt":
+		var exempt []*net.IPNet
+		exempt, e = checkNetworks("source-rate-exempt", value)
+		gc.sourceexempt = append(gc.sourceexempt, exempt...)
+	case "source-rate-addresses":
+		gc.sourceaddresses, e = checkNum("source-rate-addresses", value)
+	case "source-allow":
+		var allow []*net.IPNet
+		allow, e = checkNetworks("source-allow", value)
+		gc.sourceallow = append(gc.sourceallow, allow...)
+	case "source-deny":
+		var deny []*net.IPNet
+		deny, e = checkNetworks("source-deny", value)
+		gc.sourcedeny = append(gc.sourcedeny, deny...)
+	case "source-deny-log":
+		gc.sourcedenylog, e = checkNum("source-deny-log", value)
+	case "unconnected-packet-rate":
+		gc.unconnectedrate, e = checkNum("unconnected-packet-rate", value)
+	case "unconnected-address-rate":
+		gc.unconnectedaddrs, e = checkNum("unconnected-address-rate", value)
+	case "unknown-disconnect-interval":
+		if gc.unknowndisconnect, e = checkDuration("unknown-disconnect-interval", value); e == nil && gc.unknowndisconnect == 0 {
+			gc.unknowndisconnect = -1
+		}
+	case "fault-loss":
+		gc.faultloss, e = checkProbability("fault-loss", value)
+	case "fault-duplicate":
+		gc.faultduplicate, e = checkProbability("fault-duplicate", value)
+	case "fault-delay":
+		gc.faultdelay, e = parseDuration("fault-delay", value, time.Millisecond)
+	case "fault-jitter":
+		gc.faultjitter, e = parseDuration("fault-jitter", value, time.Millisecond)
+	case "fault-reorder":
+		gc.faultreorder, e = checkNum("fault-reorder", value)
+	case "fault-seed":
+		gc.faultseed, e = checkNum("fault-seed", value)
+	case "listener":
+		var lc listenerConfig
+		lc, e = checkListener(value)
+		if e == nil {
+			gc.listeners = append(gc.listeners, lc)
+		}
+	case "dtls-port":
+		gc.dtlsport, e = checkNum("dtls-port", value)
+	case "gateway-id":
+		gc.gatewayid, e = checkGatewayId(value)
+	case "advertise-interval":
+		gc.advertiseinterval, e = parseDuration("advertise-interval", value, time.Second)
+	case "multicast-group":
+		gc.multicastgroup, e = checkMulticastGroup(value)
+	case "multicast-interface":
+		gc.multicastinterface = value
+	case "multicast-loopback":
+		gc.multicastloopback, e = checkBool("multicast-loopback", value)
+	case "serial-device":
+		gc.serialdevice = value
+	case "serial-baud":
+		gc.serialbaud, e = checkNum("serial-baud", value)
+	case "tcp-port":
+		gc.tcpport, e = checkNum("tcp-port", value)
+	case "unix-socket":
+		gc.unixsocket = value
+	case "unix-socket-mode":
+		gc.unixmode, e = checkFileMode("unix-socket-mode", value)
+	case "tcp-idle-timeout":
+		gc.tcpidletimeout, e = parseDuration("tcp-idle-timeout", value, time.Second)
+	case "connection-idle-timeout":
+		gc.idletimeout, e = parseDuration("connection-idle-timeout", value, time.Second)
+	case "max-connections":
+		gc.maxconnections, e = checkNum("max-connections", value)
+	case "dtls-psk-file":
+		gc.dtlspskfile = value
+	case "dtls-cert-file":
+		gc.dtlscertfile = value
+	case "dtls-key-file":
+		gc.dtlskeyfile = value
+	case "dtls-client-ca-file":
+		gc.dtlsclientcafile = value
+	case "dtls-client-cert-required":
+		gc.dtlsclientcertrequired, e = checkBool("dtls-client-cert-required", value)
 	case "mqtt-broker":
 		gc.mqttbroker, e = checkURI(value)
 	case "mqtt-user":
@@ -87,8 +842,270 @@ func (gc *GatewayConfig) setOption(key, value string) error {
 		gc.mqttpassword = value
 	case "mqtt-clientid":
 		gc.mqttclientid = value
-	case "mqtt-timeout":
-		gc.mqtttimeout, e = checkNum("mqtt-timeout", value)
+	case "mqtt-ca-file":
+		gc.mqttcafile = value
+	case "mqtt-cert-file":
+		gc.mqttcertfile = value
+	case "mqtt-key-file":
+		gc.mqttkeyfile = value
+	case "mqtt-server-name":
+		gc.mqttsni = value
+	case "mqtt-protocol-version":
+		gc.mqttversion, e = checkProtocolVersion(value)
+	case "mqtt-clean-session":
+		var clean bool
+		clean, e = checkBool("mqtt-clean-session", value)
+		gc.mqttsession = !clean
+	case "mqtt-session-expiry":
+		gc.sessionexpiry, e = checkExpiry("mqtt-session-expiry", value)
+	case "mqtt-topic-aliases":
+		if gc.topicaliases, e = checkTopicAliases(value); e == nil && gc.topicaliases == 0 {
+			gc.topicaliases = -1
+		}
+	case "mqtt-message-expiry":
+		var r expiryRule
+		if r, e = checkExpiryRule(value); e == nil {
+			gc.messageexpiry = append(replaceInherited(gc.messageexpiry, &gc.layers.expiry, func(er expiryRule) bool {
+				return er.filter == r.filter
+			}), r)
+		}
+	case "upstream-qos":
+		var sn, qos int
+		if sn, qos, e = checkQosMapping(value); e == nil {
+			if gc.upstreamqos == nil {
+				gc.upstreamqos = newQosMap()
+			}
+			gc.upstreamqos.levels[byte(sn)&0x03] = byte(qos)
+		}
+	case "upstream-inflight":
+		gc.upstreaminflight, e = checkNum("upstream-inflight", value)
+	case "upstream-queue":
+		gc.upstreamqueue, e = checkNum("upstream-queue", value)
+	case "upstream-share-group":
+		gc.sharegroup, e = checkShareGroup(value)
+	case "upstream-share-topic":
+		gc.shareprefixes = append(gc.shareprefixes, value)
+	case "upstream-echoes":
+		gc.upstreamechoes, e = checkEchoPolicy(value)
+	case "topic-prefix":
+		gc.topicprefix, e = checkTopicPrefix(value)
+	case "upstream-broker":
+		var uc upstreamConfig
+		if uc, e = checkUpstream(value, gc.upstreams[gc.layers.upstreams:]); e == nil {
+			gc.upstreams = append(replaceInherited(gc.upstreams, &gc.layers.upstreams, func(u upstreamConfig) bool {
+				return u.name == uc.name
+			}), uc)
+		}
+	case "upstream-route":
+		var rc routeConfig
+		if rc, e = checkRoute(value, gc.upstreams); e == nil {
+			gc.routes = append(replaceInherited(gc.routes, &gc.layers.routes, func(r routeConfig) bool {
+				return r.prefix == rc.prefix
+			}), rc)
+		}
+	case "include":
+		e = gc.include(value)
+	case "predefined-topic":
+		var pt predefinedTopic
+		if pt, e = checkPredefined(value, gc.predefined[gc.layers.predefined:]); e == nil {
+			gc.predefined = append(replaceInherited(gc.predefined, &gc.layers.predefined, func(p predefinedTopic) bool {
+				return p.id == pt.id
+			}), pt)
+		}
+	case "upstream-qos-topic":
+		var prefix string
+		var qos int
+		if prefix, qos, e = checkQosPrefix(value); e == nil {
+			if gc.upstreamqos == nil {
+				gc.upstreamqos = newQosMap()
+			}
+			gc.upstreamqos.setPrefix(prefix, byte(qos))
+		}
+	case "status-topic":
+		if _, e = ValidateTopicName(value); e == nil {
+			gc.statustopic = value
+		} else {
+			ERROR.Printf("Invalid value specified for \"status-topic\" (%v): \"%s\"", e, value)
+		}
+	case "events-topic":
+		if _, e = ValidateTopicName(value); e == nil {
+			gc.eventstopic = value
+		} else {
+			ERROR.Printf("Invalid value specified for \"events-topic\" (%v): \"%s\"", e, value)
+		}
+	case "events-qos":
+		gc.eventsqos, e = checkQos("events-qos", value)
+	case "events-rate":
+		gc.eventsrate, e = checkNum("events-rate", value)
+	case "status-online":
+		gc.statusonline = value
+	case "status-offline":
+		gc.statusoffline = value
+	case "status-qos":
+		if gc.statusqos, e = checkQos("status-qos", value); e == nil && gc.statusqos == 0 {
+			gc.statusqos = -1
+		}
+	case "mqtt-header":
+		var name, v string
+		if name, v, e = checkHeader(value); e == nil {
+			gc.addHeader(name, v)
+		}
+	case "mqtt-insecure-skip-verify":
+		gc.mqttinsecure, e = checkBool("mqtt-insecure-skip-verify", value)
+	case "mqtt-keepalive", "mqtt-timeout":
+		// mqtt-timeout is the older name
+		gc.mqtttimeout, e = parseDuration(key, value, time.Second)
+	case "publish-timeout":
+		gc.publishtimeout, e = parseDuration("publish-timeout", value, time.Second)
+	case "max-clients":
+		gc.maxclients, e = checkNum("max-clients", value)
+	case "max-topics":
+		gc.maxtopics, e = checkNum("max-topics", value)
+	case "client-queue":
+		gc.clientqueue, e = checkNum("client-queue", value)
+	case "client-queue-bytes":
+		gc.clientbytes, e = checkNum("client-queue-bytes", value)
+	case "client-inflight":
+		gc.clientwindow, e = checkNum("client-inflight", value)
+	case "client-publish-rate":
+		gc.publishrate, e = checkNum("client-publish-rate", value)
+	case "client-publish-bytes":
+		gc.publishbytes, e = checkNum("client-publish-bytes", value)
+	case "client-publish-limit":
+		var l publishLimit
+		if l, e = checkPublishLimit(value); e == nil {
+			gc.publishlimit = append(gc.publishlimit, l)
+		}
+	case "client-publish-violations":
+		gc.violations, e = checkNum("client-publish-violations", value)
+	case "drain-timeout":
+		gc.draintimeout, e = parseDuration("drain-timeout", value, time.Second)
+	case "client-id-prefix":
+		gc.clientidprefix = value
+	case "client-id-max-length":
+		gc.clientidmaxlen, e = checkNum("client-id-max-length", value)
+	case "client-id-overflow":
+		gc.clientidoverflow, e = checkOverflow(value)
+	case "credentials-file":
+		gc.credentialsfile = value
+	case "credentials-required":
+		gc.credentialsrequired, e = checkBool("credentials-required", value)
+	case "client-allow":
+		var ids []string
+		ids, e = checkClientAllow(value)
+		gc.clientallow = append(gc.clientallow, ids...)
+	case "client-allow-file":
+		gc.clientallowfile = value
+	case "acl-file":
+		gc.aclfile = value
+	case "acl-default":
+		gc.acldefaultallow, e = checkACLDefault(value)
+	case "auth-registry-file":
+		gc.authregistryfile = value
+	case "connect-timeout":
+		gc.connecttimeout, e = parseDuration("connect-timeout", value, time.Second)
+	case "max-broker-connections":
+		gc.maxbrokerconns, e = checkNum("max-broker-connections", value)
+	case "broker-connect-rate":
+		gc.brokerconnectrate, e = checkNum("broker-connect-rate", value)
+	case "broker-connect-queue":
+		gc.brokerconnectqueue, e = checkBool("broker-connect-queue", value)
+	case "broker-reconnects":
+		gc.brokerreconnects, e = checkNum("broker-reconnects", value)
+	case "broker-offline-queue":
+		gc.offlinequeue, e = checkNum("broker-offline-queue", value)
+	case "broker-offline-queue-qos0":
+		gc.offlinequeueqos0, e = checkNum("broker-offline-queue-qos0", value)
+	case "broker-offline-ack-early":
+		gc.offlineackearly, e = checkBool("broker-offline-ack-early", value)
+	case "broker-offline-queue-file":
+		gc.offlinequeuefile = value
+	case "broker-offline-connect":
+		gc.offlineconnect, e = checkOfflineConnect(value)
+	case "keepalive-multiplier":
+		gc.keepalivemultiplier, e = checkNum("keepalive-multiplier", value)
+	case "keepalive-max":
+		gc.keepalivemax, e = parseDuration("keepalive-max", value, time.Second)
+	case "keepalive-default":
+		gc.keepalivedefault, e = parseDuration("keepalive-default", value, time.Second)
+	case "disconnect-on-stop":
+		gc.disconnectonstop, e = checkBool("disconnect-on-stop", value)
+	case "retry-interval":
+		gc.retryinterval, e = checkInterval("retry-interval", value)
+	case "retry-count":
+		gc.retrycount, e = checkCount("retry-count", value)
+	case "keepalive-grace":
+		gc.keepalivegrace, e = checkGrace("keepalive-grace", value)
+	case "sleep-grace":
+		gc.sleepgrace, e = checkGrace("sleep-grace", value)
+	case "searchgw-delay":
+		gc.searchgwdelay, e = checkDuration("searchgw-delay", value)
+	case "log-level":
+		gc.loglevel, e = checkLogLevel(value)
+	case "log-format":
+		gc.logformat, e = checkLogFormat(value)
+	case "log-destination":
+		gc.logdestination = value
+	case "log-max-size":
+		gc.logmaxsize, e = checkNum("log-max-size", value)
+	case "log-max-backups":
+		gc.logmaxbackups, e = checkNum("log-max-backups", value)
+	case "log-max-age":
+		gc.logmaxage, e = checkDuration("log-max-age", value)
+	case "log-sync":
+		gc.logsync, e = checkLogSync(value)
+	case "audit-file":
+		gc.auditfile = value
+	case "audit-max-size":
+		gc.auditmaxsize, e = checkNum("audit-max-size", value)
+	case "audit-max-backups":
+		gc.auditmaxbackups, e = checkNum("audit-max-backups", value)
+	case "audit-sync":
+		gc.auditsync, e = checkSync("audit-sync", value, ErrInvalidAuditSync)
+	case "log-syslog-address":
+		gc.logsyslogaddr, e = checkSyslogAddress(value)
+	case "log-syslog-tag":
+		gc.logsyslogtag = value
+	case "log-packets":
+		gc.logpackets, e = checkBool("log-packets", value)
+	case "log-packets-client":
+		gc.logpacketsid = value
+	case "log-packets-address":
+		gc.logpacketsaddr = value
+	case "log-trace-client":
+		gc.tracedclients = append(gc.tracedclients, strings.Split(value, ",")...)
+	case "log-trace-duration":
+		gc.traceduration, e = checkDuration("log-trace-duration", value)
+	case "admin-address":
+		gc.adminaddress, e = checkAdminAddress(value)
+	case "admin-token":
+		gc.admintoken = value
+	case "admin-pprof":
+		gc.adminpprof, e = checkBool("admin-pprof", value)
+	case "admin-pprof-public":
+		gc.adminpprofpublic, e = checkBool("admin-pprof-public", value)
+	case "admin-pprof-mutex-fraction":
+		gc.adminpprofmutex, e = checkNum("admin-pprof-mutex-fraction", value)
+	case "admin-pprof-block-rate":
+		gc.adminpprofblock, e = checkNum("admin-pprof-block-rate", value)
+	case "admin-ready-broker":
+		var broker bool
+		broker, e = checkBool("admin-ready-broker", value)
+		gc.adminreadyany = !broker
+	case "sys-interval":
+		gc.sysinterval, e = checkDuration("sys-interval", value)
+	case "sys-prefix":
+		gc.sysprefix, e = checkSysPrefix(value)
+	case "capture-enabled":
+		gc.capture, e = checkBool("capture-enabled", value)
+	case "capture-file":
+		gc.capturefile = value
+	case "capture-max-size":
+		gc.capturemaxsize, e = checkNum("capture-max-size", value)
+	case "capture-max-backups":
+		gc.capturemaxbackups, e = checkNum("capture-max-backups", value)
+	case "latency-register-rtt":
+		gc.latencyregisterrtt, e = checkBool("latency-register-rtt", value)
 	default:
 		ERROR.Printf("Unknown config option: \"%s\"", key)
 		return ErrUnknownConfigOption
@@ -96,11 +1113,43 @@ func (gc *GatewayConfig) setOption(key, value string) error {
 	return e
 }
 
+// Parse an IP address, which may have an IPv6 zone
+// ("fe80::1%eth0") as link-local addresses need
+func parseIP(s string) net.IP {
+	if i := strings.LastIndex(s, "%"); i >= 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+// An IP address, or an IP address and port
+func checkBindAddress(value string) (string, error) {
+	if parseIP(value) != nil {
+		return value, nil
+	}
+	host, port, err := net.SplitHostPort(value)
+	if err == nil && host != "" && parseIP(host) == nil {
+		err = ErrInvalidBindAddress
+	}
+	if err == nil {
+		_, err = strconv.Atoi(port)
+	}
+	if err != nil {
+		ERROR.Printf("Invalid value specified for \"bind-address\" (not ip or ip:port): \"%s\"", value)
+		return "", ErrInvalidBindAddress
+	}
+	return value, nil
+}
+
 func checkURI(value string) (string, error) {
-	if value[0:6] != "tcp://" &&
-		value[0:6] != "ssl://" &&
-		value[0:6] != "tls://" &&
-		value[0:7] != "tcps://" {
+	switch {
+	case strings.HasPrefix(value, "tcp://"),
+		strings.HasPrefix(value, "ssl://"),
+		strings.HasPrefix(value, "tls://"),
+		strings.HasPrefix(value, "tcps://"),
+		strings.HasPrefix(value, "ws://"),
+		strings.HasPrefix(value, "wss://"):
+	default:
 		ERROR.Printf("Invalid URI, must specify transport (ex: \"tcp://\"): \"%s\"", value)
 		return "", ErrNoTransportSpecified
 	}
@@ -109,6 +1158,210 @@ func checkURI(value string) (string, error) {
 	return value, nil
 }
 
+// A header for the broker's WebSocket handshake, given as
+// name=value with the value escaped as in a URL query, so that
+// "Authorization=Bearer%20abc" sends "Authorization: Bearer abc"
+func checkHeader(value string) (string, string, error) {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		ERROR.Printf("Invalid value specified for \"mqtt-header\" (not name=value): \"%s\"", value)
+		return "", "", ErrInvalidBrokerHeader
+	}
+	v, err := url.QueryUnescape(value[i+1:])
+	if err != nil {
+		ERROR.Printf("Invalid value specified for \"mqtt-header\" (%v): \"%s\"", err, value)
+		return "", "", ErrInvalidBrokerHeader
+	}
+	return value[:i], v, nil
+}
+
+// The MQTT protocol level: 3 (3.1), 4 (3.1.1) or 5
+func checkProtocolVersion(value string) (int, error) {
+	switch value {
+	case "3", "4", "5":
+		return strconv.Atoi(value)
+	default:
+		ERROR.Printf("Invalid value specified for \"mqtt-protocol-version\" (not 3, 4 or 5): \"%s\"", value)
+		return 0, ErrInvalidProtocolVersion
+	}
+}
+
+// A duration, or a number of seconds, in whole seconds from 1 to
+// the most an MQTT v5 expiry interval holds
+func checkExpiry(label, value string) (int, error) {
+	d, e := parseDuration(label, value, time.Second)
+	if e != nil || d < time.Second || d/time.Second > math.MaxUint32 {
+		ERROR.Printf("Invalid value specified for \"%s\" (not 1 to 4294967295 seconds): \"%s\"", label, value)
+		return 0, ErrInvalidExpiry
+	}
+	return int(d / time.Second), nil
+}
+
+// 0, 1 or 2
+func checkQos(label, value string) (int, error) {
+	switch value {
+	case "0", "1", "2":
+		return strconv.Atoi(value)
+	default:
+		ERROR.Printf("Invalid value specified for \"%s\" (not 0, 1 or 2): \"%s\"", label, value)
+		return 0, ErrInvalidQos
+	}
+}
+
+// The QoS of a client's PUBLISH, -1 to 2, and the QoS to send
+// it to the broker with, as sn=qos
+func checkQosMapping(value string) (int, int, error) {
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		ERROR.Printf("Invalid value specified for \"upstream-qos\" (not qos=qos): \"%s\"", value)
+		return 0, 0, ErrInvalidQos
+	}
+	sn := value[:i]
+	if sn != "-1" {
+		if _, e := checkQos("upstream-qos", sn); e != nil {
+			return 0, 0, e
+		}
+	}
+	qos, e := checkQos("upstream-qos", value[i+1:])
+	n, _ := strconv.Atoi(sn)
+	return n, qos, e
+}
+
+// A topic prefix and the QoS to send every PUBLISH under it to
+// the broker with, as prefix=qos
+func checkQosPrefix(value string) (string, int, error) {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		ERROR.Printf("Invalid value specified for \"upstream-qos-topic\" (not prefix=qos): \"%s\"", value)
+		return "", 0, ErrInvalidQos
+	}
+	qos, e := checkQos("upstream-qos-topic", value[i+1:])
+	return value[:i], qos, e
+}
+
+// name=broker, name not already given to a broker
+func checkUpstream(value string, upstreams []upstreamConfig) (upstreamConfig, error) {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 || strings.ContainsAny(value[:i], " \t") || value[:i] == defaultUpstream {
+		ERROR.Printf("Invalid value specified for \"upstream-broker\" (not name=broker): \"%s\"", value)
+		return upstreamConfig{}, ErrInvalidUpstream
+	}
+	for _, uc := range upstreams {
+		if uc.name == value[:i] {
+			ERROR.Printf("Invalid value specified for \"upstream-broker\" (%s named twice): \"%s\"", uc.name, value)
+			return upstreamConfig{}, ErrInvalidUpstream
+		}
+	}
+	return upstreamConfig{value[:i], value[i+1:]}, nil
+}
+
+// prefix=name, name being that of a broker already given or the
+// gateway's own
+func checkRoute(value string, upstreams []upstreamConfig) (routeConfig, error) {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		ERROR.Printf("Invalid value specified for \"upstream-route\" (not prefix=name): \"%s\"", value)
+		return routeConfig{}, ErrInvalidRoute
+	}
+	rc := routeConfig{value[:i], value[i+1:]}
+	if rc.upstream == defaultUpstream {
+		return rc, nil
+	}
+	for _, uc := range upstreams {
+		if uc.name == rc.upstream {
+			return rc, nil
+		}
+	}
+	ERROR.Printf("Invalid value specified for \"upstream-route\" (no upstream-broker named %s): \"%s\"", rc.upstream, value)
+	return routeConfig{}, ErrInvalidRoute
+}
+
+// id=topic, id from 1 to 0xFFFE not already given to a topic,
+// 0 and 0xFFFF being reserved, and topic a TopicFilter, which
+// clients may only subscribe to if it has wildcards
+func checkPredefined(value string, predefined []predefinedTopic) (predefinedTopic, error) {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		ERROR.Printf("Invalid value specified for \"predefined-topic\" (not id=topic): \"%s\"", value)
+		return predefinedTopic{}, ErrInvalidPredefinedTopic
+	}
+	id, e := strconv.ParseUint(value[:i], 10, 16)
+	if e != nil || id == 0 || id == 0xFFFF {
+		ERROR.Printf("Invalid value specified for \"predefined-topic\" (id not from 1 to 65534): \"%s\"", value)
+		return predefinedTopic{}, ErrInvalidPredefinedTopic
+	}
+	topic := value[i+1:]
+	if _, e = ValidateTopicFilter(topic); e != nil {
+		ERROR.Printf("Invalid value specified for \"predefined-topic\" (%v): \"%s\"", e, value)
+		return predefinedTopic{}, ErrInvalidPredefinedTopic
+	}
+	for _, pt := range predefined {
+		if pt.id == uint16(id) {
+			ERROR.Printf("Invalid value specified for \"predefined-topic\" (%d given twice): \"%s\"", id, value)
+			return predefinedTopic{}, ErrInvalidPredefinedTopic
+		}
+	}
+	return predefinedTopic{uint16(id), topic}, nil
+}
+
+// A shared subscription group name, one topic level without
+// wildcards
+func checkShareGroup(value string) (string, error) {
+	if strings.ContainsAny(value, "/+#") {
+		ERROR.Printf("Invalid value specified for \"upstream-share-group\" (not a name without /, + or #): \"%s\"", value)
+		return "", ErrInvalidShareGroup
+	}
+	return value, nil
+}
+
+// One or more topic levels without wildcards, not beginning with
+// $, always ending with /
+func checkTopicPrefix(value string) (string, error) {
+	prefix := strings.TrimSuffix(value, "/")
+	if _, e := ValidateTopicName(prefix); e != nil || strings.ContainsAny(prefix, "+#") || strings.HasPrefix(prefix, "$") {
+		ERROR.Printf("Invalid value specified for \"topic-prefix\" (not topic levels without wildcards or a leading $): \"%s\"", value)
+		return "", ErrInvalidTopicPrefix
+	}
+	return prefix + "/", nil
+}
+
+// One or more topic levels without wildcards, the gateway's own
+// topics under them
+func checkSysPrefix(value string) (string, error) {
+	prefix := strings.TrimSuffix(value, "/")
+	if _, e := ValidateTopicName(prefix); e != nil || strings.ContainsAny(prefix, "+#") {
+		ERROR.Printf("Invalid value specified for \"sys-prefix\" (not topic levels without wildcards): \"%s\"", value)
+		return "", ErrInvalidSysPrefix
+	}
+	return prefix, nil
+}
+
+// 0 to 65535, 0 using none
+func checkTopicAliases(value string) (int, error) {
+	n, e := checkNum("mqtt-topic-aliases", value)
+	if e == nil && (n < 0 || n > 0xffff) {
+		ERROR.Printf("Invalid value specified for \"mqtt-topic-aliases\" (not 0 to 65535): \"%s\"", value)
+		e = ErrInvalidTopicAliases
+	}
+	return n, e
+}
+
+// A topic filter and the seconds messages published on topics
+// it matches expire after, as filter=seconds
+func checkExpiryRule(value string) (expiryRule, error) {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		ERROR.Printf("Invalid value specified for \"mqtt-message-expiry\" (not filter=seconds): \"%s\"", value)
+		return expiryRule{}, ErrInvalidExpiry
+	}
+	if _, e := ValidateTopicFilter(value[:i]); e != nil {
+		ERROR.Printf("Invalid value specified for \"mqtt-message-expiry\" (%v): \"%s\"", e, value)
+		return expiryRule{}, e
+	}
+	s, e := checkExpiry("mqtt-message-expiry", value[i+1:])
+	return expiryRule{value[:i], uint32(s)}, e
+}
+
 func checkMode(value string) (bool, error) {
 	var isAggregating bool
 	switch value {
@@ -123,6 +1376,293 @@ func checkMode(value string) (bool, error) {
 	return isAggregating, nil
 }
 
+func checkOverflow(value string) (string, error) {
+	switch value {
+	case overflowReject, overflowTruncate, overflowHash:
+		return value, nil
+	default:
+		ERROR.Printf("Invalid value specified for \"client-id-overflow\": \"%s\"", value)
+		return "", ErrInvalidClientIdOverflow
+	}
+}
+
+// 1 to 255
+func checkGatewayId(value string) (int, error) {
+	id, e := checkNum("gateway-id", value)
+	if e == nil && (id < 1 || id > 255) {
+		ERROR.Printf("Invalid value specified for \"gateway-id\" (not 1 to 255): \"%s\"", value)
+		e = ErrInvalidGatewayId
+	}
+	return id, e
+}
+
+// From the smallest packet with a payload to the largest
+// length an MQTT-SN header can give
+func checkMessageSize(label, value string) (int, error) {
+	size, e := checkNum(label, value)
+	if e == nil && (size < minMaxMessageSize || size > 0xffff) {
+		ERROR.Printf("Invalid value specified for \"%s\" (not %d to 65535): \"%s\"", label, minMaxMessageSize, value)
+		e = ErrInvalidMessageSize
+	}
+	return size, e
+}
+
+func checkOversizePolicy(value string) (string, error) {
+	switch value {
+	case oversizeFit, oversizeDrop:
+		return value, nil
+	default:
+		ERROR.Printf("Invalid value specified for \"oversize-policy\": \"%s\"", value)
+		return "", ErrInvalidOversizePolicy
+	}
+}
+
+func checkOfflineConnect(value string) (string, error) {
+	switch value {
+	case offlineBuffer, offlineDegraded, offlineReject:
+		return value, nil
+	default:
+		ERROR.Printf("Invalid value specified for \"broker-offline-connect\": \"%s\"", value)
+		return "", ErrInvalidOfflineConnect
+	}
+}
+
+func checkEchoPolicy(value string) (string, error) {
+	switch value {
+	case echoDeliver, echoOthers, echoDrop:
+		return value, nil
+	default:
+		ERROR.Printf("Invalid value specified for \"upstream-echoes\": \"%s\"", value)
+		return "", ErrInvalidEchoPolicy
+	}
+}
+
+// Whether acl-default allows
+func checkACLDefault(value string) (bool, error) {
+	switch value {
+	case "allow":
+		return true, nil
+	case "deny":
+		return false, nil
+	default:
+		ERROR.Printf("Invalid value specified for \"acl-default\" (allow or deny): \"%s\"", value)
+		return false, ErrInvalidACLDefault
+	}
+}
+
+func checkLogLevel(value string) (string, error) {
+	if logLevelIndex(value) < 0 {
+		ERROR.Printf("Invalid value specified for \"log-level\": \"%s\"", value)
+		return "", ErrInvalidLogLevel
+	}
+	return value, nil
+}
+
+func checkLogFormat(value string) (string, error) {
+	switch value {
+	case logText, logJSON, logLogfmt:
+		return value, nil
+	default:
+		ERROR.Printf("Invalid value specified for \"log-format\": \"%s\"", value)
+		return "", ErrInvalidLogFormat
+	}
+}
+
+// none, line or how often, a duration more than 0
+func checkLogSync(value string) (string, error) {
+	return checkSync("log-sync", value, ErrInvalidLogSync)
+}
+
+// none, line or how often, a duration more than 0, for label;
+// invalid if not
+func checkSync(label, value string, invalid error) (string, error) {
+	switch value {
+	case logSyncNone, logSyncLine:
+		return value, nil
+	}
+	if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+		ERROR.Printf("Invalid value specified for \"%s\" (not none, line or a duration): \"%s\"", label, value)
+		return "", invalid
+	}
+	return value, nil
+}
+
+// A host, which may be left out to listen on every address, and
+// port
+func checkAdminAddress(value string) (string, error) {
+	_, port, err := net.SplitHostPort(value)
+	if err == nil {
+		_, err = strconv.Atoi(port)
+	}
+	if err != nil {
+		ERROR.Printf("Invalid value specified for \"admin-address\" (not host:port): \"%s\"", value)
+		return "", ErrInvalidAdminAddress
+	}
+	return value, nil
+}
+
+// A remote syslog daemon, udp://host:port or tcp://host:port
+func checkSyslogAddress(value string) (string, error) {
+	u, err := url.Parse(value)
+	if err == nil && (u.Scheme == "udp" || u.Scheme == "tcp") && u.Port() != "" && u.Path == "" {
+		return value, nil
+	}
+	ERROR.Printf("Invalid value specified for \"log-syslog-address\" (not udp:// or tcp:// and a host and port): \"%s\"", value)
+	return "", ErrInvalidSyslogAddress
+}
+
+// A multicast address and port
+func checkMulticastGroup(value string) (string, error) {
+	host, port, err := net.SplitHostPort(value)
+	if err == nil {
+		_, err = strconv.Atoi(port)
+	}
+	if ip := parseIP(host); err != nil || ip == nil || !ip.IsMulticast() {
+		ERROR.Printf("Invalid value specified for \"multicast-group\" (not a multicast ip:port): \"%s\"", value)
+		return "", ErrInvalidMulticastGroup
+	}
+	return value, nil
+}
+
+// Comma separated client ids and patterns, as client-allow
+// gives them
+func checkClientAllow(value string) ([]string, error) {
+	ids := strings.Split(value, ",")
+	for _, id := range ids {
+		if _, err := path.Match(id, ""); err != nil || id == "" {
+			ERROR.Printf("Invalid value specified for \"client-allow\" (not a client id or pattern): \"%s\"", id)
+			return nil, ErrInvalidClientAllow
+		}
+	}
+	return ids, nil
+}
+
+// A client id pattern's rate limit, pattern=rate/bytes, either
+// 0 for no limit
+func checkPublishLimit(value string) (publishLimit, error) {
+	pattern, limits, ok := strings.Cut(value, "=")
+	rate, bytes, ok2 := strings.Cut(limits, "/")
+	l := publishLimit{pattern: pattern}
+	var err error
+	if ok && ok2 {
+		if l.rate, err = strconv.Atoi(rate); err == nil {
+			l.bytes, err = strconv.Atoi(bytes)
+		}
+	}
+	if !ok || !ok2 || err != nil || l.rate < 0 || l.bytes < 0 {
+		ERROR.Printf("Invalid value specified for \"client-publish-limit\" (not pattern=rate/bytes): \"%s\"", value)
+		return l, ErrInvalidPublishLimit
+	}
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		ERROR.Printf("Invalid value specified for \"client-publish-limit\" (not a client id or pattern): \"%s\"", value)
+		return l, ErrInvalidPublishLimit
+	}
+	return l, nil
+}
+
+// Comma separated IP addresses and CIDR networks, an address
+// being a network of its own
+func checkNetworks(label, value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range strings.Split(value, ",") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			if ip := net.ParseIP(s); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				n, err = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+			}
+		}
+		if err != nil {
+			ERROR.Printf("Invalid value specified for \"%s\" (not ip or ip/prefix): \"%s\"", label, s)
+			return nil, ErrInvalidNetwork
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// 0 to 1
+func checkProbability(label, value string) (float64, error) {
+	p, e := strconv.ParseFloat(value, 64)
+	if e != nil || p < 0 || p > 1 {
+		ERROR.Printf("Invalid value specified for \"%s\" (not 0 to 1): \"%s\"", label, value)
+		return 0, ErrInvalidProbability
+	}
+	return p, nil
+}
+
+// An octal file mode, like chmod's
+func checkFileMode(label, value string) (os.FileMode, error) {
+	m, e := strconv.ParseUint(value, 8, 32)
+	if e != nil || m > 0777 {
+		ERROR.Printf("Invalid value specified for \"%s\" (not an octal file mode): \"%s\"", label, value)
+		return 0, ErrInvalidFileMode
+	}
+	return os.FileMode(m), nil
+}
+
+// A duration, such as "30s" or "5m", or, as options were once
+// given, a number of units
+func parseDuration(label, value string, unit time.Duration) (time.Duration, error) {
+	d, e := time.ParseDuration(value)
+	if e == nil {
+		return d, nil
+	}
+	n, e := strconv.Atoi(value)
+	if e != nil {
+		ERROR.Printf("Invalid value specified for \"%s\" (not a duration): \"%s\"", label, value)
+		return 0, ErrInvalidDuration
+	}
+	d = time.Duration(n) * unit
+	WARN.Printf("\"%s\" given as a bare number, deprecated: give a duration such as \"%s\" instead of \"%s\"", label, d, value)
+	return d, nil
+}
+
+// A duration, such as "30s" or "5m", or a number of seconds,
+// never negative
+func checkDuration(label, value string) (time.Duration, error) {
+	d, e := parseDuration(label, value, time.Second)
+	if e == nil && d < 0 {
+		ERROR.Printf("Invalid value specified for \"%s\" (negative): \"%s\"", label, value)
+		return 0, ErrInvalidDuration
+	}
+	return d, e
+}
+
+// A duration more than 0
+func checkInterval(label, value string) (time.Duration, error) {
+	d, e := checkDuration(label, value)
+	if e == nil && d == 0 {
+		ERROR.Printf("Invalid value specified for \"%s\" (not more than 0): \"%s\"", label, value)
+		return 0, ErrOutOfRange
+	}
+	return d, e
+}
+
+// A number of times, at least 1
+func checkCount(label, value string) (int, error) {
+	n, e := checkNum(label, value)
+	if e == nil && n < 1 {
+		ERROR.Printf("Invalid value specified for \"%s\" (not at least 1): \"%s\"", label, value)
+		return 0, ErrOutOfRange
+	}
+	return n, e
+}
+
+// A multiple of a duration a client may be silent for, at least
+// 1 so that no client is lost before its time
+func checkGrace(label, value string) (float64, error) {
+	g, e := strconv.ParseFloat(value, 64)
+	if e != nil || !(g >= 1) || math.IsInf(g, 1) {
+		ERROR.Printf("Invalid value specified for \"%s\" (not a number of at least 1): \"%s\"", label, value)
+		return 0, ErrOutOfRange
+	}
+	return g, nil
+}
+
 func checkNum(label, value string) (int, error) {
 	if p, e := strconv.Atoi(value); e != nil {
 		ERROR.Printf("Invalid value specified for \"%s\" (not a number): \"%s\"", label, value)
@@ -131,3 +1671,15 @@ func checkNum(label, value string) (int, error) {
 		return p, nil
 	}
 }
+
+func checkBool(label, value string) (bool, error) {
+	switch value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		ERROR.Printf("Invalid value specified for \"%s\" (not true or false): \"%s\"", label, value)
+		return false, ErrNotABool
+	}
+}
@@ -0,0 +1,115 @@
+package gateway
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The environment variables overriding the options of a
+// configuration file begin with envPrefix, followed by the
+// option's name in upper case with _ for each -: GNATT_PORT sets
+// port, GNATT_MQTT_BROKER mqtt-broker, as a line at the end of the
+// file would, so one given once in the file is overridden and one
+// given more than once added to. Those of the blocks name a field
+// within them: GNATT_LISTENERS_0_ADDRESS sets the address of the
+// first listener, which the file must have, and
+// GNATT_UPSTREAM_BROKERS_CLOUD the broker of the upstream named
+// cloud, added if the file has none, names matching whatever
+// their case. Those of a section name its field:
+// GNATT_LOGGING_LEVEL sets log-level as GNATT_LOG_LEVEL does.
+const envPrefix = "GNATT_"
+
+// Override the options of gc with the variables of the
+// environment
+func (gc *GatewayConfig) SetEnvironment() error {
+	return gc.setEnv(os.Environ())
+}
+
+// Override the options of gc with the variables of environ,
+// each NAME=value, in the order of their names
+func (gc *GatewayConfig) setEnv(environ []string) error {
+	sort.Strings(environ)
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		name, value := kv, ""
+		if i := strings.Index(kv, "="); i >= 0 {
+			name, value = kv[:i], kv[i+1:]
+		}
+		key := strings.ToLower(strings.Replace(strings.TrimPrefix(name, envPrefix), "_", "-", -1))
+		if err := gc.setEnvOption(key, value); err != nil {
+			ERROR.Printf("Error in configuration from environment variable %s", name)
+			return &ConfigError{name, err}
+		}
+	}
+	return nil
+}
+
+func (gc *GatewayConfig) setEnvOption(key, value string) error {
+	switch {
+	case strings.HasPrefix(key, "listeners-"):
+		return gc.setEnvListener(strings.TrimPrefix(key, "listeners-"), value)
+	case strings.HasPrefix(key, "upstream-brokers-"):
+		return gc.setEnvUpstream(strings.TrimPrefix(key, "upstream-brokers-"), value)
+	}
+	for section := range configSections {
+		if strings.HasPrefix(key, section+"-") {
+			return gc.setSectionOption(section, strings.TrimPrefix(key, section+"-"), value)
+		}
+	}
+	return gc.setOption(key, value)
+}
+
+// field, "N-type", "N-address" or "N-" and an option of the
+// listener's own such as "N-max-outbound-size", of listener N
+func (gc *GatewayConfig) setEnvListener(field, value string) error {
+	n, err := 0, ErrUnknownConfigOption
+	i := strings.Index(field, "-")
+	if i > 0 {
+		n, err = strconv.Atoi(field[:i])
+	}
+	if err != nil || n < 0 || n >= len(gc.listeners) {
+		ERROR.Printf("Invalid environment variable for \"listeners\" (no such listener): \"%s\"", field)
+		return ErrUnknownConfigOption
+	}
+	lc := gc.listeners[n]
+	kind, address, opts := lc.kind, lc.address, lc.options()
+	switch name := field[i+1:]; {
+	case name == "type":
+		kind = value
+	case name == "address":
+		address = value
+	case listenerOptions[name] || listenerOptionKinds[name] != nil:
+		// given again, it overrides the listener's own
+		opts = append(opts, name+"="+value)
+	default:
+		ERROR.Printf("Unknown config option: \"listeners.%s\"", name)
+		return ErrUnknownConfigOption
+	}
+	if len(opts) > 0 {
+		address += "?" + strings.Join(opts, "&")
+	}
+	if lc, err = checkListener(kind + "://" + address); err != nil {
+		return err
+	}
+	gc.listeners[n] = lc
+	return nil
+}
+
+// The broker of the upstream named name, added if there is none
+func (gc *GatewayConfig) setEnvUpstream(name, value string) error {
+	for i, uc := range gc.upstreams {
+		if strings.EqualFold(uc.name, name) {
+			if value == "" {
+				ERROR.Printf("Missing value for config option: \"upstream-brokers.%s\"", uc.name)
+				return ErrInvalidUpstream
+			}
+			gc.upstreams[i].broker = value
+			return nil
+		}
+	}
+	return gc.setOption("upstream-broker", name+"="+value)
+}
@@ -0,0 +1,497 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The formats of configuration file
+const (
+	configPlain = "plain"
+	configJSON  = "json"
+	configYAML  = "yaml"
+)
+
+// A structured (JSON or YAML) configuration file names its
+// options as the lines of the plain one do, a list of values
+// setting its option once for each as repeated lines do, and
+// refuses any option it does not know as they do. The options
+// that are blocks, configBlocks, only a structured file has.
+
+// An option of a structured configuration file, its value a
+// string, a list of values or the entries of a block, in the
+// order given
+type configEntry struct {
+	key   string
+	value interface{}
+}
+
+// The options that are blocks rather than values
+var configBlocks map[string]func(gc *GatewayConfig, value interface{}) error
+
+func init() {
+	// set here, as setting an option may read an included file
+	// and so refer to configBlocks
+	configBlocks = map[string]func(gc *GatewayConfig, value interface{}) error{
+		"listeners":         (*GatewayConfig).setListeners,
+		"upstream-brokers":  (*GatewayConfig).setUpstreams,
+		"upstream-routes":   (*GatewayConfig).setRoutes,
+		"predefined-topics": (*GatewayConfig).setPredefined,
+	}
+	for name := range configSections {
+		name := name
+		configBlocks[name] = func(gc *GatewayConfig, value interface{}) error {
+			return gc.setSection(name, value)
+		}
+	}
+}
+
+// The blocks grouping options, each field of one naming the
+// option it sets
+var configSections = map[string]map[string]string{
+	"logging": {
+		"level":           "log-level",
+		"format":          "log-format",
+		"destination":     "log-destination",
+		"max-size":        "log-max-size",
+		"max-backups":     "log-max-backups",
+		"max-age":         "log-max-age",
+		"sync":            "log-sync",
+		"syslog-address":  "log-syslog-address",
+		"syslog-tag":      "log-syslog-tag",
+		"packets":         "log-packets",
+		"packets-client":  "log-packets-client",
+		"packets-address": "log-packets-address",
+		"trace-client":    "log-trace-client",
+		"trace-duration":  "log-trace-duration",
+	},
+	"audit": {
+		"file":        "audit-file",
+		"max-size":    "audit-max-size",
+		"max-backups": "audit-max-backups",
+		"sync":        "audit-sync",
+	},
+	"admin": {
+		"address":              "admin-address",
+		"token":                "admin-token",
+		"pprof":                "admin-pprof",
+		"pprof-public":         "admin-pprof-public",
+		"pprof-mutex-fraction": "admin-pprof-mutex-fraction",
+		"pprof-block-rate":     "admin-pprof-block-rate",
+		"ready-broker":         "admin-ready-broker",
+	},
+	"capture": {
+		"enabled":     "capture-enabled",
+		"file":        "capture-file",
+		"max-size":    "capture-max-size",
+		"max-backups": "capture-max-backups",
+	},
+	"sys": {
+		"interval": "sys-interval",
+		"prefix":   "sys-prefix",
+	},
+	"events": {
+		"topic": "events-topic",
+		"qos":   "events-qos",
+		"rate":  "events-rate",
+	},
+	"latency": {
+		"register-rtt": "latency-register-rtt",
+	},
+	"timers": {
+		"retry-interval":     "retry-interval",
+		"retry-count":        "retry-count",
+		"advertise-interval": "advertise-interval",
+		"searchgw-delay":     "searchgw-delay",
+		"keepalive-grace":    "keepalive-grace",
+		"sleep-grace":        "sleep-grace",
+	},
+	"limits": {
+		"clients":            "max-clients",
+		"topics":             "max-topics",
+		"message-size":       "max-message-size",
+		"outbound-size":      "max-outbound-size",
+		"client-queue":       "client-queue",
+		"client-queue-bytes": "client-queue-bytes",
+		"client-inflight":    "client-inflight",
+		"publish-rate":       "client-publish-rate",
+		"publish-bytes":      "client-publish-bytes",
+		"publish-violations": "client-publish-violations",
+		"upstream-inflight":  "upstream-inflight",
+		"upstream-queue":     "upstream-queue",
+		"offline-queue":      "broker-offline-queue",
+		"offline-queue-qos0": "broker-offline-queue-qos0",
+		"connections":        "max-connections",
+		"broker-connections": "max-broker-connections",
+	},
+}
+
+// An error in a structured configuration file, in the option at
+// Key, which is a path ("listeners[1].address") into blocks
+type ConfigError struct {
+	Key string
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("config option \"%s\": %v", e.Key, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// err, in the option at key, which is in a block if err is
+// already a ConfigError
+func configError(key string, err error) error {
+	if ce, ok := err.(*ConfigError); ok {
+		if strings.HasPrefix(ce.Key, "[") {
+			return &ConfigError{key + ce.Key, ce.Err}
+		}
+		return &ConfigError{key + "." + ce.Key, ce.Err}
+	}
+	return &ConfigError{key, err}
+}
+
+// The format of file: that of its extension, json if it begins
+// with {, which no option of a plain one does, plain otherwise
+func configFormat(file string, config []byte) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return configJSON
+	case ".yaml", ".yml":
+		return configYAML
+	}
+	config = bytes.TrimSpace(config)
+	if len(config) > 0 && config[0] == '{' {
+		return configJSON
+	}
+	return configPlain
+}
+
+// Set the options of a JSON configuration file, an object
+func (gc *GatewayConfig) UnmarshalJSON(config []byte) error {
+	d := json.NewDecoder(bytes.NewReader(config))
+	d.UseNumber()
+	v, err := decodeJSON(d)
+	if err == nil {
+		if _, err = d.Token(); err == io.EOF {
+			err = nil
+		} else if err == nil {
+			err = ErrInvalidConfigFile
+		}
+	}
+	if err != nil {
+		ERROR.Printf("Error in JSON configuration: %v", err)
+		return err
+	}
+	entries, ok := v.([]configEntry)
+	if !ok {
+		ERROR.Println("Error in JSON configuration: not an object")
+		return ErrInvalidConfigFile
+	}
+	return gc.setEntries(entries)
+}
+
+// Set the options of a YAML configuration file, a mapping. A
+// file of more than one document is refused.
+func (gc *GatewayConfig) parseYAML(config []byte) error {
+	d := yaml.NewDecoder(bytes.NewReader(config))
+	var doc, next yaml.Node
+	err := d.Decode(&doc)
+	if err == io.EOF {
+		// nothing but comments, no options
+		return nil
+	}
+	if err == nil {
+		if err = d.Decode(&next); err == io.EOF {
+			err = nil
+		} else if err == nil {
+			err = ErrMultipleDocuments
+		}
+	}
+	if err != nil {
+		ERROR.Printf("Error in YAML configuration: %v", err)
+		return err
+	}
+	return gc.UnmarshalYAML(&doc)
+}
+
+// Set the options of a YAML mapping
+func (gc *GatewayConfig) UnmarshalYAML(node *yaml.Node) error {
+	v, err := decodeYAML(node)
+	if err != nil {
+		ERROR.Printf("Error in YAML configuration: %v", err)
+		return err
+	}
+	entries, ok := v.([]configEntry)
+	if !ok {
+		ERROR.Printf("Error in YAML configuration on line %d: not a mapping", node.Line)
+		return ErrInvalidConfigFile
+	}
+	return gc.setEntries(entries)
+}
+
+// What node holds, as decodeJSON has it
+func decodeYAML(node *yaml.Node) (interface{}, error) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return []configEntry(nil), nil
+		}
+		return decodeYAML(node.Content[0])
+	case yaml.AliasNode:
+		return decodeYAML(node.Alias)
+	case yaml.SequenceNode:
+		var list []interface{}
+		for _, n := range node.Content {
+			item, err := decodeYAML(n)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return list, nil
+	case yaml.MappingNode:
+		var entries []configEntry
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			k := node.Content[i]
+			if k.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: %v", k.Line, ErrInvalidConfigFile)
+			}
+			value, err := decodeYAML(node.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, configEntry{k.Value, value})
+		}
+		return entries, nil
+	}
+	if node.Tag == "!!null" {
+		return nil, nil
+	}
+	return node.Value, nil
+}
+
+// The next JSON value: a string for a string, number or bool, a
+// []interface{} for an array and a []configEntry for an object
+func decodeJSON(d *json.Decoder) (interface{}, error) {
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := t.(type) {
+	case json.Delim:
+		var v interface{}
+		if t == '[' {
+			var list []interface{}
+			for d.More() {
+				item, err := decodeJSON(d)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			v = list
+		} else {
+			var entries []configEntry
+			for d.More() {
+				k, err := d.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := decodeJSON(d)
+				if err != nil {
+					return nil, err
+				}
+				entries = append(entries, configEntry{k.(string), value})
+			}
+			v = entries
+		}
+		// the closing ] or }
+		_, err = d.Token()
+		return v, err
+	case json.Number:
+		return t.String(), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	default:
+		// a string, or nil for null
+		return t, nil
+	}
+}
+
+func (gc *GatewayConfig) setEntries(entries []configEntry) error {
+	for _, e := range entries {
+		if err := gc.setEntry(e.key, e.value); err != nil {
+			return configError(e.key, err)
+		}
+	}
+	return nil
+}
+
+// Set the option key to value, each of them if value is a list
+func (gc *GatewayConfig) setEntry(key string, value interface{}) error {
+	if block, ok := configBlocks[key]; ok {
+		return block(gc, value)
+	}
+	if list, ok := value.([]interface{}); ok {
+		for i, v := range list {
+			s, err := configValue(key, v)
+			if err == nil {
+				err = gc.setOption(key, s)
+			}
+			if err != nil {
+				return &ConfigError{fmt.Sprintf("[%d]", i), err}
+			}
+		}
+		return nil
+	}
+	s, err := configValue(key, value)
+	if err != nil {
+		return err
+	}
+	return gc.setOption(key, s)
+}
+
+// value, which must be a string
+func configValue(key string, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case nil:
+		ERROR.Printf("Missing value for config option: \"%s\"", key)
+		return "", ErrMissingValueForConfigOption
+	}
+	ERROR.Printf("Invalid value specified for \"%s\" (not a value or list of values)", key)
+	return "", ErrInvalidConfigValue
+}
+
+// The entries of the block key, which value must be
+func configBlock(key string, value interface{}) ([]configEntry, error) {
+	if entries, ok := value.([]configEntry); ok {
+		return entries, nil
+	}
+	ERROR.Printf("Invalid value specified for \"%s\" (not a block)", key)
+	return nil, ErrInvalidConfigValue
+}
+
+// "listeners": [{"type": "tcp", "address": ":1884",
+// "max-outbound-size": 512}, ...], each a listener option
+func (gc *GatewayConfig) setListeners(value interface{}) error {
+	list, ok := value.([]interface{})
+	if !ok {
+		ERROR.Println("Invalid value specified for \"listeners\" (not a list of blocks)")
+		return ErrInvalidConfigValue
+	}
+	for i, item := range list {
+		if err := gc.setListener(item); err != nil {
+			return configError(fmt.Sprintf("[%d]", i), err)
+		}
+	}
+	return nil
+}
+
+func (gc *GatewayConfig) setListener(value interface{}) error {
+	entries, err := configBlock("listeners", value)
+	if err != nil {
+		return err
+	}
+	var kind, address string
+	var opts []string
+	for _, e := range entries {
+		var s string
+		if s, err = configValue(e.key, e.value); err != nil {
+			return configError(e.key, err)
+		}
+		switch e.key {
+		case "type":
+			kind = s
+		case "address":
+			address = s
+		default:
+			if _, ok := listenerOptionKinds[e.key]; !ok && !listenerOptions[e.key] {
+				ERROR.Printf("Unknown config option: \"%s\"", e.key)
+				return configError(e.key, ErrUnknownConfigOption)
+			}
+			opts = append(opts, e.key+"="+s)
+		}
+	}
+	if len(opts) > 0 {
+		address += "?" + strings.Join(opts, "&")
+	}
+	return gc.setOption("listener", kind+"://"+address)
+}
+
+// "upstream-brokers": {"name": "broker", ...}, each an
+// upstream-broker option
+func (gc *GatewayConfig) setUpstreams(value interface{}) error {
+	return gc.setPairs("upstream-brokers", "upstream-broker", value)
+}
+
+// "upstream-routes": {"prefix": "name", ...}, each an
+// upstream-route option
+func (gc *GatewayConfig) setRoutes(value interface{}) error {
+	return gc.setPairs("upstream-routes", "upstream-route", value)
+}
+
+// "predefined-topics": {"id": "topic", ...}, each a
+// predefined-topic option
+func (gc *GatewayConfig) setPredefined(value interface{}) error {
+	return gc.setPairs("predefined-topics", "predefined-topic", value)
+}
+
+// A section, such as "logging": {"level": "debug", "format":
+// "json"} or "timers": {"retry-interval": "30s"}, each field
+// setting its option
+func (gc *GatewayConfig) setSection(section string, value interface{}) error {
+	entries, err := configBlock(section, value)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		s, err := configValue(e.key, e.value)
+		if err == nil {
+			err = gc.setSectionOption(section, e.key, s)
+		}
+		if err != nil {
+			return configError(e.key, err)
+		}
+	}
+	return nil
+}
+
+// Set the option of the field of section
+func (gc *GatewayConfig) setSectionOption(section, field, value string) error {
+	option, ok := configSections[section][field]
+	if !ok {
+		ERROR.Printf("Unknown config option: \"%s.%s\"", section, field)
+		return ErrUnknownConfigOption
+	}
+	return gc.setOption(option, value)
+}
+
+// Set option to key=value for each entry of the block key
+func (gc *GatewayConfig) setPairs(key, option string, value interface{}) error {
+	entries, err := configBlock(key, value)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		s, err := configValue(e.key, e.value)
+		if err == nil {
+			err = gc.setOption(option, e.key+"="+s)
+		}
+		if err != nil {
+			return configError(e.key, err)
+		}
+	}
+	return nil
+}
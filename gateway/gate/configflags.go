@@ -0,0 +1,236 @@
+package gateway
+
+import (
+	"flag"
+	"io"
+	"strings"
+)
+
+// An option of a configuration file, the GatewayConfig field it
+// sets, what for, and the value it has unless set, "" if none
+type configOption struct {
+	name  string
+	field string
+	usage string
+	def   string
+}
+
+// Every option a configuration file may have but the blocks and
+// mqtt-timeout, the older name of mqtt-keepalive
+var configOptions = []configOption{
+	{"mode", "aggregating", "aggregating or transparent", "transparent"},
+	{"port", "port", "UDP port to listen on", ""},
+	{"bind-address", "bindaddress", "address (and port) to listen on", ""},
+	{"mqtt-broker", "mqttbroker", "broker URL, tcp://, ssl://, tcps://, ws:// or wss://", ""},
+	{"mqtt-user", "mqttuser", "broker user name", ""},
+	{"mqtt-password", "mqttpassword", "broker password", ""},
+	{"mqtt-clientid", "mqttclientid", "client id of the aggregating gateway's broker connection", ""},
+	{"mqtt-keepalive", "mqtttimeout", "broker keepalive", "60s"},
+	{"mqtt-protocol-version", "mqttversion", "MQTT protocol version of the broker, 3, 4 or 5", ""},
+	{"mqtt-clean-session", "mqttsession", "whether the broker forgets the session on disconnect", "true"},
+	{"mqtt-session-expiry", "sessionexpiry", "how long an MQTT v5 broker keeps a session", "24h"},
+	{"mqtt-topic-aliases", "topicaliases", "topic aliases used with an MQTT v5 broker", "32"},
+	{"mqtt-message-expiry", "messageexpiry", "prefix=duration messages are kept by an MQTT v5 broker", ""},
+	{"mqtt-ca-file", "mqttcafile", "CA certificates the broker is verified with", ""},
+	{"mqtt-cert-file", "mqttcertfile", "client certificate for the broker", ""},
+	{"mqtt-key-file", "mqttkeyfile", "key of the client certificate", ""},
+	{"mqtt-server-name", "mqttsni", "server name the broker's certificate is verified for", ""},
+	{"mqtt-insecure-skip-verify", "mqttinsecure", "whether the broker's certificate goes unverified", "false"},
+	{"mqtt-header", "mqttheaders", "Name=value HTTP header of a websocket broker connection", ""},
+	{"connect-timeout", "connecttimeout", "how long connecting to the broker may take", "5s"},
+	{"publish-timeout", "publishtimeout", "how long a PUBLISH waits for the broker", "2s"},
+	{"topic-prefix", "topicprefix", "prefix of every topic on the broker", ""},
+	{"upstream-share-group", "sharegroup", "shared subscription group", ""},
+	{"upstream-share-topic", "shareprefixes", "prefix of the filters subscribed to as the group", ""},
+	{"upstream-echoes", "upstreamechoes", "what is done with echoes, others, deliver or drop", "others"},
+	{"upstream-qos", "upstreamqos", "client=broker QoS mapping", ""},
+	{"upstream-qos-topic", "upstreamqos", "prefix=QoS topics are published to the broker at", ""},
+	{"upstream-inflight", "upstreaminflight", "PUBLISHes sent to the broker at once", "1"},
+	{"upstream-queue", "upstreamqueue", "PUBLISHes waiting for the broker beyond those", "256"},
+	{"broker-offline-queue", "offlinequeue", "PUBLISHes held while the broker is down", "0"},
+	{"broker-offline-queue-qos0", "offlinequeueqos0", "QoS 0 PUBLISHes held while the broker is down", ""},
+	{"broker-offline-ack-early", "offlineackearly", "whether held PUBLISHes are acknowledged at once", "false"},
+	{"broker-offline-queue-file", "offlinequeuefile", "file held PUBLISHes are saved to on stop", ""},
+	{"broker-offline-connect", "offlineconnect", "what is done with new clients while the broker is down, buffer, degraded or reject", "buffer"},
+	{"upstream-broker", "upstreams", "name=URL of a broker besides mqtt-broker", ""},
+	{"upstream-route", "routes", "prefix=name of the broker topics are published to", ""},
+	{"predefined-topic", "predefined", "id=topic clients may use without registering", ""},
+	{"status-topic", "statustopic", "topic the gateway's availability is published to", ""},
+	{"events-topic", "eventstopic", "topic the clients' connects, disconnects, sleeps and losses are published to as JSON", ""},
+	{"events-qos", "eventsqos", "QoS the events are published at", "0"},
+	{"events-rate", "eventsrate", "events published a second at most, those beyond dropped", "100"},
+	{"status-online", "statusonline", "payload published when online", "online"},
+	{"status-offline", "statusoffline", "payload published when offline", "offline"},
+	{"status-qos", "statusqos", "QoS of the availability", "1"},
+	{"max-clients", "maxclients", "clients connected at once", "0"},
+	{"max-topics", "maxtopics", "topics registered at once", "0"},
+	{"client-queue", "clientqueue", "PUBLISHes queued for a client", "1000"},
+	{"client-queue-bytes", "clientbytes", "bytes of the payloads queued for a client", "0"},
+	{"client-inflight", "clientwindow", "PUBLISHes unacknowledged by a client at once", "1"},
+	{"client-publish-rate", "publishrate", "PUBLISHes a second from a client", "0"},
+	{"client-publish-bytes", "publishbytes", "bytes of their payloads a second from a client", "0"},
+	{"client-publish-limit", "publishlimit", "rate limits for the client ids of patterns, pattern=rate/bytes, in place of client-publish-rate and client-publish-bytes", ""},
+	{"client-publish-violations", "violations", "PUBLISHes over its rate limit a client is disconnected after", "0"},
+	{"max-message-size", "maxmsgsize", "largest packet sent or received", "1400"},
+	{"max-outbound-size", "maxoutbound", "largest packet sent", ""},
+	{"oversize-policy", "oversize", "what is done with messages too large for a client", "fit"},
+	{"udp-readers", "udpreaders", "goroutines reading the UDP socket", "1"},
+	{"source-rate-limit", "sourcerate", "packets a second from one address", "0"},
+	{"source-rate-burst", "sourceburst", "packets at once from one address", ""},
+	{"source-rate-exempt", "sourceexempt", "addresses or networks not limited", ""},
+	{"source-rate-addresses", "sourceaddresses", "addresses limited at once", "10000"},
+	{"source-allow", "sourceallow", "addresses or networks packets are taken from, all if not given", ""},
+	{"source-deny", "sourcedeny", "addresses or networks packets are dropped from, whatever source-allow has", ""},
+	{"source-deny-log", "sourcedenylog", "log one in every so many packets dropped by source-allow and source-deny, 0 none", "0"},
+	{"unconnected-packet-rate", "unconnectedrate", "packets a second from addresses with no session, 0 for no limit", "0"},
+	{"unconnected-address-rate", "unconnectedaddrs", "addresses with no session packets are taken from a second, 0 for no limit", "0"},
+	{"unknown-disconnect-interval", "unknowndisconnect", "how long after a DISCONNECT to an address with no session another is held back, 0s never", "10s"},
+	{"fault-loss", "faultloss", "probability a packet is lost", "0"},
+	{"fault-duplicate", "faultduplicate", "probability a packet is duplicated", "0"},
+	{"fault-delay", "faultdelay", "how long each packet is delayed", "0s"},
+	{"fault-jitter", "faultjitter", "how much each delay varies by", "0s"},
+	{"fault-reorder", "faultreorder", "packets a delayed one may be overtaken by", "0"},
+	{"fault-seed", "faultseed", "seed of the faults", ""},
+	{"listener", "listeners", "udp, udp6, dtls, tcp, unix, unixgram or serial://address?option=value&... to listen on besides", ""},
+	{"dtls-port", "dtlsport", "UDP port to listen for DTLS clients on", ""},
+	{"dtls-psk-file", "dtlspskfile", "pre-shared keys of DTLS clients", ""},
+	{"dtls-cert-file", "dtlscertfile", "certificate of the DTLS listener", ""},
+	{"dtls-key-file", "dtlskeyfile", "key of the certificate", ""},
+	{"dtls-client-ca-file", "dtlsclientcafile", "CA certificates DTLS clients are verified with", ""},
+	{"dtls-client-cert-required", "dtlsclientcertrequired", "whether DTLS clients must have a certificate", "false"},
+	{"tcp-port", "tcpport", "TCP port to listen on", ""},
+	{"unix-socket", "unixsocket", "unix socket to listen on", ""},
+	{"unix-socket-mode", "unixmode", "mode of the unix socket", "0660"},
+	{"serial-device", "serialdevice", "serial device to listen on", ""},
+	{"serial-baud", "serialbaud", "baud rate of the serial device", "115200"},
+	{"tcp-idle-timeout", "tcpidletimeout", "how long a TCP connection may be idle", "5m"},
+	{"connection-idle-timeout", "idletimeout", "how long a connection may be idle", "5m"},
+	{"max-connections", "maxconnections", "TCP connections and DTLS sessions at once", "10000"},
+	{"gateway-id", "gatewayid", "gateway id advertised", "1"},
+	{"advertise-interval", "advertiseinterval", "time between ADVERTISEs", "15m"},
+	{"searchgw-delay", "searchgwdelay", "longest a GWINFO answering a multicast SEARCHGW is held back", "0s"},
+	{"multicast-group", "multicastgroup", "group ADVERTISEs are sent to", ""},
+	{"multicast-interface", "multicastinterface", "interface ADVERTISEs are sent on", ""},
+	{"multicast-loopback", "multicastloopback", "whether ADVERTISEs are looped back", "false"},
+	{"keepalive-multiplier", "keepalivemultiplier", "times a client's keepalive its broker connection's is", "1"},
+	{"keepalive-max", "keepalivemax", "longest keepalive a client may have", "0s"},
+	{"keepalive-default", "keepalivedefault", "keepalive of a client giving none", "60s"},
+	{"keepalive-grace", "keepalivegrace", "times its keepalive a client may be silent for", "1.5"},
+	{"sleep-grace", "sleepgrace", "times its sleep duration a sleeping client may be silent for", "1.5"},
+	{"retry-interval", "retryinterval", "how long an acknowledgement is waited for before resending", "10s"},
+	{"retry-count", "retrycount", "times a message is resent before giving up", "3"},
+	{"client-id-prefix", "clientidprefix", "prefix of the client ids given the broker", ""},
+	{"client-id-max-length", "clientidmaxlen", "longest client id given the broker", "23"},
+	{"client-id-overflow", "clientidoverflow", "what is done with longer client ids", "reject"},
+	{"credentials-file", "credentialsfile", "broker credentials of each client", ""},
+	{"credentials-required", "credentialsrequired", "whether clients without credentials are refused", "false"},
+	{"client-allow", "clientallow", "client ids and patterns, comma separated, CONNECTs are taken from, all if neither this nor client-allow-file is given", ""},
+	{"client-allow-file", "clientallowfile", "file of the client ids and patterns CONNECTs are taken from, a line each", ""},
+	{"acl-file", "aclfile", "file of the rules of which topics each client may publish and subscribe to, all if not given", ""},
+	{"acl-default", "acldefaultallow", "what is done with a topic no rule of acl-file matches: allow or deny", "deny"},
+	{"auth-registry-file", "authregistryfile", "file of the client ids and patterns CONNECTs are accepted from, a line each with the metadata the client is given, all if not given", ""},
+	{"max-broker-connections", "maxbrokerconns", "broker connections of a transparent gateway at once", "0"},
+	{"broker-connect-rate", "brokerconnectrate", "broker connections made a second", "0"},
+	{"broker-connect-queue", "brokerconnectqueue", "whether connections beyond that wait", "false"},
+	{"broker-reconnects", "brokerreconnects", "times a lost broker connection is made again", "0"},
+	{"disconnect-on-stop", "disconnectonstop", "whether clients are sent DISCONNECT on stop", "false"},
+	{"drain-timeout", "draintimeout", "how long a drain waits for clients", "60s"},
+	{"log-level", "loglevel", "what is logged: error, warn, info or debug", "info"},
+	{"log-format", "logformat", "how lines are logged: text, json or logfmt", "text"},
+	{"log-destination", "logdestination", "where lines are logged: stdout (errors to stderr), stderr, syslog or a file", "stdout"},
+	{"log-max-size", "logmaxsize", "bytes a log file grows to before it rotates, 0 never", "0"},
+	{"log-max-backups", "logmaxbackups", "rotated log files kept, 0 all", "0"},
+	{"log-max-age", "logmaxage", "how long rotated log files are kept, 0s whatever their age", "0s"},
+	{"log-sync", "logsync", "how often a log file is synced: none, line or a duration", "none"},
+	{"log-syslog-address", "logsyslogaddr", "remote syslog daemon, udp:// or tcp://, if not the local one", ""},
+	{"log-syslog-tag", "logsyslogtag", "program name lines sent to syslog are tagged with", "gnatt"},
+	{"log-packets", "logpackets", "log every packet received and sent as hex, whatever the log-level", "false"},
+	{"log-packets-client", "logpacketsid", "the client id log-packets logs the packets of, all if not given", ""},
+	{"log-packets-address", "logpacketsaddr", "the host or host:port log-packets logs the packets of, all if not given", ""},
+	{"log-trace-client", "tracedclients", "client ids, comma separated, whose packets and lines are logged at info whatever the log-level", ""},
+	{"log-trace-duration", "traceduration", "how long a client is traced before it expires", "1h"},
+	{"audit-file", "auditfile", "file the clients' sessions and the admin API's actions are recorded to, off if not given", ""},
+	{"audit-max-size", "auditmaxsize", "bytes the audit file grows to before it rotates, 0 never", "0"},
+	{"audit-max-backups", "auditmaxbackups", "rotated audit files kept, 0 all", "0"},
+	{"audit-sync", "auditsync", "how often the audit file is synced: none, line or a duration", "line"},
+	{"admin-address", "adminaddress", "host:port of the admin HTTP listener, off if not given", ""},
+	{"admin-token", "admintoken", "bearer token the admin listener requires, if given", ""},
+	{"admin-pprof", "adminpprof", "serve net/http/pprof's profiles on the admin listener", "false"},
+	{"admin-pprof-public", "adminpprofpublic", "allow admin-pprof on an admin-address that is not loopback", "false"},
+	{"admin-pprof-mutex-fraction", "adminpprofmutex", "1 in how many mutex contention events are profiled, 0 none", "0"},
+	{"admin-pprof-block-rate", "adminpprofblock", "nanoseconds blocked per blocking event profiled, 0 none", "0"},
+	{"admin-ready-broker", "adminreadyany", "whether /readyz waits for the broker to be connected", "true"},
+	{"sys-interval", "sysinterval", "how often the gateway's statistics are published to its clients, 0s never", "0s"},
+	{"sys-prefix", "sysprefix", "the topics the gateway's statistics are published under", "$SYS/gateway"},
+	{"capture-enabled", "capture", "capture every packet to capture-file from the start", "false"},
+	{"capture-file", "capturefile", "pcap file packets are captured to, by capture-enabled or the admin API", ""},
+	{"capture-max-size", "capturemaxsize", "bytes a capture file grows to before it rolls over", "67108864"},
+	{"capture-max-backups", "capturemaxbackups", "capture files rolled over that are kept", "1"},
+	{"latency-register-rtt", "latencyregisterrtt", "time the round trip of every REGISTER to each client", "false"},
+}
+
+// The options given as command-line flags, one for each option,
+// named as it is, which may be given more than once as it may
+type ConfigFlags struct {
+	set []configEntry
+}
+
+// Define a flag for each option in fs
+func NewConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+	cf := &ConfigFlags{}
+	for _, o := range configOptions {
+		fs.Var(configFlag{cf, o.name}, o.name, o.usage)
+	}
+	return cf
+}
+
+// A flag setting an option
+type configFlag struct {
+	cf   *ConfigFlags
+	name string
+}
+
+func (f configFlag) String() string {
+	return ""
+}
+
+func (f configFlag) Set(value string) error {
+	f.cf.set = append(f.cf.set, configEntry{f.name, value})
+	return nil
+}
+
+// Set the options given in gc, over those of its file and the
+// environment, in the order they were given
+func (cf *ConfigFlags) Apply(gc *GatewayConfig) error {
+	for _, e := range cf.set {
+		if err := gc.setOption(e.key, e.value.(string)); err != nil {
+			ERROR.Printf("Error in configuration from flag -%s", e.key)
+			return &ConfigError{"-" + e.key, err}
+		}
+	}
+	return nil
+}
+
+// Whether gc has a broker and somewhere to listen, as a
+// configuration given only by flags must
+func (gc *GatewayConfig) isUsable() bool {
+	return gc.mqttbroker != "" && (addrPort(gc.listenAddress()) != 0 || len(gc.listeners) > 0)
+}
+
+// Write every option to w as a YAML configuration, each
+// described and commented out, with the value it has unless set
+// if it has one, as -print-default-config prints them
+func PrintDefaultConfig(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("# Every option of the gateway, with the value it has unless set.\n")
+	b.WriteString("# Those given more than once take a list of values.\n")
+	for _, o := range configOptions {
+		b.WriteString("\n# " + o.usage + "\n#" + o.name + ":")
+		if o.def != "" {
+			b.WriteString(" " + o.def)
+		}
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
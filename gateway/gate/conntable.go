@@ -0,0 +1,89 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a TCP connection or DTLS session may go without a
+// packet unless configured otherwise; longer than clients'
+// keepalives
+const defaultIdleTimeout = 5 * time.Minute
+
+// How many TCP connections and DTLS sessions a gateway has open
+// at once unless configured otherwise
+const defaultMaxConnections = 10000
+
+// The TCP connections and DTLS sessions, handshaking or not, a
+// gateway's listeners have open, shared between them so that
+// together they have no more than max. Those that go idle are
+// closed by their listeners and counted here.
+type connTable struct {
+	sync.Mutex
+	conns    map[net.Conn]*listenerCounters
+	max      int
+	timeouts uint64
+	refused  uint64
+}
+
+func newConnTable(max int) *connTable {
+	return &connTable{conns: make(map[net.Conn]*listenerCounters), max: max}
+}
+
+// Add conn, open on the listener l, unless max are open
+// already, when it is counted as refused
+func (t *connTable) add(conn net.Conn, l *listenerCounters) bool {
+	defer t.Unlock()
+	t.Lock()
+	if len(t.conns) >= t.max {
+		t.refused++
+		return false
+	}
+	t.conns[conn] = l
+	return true
+}
+
+func (t *connTable) remove(conn net.Conn) {
+	defer t.Unlock()
+	t.Lock()
+	delete(t.conns, conn)
+}
+
+// Close every connection open on the listener l
+func (t *connTable) close(l *listenerCounters) {
+	defer t.Unlock()
+	t.Lock()
+	for conn, cl := range t.conns {
+		if cl == l {
+			conn.Close()
+		}
+	}
+}
+
+// Count a connection closed for being idle if err, what ended
+// it, is a timeout, reporting whether it was
+func (t *connTable) timedOut(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		atomic.AddUint64(&t.timeouts, 1)
+		return true
+	}
+	return false
+}
+
+// The TCP connections and DTLS sessions open, and how many have
+// been closed for being idle or refused for being too many
+type ConnectionStats struct {
+	Open         int
+	IdleTimeouts uint64
+	Refused      uint64
+}
+
+func (t *connTable) stats() ConnectionStats {
+	defer t.Unlock()
+	t.Lock()
+	return ConnectionStats{len(t.conns), atomic.LoadUint64(&t.timeouts), t.refused}
+}
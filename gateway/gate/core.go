@@ -0,0 +1,776 @@
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// The MQTT-SN side shared by both gateways: decoding packets,
+// finding the client they are from and the exchanges that do
+// not depend on how the gateway talks to the broker, which is
+// left to its backend.
+type core struct {
+	oversizedPackets uint64
+	transformDrops   uint64
+	notAllowed       uint64
+	aclDenied        uint64
+	authRefused      uint64
+	publishLimited   uint64
+	life             int32
+	clients          Clients
+	tIndex           topicNames
+	middlewares      []Middleware
+	backend          backend
+	discovery        *discovery
+	sys              *sysTopics
+	latency          *latencies
+	sources          atomic.Pointer[sourceLimiter]
+	allowed          atomic.Pointer[allowlist]
+	filter           atomic.Pointer[sourceFilter]
+	flood            atomic.Pointer[floodGuard]
+	acl              atomic.Pointer[acl]
+	registry         atomic.Pointer[RegistryAuthenticator]
+	faults           *Faults
+	admin            *admin
+	bans             *bans
+	audit            *audit
+	window           *publishWindow
+	upTransform      Transform
+	downTransform    Transform
+	auth             Authenticator
+	echoes           *echoes
+	timers           protocolTimers
+	maxClients       int
+	clientLimits     clientLimits
+	publishLimits    publishLimits
+	config           atomic.Pointer[GatewayConfig]
+	reloading        sync.Mutex
+}
+
+// What a gateway does with the broker for its clients
+type backend interface {
+	// Answer a CONNECT, or start its will exchange
+	handle_CONNECT(m *ConnectMessage, c uConn, a uAddr)
+	// Accept the client once its will exchange is done
+	accept(client SNClient)
+	publishUpstream(client SNClient, topic string, m *PublishMessage) error
+	// Return the QoS granted, ErrSubscriptionRefused if the
+	// subscription is not allowed
+	subscribeUpstream(client SNClient, topic string, qos byte) (byte, error)
+	unsubscribeUpstream(client SNClient, topic string)
+	// Return the return code for the WILLTOPICRESP or WILLMSGRESP
+	updateWill(client SNClient) byte
+	// End the client's session, it is no longer a client
+	disconnect(client SNClient, reason string)
+	// The client is gone without a DISCONNECT, its connection
+	// having closed
+	lost(client SNClient)
+	// End the client's session as the gateway, publishing its
+	// will if will and the gateway holds it
+	kick(client SNClient, will bool)
+	// The client has gone to sleep for d
+	asleep(client SNClient, d time.Duration)
+}
+
+func newCore() core {
+	return core{
+		clients: Clients{
+			clients: make(map[string]SNClient),
+		},
+		tIndex: topicNames{
+			contents:   make(map[uint16]string),
+			predefined: make(map[uint16]string),
+		},
+		latency:      newLatencies(),
+		bans:         newBans(),
+		timers:       defaultTimers(),
+		clientLimits: defaultClientLimits(),
+	}
+}
+
+// Add a middleware to the chain every packet from a client
+// goes through. Must be called before Start.
+func (g *core) Use(m Middleware) {
+	g.middlewares = append(g.middlewares, m)
+}
+
+// How long a drain waits for the clients, as the configuration
+// the gateway runs with, reloaded or not, has it
+func (g *core) DrainTimeout() time.Duration {
+	return g.config.Load().DrainTimeout()
+}
+
+// Decode the first nbytes of buffer and pass the packet down
+// the middleware chain. buffer belongs to the caller, who may
+// reuse it once OnPacket returns.
+func (g *core) OnPacket(nbytes int, buffer []byte, con uConn, addr uAddr) {
+	received := time.Now()
+	if !g.admitUnconnected(buffer[:nbytes], addr, received) {
+		return
+	}
+	if cp := captures.Load(); cp != nil {
+		cp.packet(addr.r, con.localAddr(), buffer[:nbytes])
+	}
+	if DEBUG.Enabled() {
+		DEBUG.Log(fmt.Sprintf("%d bytes: % x", nbytes, buffer[:nbytes]), coreLog, logRemote(addr))
+	}
+
+	buf := bytes.NewBuffer(buffer[:nbytes])
+	rawmsg, err := ReadPacket(buf)
+	if err != nil {
+		if d := packetDumps.Load(); d != nil {
+			g.dumpInbound(d, nil, buffer[:nbytes], addr)
+		}
+		if traces.active() {
+			g.traceInbound(nil, buffer[:nbytes], addr)
+		}
+		ERROR.Log("malformed packet: "+err.Error(), coreLog, logRemote(addr))
+		return
+	}
+	if e, ok := rawmsg.(*EncapsulatedMessage); ok {
+		// from a wireless node, relayed by a forwarder
+		if rawmsg, addr = decapsulate(e, addr); rawmsg == nil || rawmsg.MessageType() == ENCMSG {
+			ERROR.Log("malformed encapsulated packet", coreLog, logRemote(addr))
+			return
+		}
+		if g.clients.GetClient(addr) == nil && !g.flood.Load().allow(addr, received) {
+			return
+		}
+	}
+	if d := packetDumps.Load(); d != nil {
+		g.dumpInbound(d, rawmsg, buffer[:nbytes], addr)
+	}
+	if traces.active() {
+		g.traceInbound(rawmsg, buffer[:nbytes], addr)
+	}
+	DEBUG.Log("decoded", coreLog, logMsgType(rawmsg.MessageType()), logRemote(addr))
+
+	chain(g.middlewares, g.handle)(rawmsg, con, addr)
+	g.latency.handled(rawmsg.MessageType(), time.Since(received))
+}
+
+// The last PacketHandler of the middleware chain
+func (g *core) handle(rawmsg Message, con uConn, addr uAddr) {
+	switch msg := rawmsg.(type) {
+	case *ConnectMessage:
+		if g.bans.banned(string(msg.ClientId), addr, time.Now()) {
+			WARN.Log("banned, CONNECT refused", coreLog, logClientId(string(msg.ClientId)), logRemote(addr))
+			sendConnack(con, addr, REJ_NOT_SUPORTED)
+			return
+		}
+		if !g.allowed.Load().allows(string(msg.ClientId)) {
+			WARN.Log("client id not allowed, CONNECT refused", coreLog, logClientId(string(msg.ClientId)), logRemote(addr))
+			atomic.AddUint64(&g.notAllowed, 1)
+			sendConnack(con, addr, REJ_NOT_SUPORTED)
+			return
+		}
+		g.flood.Load().forget(addr)
+		g.backend.handle_CONNECT(msg, con, addr)
+		return
+	case *PingreqMessage:
+		g.handle_PINGREQ(msg, con, addr)
+		return
+	case *SearchGwMessage:
+		g.handle_SEARCHGW(msg, con, addr)
+		return
+	case *AdvertiseMessage, *GwInfoMessage:
+		DEBUG.Log("ignored", coreLog, logMsgType(rawmsg.MessageType()), logRemote(addr))
+		return
+	case *PublishMessage:
+		if msg.Qos == 3 {
+			g.handle_PUBLISH_QoS_minus_one(msg, con, addr)
+			return
+		}
+	}
+
+	// everything else needs a client; one the gateway does not
+	// know (it may have restarted) is told to connect again
+	client := g.clients.GetClient(addr)
+	if client == nil {
+		if !g.flood.Load().disconnect(addr, time.Now()) {
+			DEBUG.Log("packet from an unknown client, told to connect again recently", coreLog, logMsgType(rawmsg.MessageType()), logRemote(addr))
+			return
+		}
+		ERROR.Log("packet from an unknown client", coreLog, logMsgType(rawmsg.MessageType()), logRemote(addr))
+		if err := con.WriteTo(NewMessage(DISCONNECT), addr); err != nil {
+			ERROR.Log(err.Error(), coreLog, logRemote(addr))
+		}
+		return
+	}
+	client.base().Touch()
+
+	switch msg := rawmsg.(type) {
+	case *WillTopicMessage:
+		g.handle_WILLTOPIC(msg, client)
+	case *WillMsgMessage:
+		g.handle_WILLMSG(msg, client)
+	case *RegisterMessage:
+		g.handle_REGISTER(msg, client)
+	case *RegackMessage:
+		g.handle_REGACK(msg, client)
+	case *PublishMessage:
+		g.handle_PUBLISH(msg, client)
+	case *PubackMessage:
+		g.handle_PUBACK(msg, client)
+	case *PubcompMessage:
+		g.handle_PUBCOMP(msg, client)
+	case *PubrecMessage:
+		g.handle_PUBREC(msg, client)
+	case *PubrelMessage:
+		g.handle_PUBREL(msg, client)
+	case *SubscribeMessage:
+		g.handle_SUBSCRIBE(msg, client)
+	case *UnsubscribeMessage:
+		g.handle_UNSUBSCRIBE(msg, client)
+	case *DisconnectMessage:
+		g.handle_DISCONNECT(msg, client)
+	case *WillTopicUpdateMessage:
+		g.handle_WILLTOPICUPD(msg, client)
+	case *WillMsgUpdateMessage:
+		g.handle_WILLMSGUPD(msg, client)
+	default:
+		ERROR.Log(fmt.Sprintf("unexpected message type %T", msg), coreLog, logClient(client.base()))
+	}
+}
+
+// Refuse the CONNECT of a client in its will exchange
+func (g *core) refuse(client *Client, rc byte) {
+	g.clients.RemoveClient(client.Address)
+	sendConnack(client.Conn, client.Address, rc)
+}
+
+func (g *core) handle_WILLTOPIC(m *WillTopicMessage, sc SNClient) {
+	client := sc.base()
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logClient(client), logRemote(client.Address))
+	if client.State() != CONNECTING {
+		ERROR.Log("unexpected packet", coreLog, logMsgType(m.MessageType()), logClient(client))
+		return
+	}
+	if len(m.WillTopic) == 0 {
+		// an empty WILLTOPIC means no will after all
+		g.backend.accept(sc)
+		return
+	}
+	if _, err := ValidateTopicName(string(m.WillTopic)); err != nil {
+		ERROR.Log("refused, invalid will topic: "+err.Error(), coreLog, logClient(client), logTopic(string(m.WillTopic)))
+		g.refuse(client, REJ_NOT_SUPORTED)
+		return
+	}
+	if !g.authorized(client, aclPublish, string(m.WillTopic)) {
+		g.refuse(client, REJ_NOT_SUPORTED)
+		return
+	}
+	client.SetWillTopic(string(m.WillTopic), m.Qos, m.Retain)
+	if ioerr := client.Write(NewMessage(WILLMSGREQ)); ioerr != nil {
+		ERROR.Log(ioerr.Error(), coreLog, logClient(client))
+	} else {
+		DEBUG.Log("sent", coreLog, logMsgType(WILLMSGREQ), logClient(client))
+	}
+}
+
+func (g *core) handle_WILLMSG(m *WillMsgMessage, sc SNClient) {
+	client := sc.base()
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logClient(client), logRemote(client.Address))
+	if client.State() != CONNECTING || !client.SetWillMessage(m.WillMsg) {
+		ERROR.Log("unexpected packet", coreLog, logMsgType(m.MessageType()), logClient(client))
+		return
+	}
+	g.backend.accept(sc)
+}
+
+func (g *core) handle_REGISTER(m *RegisterMessage, sc SNClient) {
+	client := sc.base()
+	topic := string(m.TopicName)
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logClient(client), logRemote(client.Address), logMsgId(m.MessageId), logTopic(topic))
+
+	if _, err := ValidateTopicName(topic); err != nil {
+		ERROR.Log("cannot register: "+err.Error(), coreLog, logClient(client), logTopic(topic))
+		if ioerr := client.Write(NewRegackMessage(0, m.MessageId, REJ_NOT_SUPORTED)); ioerr != nil {
+			ERROR.Log(ioerr.Error(), coreLog, logClient(client))
+		}
+		return
+	}
+	if !g.authorized(client, aclPublish, topic) {
+		if ioerr := client.Write(NewRegackMessage(0, m.MessageId, REJ_NOT_SUPORTED)); ioerr != nil {
+			ERROR.Log(ioerr.Error(), coreLog, logClient(client))
+		}
+		return
+	}
+
+	var topicid uint16
+	if !g.tIndex.containsTopic(topic) {
+		topicid = g.tIndex.putTopic(topic)
+	} else {
+		topicid = g.tIndex.getId(topic)
+	}
+	DEBUG.Log("registered", coreLog, logClient(client), logTopic(topic), logTopicId(topicid))
+	if topicid == 0 {
+		if ioerr := client.Write(NewRegackMessage(0, m.MessageId, REJ_CONGESTION)); ioerr != nil {
+			ERROR.Log(ioerr.Error(), coreLog, logClient(client))
+		}
+		return
+	}
+
+	client.Register(topicid, topic)
+
+	ra := NewRegackMessage(topicid, m.MessageId, ACCEPTED)
+	if err := client.Write(ra); err != nil {
+		ERROR.Log(err.Error(), coreLog, logClient(client))
+	} else {
+		DEBUG.Log("sent", coreLog, logMsgType(REGACK), logClient(client), logMsgId(m.MessageId))
+	}
+}
+
+func (g *core) handle_REGACK(m *RegackMessage, sc SNClient) {
+	client := sc.base()
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logClient(client), logRemote(client.Address))
+	// the gateway sends a register when there is a message
+	// that needs to be published, so we do that now
+	if !client.AckRegister(m) {
+		ERROR.Log("unexpected packet", coreLog, logMsgType(REGACK), logClient(client), logTopicId(m.TopicId), logMsgId(m.MessageId))
+	}
+}
+
+func (g *core) handle_PUBLISH(m *PublishMessage, sc SNClient) {
+	client := sc.base()
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logClient(client), logRemote(client.Address))
+
+	var topic string
+	switch m.TopicIdType {
+	case topicIdNormal:
+		if topic = g.tIndex.getTopic(m.TopicId); !client.Registered(m.TopicId) {
+			topic = ""
+		}
+	case topicIdPredefined:
+		// one with wildcards can only be subscribed to
+		if topic = g.tIndex.getPredefined(m.TopicId); ContainsWildcard(topic) {
+			topic = ""
+		}
+	}
+	if topic == "" {
+		ERROR.Log(fmt.Sprintf("PUBLISH to an unknown topic id of type %d", m.TopicIdType), coreLog, logClient(client), logTopicId(m.TopicId), logMsgId(m.MessageId))
+		sendPuback(client, m, REJ_INVALID_TID)
+		return
+	}
+	if g.sys.local(topic) {
+		// the gateway's own topics are not published to
+		WARN.Log("PUBLISH to the gateway's own topic refused", coreLog, logClient(client), logTopic(topic), logMsgId(m.MessageId))
+		g.answer(client, m, REJ_NOT_SUPORTED)
+		return
+	}
+	if !g.authorized(client, aclPublish, topic) {
+		g.answer(client, m, REJ_NOT_SUPORTED)
+		return
+	}
+
+	DEBUG.Log("publishing", coreLog, logClient(client), logTopic(topic), logMsgId(m.MessageId), Field{"qos", m.Qos}, Field{"retain", m.Retain})
+	if m.Qos == 2 && !client.Received(m.MessageId) {
+		// the PUBREC was lost, the message was published already
+		DEBUG.Log("duplicate PUBLISH", coreLog, logClient(client), logMsgId(m.MessageId))
+		sendPubrec(client, m)
+		return
+	}
+	if limited := client.overPublishLimit(len(m.Data), time.Now()); limited > 0 {
+		g.overPublishLimit(sc, m, limited)
+		return
+	}
+	if g.upTransform != nil {
+		t, data, err := g.transform(g.upTransform, topic, m.Data)
+		if err != nil {
+			ERROR.Log("PUBLISH dropped: "+err.Error(), coreLog, logClient(client), logTopic(topic), logMsgId(m.MessageId))
+			g.answer(client, m, REJ_NOT_SUPORTED)
+			return
+		}
+		pm := *m
+		if !m.Retain || len(m.Data) > 0 {
+			pm.Data = data
+		}
+		topic, m = t, &pm
+	}
+	g.echoes.published(client, topic, m.Data)
+	if g.window != nil {
+		g.window.submit(client, topic, m, func(err error) {
+			g.published(client, m, err)
+		})
+		return
+	}
+	g.published(client, m, g.backend.publishUpstream(sc, topic, m))
+}
+
+// A PUBLISH at QoS -1, from a client that need not be
+// connected, to a pre-defined topic or a short topic name. It is
+// published if the listener it came through allows it and the
+// gateway has a broker connection of its own; nothing is
+// answered either way.
+func (g *core) handle_PUBLISH_QoS_minus_one(m *PublishMessage, con uConn, addr uAddr) {
+	DEBUG.Log("received at QoS -1", coreLog, logMsgType(m.MessageType()), logRemote(addr))
+	if !con.l.allowsQosMinusOne() {
+		ERROR.Log("QoS -1 PUBLISH not allowed on its listener, dropped", coreLog, logRemote(addr))
+		return
+	}
+	var topic string
+	switch m.TopicIdType {
+	case topicIdPredefined:
+		topic = g.tIndex.getPredefined(m.TopicId)
+	case topicIdShort:
+		topic = string([]byte{byte(m.TopicId >> 8), byte(m.TopicId)})
+	}
+	if _, err := ValidateTopicName(topic); err != nil {
+		ERROR.Log(fmt.Sprintf("QoS -1 PUBLISH to an unknown topic id of type %d, dropped", m.TopicIdType), coreLog, logRemote(addr), logTopicId(m.TopicId))
+		return
+	}
+	if !g.acl.Load().allows("", aclPublish, topic) {
+		WARN.Log("QoS -1 PUBLISH denied by the ACL, dropped", coreLog, logRemote(addr), logTopic(topic))
+		atomic.AddUint64(&g.aclDenied, 1)
+		return
+	}
+	p, ok := g.backend.(connectionlessPublisher)
+	if !ok {
+		ERROR.Log("QoS -1 PUBLISH dropped, there is no broker connection but a client's", coreLog, logRemote(addr), logTopic(topic))
+		return
+	}
+	if g.upTransform != nil {
+		t, data, err := g.transform(g.upTransform, topic, m.Data)
+		if err != nil {
+			ERROR.Log("QoS -1 PUBLISH dropped: "+err.Error(), coreLog, logRemote(addr), logTopic(topic))
+			return
+		}
+		pm := *m
+		pm.Data = data
+		topic, m = t, &pm
+	}
+	if err := p.publishConnectionless(topic, m); err != nil {
+		ERROR.Log("QoS -1 PUBLISH not published: "+err.Error(), coreLog, logRemote(addr), logTopic(topic))
+	}
+}
+
+// A backend publishing to the broker for clients that are not
+// connected, as those publishing at QoS -1 need not be
+type connectionlessPublisher interface {
+	publishConnectionless(topic string, m *PublishMessage) error
+}
+
+// Answer the client's PUBLISH, now published to the broker or
+// not
+func (g *core) published(client *Client, m *PublishMessage, err error) {
+	var rc byte = ACCEPTED
+	if err != nil {
+		ERROR.Log("PUBLISH not published: "+err.Error(), coreLog, logClient(client), logMsgId(m.MessageId))
+		rc = REJ_CONGESTION
+	} else {
+		DEBUG.Log("published", coreLog, logClient(client), logMsgId(m.MessageId))
+	}
+	g.answer(client, m, rc)
+}
+
+// Answer the client's PUBLISH with rc, for which a QoS 2 one is
+// released if it is not ACCEPTED
+func (g *core) answer(client *Client, m *PublishMessage, rc byte) {
+	switch {
+	case m.Qos == 2 && rc != ACCEPTED:
+		client.Released(m.MessageId)
+		sendPuback(client, m, rc)
+	case m.Qos == 1:
+		sendPuback(client, m, rc)
+	case m.Qos == 2:
+		sendPubrec(client, m)
+	}
+}
+
+func sendPuback(client *Client, m *PublishMessage, rc byte) {
+	if m.Qos == 0 && rc == ACCEPTED {
+		return
+	}
+	pa := NewMessage(PUBACK).(*PubackMessage)
+	pa.TopicId = m.TopicId
+	pa.MessageId = m.MessageId
+	pa.ReturnCode = rc
+	if err := client.Write(pa); err != nil {
+		ERROR.Log(err.Error(), coreLog, logClient(client))
+	}
+}
+
+func sendPubrec(client *Client, m *PublishMessage) {
+	pr := NewMessage(PUBREC).(*PubrecMessage)
+	pr.MessageId = m.MessageId
+	if err := client.Write(pr); err != nil {
+		ERROR.Log(err.Error(), coreLog, logClient(client))
+	}
+}
+
+func (g *core) handle_PUBACK(m *PubackMessage, sc SNClient) {
+	client := sc.base()
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logClient(client), logRemote(client.Address))
+	switch m.ReturnCode {
+	case REJ_INVALID_TID:
+		if !client.PublishRejected(m.MessageId) {
+			ERROR.Log("unexpected packet", coreLog, logMsgType(PUBACK), logClient(client), logMsgId(m.MessageId))
+		}
+		return
+	case ACCEPTED:
+	default:
+		ERROR.Log(fmt.Sprintf("PUBLISH rejected with rc %d", m.ReturnCode), coreLog, logClient(client), logMsgId(m.MessageId))
+	}
+	if !client.AckPublish(m.MessageId) {
+		ERROR.Log("unexpected packet", coreLog, logMsgType(PUBACK), logClient(client), logMsgId(m.MessageId))
+	}
+}
+
+func (g *core) handle_PUBCOMP(m *PubcompMessage, sc SNClient) {
+	client := sc.base()
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logClient(client), logRemote(client.Address))
+	if !client.AckPublish(m.MessageId) {
+		ERROR.Log("unexpected packet", coreLog, logMsgType(PUBCOMP), logClient(client), logMsgId(m.MessageId))
+	}
+}
+
+func (g *core) handle_PUBREC(m *PubrecMessage, sc SNClient) {
+	client := sc.base()
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logClient(client), logRemote(client.Address))
+	if !client.PublishReceived(m.MessageId) {
+		ERROR.Log("unexpected packet", coreLog, logMsgType(PUBREC), logClient(client), logMsgId(m.MessageId))
+	}
+}
+
+// The second half of a QoS 2 PUBLISH from the client, which
+// was published when it arrived. A PUBREL resent because the
+// PUBCOMP was lost is answered again.
+func (g *core) handle_PUBREL(m *PubrelMessage, sc SNClient) {
+	client := sc.base()
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logClient(client), logRemote(client.Address))
+	if !client.Released(m.MessageId) {
+		DEBUG.Log("PUBREL for no PUBLISH", coreLog, logClient(client), logMsgId(m.MessageId))
+	}
+	pc := NewMessage(PUBCOMP).(*PubcompMessage)
+	pc.MessageId = m.MessageId
+	if err := client.Write(pc); err != nil {
+		ERROR.Log(err.Error(), coreLog, logClient(client))
+	}
+}
+
+func (g *core) handle_SUBSCRIBE(m *SubscribeMessage, sc SNClient) {
+	client := sc.base()
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logClient(client), logRemote(client.Address))
+	var topicid uint16
+	var rc byte = ACCEPTED
+	qos := m.Qos
+	topic := string(m.TopicName)
+	if m.TopicIdType == topicIdPredefined {
+		topic = g.tIndex.getPredefined(m.TopicId)
+	}
+	if m.TopicIdType != topicIdNormal && m.TopicIdType != topicIdPredefined { // todo: short topic names
+		ERROR.Log(fmt.Sprintf("topic id type %d not supported", m.TopicIdType), coreLog, logClient(client), logMsgId(m.MessageId))
+		rc = REJ_NOT_SUPORTED
+	} else if topic == "" && m.TopicIdType == topicIdPredefined {
+		ERROR.Log("SUBSCRIBE to an unknown pre-defined topic id", coreLog, logClient(client), logTopicId(m.TopicId), logMsgId(m.MessageId))
+		rc = REJ_INVALID_TID
+	} else if _, err := ValidateTopicFilter(topic); err != nil {
+		ERROR.Log("cannot subscribe: "+err.Error(), coreLog, logClient(client), logTopic(topic), logMsgId(m.MessageId))
+		rc = REJ_NOT_SUPORTED
+	} else if !g.authorized(client, aclSubscribe, topic) {
+		rc = REJ_NOT_SUPORTED
+	} else {
+		DEBUG.Log("subscribing", coreLog, logClient(client), logTopic(topic), Field{"qos", m.Qos})
+		if m.TopicIdType == topicIdPredefined {
+			topicid = m.TopicId
+		} else if !ContainsWildcard(topic) {
+			topicid = g.tIndex.getId(topic)
+			if topicid == 0 {
+				topicid = g.tIndex.putTopic(topic)
+			}
+			if topicid != 0 {
+				// the SUBACK tells the client the topic id
+				client.Register(topicid, topic)
+			}
+		}
+		if topicid == 0 && m.TopicIdType == topicIdNormal && !ContainsWildcard(topic) {
+			rc = REJ_CONGESTION
+		} else if granted, err := g.backend.subscribeUpstream(sc, topic, m.Qos); err == ErrSubscriptionRefused {
+			topicid = 0
+			rc = REJ_NOT_SUPORTED
+		} else if err != nil {
+			topicid = 0
+			rc = REJ_CONGESTION
+		} else {
+			qos = granted
+			client.Subscribe(topic, qos)
+		}
+	}
+
+	suba := NewSubackMessage(topicid, m.MessageId, qos, rc)
+	if err := client.Write(suba); err != nil {
+		ERROR.Log(err.Error(), coreLog, logClient(client))
+	} else {
+		DEBUG.Log("sent", coreLog, logMsgType(SUBACK), logClient(client), logMsgId(m.MessageId))
+	}
+}
+
+func (g *core) handle_UNSUBSCRIBE(m *UnsubscribeMessage, sc SNClient) {
+	client := sc.base()
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logClient(client), logRemote(client.Address))
+	topic := string(m.TopicName)
+	if m.TopicIdType == topicIdPredefined {
+		topic = g.tIndex.getPredefined(m.TopicId)
+	}
+	if m.TopicIdType != topicIdNormal && m.TopicIdType != topicIdPredefined {
+		ERROR.Log(fmt.Sprintf("topic id type %d not supported", m.TopicIdType), coreLog, logClient(client), logMsgId(m.MessageId))
+	} else if client.Unsubscribe(topic) {
+		g.backend.unsubscribeUpstream(sc, topic)
+	}
+	ua := NewMessage(UNSUBACK).(*UnsubackMessage)
+	ua.MessageId = m.MessageId
+	if err := client.Write(ua); err != nil {
+		ERROR.Log(err.Error(), coreLog, logClient(client))
+	} else {
+		DEBUG.Log("sent", coreLog, logMsgType(UNSUBACK), logClient(client), logMsgId(m.MessageId))
+	}
+}
+
+func (g *core) handle_PINGREQ(m *PingreqMessage, c uConn, a uAddr) {
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logRemote(a))
+	if sc := g.clients.GetClient(a); sc != nil {
+		client := sc.base()
+		client.Touch()
+		if len(m.ClientId) > 0 && client.ClientId == string(m.ClientId) && client.State() == ASLEEP {
+			// a sleeping client checking for messages, it gets
+			// its PINGRESP once they have all been delivered
+			client.Wake()
+			return
+		}
+	}
+	if err := c.WriteTo(NewMessage(PINGRESP), a); err != nil {
+		ERROR.Log(err.Error(), coreLog, logRemote(a))
+	} else {
+		DEBUG.Log("sent", coreLog, logMsgType(PINGRESP), logRemote(a))
+	}
+}
+
+// A SEARCHGW sent to the gateway itself is answered to the
+// client alone; one on the multicast group is answered there
+func (g *core) handle_SEARCHGW(m *SearchGwMessage, c uConn, a uAddr) {
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logRemote(a))
+	if err := c.WriteTo(g.discovery.gwinfo(), a); err != nil {
+		ERROR.Log(err.Error(), coreLog, logRemote(a))
+	}
+}
+
+// A DISCONNECT with a duration puts the client to sleep, keeping
+// its session (a transparent client's broker connection pings
+// the broker itself meanwhile); otherwise the session ends
+func (g *core) handle_DISCONNECT(m *DisconnectMessage, sc SNClient) {
+	client := sc.base()
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logClient(client), logRemote(client.Address), Field{"duration", m.Duration})
+	if m.Duration > 0 {
+		client.Sleep()
+		client.SetKeepAlive(time.Duration(m.Duration) * time.Second)
+		g.backend.asleep(sc, time.Duration(m.Duration)*time.Second)
+	} else {
+		g.backend.disconnect(sc, DisconnectRequested)
+	}
+	if ioerr := client.Write(NewMessage(DISCONNECT)); ioerr != nil {
+		ERROR.Log(ioerr.Error(), coreLog, logClient(client))
+	}
+}
+
+// The client's DTLS session or TCP connection has closed, so
+// the client is lost, asleep or not
+func (g *core) closed(addr uAddr) {
+	if sc := g.clients.GetClient(addr); sc != nil {
+		INFO.Log("connection closed", coreLog, logClient(sc.base()), logRemote(addr))
+		g.backend.lost(sc)
+	}
+}
+
+// Disconnect the client with id as the gateway: it is sent a
+// DISCONNECT and its session ends, its will published if will,
+// and if ban is given its id and address are refused for as
+// long. False if there is no client with id.
+func (g *core) kickById(id string, will bool, ban time.Duration) bool {
+	client := g.clientById(id)
+	if client == nil {
+		return false
+	}
+	sc := g.clients.GetClient(client.Address)
+	if sc == nil {
+		return false
+	}
+	if ioerr := client.Write(NewMessage(DISCONNECT)); ioerr != nil {
+		ERROR.Log(ioerr.Error(), coreLog, logClient(client))
+	}
+	g.backend.kick(sc, will)
+	if ban > 0 {
+		g.bans.ban(id, client.Address, time.Now().Add(ban))
+	}
+	return true
+}
+
+// A packet larger than max was received and dropped
+func (g *core) oversized(addr uAddr, max int) {
+	atomic.AddUint64(&g.oversizedPackets, 1)
+	ERROR.Log(fmt.Sprintf("packet of more than %d bytes dropped", max), coreLog, logRemote(addr))
+}
+
+// The number of packets dropped for being larger than the
+// maximum message size
+func (g *core) OversizedPackets() uint64 {
+	return atomic.LoadUint64(&g.oversizedPackets)
+}
+
+// Whether a packet from addr may be handled, or is dropped for
+// its source being denied or not allowed, or going over its
+// rate limit
+func (g *core) admit(addr uAddr) bool {
+	if f := g.filter.Load(); f != nil && !f.allows(addr) {
+		return false
+	}
+	s := g.sources.Load()
+	return s == nil || s.allow(addr, time.Now())
+}
+
+// The packets dropped from each source address over its rate
+// limit, for the addresses still tracked
+func (g *core) RateLimitedSources() map[string]uint64 {
+	s := g.sources.Load()
+	if s == nil {
+		return nil
+	}
+	return s.dropped()
+}
+
+func (g *core) handle_WILLTOPICUPD(m *WillTopicUpdateMessage, sc SNClient) {
+	client := sc.base()
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logClient(client), logRemote(client.Address))
+	var rc byte = REJ_NOT_SUPORTED
+	if _, err := ValidateTopicName(string(m.WillTopic)); len(m.WillTopic) > 0 && err != nil {
+		ERROR.Log("invalid will topic: "+err.Error(), coreLog, logClient(client), logTopic(string(m.WillTopic)))
+	} else if len(m.WillTopic) == 0 || g.authorized(client, aclPublish, string(m.WillTopic)) {
+		client.UpdateWillTopic(string(m.WillTopic), m.Qos, m.Retain)
+		rc = g.backend.updateWill(sc)
+	}
+	wr := NewMessage(WILLTOPICRESP).(*WillTopicRespMessage)
+	wr.ReturnCode = rc
+	if err := client.Write(wr); err != nil {
+		ERROR.Log(err.Error(), coreLog, logClient(client))
+	}
+}
+
+func (g *core) handle_WILLMSGUPD(m *WillMsgUpdateMessage, sc SNClient) {
+	client := sc.base()
+	DEBUG.Log("received", coreLog, logMsgType(m.MessageType()), logClient(client), logRemote(client.Address))
+	var rc byte = REJ_NOT_SUPORTED
+	if !client.SetWillMessage(m.WillMsg) {
+		ERROR.Log("no will to update", coreLog, logClient(client))
+	} else {
+		rc = g.backend.updateWill(sc)
+	}
+	wr := NewMessage(WILLMSGRESP).(*WillMsgRespMessage)
+	wr.ReturnCode = rc
+	if err := client.Write(wr); err != nil {
+		ERROR.Log(err.Error(), coreLog, logClient(client))
+	}
+}
@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Broker credentials for the clients of the transparent gateway,
+// read from a file with a line per client:
+//
+//	clientid username password
+//
+// A client id ending in * is a prefix matching every client id
+// that starts with it; an exact match wins over a prefix, and a
+// longer prefix over a shorter one. Blank lines and lines
+// starting with # are ignored.
+type credentials struct {
+	sync.RWMutex
+	file     string
+	exact    map[string]credential
+	prefixes map[string]credential
+}
+
+type credential struct {
+	username string
+	password string
+}
+
+func loadCredentials(file string) (*credentials, error) {
+	c := &credentials{file: file}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Read the file again. If it cannot be read the credentials
+// already loaded are kept.
+func (c *credentials) reload() error {
+	apply, err := c.read()
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Read the file, returning what has the credentials in it used
+// from then on
+func (c *credentials) read() (func(), error) {
+	f, err := os.Open(c.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	exact := make(map[string]credential)
+	prefixes := make(map[string]credential)
+	scanner := bufio.NewScanner(f)
+	var lineno int
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			// not the line itself, it may well hold a password
+			ERROR.Printf("Invalid credentials on line %d of %s\n", lineno, c.file)
+			return nil, ErrInvalidCredentials
+		}
+		if strings.HasSuffix(fields[0], "*") {
+			prefixes[strings.TrimSuffix(fields[0], "*")] = credential{fields[1], fields[2]}
+		} else {
+			exact[fields[0]] = credential{fields[1], fields[2]}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		defer c.Unlock()
+		c.Lock()
+		c.exact = exact
+		c.prefixes = prefixes
+		INFO.Printf("loaded credentials for %d clients and %d prefixes from %s\n", len(exact), len(prefixes), c.file)
+	}, nil
+}
+
+// The credentials for clientid, if there are any
+func (c *credentials) lookup(clientid string) (credential, bool) {
+	defer c.RUnlock()
+	c.RLock()
+	if cred, ok := c.exact[clientid]; ok {
+		return cred, true
+	}
+	var best string
+	var found bool
+	for prefix := range c.prefixes {
+		if strings.HasPrefix(clientid, prefix) && (!found || len(prefix) > len(best)) {
+			best, found = prefix, true
+		}
+	}
+	return c.prefixes[best], found
+}
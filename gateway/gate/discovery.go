@@ -0,0 +1,226 @@
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// How often the gateway advertises itself unless configured
+// otherwise; the specification's T_ADV is at least 15 minutes
+const defaultAdvertiseInterval = 15 * time.Minute
+
+// The longest interval an ADVERTISE can give, in seconds
+const maxAdvertiseDuration = 0xffff
+
+// How clients find the gateway: it answers SEARCHGW with GWINFO,
+// and, given a multicast group, listens for SEARCHGW on the
+// group, answers it there, after a random delay of up to
+// searchDelay unless another gateway answers first, and sends
+// ADVERTISE to it every interval
+type discovery struct {
+	gatewayId   byte
+	interval    time.Duration
+	searchDelay time.Duration
+	group       *net.UDPAddr
+	ifname      string
+	loopback    bool
+	conn        *net.UDPConn
+	intervals   chan time.Duration
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func newDiscovery(gc *GatewayConfig) *discovery {
+	d := &discovery{
+		gatewayId:   byte(gc.gatewayid),
+		interval:    gc.advertiseInterval(),
+		searchDelay: gc.searchgwdelay,
+		ifname:      gc.multicastinterface,
+		loopback:    gc.multicastloopback,
+		intervals:   make(chan time.Duration),
+	}
+	if gc.gatewayid == 0 {
+		d.gatewayId = 1
+	}
+	if gc.multicastgroup != "" {
+		// checked when the configuration was parsed
+		d.group, _ = net.ResolveUDPAddr("udp", gc.multicastgroup)
+	}
+	return d
+}
+
+func (d *discovery) gwinfo() Message {
+	gi := NewMessage(GWINFO).(*GwInfoMessage)
+	gi.GatewayId = d.gatewayId
+	return gi
+}
+
+// Join the multicast group, if there is one, and start
+// advertising the gateway to it
+func (d *discovery) start() error {
+	if d.group == nil {
+		return nil
+	}
+	var ifi *net.Interface
+	if d.ifname != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(d.ifname); err != nil {
+			return fmt.Errorf("cannot use multicast interface %s: %v", d.ifname, err)
+		}
+	}
+	nw := "udp4"
+	if d.group.IP.To4() == nil {
+		nw = "udp6"
+	}
+	// the socket does not see its own packets unless loopback
+	// is set, for clients on the gateway's host
+	conn, err := net.ListenMulticastUDP(nw, ifi, d.group)
+	if err == nil && d.loopback {
+		if nw == "udp4" {
+			err = ipv4.NewPacketConn(conn).SetMulticastLoopback(true)
+		} else {
+			err = ipv6.NewPacketConn(conn).SetMulticastLoopback(true)
+		}
+		if err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot join multicast group %s: %v", d.group, err)
+	}
+	INFO.Printf("joined multicast group %s\n", d.group)
+	d.conn = conn
+	d.done = make(chan struct{})
+	d.wg.Add(2)
+	go d.serve()
+	go d.advertise()
+	return nil
+}
+
+// Answer each SEARCHGW on the group with a GWINFO to the group,
+// so that every client searching hears it. Held back, the answer
+// is given up on hearing another gateway's GWINFO, and covers
+// the SEARCHGWs heard meanwhile.
+func (d *discovery) serve() {
+	defer d.wg.Done()
+	conn := d.conn
+	var answer *time.Timer
+	var due time.Time
+	defer func() {
+		if answer != nil {
+			answer.Stop()
+		}
+	}()
+	for {
+		buffer := make([]byte, 1024)
+		n, remote, err := d.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-d.done:
+				return
+			default:
+				ERROR.Println(err)
+				continue
+			}
+		}
+		m, err := ReadPacket(bytes.NewBuffer(buffer[:n]))
+		if err != nil {
+			continue
+		}
+		switch m.MessageType() {
+		case GWINFO:
+			if answer != nil && answer.Stop() {
+				DEBUG.Printf("multicast GWINFO from %v, not answering\n", remote)
+				due = time.Time{}
+			}
+			continue
+		case SEARCHGW:
+		default:
+			continue
+		}
+		DEBUG.Printf("multicast SEARCHGW from %v\n", remote)
+		if d.searchDelay <= 0 {
+			d.answer(conn)
+		} else if now := time.Now(); !now.Before(due) {
+			delay := time.Duration(rand.Int63n(int64(d.searchDelay)))
+			due = now.Add(delay)
+			answer = time.AfterFunc(delay, func() { d.answer(conn) })
+		}
+	}
+}
+
+// Send a GWINFO to the group on conn, unless no longer listening
+// to it
+func (d *discovery) answer(conn *net.UDPConn) {
+	select {
+	case <-d.done:
+		return
+	default:
+	}
+	if err := (uConn{conn, 0, nil}).WriteTo(d.gwinfo(), uAddr{d.group}); err != nil {
+		ERROR.Println(err)
+	}
+}
+
+func (d *discovery) advertise() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	adv := d.advertisement(d.interval)
+	for {
+		if err := (uConn{d.conn, 0, nil}).WriteTo(adv, uAddr{d.group}); err != nil {
+			ERROR.Println(err)
+		}
+		select {
+		case <-ticker.C:
+		case interval := <-d.intervals:
+			ticker.Reset(interval)
+			adv = d.advertisement(interval)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// An ADVERTISE of the next one being sent in interval
+func (d *discovery) advertisement(interval time.Duration) *AdvertiseMessage {
+	adv := NewMessage(ADVERTISE).(*AdvertiseMessage)
+	adv.GatewayId = d.gatewayId
+	adv.Duration = maxAdvertiseDuration
+	if interval < maxAdvertiseDuration*time.Second {
+		adv.Duration = uint16(interval / time.Second)
+	}
+	return adv
+}
+
+// Advertise every interval from now on, at once if advertising
+func (d *discovery) setInterval(interval time.Duration) {
+	if d.conn == nil {
+		d.interval = interval
+		return
+	}
+	select {
+	case d.intervals <- interval:
+	case <-d.done:
+	}
+}
+
+// Leave the multicast group
+func (d *discovery) stop() {
+	if d.conn == nil {
+		return
+	}
+	close(d.done)
+	d.conn.Close()
+	d.wg.Wait()
+	d.conn = nil
+}
@@ -0,0 +1,436 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	dtlsprotocol "github.com/pion/dtls/v2/pkg/protocol"
+	"github.com/pion/dtls/v2/pkg/protocol/recordlayer"
+	"github.com/pion/transport/v2/udp"
+)
+
+// How long a client has to complete its DTLS handshake
+const dtlsHandshakeTimeout = 10 * time.Second
+
+// The largest datagram pion reads, so no record decrypts to
+// more and a buffer of it always holds a whole packet
+const dtlsReadBufferSize = 8192
+
+// Failed handshakes logged at once, and a second afterwards
+const (
+	dtlsFailureBurst = 5
+	dtlsFailureRate  = 1
+)
+
+var (
+	pskCipherSuites = []dtls.CipherSuiteID{
+		dtls.TLS_PSK_WITH_AES_128_CCM_8,
+		dtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+	}
+	certCipherSuites = []dtls.CipherSuiteID{
+		dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		dtls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		dtls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		dtls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	}
+)
+
+// A DTLS session with a client, which replies to it are
+// written to rather than to the gateway's UDP socket, and the
+// certificate the client presented, if any
+type dtlsSession struct {
+	net.Conn
+	peer *x509.Certificate
+}
+
+func (s dtlsSession) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return s.Write(b)
+}
+
+// The names the certificate is for: the subject's common name,
+// then its subject alternative names
+func certificateNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// What DTLS clients are authenticated with: pre-shared keys, a
+// certificate, or both. Client certificates are verified
+// against the CA bundle in clientCA, and must be presented if
+// clientCertRequired is set.
+type dtlsFiles struct {
+	psk                string
+	cert               string
+	key                string
+	clientCA           string
+	clientCertRequired bool
+}
+
+// The files with those of own given instead
+func (f dtlsFiles) with(own dtlsFiles) dtlsFiles {
+	if own.psk != "" {
+		f.psk = own.psk
+	}
+	if own.cert != "" {
+		f.cert, f.key = own.cert, own.key
+	}
+	if own.clientCA != "" {
+		f.clientCA = own.clientCA
+	}
+	f.clientCertRequired = f.clientCertRequired || own.clientCertRequired
+	return f
+}
+
+// Read the files and make the configuration for the DTLS
+// sessions they allow
+func (f dtlsFiles) config() (*dtls.Config, error) {
+	config := &dtls.Config{
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		ConnectContextMaker: func() (context.Context, func()) {
+			return context.WithTimeout(context.Background(), dtlsHandshakeTimeout)
+		},
+	}
+	if f.psk == "" && f.cert == "" {
+		return nil, ErrNoDTLSCredentials
+	}
+	if f.psk != "" {
+		keys, err := loadPSKs(f.psk)
+		if err != nil {
+			return nil, err
+		}
+		config.PSK = func(identity []byte) ([]byte, error) {
+			if key, ok := keys[string(identity)]; ok {
+				return key, nil
+			}
+			return nil, ErrUnknownPSKIdentity
+		}
+		config.PSKIdentityHint = []byte("gnatt")
+		config.CipherSuites = append(config.CipherSuites, pskCipherSuites...)
+	}
+	if f.cert != "" {
+		cert, err := tls.LoadX509KeyPair(f.cert, f.key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+		config.CipherSuites = append(config.CipherSuites, certCipherSuites...)
+	}
+	if f.clientCA != "" {
+		pem, err := ioutil.ReadFile(f.clientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			ERROR.Printf("No certificates in %s\n", f.clientCA)
+			return nil, ErrInvalidClientCA
+		}
+		config.ClientAuth = dtls.VerifyClientCertIfGiven
+		if f.clientCertRequired {
+			config.ClientAuth = dtls.RequireAndVerifyClientCert
+		}
+	} else if f.clientCertRequired {
+		return nil, ErrNoClientCA
+	}
+	return config, nil
+}
+
+// Pre-shared keys for DTLS, read from a file with a line per
+// client identity:
+//
+//	identity hexkey
+//
+// Blank lines and lines starting with # are ignored.
+func loadPSKs(file string) (map[string][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	var lineno int
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		var key []byte
+		if len(fields) == 2 {
+			key, err = hex.DecodeString(fields[1])
+		}
+		if len(fields) != 2 || err != nil || len(key) == 0 {
+			// not the line itself, it holds a key
+			ERROR.Printf("Invalid pre-shared key on line %d of %s\n", lineno, file)
+			return nil, ErrInvalidPSK
+		}
+		keys[fields[0]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Logs failures, dtlsFailureBurst at once and dtlsFailureRate a
+// second afterwards, counting the rest, so that a scan of the
+// DTLS port cannot flood the log
+type failureLog struct {
+	limiter    *rateLimiter
+	suppressed int32
+}
+
+func newFailureLog() *failureLog {
+	return &failureLog{
+		limiter: &rateLimiter{
+			rate:    dtlsFailureRate,
+			burst:   dtlsFailureBurst,
+			buckets: make(map[string]*bucket),
+		},
+	}
+}
+
+// Log the failure unless too many have been, reporting whether
+// it was
+func (f *failureLog) log(now time.Time, format string, v ...interface{}) bool {
+	if !f.limiter.allow("", now) {
+		atomic.AddInt32(&f.suppressed, 1)
+		return false
+	}
+	if n := atomic.SwapInt32(&f.suppressed, 0); n > 0 {
+		ERROR.Printf("%d more failures not logged\n", n)
+	}
+	ERROR.Printf(format, v...)
+	return true
+}
+
+// A DTLS socket feeding packets to a Gateway, each client
+// having a session of its own
+type dtlsListener struct {
+	sync.RWMutex
+	ln       net.Listener
+	files    dtlsFiles
+	config   *dtls.Config
+	failures *failureLog
+	size     int
+	buffers  *bufferPool
+	counters *listenerCounters
+	idle     time.Duration
+	sessions *connTable
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Listen for DTLS clients on addr, who authenticate with what
+// files gives, for packets of up to size bytes, ending their
+// sessions if nothing is heard in them for idle. Sessions are
+// kept in sessions, and refused when it is full.
+func listenDTLS(addr string, files dtlsFiles, idle time.Duration, sessions *connTable, size int, g Gateway) (*dtlsListener, error) {
+	config, err := files.config()
+	if err != nil {
+		return nil, err
+	}
+	nw := network(addr)
+	address, err := net.ResolveUDPAddr(nw, addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DTLS listen address %s: %v", addr, err)
+	}
+	lc := udp.ListenConfig{
+		// only a handshake starts a session
+		AcceptFilter: func(packet []byte) bool {
+			pkts, err := recordlayer.UnpackDatagram(packet)
+			if err != nil || len(pkts) < 1 {
+				return false
+			}
+			h := &recordlayer.Header{}
+			if err := h.Unmarshal(pkts[0]); err != nil {
+				return false
+			}
+			return h.ContentType == dtlsprotocol.ContentTypeHandshake
+		},
+	}
+	ln, err := lc.Listen(nw, address)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %s: %v", addr, err)
+	}
+	INFO.Printf("listening for DTLS on %s\n", ln.Addr())
+	l := &dtlsListener{
+		ln:       ln,
+		files:    files,
+		config:   config,
+		failures: newFailureLog(),
+		size:     size,
+		buffers:  newBufferPool(dtlsReadBufferSize),
+		counters: newListenerCounters("dtls", ln.Addr()),
+		idle:     idle,
+		sessions: sessions,
+		done:     make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go l.serve(g)
+	return l, nil
+}
+
+// Read the keys and certificates again, returning what has the
+// sessions to come use them; the sessions there are keep going.
+// If they cannot be read those already loaded are kept.
+func (l *dtlsListener) read() (func(), error) {
+	config, err := l.files.config()
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		l.Lock()
+		l.config = config
+		l.Unlock()
+		INFO.Println("DTLS keys and certificates reloaded")
+	}, nil
+}
+
+func (l *dtlsListener) stats() *listenerCounters {
+	return l.counters
+}
+
+func (l *dtlsListener) addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *dtlsListener) currentConfig() *dtls.Config {
+	defer l.RUnlock()
+	l.RLock()
+	return l.config
+}
+
+func (l *dtlsListener) serve(g Gateway) {
+	defer l.wg.Done()
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+				ERROR.Println(err)
+				continue
+			}
+		}
+		if !l.sessions.add(conn, l.counters) {
+			l.failures.log(time.Now(), "refusing DTLS session with %v, too many open\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		l.wg.Add(1)
+		go l.session(conn, g)
+	}
+}
+
+// Handshake with the client, then feed its packets to g until
+// the session ends or goes idle, which ends the client's
+// MQTT-SN session too unless the gateway is stopping and ends
+// it itself
+func (l *dtlsListener) session(conn net.Conn, g Gateway) {
+	defer l.wg.Done()
+	defer l.sessions.remove(conn)
+	defer conn.Close()
+	addr := uAddr{conn.RemoteAddr().(*net.UDPAddr)}
+	dconn, err := dtls.Server(conn, l.currentConfig())
+	if err != nil {
+		l.failures.log(time.Now(), "DTLS handshake with %v failed: %v\n", addr, err)
+		return
+	}
+	defer dconn.Close()
+	session := dtlsSession{dconn, nil}
+	if certs := dconn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		if session.peer, err = x509.ParseCertificate(certs[0]); err != nil {
+			ERROR.Printf("certificate from %v: %v\n", addr, err)
+			return
+		}
+		INFO.Printf("DTLS session with %v, certificate for %v\n", addr, certificateNames(session.peer))
+	} else {
+		INFO.Printf("DTLS session with %v\n", addr)
+	}
+
+	var wg sync.WaitGroup
+	for {
+		buffer := l.buffers.get()
+		dconn.SetReadDeadline(time.Now().Add(l.idle))
+		n, err := dconn.Read(*buffer)
+		if err == nil {
+			l.counters.received(n)
+		}
+		if err == nil && !g.admit(addr) {
+			l.buffers.put(buffer)
+			continue
+		}
+		if err == nil && n > l.size {
+			g.oversized(addr, l.size)
+			l.buffers.put(buffer)
+			continue
+		}
+		if err != nil {
+			l.buffers.put(buffer)
+			if l.sessions.timedOut(err) {
+				INFO.Printf("DTLS session with %v idle for %v\n", addr, l.idle)
+			}
+			INFO.Printf("DTLS session with %v ended: %v\n", addr, err)
+			wg.Wait()
+			select {
+			case <-l.done:
+			default:
+				g.closed(addr)
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer l.buffers.put(buffer)
+			g.OnPacket(n, (*buffer)[:n], uConn{session, l.size, l.counters}, addr)
+		}()
+	}
+}
+
+// Close the socket and every session, and wait until every
+// packet already read has been handled, or until ctx is done
+func (l *dtlsListener) stop(ctx context.Context) error {
+	close(l.done)
+	l.ln.Close()
+	l.sessions.close(l.counters)
+	finished := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// Every packet received and sent, logged a line each to the
+// DEBUG logger whatever the level logged, of one client if
+// clientId is given and of one address, a host or host:port, if
+// address is. A client is known by its address, those it is
+// seen at kept in addrs for the packets sent to it. Off unless
+// set with log-packets or by the admin API; like the loggers it
+// is the process's.
+type packetDump struct {
+	clientId string
+	address  string
+	sync.Mutex
+	addrs map[string]bool
+}
+
+var packetDumps atomic.Pointer[packetDump]
+
+func newPacketDump(clientId, address string) *packetDump {
+	return &packetDump{clientId: clientId, address: address, addrs: make(map[string]bool)}
+}
+
+// Dump the packets received and sent as d has it, none if d is
+// nil
+func setPacketDump(d *packetDump) {
+	packetDumps.Store(d)
+}
+
+// Whether the packets of id at a are dumped; id is "" if it is
+// not known, a client whose address has been seen being dumped
+func (d *packetDump) matches(id string, a uAddr) bool {
+	if d.address != "" && d.address != a.String() && d.address != a.host() {
+		return false
+	}
+	if d.clientId == "" {
+		return true
+	}
+	defer d.Unlock()
+	d.Lock()
+	if id == d.clientId {
+		d.addrs[a.String()] = true
+		return true
+	}
+	return id == "" && d.addrs[a.String()]
+}
+
+// Log a packet of msgType, b, received from or sent to a
+func (d *packetDump) log(direction string, id string, a uAddr, msgType string, b []byte) {
+	if !d.matches(id, a) {
+		return
+	}
+	DEBUG.output(direction, []Field{dumpLog, logRemote(a), {fieldMsgType, msgType}, {"bytes", len(b)}, {"hex", fmt.Sprintf("% x", b)}})
+}
+
+// Log a packet received, m its decoded form, nil if it is
+// malformed
+func (g *core) dumpInbound(d *packetDump, m Message, b []byte, a uAddr) {
+	msgType := "malformed"
+	if m != nil {
+		msgType = MessageNames[m.MessageType()]
+	}
+	var id string
+	if d.clientId != "" {
+		if c, ok := m.(*ConnectMessage); ok {
+			id = string(c.ClientId)
+		} else if sc := g.clients.GetClient(a); sc != nil {
+			id = sc.base().ClientId
+		}
+	}
+	d.log("in", id, a, msgType, b)
+}
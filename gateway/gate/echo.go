@@ -0,0 +1,129 @@
+package gateway
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What an aggregating gateway does with the messages the broker
+// sends back to it that it published itself, for a client
+// subscribed to a filter matching their topic
+const (
+	echoDeliver = "deliver" // deliver them as any other message
+	echoOthers  = "others"  // deliver them to all but the publisher
+	echoDrop    = "drop"    // deliver them to no one
+)
+
+// How long after a message is published to the broker it is
+// looked for among those the broker sends
+var echoWindow = 5 * time.Second
+
+// The messages published to the broker lately, for those it
+// sends back to be known as echoes: a message with the topic and
+// payload of one published within echoWindow is taken as its
+// echo, once. Another client publishing the same on the topic
+// meanwhile is taken for an echo too.
+type echoes struct {
+	sync.Mutex
+	policy     string
+	sent       map[echoKey][]echoSent
+	swept      time.Time
+	suppressed uint64
+}
+
+type echoKey struct {
+	topic string
+	hash  uint64
+}
+
+// A message published for client at a time
+type echoSent struct {
+	client *Client
+	at     time.Time
+}
+
+// Nil if echoes are delivered as any other message
+func newEchoes(policy string) *echoes {
+	if policy == echoDeliver {
+		return nil
+	}
+	return &echoes{policy: policy, sent: make(map[echoKey][]echoSent)}
+}
+
+func newEchoKey(topic string, payload []byte) echoKey {
+	h := fnv.New64a()
+	h.Write(payload)
+	return echoKey{topic, h.Sum64()}
+}
+
+// Note that client published payload to the broker on topic
+func (e *echoes) published(client *Client, topic string, payload []byte) {
+	if e == nil {
+		return
+	}
+	now := time.Now()
+	k := newEchoKey(topic, payload)
+	defer e.Unlock()
+	e.Lock()
+	if now.Sub(e.swept) > echoWindow {
+		e.sweep(now)
+	}
+	e.sent[k] = append(e.sent[k], echoSent{client, now})
+}
+
+// Forget what was published too long ago
+func (e *echoes) sweep(now time.Time) {
+	for k, sent := range e.sent {
+		if sent = expired(sent, now); len(sent) == 0 {
+			delete(e.sent, k)
+		} else {
+			e.sent[k] = sent
+		}
+	}
+	e.swept = now
+}
+
+// sent without those published too long ago, oldest first
+func expired(sent []echoSent, now time.Time) []echoSent {
+	i := 0
+	for i < len(sent) && now.Sub(sent[i].at) > echoWindow {
+		i++
+	}
+	return sent[i:]
+}
+
+// Whether a message from the broker is an echo, and if so the
+// client it was published for
+func (e *echoes) echo(topic string, payload []byte) (*Client, bool) {
+	if e == nil || strings.HasPrefix(topic, "$") {
+		return nil, false
+	}
+	k := newEchoKey(topic, payload)
+	defer e.Unlock()
+	e.Lock()
+	sent := expired(e.sent[k], time.Now())
+	if len(sent) == 0 {
+		delete(e.sent, k)
+		return nil, false
+	}
+	if len(sent) == 1 {
+		delete(e.sent, k)
+	} else {
+		e.sent[k] = sent[1:]
+	}
+	atomic.AddUint64(&e.suppressed, 1)
+	return sent[0].client, true
+}
+
+// The number of messages from the broker taken as echoes of the
+// gateway's own, and not delivered to their publisher or, with
+// upstream-echoes drop, to anyone
+func (g *core) EchoesSuppressed() uint64 {
+	if g.echoes == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&g.echoes.suppressed)
+}
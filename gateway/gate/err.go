@@ -9,13 +9,97 @@ var (
 	ErrMissingValueForConfigOption  = errors.New("Missing value for config option")
 	ErrTooManyValuesForConfigOption = errors.New("Too many values for config option")
 	ErrUnknownConfigOption          = errors.New("Unknown config option")
+	ErrInvalidConfigFile            = errors.New("Invalid configuration file")
+	ErrInvalidConfigValue           = errors.New("Invalid value for config option")
+	ErrInvalidConfigFormat          = errors.New("Invalid configuration format")
+	ErrMultipleDocuments            = errors.New("More than one document in YAML configuration")
+	ErrIncludeCycle                 = errors.New("Configuration files include each other")
+	ErrNoConfiguration              = errors.New("No configuration file, nor a broker and port")
+	ErrOutOfRange                   = errors.New("Out of range")
+	ErrNegative                     = errors.New("Negative")
+	ErrInvalidDuration              = errors.New("Invalid duration")
+	ErrInvalidBrokerURL             = errors.New("Invalid broker URL")
+	ErrInvalidBindAddress           = errors.New("Invalid bind address")
 	ErrNoTransportSpecified         = errors.New("Missing transport")
 	ErrInvalidModeSpecified         = errors.New("Invalid mode")
 	ErrNotANumber                   = errors.New("Not a number")
+	ErrNotABool                     = errors.New("Not true or false")
+	ErrInvalidClientIdOverflow      = errors.New("Invalid client id overflow strategy")
+	ErrInvalidCredentials           = errors.New("Invalid credentials file")
+	ErrNoCredentials                = errors.New("No broker credentials for client")
+	ErrInvalidPSK                   = errors.New("Invalid pre-shared keys file")
+	ErrNoDTLSCredentials            = errors.New("Missing dtls-psk-file or dtls-cert-file for dtls-port")
+	ErrInvalidClientCA              = errors.New("Invalid DTLS client CA file")
+	ErrInvalidGatewayId             = errors.New("Invalid gateway id")
+	ErrInvalidMulticastGroup        = errors.New("Invalid multicast group")
+	ErrInvalidFileMode              = errors.New("Invalid file mode")
+	ErrInvalidMessageSize           = errors.New("Invalid maximum message size")
+	ErrInvalidNetwork               = errors.New("Invalid address or network")
+	ErrInvalidClientAllow           = errors.New("Invalid client-allow")
+	ErrInvalidPublishLimit          = errors.New("Invalid client-publish-limit")
+	ErrInvalidACL                   = errors.New("Invalid acl-file")
+	ErrInvalidACLDefault            = errors.New("Invalid acl-default")
+	ErrInvalidRegistry              = errors.New("Invalid auth-registry-file")
+	ErrAuthenticator                = errors.New("Authenticator failed")
+	ErrInvalidProbability           = errors.New("Invalid probability")
+	ErrInvalidListener              = errors.New("Invalid listener")
+	ErrDuplicateListener            = errors.New("Listening where another listener does")
+	ErrInvalidOversizePolicy        = errors.New("Invalid oversize policy")
+	ErrNoClientCA                   = errors.New("Missing dtls-client-ca-file for dtls-client-cert-required")
+	ErrInvalidBrokerCA              = errors.New("Invalid mqtt-ca-file")
+	ErrInvalidProtocolVersion       = errors.New("Invalid mqtt-protocol-version")
+	ErrInvalidExpiry                = errors.New("Invalid expiry")
+	ErrWindowFull                   = errors.New("Too many publishes queued for the broker")
+	ErrInvalidQos                   = errors.New("Invalid qos")
+	ErrInvalidTopicAliases          = errors.New("Invalid mqtt-topic-aliases")
+	ErrInvalidBrokerHeader          = errors.New("Invalid mqtt-header")
+	ErrInvalidTopicPrefix           = errors.New("Invalid topic-prefix")
+	ErrInvalidSysPrefix             = errors.New("Invalid sys-prefix")
+	ErrInvalidShareGroup            = errors.New("Invalid upstream-share-group")
+	ErrInvalidEchoPolicy            = errors.New("Invalid upstream-echoes")
+	ErrInvalidOfflineConnect        = errors.New("Invalid broker-offline-connect")
+	ErrInvalidUpstream              = errors.New("Invalid upstream-broker")
+	ErrInvalidRoute                 = errors.New("Invalid upstream-route")
+	ErrInvalidPredefinedTopic       = errors.New("Invalid predefined-topic")
+	ErrInvalidLogLevel              = errors.New("Invalid log-level")
+	ErrInvalidLogFormat             = errors.New("Invalid log-format")
+	ErrInvalidLogSync               = errors.New("Invalid log-sync")
+	ErrInvalidAuditSync             = errors.New("Invalid audit-sync")
+	ErrSyslogFormat                 = errors.New("log-format json or logfmt cannot be sent to syslog")
+	ErrInvalidAdminAddress          = errors.New("Invalid admin-address")
+	ErrNoAdminAddress               = errors.New("Missing admin-address for admin-pprof")
+	ErrNoCaptureFile                = errors.New("Missing capture-file for capture-enabled")
+	ErrPprofNotLoopback             = errors.New("admin-pprof on an admin-address that is not loopback needs admin-pprof-public")
+	ErrInvalidSyslogAddress         = errors.New("Invalid log-syslog-address")
+	ErrNoSyslog                     = errors.New("Syslog is not supported on this platform")
+	ErrIncompleteBrokerCert         = errors.New("mqtt-cert-file and mqtt-key-file must be given together")
+	ErrUnknownPSKIdentity           = errors.New("Unknown pre-shared key identity")
 
 	/* Protocol Errors */
-	ErrZeroLengthClientID = errors.New("Zero-length clientID is invalid")
-	ErrClientIDTooLong    = errors.New("ClientID too long")
+	ErrZeroLengthClientID       = errors.New("Zero-length clientID is invalid")
+	ErrClientIDTooLong          = errors.New("ClientID too long")
+	ErrUnsupportedProtocolId    = errors.New("Unsupported protocol id")
+	ErrTooManyClients           = errors.New("Too many clients")
+	ErrTooManyBrokerConnections = errors.New("Too many broker connections")
+	ErrSubscriptionRefused      = errors.New("Subscription refused by the broker")
+	ErrBrokerTimeout            = errors.New("Timed out connecting to the broker")
+	ErrBrokerUnavailable        = errors.New("Broker unreachable and no more messages can be held")
+	ErrNotASocket               = errors.New("Not a socket")
+	ErrSocketInUse              = errors.New("Socket in use")
+	ErrNoReusePort              = errors.New("SO_REUSEPORT not supported")
+	ErrMessageTooLarge          = errors.New("Message larger than the maximum message size")
+	ErrDraining                 = errors.New("Draining, not accepting new clients")
+	ErrBrokerOffline            = errors.New("Broker unreachable, not accepting new clients")
+	ErrPublishTimeout           = errors.New("Timed out publishing to the broker")
+	ErrInvalidCBOR              = errors.New("Invalid or unsupported CBOR")
+
+	/* Transport Errors */
+	ErrMemAddrInUse       = errors.New("Address in use")
+	ErrTransportClosed    = errors.New("Transport closed")
+	ErrSerialUnavailable  = errors.New("Serial port unavailable")
+	ErrInvalidBaudRate    = errors.New("Unsupported baud rate")
+	ErrNoSerialPorts      = errors.New("Serial ports are only supported on Linux")
+	ErrActivationMismatch = errors.New("Socket does not match the configuration")
 
 	/* Topic Errors */
 	ErrTopicFilterEmptyString     = errors.New("TopicFilter cannot be empty string")
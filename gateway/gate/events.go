@@ -0,0 +1,128 @@
+package gateway
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// The version of the events' payload, raised whenever a field
+// is removed or changes meaning; fields may be added without
+const eventsVersion = 1
+
+// Events published a second at most unless configured
+const defaultEventsRate = 100
+
+// What a client's event is published as, as JSON:
+//
+//	{"version": 1, "client_id": "sensor-1", "event": "disconnected",
+//	 "time": "2026-10-16T09:00:00.123Z", "address": "192.0.2.1:5000",
+//	 "reason": "kicked"}
+//
+// event is connected, disconnected, asleep or lost, and reason,
+// given with disconnected, is the reason OnDisconnect is given:
+// disconnect, gateway stopped, kicked or replaced, the last when
+// the client connects again from the same address. time is in
+// UTC.
+type clientEvent struct {
+	Version  int       `json:"version"`
+	ClientId string    `json:"client_id"`
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Address  string    `json:"address"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// Events a client goes through
+const (
+	eventConnected    = "connected"
+	eventDisconnected = "disconnected"
+	eventAsleep       = "asleep"
+	eventLost         = "lost"
+)
+
+// The aggregating gateway's clients' events, published to topic
+// on the broker as the hooks are called, rate a second at most
+// on average, in bursts as many; those beyond are dropped and
+// counted. Called from the hook queue alone, it needs no lock
+// but for its counts.
+type events struct {
+	topic     string
+	qos       byte
+	rate      float64
+	tokens    float64
+	last      time.Time
+	publish   func(payload []byte)
+	published uint64
+	dropped   uint64
+}
+
+// The events gc configures, nil unless it gives events-topic
+func newEvents(gc *GatewayConfig) *events {
+	if gc.eventstopic == "" {
+		return nil
+	}
+	rate := defaultEventsRate
+	if gc.eventsrate > 0 {
+		rate = gc.eventsrate
+	}
+	return &events{topic: gc.eventstopic, qos: byte(gc.eventsqos), rate: float64(rate), tokens: float64(rate)}
+}
+
+// The hooks publishing the events, none if e is nil
+func (e *events) hooks() Hooks {
+	if e == nil {
+		return Hooks{}
+	}
+	return Hooks{
+		OnConnected: func(client *Client) {
+			e.event(client, eventConnected, "")
+		},
+		OnDisconnect: func(client *Client, reason string) {
+			if reason == DisconnectLost {
+				e.event(client, eventLost, "")
+			} else {
+				e.event(client, eventDisconnected, reason)
+			}
+		},
+		OnSleep: func(client *Client, duration time.Duration) {
+			e.event(client, eventAsleep, "")
+		},
+	}
+}
+
+func (e *events) event(client *Client, event, reason string) {
+	now := time.Now()
+	if !e.allow(now) {
+		atomic.AddUint64(&e.dropped, 1)
+		return
+	}
+	payload, _ := json.Marshal(clientEvent{eventsVersion, client.ClientId, event, now.UTC(), client.Address.String(), reason})
+	e.publish(payload)
+	atomic.AddUint64(&e.published, 1)
+}
+
+// Whether an event may be published at now, counting it against
+// the allowance
+func (e *events) allow(now time.Time) bool {
+	if !e.last.IsZero() {
+		e.tokens += now.Sub(e.last).Seconds() * e.rate
+		if e.tokens > e.rate {
+			e.tokens = e.rate
+		}
+	}
+	e.last = now
+	if e.tokens < 1 {
+		return false
+	}
+	e.tokens--
+	return true
+}
+
+// The events published and those dropped, none if e is nil
+func (e *events) counts() (published, dropped uint64) {
+	if e == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&e.published), atomic.LoadUint64(&e.dropped)
+}
@@ -0,0 +1,184 @@
+package gateway
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// What a FaultyTransport does to the packets through it, in
+// either direction, to test against a bad network
+type Faults struct {
+	Loss      float64       // the probability a packet is dropped
+	Duplicate float64       // the probability it is delivered twice
+	Delay     time.Duration // added to every packet
+	Jitter    time.Duration // up to this much more, at random
+	Reorder   int           // how many later packets may overtake it
+	Seed      int64         // the same seed makes the same choices
+}
+
+// How long a packet held back for reordering waits for later
+// ones to overtake it
+const faultReorderHold = 20 * time.Millisecond
+
+// The largest packet a FaultyTransport reads
+const faultReadSize = 0xffff
+
+type faultyPacket struct {
+	b    []byte
+	from net.Addr
+	err  error
+}
+
+// A Transport that loses, duplicates, delays and reorders the
+// packets read from and written to the one it wraps. Which
+// packets it does what to is chosen from Faults.Seed, so that
+// a test given the same packets in the same order fails the
+// same way.
+type FaultyTransport struct {
+	Transport
+	sync.Mutex
+	faults Faults
+	rng    *rand.Rand
+	held   []func()
+	hold   *time.Timer
+	in     chan faultyPacket
+	done   chan struct{}
+	once   sync.Once
+}
+
+func NewFaultyTransport(t Transport, f Faults) *FaultyTransport {
+	ft := &FaultyTransport{
+		Transport: t,
+		faults:    f,
+		rng:       rand.New(rand.NewSource(f.Seed)),
+		in:        make(chan faultyPacket, memQueueLength),
+		done:      make(chan struct{}),
+	}
+	go ft.read()
+	return ft
+}
+
+func (t *FaultyTransport) read() {
+	buf := make([]byte, faultReadSize)
+	for {
+		n, from, err := t.Transport.ReadFrom(buf)
+		if err != nil {
+			select {
+			case t.in <- faultyPacket{nil, nil, err}:
+				continue
+			case <-t.done:
+				return
+			}
+		}
+		p := faultyPacket{append([]byte(nil), buf[:n]...), from, nil}
+		t.inject(func() {
+			select {
+			case t.in <- p:
+			case <-t.done:
+			}
+		})
+	}
+}
+
+func (t *FaultyTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-t.in:
+		return copy(b, p.b), p.from, p.err
+	case <-t.done:
+		return 0, nil, ErrTransportClosed
+	}
+}
+
+// Write b to addr, or not, or twice, or later. Like UDP, a
+// packet that is lost is not an error.
+func (t *FaultyTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-t.done:
+		return 0, ErrTransportClosed
+	default:
+	}
+	b = append([]byte(nil), b...)
+	t.inject(func() {
+		if _, err := t.Transport.WriteTo(b, addr); err != nil {
+			ERROR.Println(err)
+		}
+	})
+	return len(b), nil
+}
+
+func (t *FaultyTransport) Close() error {
+	var err error
+	t.once.Do(func() {
+		close(t.done)
+		err = t.Transport.Close()
+	})
+	return err
+}
+
+// Deliver a packet as the faults have it, deciding what to do
+// with it before delivering anything, so that the decisions
+// are made in the order the packets came
+func (t *FaultyTransport) inject(deliver func()) {
+	t.Lock()
+	var now []func()
+	if t.rng.Float64() >= t.faults.Loss {
+		copies := 1
+		if t.rng.Float64() < t.faults.Duplicate {
+			copies = 2
+		}
+		for i := 0; i < copies; i++ {
+			now = append(now, t.reorder(t.delay(deliver))...)
+		}
+	}
+	t.Unlock()
+	for _, f := range now {
+		f()
+	}
+}
+
+// Must be called with the lock held.
+func (t *FaultyTransport) delay(deliver func()) func() {
+	d := t.faults.Delay
+	if t.faults.Jitter > 0 {
+		d += time.Duration(t.rng.Int63n(int64(t.faults.Jitter)))
+	}
+	if d <= 0 {
+		return deliver
+	}
+	return func() { time.AfterFunc(d, deliver) }
+}
+
+// Hold deliver back until Reorder more packets have come, then
+// deliver any one of those held, or all of them once none has
+// come for a while. Must be called with the lock held.
+func (t *FaultyTransport) reorder(deliver func()) []func() {
+	if t.faults.Reorder <= 0 {
+		return []func(){deliver}
+	}
+	t.held = append(t.held, deliver)
+	if t.hold == nil {
+		t.hold = time.AfterFunc(faultReorderHold, t.release)
+	}
+	if len(t.held) <= t.faults.Reorder {
+		return nil
+	}
+	i := t.rng.Intn(len(t.held))
+	deliver = t.held[i]
+	t.held = append(t.held[:i], t.held[i+1:]...)
+	return []func(){deliver}
+}
+
+func (t *FaultyTransport) release() {
+	t.Lock()
+	held := make([]func(), len(t.held))
+	for i, j := range t.rng.Perm(len(t.held)) {
+		held[i] = t.held[j]
+	}
+	t.held, t.hold = nil, nil
+	t.Unlock()
+	for _, f := range held {
+		f()
+	}
+}
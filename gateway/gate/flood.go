@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// How long after a DISCONNECT is sent to an address with no
+// session another is not, unless configured
+const defaultUnknownDisconnectInterval = 10 * time.Second
+
+// A budget for the packets from addresses with no session, so
+// that a port scan or a flood of forged packets costs the gateway
+// little and cannot turn it into a reflector: packetRate such
+// packets a second, in bursts of up to as many, and packets from
+// addressRate distinct addresses a second; either 0 for no limit.
+// Any beyond are dropped before they are decoded, without a word.
+// A client with a session is never counted against it. A packet
+// from an address with no session that is not a CONNECT, SEARCHGW
+// or the like is answered with a DISCONNECT no more than once
+// every disconnectInterval, until the address connects.
+type floodGuard struct {
+	sync.Mutex
+	packetRate         float64
+	addressRate        int
+	disconnectInterval time.Duration
+	tokens             float64
+	last               time.Time
+	second             time.Time // when the addresses were last forgotten
+	addresses          map[string]struct{}
+	disconnected       map[string]time.Time
+	swept              time.Time
+	counts             FloodStats
+}
+
+// The packets from addresses with no session, those the budget
+// has dropped, and the DISCONNECTs sent to them or held back
+type FloodStats struct {
+	Packets              uint64 `json:"packets"`
+	OverPacketRate       uint64 `json:"over_packet_rate"`
+	OverAddressRate      uint64 `json:"over_address_rate"`
+	Disconnects          uint64 `json:"disconnects"`
+	SuppressedDisconnect uint64 `json:"suppressed_disconnects"`
+}
+
+// The budget gc configures
+func newFloodGuard(gc *GatewayConfig) *floodGuard {
+	return &floodGuard{
+		packetRate:         float64(gc.unconnectedrate),
+		addressRate:        gc.unconnectedaddrs,
+		disconnectInterval: gc.unknownDisconnectInterval(),
+		addresses:          make(map[string]struct{}),
+		disconnected:       make(map[string]time.Time),
+	}
+}
+
+// Whether a packet from a, an address with no session, may be
+// handled at now, counting it against the budget
+func (f *floodGuard) allow(a uAddr, now time.Time) bool {
+	if f == nil {
+		return true
+	}
+	atomic.AddUint64(&f.counts.Packets, 1)
+	if f.packetRate == 0 && f.addressRate == 0 {
+		return true
+	}
+	defer f.Unlock()
+	f.Lock()
+	if f.addressRate > 0 {
+		if now.Sub(f.second) >= time.Second {
+			f.addresses = make(map[string]struct{})
+			f.second = now
+		}
+		key := a.String()
+		if _, ok := f.addresses[key]; !ok {
+			if len(f.addresses) >= f.addressRate {
+				atomic.AddUint64(&f.counts.OverAddressRate, 1)
+				return false
+			}
+			f.addresses[key] = struct{}{}
+		}
+	}
+	if f.packetRate > 0 {
+		if f.last.IsZero() {
+			f.tokens = f.packetRate
+		} else {
+			f.tokens += now.Sub(f.last).Seconds() * f.packetRate
+		}
+		if f.tokens > f.packetRate {
+			f.tokens = f.packetRate
+		}
+		f.last = now
+		if f.tokens < 1 {
+			atomic.AddUint64(&f.counts.OverPacketRate, 1)
+			return false
+		}
+		f.tokens--
+	}
+	return true
+}
+
+// Whether a DISCONNECT may be sent to a, an address with no
+// session, at now: not if one was less than disconnectInterval
+// ago
+func (f *floodGuard) disconnect(a uAddr, now time.Time) bool {
+	if f == nil {
+		return true
+	}
+	if f.disconnectInterval <= 0 {
+		atomic.AddUint64(&f.counts.Disconnects, 1)
+		return true
+	}
+	defer f.Unlock()
+	f.Lock()
+	if now.Sub(f.swept) > f.disconnectInterval {
+		for key, sent := range f.disconnected {
+			if now.Sub(sent) >= f.disconnectInterval {
+				delete(f.disconnected, key)
+			}
+		}
+		f.swept = now
+	}
+	key := a.String()
+	if sent, ok := f.disconnected[key]; ok && now.Sub(sent) < f.disconnectInterval {
+		atomic.AddUint64(&f.counts.SuppressedDisconnect, 1)
+		return false
+	}
+	f.disconnected[key] = now
+	atomic.AddUint64(&f.counts.Disconnects, 1)
+	return true
+}
+
+// Forget the DISCONNECT sent to a, which is connecting, so that
+// it is told again should it lose its session
+func (f *floodGuard) forget(a uAddr) {
+	if f == nil || f.disconnectInterval <= 0 {
+		return
+	}
+	defer f.Unlock()
+	f.Lock()
+	delete(f.disconnected, a.String())
+}
+
+func (f *floodGuard) snapshot() FloodStats {
+	if f == nil {
+		return FloodStats{}
+	}
+	return FloodStats{
+		atomic.LoadUint64(&f.counts.Packets),
+		atomic.LoadUint64(&f.counts.OverPacketRate),
+		atomic.LoadUint64(&f.counts.OverAddressRate),
+		atomic.LoadUint64(&f.counts.Disconnects),
+		atomic.LoadUint64(&f.counts.SuppressedDisconnect),
+	}
+}
+
+// The type of the packet in b, 0 if b is too short to have one
+func packetType(b []byte) byte {
+	switch {
+	case len(b) > 3 && b[0] == 0x01:
+		return b[3]
+	case len(b) > 1 && b[0] != 0x01:
+		return b[1]
+	}
+	return 0
+}
+
+// Whether a packet from addr may be handled: always if addr has
+// a session, otherwise if the budget for those that do not
+// allows it. An encapsulated packet is let through to be
+// decoded, the node it is from being known only then.
+func (g *core) admitUnconnected(b []byte, addr uAddr, now time.Time) bool {
+	if packetType(b) == ENCMSG || g.clients.GetClient(addr) != nil {
+		return true
+	}
+	return g.flood.Load().allow(addr, now)
+}
+
+// What the budget for packets from addresses with no session has
+// dropped, and the DISCONNECTs sent to them or held back
+func (g *core) Flood() FloodStats {
+	return g.flood.Load().snapshot()
+}
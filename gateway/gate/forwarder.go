@@ -0,0 +1,41 @@
+package gateway
+
+import (
+	"encoding/hex"
+	"net"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// The address of a wireless node behind a forwarder: packets
+// from the node arrive encapsulated from the forwarder's
+// address, so the node is known by both. Packets to it are
+// encapsulated and sent to the forwarder.
+type nodeAddr struct {
+	forwarder net.Addr
+	nodeId    string
+	radius    byte
+}
+
+func (a nodeAddr) Network() string {
+	return "node"
+}
+
+func (a nodeAddr) String() string {
+	return uAddr{a.forwarder}.String() + "/" + hex.EncodeToString([]byte(a.nodeId))
+}
+
+// The message encapsulated in e, and the address of the node it
+// is from
+func decapsulate(e *EncapsulatedMessage, from uAddr) (Message, uAddr) {
+	return e.Message, uAddr{nodeAddr{from.r, string(e.WirelessNodeId), e.Radius}}
+}
+
+// m encapsulated for the node at a, and the address of its
+// forwarder, or m and a themselves for any other client
+func encapsulate(m Message, a uAddr) (Message, uAddr) {
+	if node, ok := a.r.(nodeAddr); ok {
+		return NewEncapsulatedMessage([]byte(node.nodeId), node.radius, m), uAddr{node.forwarder}
+	}
+	return m, a
+}
@@ -1,11 +1,43 @@
 package gateway
 
 import (
+	"context"
 	"net"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
 type Gateway interface {
-	Start()
+	Start() error
+	Stop(context.Context) error
 	Port() int
-	OnPacket(int, []byte, *net.UDPConn, *net.UDPAddr)
+	Addr() string
+	Addrs() []net.Addr
+	Serve(Transport)
+	OnPacket(int, []byte, uConn, uAddr)
+	closed(uAddr)
+	oversized(uAddr, int)
+	admit(uAddr) bool
+}
+
+// The parts of the MQTT client used by the gateways, so
+// that tests can stand in for a broker
+type mqttClient interface {
+	Connect() MQTT.Token
+	Disconnect(quiesce uint)
+	Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token
+	Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token
+	Unsubscribe(topics ...string) MQTT.Token
+	IsConnected() bool
+}
+
+// Give up waiting for c to connect with token. The client keeps
+// trying, so is disconnected should it connect after all.
+func abandonConnect(c mqttClient, token MQTT.Token) {
+	go func() {
+		token.Wait()
+		if token.Error() == nil {
+			c.Disconnect(0)
+		}
+	}()
 }
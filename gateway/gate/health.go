@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// Where a gateway is in its life, for its health checks
+const (
+	lifeStopped  int32 = iota // not started, or stopped
+	lifeServing               // its listeners bound
+	lifeDraining              // refusing new clients
+	lifeStopping
+)
+
+var lifeReasons = [...]string{"not started", "", "draining", "stopping"}
+
+// The paths of the health checks, which need no admin-token
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// What a health check answers: ok, or unavailable and why
+type healthInfo struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (g *core) setLife(life int32) {
+	atomic.StoreInt32(&g.life, life)
+}
+
+// Why the gateway is not alive, "" if it is serving
+func (g *core) notAlive() string {
+	return lifeReasons[atomic.LoadInt32(&g.life)]
+}
+
+// Serve the health checks: /healthz, whether the gateway is
+// serving its listeners, and /readyz, whether it can also take
+// clients, notReady giving why not if it cannot for all it is
+// serving. Each answers 200, or 503 with the reason, from what
+// the gateway already knows, without asking the broker.
+func (a *admin) serveHealth(g *core, notReady func() string) {
+	a.mux.HandleFunc(healthzPath, get(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, g.notAlive())
+	}))
+	a.mux.HandleFunc(readyzPath, get(func(w http.ResponseWriter, r *http.Request) {
+		reason := g.notAlive()
+		if reason == "" {
+			reason = notReady()
+		}
+		writeHealth(w, reason)
+	}))
+}
+
+func writeHealth(w http.ResponseWriter, reason string) {
+	h, status := healthInfo{Status: "ok"}, http.StatusOK
+	if reason != "" {
+		h, status = healthInfo{"unavailable", reason}, http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(h)
+}
+
+// Why the aggregating gateway cannot take clients though it is
+// serving: a broker it publishes to is not connected, unless
+// admin-ready-broker is false
+func (ag *AGateway) notReady() string {
+	if !ag.config.Load().readyBroker() {
+		return ""
+	}
+	for _, u := range ag.upstreams() {
+		if s := u.brokerState(); s.State != BrokerConnected {
+			return u.String() + " is " + s.State
+		}
+	}
+	return ""
+}
+
+// The transparent gateway connects each client to the broker on
+// its own, so has no connection of its own to be ready with
+func (t *TGateway) notReady() string {
+	return ""
+}
@@ -0,0 +1,158 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+)
+
+// Callbacks for programs embedding the gateway, all optional.
+// OnConnect is called on the packet path once a client has
+// completed its CONNECT, and returning an error refuses the
+// client, so it must return quickly; it is where a client id
+// can be bound to the client's certificate (see PeerNames).
+// The others are queued and called one at a time on a
+// goroutine of their own, so a slow hook cannot hold up the
+// gateway; if hookQueueSize events are waiting, further events
+// are dropped.
+type Hooks struct {
+	OnConnect func(client *Client) error
+	// The client has been accepted, its CONNACK sent
+	OnConnected  func(client *Client)
+	OnDisconnect func(client *Client, reason string)
+	// The client has gone to sleep for duration
+	OnSleep           func(client *Client, duration time.Duration)
+	OnSubscribe       func(client *Client, filter string, qos byte)
+	OnPublishUpstream func(topic string, payload []byte)
+	OnDeliver         func(client *Client, topic string)
+	// The aggregating gateway's broker connection has been lost,
+	// or made again once its subscriptions have been renewed
+	OnBrokerConnection func(connected bool)
+	// The aggregating gateway's broker connection has changed
+	// state
+	OnBrokerState func(state BrokerState)
+}
+
+// Reasons given to OnDisconnect
+const (
+	DisconnectRequested = "disconnect"
+	DisconnectStopped   = "gateway stopped"
+	DisconnectLost      = "lost"
+	DisconnectKicked    = "kicked"
+	DisconnectReplaced  = "replaced"
+)
+
+const hookQueueSize = 256
+
+// The hooks of both h and o, each event given to h's then to
+// o's; a client refused by h's OnConnect is not given to o's
+func (h Hooks) and(o Hooks) Hooks {
+	b := Hooks{
+		OnConnect:          h.OnConnect,
+		OnConnected:        both1(h.OnConnected, o.OnConnected),
+		OnDisconnect:       both2(h.OnDisconnect, o.OnDisconnect),
+		OnSleep:            both2(h.OnSleep, o.OnSleep),
+		OnSubscribe:        h.OnSubscribe,
+		OnPublishUpstream:  both2(h.OnPublishUpstream, o.OnPublishUpstream),
+		OnDeliver:          both2(h.OnDeliver, o.OnDeliver),
+		OnBrokerConnection: both1(h.OnBrokerConnection, o.OnBrokerConnection),
+		OnBrokerState:      both1(h.OnBrokerState, o.OnBrokerState),
+	}
+	if h.OnConnect == nil {
+		b.OnConnect = o.OnConnect
+	} else if o.OnConnect != nil {
+		b.OnConnect = func(client *Client) error {
+			if err := h.OnConnect(client); err != nil {
+				return err
+			}
+			return o.OnConnect(client)
+		}
+	}
+	if h.OnSubscribe == nil {
+		b.OnSubscribe = o.OnSubscribe
+	} else if o.OnSubscribe != nil {
+		b.OnSubscribe = func(client *Client, filter string, qos byte) {
+			h.OnSubscribe(client, filter, qos)
+			o.OnSubscribe(client, filter, qos)
+		}
+	}
+	return b
+}
+
+// f then g, either of which may be nil, nil if both are
+func both1[A any](f, g func(A)) func(A) {
+	if f == nil || g == nil {
+		if f == nil {
+			return g
+		}
+		return f
+	}
+	return func(a A) {
+		f(a)
+		g(a)
+	}
+}
+
+func both2[A, B any](f, g func(A, B)) func(A, B) {
+	if f == nil || g == nil {
+		if f == nil {
+			return g
+		}
+		return f
+	}
+	return func(a A, b B) {
+		f(a, b)
+		g(a, b)
+	}
+}
+
+type hookQueue struct {
+	queue chan func()
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newHookQueue() *hookQueue {
+	return &hookQueue{queue: make(chan func(), hookQueueSize)}
+}
+
+func (q *hookQueue) start() {
+	q.done = make(chan struct{})
+	q.wg.Add(1)
+	go q.run(q.done)
+}
+
+func (q *hookQueue) run(done chan struct{}) {
+	defer q.wg.Done()
+	for {
+		select {
+		case f := <-q.queue:
+			f()
+		case <-done:
+			// call whatever was queued before stopping
+			for {
+				select {
+				case f := <-q.queue:
+					f()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *hookQueue) stop() {
+	if q.done != nil {
+		close(q.done)
+		q.wg.Wait()
+		q.done = nil
+	}
+}
+
+func (q *hookQueue) push(f func()) {
+	select {
+	case q.queue <- f:
+	default:
+		ERROR.Println("hook queue is full, dropping event")
+	}
+}
@@ -0,0 +1,128 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// A configuration may be read from several files, those given
+// to LoadConfig and those they include, each read in turn into
+// the same GatewayConfig. Each file's options override those of
+// the files read before it, as an option given again later in
+// one file does: an option taking one value has the last given,
+// and those given more than once are merged. An upstream-broker,
+// upstream-route, predefined-topic, mqtt-header or
+// mqtt-message-expiry replaces the one an earlier file gave for
+// the same name, prefix, id, header or filter, the others being
+// kept; the values of any other option given more than once,
+// such as listener or source-rate-exempt, are appended. An
+// include is read where it is given, the options following it
+// overriding those of the file it includes.
+
+// The files being read, each included by the one before it, and
+// how many of the named entries of the configuration were given
+// by the files read before the one being read
+type configLayers struct {
+	files      []string
+	upstreams  int
+	routes     int
+	predefined int
+	expiry     int
+	headers    map[string]bool
+}
+
+// An error reading a configuration file, in Files, the last of
+// them included by the one before it
+type IncludeError struct {
+	Files []string
+	Err   error
+}
+
+func (e *IncludeError) Error() string {
+	return fmt.Sprintf("in %s: %v", strings.Join(e.Files, " -> "), e.Err)
+}
+
+func (e *IncludeError) Unwrap() error {
+	return e.Err
+}
+
+// Set the options of file, in format, over those already set
+func (gc *GatewayConfig) parseLayer(file, format string) error {
+	gc.layers.files = append(gc.layers.files, file)
+	defer func() {
+		gc.layers.files = gc.layers.files[:len(gc.layers.files)-1]
+	}()
+	gc.beginLayer()
+	return gc.parseFile(file, format)
+}
+
+// The options set from here on override the named entries of
+// those already set
+func (gc *GatewayConfig) beginLayer() {
+	gc.layers.upstreams = len(gc.upstreams)
+	gc.layers.routes = len(gc.routes)
+	gc.layers.predefined = len(gc.predefined)
+	gc.layers.expiry = len(gc.messageexpiry)
+	gc.layers.headers = make(map[string]bool)
+	for name := range gc.mqttheaders {
+		gc.layers.headers[name] = true
+	}
+}
+
+// Set the options of file, found beside the file including it
+// unless it is absolute, which must not be one of those
+// including it
+func (gc *GatewayConfig) include(file string) error {
+	including := gc.layers.files
+	if len(including) > 0 && !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(including[len(including)-1]), file)
+	}
+	chain := append(including[:len(including):len(including)], file)
+	for _, f := range including {
+		if filepath.Clean(f) == filepath.Clean(file) {
+			ERROR.Printf("Configuration files include each other: %s", strings.Join(chain, " -> "))
+			return &IncludeError{chain, ErrIncludeCycle}
+		}
+	}
+	if err := gc.parseLayer(file, ""); err != nil {
+		var ie *IncludeError
+		if !errors.As(err, &ie) {
+			ERROR.Printf("Error in configuration included as %s", strings.Join(chain, " -> "))
+			err = &IncludeError{chain, err}
+		}
+		return err
+	}
+	// what follows the include overrides it
+	gc.beginLayer()
+	return nil
+}
+
+// list without the first of its first *inherited entries, those
+// given by earlier files, that is the same as the one replacing
+// it
+func replaceInherited[T any](list []T, inherited *int, same func(T) bool) []T {
+	for i := 0; i < *inherited; i++ {
+		if same(list[i]) {
+			*inherited--
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// Add the header name: value, replacing the values an earlier
+// file gave it
+func (gc *GatewayConfig) addHeader(name, value string) {
+	if gc.mqttheaders == nil {
+		gc.mqttheaders = http.Header{}
+	}
+	name = http.CanonicalHeaderKey(name)
+	if gc.layers.headers[name] {
+		gc.mqttheaders.Del(name)
+		delete(gc.layers.headers, name)
+	}
+	gc.mqttheaders.Add(name, value)
+}
@@ -0,0 +1,137 @@
+package gateway
+
+import (
+	"sync/atomic"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// The upper bounds of the buckets latencies are counted in; those
+// beyond the last are counted in all but a bucket
+var latencyBounds = [...]time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// Durations counted in the buckets of latencyBounds, as well as
+// in parent if it is given. Safe to observe from any goroutine.
+type histogram struct {
+	buckets [len(latencyBounds)]uint64
+	count   uint64
+	sum     uint64 // nanoseconds
+	parent  *histogram
+}
+
+// A histogram as it is exported: each bucket counts those up to
+// its bound, in seconds, those of the buckets before it among
+// them, as Prometheus has it
+type histogramSnapshot struct {
+	Count   uint64        `json:"count"`
+	Sum     float64       `json:"sum_seconds"`
+	Buckets []bucketCount `json:"buckets"`
+}
+
+type bucketCount struct {
+	Le    float64 `json:"le"`
+	Count uint64  `json:"count"`
+}
+
+func (h *histogram) observe(d time.Duration) {
+	for i, bound := range latencyBounds {
+		if d <= bound {
+			atomic.AddUint64(&h.buckets[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+	if h.parent != nil {
+		h.parent.observe(d)
+	}
+}
+
+func (h *histogram) snapshot() histogramSnapshot {
+	s := histogramSnapshot{
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     time.Duration(atomic.LoadUint64(&h.sum)).Seconds(),
+		Buckets: make([]bucketCount, len(latencyBounds)),
+	}
+	var cumulative uint64
+	for i, bound := range latencyBounds {
+		cumulative += atomic.LoadUint64(&h.buckets[i])
+		s.Buckets[i] = bucketCount{bound.Seconds(), cumulative}
+	}
+	return s
+}
+
+// How long the gateway takes over what it does: handling each
+// type of packet, from its datagram being read to its handler
+// returning; waiting for the broker to acknowledge a PUBLISH;
+// and publishing a message from the broker to the last of its
+// subscribers. How long clients take to answer a REGISTER is
+// timed only given latency-register-rtt, every client having a
+// histogram of its own.
+type latencies struct {
+	handle      map[byte]*histogram
+	upstream    histogram
+	distribute  histogram
+	register    histogram
+	registerRTT bool
+}
+
+func newLatencies() *latencies {
+	l := &latencies{handle: make(map[byte]*histogram, len(MessageNames))}
+	for msgType := range MessageNames {
+		l.handle[msgType] = &histogram{}
+	}
+	return l
+}
+
+// Count d as the time taken to handle a packet of msgType
+func (l *latencies) handled(msgType byte, d time.Duration) {
+	if h := l.handle[msgType]; h != nil {
+		h.observe(d)
+	}
+}
+
+// The histograms as they are exported, a packet type only if
+// one has been handled
+func (l *latencies) snapshot() map[string]interface{} {
+	handle := make(map[string]histogramSnapshot)
+	for msgType, h := range l.handle {
+		if atomic.LoadUint64(&h.count) > 0 {
+			handle[MessageNames[msgType]] = h.snapshot()
+		}
+	}
+	m := map[string]interface{}{
+		"handle":     handle,
+		"upstream":   l.upstream.snapshot(),
+		"distribute": l.distribute.snapshot(),
+	}
+	if l.registerRTT {
+		m["register_rtt"] = l.register.snapshot()
+	}
+	return m
+}
+
+// Give c a histogram of the round trips of its REGISTERs if they
+// are timed
+func (l *latencies) configureClient(c *Client) {
+	if l.registerRTT {
+		c.registerRTT = &histogram{parent: &l.register}
+	}
+}
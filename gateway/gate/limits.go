@@ -0,0 +1,126 @@
+package gateway
+
+import "time"
+
+// The limits on what the gateway keeps, set by the options of
+// the limits section, each 0 for no limit unless it has a
+// default: clients served at once (max-clients), topics
+// registered (max-topics), what is queued and in flight for each
+// client (client-queue, client-queue-bytes, client-inflight),
+// what each client may publish a second (client-publish-rate,
+// client-publish-bytes, client-publish-limit), what is on its way to the broker (upstream-inflight,
+// upstream-queue, broker-offline-queue, broker-offline-queue-qos0),
+// connections open (max-connections, max-broker-connections) and
+// the size of each packet (max-message-size, max-outbound-size).
+
+// The PUBLISHes queued for a client while it is asleep or
+// registering their topics, unless configured
+const defaultClientQueue = 1000
+
+// The number of QoS 1 and 2 PUBLISHes that may be awaiting
+// acknowledgement from a client at once, unless configured
+const defaultInflightWindow = 1
+
+// The limits of what is kept for each client
+type clientLimits struct {
+	queue      int // PUBLISHes queued, 0 for no limit
+	queueBytes int // bytes of their payloads, 0 for no limit
+	inflight   int // QoS 1 and 2 PUBLISHes unacknowledged
+}
+
+func defaultClientLimits() clientLimits {
+	return clientLimits{defaultClientQueue, 0, defaultInflightWindow}
+}
+
+// Take the limits of gc
+func (g *core) setLimits(gc *GatewayConfig) {
+	g.maxClients = gc.maxclients
+	g.clientLimits = gc.clientLimits()
+	g.publishLimits = gc.publishLimits()
+	g.tIndex.max = gc.maxtopics
+}
+
+// Give a new client the gateway's timers and limits, its rate
+// limit among them, and a histogram of its REGISTERs' round
+// trips if they are timed
+func (g *core) configureClient(c *Client) {
+	c.timers = g.timers
+	c.limits = g.clientLimits
+	if l, ok := g.publishLimits.of(c.ClientId); ok {
+		c.publishLimit = newPublishBucket(l, time.Now())
+	}
+	g.latency.configureClient(c)
+}
+
+// Whether a client at a, not already one, would be one more
+// than the gateway serves at once
+func (g *core) tooManyClients(a uAddr) bool {
+	if g.maxClients > 0 && g.clients.GetClient(a) == nil && g.clients.Len() >= g.maxClients {
+		ERROR.Printf("already serving %d clients\n", g.maxClients)
+		return true
+	}
+	return false
+}
+
+// A limit, named by the option setting it, and how much of it is
+// used: for those of each client, by the client using the most.
+// Max is 0 for no limit.
+type LimitUsage struct {
+	Name string
+	Max  int
+	Used int
+}
+
+// The usage of the limits on clients and topics
+func (g *core) limitUsage() []LimitUsage {
+	var queued, queuedBytes, inflight int
+	g.clients.Range(func(sc SNClient) {
+		q, b, i := sc.base().usage()
+		queued = maxInt(queued, q)
+		queuedBytes = maxInt(queuedBytes, b)
+		inflight = maxInt(inflight, i)
+	})
+	return []LimitUsage{
+		{"max-clients", g.maxClients, g.clients.Len()},
+		{"max-topics", g.tIndex.max, g.tIndex.len()},
+		{"client-queue", g.clientLimits.queue, queued},
+		{"client-queue-bytes", g.clientLimits.queueBytes, queuedBytes},
+		{"client-inflight", g.clientLimits.inflight, inflight},
+	}
+}
+
+// The limits of the gateway and how much of each is used
+func (ag *AGateway) Limits() []LimitUsage {
+	usage := ag.limitUsage()
+	if ag.window != nil {
+		inflight, queued := ag.window.usage()
+		usage = append(usage,
+			LimitUsage{"upstream-inflight", cap(ag.window.slots), inflight},
+			LimitUsage{"upstream-queue", cap(ag.window.queue), queued})
+	}
+	var held, heldQos0 int
+	for _, u := range ag.upstreams() {
+		u.Lock()
+		held = maxInt(held, len(u.held)-u.heldQos0)
+		heldQos0 = maxInt(heldQos0, u.heldQos0)
+		u.Unlock()
+	}
+	return append(usage,
+		LimitUsage{"broker-offline-queue", ag.upstream.maxHeld, held},
+		LimitUsage{"broker-offline-queue-qos0", ag.upstream.maxHeldQos0, heldQos0},
+		LimitUsage{"max-connections", ag.transports.conns.max, ag.transports.Connections().Open})
+}
+
+// The limits of the gateway and how much of each is used
+func (t *TGateway) Limits() []LimitUsage {
+	return append(t.limitUsage(),
+		LimitUsage{"max-broker-connections", t.brokerConns.max, t.BrokerConnections()},
+		LimitUsage{"max-connections", t.transports.conns.max, t.transports.Connections().Open})
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,277 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// A listener a gateway has besides those its flat options
+// configure, from a "listener" line of the configuration:
+//
+//	listener udp://192.168.1.10:1884
+//	listener udp6://:1884
+//	listener dtls://203.0.113.5:8883?psk-file=/etc/gnatt/site.psk
+//	listener unix:///run/gnatt/forwarder.sock?mode=0600
+//	listener serial:///dev/ttyUSB0?baud=9600
+//	listener udp://[fd00::1]:1884?max-outbound-size=100&allow-qos-minus-one=true
+//
+// udp6 listens on IPv6 alone, and unixgram is another name for
+// unix, whose sockets are datagram ones. Options given after ?,
+// separated by &, are the listener's own: max-message-size and
+// max-outbound-size, as those options are for the others;
+// allow-qos-minus-one, letting clients publish at QoS -1 without
+// connecting; psk-file, cert-file, key-file, client-ca-file and
+// client-cert-required of a DTLS listener; mode of a unix one;
+// and baud of a serial one. Those not given are as the options
+// of the listener's kind have them.
+type listenerConfig struct {
+	kind        string // "udp", "udp6", "dtls", "tcp", "unix" or "serial"
+	address     string // host:port, socket path or serial device
+	outbound    int    // the largest packet sent, 0 as configured
+	maxSize     int    // the largest packet received or sent, 0 as configured
+	qosMinusOne bool
+	dtls        dtlsFiles   // each "" as configured
+	baud        int         // 0 as configured
+	mode        os.FileMode // 0 as configured
+}
+
+func (lc listenerConfig) String() string {
+	return lc.kind + "://" + lc.address
+}
+
+// The options of the listener's own, as checkListener reads them
+func (lc listenerConfig) options() []string {
+	var opts []string
+	add := func(name, value string, given bool) {
+		if given {
+			opts = append(opts, name+"="+value)
+		}
+	}
+	add("max-message-size", strconv.Itoa(lc.maxSize), lc.maxSize > 0)
+	add("max-outbound-size", strconv.Itoa(lc.outbound), lc.outbound > 0)
+	add("allow-qos-minus-one", "true", lc.qosMinusOne)
+	add("psk-file", lc.dtls.psk, lc.dtls.psk != "")
+	add("cert-file", lc.dtls.cert, lc.dtls.cert != "")
+	add("key-file", lc.dtls.key, lc.dtls.key != "")
+	add("client-ca-file", lc.dtls.clientCA, lc.dtls.clientCA != "")
+	add("client-cert-required", "true", lc.dtls.clientCertRequired)
+	add("baud", strconv.Itoa(lc.baud), lc.baud > 0)
+	add("mode", fmt.Sprintf("%#o", lc.mode), lc.mode != 0)
+	return opts
+}
+
+// What a gateway listens on and stops
+type gatewayListener interface {
+	stop(ctx context.Context) error
+	stats() *listenerCounters
+	// The address bound to, which the system chose the port of
+	// if it was given as 0
+	addr() net.Addr
+}
+
+// The packets through a listener, named by the network and the
+// address it listens on ("udp://0.0.0.0:1884"), which is the
+// name its clients are tagged with, and the largest packet that
+// may be sent to its clients, 0 for the listener's maximum
+type listenerCounters struct {
+	name       string
+	packetsIn  uint64
+	bytesIn    uint64
+	packetsOut uint64
+	bytesOut   uint64
+	outbound   int64
+	// whether its clients may publish at QoS -1 without
+	// connecting
+	qosMinusOne atomic.Bool
+}
+
+func newListenerCounters(kind string, addr net.Addr) *listenerCounters {
+	return &listenerCounters{name: kind + "://" + addr.String()}
+}
+
+func (c *listenerCounters) received(n int) {
+	atomic.AddUint64(&c.packetsIn, 1)
+	atomic.AddUint64(&c.bytesIn, uint64(n))
+}
+
+func (c *listenerCounters) sent(n int) {
+	atomic.AddUint64(&c.packetsOut, 1)
+	atomic.AddUint64(&c.bytesOut, uint64(n))
+}
+
+// Limit the packets sent to the listener's clients to n bytes,
+// as the network beyond it allows; 0 for no limit of its own
+func (c *listenerCounters) setOutbound(n int) {
+	atomic.StoreInt64(&c.outbound, int64(n))
+}
+
+func (c *listenerCounters) maxOutbound() int {
+	return int(atomic.LoadInt64(&c.outbound))
+}
+
+// Let the listener's clients publish at QoS -1, or not
+func (c *listenerCounters) allowQosMinusOne(allow bool) {
+	c.qosMinusOne.Store(allow)
+}
+
+// Whether clients may publish at QoS -1 through the listener,
+// which c may be nil for, as it is for none
+func (c *listenerCounters) allowsQosMinusOne() bool {
+	return c != nil && c.qosMinusOne.Load()
+}
+
+// What a listener has handled, and how many of the gateway's
+// clients are connected through it
+type ListenerStats struct {
+	Name       string
+	Clients    int
+	PacketsIn  uint64
+	BytesIn    uint64
+	PacketsOut uint64
+	BytesOut   uint64
+}
+
+// The stats of the gateway's UDP listener, if it is listening,
+// and of each of its others
+func listenerStats(g *core, l *listener, ts *transports) []ListenerStats {
+	var all []gatewayListener
+	if l != nil {
+		all = append(all, l)
+	}
+	all = append(all, ts.listeners()...)
+	clients := make(map[*listenerCounters]int)
+	g.clients.Range(func(c SNClient) {
+		clients[c.base().Conn.l]++
+	})
+	stats := make([]ListenerStats, len(all))
+	for i, gl := range all {
+		c := gl.stats()
+		stats[i] = ListenerStats{
+			c.name,
+			clients[c],
+			atomic.LoadUint64(&c.packetsIn),
+			atomic.LoadUint64(&c.bytesIn),
+			atomic.LoadUint64(&c.packetsOut),
+			atomic.LoadUint64(&c.bytesOut),
+		}
+	}
+	return stats
+}
+
+// The addresses the gateway's UDP listener, if it is listening,
+// and each of its others are bound to
+func listenerAddrs(l *listener, ts *transports) []net.Addr {
+	var addrs []net.Addr
+	if l != nil {
+		addrs = append(addrs, l.addr())
+	}
+	for _, gl := range ts.listeners() {
+		addrs = append(addrs, gl.addr())
+	}
+	return addrs
+}
+
+// kind://address, kind being udp, udp6, dtls, tcp, unix,
+// unixgram or serial, optionally followed by ? and the
+// listener's own options, name=value, separated by &
+func checkListener(value string) (listenerConfig, error) {
+	var opts string
+	if i := strings.LastIndex(value, "?"); i >= 0 {
+		value, opts = value[:i], value[i+1:]
+	}
+	i := strings.Index(value, "://")
+	if i <= 0 || len(value) == i+3 {
+		ERROR.Printf("Invalid value specified for \"listener\" (not udp, udp6, dtls, tcp, unix, unixgram or serial://address): \"%s\"", value)
+		return listenerConfig{}, ErrInvalidListener
+	}
+	lc := listenerConfig{kind: value[:i], address: value[i+3:]}
+	switch lc.kind {
+	case "unixgram":
+		lc.kind = "unix"
+	case "udp", "udp6", "dtls", "tcp", "unix", "serial":
+	default:
+		ERROR.Printf("Invalid value specified for \"listener\" (not udp, udp6, dtls, tcp, unix, unixgram or serial://address): \"%s\"", value)
+		return listenerConfig{}, ErrInvalidListener
+	}
+	if opts == "" {
+		return lc, nil
+	}
+	for _, opt := range strings.Split(opts, "&") {
+		if err := lc.setOption(opt); err != nil {
+			return listenerConfig{}, err
+		}
+	}
+	return lc, nil
+}
+
+// The listener's own options for any kind of listener
+var listenerOptions = map[string]bool{
+	"max-message-size":    true,
+	"max-outbound-size":   true,
+	"allow-qos-minus-one": true,
+}
+
+// The kinds of listener each of the listener's own options is
+// for, those for any kind being listenerOptions
+var listenerOptionKinds = map[string][]string{
+	"psk-file":             {"dtls"},
+	"cert-file":            {"dtls"},
+	"key-file":             {"dtls"},
+	"client-ca-file":       {"dtls"},
+	"client-cert-required": {"dtls"},
+	"mode":                 {"unix"},
+	"baud":                 {"serial"},
+}
+
+// Set an option of the listener's own, name=value
+func (lc *listenerConfig) setOption(opt string) error {
+	name, value := opt, ""
+	if i := strings.Index(opt, "="); i >= 0 {
+		name, value = opt[:i], opt[i+1:]
+	}
+	if kinds, ok := listenerOptionKinds[name]; ok && !containsString(kinds, lc.kind) {
+		ERROR.Printf("Invalid value specified for \"listener\" (%s is not an option of a %s listener): \"%s\"", name, lc.kind, opt)
+		return ErrInvalidListener
+	}
+	var e error
+	switch name {
+	case "max-message-size":
+		lc.maxSize, e = checkMessageSize("max-message-size", value)
+	case "max-outbound-size":
+		lc.outbound, e = checkMessageSize("max-outbound-size", value)
+	case "allow-qos-minus-one":
+		lc.qosMinusOne, e = checkBool("allow-qos-minus-one", value)
+	case "psk-file":
+		lc.dtls.psk = value
+	case "cert-file":
+		lc.dtls.cert = value
+	case "key-file":
+		lc.dtls.key = value
+	case "client-ca-file":
+		lc.dtls.clientCA = value
+	case "client-cert-required":
+		lc.dtls.clientCertRequired, e = checkBool("client-cert-required", value)
+	case "mode":
+		lc.mode, e = checkFileMode("mode", value)
+	case "baud":
+		lc.baud, e = checkNum("baud", value)
+	default:
+		ERROR.Printf("Invalid value specified for \"listener\" (unknown option): \"%s\"", opt)
+		return ErrInvalidListener
+	}
+	return e
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
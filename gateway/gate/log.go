@@ -1,16 +1,299 @@
 package gateway
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+// The gateway logs errors to ERROR, what may be wrong to WARN,
+// what it does, such as clients coming and going, to INFO and
+// the detail of it, each packet and delivery, to DEBUG.
+// InitLogger sets where they write; ConfigureLogger then sets
+// which of them are written, how and where, from the log-*
+// options, changing the loggers rather than replacing them so
+// that those holding them keep logging.
 var (
-	INFO  *log.Logger
-	ERROR *log.Logger
+	ERROR *Logger
+	WARN  *Logger
+	INFO  *Logger
+	DEBUG *Logger
 )
 
+// A logger of one level, which neither formats nor writes what
+// it is given while the gateway logs less than its level
+type Logger struct {
+	*log.Logger
+	level int32
+}
+
+func newLogger(w io.Writer, level int) *Logger {
+	return &Logger{log.New(w, logPrefixes[level], log.Ldate|log.Ltime), int32(level)}
+}
+
+// Whether what is given to l is logged, for lines whose
+// arguments are costly to work out
+func (l *Logger) Enabled() bool {
+	return l.level <= atomic.LoadInt32(&logLevel)
+}
+
+func (l *Logger) Print(v ...interface{}) {
+	if l.Enabled() {
+		l.output(fmt.Sprint(v...), nil)
+	}
+}
+
+func (l *Logger) Printf(format string, v ...interface{}) {
+	if l.Enabled() {
+		l.output(fmt.Sprintf(format, v...), nil)
+	}
+}
+
+func (l *Logger) Println(v ...interface{}) {
+	if l.Enabled() {
+		l.output(fmt.Sprintln(v...), nil)
+	}
+}
+
+// Log msg with fields, which the structured formats keep apart
+// from it and text has after it. A line naming a client traced
+// is logged whatever the level, at INFO if it is below, and
+// tagged as traced.
+func (l *Logger) Log(msg string, fields ...Field) {
+	if traces.active() && traces.matches(fields) {
+		if l.level > INFO.level {
+			l = INFO
+		}
+		l.output(msg, append(fields[:len(fields):len(fields)], traceTag))
+		return
+	}
+	if l.Enabled() {
+		l.output(msg, fields)
+	}
+}
+
+// Write a line of msg and fields in the format logged
+func (l *Logger) output(msg string, fields []Field) {
+	msg = strings.TrimSuffix(msg, "\n")
+	switch logFormatting.Load() {
+	case logJSON:
+		l.Output(3, encodeJSON(logLevels[l.level], msg, fields))
+	case logLogfmt:
+		l.Output(3, encodeLogfmt(logLevels[l.level], msg, fields))
+	default:
+		l.Output(3, msg+encodeText(fields))
+	}
+}
+
+// The index in logLevels of the most detailed level logged
+var logLevel int32
+
+// The format lines are logged in, logText unless configured
+var logFormatting atomic.Value
+
+// A standard logger writing to the logger of level, as logLevels
+// has them, for the libraries the gateway uses
+func libraryLogger(level int) *log.Logger {
+	return log.New(libraryLog(level), "", 0)
+}
+
+// Writes what a library logs to the gateway's logger of a level
+type libraryLog int
+
+func (l libraryLog) Write(p []byte) (int, error) {
+	if logger := loggers()[l]; logger.Enabled() {
+		logger.Output(4, string(p))
+	}
+	return len(p), nil
+}
+
+// The levels of logging, each logging what those before it do
+// as well
+const (
+	levelError = "error"
+	levelWarn  = "warn"
+	levelInfo  = "info"
+	levelDebug = "debug"
+)
+
+var logLevels = []string{levelError, levelWarn, levelInfo, levelDebug}
+
+// What begins the text lines of each level
+var logPrefixes = [4]string{"ERROR: ", "WARN:  ", "INFO:  ", "DEBUG: "}
+
+// How lines are logged
+const (
+	logText   = "text"   // the message, then its fields, after the time and level
+	logJSON   = "json"   // an object of time, level, component, msg and fields to a line
+	logLogfmt = "logfmt" // key=value pairs of the same to a line
+)
+
+// Where lines are logged, a file's path if none of these
+const (
+	logStdout = "stdout" // errors and warnings to stderr
+	logStderr = "stderr"
+	logSyslog = "syslog"
+)
+
+// The program name lines sent to syslog are tagged with unless
+// configured
+const defaultSyslogTag = "gnatt"
+
+// Where each level, as logLevels has them, is logged, and the
+// file or syslog connection logged to, closed once no longer
+// logged to
+var logging struct {
+	sync.Mutex
+	writers [4]io.Writer
+	closer  io.Closer
+}
+
+// The loggers of each level, as logLevels has them
+func loggers() [4]*Logger {
+	return [4]*Logger{ERROR, WARN, INFO, DEBUG}
+}
+
+// The index in logLevels of level, -1 if it is not one
+func logLevelIndex(level string) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// Log INFO to infoHandle and ERROR and WARN to errorHandle, as
+// text; DEBUG is not logged
 func InitLogger(infoHandle, errorHandle io.Writer) {
-	INFO = log.New(infoHandle, "INFO:  ", log.Ldate|log.Ltime)
-	ERROR = log.New(errorHandle, "ERROR: ", log.Ldate|log.Ltime)
+	ERROR = newLogger(errorHandle, 0)
+	WARN = newLogger(errorHandle, 1)
+	INFO = newLogger(infoHandle, 2)
+	DEBUG = newLogger(infoHandle, 3)
+	logging.Lock()
+	defer logging.Unlock()
+	logging.writers = [4]io.Writer{errorHandle, errorHandle, infoHandle, infoHandle}
+	atomic.StoreInt32(&logLevel, int32(logLevelIndex(levelInfo)))
+	logFormatting.Store(logText)
+	if logging.closer != nil {
+		logging.closer.Close()
+		logging.closer = nil
+	}
+}
+
+// Log as the log-level, log-format and log-destination options
+// of gc have it, before the gateway is started
+func ConfigureLogger(gc *GatewayConfig) error {
+	if ERROR == nil {
+		InitLogger(ioutil.Discard, ioutil.Discard)
+	}
+	out, err := openLogOutput(gc)
+	if err != nil {
+		return err
+	}
+	setLogOutput(out, gc)
+	atomic.StoreInt32(&logLevel, int32(logLevelIndex(gc.logLevel())))
+	setPacketDump(gc.packetDump())
+	traces.configure(gc)
+	return nil
+}
+
+// Where the loggers of each level write, and what is closed once
+// they no longer do
+type logOutput struct {
+	writers [4]io.Writer
+	closer  io.Closer
+}
+
+// Open where the log-destination option of gc has the gateway
+// log, a file or syslog among them
+func openLogOutput(gc *GatewayConfig) (*logOutput, error) {
+	switch dest := gc.logDestination(); dest {
+	case logStdout:
+		return &logOutput{writers: [4]io.Writer{os.Stderr, os.Stderr, os.Stdout, os.Stdout}}, nil
+	case logStderr:
+		return &logOutput{writers: [4]io.Writer{os.Stderr, os.Stderr, os.Stderr, os.Stderr}}, nil
+	case logSyslog:
+		writers, closer, err := openSyslog(gc.logsyslogaddr, gc.logSyslogTag())
+		if err != nil {
+			ERROR.Printf("Cannot log to syslog: %v", err)
+			return nil, err
+		}
+		return &logOutput{writers, closer}, nil
+	default:
+		f, err := openLogFile(gc.logFile())
+		if err != nil {
+			ERROR.Printf("Cannot log to %s: %v", dest, err)
+			return nil, err
+		}
+		return &logOutput{[4]io.Writer{f, f, f, f}, f}, nil
+	}
+}
+
+// Log to out, or where the gateway logs already if out is nil,
+// in the log-format of gc, closing what was logged to before
+func setLogOutput(out *logOutput, gc *GatewayConfig) {
+	// syslog and structured lines carry their own time and level
+	prefixes, flags := logPrefixes, log.Ldate|log.Ltime
+	if gc.logDestination() == logSyslog || gc.logFormat() != logText {
+		prefixes, flags = [4]string{}, 0
+	}
+
+	logging.Lock()
+	defer logging.Unlock()
+	var old io.Closer
+	if out != nil {
+		old = logging.closer
+		logging.writers, logging.closer = out.writers, out.closer
+	}
+	for i, l := range loggers() {
+		l.SetOutput(logging.writers[i])
+		l.SetPrefix(prefixes[i])
+		l.SetFlags(flags)
+	}
+	logFormatting.Store(gc.logFormat())
+	if old != nil {
+		old.Close()
+	}
+}
+
+// Open the log file again, once logrotate has moved it away, to
+// log to a new one at its path; there is nothing to do unless
+// logging to a file
+func ReopenLog() error {
+	logging.Lock()
+	defer logging.Unlock()
+	if f, ok := logging.closer.(*logFile); ok {
+		return f.reopen()
+	}
+	return nil
+}
+
+// Lines dropped, not having been written where they are logged
+var logDropped uint64
+
+// The lines dropped since the gateway started, a log file not
+// having taken them
+func LogDropped() uint64 {
+	return atomic.LoadUint64(&logDropped)
+}
+
+// Log level and the levels before it alone, from now on
+func SetLogLevel(level string) error {
+	i := logLevelIndex(level)
+	if i < 0 {
+		return ErrInvalidLogLevel
+	}
+	atomic.StoreInt32(&logLevel, int32(i))
+	return nil
+}
+
+// The level logged, and the levels before it
+func LogLevel() string {
+	return logLevels[atomic.LoadInt32(&logLevel)]
 }
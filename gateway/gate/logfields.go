@@ -0,0 +1,175 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// A field of a line logged. The structured formats give every
+// line its time, level and component, the part of the gateway
+// logging it, and lines about a client, a packet or a topic
+// the fields naming them, so that they may be searched for
+// whatever the message says.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// The keys of the fields lines are given
+const (
+	fieldComponent = "component"
+	fieldClientId  = "client_id"
+	fieldRemote    = "remote_addr"
+	fieldMsgType   = "msg_type"
+	fieldTopic     = "topic"
+	fieldMsgId     = "msgid"
+	fieldTopicId   = "topic_id"
+)
+
+// The component of lines not given one
+const defaultComponent = "gateway"
+
+func logComponent(name string) Field {
+	return Field{fieldComponent, name}
+}
+
+// The components of the gateway
+var (
+	coreLog        = logComponent("core")
+	aggregatingLog = logComponent("aggregating")
+	transparentLog = logComponent("transparent")
+	clientLog      = logComponent("client")
+	adminLog       = logComponent("admin")
+	dumpLog        = logComponent("dump")
+)
+
+// The client's id; its address is logRemote's
+func logClient(c *Client) Field {
+	return logClientId(c.ClientId)
+}
+
+// The id of a client not made yet
+func logClientId(id string) Field {
+	return Field{fieldClientId, id}
+}
+
+// The address a packet came from or was sent to, net.Addr or
+// uAddr
+func logRemote(addr fmt.Stringer) Field {
+	return Field{fieldRemote, addr}
+}
+
+// The name of the type of a packet, such as PUBLISH
+func logMsgType(t byte) Field {
+	return Field{fieldMsgType, MessageNames[t]}
+}
+
+func logTopic(topic string) Field {
+	return Field{fieldTopic, topic}
+}
+
+func logMsgId(id uint16) Field {
+	return Field{fieldMsgId, id}
+}
+
+func logTopicId(id uint16) Field {
+	return Field{fieldTopicId, id}
+}
+
+// The value of a field as text
+func fieldText(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	case error:
+		return v.Error()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// The component given among fields, defaultComponent if none
+// is, and the other fields
+func splitComponent(fields []Field) (string, []Field) {
+	for i, f := range fields {
+		if f.Key == fieldComponent {
+			rest := append(fields[:i:i], fields[i+1:]...)
+			return fieldText(f.Value), rest
+		}
+	}
+	return defaultComponent, fields
+}
+
+// The fields as " key=value" pairs after the message
+func encodeText(fields []Field) string {
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteByte(' ')
+		writeLogfmt(&b, f.Key, fieldText(f.Value))
+	}
+	return b.String()
+}
+
+// A line of key=value pairs, a value quoted if it must be
+func encodeLogfmt(level, msg string, fields []Field) string {
+	component, fields := splitComponent(fields)
+	var b strings.Builder
+	writeLogfmt(&b, "time", time.Now().Format(time.RFC3339Nano))
+	b.WriteString(" ")
+	writeLogfmt(&b, "level", level)
+	b.WriteString(" ")
+	writeLogfmt(&b, fieldComponent, component)
+	b.WriteString(" ")
+	writeLogfmt(&b, "msg", msg)
+	b.WriteString(encodeText(fields))
+	return b.String()
+}
+
+func writeLogfmt(b *strings.Builder, key, value string) {
+	b.WriteString(key)
+	b.WriteByte('=')
+	if value == "" || strings.ContainsAny(value, " =\"\\") || strings.IndexFunc(value, func(r rune) bool { return r < ' ' }) >= 0 {
+		value = strconv.Quote(value)
+	}
+	b.WriteString(value)
+}
+
+// A JSON object of the time, level, component and msg, then the
+// fields in the order given, numbers kept as numbers
+func encodeJSON(level, msg string, fields []Field) string {
+	component, fields := splitComponent(fields)
+	var b strings.Builder
+	add := func(key string, value interface{}) {
+		if b.Len() == 0 {
+			b.WriteByte('{')
+		} else {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		b.Write(k)
+		b.WriteByte(':')
+		switch value.(type) {
+		case int, int64, uint16, uint32, byte, bool:
+		default:
+			value = fieldText(value)
+		}
+		v, _ := json.Marshal(value)
+		b.Write(v)
+	}
+	add("time", time.Now().Format(time.RFC3339Nano))
+	add("level", level)
+	add(fieldComponent, component)
+	add("msg", msg)
+	for _, f := range fields {
+		add(f.Key, f.Value)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
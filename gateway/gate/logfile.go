@@ -0,0 +1,182 @@
+package gateway
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often a log file is synced to disk, if not every interval
+// given as a duration
+const (
+	logSyncNone = "none" // as the operating system sees fit
+	logSyncLine = "line" // after every line
+)
+
+// A log file, how large it grows before it rotates and what is
+// kept of those rotated
+type logFileConfig struct {
+	path       string
+	maxSize    int64         // 0 never rotated
+	maxBackups int           // 0 all kept
+	maxAge     time.Duration // 0 kept whatever their age
+	syncLine   bool
+	syncEvery  time.Duration // 0 not synced periodically
+}
+
+// The name of the nth file rotated out of path, path.1 being
+// the latest
+func backupName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// A log file, rotated once writing a line would grow it beyond
+// its maximum size, and reopened when logrotate has moved it.
+// Lines are written and the file rotated under its lock, so no
+// line written while it rotates is lost. A line that cannot be
+// written, the disk being full, is dropped and counted rather
+// than retried, so that the packet path is never held up.
+type logFile struct {
+	sync.Mutex
+	conf    logFileConfig
+	file    *os.File
+	size    int64
+	stop    chan struct{}
+	dropped *uint64
+}
+
+func openLogFile(conf logFileConfig) (*logFile, error) {
+	return openFile(conf, &logDropped)
+}
+
+// A file written as the log file is, counting the lines dropped
+// in dropped
+func openFile(conf logFileConfig, dropped *uint64) (*logFile, error) {
+	f := &logFile{conf: conf, stop: make(chan struct{}), dropped: dropped}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	if conf.syncEvery > 0 {
+		go f.syncEvery(conf.syncEvery)
+	}
+	return f, nil
+}
+
+// Must be called with the lock held.
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.conf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	f.file, f.size = file, 0
+	if fi, err := file.Stat(); err == nil {
+		f.size = fi.Size()
+	}
+	return nil
+}
+
+func (f *logFile) Write(p []byte) (int, error) {
+	defer f.Unlock()
+	f.Lock()
+	if f.file != nil && f.conf.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.conf.maxSize {
+		f.rotate()
+	}
+	if f.file == nil && f.open() != nil {
+		atomic.AddUint64(f.dropped, 1)
+		return len(p), nil
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		atomic.AddUint64(f.dropped, 1)
+	} else if f.conf.syncLine {
+		f.file.Sync()
+	}
+	return len(p), nil
+}
+
+// Move the file out of the way and open a new one. If it cannot
+// be moved, lines are written to it until it grows by the
+// maximum size again. Must be called with the lock held.
+func (f *logFile) rotate() {
+	f.file.Close()
+	f.file = nil
+	if err := rotateFile(f.conf.path, f.conf.maxBackups, f.conf.maxAge); err != nil {
+		if f.open() == nil {
+			f.size = 0
+		}
+		return
+	}
+	f.open()
+}
+
+// Move the closed file at path to path.1, those before it along
+// one, removing those beyond maxBackups or older than maxAge,
+// either 0 for no limit
+func rotateFile(path string, maxBackups int, maxAge time.Duration) error {
+	n := 0
+	for {
+		if _, err := os.Stat(backupName(path, n+1)); err != nil {
+			break
+		}
+		n++
+	}
+	for i := n; i > 0; i-- {
+		os.Rename(backupName(path, i), backupName(path, i+1))
+	}
+	if err := os.Rename(path, backupName(path, 1)); err != nil {
+		return err
+	}
+	for i := 1; i <= n+1; i++ {
+		name := backupName(path, i)
+		if maxBackups > 0 && i > maxBackups {
+			os.Remove(name)
+		} else if fi, err := os.Stat(name); err == nil && maxAge > 0 && time.Since(fi.ModTime()) > maxAge {
+			os.Remove(name)
+		}
+	}
+	return nil
+}
+
+// Close the file and open a new one at its path, for logrotate
+// having moved it away
+func (f *logFile) reopen() error {
+	defer f.Unlock()
+	f.Lock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+func (f *logFile) syncEvery(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-t.C:
+			f.Lock()
+			if f.file != nil {
+				f.file.Sync()
+			}
+			f.Unlock()
+		}
+	}
+}
+
+func (f *logFile) Close() error {
+	close(f.stop)
+	defer f.Unlock()
+	f.Lock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
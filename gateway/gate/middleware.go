@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// Handles a packet received from a client
+type PacketHandler func(msg Message, c uConn, a uAddr)
+
+// Wraps a PacketHandler. A middleware may drop a packet by not
+// calling next, or pass next a different message.
+type Middleware func(next PacketHandler) PacketHandler
+
+// Chain the middlewares in front of h, the first one given
+// being the first to see each packet
+func chain(middlewares []Middleware, h PacketHandler) PacketHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Allow each address rate packets a second on average, in
+// bursts of up to burst packets, and drop the rest
+func RateLimit(rate float64, burst int) Middleware {
+	rl := &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+	return func(next PacketHandler) PacketHandler {
+		return func(msg Message, c uConn, a uAddr) {
+			if !rl.allow(a.String(), time.Now()) {
+				ERROR.Printf("rate limit exceeded by %v, dropping %s\n", a, MessageNames[msg.MessageType()])
+				return
+			}
+			next(msg, c, a)
+		}
+	}
+}
+
+// Addresses not heard from for this long are forgotten
+const rateLimitIdle = time.Minute
+
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (rl *rateLimiter) allow(addr string, now time.Time) bool {
+	defer rl.Unlock()
+	rl.Lock()
+	if now.Sub(rl.swept) > rateLimitIdle {
+		for a, b := range rl.buckets {
+			if now.Sub(b.last) > rateLimitIdle {
+				delete(rl.buckets, a)
+			}
+		}
+		rl.swept = now
+	}
+	b := rl.buckets[addr]
+	if b == nil {
+		b = &bucket{rl.burst, now}
+		rl.buckets[addr] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
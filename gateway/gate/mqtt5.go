@@ -0,0 +1,627 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/websocket"
+)
+
+// How long an MQTT v5 broker keeps the session of a client that
+// asks for one after it disconnects, unless configured
+const defaultSessionExpiry = 24 * 60 * 60
+
+// The most topic aliases used on an MQTT v5 broker connection
+// unless configured, fewer if the broker allows fewer
+const defaultTopicAliases = 32
+
+// What the broker connections carry when the broker speaks MQTT
+// v5
+type mqtt5Config struct {
+	sessionExpiry uint32
+	topicAliases  uint16
+	messageExpiry []expiryRule
+}
+
+// Messages published on topics matching filter expire if the
+// broker has not delivered them within seconds
+type expiryRule struct {
+	filter  string
+	seconds uint32
+}
+
+// The expiry of messages published on topic, set by the first
+// rule that matches it, 0 (none) if none does
+func (m *mqtt5Config) expiry(topic string) uint32 {
+	for _, r := range m.messageExpiry {
+		if TopicMatches(r.filter, topic) {
+			return r.seconds
+		}
+	}
+	return 0
+}
+
+// The settings of a connection to an MQTT v5 broker
+type mqtt5Options struct {
+	*mqtt5Config
+	broker         string
+	clientID       string
+	username       string
+	password       string
+	cleanSession   bool
+	keepAlive      time.Duration
+	connectTimeout time.Duration
+	will           *Will
+	tlsConfig      *tls.Config
+	headers        http.Header
+	noLocal        bool
+	defaultHandler MQTT.MessageHandler
+	lost           func(error)
+}
+
+// The CONNECT for the connection. A session that is not clean
+// starts where the last left off, and is kept by the broker for
+// sessionExpiry after the connection ends; a clean one is not
+// kept at all.
+func (o *mqtt5Options) connectPacket() *paho.Connect {
+	cp := &paho.Connect{
+		ClientID:   o.clientID,
+		KeepAlive:  uint16(o.keepAlive / time.Second),
+		CleanStart: o.cleanSession,
+		Properties: &paho.ConnectProperties{},
+	}
+	if !o.cleanSession {
+		expiry := o.sessionExpiry
+		cp.Properties.SessionExpiryInterval = &expiry
+	}
+	if o.username != "" {
+		cp.Username, cp.UsernameFlag = o.username, true
+		cp.Password, cp.PasswordFlag = []byte(o.password), true
+	}
+	if o.will != nil {
+		cp.WillMessage = &paho.WillMessage{
+			Retain:  o.will.Retain,
+			QoS:     o.will.Qos,
+			Topic:   o.will.Topic,
+			Payload: o.will.Data,
+		}
+		if s := o.expiry(o.will.Topic); s > 0 {
+			cp.WillProperties = &paho.WillProperties{MessageExpiry: &s}
+		}
+	}
+	return cp
+}
+
+// A connection to an MQTT v5 broker, used by the gateways as
+// they use the v3 client. It is not connected again when lost,
+// the gateways doing that themselves.
+type mqtt5Client struct {
+	sync.Mutex
+	opts      mqtt5Options
+	client    *paho.Client
+	connected bool
+	aliases   topicAliases
+	handlers  []mqtt5Handler
+}
+
+// Where messages matching filter are delivered
+type mqtt5Handler struct {
+	filter  string
+	handler MQTT.MessageHandler
+}
+
+func newMQTT5Client(opts mqtt5Options) *mqtt5Client {
+	if opts.connectTimeout == 0 {
+		opts.connectTimeout = defaultConnectTimeout
+	}
+	return &mqtt5Client{opts: opts}
+}
+
+func (c *mqtt5Client) Connect() MQTT.Token {
+	t := newMQTT5Token()
+	go func() {
+		rc, present, err := c.connect()
+		t.sessionPresent = present
+		t.complete(rc, nil, err)
+	}()
+	return t
+}
+
+// Connect, returning the broker's reason code if it refused, or
+// whether it resumed the session if it accepted
+func (c *mqtt5Client) connect() (byte, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.connectTimeout)
+	defer cancel()
+	conn, err := dialBroker(ctx, c.opts.broker, c.opts.tlsConfig, c.opts.headers)
+	if err != nil {
+		return 0, false, err
+	}
+	var pc *paho.Client
+	pc = paho.NewClient(paho.ClientConfig{
+		ClientID: c.opts.clientID,
+		Conn:     conn,
+		Router:   paho.NewSingleHandlerRouter(c.deliver),
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			c.serverDisconnect(pc, d)
+		},
+		OnClientError: func(err error) {
+			c.lost(pc, err)
+		},
+	})
+	ca, err := pc.Connect(ctx, c.opts.connectPacket())
+	if ca != nil && ca.ReasonCode >= 0x80 {
+		conn.Close()
+		var reason string
+		if ca.Properties != nil {
+			reason = ca.Properties.ReasonString
+		}
+		err := &reasonError{ca.ReasonCode, reason}
+		ERROR.Printf("broker refused the connection for \"%s\": %v\n", c.opts.clientID, err)
+		return ca.ReasonCode, false, err
+	}
+	if err != nil {
+		conn.Close()
+		return 0, false, err
+	}
+	aliases := uint16(0)
+	if ca.Properties != nil && ca.Properties.TopicAliasMaximum != nil {
+		aliases = *ca.Properties.TopicAliasMaximum
+	}
+	if aliases > c.opts.topicAliases {
+		aliases = c.opts.topicAliases
+	}
+	c.Lock()
+	c.client = pc
+	c.connected = true
+	c.aliases.reset(aliases)
+	c.Unlock()
+	return 0, ca.SessionPresent, nil
+}
+
+// Close the connection; unlike the v3 client there is nothing
+// to wait for
+func (c *mqtt5Client) Disconnect(quiesce uint) {
+	c.Lock()
+	pc := c.client
+	c.client, c.connected = nil, false
+	c.Unlock()
+	if pc != nil {
+		pc.Disconnect(&paho.Disconnect{ReasonCode: 0})
+	}
+}
+
+func (c *mqtt5Client) IsConnected() bool {
+	defer c.Unlock()
+	c.Lock()
+	return c.connected
+}
+
+// The connection pc has failed, unless it was closed already
+func (c *mqtt5Client) lost(pc *paho.Client, err error) {
+	c.Lock()
+	if c.client != pc || !c.connected {
+		c.Unlock()
+		return
+	}
+	c.client, c.connected = nil, false
+	c.Unlock()
+	if c.opts.lost != nil {
+		c.opts.lost(err)
+	}
+}
+
+// The broker has closed the connection pc, saying why
+func (c *mqtt5Client) serverDisconnect(pc *paho.Client, d *paho.Disconnect) {
+	var reason string
+	if d.Properties != nil {
+		reason = d.Properties.ReasonString
+	}
+	err := &reasonError{d.ReasonCode, reason}
+	ERROR.Printf("broker disconnected \"%s\": %v\n", c.opts.clientID, err)
+	c.lost(pc, err)
+}
+
+func (c *mqtt5Client) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	t := newMQTT5Token()
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	}
+	c.Lock()
+	pc := c.client
+	if pc == nil {
+		c.Unlock()
+		t.complete(0, nil, ErrBrokerUnavailable)
+		return t
+	}
+	p, setup := c.publishPacket(topic, qos, retained, data)
+	c.Unlock()
+	go func() {
+		pr, err := pc.Publish(context.Background(), p)
+		if err == nil && pr != nil && pr.ReasonCode >= 0x80 {
+			var reason string
+			if pr.Properties != nil {
+				reason = pr.Properties.ReasonString
+			}
+			err = &reasonError{pr.ReasonCode, reason}
+			ERROR.Printf("broker refused a publish on \"%s\": %v\n", topic, err)
+		} else if err == nil && pr != nil && pr.ReasonCode == 0x10 {
+			DEBUG.Printf("no subscribers for the publish on \"%s\"\n", topic)
+		}
+		if setup != nil {
+			c.Lock()
+			setup.pending, setup.sent = false, err == nil
+			c.Unlock()
+		}
+		t.complete(0, nil, err)
+	}()
+	return t
+}
+
+// The PUBLISH for a message, expiring as configured for its
+// topic, and sent with the topic's alias once the broker knows
+// it. If it is the one to tell the broker, the alias is
+// returned, to be marked sent once it has been.
+func (c *mqtt5Client) publishPacket(topic string, qos byte, retained bool, payload []byte) (*paho.Publish, *topicAlias) {
+	p := &paho.Publish{
+		QoS:        qos,
+		Retain:     retained,
+		Topic:      topic,
+		Payload:    payload,
+		Properties: &paho.PublishProperties{},
+	}
+	if s := c.opts.expiry(topic); s > 0 {
+		p.Properties.MessageExpiry = &s
+	}
+	ta, setup := c.aliases.get(topic)
+	if ta == nil {
+		return p, nil
+	}
+	id := ta.id
+	p.Properties.TopicAlias = &id
+	if !setup {
+		p.Topic = ""
+		return p, nil
+	}
+	return p, ta
+}
+
+func (c *mqtt5Client) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	t := newMQTT5Token()
+	c.Lock()
+	pc := c.client
+	c.setHandler(topic, callback)
+	c.Unlock()
+	if pc == nil {
+		t.complete(0, nil, ErrBrokerUnavailable)
+		return t
+	}
+	go func() {
+		s := &paho.Subscribe{
+			// No Local is not allowed on a shared subscription
+			Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos, NoLocal: c.opts.noLocal && unshared(topic) == topic}},
+		}
+		sa, err := pc.Subscribe(context.Background(), s)
+		var granted map[string]byte
+		if sa != nil && len(sa.Reasons) > 0 {
+			// a refusal is told by the QoS granted, as by the
+			// v3 client
+			err = nil
+			granted = map[string]byte{topic: sa.Reasons[0]}
+			if sa.Reasons[0] >= 0x80 {
+				var reason string
+				if sa.Properties != nil {
+					reason = sa.Properties.ReasonString
+				}
+				ERROR.Printf("broker refused to subscribe to \"%s\": %v\n", topic, &reasonError{sa.Reasons[0], reason})
+				granted[topic] = mqttSubackFailure
+			}
+		}
+		if err != nil || granted[topic] == mqttSubackFailure {
+			c.Lock()
+			c.removeHandler(topic)
+			c.Unlock()
+		}
+		t.complete(0, granted, err)
+	}()
+	return t
+}
+
+func (c *mqtt5Client) Unsubscribe(topics ...string) MQTT.Token {
+	t := newMQTT5Token()
+	c.Lock()
+	pc := c.client
+	for _, topic := range topics {
+		c.removeHandler(topic)
+	}
+	c.Unlock()
+	if pc == nil {
+		t.complete(0, nil, ErrBrokerUnavailable)
+		return t
+	}
+	go func() {
+		ua, err := pc.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: topics})
+		if ua != nil {
+			for i, rc := range ua.Reasons {
+				if rc >= 0x80 && i < len(topics) {
+					ERROR.Printf("broker refused to unsubscribe from \"%s\": %v\n", topics[i], &reasonError{rc, ""})
+				}
+			}
+		}
+		t.complete(0, nil, err)
+	}()
+	return t
+}
+
+// Deliver messages matching filter to handler, in place of any
+// handler it had
+func (c *mqtt5Client) setHandler(filter string, handler MQTT.MessageHandler) {
+	for i, h := range c.handlers {
+		if h.filter == filter {
+			c.handlers[i].handler = handler
+			return
+		}
+	}
+	c.handlers = append(c.handlers, mqtt5Handler{filter, handler})
+}
+
+func (c *mqtt5Client) removeHandler(filter string) {
+	for i, h := range c.handlers {
+		if h.filter == filter {
+			c.handlers = append(c.handlers[:i], c.handlers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Deliver a message from the broker to the handler of the
+// first filter it matches, a shared one matching as the filter
+// it shares, or to the default handler
+func (c *mqtt5Client) deliver(p *paho.Publish) {
+	c.Lock()
+	handler := c.opts.defaultHandler
+	for _, h := range c.handlers {
+		if TopicMatches(unshared(h.filter), p.Topic) {
+			handler = h.handler
+			break
+		}
+	}
+	c.Unlock()
+	if handler != nil {
+		handler(nil, mqtt5Message{p})
+	}
+}
+
+// A message from an MQTT v5 broker, as the v3 client gives it
+type mqtt5Message struct {
+	p *paho.Publish
+}
+
+func (m mqtt5Message) Duplicate() bool   { return false }
+func (m mqtt5Message) Qos() byte         { return m.p.QoS }
+func (m mqtt5Message) Retained() bool    { return m.p.Retain }
+func (m mqtt5Message) Topic() string     { return m.p.Topic }
+func (m mqtt5Message) MessageID() uint16 { return m.p.PacketID }
+func (m mqtt5Message) Payload() []byte   { return m.p.Payload }
+
+// The outcome of an operation on an MQTT v5 broker connection,
+// as the v3 client gives it
+type mqtt5Token struct {
+	MQTT.Token
+	done           chan struct{}
+	rc             byte
+	granted        map[string]byte
+	sessionPresent bool
+	err            error
+}
+
+func newMQTT5Token() *mqtt5Token {
+	return &mqtt5Token{done: make(chan struct{})}
+}
+
+func (t *mqtt5Token) complete(rc byte, granted map[string]byte, err error) {
+	t.rc, t.granted, t.err = rc, granted, err
+	close(t.done)
+}
+
+func (t *mqtt5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *mqtt5Token) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// The error, nil until the operation is complete
+func (t *mqtt5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// The broker's reason code for refusing the connection
+func (t *mqtt5Token) ReturnCode() byte {
+	select {
+	case <-t.done:
+		return t.rc
+	default:
+		return 0
+	}
+}
+
+// Whether the broker resumed the session it had kept
+func (t *mqtt5Token) SessionPresent() bool {
+	select {
+	case <-t.done:
+		return t.sessionPresent
+	default:
+		return false
+	}
+}
+
+// The QoS the broker granted, by filter
+func (t *mqtt5Token) Result() map[string]byte {
+	select {
+	case <-t.done:
+		return t.granted
+	default:
+		return nil
+	}
+}
+
+// The aliases of the topics published on an MQTT v5 broker
+// connection, given first come first served up to max. The
+// broker is told a topic's alias by the first PUBLISH with it,
+// after which the topic is left out; until that PUBLISH has
+// been sent, others on the topic are sent without the alias.
+type topicAliases struct {
+	max     uint16
+	aliases map[string]*topicAlias
+}
+
+type topicAlias struct {
+	id      uint16
+	pending bool
+	sent    bool
+}
+
+// Forget the aliases, a new connection having none yet
+func (a *topicAliases) reset(max uint16) {
+	a.max = max
+	a.aliases = make(map[string]*topicAlias)
+}
+
+// The alias to publish on topic with, nil if none, and whether
+// the PUBLISH must tell the broker it
+func (a *topicAliases) get(topic string) (*topicAlias, bool) {
+	if ta, ok := a.aliases[topic]; ok {
+		switch {
+		case ta.sent:
+			return ta, false
+		case ta.pending:
+			return nil, false
+		}
+		// the PUBLISH telling the broker failed
+		ta.pending = true
+		return ta, true
+	}
+	if len(a.aliases) >= int(a.max) {
+		return nil, false
+	}
+	ta := &topicAlias{id: uint16(len(a.aliases) + 1), pending: true}
+	a.aliases[topic] = ta
+	return ta, true
+}
+
+// Dial the broker at uri over TCP, TLS or a WebSocket, as the v3
+// client does
+func dialBroker(ctx context.Context, uri string, tlsConfig *tls.Config, headers http.Header) (net.Conn, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{}
+	switch u.Scheme {
+	case "tcp":
+		return d.DialContext(ctx, "tcp", u.Host)
+	case "ssl", "tls", "tcps":
+		return (&tls.Dialer{NetDialer: d, Config: tlsConfig}).DialContext(ctx, "tcp", u.Host)
+	case "ws", "wss":
+		config, err := websocket.NewConfig(uri, "http://"+u.Host)
+		if err != nil {
+			return nil, err
+		}
+		config.Protocol = []string{"mqtt"}
+		config.TlsConfig = tlsConfig
+		for name, values := range headers {
+			config.Header[name] = values
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			d.Deadline = deadline
+		}
+		config.Dialer = d
+		conn, err := websocket.DialConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		conn.PayloadType = websocket.BinaryFrame
+		return conn, nil
+	}
+	return nil, ErrNoTransportSpecified
+}
+
+// A reason code from an MQTT v5 broker at or above 0x80, which
+// is a failure, with the reason the broker gave
+type reasonError struct {
+	code   byte
+	reason string
+}
+
+func (e *reasonError) Error() string {
+	s := fmt.Sprintf("reason code 0x%02x", e.code)
+	if name, ok := reasonCodes[e.code]; ok {
+		s += " (" + name + ")"
+	}
+	if e.reason != "" {
+		s += ": " + e.reason
+	}
+	return s
+}
+
+// The MQTT v5 reason codes a broker fails with
+var reasonCodes = map[byte]string{
+	0x80: "unspecified error",
+	0x81: "malformed packet",
+	0x82: "protocol error",
+	0x83: "implementation specific error",
+	0x84: "unsupported protocol version",
+	0x85: "client identifier not valid",
+	0x86: "bad user name or password",
+	0x87: "not authorized",
+	0x88: "server unavailable",
+	0x89: "server busy",
+	0x8a: "banned",
+	0x8b: "server shutting down",
+	0x8c: "bad authentication method",
+	0x8d: "keep alive timeout",
+	0x8e: "session taken over",
+	0x8f: "topic filter invalid",
+	0x90: "topic name invalid",
+	0x91: "packet identifier in use",
+	0x93: "receive maximum exceeded",
+	0x94: "topic alias invalid",
+	0x95: "packet too large",
+	0x96: "message rate too high",
+	0x97: "quota exceeded",
+	0x98: "administrative action",
+	0x99: "payload format invalid",
+	0x9a: "retain not supported",
+	0x9b: "qos not supported",
+	0x9c: "use another server",
+	0x9d: "server moved",
+	0x9e: "shared subscriptions not supported",
+	0x9f: "connection rate exceeded",
+	0xa0: "maximum connect time",
+	0xa1: "subscription identifiers not supported",
+	0xa2: "wildcard subscriptions not supported",
+}
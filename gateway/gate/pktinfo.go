@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// A UDP socket bound to every address of the host, which learns
+// the address each packet was sent to so that the reply is sent
+// from it. The kernel would otherwise choose the source by
+// route, and on a host with several addresses that may not be
+// the one the client sent to, whose reply many constrained
+// stacks drop.
+type pktinfoConn struct {
+	*net.UDPConn
+	v4 *ipv4.PacketConn
+	v6 *ipv6.PacketConn
+}
+
+// Whether conn is bound to every address, so that its replies
+// need their source set
+func unspecified(conn Transport) bool {
+	u, ok := conn.(*net.UDPConn)
+	if !ok {
+		return false
+	}
+	a, ok := u.LocalAddr().(*net.UDPAddr)
+	return ok && (a.IP == nil || a.IP.IsUnspecified())
+}
+
+// Ask for the address each packet conn reads was sent to. An
+// IPv6 socket may be sent IPv4 packets too, which are told
+// their address as IPv4-mapped and answered over IPv4.
+func newPktinfoConn(conn *net.UDPConn) (*pktinfoConn, error) {
+	c := &pktinfoConn{UDPConn: conn, v4: ipv4.NewPacketConn(conn)}
+	if a := conn.LocalAddr().(*net.UDPAddr); a.IP.To4() != nil {
+		if err := c.v4.SetControlMessage(ipv4.FlagDst, true); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	c.v6 = ipv6.NewPacketConn(conn)
+	if err := c.v6.SetControlMessage(ipv6.FlagDst, true); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Read a packet, and the address it was sent to, nil if the
+// kernel did not say
+func (c *pktinfoConn) readFromTo(b []byte) (int, net.Addr, net.IP, error) {
+	if c.v6 != nil {
+		n, cm, src, err := c.v6.ReadFrom(b)
+		if cm == nil {
+			return n, src, nil, err
+		}
+		return n, src, cm.Dst, err
+	}
+	n, cm, src, err := c.v4.ReadFrom(b)
+	if cm == nil {
+		return n, src, nil, err
+	}
+	return n, src, cm.Dst, err
+}
+
+// Write b to addr from the address src
+func (c *pktinfoConn) writeFromTo(b []byte, addr net.Addr, src net.IP) (int, error) {
+	if ip4 := src.To4(); ip4 != nil {
+		return c.v4.WriteTo(b, &ipv4.ControlMessage{Src: ip4}, addr)
+	}
+	return c.v6.WriteTo(b, &ipv6.ControlMessage{Src: src}, addr)
+}
+
+// Replies to a client written from the address it sent to
+type pinnedReplier struct {
+	c   *pktinfoConn
+	src net.IP
+}
+
+// Write b to addr from the address the client sent to, or from
+// whichever the kernel chooses if that cannot be, as when it was
+// a subnet's broadcast address
+func (r pinnedReplier) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := r.c.writeFromTo(b, addr, r.src)
+	if err != nil {
+		return r.c.WriteTo(b, addr)
+	}
+	return n, err
+}
+
+// Read a packet from conn, returning what to reply to its
+// sender with: conn itself, unless it knows the address the
+// packet was sent to and replies from there
+func readPacket(conn Transport, b []byte) (int, net.Addr, replier, error) {
+	c, ok := conn.(*pktinfoConn)
+	if !ok {
+		n, remote, err := conn.ReadFrom(b)
+		return n, remote, conn, err
+	}
+	n, remote, dst, err := c.readFromTo(b)
+	if dst == nil || !dst.IsGlobalUnicast() && !dst.IsLoopback() {
+		// sent to a group or to everyone, not to an address
+		return n, remote, conn, err
+	}
+	return n, remote, pinnedReplier{c, dst}, err
+}
@@ -0,0 +1,32 @@
+package gateway
+
+import (
+	"strings"
+)
+
+// The namespace the aggregating gateway puts the topics it
+// bridges under on the broker, so that gateways sharing a broker
+// keep apart while their clients see the topics they always did.
+// Topics and filters beginning with $ are the broker's own, and
+// are left as they are. Empty if not configured.
+type topicPrefix string
+
+// topic, or filter, as the broker knows it
+func (p topicPrefix) upstream(topic string) string {
+	if p == "" || strings.HasPrefix(topic, "$") {
+		return topic
+	}
+	return string(p) + topic
+}
+
+// The topic of a message from the broker as the clients know it,
+// false if it is outside the namespace
+func (p topicPrefix) downstream(topic string) (string, bool) {
+	if p == "" || strings.HasPrefix(topic, "$") {
+		return topic, true
+	}
+	if !strings.HasPrefix(topic, string(p)) || len(topic) == len(p) {
+		return "", false
+	}
+	return topic[len(p):], true
+}
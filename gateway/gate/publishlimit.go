@@ -0,0 +1,148 @@
+package gateway
+
+import (
+	"path"
+	"sync/atomic"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// The PUBLISHes over its limit a client may send between those
+// logged
+const publishLimitLogEvery = 100
+
+// The most a client may publish: rate PUBLISHes and bytes bytes
+// of their payloads a second, either 0 for no limit. pattern is
+// the client ids it is for, as client-publish-limit gives them.
+type publishLimit struct {
+	pattern string
+	rate    int
+	bytes   int
+}
+
+// The limits on what clients publish: those of
+// client-publish-limit, the first matching a client's id
+// deciding, and for any other client that of
+// client-publish-rate and client-publish-bytes. A client is
+// disconnected once it has sent violations PUBLISHes over its
+// limit, never if 0.
+type publishLimits struct {
+	limits     []publishLimit
+	all        publishLimit
+	violations int
+}
+
+// The limit of the client with id, false if it has none
+func (p publishLimits) of(id string) (publishLimit, bool) {
+	l := p.all
+	for _, pl := range p.limits {
+		if ok, _ := path.Match(pl.pattern, id); ok {
+			l = pl
+			break
+		}
+	}
+	return l, l.rate > 0 || l.bytes > 0
+}
+
+// A client's allowance under its limit, a token bucket of
+// PUBLISHes and one of bytes, each filling at its limit a second
+// and holding a second's worth at most. A PUBLISH larger than a
+// second's worth of bytes is taken when the bucket is full,
+// leaving it in debt.
+type publishBucket struct {
+	limit   publishLimit
+	tokens  float64
+	bytes   float64
+	last    time.Time
+	limited uint64 // PUBLISHes over the limit
+}
+
+func newPublishBucket(l publishLimit, now time.Time) *publishBucket {
+	return &publishBucket{l, float64(l.rate), float64(l.bytes), now, 0}
+}
+
+func (b *publishBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens += elapsed * float64(b.limit.rate)
+	if b.tokens > float64(b.limit.rate) {
+		b.tokens = float64(b.limit.rate)
+	}
+	b.bytes += elapsed * float64(b.limit.bytes)
+	if b.bytes > float64(b.limit.bytes) {
+		b.bytes = float64(b.limit.bytes)
+	}
+	b.last = now
+}
+
+// Take a PUBLISH of n bytes from the allowance, false if it is
+// over the limit
+func (b *publishBucket) take(n int, now time.Time) bool {
+	b.refill(now)
+	if b.limit.rate > 0 && b.tokens < 1 ||
+		b.limit.bytes > 0 && b.bytes < float64(n) && b.bytes < float64(b.limit.bytes) {
+		b.limited++
+		return false
+	}
+	if b.limit.rate > 0 {
+		b.tokens--
+	}
+	b.bytes -= float64(n)
+	return true
+}
+
+// A client's limit and what is left of its allowance, in the
+// admin API's client snapshot
+type publishLimitInfo struct {
+	Rate       int     `json:"rate"`
+	Bytes      int     `json:"bytes"`
+	Tokens     float64 `json:"tokens"`
+	ByteTokens float64 `json:"byte_tokens"`
+	Limited    uint64  `json:"limited"`
+}
+
+func (b publishBucket) info(now time.Time) *publishLimitInfo {
+	b.refill(now)
+	return &publishLimitInfo{b.limit.rate, b.limit.bytes, b.tokens, b.bytes, b.limited}
+}
+
+// Count a PUBLISH of n bytes against the client's limit,
+// returning the PUBLISHes it has sent over it, 0 if this one is
+// within it
+func (c *Client) overPublishLimit(n int, now time.Time) uint64 {
+	defer c.Unlock()
+	c.Lock()
+	if c.publishLimit == nil || c.publishLimit.take(n, now) {
+		return 0
+	}
+	return c.publishLimit.limited
+}
+
+// Refuse a PUBLISH over the client's limit as congestion, for
+// the client to back off, or drop it at QoS 0, and disconnect
+// the client once it has gone over its limit as often as
+// client-publish-violations allows
+func (g *core) overPublishLimit(sc SNClient, m *PublishMessage, limited uint64) {
+	client := sc.base()
+	atomic.AddUint64(&g.publishLimited, 1)
+	if limited%publishLimitLogEvery == 1 {
+		WARN.Log("PUBLISH over the client's rate limit refused", coreLog, logClient(client), logMsgId(m.MessageId), Field{"qos", m.Qos}, Field{"limited", limited}, Field{"logged_every", publishLimitLogEvery})
+	}
+	g.answer(client, m, REJ_CONGESTION)
+	if v := g.publishLimits.violations; v > 0 && limited == uint64(v) {
+		WARN.Log("over its rate limit too often, disconnected", coreLog, logClient(client), Field{"limited", limited})
+		if ioerr := client.Write(NewMessage(DISCONNECT)); ioerr != nil {
+			ERROR.Log(ioerr.Error(), coreLog, logClient(client))
+		}
+		g.backend.kick(sc, true)
+	}
+}
+
+// The number of PUBLISHes refused or dropped for being over
+// their client's rate limit
+func (g *core) PublishLimited() uint64 {
+	return atomic.LoadUint64(&g.publishLimited)
+}
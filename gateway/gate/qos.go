@@ -0,0 +1,57 @@
+package gateway
+
+import (
+	"sort"
+	"strings"
+)
+
+// The QoS the gateways publish to the broker with, given the
+// QoS of the client's PUBLISH (-1 being 3). Unless configured a
+// PUBLISH keeps its QoS, and one at -1 is published at 0. Topics
+// under a configured prefix are published at its QoS whatever
+// the client sent, the longest matching prefix applying.
+//
+// The client's PUBLISH is acknowledged once the broker has it,
+// so the guarantee a client gets is the lower of the two: one
+// published to the broker below the client's QoS may be lost or
+// duplicated after the client was told it was delivered, and
+// one published above it costs the broker more without making
+// the client's own hop any more reliable.
+type qosMap struct {
+	levels   [4]byte
+	prefixes []qosPrefix
+}
+
+type qosPrefix struct {
+	prefix string
+	qos    byte
+}
+
+func newQosMap() *qosMap {
+	return &qosMap{levels: [4]byte{0, 1, 2, 0}}
+}
+
+// Publish topics under prefix at qos, whatever the client sent
+func (q *qosMap) setPrefix(prefix string, qos byte) {
+	for i := range q.prefixes {
+		if q.prefixes[i].prefix == prefix {
+			q.prefixes[i].qos = qos
+			return
+		}
+	}
+	q.prefixes = append(q.prefixes, qosPrefix{prefix, qos})
+	sort.Slice(q.prefixes, func(i, j int) bool {
+		return len(q.prefixes[i].prefix) > len(q.prefixes[j].prefix)
+	})
+}
+
+// The QoS to publish a PUBLISH on topic at qos to the broker
+// with
+func (q *qosMap) upstream(topic string, qos byte) byte {
+	for _, p := range q.prefixes {
+		if strings.HasPrefix(topic, p.prefix) {
+			return p.qos
+		}
+	}
+	return q.levels[qos&0x03]
+}
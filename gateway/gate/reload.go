@@ -0,0 +1,271 @@
+package gateway
+
+import (
+	"reflect"
+	"strings"
+)
+
+// The options a running gateway applies when its configuration
+// is reloaded, each copying its value from the configuration
+// read again into the running one. Changes to any other option
+// are only applied by restarting.
+var reloadable = map[string]func(running, gc *GatewayConfig){
+	"source-rate-limit":           func(r, gc *GatewayConfig) { r.sourcerate = gc.sourcerate },
+	"source-rate-burst":           func(r, gc *GatewayConfig) { r.sourceburst = gc.sourceburst },
+	"source-rate-exempt":          func(r, gc *GatewayConfig) { r.sourceexempt = gc.sourceexempt },
+	"source-rate-addresses":       func(r, gc *GatewayConfig) { r.sourceaddresses = gc.sourceaddresses },
+	"source-allow":                func(r, gc *GatewayConfig) { r.sourceallow = gc.sourceallow },
+	"source-deny":                 func(r, gc *GatewayConfig) { r.sourcedeny = gc.sourcedeny },
+	"source-deny-log":             func(r, gc *GatewayConfig) { r.sourcedenylog = gc.sourcedenylog },
+	"unconnected-packet-rate":     func(r, gc *GatewayConfig) { r.unconnectedrate = gc.unconnectedrate },
+	"unconnected-address-rate":    func(r, gc *GatewayConfig) { r.unconnectedaddrs = gc.unconnectedaddrs },
+	"unknown-disconnect-interval": func(r, gc *GatewayConfig) { r.unknowndisconnect = gc.unknowndisconnect },
+	"advertise-interval":          func(r, gc *GatewayConfig) { r.advertiseinterval = gc.advertiseinterval },
+	"drain-timeout":               func(r, gc *GatewayConfig) { r.draintimeout = gc.draintimeout },
+	"predefined-topic":            func(r, gc *GatewayConfig) { r.predefined = addedPredefined(r.predefined, gc.predefined) },
+	"log-level":                   func(r, gc *GatewayConfig) { r.loglevel = gc.loglevel },
+	"log-format":                  func(r, gc *GatewayConfig) { r.logformat = gc.logformat },
+	"log-destination":             func(r, gc *GatewayConfig) { r.logdestination = gc.logdestination },
+	"log-max-size":                func(r, gc *GatewayConfig) { r.logmaxsize = gc.logmaxsize },
+	"log-max-backups":             func(r, gc *GatewayConfig) { r.logmaxbackups = gc.logmaxbackups },
+	"log-max-age":                 func(r, gc *GatewayConfig) { r.logmaxage = gc.logmaxage },
+	"log-sync":                    func(r, gc *GatewayConfig) { r.logsync = gc.logsync },
+	"log-syslog-address":          func(r, gc *GatewayConfig) { r.logsyslogaddr = gc.logsyslogaddr },
+	"log-syslog-tag":              func(r, gc *GatewayConfig) { r.logsyslogtag = gc.logsyslogtag },
+	"client-allow":                func(r, gc *GatewayConfig) { r.clientallow = gc.clientallow },
+	"client-allow-file":           func(r, gc *GatewayConfig) { r.clientallowfile = gc.clientallowfile },
+	"acl-file":                    func(r, gc *GatewayConfig) { r.aclfile = gc.aclfile },
+	"auth-registry-file":          func(r, gc *GatewayConfig) { r.authregistryfile = gc.authregistryfile },
+	"acl-default":                 func(r, gc *GatewayConfig) { r.acldefaultallow = gc.acldefaultallow },
+}
+
+// The log-* options a change to which has the log opened again
+// where the configuration has it
+var logOutputOptions = map[string]bool{
+	"log-destination":    true,
+	"log-max-size":       true,
+	"log-max-backups":    true,
+	"log-max-age":        true,
+	"log-sync":           true,
+	"log-syslog-address": true,
+	"log-syslog-tag":     true,
+}
+
+// The pre-defined topics of running with those of topics whose
+// ids it does not have; as clients may still use them, an id is
+// only removed or given another topic by restarting
+func addedPredefined(running, topics []predefinedTopic) []predefinedTopic {
+	ids := make(map[uint16]bool)
+	for _, pt := range running {
+		ids[pt.id] = true
+	}
+	added := append([]predefinedTopic{}, running...)
+	for _, pt := range topics {
+		if !ids[pt.id] {
+			added = append(added, pt)
+		}
+	}
+	return added
+}
+
+// The options whose values differ between old and gc, those that
+// can be reloaded and those that need a restart
+func configChanges(old, gc *GatewayConfig) (reload, restart []string) {
+	o, n := reflect.ValueOf(old).Elem(), reflect.ValueOf(gc).Elem()
+	for _, opt := range configOptions {
+		if sameValue(o.FieldByName(opt.field), n.FieldByName(opt.field)) {
+			continue
+		}
+		if reloadable[opt.name] != nil {
+			reload = append(reload, opt.name)
+		} else {
+			restart = append(restart, opt.name)
+		}
+	}
+	return reload, restart
+}
+
+// Whether a and b, of the same type, hold the same value, as
+// reflect.DeepEqual has it, but for values of unexported fields
+func sameValue(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return sameValue(a.Elem(), b.Elem())
+	case reflect.Slice, reflect.Array:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !sameValue(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for _, k := range a.MapKeys() {
+			if v := b.MapIndex(k); !v.IsValid() || !sameValue(a.MapIndex(k), v) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !sameValue(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.String:
+		return a.String() == b.String()
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+	}
+	return false
+}
+
+// Read the files of client-allow-file, acl-file and
+// auth-registry-file, as gc has them, returning what puts them to
+// use; none are unless all can be read
+func (g *core) readFiles(gc *GatewayConfig) (func(), error) {
+	allowed, err := newAllowlist(gc)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := newACL(gc)
+	if err != nil {
+		return nil, err
+	}
+	registry, err := newRegistry(gc)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		g.allowed.Store(allowed)
+		g.acl.Store(acl)
+		g.registry.Store(registry)
+	}, nil
+}
+
+// Read the files of the running configuration again with
+// readFiles, putting them to use if all can be read
+func (g *core) reloadFiles(readFiles func(*GatewayConfig) (func(), error)) error {
+	defer g.reloading.Unlock()
+	g.reloading.Lock()
+	apply, err := readFiles(g.config.Load())
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Apply what can be of gc, the gateway's configuration read
+// again, logging which options changed and which of them need a
+// restart. The files it names are read with readFiles, and the
+// log opened where it has it, before anything is applied;
+// nothing is if any of them cannot be.
+func (g *core) reloadConfig(gc *GatewayConfig, readFiles func(*GatewayConfig) (func(), error)) error {
+	defer g.reloading.Unlock()
+	g.reloading.Lock()
+	old := g.config.Load()
+	if old == nil {
+		old = &GatewayConfig{}
+	}
+	reload, restart := configChanges(old, gc)
+	running := *old
+	for _, name := range reload {
+		reloadable[name](&running, gc)
+	}
+	applyFiles, err := readFiles(&running)
+	if err != nil {
+		return err
+	}
+	// the log is opened last, there being nothing to close should
+	// the files not be read
+	var logOut *logOutput
+	reformat := false
+	for _, name := range reload {
+		reformat = reformat || name == "log-format"
+		if logOutputOptions[name] && logOut == nil {
+			if logOut, err = openLogOutput(&running); err != nil {
+				return err
+			}
+		}
+	}
+
+	applyFiles()
+	for _, name := range reload {
+		if name == "predefined-topic" {
+			g.reloadPredefined(&running, gc)
+		}
+	}
+	g.config.Store(&running)
+	if logOut != nil || reformat {
+		setLogOutput(logOut, &running)
+	}
+	for _, name := range reload {
+		switch {
+		case strings.HasPrefix(name, "source-rate-"):
+			// the sources' allowances start afresh
+			g.sources.Store(newSourceLimiter(&running))
+		case name == "source-allow" || strings.HasPrefix(name, "source-deny"):
+			// the rules' counts start afresh
+			g.filter.Store(newSourceFilter(&running))
+		case strings.HasPrefix(name, "unconnected-") || name == "unknown-disconnect-interval":
+			// as do the budget and its counts
+			g.flood.Store(newFloodGuard(&running))
+		case name == "advertise-interval":
+			g.discovery.setInterval(running.advertiseInterval())
+		case name == "log-level":
+			SetLogLevel(running.logLevel())
+		}
+	}
+	if len(reload) > 0 {
+		INFO.Printf("configuration reloaded, applied %s\n", strings.Join(reload, ", "))
+	} else {
+		INFO.Println("configuration reloaded, nothing to apply")
+	}
+	if len(restart) > 0 {
+		ERROR.Printf("configuration changes to %s not applied until the gateway restarts\n", strings.Join(restart, ", "))
+	}
+	return nil
+}
+
+// Add the pre-defined topics of running the gateway does not
+// have, logging those that cannot be until it restarts: ids
+// already handed out to registered topics, and those removed
+// or given another topic in gc
+func (g *core) reloadPredefined(running, gc *GatewayConfig) {
+	for _, pt := range g.tIndex.addPredefined(running.predefined) {
+		ERROR.Printf("predefined topic id %d already in use, \"%s\" not added until the gateway restarts\n", pt.id, pt.topic)
+		running.predefined = removePredefined(running.predefined, pt)
+	}
+	for _, pt := range running.predefined {
+		if len(removePredefined(gc.predefined, pt)) == len(gc.predefined) {
+			ERROR.Printf("predefined topic id %d (\"%s\") not removed or changed until the gateway restarts\n", pt.id, pt.topic)
+		}
+	}
+}
+
+// topics without pt
+func removePredefined(topics []predefinedTopic, pt predefinedTopic) []predefinedTopic {
+	kept := make([]predefinedTopic, 0, len(topics))
+	for _, t := range topics {
+		if t != pt {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,38 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Bind n UDP sockets to address with SO_REUSEPORT, the kernel
+// spreading clients across them by their address
+func listenReusePort(nw string, address *net.UDPAddr, n int) ([]Transport, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}}
+	addr := address.String()
+	conns := make([]Transport, 0, n)
+	for len(conns) < n {
+		conn, err := lc.ListenPacket(context.Background(), nw, addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		// the port the first was given, if any would do
+		addr = conn.LocalAddr().String()
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
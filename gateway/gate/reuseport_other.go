@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package gateway
+
+import "net"
+
+func listenReusePort(nw string, address *net.UDPAddr, n int) ([]Transport, error) {
+	return nil, ErrNoReusePort
+}
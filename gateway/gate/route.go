@@ -0,0 +1,117 @@
+package gateway
+
+import (
+	"sort"
+	"strings"
+)
+
+// The name routes give the aggregating gateway's own broker
+const defaultUpstream = "default"
+
+// A broker besides the aggregating gateway's own, to which the
+// topics routed to it are published. It is connected to with the
+// settings of the gateway's own, but without its will.
+type upstreamConfig struct {
+	name   string
+	broker string
+}
+
+// Topics beginning with prefix are published to the upstream
+// named
+type routeConfig struct {
+	prefix   string
+	upstream string
+}
+
+// Which broker the aggregating gateway publishes each topic to:
+// that of the longest route prefix the topic begins with, its own
+// if it begins with none. Each broker is connected to, connected
+// again and holds what is published while it is down on its own.
+type routing struct {
+	upstreams []*upstream // besides the gateway's own
+	routes    []route     // the longest prefix first
+}
+
+type route struct {
+	prefix string
+	u      *upstream
+}
+
+// The routing gc configures, own being the gateway's own broker
+// and newClient making the client for each other one
+func newRouting(gc *GatewayConfig, own *upstream, newClient func(u *upstream, broker string) mqttClient) routing {
+	var r routing
+	named := map[string]*upstream{defaultUpstream: own}
+	for _, uc := range gc.upstreams {
+		u := newUpstream(gc)
+		// only the gateway's own broker saves what it holds
+		u.name, u.file = uc.name, ""
+		u.client = newClient(u, uc.broker)
+		r.upstreams = append(r.upstreams, u)
+		named[uc.name] = u
+	}
+	for _, rc := range gc.routes {
+		r.routes = append(r.routes, route{rc.prefix, named[rc.upstream]})
+	}
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return len(r.routes[i].prefix) > len(r.routes[j].prefix)
+	})
+	return r
+}
+
+// Every broker, the gateway's own first
+func (ag *AGateway) upstreams() []*upstream {
+	return append([]*upstream{ag.upstream}, ag.routing.upstreams...)
+}
+
+// The client of u's broker
+func (ag *AGateway) brokerOf(u *upstream) mqttClient {
+	if u.client == nil {
+		return ag.mqttclient
+	}
+	return u.client
+}
+
+// The broker topic is published to
+func (ag *AGateway) upstreamOf(topic string) *upstream {
+	for _, r := range ag.routing.routes {
+		if strings.HasPrefix(topic, r.prefix) {
+			return r.u
+		}
+	}
+	return ag.upstream
+}
+
+// The brokers some topic filter matches is published to, which
+// are subscribed to it. Every topic it matches begins with what
+// precedes its first wildcard, so is published to the broker of
+// that, or to that of a longer route.
+func (ag *AGateway) upstreamsOf(filter string) []*upstream {
+	if ag.sys.local(filter) {
+		// the gateway's own, published to no broker
+		return nil
+	}
+	head := filter
+	if i := strings.IndexAny(filter, "+#"); i >= 0 {
+		head = filter[:i]
+	}
+	us := []*upstream{ag.upstreamOf(head)}
+	if head == filter {
+		return us
+	}
+	for _, r := range ag.routing.routes {
+		if len(r.prefix) > len(head) && strings.HasPrefix(r.prefix, head) && !containsUpstream(us, r.u) {
+			us = append(us, r.u)
+		}
+	}
+	return us
+}
+
+func containsUpstream(us []*upstream, u *upstream) bool {
+	for _, v := range us {
+		if v == u {
+			return true
+		}
+	}
+	return false
+}
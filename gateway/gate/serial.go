@@ -0,0 +1,129 @@
+package gateway
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// The baud rate of a serial port unless configured otherwise
+const defaultSerialBaud = 115200
+
+// How long to wait before reopening a serial device that has
+// gone, a USB adapter having been unplugged
+const serialRetryInterval = time.Second
+
+// The address of a serial device, that of the forwarder its
+// radio bridge is
+type serialAddr string
+
+func (a serialAddr) Network() string { return "serial" }
+func (a serialAddr) String() string  { return string(a) }
+
+// A serial port with a radio bridge attached, which relays the
+// packets of wireless nodes encapsulated. Packets follow each
+// other on the line framed by their length, as on TCP. The
+// device is reopened if it goes away and comes back.
+type serialTransport struct {
+	sync.Mutex
+	device string
+	baud   int
+	retry  time.Duration
+	port   io.ReadWriteCloser
+	r      *bufio.Reader
+	done   chan struct{}
+	once   sync.Once
+}
+
+func openSerialTransport(device string, baud int) (*serialTransport, error) {
+	port, err := openSerial(device, baud)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %v", device, err)
+	}
+	INFO.Printf("listening on serial port %s at %d baud\n", device, baud)
+	return &serialTransport{
+		device: device,
+		baud:   baud,
+		retry:  serialRetryInterval,
+		port:   port,
+		r:      bufio.NewReader(port),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Read the next packet, waiting for the device to come back if
+// it has gone
+func (t *serialTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		t.Lock()
+		port, r := t.port, t.r
+		t.Unlock()
+		if port != nil {
+			frame, err := ReadFrame(r)
+			if err == nil {
+				return copy(b, frame), serialAddr(t.device), nil
+			}
+			select {
+			case <-t.done:
+				return 0, nil, ErrTransportClosed
+			default:
+			}
+			// a bad length loses the framing too, which
+			// reopening the device starts afresh
+			ERROR.Printf("serial port %s failed: %v\n", t.device, err)
+			t.drop(port)
+		}
+		select {
+		case <-t.done:
+			return 0, nil, ErrTransportClosed
+		case <-time.After(t.retry):
+		}
+		if port, err := openSerial(t.device, t.baud); err == nil {
+			INFO.Printf("serial port %s reopened\n", t.device)
+			t.Lock()
+			t.port, t.r = port, bufio.NewReader(port)
+			t.Unlock()
+		}
+	}
+}
+
+func (t *serialTransport) drop(port io.ReadWriteCloser) {
+	defer t.Unlock()
+	t.Lock()
+	if t.port == port {
+		port.Close()
+		t.port, t.r = nil, nil
+	}
+}
+
+// Write a packet, whole, to the line; addr is the device itself
+func (t *serialTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	defer t.Unlock()
+	t.Lock()
+	if t.port == nil {
+		return 0, ErrSerialUnavailable
+	}
+	return t.port.Write(b)
+}
+
+func (t *serialTransport) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+		t.Lock()
+		if t.port != nil {
+			t.port.Close()
+			t.port, t.r = nil, nil
+		}
+		t.Unlock()
+	})
+	return nil
+}
+
+func (t *serialTransport) LocalAddr() net.Addr {
+	return serialAddr(t.device)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package gateway
+
+import "os"
+
+func openSerial(device string, baud int) (*os.File, error) {
+	return nil, ErrNoSerialPorts
+}
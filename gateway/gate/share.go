@@ -0,0 +1,49 @@
+package gateway
+
+import (
+	"strings"
+)
+
+// Shared subscriptions, for aggregating gateways bridging the
+// same filters on one broker: each gateway subscribes as a member
+// of group, and the broker delivers each message to one member
+// rather than to all of them. Only filters beginning with one of
+// prefixes are shared, all of them if there are none; the
+// clients' subscriptions are still kept, and matched, on the
+// unshared filter.
+//
+// A broker sends no retained messages to a new shared
+// subscription, so clients subscribing to a shared filter do not
+// get the last message published on its topics. Filters whose
+// clients rely on that are best left unshared, by listing the
+// prefixes that are to be shared.
+type sharing struct {
+	group    string
+	prefixes []string
+}
+
+// Whether the gateway shares filter. Filters beginning with $
+// are the broker's own, and are never shared.
+func (s *sharing) shares(filter string) bool {
+	if s == nil || strings.HasPrefix(filter, "$") {
+		return false
+	}
+	for _, p := range s.prefixes {
+		if strings.HasPrefix(filter, p) {
+			return true
+		}
+	}
+	return len(s.prefixes) == 0
+}
+
+// The filter a shared subscription's messages match, filter
+// itself if it is not shared
+func unshared(filter string) string {
+	if !strings.HasPrefix(filter, "$share/") {
+		return filter
+	}
+	if i := strings.Index(filter[len("$share/"):], "/"); i >= 0 {
+		return filter[len("$share/")+i+1:]
+	}
+	return filter
+}
@@ -1,5 +1,9 @@
 package gateway
 
+import (
+	. "github.com/alsm/gnatt/packets"
+)
+
 func validateClientId(clientid []byte) (string, error) {
 	if len(clientid) == 0 {
 		ERROR.Println("zero length client id not allowed")
@@ -11,3 +15,39 @@ func validateClientId(clientid []byte) (string, error) {
 	}
 	return string(clientid), nil
 }
+
+func validateConnect(m *ConnectMessage) (string, error) {
+	if m.ProtocolId != 0x01 {
+		ERROR.Printf("unsupported protocol id %d\n", m.ProtocolId)
+		return "", ErrUnsupportedProtocolId
+	}
+	return validateClientId(m.ClientId)
+}
+
+// The CONNACK return code for a CONNECT refused because of err.
+// Limits that may clear later are reported as congestion so
+// the client retries, anything else the gateway will never
+// accept is reported as not supported.
+func connackCode(err error) byte {
+	if rc, ok := err.(authRefused); ok {
+		return byte(rc)
+	}
+	switch err {
+	case ErrTooManyClients, ErrDraining, ErrBrokerOffline, ErrAuthenticator:
+		return REJ_CONGESTION
+	default:
+		return REJ_NOT_SUPORTED
+	}
+}
+
+// Send a CONNACK with return code rc to r. This does not need
+// a Client so it can be used to refuse a CONNECT.
+func sendConnack(c uConn, r uAddr, rc byte) {
+	ca := NewMessage(CONNACK).(*ConnackMessage)
+	ca.ReturnCode = rc
+	if err := c.WriteTo(ca, r); err != nil {
+		ERROR.Println(err)
+	} else {
+		DEBUG.Printf("CONNACK (rc %d) was sent to %s\n", rc, r)
+	}
+}
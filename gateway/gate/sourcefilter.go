@@ -0,0 +1,174 @@
+package gateway
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+)
+
+// Which source addresses packets are taken from, before they are
+// even decoded: none in a network of source-deny, and if
+// source-allow is given only those in one of its networks,
+// IPv4 and IPv6 alike. A packet from any other is dropped
+// without a word, but one in every logEvery is logged if
+// source-deny-log asks for it. Each rule counts the packets it
+// matched.
+type sourceFilter struct {
+	allow    prefixTable
+	deny     prefixTable
+	logEvery uint64
+	refused  uint64 // from addresses no allow rule matched
+	dropped  uint64
+}
+
+// A network of source-allow or source-deny, and the packets it
+// has matched
+type sourceRule struct {
+	network *net.IPNet
+	hits    uint64
+}
+
+// Networks by the length of their prefixes, longest first, each
+// length's keyed by the address masked to it, so that an
+// address is looked up once for each length rather than against
+// every network
+type prefixTable []prefixLength
+
+type prefixLength struct {
+	mask  net.IPMask
+	rules map[string]*sourceRule
+}
+
+// The filter gc configures, nil unless it gives source-allow or
+// source-deny
+func newSourceFilter(gc *GatewayConfig) *sourceFilter {
+	if len(gc.sourceallow) == 0 && len(gc.sourcedeny) == 0 {
+		return nil
+	}
+	return &sourceFilter{
+		allow:    newPrefixTable(gc.sourceallow),
+		deny:     newPrefixTable(gc.sourcedeny),
+		logEvery: uint64(gc.sourcedenylog),
+	}
+}
+
+func newPrefixTable(networks []*net.IPNet) prefixTable {
+	var t prefixTable
+	for _, n := range networks {
+		ip, mask := n.IP.Mask(n.Mask), n.Mask
+		if ip4 := ip.To4(); ip4 != nil && len(mask) == net.IPv6len {
+			ip, mask = ip4, mask[12:]
+		}
+		i := sort.Search(len(t), func(i int) bool {
+			return !longerPrefix(t[i].mask, mask)
+		})
+		if i == len(t) || t[i].mask.String() != mask.String() {
+			t = append(t, prefixLength{})
+			copy(t[i+1:], t[i:])
+			t[i] = prefixLength{mask, make(map[string]*sourceRule)}
+		}
+		if t[i].rules[string(ip)] == nil {
+			t[i].rules[string(ip)] = &sourceRule{network: &net.IPNet{IP: ip, Mask: mask}}
+		}
+	}
+	return t
+}
+
+// Whether a sorts before b: IPv4 before IPv6, then the longer
+// prefix first
+func longerPrefix(a, b net.IPMask) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	ai, _ := a.Size()
+	bi, _ := b.Size()
+	return ai > bi
+}
+
+// The rule of the longest prefix matching ip, nil if none does
+func (t prefixTable) match(ip net.IP) *sourceRule {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, l := range t {
+		if len(l.mask) != len(ip) {
+			continue
+		}
+		if r := l.rules[string(ip.Mask(l.mask))]; r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// Whether a packet from a may be handled: deny wins over allow.
+// An address without an IP, such as a serial port's, is not
+// filtered.
+func (f *sourceFilter) allows(a uAddr) bool {
+	ip := a.ip()
+	if ip == nil {
+		return true
+	}
+	if r := f.deny.match(ip); r != nil {
+		atomic.AddUint64(&r.hits, 1)
+		f.drop(a, "denied by "+r.network.String())
+		return false
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	if r := f.allow.match(ip); r != nil {
+		atomic.AddUint64(&r.hits, 1)
+		return true
+	}
+	atomic.AddUint64(&f.refused, 1)
+	f.drop(a, "not allowed")
+	return false
+}
+
+func (f *sourceFilter) drop(a uAddr, why string) {
+	n := atomic.AddUint64(&f.dropped, 1)
+	if f.logEvery > 0 && (n-1)%f.logEvery == 0 {
+		WARN.Log("source "+why+", packet dropped", coreLog, logRemote(a), Field{"dropped", n}, Field{"logged_every", f.logEvery})
+	}
+}
+
+// The packets a rule has matched; rule not-allowed, of no
+// network, counts those no allow rule matched
+type sourceRuleHits struct {
+	Rule    string `json:"rule"`
+	Network string `json:"network"`
+	Hits    uint64 `json:"hits"`
+}
+
+// The packets each rule has matched, the deny rules' first
+func (f *sourceFilter) hits() []sourceRuleHits {
+	hits := []sourceRuleHits{}
+	for _, t := range []struct {
+		rule  string
+		table prefixTable
+	}{{"deny", f.deny}, {"allow", f.allow}} {
+		var rules []sourceRuleHits
+		for _, l := range t.table {
+			for _, r := range l.rules {
+				rules = append(rules, sourceRuleHits{t.rule, r.network.String(), atomic.LoadUint64(&r.hits)})
+			}
+		}
+		sort.Slice(rules, func(i, j int) bool {
+			return rules[i].Network < rules[j].Network
+		})
+		hits = append(hits, rules...)
+	}
+	if len(f.allow) > 0 {
+		hits = append(hits, sourceRuleHits{"not-allowed", "", atomic.LoadUint64(&f.refused)})
+	}
+	return hits
+}
+
+// The packets dropped for their source address
+func (f *sourceFilter) droppedCount() uint64 {
+	if f == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&f.dropped)
+}
@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// Source addresses tracked at once unless configured
+const defaultSourceLimitAddresses = 10000
+
+// Limits the packets each source address may send before they
+// are even decoded: rate a second on average, in bursts of up
+// to burst. Only the max addresses heard from most recently are
+// tracked, the one heard from longest ago being forgotten to
+// make room. Addresses in exempt are not limited.
+type sourceLimiter struct {
+	sync.Mutex
+	rate     float64
+	burst    float64
+	max      int
+	exempt   []*net.IPNet
+	sources  map[string]*list.Element
+	recent   *list.List // of *source, most recent first
+	failures *failureLog
+}
+
+type source struct {
+	addr    string
+	tokens  float64
+	last    time.Time
+	dropped uint64
+}
+
+// The limiter gc configures, nil unless it sets a rate
+func newSourceLimiter(gc *GatewayConfig) *sourceLimiter {
+	if gc.sourcerate <= 0 {
+		return nil
+	}
+	s := &sourceLimiter{
+		rate:     float64(gc.sourcerate),
+		burst:    float64(gc.sourcerate),
+		max:      defaultSourceLimitAddresses,
+		exempt:   gc.sourceexempt,
+		sources:  make(map[string]*list.Element),
+		recent:   list.New(),
+		failures: newFailureLog(),
+	}
+	if gc.sourceburst > 0 {
+		s.burst = float64(gc.sourceburst)
+	}
+	if gc.sourceaddresses > 0 {
+		s.max = gc.sourceaddresses
+	}
+	return s
+}
+
+// Whether a packet from a may be handled, counting it against
+// a's allowance
+func (s *sourceLimiter) allow(a uAddr, now time.Time) bool {
+	if s.exempted(a) {
+		return true
+	}
+	key := a.String()
+	s.Lock()
+	e := s.sources[key]
+	if e == nil {
+		if s.recent.Len() >= s.max {
+			oldest := s.recent.Back()
+			s.recent.Remove(oldest)
+			delete(s.sources, oldest.Value.(*source).addr)
+		}
+		e = s.recent.PushFront(&source{key, s.burst, now, 0})
+		s.sources[key] = e
+	} else {
+		s.recent.MoveToFront(e)
+	}
+	src := e.Value.(*source)
+	src.tokens += now.Sub(src.last).Seconds() * s.rate
+	if src.tokens > s.burst {
+		src.tokens = s.burst
+	}
+	src.last = now
+	if src.tokens >= 1 {
+		src.tokens--
+		s.Unlock()
+		return true
+	}
+	src.dropped++
+	dropped := src.dropped
+	s.Unlock()
+	s.failures.log(now, "rate limit exceeded by %v, %d packets dropped\n", a, dropped)
+	return false
+}
+
+func (s *sourceLimiter) exempted(a uAddr) bool {
+	ip := a.ip()
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.exempt {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The packets dropped from each address tracked that has had
+// any dropped
+func (s *sourceLimiter) dropped() map[string]uint64 {
+	defer s.Unlock()
+	s.Lock()
+	dropped := make(map[string]uint64)
+	for e := s.recent.Front(); e != nil; e = e.Next() {
+		if src := e.Value.(*source); src.dropped > 0 {
+			dropped[src.addr] = src.dropped
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,32 @@
+package gateway
+
+// The availability of the aggregating gateway, published
+// retained on topic: online once it is connected to the broker,
+// again after each reconnect, and offline when it stops. Should
+// its connection be lost, the broker publishes offline for it,
+// as its will.
+type status struct {
+	topic   string
+	online  string
+	offline string
+	qos     byte
+}
+
+// Publish the gateway's availability, if configured, waiting
+// for the broker to have it
+func (ag *AGateway) announce(online bool) {
+	st := ag.status
+	if st == nil {
+		return
+	}
+	payload := st.offline
+	if online {
+		payload = st.online
+	}
+	token := ag.mqttclient.Publish(st.topic, st.qos, true, []byte(payload))
+	if !token.WaitTimeout(brokerTimeout) {
+		ERROR.Printf("could not publish \"%s\" on \"%s\": %v\n", payload, st.topic, ErrBrokerTimeout)
+	} else if token.Error() != nil {
+		ERROR.Printf("could not publish \"%s\" on \"%s\": %v\n", payload, st.topic, token.Error())
+	}
+}
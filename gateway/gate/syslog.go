@@ -0,0 +1,172 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package gateway
+
+import (
+	"io"
+	"log/syslog"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const syslogSupported = true
+
+// The severity each level, as logLevels has them, is logged at
+var syslogSeverities = [4]syslog.Priority{syslog.LOG_ERR, syslog.LOG_WARNING, syslog.LOG_INFO, syslog.LOG_DEBUG}
+
+// Lines held while syslog cannot be written to, beyond which
+// they are dropped, and how long one is tried for
+const (
+	syslogBuffer = 256
+	syslogHold   = 5 * time.Second
+)
+
+// How long to wait before trying to write a line again
+var syslogRetry = 100 * time.Millisecond
+
+// Writers logging each level to syslog, the local daemon or the
+// one at address, udp:// or tcp://, tagged as tag, and what
+// closes the connection to it. Only the local daemon not being
+// there is an error: a remote one is connected to again until
+// it answers.
+func openSyslog(address, tag string) ([4]io.Writer, io.Closer, error) {
+	s := &syslogSink{
+		tag:   tag,
+		lines: make(chan syslogLine, syslogBuffer),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if address != "" {
+		u, err := url.Parse(address)
+		if err != nil {
+			return [4]io.Writer{}, nil, ErrInvalidSyslogAddress
+		}
+		s.network, s.address = u.Scheme, u.Host
+	}
+	if err := s.dial(); err != nil && address == "" {
+		return [4]io.Writer{}, nil, err
+	}
+	go s.run()
+	var writers [4]io.Writer
+	for i, severity := range syslogSeverities {
+		writers[i] = syslogWriter{s, severity}
+	}
+	return writers, s, nil
+}
+
+// A line to be written to syslog, and when it was logged
+type syslogLine struct {
+	severity syslog.Priority
+	text     string
+	at       time.Time
+}
+
+// Writes lines to syslog from a buffer, so that logging never
+// waits on it. A line that cannot be written is tried again
+// until it has been held for syslogHold, while those after it
+// wait in the buffer; once that is full they are dropped, and
+// counted.
+type syslogSink struct {
+	network, address, tag string
+
+	w     *syslog.Writer
+	lines chan syslogLine
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// Called before run starts, and then from it alone.
+func (s *syslogSink) dial() error {
+	w, err := syslog.Dial(s.network, s.address, syslog.LOG_DAEMON|syslog.LOG_INFO, s.tag)
+	if err != nil {
+		return err
+	}
+	s.w = w
+	return nil
+}
+
+func (s *syslogSink) run() {
+	defer close(s.done)
+	for {
+		select {
+		case l := <-s.lines:
+			s.deliver(l)
+		case <-s.stop:
+			// what is left is tried once
+			for {
+				select {
+				case l := <-s.lines:
+					if s.write(l) != nil {
+						atomic.AddUint64(&logDropped, 1)
+					}
+				default:
+					if s.w != nil {
+						s.w.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *syslogSink) deliver(l syslogLine) {
+	for s.write(l) != nil {
+		if time.Since(l.at) >= syslogHold {
+			atomic.AddUint64(&logDropped, 1)
+			return
+		}
+		select {
+		case <-s.stop:
+			atomic.AddUint64(&logDropped, 1)
+			return
+		case <-time.After(syslogRetry):
+		}
+	}
+}
+
+// Write a line at its severity, connecting first if need be;
+// once connected, syslog.Writer connects again itself when a
+// write fails
+func (s *syslogSink) write(l syslogLine) error {
+	if s.w == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	switch l.severity {
+	case syslog.LOG_ERR:
+		return s.w.Err(l.text)
+	case syslog.LOG_WARNING:
+		return s.w.Warning(l.text)
+	case syslog.LOG_DEBUG:
+		return s.w.Debug(l.text)
+	default:
+		return s.w.Info(l.text)
+	}
+}
+
+// Stop writing, once what is buffered has been tried once more
+func (s *syslogSink) Close() error {
+	close(s.stop)
+	<-s.done
+	return nil
+}
+
+// Writes each line to syslog at one severity, or drops it if
+// the buffer is full
+type syslogWriter struct {
+	s        *syslogSink
+	severity syslog.Priority
+}
+
+func (w syslogWriter) Write(p []byte) (int, error) {
+	select {
+	case w.s.lines <- syslogLine{w.severity, string(p), time.Now()}:
+	default:
+		atomic.AddUint64(&logDropped, 1)
+	}
+	return len(p), nil
+}
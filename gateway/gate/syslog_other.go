@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package gateway
+
+import "io"
+
+// log/syslog has no Windows or Plan 9 implementation
+const syslogSupported = false
+
+func openSyslog(address, tag string) ([4]io.Writer, io.Closer, error) {
+	return [4]io.Writer{}, nil, ErrNoSyslog
+}
@@ -0,0 +1,126 @@
+package gateway
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Where the gateway publishes its own statistics unless
+// configured otherwise
+const defaultSysPrefix = "$SYS/gateway"
+
+// The gateway's statistics, published every interval to the
+// clients subscribed to the topics under prefix, as the broker's
+// messages are, and never to the broker: the subscriptions to
+// those topics are the gateway's alone. Off if interval is 0.
+type sysTopics struct {
+	prefix   string
+	interval time.Duration
+	stats    func() map[string]string
+	publish  func(MQTT.Message) int
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newSysTopics(gc *GatewayConfig) *sysTopics {
+	return &sysTopics{prefix: gc.sysPrefix(), interval: gc.sysinterval}
+}
+
+// Whether filter is within the gateway's own topics, so is not
+// subscribed to on the broker
+func (s *sysTopics) local(filter string) bool {
+	if s == nil || s.interval == 0 {
+		return false
+	}
+	return filter == s.prefix || strings.HasPrefix(filter, s.prefix+"/")
+}
+
+// Publish what stats gives with publish every interval, each
+// value to its topic under the prefix
+func (s *sysTopics) start(stats func() map[string]string, publish func(MQTT.Message) int) {
+	if s.interval == 0 {
+		return
+	}
+	s.stats, s.publish = stats, publish
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go s.run()
+}
+
+func (s *sysTopics) stop() {
+	if s.done == nil {
+		return
+	}
+	close(s.done)
+	s.wg.Wait()
+	s.done = nil
+}
+
+func (s *sysTopics) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			for topic, value := range s.stats() {
+				s.publish(injectedMessage{s.prefix + "/" + topic, []byte(value), 0, false})
+			}
+		}
+	}
+}
+
+// The statistics both gateways have: how long the gateway has
+// been up, in seconds, how many clients it has, and how many
+// packets it received and sent a second since the last time
+func (g *core) sysStats(listeners func() []ListenerStats) func() map[string]string {
+	started := time.Now()
+	last := started
+	var lastIn, lastOut uint64
+	return func() map[string]string {
+		now := time.Now()
+		var in, out uint64
+		for _, s := range listeners() {
+			in += s.PacketsIn
+			out += s.PacketsOut
+		}
+		elapsed := now.Sub(last).Seconds()
+		stats := map[string]string{
+			"uptime":                       strconv.FormatInt(int64(now.Sub(started)/time.Second), 10),
+			"clients":                      strconv.Itoa(g.clients.Len()),
+			"messages/received/per-second": strconv.FormatFloat(float64(in-lastIn)/elapsed, 'f', 1, 64),
+			"messages/sent/per-second":     strconv.FormatFloat(float64(out-lastOut)/elapsed, 'f', 1, 64),
+		}
+		last, lastIn, lastOut = now, in, out
+		return stats
+	}
+}
+
+// The aggregating gateway's statistics, with the state of its
+// connection to the broker and whether any broker is offline
+func (ag *AGateway) sysStats() func() map[string]string {
+	stats := ag.core.sysStats(ag.Listeners)
+	return func() map[string]string {
+		m := stats()
+		m["broker"] = ag.BrokerState().State
+		m["broker/degraded"] = strconv.FormatBool(ag.Degraded())
+		return m
+	}
+}
+
+// The transparent gateway's statistics, with its connections to
+// the broker
+func (t *TGateway) sysStats() func() map[string]string {
+	stats := t.core.sysStats(t.Listeners)
+	return func() map[string]string {
+		m := stats()
+		m["broker/connections"] = strconv.Itoa(t.BrokerConnections())
+		return m
+	}
+}
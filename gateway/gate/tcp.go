@@ -0,0 +1,158 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// A client's own TCP connection, which replies to it are
+// written to
+type tcpConn struct {
+	net.Conn
+}
+
+func (c tcpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+// The TCP network to listen on addr with, as network
+func tcpNetwork(addr string) string {
+	return "tcp" + network(addr)[len("udp"):]
+}
+
+// A TCP socket feeding packets to a Gateway, each client having
+// a connection of its own and framing its packets by their
+// length
+type tcpListener struct {
+	ln       net.Listener
+	idle     time.Duration
+	size     int
+	counters *listenerCounters
+	conns    *connTable
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Listen for TCP clients on addr, closing their connections if
+// nothing is heard on them for idle, for packets of up to size
+// bytes. Connections are kept in conns, and refused when it is
+// full.
+func listenTCP(addr string, idle time.Duration, conns *connTable, size int, g Gateway) (*tcpListener, error) {
+	ln, err := inheritedTCP(addr)
+	if err != nil {
+		return nil, err
+	} else if ln != nil {
+		INFO.Printf("listening for TCP on %s, passed by systemd\n", ln.Addr())
+	} else if ln, err = net.Listen(tcpNetwork(addr), addr); err != nil {
+		return nil, fmt.Errorf("cannot listen on %s: %v", addr, err)
+	} else {
+		INFO.Printf("listening for TCP on %s\n", ln.Addr())
+	}
+	l := &tcpListener{
+		ln:       ln,
+		idle:     idle,
+		size:     size,
+		counters: newListenerCounters("tcp", ln.Addr()),
+		conns:    conns,
+		done:     make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go l.serve(g)
+	return l, nil
+}
+
+func (l *tcpListener) stats() *listenerCounters {
+	return l.counters
+}
+
+func (l *tcpListener) addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *tcpListener) serve(g Gateway) {
+	defer l.wg.Done()
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+				ERROR.Println(err)
+				continue
+			}
+		}
+		if !l.conns.add(conn, l.counters) {
+			ERROR.Printf("refusing TCP connection from %v, too many open\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		l.wg.Add(1)
+		go l.connection(conn, g)
+	}
+}
+
+// Feed the client's packets to g, one at a time and in order,
+// until the connection closes or goes idle, whether or not the
+// client has connected, when the client is lost unless the
+// gateway is stopping and ends its session itself
+func (l *tcpListener) connection(conn net.Conn, g Gateway) {
+	defer l.wg.Done()
+	defer l.conns.remove(conn)
+	defer conn.Close()
+	addr := uAddr{conn.RemoteAddr()}
+	INFO.Printf("TCP connection from %v\n", addr)
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(l.idle))
+		frame, err := ReadFrame(r)
+		if err != nil {
+			if l.conns.timedOut(err) {
+				INFO.Printf("TCP connection from %v idle for %v\n", addr, l.idle)
+			}
+			INFO.Printf("TCP connection from %v closed: %v\n", addr, err)
+			select {
+			case <-l.done:
+			default:
+				g.closed(addr)
+			}
+			return
+		}
+		l.counters.received(len(frame))
+		if !g.admit(addr) {
+			continue
+		}
+		if len(frame) > l.size {
+			// read whole, so the next packet is still found
+			g.oversized(addr, l.size)
+			continue
+		}
+		g.OnPacket(len(frame), frame, uConn{tcpConn{conn}, l.size, l.counters}, addr)
+	}
+}
+
+// Close the socket and every connection, and wait until every
+// packet already read has been handled, or until ctx is done
+func (l *tcpListener) stop(ctx context.Context) error {
+	close(l.done)
+	l.ln.Close()
+	l.conns.close(l.counters)
+	finished := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -60,14 +60,56 @@ func ValidateTopicName(topic string) ([]string, error) {
 	return levels, nil
 }
 
+// Return true if topic (a TopicName) is matched by filter (a
+// TopicFilter). Both are assumed to be valid. A topic beginning
+// with $ is not matched by a filter beginning with a wildcard.
+func TopicMatches(filter, topic string) bool {
+	flevels := strings.Split(filter, "/")
+	tlevels := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (flevels[0] == "#" || flevels[0] == "+") {
+		return false
+	}
+	for i, level := range flevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(tlevels) {
+			return false
+		}
+		if level != "+" && level != tlevels[i] {
+			return false
+		}
+	}
+	return len(flevels) == len(tlevels)
+}
+
+// The types of topic id in a PUBLISH, SUBSCRIBE or UNSUBSCRIBE
+const (
+	topicIdNormal     byte = 0x00
+	topicIdPredefined byte = 0x01
+	topicIdShort      byte = 0x02
+)
+
+// A topic configured with its id, which clients use without
+// registering it
+type predefinedTopic struct {
+	id    uint16
+	topic string
+}
+
 // This needs to be efficient for indexing by topicId.
 // However, it is necessary when adding a new topic to index
 // by topic name (to check if it already exists). We optimze
 // for the former case.
+// The pre-defined topics, configured by id, are kept apart and
+// their ids never handed out by putTopic, which hands out no
+// more than max (no limit if 0) or the ids there are.
 type topicNames struct {
 	sync.RWMutex
-	contents map[uint16]string
-	next     uint16
+	contents   map[uint16]string
+	predefined map[uint16]string
+	next       uint16
+	max        int
 }
 
 // O(n)
@@ -91,7 +133,7 @@ func (repo *topicNames) getId(topic string) uint16 {
 			break
 		}
 	}
-	INFO.Printf("get[%s] -> %d\n", topic, topicid)
+	DEBUG.Printf("get[%s] -> %d\n", topic, topicid)
 	return topicid
 }
 
@@ -100,16 +142,107 @@ func (repo *topicNames) getTopic(id uint16) string {
 	defer repo.RUnlock()
 	repo.RLock()
 	topic := repo.contents[id]
-	INFO.Printf("getTopic[%d] -> %s\n", id, topic)
+	DEBUG.Printf("getTopic[%d] -> %s\n", id, topic)
 	return topic
 }
 
-// O(1)
+// O(1) until the ids wrap around. 0 if no more topics can be
+// registered.
 func (repo *topicNames) putTopic(topic string) uint16 {
 	defer repo.Unlock()
 	repo.Lock()
-	repo.next++
+	if repo.max > 0 && len(repo.contents) >= repo.max || len(repo.contents)+len(repo.predefined) >= 0xFFFF {
+		ERROR.Printf("%d topics registered, \"%s\" cannot be\n", len(repo.contents), topic)
+		return 0
+	}
+	for {
+		repo.next++
+		if _, ok := repo.predefined[repo.next]; ok || repo.next == 0 {
+			continue
+		}
+		if _, ok := repo.contents[repo.next]; !ok {
+			break
+		}
+	}
 	repo.contents[repo.next] = topic
-	INFO.Printf("put[%d] -> %s\n", repo.next, topic)
+	DEBUG.Printf("put[%d] -> %s\n", repo.next, topic)
 	return repo.next
 }
+
+// The number of topics registered
+func (repo *topicNames) len() int {
+	defer repo.RUnlock()
+	repo.RLock()
+	return len(repo.contents)
+}
+
+// The topics registered, and those pre-defined, by id
+func (repo *topicNames) snapshot() (contents, predefined map[uint16]string) {
+	defer repo.RUnlock()
+	repo.RLock()
+	contents = make(map[uint16]string, len(repo.contents))
+	for id, topic := range repo.contents {
+		contents[id] = topic
+	}
+	predefined = make(map[uint16]string, len(repo.predefined))
+	for id, topic := range repo.predefined {
+		predefined[id] = topic
+	}
+	return contents, predefined
+}
+
+// The pre-defined topic with id, "" if there is none. It may be
+// a TopicFilter, which a client can only subscribe to.
+func (repo *topicNames) getPredefined(id uint16) string {
+	defer repo.RUnlock()
+	repo.RLock()
+	return repo.predefined[id]
+}
+
+// The id of the pre-defined topic, 0 if it is not one. O(n)
+func (repo *topicNames) getPredefinedId(topic string) uint16 {
+	defer repo.RUnlock()
+	repo.RLock()
+	for id, topicVal := range repo.predefined {
+		if topicVal == topic {
+			return id
+		}
+	}
+	return 0
+}
+
+// The id a PUBLISH on topic is sent to a client with, and its
+// type: the pre-defined id if topic has one, otherwise its id,
+// given it if it has none, 0 if it cannot be
+func (repo *topicNames) publishId(topic string) (uint16, byte) {
+	if id := repo.getPredefinedId(topic); id != 0 {
+		return id, topicIdPredefined
+	}
+	id := repo.getId(topic)
+	if id == 0 {
+		// matched by a wildcard subscription, not seen before
+		id = repo.putTopic(topic)
+	}
+	return id, topicIdNormal
+}
+
+// Add the pre-defined topics not already there, returning those
+// whose ids have been handed out by putTopic and so cannot be
+// added until the gateway restarts
+func (repo *topicNames) addPredefined(topics []predefinedTopic) []predefinedTopic {
+	defer repo.Unlock()
+	repo.Lock()
+	var taken []predefinedTopic
+	for _, pt := range topics {
+		if _, ok := repo.predefined[pt.id]; ok {
+			continue
+		}
+		if _, ok := repo.contents[pt.id]; ok {
+			taken = append(taken, pt)
+			continue
+		}
+		repo.predefined[pt.id] = pt.topic
+		INFO.Printf("predefined[%d] -> %s\n", pt.id, pt.topic)
+	}
+	return taken
+}
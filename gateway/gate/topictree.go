@@ -1,6 +1,8 @@
 package gateway
 
 import (
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -50,7 +52,7 @@ func NewTopicTree() *TopicTree {
 func (tt *TopicTree) AddSubscription(client *Client, topic string) (bool, error) {
 	defer tt.Unlock()
 	tt.Lock()
-	INFO.Printf("AddSubscription(\"%s\", \"%s\")\n", client.ClientId, topic)
+	DEBUG.Printf("AddSubscription(\"%s\", \"%s\")\n", client.ClientId, topic)
 	if levels, e := ValidateTopicFilter(topic); e != nil {
 		return false, e
 	} else {
@@ -88,7 +90,7 @@ func (tt *TopicTree) RemoveSubscription(s *Client, topic string) error {
 				// inexpensive way of removing from a slice
 				n.clients[i] = n.clients[len(n.clients)-1]
 				n.clients = n.clients[0 : len(n.clients)-1]
-				INFO.Printf("deleted subscription of client \"%s\"\n", s.ClientId)
+				DEBUG.Printf("deleted subscription of client \"%s\"\n", s.ClientId)
 				return nil
 			}
 		}
@@ -109,6 +111,16 @@ func (tt *TopicTree) SubscribersOf(topic string) ([]*Client, error) {
 	n := tt.root
 	if levels, e := ValidateTopicName(topic); e != nil {
 		return nil, e
+	} else if strings.HasPrefix(topic, "$") {
+		// filters beginning with a wildcard do not match the
+		// broker's own topics
+		if n = n.children[levels[0]]; n == nil {
+			return clients, nil
+		} else if len(levels) == 1 {
+			return append(clients, n.clients...), nil
+		}
+		subscribers(n, levels[1:], &clients)
+		return clients, nil
 	} else {
 		subscribers(n, levels, &clients)
 		return clients, nil
@@ -140,3 +152,44 @@ func subscribers(n *node, levels []string, clients *[]*Client) {
 		}
 	}
 }
+
+// The filters with at least one subscriber, in order
+func (tt *TopicTree) Filters() []string {
+	defer tt.RUnlock()
+	tt.RLock()
+	var fs []string
+	filters(tt.root, nil, &fs)
+	sort.Strings(fs)
+	return fs
+}
+
+// Call f for each filter with at least one subscriber, in
+// order, with its subscribers. f is called on a snapshot, so
+// the tree is not held while it runs.
+func (tt *TopicTree) Walk(f func(filter string, clients []*Client)) {
+	tt.RLock()
+	var fs []string
+	filters(tt.root, nil, &fs)
+	sort.Strings(fs)
+	subscribers := make([][]*Client, len(fs))
+	for i, filter := range fs {
+		n := tt.root
+		for _, level := range strings.Split(filter, "/") {
+			n = n.children[level]
+		}
+		subscribers[i] = append([]*Client(nil), n.clients...)
+	}
+	tt.RUnlock()
+	for i, filter := range fs {
+		f(filter, subscribers[i])
+	}
+}
+
+func filters(n *node, levels []string, fs *[]string) {
+	if len(n.clients) > 0 && len(levels) > 0 {
+		*fs = append(*fs, strings.Join(levels, "/"))
+	}
+	for level, child := range n.children {
+		filters(child, append(levels[:len(levels):len(levels)], level), fs)
+	}
+}
@@ -0,0 +1,217 @@
+package gateway
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// How long a client is traced unless configured or asked
+const defaultTraceDuration = time.Hour
+
+// What the lines of a client traced are tagged with, to be
+// grepped for: trace=true
+var traceTag = Field{"trace", true}
+
+var traceLog = logComponent("trace")
+
+// The clients traced: every packet they send and are sent, and
+// every line logged of them, is logged at INFO whatever the
+// log-level, tagged with traceTag. A client is traced by its id,
+// from whichever address it comes and however often it
+// reconnects, until its trace expires; the address it was last
+// seen at is kept for the lines naming it by address alone.
+// Set with log-trace-clients or by the admin API; like the
+// loggers it is the process's.
+type traceSet struct {
+	count int32 // of ids, 0 letting lines be logged without a look
+	sync.Mutex
+	until map[string]*traceEntry
+	addrs map[string]string // the id of the client at each address
+}
+
+type traceEntry struct {
+	until time.Time
+	timer *time.Timer
+	addr  string
+}
+
+var traces = &traceSet{until: make(map[string]*traceEntry), addrs: make(map[string]string)}
+
+// A client traced, and until when
+type traceInfo struct {
+	Client string    `json:"client"`
+	Until  time.Time `json:"until"`
+}
+
+// Whether any client is traced
+func (s *traceSet) active() bool {
+	return atomic.LoadInt32(&s.count) > 0
+}
+
+// Trace the client with id for d, from now, however long it was
+// traced for before; returns when it stops
+func (s *traceSet) set(id string, d time.Duration) time.Time {
+	if d <= 0 {
+		d = defaultTraceDuration
+	}
+	defer s.Unlock()
+	s.Lock()
+	e := &traceEntry{until: time.Now().Add(d)}
+	if old := s.until[id]; old == nil {
+		atomic.AddInt32(&s.count, 1)
+	} else {
+		old.timer.Stop()
+		e.addr = old.addr
+	}
+	s.until[id] = e
+	e.timer = time.AfterFunc(d, func() {
+		if s.expire(id, e) {
+			INFO.output("trace expired", []Field{traceLog, logClientId(id)})
+		}
+	})
+	return e.until
+}
+
+// Stop tracing the client with id, returning whether it was
+func (s *traceSet) clear(id string) bool {
+	defer s.Unlock()
+	s.Lock()
+	e := s.until[id]
+	if e == nil {
+		return false
+	}
+	e.timer.Stop()
+	s.remove(id, e)
+	return true
+}
+
+// Stop tracing every client
+func (s *traceSet) reset() {
+	defer s.Unlock()
+	s.Lock()
+	for id, e := range s.until {
+		e.timer.Stop()
+		s.remove(id, e)
+	}
+}
+
+// Stop tracing the client with id if e is still its trace,
+// returning whether it was
+func (s *traceSet) expire(id string, e *traceEntry) bool {
+	defer s.Unlock()
+	s.Lock()
+	if s.until[id] != e {
+		return false
+	}
+	s.remove(id, e)
+	return true
+}
+
+// Must be called with the lock held.
+func (s *traceSet) remove(id string, e *traceEntry) {
+	delete(s.until, id)
+	if e.addr != "" {
+		delete(s.addrs, e.addr)
+	}
+	atomic.AddInt32(&s.count, -1)
+}
+
+// The clients traced, by id
+func (s *traceSet) list() []traceInfo {
+	defer s.Unlock()
+	s.Lock()
+	list := []traceInfo{}
+	for id, e := range s.until {
+		list = append(list, traceInfo{id, e.until})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Client < list[j].Client
+	})
+	return list
+}
+
+// Whether the client with id is traced, noting that it is at a
+// if it is
+func (s *traceSet) seen(id string, a uAddr) bool {
+	defer s.Unlock()
+	s.Lock()
+	e := s.until[id]
+	if e == nil {
+		return false
+	}
+	if addr := a.String(); e.addr != addr {
+		if e.addr != "" {
+			delete(s.addrs, e.addr)
+		}
+		e.addr = addr
+		s.addrs[addr] = id
+	}
+	return true
+}
+
+// The id of the client traced at a, "" if there is none
+func (s *traceSet) at(a uAddr) string {
+	defer s.Unlock()
+	s.Lock()
+	return s.addrs[a.String()]
+}
+
+// Whether fields name a client traced, by its id or address
+func (s *traceSet) matches(fields []Field) bool {
+	defer s.Unlock()
+	s.Lock()
+	for _, f := range fields {
+		switch f.Key {
+		case fieldClientId:
+			if id, ok := f.Value.(string); ok && s.until[id] != nil {
+				return true
+			}
+		case fieldRemote:
+			if a, ok := f.Value.(fmt.Stringer); ok && s.addrs[a.String()] != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Trace as the log-trace-* options of gc have it, replacing any
+// trace set before
+func (s *traceSet) configure(gc *GatewayConfig) {
+	s.reset()
+	for _, id := range gc.tracedclients {
+		s.set(id, gc.traceDuration())
+	}
+}
+
+// Log a packet of msgType, b, received from or sent to the
+// client with id at a
+func tracePacket(direction string, id string, a uAddr, msgType string, b []byte) {
+	INFO.output(direction, []Field{traceLog, logClientId(id), logRemote(a), {fieldMsgType, msgType}, {"bytes", len(b)}, {"hex", fmt.Sprintf("% x", b)}, traceTag})
+}
+
+// Log a packet received, m its decoded form, nil if it is
+// malformed, if it is from a client traced
+func (g *core) traceInbound(m Message, b []byte, a uAddr) {
+	var id string
+	if c, ok := m.(*ConnectMessage); ok {
+		id = string(c.ClientId)
+	} else if sc := g.clients.GetClient(a); sc != nil {
+		id = sc.base().ClientId
+	} else {
+		id = traces.at(a)
+	}
+	if id == "" || !traces.seen(id, a) {
+		return
+	}
+	msgType := "malformed"
+	if m != nil {
+		msgType = MessageNames[m.MessageType()]
+	}
+	tracePacket("in", id, a, msgType, b)
+}
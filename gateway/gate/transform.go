@@ -0,0 +1,257 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"sync/atomic"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// A rewrite of a message's topic and payload on its way between
+// the clients and the broker. Returning an error drops the
+// message.
+type Transform func(topic string, payload []byte) (string, []byte, error)
+
+// Rewrite what clients publish before it is sent to the broker.
+// t is called on the goroutine handling the client's PUBLISH, so
+// a slow one holds up that client's publish but not the reading
+// of packets. A QoS 1 or 2 PUBLISH it drops is refused with
+// REJ_NOT_SUPPORTED. A retained PUBLISH with no payload, which
+// clears the topic's retained message, keeps no payload whatever
+// t returns. Must be called before Start.
+func (ag *AGateway) SetUpstreamTransform(t Transform) {
+	ag.upTransform = t
+}
+
+// Rewrite what arrives from the broker before it is matched with
+// the clients' subscriptions, which match the rewritten topic,
+// and delivered to them. t is called as each message arrives, in
+// order. Must be called before Start.
+func (ag *AGateway) SetDownstreamTransform(t Transform) {
+	ag.downTransform = t
+}
+
+// The number of messages dropped by a transform, in either
+// direction
+func (g *core) TransformDrops() uint64 {
+	return atomic.LoadUint64(&g.transformDrops)
+}
+
+// Apply t to a message on topic, returning the topic and payload
+// it is to have, or the error it is dropped for, counted. The
+// topic t returns must be a valid topic name.
+func (g *core) transform(t Transform, topic string, payload []byte) (string, []byte, error) {
+	topic, payload, err := t(topic, payload)
+	if err == nil {
+		_, err = ValidateTopicName(topic)
+	}
+	if err != nil {
+		atomic.AddUint64(&g.transformDrops, 1)
+		return "", nil, err
+	}
+	return topic, payload, nil
+}
+
+// A message from the broker with the topic and payload the
+// clients are given
+type rewrittenMessage struct {
+	MQTT.Message
+	topic   string
+	payload []byte
+}
+
+func (m rewrittenMessage) Topic() string   { return m.topic }
+func (m rewrittenMessage) Payload() []byte { return m.payload }
+
+// The deepest arrays and maps are nested in CBOR that CBORToJSON
+// converts
+const maxCBORDepth = 32
+
+// An upstream Transform for devices that send CBOR (RFC 7049) to
+// save bytes, publishing JSON to the broker on the same topic.
+// Map keys must be strings or numbers, byte strings become
+// base64, tags are dropped and indefinite lengths are not
+// supported. An empty payload is left empty.
+func CBORToJSON(topic string, payload []byte) (string, []byte, error) {
+	if len(payload) == 0 {
+		return topic, payload, nil
+	}
+	d := cborDecoder{payload}
+	v, err := d.value(0)
+	if err == nil && len(d.b) > 0 {
+		err = ErrInvalidCBOR
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	j, err := json.Marshal(v)
+	return topic, j, err
+}
+
+// What remains of a CBOR payload to decode
+type cborDecoder struct {
+	b []byte
+}
+
+// Decode the next value, nested depth deep
+func (d *cborDecoder) value(depth int) (interface{}, error) {
+	if len(d.b) == 0 || depth > maxCBORDepth {
+		return nil, ErrInvalidCBOR
+	}
+	major, info := d.b[0]>>5, d.b[0]&0x1f
+	d.b = d.b[1:]
+	if major == 7 {
+		return d.simple(info)
+	}
+	n, err := d.argument(info)
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		return n, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return -1 - float64(n), nil
+		}
+		return -1 - int64(n), nil
+	case 2, 3:
+		if n > uint64(len(d.b)) {
+			return nil, ErrInvalidCBOR
+		}
+		s := d.b[:n]
+		d.b = d.b[n:]
+		if major == 2 {
+			return s, nil
+		}
+		return string(s), nil
+	case 4:
+		if n > uint64(len(d.b)) {
+			return nil, ErrInvalidCBOR
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case 5:
+		if n > uint64(len(d.b))/2 {
+			return nil, ErrInvalidCBOR
+		}
+		m := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			k, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			var key string
+			switch k := k.(type) {
+			case string:
+				key = k
+			case uint64, int64, float64:
+				j, _ := json.Marshal(k)
+				key = string(j)
+			default:
+				return nil, ErrInvalidCBOR
+			}
+			if m[key], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	default:
+		// a tag, of the value that follows
+		return d.value(depth + 1)
+	}
+}
+
+// The argument following the initial byte, given its low 5 bits
+func (d *cborDecoder) argument(info byte) (uint64, error) {
+	if info < 24 {
+		return uint64(info), nil
+	}
+	size := 0
+	switch info {
+	case 24:
+		size = 1
+	case 25:
+		size = 2
+	case 26:
+		size = 4
+	case 27:
+		size = 8
+	default:
+		return 0, ErrInvalidCBOR
+	}
+	if len(d.b) < size {
+		return 0, ErrInvalidCBOR
+	}
+	var n uint64
+	for _, b := range d.b[:size] {
+		n = n<<8 | uint64(b)
+	}
+	d.b = d.b[size:]
+	return n, nil
+}
+
+// A simple value or float, given the low 5 bits of its initial
+// byte
+func (d *cborDecoder) simple(info byte) (interface{}, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		if len(d.b) < 2 {
+			return nil, ErrInvalidCBOR
+		}
+		h := binary.BigEndian.Uint16(d.b)
+		d.b = d.b[2:]
+		return halfFloat(h), nil
+	case 26:
+		if len(d.b) < 4 {
+			return nil, ErrInvalidCBOR
+		}
+		f := math.Float32frombits(binary.BigEndian.Uint32(d.b))
+		d.b = d.b[4:]
+		return float64(f), nil
+	case 27:
+		if len(d.b) < 8 {
+			return nil, ErrInvalidCBOR
+		}
+		f := math.Float64frombits(binary.BigEndian.Uint64(d.b))
+		d.b = d.b[8:]
+		return f, nil
+	default:
+		return nil, ErrInvalidCBOR
+	}
+}
+
+// The value of an IEEE 754 half-precision float
+func halfFloat(h uint16) float64 {
+	exp, mant := int(h>>10)&0x1f, float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
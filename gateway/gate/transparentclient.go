@@ -1,85 +1,262 @@
 package gateway
 
 import (
-	"net"
-	"sync"
+	"fmt"
+	"hash/fnv"
+	"time"
 
 	. "github.com/alsm/gnatt/packets"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
+// How long to wait for the broker to answer on behalf of a
+// client
+const brokerTimeout = 2 * time.Second
+
+// How long to wait for a client's broker connection, unless
+// configured; less than the usual MQTT-SN retry interval
+const defaultConnectTimeout = 5 * time.Second
+
+// The keepalive of a broker connection for a client that
+// asked for none, unless configured
+const defaultMQTTKeepAlive = 60 * time.Second
+
+// The longest keepalive an MQTT CONNECT can carry
+const maxMQTTKeepAlive = 65535 * time.Second
+
+// The keepalive of the broker connection for a client with
+// keepalive duration d; multiplied, capped at ceiling (if not
+// 0), and def if the client asked for none. A broker connection
+// without a keepalive could go unnoticed when half open.
+func mqttKeepAlive(d uint16, multiplier int, ceiling, def time.Duration) time.Duration {
+	if d == 0 {
+		if def > 0 {
+			return def
+		}
+		return defaultMQTTKeepAlive
+	}
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	k := time.Duration(d) * time.Duration(multiplier) * time.Second
+	if ceiling > 0 && k > ceiling {
+		k = ceiling
+	}
+	if k > maxMQTTKeepAlive {
+		k = maxMQTTKeepAlive
+	}
+	return k
+}
+
+// The return code in an MQTT SUBACK for a refused subscription
+const mqttSubackFailure = 0x80
+
+// The longest client id an MQTT 3.1 broker has to accept
+const defaultClientIdMaxLen = 23
+
+// What to do with an MQTT client id longer than the maximum
+const (
+	overflowReject   = "reject"   // refuse the CONNECT
+	overflowTruncate = "truncate" // keep the start of the id
+	overflowHash     = "hash"     // keep the start of the id and add a hash of all of it
+)
+
+// The MQTT client id for the MQTT-SN client id, which is passed
+// through behind prefix so that the broker's ACLs and sessions
+// apply to the MQTT-SN client
+func mqttClientId(prefix, id string, max int, overflow string) (string, error) {
+	if max <= 0 {
+		max = defaultClientIdMaxLen
+	}
+	mqttid := prefix + id
+	if len(mqttid) <= max {
+		return mqttid, nil
+	}
+	switch overflow {
+	case overflowTruncate:
+		return mqttid[:max], nil
+	case overflowHash:
+		h := fnv.New32a()
+		h.Write([]byte(mqttid))
+		sum := fmt.Sprintf("%08x", h.Sum32())
+		if max <= len(sum) {
+			return sum[:max], nil
+		}
+		return mqttid[:max-len(sum)] + sum, nil
+	default:
+		return "", ErrClientIDTooLong
+	}
+}
+
+// An MQTT-SN client of the transparent gateway, with its own
+// connection to the broker
 type TClient struct {
-	Client
-	mqttClient *MQTT.Client
-	mqttBroker string
-	username   string
-	password   string
+	*Client
+	mqttClient    mqttClient
+	mqttBroker    string
+	mqttClientId  string
+	username      string
+	password      string
+	cleanSession  bool
+	keepAlive     uint16
+	mqttKeepAlive time.Duration
+	dialed        bool
 }
 
-// Do not allow the creation of an MQTT-SN client if
-// a connection to the MQTT broker cannot be established
-func NewTClient(ClientId, Broker string, Connection *net.UDPConn, Address *net.UDPAddr) (*TClient, error) {
-	INFO.Println("NewTClient, id: %s", ClientId)
-	t := &TClient{
-		Client{
-			sync.RWMutex{},
-			ClientId,
-			Connection,
-			Address,
-			make(map[uint16]string),
-			make(map[uint16]*PublishMessage),
-		},
+func NewTClient(ClientId, Broker string, Connection uConn, Address uAddr) *TClient {
+	INFO.Log("new transparent client", transparentLog, logClientId(ClientId), logRemote(Address))
+	return &TClient{
+		NewClient(ClientId, Connection, Address),
 		nil,
 		Broker,
+		ClientId,
 		"",
 		"",
+		true,
+		0,
+		defaultMQTTKeepAlive,
+		false,
 	}
-	if err := t.connectMQTT(ClientId, Broker); err != nil {
-		return nil, err
-	}
-	return t, nil
 }
 
-func (t *TClient) connectMQTT(ClientId, Broker string) error {
+// The options for the client's broker connection, which
+// carries its will. Messages the broker has queued for a
+// resumed session arrive without a subscription handler, so
+// are delivered by the default handler. A websocket broker
+// with headers is reached through relays.
+func (t *TClient) mqttOptions(tIndex *topicNames, relays *brokerRelays) *MQTT.ClientOptions {
 	opts := MQTT.NewClientOptions()
-	opts.AddBroker(Broker)
-	opts.SetClientID(ClientId)
+	opts.SetDefaultPublishHandler(t.deliverMQTT(tIndex))
+	opts.AddBroker(relays.url(t.mqttBroker))
+	opts.SetClientID(t.mqttClientId)
+	opts.SetCleanSession(t.cleanSession)
+	opts.SetKeepAlive(t.mqttKeepAlive)
 	if t.username != "" {
 		opts.SetUsername(t.username)
 		opts.SetPassword(t.password)
 	}
-	t.mqttClient = MQTT.NewClient(opts)
+	if will := t.Will(); will != nil {
+		opts.SetBinaryWill(will.Topic, will.Data, will.Qos, will.Retain)
+	}
+	return opts
+}
 
-	if token := t.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		return token.Error()
+// The settings for the client's connection to an MQTT v5
+// broker, which carries its will as the v3 one does
+func (t *TClient) mqtt5Options(tIndex *topicNames, conf *mqtt5Config) mqtt5Options {
+	return mqtt5Options{
+		mqtt5Config:    conf,
+		broker:         t.mqttBroker,
+		clientID:       t.mqttClientId,
+		username:       t.username,
+		password:       t.password,
+		cleanSession:   t.cleanSession,
+		keepAlive:      t.mqttKeepAlive,
+		will:           t.Will(),
+		defaultHandler: t.deliverMQTT(tIndex),
 	}
-	INFO.Println("TClient connected to mqtt broker")
-	return nil
 }
 
-func (t *TClient) disconnectMQTT() {
-	t.mqttClient.Disconnect(100)
+// Connect to the broker, waiting at most timeout, and return
+// the CONNACK return code for the MQTT-SN client
+func (t *TClient) connectMQTT(c mqttClient, timeout time.Duration) (byte, error) {
+	t.mqttClient = c
+	token := t.mqttClient.Connect()
+	if !token.WaitTimeout(timeout) {
+		abandonConnect(t.mqttClient, token)
+		return REJ_CONGESTION, ErrBrokerTimeout
+	}
+	if token.Error() != nil {
+		rc := byte(REJ_CONGESTION)
+		if ct, ok := token.(interface {
+			ReturnCode() byte
+		}); ok {
+			rc = mqttConnackCode(ct.ReturnCode())
+		}
+		return rc, token.Error()
+	}
+	INFO.Log("connected to the broker", transparentLog, logClient(t.Client))
+	return ACCEPTED, nil
 }
 
-func (t *TClient) subscribeMQTT(qos byte, topic string, tIndex *topicNames) {
-	var handler MQTT.MessageHandler = func(client *MQTT.Client, msg MQTT.Message) {
-		INFO.Println("publish handler")
+// The MQTT-SN CONNACK return code for a failed connection to
+// the broker, given the broker's return code, or reason code if
+// it is MQTT v5. Failing to reach the broker (no return code),
+// or it being unavailable, busy, over quota or elsewhere, may
+// pass; anything else it refuses is the client's problem.
+func mqttConnackCode(rc byte) byte {
+	switch rc {
+	case 0x00, 0x03, 0x88, 0x89, 0x97, 0x9c, 0x9d, 0x9f:
+		return REJ_CONGESTION
+	default:
+		return REJ_NOT_SUPORTED
+	}
+}
 
-		tid := tIndex.getId(msg.Topic())
-		// is topicid type always 0 coming out of tIndex ?
-		// todo: msgid is not always 0
-		pm := NewPublishMessage(tid, 0x00, msg.Payload(), msg.Qos(), 0x00, msg.Retained(), msg.Duplicate())
+// Record whether the client holds a broker connection,
+// returning whether it did
+func (t *TClient) setDialed(dialed bool) bool {
+	defer t.Unlock()
+	t.Lock()
+	was := t.dialed
+	t.dialed = dialed
+	return was
+}
 
-		if err := t.Write(pm); err != nil {
-			ERROR.Println(err)
-		} else {
-			INFO.Println("incoming mqtt published to mqtt-sn")
+func (t *TClient) disconnectMQTT() {
+	if t.mqttClient != nil {
+		t.mqttClient.Disconnect(100)
+	}
+}
+
+// Deliver what arrives from the broker to the client alone
+func (t *TClient) deliverMQTT(tIndex *topicNames) MQTT.MessageHandler {
+	return func(client *MQTT.Client, msg MQTT.Message) {
+		tid, tidtype := tIndex.publishId(msg.Topic())
+		if tid == 0 {
+			ERROR.Log("no topic id left, PUBLISH dropped", transparentLog, logClient(t.Client), logTopic(msg.Topic()))
+			return
 		}
+		pm := NewPublishMessage(tid, tidtype, msg.Payload(), msg.Qos(), 0x00, msg.Retained(), msg.Duplicate())
+		t.Deliver(pm, msg.Topic())
 	}
+}
 
-	if token := t.mqttClient.Subscribe(topic, qos, handler); token.WaitTimeout(2000) && token.Error() != nil {
-		ERROR.Println("Error subscribing,", token.Error())
+// Subscribe on the client's broker connection, returning the
+// QoS the broker granted, which may be less than asked for
+func (t *TClient) subscribeMQTT(qos byte, topic string, tIndex *topicNames) (byte, error) {
+	handler := t.deliverMQTT(tIndex)
+	token := t.mqttClient.Subscribe(topic, qos, handler)
+	if !token.WaitTimeout(brokerTimeout) {
+		ERROR.Log("error subscribing: "+ErrBrokerTimeout.Error(), transparentLog, logClient(t.Client), logTopic(topic))
+		return 0, ErrBrokerTimeout
+	}
+	if token.Error() != nil {
+		ERROR.Log("error subscribing: "+token.Error().Error(), transparentLog, logClient(t.Client), logTopic(topic))
+		return 0, token.Error()
+	}
+	granted := qos
+	if st, ok := token.(interface {
+		Result() map[string]byte
+	}); ok {
+		if g, ok := st.Result()[topic]; ok {
+			granted = g
+		}
+	}
+	if granted == mqttSubackFailure {
+		ERROR.Log("broker refused the subscription", transparentLog, logClient(t.Client), logTopic(topic))
+		return 0, ErrSubscriptionRefused
 	}
-	INFO.Println(t.ClientId, "subscribed to", topic)
+	DEBUG.Log("subscribed", transparentLog, logClient(t.Client), logTopic(topic), Field{"qos", granted})
+	return granted, nil
+}
+
+func (t *TClient) unsubscribeMQTT(topic string) error {
+	if token := t.mqttClient.Unsubscribe(topic); token.WaitTimeout(brokerTimeout) && token.Error() != nil {
+		ERROR.Log("error unsubscribing: "+token.Error().Error(), transparentLog, logClient(t.Client), logTopic(topic))
+		return token.Error()
+	}
+	DEBUG.Log("unsubscribed", transparentLog, logClient(t.Client), logTopic(topic))
+	return nil
 }
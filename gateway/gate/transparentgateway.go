@@ -1,314 +1,636 @@
 package gateway
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"net"
-	"os"
+	"net/http"
 	"sync"
+	"time"
 
 	. "github.com/alsm/gnatt/packets"
 
-	//MQTT "github.com/eclipse/paho.mqtt.golang"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
-type TGateway struct {
-	stopsig    chan os.Signal
-	port       int
-	mqttBroker string
-	clients    Clients
-	tIndex     topicNames
-}
+// How long to wait before connecting a client to the broker
+// again after losing its connection; a variable so tests can
+// shorten it
+var reconnectInterval = time.Second
 
-func NewTGateway(gc *GatewayConfig, stopsig chan os.Signal) *TGateway {
+type TGateway struct {
+	core
+	address          string
+	readers          int
+	maxMessageSize   int
+	mqttBroker       string
+	mqttuser         string
+	mqttpassword     string
+	tlsConfig        *tls.Config
+	httpHeaders      http.Header
+	relays           *brokerRelays
+	mqttVersion      int
+	mqtt5            *mqtt5Config
+	qos              *qosMap
+	clientIdPrefix   string
+	clientIdMaxLen   int
+	clientIdOverflow string
+	credentials      *credentials
+	credsRequired    bool
+	connectTimeout   time.Duration
+	brokerConns      *brokerConns
+	brokerReconnects int
+	keepAliveFactor  int
+	keepAliveMax     time.Duration
+	keepAliveDefault time.Duration
+	sessions         sessions
+	disconnectOnStop bool
+	listener         *listener
+	newMQTTClient    func(*MQTT.ClientOptions) mqttClient
+	transports
+}
+
+func NewTGateway(gc *GatewayConfig) (*TGateway, error) {
+	var creds *credentials
+	if gc.credentialsfile != "" {
+		var err error
+		if creds, err = loadCredentials(gc.credentialsfile); err != nil {
+			return nil, err
+		}
+	}
+	tlsConfig, err := gc.brokerTLS().config()
+	if err != nil {
+		return nil, err
+	}
 	t := &TGateway{
-		stopsig,
-		gc.port,
+		newCore(),
+		gc.listenAddress(),
+		gc.udpreaders,
+		gc.maxMessageSize(),
 		gc.mqttbroker,
-		Clients{
-			sync.RWMutex{},
-			make(map[string]SNClient),
+		gc.mqttuser,
+		gc.mqttpassword,
+		tlsConfig,
+		gc.mqttheaders,
+		newBrokerRelays(gc, tlsConfig),
+		gc.mqttversion,
+		gc.mqtt5(),
+		gc.qosMap(),
+		gc.clientidprefix,
+		gc.clientidmaxlen,
+		gc.clientidoverflow,
+		creds,
+		gc.credentialsrequired,
+		defaultConnectTimeout,
+		newBrokerConns(gc.maxbrokerconns, gc.brokerconnectrate, gc.brokerconnectqueue),
+		gc.brokerreconnects,
+		gc.keepalivemultiplier,
+		gc.keepalivemax,
+		gc.keepalivedefault,
+		sessions{
+			sync.Mutex{},
+			make(map[string]*session),
 		},
-		topicNames{
-			sync.RWMutex{},
-			make(map[uint16]string),
-			0,
+		gc.disconnectonstop,
+		nil,
+		func(opts *MQTT.ClientOptions) mqttClient {
+			return MQTT.NewClient(opts)
 		},
+		newTransports(gc),
 	}
-	return t
-}
-
-func (t *TGateway) Port() int {
-	return t.port
+	t.backend = t
+	t.config.Store(gc)
+	t.discovery = newDiscovery(gc)
+	t.sys = newSysTopics(gc)
+	t.admin = newAdmin(gc.adminaddress, gc.admintoken)
+	t.admin.publishVars(t.vars())
+	t.admin.serveAPI(&t.core, t.subscriptions, t.inject)
+	t.admin.serveHealth(&t.core, t.notReady)
+	if gc.adminpprof {
+		t.admin.servePprof(gc.adminpprofmutex, gc.adminpprofblock)
+	}
+	t.sources.Store(newSourceLimiter(gc))
+	t.filter.Store(newSourceFilter(gc))
+	t.flood.Store(newFloodGuard(gc))
+	t.tIndex.addPredefined(gc.predefined)
+	t.faults = gc.faults()
+	t.timers = gc.protocolTimers()
+	t.audit = newAudit(gc)
+	t.latency.registerRTT = gc.latencyregisterrtt
+	t.setLimits(gc)
+	if gc.connecttimeout > 0 {
+		t.connectTimeout = gc.connecttimeout
+	}
+	return t, nil
 }
 
-func (t *TGateway) Start() {
-	go t.awaitStop()
-	INFO.Println("Transparent Gataway is started")
-	listen(t)
+// Read the credentials file, client-allow-file, acl-file,
+// auth-registry-file, and the DTLS keys and certificates, again;
+// none are used unless all can be read. Clients already
+// connected keep the connections and sessions they have, their
+// subscriptions among them.
+func (t *TGateway) Reload() error {
+	return t.reloadFiles(t.readFiles)
 }
 
-func (t *TGateway) awaitStop() {
-	<-t.stopsig
-	INFO.Println("Transparent Gateway is stopped")
-	os.Exit(0)
-}
-
-func (t *TGateway) OnPacket(nbytes int, buffer []byte, con *net.UDPConn, addr *net.UDPAddr) {
-	INFO.Println("TG OnPacket!")
-	INFO.Printf("bytes: %s\n", string(buffer[0:nbytes]))
-
-	buf := bytes.NewBuffer(buffer)
-	rawmsg, _ := ReadPacket(buf)
-
-	INFO.Printf("rawmsg.MessageType(): %s\n", MessageNames[rawmsg.MessageType()])
-
-	switch msg := rawmsg.(type) {
-	case *AdvertiseMessage:
-		t.handle_ADVERTISE(msg, addr)
-	case *SearchGwMessage:
-		t.handle_SEARCHGW(msg, addr)
-	case *GwInfoMessage:
-		t.handle_GWINFO(msg, addr)
-	case *ConnectMessage:
-		t.handle_CONNECT(msg, con, addr)
-	case *ConnackMessage:
-		t.handle_CONNACK(msg, addr)
-	case *WillTopicReqMessage:
-		t.handle_WILLTOPICREQ(msg, addr)
-	case *WillTopicMessage:
-		t.handle_WILLTOPIC(msg, addr)
-	case *WillMsgReqMessage:
-		t.handle_WILLMSGREQ(msg, addr)
-	case *WillMsgMessage:
-		t.handle_WILLMSG(msg, addr)
-	case *RegisterMessage:
-		t.handle_REGISTER(msg, con, addr)
-	case *RegackMessage:
-		t.handle_REGACK(msg, addr)
-	case *PublishMessage:
-		t.handle_PUBLISH(msg, addr)
-	case *PubackMessage:
-		t.handle_PUBACK(msg, addr)
-	case *PubcompMessage:
-		t.handle_PUBCOMP(msg, addr)
-	case *PubrecMessage:
-		t.handle_PUBREC(msg, addr)
-	case *PubrelMessage:
-		t.handle_PUBREL(msg, addr)
-	case *SubscribeMessage:
-		t.handle_SUBSCRIBE(msg, addr)
-	case *SubackMessage:
-		t.handle_SUBACK(msg, addr)
-	case *UnsubackMessage:
-		t.handle_UNSUBACK(msg, addr)
-	case *PingreqMessage:
-		t.handle_PINGREQ(msg, con, addr)
-	case *DisconnectMessage:
-		t.handle_DISCONNECT(msg, addr)
-	case *WillTopicUpdateMessage:
-		t.handle_WILLTOPICUPD(msg, addr)
-	case *WillTopicRespMessage:
-		t.handle_WILLTOPICRESP(msg, addr)
-	case *WillMsgUpdateMessage:
-		t.handle_WILLMSGUPD(msg, addr)
-	case *WillMsgRespMessage:
-		t.handle_WILLMSGRESP(msg, addr)
-	default:
-		ERROR.Printf("Unknown Message Type %T\n", msg)
-	}
-}
-
-func (t *TGateway) handle_ADVERTISE(m *AdvertiseMessage, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
-}
-
-func (t *TGateway) handle_SEARCHGW(m *SearchGwMessage, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
-}
-
-func (t *TGateway) handle_GWINFO(m *GwInfoMessage, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
-}
-
-func (t *TGateway) handle_CONNECT(m *ConnectMessage, c *net.UDPConn, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
-	INFO.Println(m.ProtocolId, m.Duration, m.ClientId)
-	if clientid, err := validateClientId(m.ClientId); err != nil {
-		ERROR.Println(err)
-	} else {
-		INFO.Printf("clientid: %s\n", clientid)
-		INFO.Printf("remoteaddr: %s\n", a)
-		INFO.Printf("will: %v\n", m.Will)
-		if m.Will {
-			// todo: will msg
-		}
-		if tClient, err := NewTClient(string(clientid), t.mqttBroker, c, a); err != nil {
-			ERROR.Println(err)
-		} else {
-			t.clients.AddClient(tClient)
-
-			// establish connection to mqtt broker
-
-			ca := NewMessage(CONNACK).(*ConnackMessage)
-			ca.ReturnCode = 0
-			if err = tClient.Write(ca); err != nil {
-				ERROR.Println(err)
-			} else {
-				INFO.Println("CONNACK was sent")
-			}
+// Read the credentials file, the files gc names and the DTLS keys
+// and certificates, returning what puts them to use
+func (t *TGateway) readFiles(gc *GatewayConfig) (func(), error) {
+	apply, err := t.core.readFiles(gc)
+	if err != nil {
+		return nil, err
+	}
+	credentials := func() {}
+	if t.credentials != nil {
+		if credentials, err = t.credentials.read(); err != nil {
+			return nil, err
 		}
 	}
+	dtls, err := t.transports.read()
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		apply()
+		credentials()
+		dtls()
+	}, nil
 }
 
-func (t *TGateway) handle_CONNACK(m *ConnackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+// Reload, and apply the options of gc, the gateway's
+// configuration read again, that can be changed while it runs,
+// logging the changes to the rest
+func (t *TGateway) ReloadConfig(gc *GatewayConfig) error {
+	return t.reloadConfig(gc, t.readFiles)
 }
 
-func (t *TGateway) handle_WILLTOPICREQ(m *WillTopicReqMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+// Serve the clients of t as well, until the gateway stops.
+// Must be called after Start.
+func (t *TGateway) Serve(tr Transport) {
+	t.transports.serve(tr, t)
 }
 
-func (t *TGateway) handle_WILLTOPIC(m *WillTopicMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+// The broker connections held for clients
+func (t *TGateway) BrokerConnections() int {
+	return t.brokerConns.Len()
 }
 
-func (t *TGateway) handle_WILLMSGREQ(m *WillMsgReqMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+// The address the gateway listens on; once started, the
+// address it is bound to
+func (t *TGateway) Addr() string {
+	if l := t.listener; l != nil {
+		return l.String()
+	}
+	return t.address
 }
 
-func (t *TGateway) handle_WILLMSG(m *WillMsgMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+// What each listener has handled
+func (t *TGateway) Listeners() []ListenerStats {
+	return listenerStats(&t.core, t.listener, &t.transports)
 }
 
-func (t *TGateway) handle_REGISTER(m *RegisterMessage, c *net.UDPConn, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
-	topic := string(m.TopicName)
-	var topicid uint16
-	if !t.tIndex.containsTopic(topic) {
-		topicid = t.tIndex.putTopic(topic)
-	} else {
-		topicid = t.tIndex.getId(topic)
-	}
-
-	INFO.Printf("t topicid: %d\n", topicid)
-
-	tclient := t.clients.GetClient(r).(*TClient)
-	tclient.Register(topicid, topic)
+// The addresses the gateway is bound to once started, like
+// AGateway's
+func (t *TGateway) Addrs() []net.Addr {
+	return listenerAddrs(t.listener, &t.transports)
+}
 
-	ra := NewRegackMessage(topicid, m.MessageId, 0)
-	INFO.Printf("ra.Msgid: %d\n", ra.MessageId)
+// The UDP port the gateway listens on, like AGateway's
+func (t *TGateway) Port() int {
+	if l := t.listener; l != nil {
+		return l.port()
+	}
+	return addrPort(t.address)
+}
 
-	if err := tclient.Write(ra); err != nil {
+func (t *TGateway) Start() error {
+	gc := t.config.Load()
+	if err := t.loadAllowlist(gc); err != nil {
+		return err
+	}
+	if err := t.loadACL(gc); err != nil {
+		return err
+	}
+	if err := t.loadRegistry(gc); err != nil {
+		return err
+	}
+	if err := t.audit.start(); err != nil {
+		return err
+	}
+	l, err := listen(t.address, t.readers, t.maxMessageSize, t.faults, t)
+	if err != nil {
+		t.audit.stop()
+		return err
+	}
+	l.counters.setOutbound(t.transports.outbound)
+	if err := t.transports.start(t); err != nil {
+		l.stop(context.Background())
+		t.audit.stop()
+		return err
+	}
+	if err := t.admin.start(); err != nil {
+		t.transports.stop(context.Background())
+		l.stop(context.Background())
+		t.audit.stop()
+		return err
+	}
+	if err := t.discovery.start(); err != nil {
+		// clients can still be told where the gateway is
 		ERROR.Println(err)
-	} else {
-		INFO.Println("REGACK sent")
 	}
+	t.startCapture()
+	t.listener = l
+	t.sys.start(t.sysStats(), t.inject)
+	t.setLife(lifeServing)
+	INFO.Println("Transparent Gateway is started")
+	return nil
+}
+
+// Optionally send a DISCONNECT to every client, stop listening,
+// wait for the packets being handled (or for ctx to be done)
+// and disconnect every client from the broker
+func (t *TGateway) Stop(ctx context.Context) error {
+	INFO.Println("Transparent Gateway is stopping")
+	t.setLife(lifeStopping)
+	if t.disconnectOnStop {
+		t.clients.Range(func(c SNClient) {
+			if err := c.(*TClient).Write(NewMessage(DISCONNECT)); err != nil {
+				ERROR.Println(err)
+			}
+		})
+	}
+	t.discovery.stop()
+	t.sys.stop()
+	var err error
+	if t.listener != nil {
+		err = t.listener.stop(ctx)
+		t.listener = nil
+	}
+	if terr := t.transports.stop(ctx); err == nil {
+		err = terr
+	}
+	t.clients.Range(func(c SNClient) {
+		t.endSession(c.(*TClient))
+	})
+	t.clients.Clear()
+	t.relays.close()
+	t.audit.stop()
+	stopCapture()
+	// the health checks answer until the end
+	if aerr := t.admin.stop(ctx); err == nil {
+		err = aerr
+	}
+	t.setLife(lifeStopped)
+	INFO.Println("Transparent Gateway is stopped")
+	return err
 }
 
-func (t *TGateway) handle_REGACK(m *RegackMessage, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
-}
+func (t *TGateway) handle_CONNECT(m *ConnectMessage, c uConn, a uAddr) {
+	clientid, err := validateConnect(m)
+	DEBUG.Log("received", transparentLog, logMsgType(m.MessageType()), logClientId(clientid), logRemote(a), Field{"will", m.Will}, Field{"duration", m.Duration})
+	var metadata map[string]string
+	if err == nil {
+		metadata, err = t.authenticate(clientid, c, a)
+	}
+	if err != nil {
+		ERROR.Log(err.Error(), transparentLog, logClientId(clientid), logRemote(a))
+		sendConnack(c, a, connackCode(err))
+		return
+	}
 
-func (t *TGateway) handle_PUBLISH(m *PublishMessage, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
-	tclient := t.clients.GetClient(a).(*TClient)
+	mqttid, err := mqttClientId(t.clientIdPrefix, clientid, t.clientIdMaxLen, t.clientIdOverflow)
+	if err != nil {
+		ERROR.Log("no MQTT client id: "+err.Error(), transparentLog, logClientId(clientid), logRemote(a))
+		sendConnack(c, a, REJ_NOT_SUPORTED)
+		return
+	}
 
-	topic := t.tIndex.getTopic(m.TopicId)
+	username, password := t.mqttuser, t.mqttpassword
+	if t.credentials != nil {
+		if cred, ok := t.credentials.lookup(clientid); ok {
+			username, password = cred.username, cred.password
+		} else if t.credsRequired {
+			ERROR.Log("refused: "+ErrNoCredentials.Error(), transparentLog, logClientId(clientid), logRemote(a))
+			sendConnack(c, a, REJ_NOT_SUPORTED)
+			return
+		}
+	}
 
-	INFO.Println(topic, m.Qos, m.Retain, m.Data)
-	if token := tclient.mqttClient.Publish(topic, m.Qos, m.Retain, m.Data); token.WaitTimeout(2000) && token.Error() != nil {
-		ERROR.Println("Error publishing message", token.Error())
+	if old, ok := t.clients.GetClient(a).(*TClient); ok {
+		// a new session replaces the old one, and its broker connection
+		t.endSession(old)
+	}
+	if t.tooManyClients(a) {
+		sendConnack(c, a, connackCode(ErrTooManyClients))
 		return
 	}
-	INFO.Println("PUBLISH published")
+	tclient := NewTClient(clientid, t.mqttBroker, c, a)
+	tclient.setMetadata(metadata)
+	t.configureClient(tclient.Client)
+	tclient.mqttClientId = mqttid
+	tclient.username = username
+	tclient.password = password
+	tclient.cleanSession = m.CleanSession
+	tclient.keepAlive = m.Duration
+	tclient.mqttKeepAlive = mqttKeepAlive(m.Duration, t.keepAliveFactor, t.keepAliveMax, t.keepAliveDefault)
+	if s := t.sessions.take(clientid); s != nil && !m.CleanSession {
+		INFO.Log("resuming the session", transparentLog, logClientId(clientid), logRemote(a))
+		tclient.resume(s)
+	}
+	t.clients.AddClient(tclient)
+
+	if m.Will {
+		// the broker connection, which carries the will, is
+		// made once the will exchange completes
+		tclient.SetState(CONNECTING)
+		if ioerr := tclient.Write(NewMessage(WILLTOPICREQ)); ioerr != nil {
+			ERROR.Log(ioerr.Error(), transparentLog, logClient(tclient.Client))
+		} else {
+			DEBUG.Log("sent", transparentLog, logMsgType(WILLTOPICREQ), logClient(tclient.Client))
+		}
+		return
+	}
+	t.connectMQTT(tclient)
 }
 
-func (t *TGateway) handle_PUBACK(m *PubackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+// Connect the client to the broker and accept its CONNECT, or
+// refuse it if the broker cannot be reached
+func (t *TGateway) connectMQTT(tclient *TClient) {
+	if rc, err := t.dialMQTT(tclient); err != nil {
+		ERROR.Log("broker refused the client: "+err.Error(), transparentLog, logClient(tclient.Client), logRemote(tclient.Address), Field{"mqtt_client_id", tclient.mqttClientId})
+		if t.clients.GetClient(tclient.Address) == SNClient(tclient) {
+			t.clients.RemoveClient(tclient.Address)
+		}
+		sendConnack(tclient.Conn, tclient.Address, rc)
+		return
+	}
+	if t.clients.GetClient(tclient.Address) != SNClient(tclient) {
+		// replaced by a new CONNECT while waiting for the broker
+		t.hangUp(tclient)
+		return
+	}
+	tclient.onUnreachable = func() {
+		t.lostClient(tclient)
+	}
+	if tclient.keepAlive > 0 {
+		tclient.Supervise(time.Duration(tclient.keepAlive)*time.Second, func() {
+			t.lostClient(tclient)
+		})
+	}
+	tclient.SetState(ACTIVE)
+	ca := NewMessage(CONNACK).(*ConnackMessage)
+	ca.ReturnCode = ACCEPTED
+	if err := tclient.Write(ca); err != nil {
+		ERROR.Log(err.Error(), transparentLog, logClient(tclient.Client))
+	} else {
+		DEBUG.Log("sent", transparentLog, logMsgType(CONNACK), logClient(tclient.Client))
+	}
 }
 
-func (t *TGateway) handle_PUBCOMP(m *PubcompMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+// A connection to the broker for the client, speaking the
+// protocol version configured
+func (t *TGateway) brokerClient(tclient *TClient, timeout time.Duration) mqttClient {
+	lost := func(err error) {
+		t.lostMQTT(tclient, err)
+	}
+	if t.mqtt5 != nil {
+		opts := tclient.mqtt5Options(&t.tIndex, t.mqtt5)
+		opts.connectTimeout = timeout
+		opts.tlsConfig = t.tlsConfig
+		opts.headers = t.httpHeaders
+		opts.lost = lost
+		return newMQTT5Client(opts)
+	}
+	opts := tclient.mqttOptions(&t.tIndex, t.relays)
+	if t.mqttVersion > 0 {
+		opts.SetProtocolVersion(uint(t.mqttVersion))
+	}
+	if t.tlsConfig != nil {
+		opts.SetTLSConfig(t.tlsConfig)
+	}
+	opts.SetConnectionLostHandler(func(c *MQTT.Client, err error) {
+		lost(err)
+	})
+	return t.newMQTTClient(opts)
+}
+
+// Connect the client to the broker, within the gateway's limit
+// on broker connections; waiting for the limit counts toward
+// the connect timeout
+func (t *TGateway) dialMQTT(tclient *TClient) (byte, error) {
+	start := time.Now()
+	if !t.brokerConns.acquire(t.connectTimeout) {
+		return REJ_CONGESTION, ErrTooManyBrokerConnections
+	}
+	timeout := t.connectTimeout - time.Since(start)
+	rc, err := tclient.connectMQTT(t.brokerClient(tclient, timeout), timeout)
+	if err != nil {
+		t.brokerConns.release()
+		return rc, err
+	}
+	tclient.setDialed(true)
+	return rc, nil
 }
 
-func (t *TGateway) handle_PUBREC(m *PubrecMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+// Close the client's broker connection, if it has one
+func (t *TGateway) hangUp(tclient *TClient) {
+	tclient.disconnectMQTT()
+	if tclient.setDialed(false) {
+		t.brokerConns.release()
+	}
 }
 
-func (t *TGateway) handle_PUBREL(m *PubrelMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) lost(sc SNClient) {
+	t.lostClient(sc.(*TClient))
 }
 
-func (t *TGateway) handle_SUBSCRIBE(m *SubscribeMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
-	topic := ""
-	if m.TopicIdType == 0 { // todo: other topic id types, also use enum
-		topic = string(m.TopicName)
-	} else {
-		ERROR.Println("other topic id types not supported yet")
-		topic = "not_implemented"
+// The client has not been heard from for too long, or its
+// connection has closed. Its broker connection is still up, so
+// the gateway publishes its will before closing it.
+func (t *TGateway) lostClient(tclient *TClient) {
+	ERROR.Log("client lost", transparentLog, logClient(tclient.Client), logRemote(tclient.Address))
+	if t.clients.GetClient(tclient.Address) != SNClient(tclient) {
+		return
 	}
-	tclient := t.clients.GetClient(r).(*TClient)
-	INFO.Printf("subscribe, qos: %d, topic: %s\n", m.Qos, topic)
-	tclient.subscribeMQTT(m.Qos, topic, &t.tIndex)
-
-	suba := NewSubackMessage(0, m.MessageId, m.Qos, 0)
-
-	if err := tclient.Write(suba); err != nil {
-		ERROR.Println(err)
-	} else {
-		INFO.Println("SUBACK sent")
+	t.clients.RemoveClient(tclient.Address)
+	t.publishWill(tclient)
+	t.endSession(tclient)
+}
+
+// Publish the client's will, if it has one, on its broker
+// connection
+func (t *TGateway) publishWill(tclient *TClient) {
+	if will := tclient.Will(); will != nil {
+		token := tclient.mqttClient.Publish(will.Topic, will.Qos, will.Retain, will.Data)
+		err := ErrPublishTimeout
+		if token.WaitTimeout(brokerTimeout) {
+			err = token.Error()
+		}
+		if err != nil {
+			ERROR.Log("error publishing the will: "+err.Error(), transparentLog, logClient(tclient.Client), logTopic(will.Topic))
+		} else {
+			INFO.Log("published the will", transparentLog, logClient(tclient.Client), logTopic(will.Topic))
+		}
 	}
 }
 
-func (t *TGateway) handle_SUBACK(m *SubackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+// The client's broker connection has been lost. The gateway
+// connects again, up to brokerReconnects times, before giving
+// up and ending the client's MQTT-SN session too.
+func (t *TGateway) lostMQTT(tclient *TClient, err error) {
+	ERROR.Log("broker connection lost: "+err.Error(), transparentLog, logClient(tclient.Client))
+	t.hangUp(tclient)
+	for i := 0; i < t.brokerReconnects; i++ {
+		time.Sleep(reconnectInterval)
+		if t.clients.GetClient(tclient.Address) != SNClient(tclient) {
+			return
+		}
+		if _, err := t.dialMQTT(tclient); err != nil {
+			ERROR.Log("could not reconnect to the broker: "+err.Error(), transparentLog, logClient(tclient.Client))
+			continue
+		}
+		INFO.Log("reconnected to the broker", transparentLog, logClient(tclient.Client))
+		t.resubscribe(tclient)
+		return
+	}
+	if t.clients.GetClient(tclient.Address) != SNClient(tclient) {
+		// already replaced by a new session
+		return
+	}
+	t.clients.RemoveClient(tclient.Address)
+	t.endSession(tclient)
+	if ioerr := tclient.Write(NewMessage(DISCONNECT)); ioerr != nil {
+		ERROR.Log(ioerr.Error(), transparentLog, logClient(tclient.Client))
+	}
 }
 
-func (t *TGateway) handle_UNSUBSCRIBE(m *UnsubscribeMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+// Close the client's broker connection, keeping what is needed
+// to resume its session if it did not ask for a clean one
+func (t *TGateway) endSession(tclient *TClient) {
+	tclient.Close()
+	t.hangUp(tclient)
+	if !tclient.cleanSession {
+		t.sessions.put(tclient.ClientId, tclient.session())
+	}
 }
 
-func (t *TGateway) handle_UNSUBACK(m *UnsubackMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (t *TGateway) accept(sc SNClient) {
+	t.connectMQTT(sc.(*TClient))
 }
 
-func (t *TGateway) handle_PINGREQ(m *PingreqMessage, c *net.UDPConn, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
-	tclient := t.clients.GetClient(a).(*TClient)
-
-	resp := NewMessage(PINGRESP)
+// Publish on the client's own broker connection
+func (t *TGateway) publishUpstream(sc SNClient, topic string, m *PublishMessage) error {
+	tclient := sc.(*TClient)
+	sent := time.Now()
+	token := tclient.mqttClient.Publish(topic, t.qos.upstream(topic, m.Qos), m.Retain, m.Data)
+	if !token.WaitTimeout(brokerTimeout) {
+		return ErrPublishTimeout
+	}
+	t.latency.upstream.observe(time.Since(sent))
+	return token.Error()
+}
 
-	if err := tclient.Write(resp); err != nil {
-		ERROR.Println(err)
-	} else {
-		INFO.Println("PINGRESP sent")
+// The gateway's own topics are subscribed to on the gateway
+// alone
+func (t *TGateway) subscribeUpstream(sc SNClient, topic string, qos byte) (byte, error) {
+	if t.sys.local(topic) {
+		return qos, nil
 	}
+	return sc.(*TClient).subscribeMQTT(qos, topic, &t.tIndex)
 }
 
-func (t *TGateway) handle_PINGRESP(m *PingrespMessage, a *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], a)
+func (t *TGateway) unsubscribeUpstream(sc SNClient, topic string) {
+	if t.sys.local(topic) {
+		return
+	}
+	sc.(*TClient).unsubscribeMQTT(topic)
+}
+
+// The broker connection is closed along with the session
+func (t *TGateway) disconnect(sc SNClient, reason string) {
+	tclient := sc.(*TClient)
+	t.clients.RemoveClient(tclient.Address)
+	t.endSession(tclient)
+}
+
+// Deliver msg to each client subscribed to it, as its broker
+// connection would, at no more than the QoS of its
+// subscription; returning how many it is for
+func (t *TGateway) inject(msg MQTT.Message) int {
+	var targeted int
+	t.clients.Range(func(sc SNClient) {
+		tclient := sc.(*TClient)
+		qos, ok := tclient.matching(msg.Topic())
+		if !ok {
+			return
+		}
+		if msg.Qos() < qos {
+			qos = msg.Qos()
+		}
+		tclient.deliverMQTT(&t.tIndex)(nil, injectedMessage{msg.Topic(), msg.Payload(), qos, msg.Retained()})
+		targeted++
+	})
+	return targeted
 }
 
-func (t *TGateway) handle_DISCONNECT(m *DisconnectMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
-	tclient := t.clients.GetClient(r).(*TClient)
-	tclient.disconnectMQTT()
-	t.clients.RemoveClient(tclient.ClientId)
+// The transparent gateway has no hooks to tell
+func (t *TGateway) asleep(sc SNClient, d time.Duration) {}
+
+func (t *TGateway) kick(sc SNClient, will bool) {
+	tclient := sc.(*TClient)
+	t.clients.RemoveClient(tclient.Address)
+	if will {
+		t.publishWill(tclient)
+	}
+	t.endSession(tclient)
+}
+
+// A will can only be changed by connecting to the broker
+// again, so a will update replaces the client's broker
+// connection with one carrying the new will, subscribing again
+// to what the client was subscribed to. If the broker cannot be
+// reached the client's session ends.
+func (t *TGateway) updateWill(sc SNClient) byte {
+	tclient := sc.(*TClient)
+	t.hangUp(tclient)
+	if rc, err := t.dialMQTT(tclient); err != nil {
+		ERROR.Log("could not update the will: "+err.Error(), transparentLog, logClient(tclient.Client))
+		t.clients.RemoveClient(tclient.Address)
+		tclient.Close()
+		return rc
+	}
+	t.resubscribe(tclient)
+	return ACCEPTED
 }
 
-func (t *TGateway) handle_WILLTOPICUPD(m *WillTopicUpdateMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+// Subscribe the client's new broker connection to what the
+// client was subscribed to
+func (t *TGateway) resubscribe(tclient *TClient) {
+	for filter, qos := range tclient.session().subscriptions {
+		if t.sys.local(filter) {
+			continue
+		}
+		tclient.subscribeMQTT(qos, filter, &t.tIndex)
+	}
 }
 
-func (t *TGateway) handle_WILLTOPICRESP(m *WillTopicRespMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+// The sessions of disconnected clients, by client id
+type sessions struct {
+	sync.Mutex
+	sessions map[string]*session
 }
 
-func (t *TGateway) handle_WILLMSGUPD(m *WillMsgUpdateMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+func (s *sessions) put(clientid string, sess *session) {
+	defer s.Unlock()
+	s.Lock()
+	s.sessions[clientid] = sess
 }
 
-func (t *TGateway) handle_WILLMSGRESP(m *WillMsgRespMessage, r *net.UDPAddr) {
-	INFO.Printf("handle_%s from %v\n", MessageNames[m.MessageType()], r)
+// Remove and return the session of clientid, if any
+func (s *sessions) take(clientid string) *session {
+	defer s.Unlock()
+	s.Lock()
+	sess := s.sessions[clientid]
+	delete(s.sessions, clientid)
+	return sess
 }
@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"net"
+	"sync"
+)
+
+// What a listener reads packets from and writes replies to, one
+// datagram at a time: a UDP or unix datagram socket, or a
+// MemTransport. Any net.PacketConn is a Transport. Clients are
+// known by the String of the address their packets come from,
+// prefixed with its Network unless it is UDP, so a Transport's
+// addresses must name their senders uniquely and stably.
+type Transport interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	Close() error
+	LocalAddr() net.Addr
+}
+
+// How many packets a MemTransport holds before writers to it
+// wait
+const memQueueLength = 64
+
+// The name of a MemTransport on its MemNetwork
+type MemAddr string
+
+func (a MemAddr) Network() string { return "mem" }
+func (a MemAddr) String() string  { return string(a) }
+
+// An in-process network of MemTransports, which send each other
+// packets by name, for running a gateway and its clients
+// without sockets
+type MemNetwork struct {
+	sync.RWMutex
+	transports map[MemAddr]*MemTransport
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{transports: make(map[MemAddr]*MemTransport)}
+}
+
+// A transport on the network named name
+func (n *MemNetwork) Listen(name string) (*MemTransport, error) {
+	defer n.Unlock()
+	n.Lock()
+	addr := MemAddr(name)
+	if n.transports[addr] != nil {
+		return nil, ErrMemAddrInUse
+	}
+	t := &MemTransport{
+		network: n,
+		addr:    addr,
+		in:      make(chan memPacket, memQueueLength),
+		done:    make(chan struct{}),
+	}
+	n.transports[addr] = t
+	return t, nil
+}
+
+func (n *MemNetwork) lookup(addr net.Addr) *MemTransport {
+	defer n.RUnlock()
+	n.RLock()
+	return n.transports[MemAddr(addr.String())]
+}
+
+type memPacket struct {
+	b    []byte
+	from MemAddr
+}
+
+// A Transport on a MemNetwork. Like UDP, packets to a name no
+// transport has are dropped, and a packet larger than the buffer
+// it is read into is cut short.
+type MemTransport struct {
+	network *MemNetwork
+	addr    MemAddr
+	in      chan memPacket
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (t *MemTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-t.in:
+		return copy(b, p.b), p.from, nil
+	case <-t.done:
+		return 0, nil, ErrTransportClosed
+	}
+}
+
+func (t *MemTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	to := t.network.lookup(addr)
+	if to == nil {
+		return len(b), nil
+	}
+	p := memPacket{append([]byte(nil), b...), t.addr}
+	select {
+	case to.in <- p:
+		return len(b), nil
+	case <-to.done:
+		return len(b), nil
+	case <-t.done:
+		return 0, ErrTransportClosed
+	}
+}
+
+// Leave the network, ending reads
+func (t *MemTransport) Close() error {
+	t.once.Do(func() {
+		t.network.Lock()
+		delete(t.network.transports, t.addr)
+		t.network.Unlock()
+		close(t.done)
+	})
+	return nil
+}
+
+func (t *MemTransport) LocalAddr() net.Addr {
+	return t.addr
+}
@@ -0,0 +1,261 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// The listeners a gateway has besides its UDP one, each
+// enabled by having an address, and as many more as configs
+// has
+type transports struct {
+	maxSize     int
+	outbound    int
+	dtlsAddress string
+	dtlsFiles   dtlsFiles
+	dtlsIdle    time.Duration
+	dtls        *dtlsListener
+	tcpAddress  string
+	tcpIdle     time.Duration
+	tcp         *tcpListener
+	unixPath    string
+	unixMode    os.FileMode
+	unix        *unixListener
+	serialDev   string
+	serialBaud  int
+	serial      *listener
+	configs     []listenerConfig
+	more        []gatewayListener
+	served      []*listener
+	conns       *connTable
+}
+
+func newTransports(gc *GatewayConfig) transports {
+	return transports{
+		gc.maxMessageSize(),
+		gc.maxoutbound,
+		gc.dtlsAddress(),
+		gc.dtlsFiles(),
+		gc.connectionIdleTimeout(),
+		nil,
+		gc.tcpAddress(),
+		gc.tcpIdleTimeout(),
+		nil,
+		gc.unixsocket,
+		gc.unixSocketMode(),
+		nil,
+		gc.serialdevice,
+		gc.serialBaud(),
+		nil,
+		gc.listeners,
+		nil,
+		nil,
+		newConnTable(gc.maxConnections()),
+	}
+}
+
+// Listen for g on each transport enabled. If one cannot be
+// listened on, those already listening are stopped.
+func (ts *transports) start(g Gateway) error {
+	if ts.dtlsAddress != "" {
+		d, err := listenDTLS(ts.dtlsAddress, ts.dtlsFiles, ts.dtlsIdle, ts.conns, ts.maxSize, g)
+		if err != nil {
+			return err
+		}
+		ts.dtls = d
+	}
+	if ts.tcpAddress != "" {
+		l, err := listenTCP(ts.tcpAddress, ts.tcpIdle, ts.conns, ts.maxSize, g)
+		if err != nil {
+			ts.stop(context.Background())
+			return err
+		}
+		ts.tcp = l
+	}
+	if ts.unixPath != "" {
+		l, err := listenUnix(ts.unixPath, ts.unixMode, ts.maxSize, g)
+		if err != nil {
+			ts.stop(context.Background())
+			return err
+		}
+		ts.unix = l
+	}
+	if ts.serialDev != "" {
+		st, err := openSerialTransport(ts.serialDev, ts.serialBaud)
+		if err != nil {
+			ts.stop(context.Background())
+			return err
+		}
+		ts.serial = newListener(g, ts.maxSize, st)
+	}
+	for _, l := range ts.listeners() {
+		l.stats().setOutbound(ts.outbound)
+	}
+	for _, lc := range ts.configs {
+		l, err := ts.open(lc, g)
+		if err != nil {
+			ts.stop(context.Background())
+			return fmt.Errorf("listener %s: %v", lc, err)
+		}
+		if lc.outbound > 0 {
+			l.stats().setOutbound(lc.outbound)
+		} else {
+			l.stats().setOutbound(ts.outbound)
+		}
+		l.stats().allowQosMinusOne(lc.qosMinusOne)
+		ts.more = append(ts.more, l)
+	}
+	return nil
+}
+
+// Listen for g as lc has it, with the options of its kind
+// where it has none of its own
+func (ts *transports) open(lc listenerConfig, g Gateway) (gatewayListener, error) {
+	size := ts.maxSize
+	if lc.maxSize > 0 {
+		size = lc.maxSize
+	}
+	switch lc.kind {
+	case "udp", "udp6":
+		address := lc.address
+		if host, port, err := net.SplitHostPort(address); err == nil && host == "" && lc.kind == "udp6" {
+			address = net.JoinHostPort("::", port)
+		}
+		l, err := listen(address, 1, size, nil, g)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	case "dtls":
+		l, err := listenDTLS(lc.address, ts.dtlsFiles.with(lc.dtls), ts.dtlsIdle, ts.conns, size, g)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	case "tcp":
+		l, err := listenTCP(lc.address, ts.tcpIdle, ts.conns, size, g)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	case "unix":
+		mode := ts.unixMode
+		if lc.mode != 0 {
+			mode = lc.mode
+		}
+		l, err := listenUnix(lc.address, mode, size, g)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	default:
+		baud := ts.serialBaud
+		if lc.baud > 0 {
+			baud = lc.baud
+		}
+		st, err := openSerialTransport(lc.address, baud)
+		if err != nil {
+			return nil, err
+		}
+		return newListener(g, size, st), nil
+	}
+}
+
+// Every listener open
+func (ts *transports) listeners() []gatewayListener {
+	var all []gatewayListener
+	if ts.dtls != nil {
+		all = append(all, ts.dtls)
+	}
+	if ts.tcp != nil {
+		all = append(all, ts.tcp)
+	}
+	if ts.unix != nil {
+		all = append(all, ts.unix)
+	}
+	if ts.serial != nil {
+		all = append(all, ts.serial)
+	}
+	all = append(all, ts.more...)
+	for _, l := range ts.served {
+		all = append(all, l)
+	}
+	return all
+}
+
+// The TCP connections and DTLS sessions open on every listener
+func (ts *transports) Connections() ConnectionStats {
+	return ts.conns.stats()
+}
+
+// Feed what t receives to g too, until stopped
+func (ts *transports) serve(t Transport, g Gateway) {
+	l := newListener(g, ts.maxSize, t)
+	l.counters.setOutbound(ts.outbound)
+	ts.served = append(ts.served, l)
+}
+
+// Stop listening on every transport, returning the first error
+func (ts *transports) stop(ctx context.Context) error {
+	var err error
+	for _, l := range ts.served {
+		if serr := l.stop(ctx); err == nil {
+			err = serr
+		}
+	}
+	ts.served = nil
+	for _, l := range ts.more {
+		if merr := l.stop(ctx); err == nil {
+			err = merr
+		}
+	}
+	ts.more = nil
+	if ts.dtls != nil {
+		if derr := ts.dtls.stop(ctx); err == nil {
+			err = derr
+		}
+		ts.dtls = nil
+	}
+	if ts.tcp != nil {
+		if terr := ts.tcp.stop(ctx); err == nil {
+			err = terr
+		}
+		ts.tcp = nil
+	}
+	if ts.unix != nil {
+		if uerr := ts.unix.stop(ctx); err == nil {
+			err = uerr
+		}
+		ts.unix = nil
+	}
+	if ts.serial != nil {
+		if serr := ts.serial.stop(ctx); err == nil {
+			err = serr
+		}
+		ts.serial = nil
+	}
+	return err
+}
+
+// Read the DTLS keys and certificates again, returning what puts
+// them to use; none are unless all can be read
+func (ts *transports) read() (func(), error) {
+	var apply []func()
+	for _, l := range ts.listeners() {
+		if d, ok := l.(*dtlsListener); ok {
+			a, err := d.read()
+			if err != nil {
+				return nil, err
+			}
+			apply = append(apply, a)
+		}
+	}
+	return func() {
+		for _, a := range apply {
+			a()
+		}
+	}, nil
+}
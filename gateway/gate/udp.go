@@ -1,23 +1,447 @@
 package gateway
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
+
+	. "github.com/alsm/gnatt/packets"
 )
 
+// Where replies to a client are written: the Transport, such as
+// the UDP socket a gateway listens on, shared by all of its
+// clients, or the client's own DTLS session or TCP connection,
+// and the largest packet that may be written to it, 0 for any.
+// The counters are those of the listener the client came
+// through, if any.
+type uConn struct {
+	c   replier
+	max int
+	l   *listenerCounters
+}
+
+type replier interface {
+	WriteTo(b []byte, addr net.Addr) (int, error)
+}
+
+// The remote address of an MQTT-SN client. A client with a
+// connection of its own (TCP) is known by its connection, so
+// its address is distinct from a UDP one.
+type uAddr struct {
+	r net.Addr
+}
+
+func (a uAddr) String() string {
+	switch r := a.r.(type) {
+	case nil:
+		return "<nil>"
+	case *net.UDPAddr:
+		return r.String()
+	default:
+		return r.Network() + ":" + r.String()
+	}
+}
+
+// The IP address of a, nil if it has none (a serial line or
+// unix socket)
+func (a uAddr) ip() net.IP {
+	switch r := a.r.(type) {
+	case *net.UDPAddr:
+		return r.IP
+	case *net.TCPAddr:
+		return r.IP
+	default:
+		return nil
+	}
+}
+
+// The host of a, its IP address if it has one
+func (a uAddr) host() string {
+	if ip := a.ip(); ip != nil {
+		return ip.String()
+	}
+	return a.String()
+}
+
+// Serialise m and send it to a, unless it is larger than the
+// connection allows
+func (c uConn) WriteTo(m Message, a uAddr) error {
+	msgType, to := m.MessageType(), a
+	m, a = encapsulate(m, a)
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		return err
+	}
+	if max := c.limit(); max > 0 && buf.Len() > max {
+		return ErrMessageTooLarge
+	}
+	if d := packetDumps.Load(); d != nil {
+		d.log("out", "", to, MessageNames[msgType], buf.Bytes())
+	}
+	if traces.active() {
+		if id := traces.at(to); id != "" {
+			tracePacket("out", id, to, MessageNames[msgType], buf.Bytes())
+		}
+	}
+	if cp := captures.Load(); cp != nil {
+		cp.packet(c.localAddr(), a.r, buf.Bytes())
+	}
+	_, err := c.c.WriteTo(buf.Bytes(), a.r)
+	if err == nil && c.l != nil {
+		c.l.sent(buf.Len())
+	}
+	return err
+}
+
+// Whether the connection is the client's own (TCP or DTLS),
+// which cannot be written to again once it has failed
+func (c uConn) stream() bool {
+	switch c.c.(type) {
+	case tcpConn, dtlsSession:
+		return true
+	}
+	return false
+}
+
+// The gateway's address on the connection
+func (c uConn) localAddr() net.Addr {
+	if l, ok := c.c.(interface{ LocalAddr() net.Addr }); ok {
+		return l.LocalAddr()
+	}
+	return nil
+}
+
+// The name of the listener the connection is on, "" if none
+func (c uConn) Listener() string {
+	if c.l == nil {
+		return ""
+	}
+	return c.l.name
+}
+
+// The largest packet that may be written to the connection, 0
+// for any: its own maximum, or its listener's limit on what is
+// sent to clients if that is smaller
+func (c uConn) limit() int {
+	if c.l == nil {
+		return c.max
+	}
+	if out := c.l.maxOutbound(); out > 0 && (c.max == 0 || out < c.max) {
+		return out
+	}
+	return c.max
+}
+
+// The size of m written to a, encapsulated if a is a node
+// behind a forwarder
+func (c uConn) size(m Message, a uAddr) int {
+	m, _ = encapsulate(m, a)
+	var buf bytes.Buffer
+	m.Write(&buf)
+	return buf.Len()
+}
+
+// Whether m is small enough to be written to a
+func (c uConn) fits(m Message, a uAddr) bool {
+	max := c.limit()
+	return max == 0 || c.size(m, a) <= max
+}
+
 func port2str(port int) string {
 	return fmt.Sprintf(":%d", port)
 }
 
-func listen(g Gateway) {
-	address, err := net.ResolveUDPAddr("udp", port2str(g.Port()))
-	chkerr(err)
-	udpconn, err := net.ListenUDP("udp", address)
-	chkerr(err)
+// The port of a "host:port" address, 0 if it has none
+func addrPort(addr string) int {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// The largest packet sent or received unless configured
+// otherwise, to stay within a typical MTU
+const defaultMaxMessageSize = 1400
+
+// The smallest maximum: a PUBLISH with one byte of payload
+const minMaxMessageSize = 8
+
+// Buffers for reading packets of up to size bytes, taken for
+// each read and given back once the packet has been handled.
+// Each has a byte to spare, so a larger packet fills it rather
+// than being cut to fit. Messages decoded from a buffer copy
+// what they keep of it, so none outlives OnPacket.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		b := make([]byte, size+1)
+		return &b
+	}
+	return p
+}
+
+func (p *bufferPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) put(b *[]byte) {
+	p.pool.Put(b)
+}
+
+// The most packets from one address that may wait to be
+// handled, any more read being dropped
+const sourceQueueLength = 64
+
+// A Transport feeding packets to a Gateway, a UDP (or unix
+// datagram) socket, or several sharing a port, each with a
+// reader of its own
+type listener struct {
+	sync.Mutex
+	conns     []Transport
+	inherited bool
+	buffers   *bufferPool
+	counters  *listenerCounters
+	// the packets read and waiting to be handled, by the address
+	// they are from, present while one from it is being handled
+	queues map[string][]inbound
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// A packet read by a listener, to be handled
+type inbound struct {
+	buffer *[]byte
+	n      int
+	conn   uConn
+	addr   uAddr
+}
+
+// The network to listen on addr with: IPv4 or IPv6 for an
+// address of either, both for none
+func network(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return "udp"
+	}
+	if ip := parseIP(host); ip != nil && ip.To4() == nil {
+		return "udp6"
+	}
+	return "udp4"
+}
+
+// Listen on addr, "host:port" or ":port", for packets for g,
+// with the given number of sockets sharing the port where the
+// platform allows it (SO_REUSEPORT), one otherwise. Each
+// client's packets are handled one at a time, in the order they
+// were read, while different clients' are handled at once; the
+// kernel gives each socket the packets of the same clients, so
+// that is the order they arrived in. Packets larger than
+// size are dropped, and none larger is sent. A socket passed by
+// systemd is used instead of binding one. Sockets bound to every
+// address reply from the one each client sent to. Unless faults
+// is nil they are injected into every packet, for soak tests.
+func listen(addr string, readers, size int, faults *Faults, g Gateway) (*listener, error) {
+	conns, inherited, err := bindUDP(addr, readers)
+	if err != nil {
+		return nil, err
+	}
+	for i, conn := range conns {
+		if !unspecified(conn) {
+			continue
+		}
+		c, err := newPktinfoConn(conn.(*net.UDPConn))
+		if err != nil {
+			ERROR.Printf("replies on %s may come from another address: %v\n", conn.LocalAddr(), err)
+			break
+		}
+		conns[i] = c
+	}
+	if faults != nil {
+		ERROR.Printf("injecting faults into the packets on %s: %+v\n", conns[0].LocalAddr(), *faults)
+		for i, conn := range conns {
+			f := *faults
+			f.Seed += int64(i)
+			conns[i] = NewFaultyTransport(conn, f)
+		}
+	}
+	l := newListener(g, size, conns...)
+	l.inherited = inherited
+	return l, nil
+}
+
+// The sockets to listen on addr with, and whether systemd
+// passed them
+func bindUDP(addr string, readers int) ([]Transport, bool, error) {
+	if conn, err := inheritedUDP(addr); err != nil {
+		return nil, false, err
+	} else if conn != nil {
+		INFO.Printf("listening on %s, passed by systemd\n", conn.LocalAddr())
+		if readers > 1 {
+			ERROR.Printf("one reader for the socket passed by systemd, not %d\n", readers)
+		}
+		return []Transport{conn}, true, nil
+	}
+	nw := network(addr)
+	address, err := net.ResolveUDPAddr(nw, addr)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid listen address %s: %v", addr, err)
+	}
+	if readers > 1 {
+		conns, err := listenReusePort(nw, address, readers)
+		if err == nil {
+			INFO.Printf("listening on %s with %d readers\n", conns[0].LocalAddr(), readers)
+			return conns, false, nil
+		}
+		ERROR.Printf("cannot listen on %s with %d readers, using one: %v\n", addr, readers, err)
+	}
+	udpconn, err := net.ListenUDP(nw, address)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot listen on %s: %v", addr, err)
+	}
+	INFO.Printf("listening on %s\n", udpconn.LocalAddr())
+	return []Transport{udpconn}, false, nil
+}
+
+// Feed the packets of up to size bytes each of conns receives
+// to g, replying on the transport each came from
+func newListener(g Gateway, size int, conns ...Transport) *listener {
+	l := &listener{
+		conns:    conns,
+		buffers:  newBufferPool(size),
+		counters: newListenerCounters(conns[0].LocalAddr().Network(), conns[0].LocalAddr()),
+		queues:   make(map[string][]inbound),
+		done:     make(chan struct{}),
+	}
+	for _, conn := range conns {
+		l.wg.Add(1)
+		go l.serve(conn, g)
+	}
+	return l
+}
+
+// The address listened on
+func (l *listener) addr() net.Addr {
+	return l.conns[0].LocalAddr()
+}
+
+func (l *listener) port() int {
+	return addrPort(l.addr().String())
+}
+
+func (l *listener) stats() *listenerCounters {
+	return l.counters
+}
+
+// The address listened on, and whether systemd passed the socket
+func (l *listener) String() string {
+	if l.inherited {
+		return l.addr().String() + " (systemd)"
+	}
+	return l.addr().String()
+}
+
+func (l *listener) serve(conn Transport, g Gateway) {
+	defer l.wg.Done()
+	for {
+		buffer := l.buffers.get()
+		n, remote, reply, err := readPacket(conn, *buffer)
+		if err != nil {
+			l.buffers.put(buffer)
+			select {
+			case <-l.done:
+				return
+			default:
+				ERROR.Println(err)
+				continue
+			}
+		}
+		if remote == nil || remote.String() == "" {
+			// an unbound unix socket, which cannot be answered
+			ERROR.Printf("dropping a packet from an unnamed socket on %s\n", conn.LocalAddr())
+			l.buffers.put(buffer)
+			continue
+		}
+		l.counters.received(n)
+		if !g.admit(uAddr{remote}) {
+			l.buffers.put(buffer)
+			continue
+		}
+		if n > l.buffers.size {
+			g.oversized(uAddr{remote}, l.buffers.size)
+			l.buffers.put(buffer)
+			continue
+		}
+		l.dispatch(inbound{buffer, n, uConn{reply, l.buffers.size, l.counters}, uAddr{remote}}, g)
+	}
+}
+
+// Queue p behind the packets from its address waiting to be
+// handled, or start handling those from it with p if there are
+// none, dropping it if too many are waiting
+func (l *listener) dispatch(p inbound, g Gateway) {
+	key := p.addr.String()
+	l.Lock()
+	if queue, ok := l.queues[key]; ok {
+		if len(queue) >= sourceQueueLength {
+			l.Unlock()
+			l.buffers.put(p.buffer)
+			return
+		}
+		l.queues[key] = append(queue, p)
+		l.Unlock()
+		return
+	}
+	l.queues[key] = nil
+	l.wg.Add(1)
+	l.Unlock()
+	go l.handle(key, p, g)
+}
+
+// Handle p and then each packet queued from the same address in
+// turn, until none is left
+func (l *listener) handle(key string, p inbound, g Gateway) {
+	defer l.wg.Done()
 	for {
-		buffer := make([]byte, 1024)
-		n, remote, err := udpconn.ReadFromUDP(buffer)
-		chkerr(err)
-		go g.OnPacket(n, buffer, udpconn, remote)
+		g.OnPacket(p.n, (*p.buffer)[:p.n], p.conn, p.addr)
+		l.buffers.put(p.buffer)
+		l.Lock()
+		queue := l.queues[key]
+		if len(queue) == 0 {
+			delete(l.queues, key)
+			l.Unlock()
+			return
+		}
+		p, l.queues[key] = queue[0], queue[1:]
+		l.Unlock()
+	}
+}
+
+// Close the sockets and wait until every packet already read
+// has been handled, or until ctx is done
+func (l *listener) stop(ctx context.Context) error {
+	close(l.done)
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	finished := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
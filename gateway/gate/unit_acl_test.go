@@ -0,0 +1,183 @@
+package gateway
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// An ACL read from rules, denying what no rule matches
+func testACL(t *testing.T, rules string) *acl {
+	file := filepath.Join(t.TempDir(), "acl")
+	os.WriteFile(file, []byte(rules), 0644)
+	a, err := newACL(&GatewayConfig{aclfile: file})
+	if err != nil {
+		t.Fatalf("newACL: %v", err)
+	}
+	return a
+}
+
+func Test_acl(t *testing.T) {
+	a := testACL(t, `
+# the fleet
+sensor-*   publish    site42/sensors/%c/#   allow
+sensor-*   subscribe  site42/cmd/%c/#       allow
+sensor-13  all        #                     deny
+*          subscribe  site42/cmd/all        allow
+admin      all        site42/#              allow
+`)
+	for _, c := range []struct {
+		id, action, topic string
+		allowed           bool
+	}{
+		{"sensor-17", aclPublish, "site42/sensors/sensor-17/temp", true},
+		{"sensor-17", aclPublish, "site42/sensors/sensor-17", true},
+		{"sensor-17", aclPublish, "site42/sensors/sensor-18/temp", false},
+		{"sensor-17", aclPublish, "site42/cmd/sensor-17/reset", false},
+		{"sensor-17", aclSubscribe, "site42/cmd/sensor-17/#", true},
+		{"sensor-17", aclSubscribe, "site42/cmd/sensor-17/+/x", true},
+		{"sensor-17", aclSubscribe, "site42/cmd/+/reset", false},
+		{"sensor-17", aclSubscribe, "site42/cmd/#", false},
+		{"sensor-17", aclSubscribe, "site42/sensors/sensor-17/#", false},
+		{"sensor-17", aclSubscribe, "site42/cmd/all", true},
+		// the first rule matching wins
+		{"sensor-13", aclPublish, "site42/sensors/sensor-13/temp", true},
+		{"sensor-13", aclPublish, "site42/other", false},
+		{"sensor-13", aclSubscribe, "site42/cmd/all", false},
+		// an id that would widen the filter matches no %c rule
+		{"sensor-#", aclPublish, "site42/sensors/x", false},
+		{"sensor-a/b", aclPublish, "site42/sensors/sensor-a/b", false},
+		{"admin", aclSubscribe, "site42/+/sensor-17/#", true},
+		{"admin", aclSubscribe, "#", false},
+		{"admin", aclPublish, "$SYS/x", false},
+		{"other", aclPublish, "site42/sensors/other", false},
+	} {
+		if a.allows(c.id, c.action, c.topic) != c.allowed {
+			t.Errorf("expected %s to %s %s allowed %v", c.id, c.action, c.topic, c.allowed)
+		}
+	}
+	if !(*acl)(nil).allows("any", aclPublish, "any") {
+		t.Fatalf("expected everything allowed without an ACL")
+	}
+}
+
+// A deny rule stops a subscription that may match any topic it
+// denies, an allow rule allows only those it covers
+func Test_acl_wildcards(t *testing.T) {
+	a := testACL(t, `
+*  subscribe  a/secret/#  deny
+*  subscribe  a/#         allow
+`)
+	for topic, allowed := range map[string]bool{
+		"a/public":     true,
+		"a/+/x":        false,
+		"a/#":          false,
+		"a/secret":     false,
+		"a/secrets/#":  true,
+		"+/public":     false,
+		"a/public/#":   true,
+		"$SYS/#":       false,
+		"a/secret/+/y": false,
+	} {
+		if a.allows("c", aclSubscribe, topic) != allowed {
+			t.Errorf("expected a subscription to %s allowed %v", topic, allowed)
+		}
+	}
+	for _, c := range []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"a/+", "+/b", true},
+		{"a/#", "a", true},
+		{"a/b", "a/b/c", false},
+		{"a/+/c", "a/b/#", true},
+		{"$SYS/#", "#", false},
+		{"a/b", "a/c", false},
+	} {
+		if filtersOverlap(c.a, c.b) != c.overlap || filtersOverlap(c.b, c.a) != c.overlap {
+			t.Errorf("expected %s and %s to overlap %v", c.a, c.b, c.overlap)
+		}
+	}
+
+	allowing := testACL(t, "*  publish  a/#  deny\n")
+	allowing.allow = true
+	if allowing.allows("c", aclPublish, "a/b") || !allowing.allows("c", aclPublish, "b") {
+		t.Fatalf("expected what no rule matches allowed given acl-default allow")
+	}
+	for _, rules := range []string{"c publish a", "c write a allow", "c publish a/#/b allow", "c[ publish a allow"} {
+		file := filepath.Join(t.TempDir(), "acl")
+		os.WriteFile(file, []byte(rules), 0644)
+		if _, err := newACL(&GatewayConfig{aclfile: file}); err != ErrInvalidACL {
+			t.Errorf("expected %q refused, got %v", rules, err)
+		}
+	}
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("acl-default maybe"); err != ErrInvalidACLDefault {
+		t.Fatalf("expected %v, got %v", ErrInvalidACLDefault, err)
+	}
+}
+
+// What the ACL denies is answered "rejected: not supported" in
+// each of the paths a topic comes through, and counted
+func Test_acl_paths(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.mqttclient = &fakeBroker{}
+	ag.acl.Store(testACL(t, "fake  all  allowed/#  allow\n"))
+
+	ag.handle_REGISTER(NewRegisterMessage(0, 1, []byte("denied")), client)
+	if m := f.expect(REGACK).(*RegackMessage); m.ReturnCode != REJ_NOT_SUPORTED || m.TopicId != 0 {
+		t.Fatalf("expected the REGISTER rejected, got %+v", m)
+	}
+	ag.handle_REGISTER(NewRegisterMessage(0, 2, []byte("allowed/a")), client)
+	if m := f.expect(REGACK).(*RegackMessage); m.ReturnCode != ACCEPTED {
+		t.Fatalf("expected the REGISTER accepted, got %+v", m)
+	}
+
+	ag.tIndex.addPredefined([]predefinedTopic{{7, "denied"}})
+	pm := NewMessage(PUBLISH).(*PublishMessage)
+	pm.TopicIdType, pm.TopicId, pm.MessageId, pm.Qos = topicIdPredefined, 7, 3, 1
+	ag.handle_PUBLISH(pm, client)
+	if m := f.expect(PUBACK).(*PubackMessage); m.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("expected the PUBLISH rejected, got %+v", m)
+	}
+
+	ag.handle_SUBSCRIBE(subscribeMessage("denied/#", 4, 1), client)
+	if m := f.expect(SUBACK).(*SubackMessage); m.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("expected the SUBSCRIBE rejected, got %+v", m)
+	}
+
+	wu := NewMessage(WILLTOPICUPD).(*WillTopicUpdateMessage)
+	wu.WillTopic = []byte("denied")
+	ag.handle_WILLTOPICUPD(wu, client)
+	if m := f.expect(WILLTOPICRESP).(*WillTopicRespMessage); m.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("expected the will topic rejected, got %+v", m)
+	}
+
+	if client.ACLDenials() != 4 || ag.ACLDenied() != 4 {
+		t.Fatalf("expected 4 denials counted, got %d and %d", client.ACLDenials(), ag.ACLDenied())
+	}
+}
+
+// A CONNECT whose will topic is denied is refused
+func Test_acl_will(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.mqttclient = &fakeBroker{}
+	ag.acl.Store(testACL(t, "*  publish  wills/%c  allow\n"))
+	ag.clients.RemoveClient(client.Address)
+
+	ag.handle(connectMessage("w", true), client.Conn, f.addr())
+	f.expect(WILLTOPICREQ)
+	wt := NewMessage(WILLTOPIC).(*WillTopicMessage)
+	wt.WillTopic = []byte("wills/other")
+	ag.handle(wt, client.Conn, f.addr())
+	if m := f.expect(CONNACK).(*ConnackMessage); m.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("expected the CONNECT refused, got %d", m.ReturnCode)
+	}
+	if ag.clients.GetClient(f.addr()) != nil {
+		t.Fatalf("expected no session")
+	}
+}
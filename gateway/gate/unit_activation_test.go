@@ -0,0 +1,98 @@
+//go:build linux
+// +build linux
+
+package gateway
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// Pass files as systemd would, named names, from fd 200 on
+func activate(t *testing.T, names string, files ...*os.File) {
+	listenFdsStart = 200
+	for i, f := range files {
+		if err := unix.Dup3(int(f.Fd()), listenFdsStart+i, 0); err != nil {
+			t.Fatalf("Dup3: %v", err)
+		}
+		f.Close()
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", strconv.Itoa(len(files)))
+	os.Setenv("LISTEN_FDNAMES", names)
+	activation.read, activation.files = false, nil
+	t.Cleanup(func() {
+		for _, f := range activation.files {
+			f.Close()
+		}
+		activation.read, activation.files = false, nil
+		listenFdsStart = 3
+	})
+}
+
+func Test_socket_activation(t *testing.T) {
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	tcp, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+	udpaddr, tcpaddr := udp.LocalAddr().String(), tcp.Addr().String()
+	udpfile, _ := udp.File()
+	tcpfile, _ := tcp.File()
+	udp.Close()
+	tcp.Close()
+	// the UDP socket by its kind, the TCP one by its name
+	activate(t, "gnatt.socket:tcp", udpfile, tcpfile)
+
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1", port: 1, tcpport: 1})
+	ag.mqttclient = &fakeBroker{}
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatalf("expected the environment to be cleared")
+	}
+	if ag.Addr() != udpaddr+" (systemd)" || ag.Port() != addrPort(udpaddr) {
+		t.Fatalf("listening on %s, port %d, not %s", ag.Addr(), ag.Port(), udpaddr)
+	}
+	if ag.transports.tcp.ln.Addr().String() != tcpaddr {
+		t.Fatalf("listening for TCP on %v, not %s", ag.transports.tcp.ln.Addr(), tcpaddr)
+	}
+
+	raddr, _ := net.ResolveUDPAddr("udp", udpaddr)
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	defer c.Close()
+	pingUDP(t, c, packet(NewMessage(PINGREQ)))
+}
+
+func Test_socket_activation_mismatch(t *testing.T) {
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	f, _ := udp.File()
+	udp.Close()
+	activate(t, "udp", f)
+
+	ag := NewAGateway(&GatewayConfig{bindaddress: "::1", port: 1})
+	ag.mqttclient = &fakeBroker{}
+	if err := ag.Start(); err == nil || !strings.Contains(err.Error(), ErrActivationMismatch.Error()) {
+		ag.Stop(context.Background())
+		t.Fatalf("expected %v, got %v", ErrActivationMismatch, err)
+	}
+}
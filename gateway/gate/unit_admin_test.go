@@ -0,0 +1,316 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// Start the gateway's admin listener on a port of the system's
+// choosing, returning its URL
+func startAdmin(t *testing.T, a *admin) string {
+	a.address = "127.0.0.1:0"
+	if err := a.start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { a.stop(context.Background()) })
+	return "http://" + a.Addr().String()
+}
+
+// GET url, decoding what it answers into v
+func getJSON(t *testing.T, url string, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+}
+
+func Test_admin_vars(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.handle_REGISTER(registerMessage("a", 1), client)
+	f.expect(REGACK)
+	subscribe(ag, client, "a", 0)
+	client.limits.queue = 1
+	sleep(ag, f)
+	ag.distribute(&fakeMessage{"a", []byte{1}, 0})
+	ag.distribute(&fakeMessage{"a", []byte{2}, 0})
+	url := startAdmin(t, ag.admin)
+
+	var vars struct {
+		Cmdline []string
+		Gnatt   struct {
+			Clients int
+			Topics  int
+			Traffic map[string]uint64
+			Dropped map[string]uint64
+			Limits  []LimitUsage
+			Broker  map[string]interface{}
+			Brokers []map[string]interface{}
+		}
+	}
+	getJSON(t, url+"/debug/vars", &vars)
+	g := vars.Gnatt
+	if len(vars.Cmdline) == 0 || g.Clients != 1 || g.Topics != 1 {
+		t.Fatalf("expected the command line, 1 client and 1 topic, got %+v", vars)
+	}
+	if g.Dropped["client_queue"] != 1 || g.Dropped["oversized_packets"] != 0 {
+		t.Fatalf("expected 1 PUBLISH dropped from a full queue, got %v", g.Dropped)
+	}
+	if _, ok := g.Traffic["packets_in"]; !ok || len(g.Limits) == 0 {
+		t.Fatalf("expected the traffic and limits, got %v and %v", g.Traffic, g.Limits)
+	}
+	if len(g.Brokers) != 1 || g.Brokers[0]["state"] != "disconnected" || g.Broker["offline_queue"] != 0.0 {
+		t.Fatalf("expected the broker disconnected, got %v and %v", g.Brokers, g.Broker)
+	}
+
+	if err := ag.admin.stop(context.Background()); err != nil || ag.admin.Addr() != nil {
+		t.Fatalf("expected the listener stopped, got %v", err)
+	}
+}
+
+func Test_admin_api(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.handle_REGISTER(registerMessage("a/b", 1), client)
+	f.expect(REGACK)
+	subscribe(ag, client, "a/#", 1)
+	ag.admin.token = "secret"
+	url := startAdmin(t, ag.admin)
+
+	if resp, err := http.Get(url + "/clients"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a request without the token refused, got %v", err)
+	}
+	ag.admin.token = ""
+	ag.admin.stop(context.Background())
+	url = startAdmin(t, ag.admin)
+
+	var clients []clientInfo
+	getJSON(t, url+"/clients", &clients)
+	if len(clients) != 1 || clients[0].Id != "fake" || clients[0].State != "active" || clients[0].Subscribed != nil {
+		t.Fatalf("expected the active client without detail, got %+v", clients)
+	}
+	var detail clientInfo
+	getJSON(t, url+"/clients/fake", &detail)
+	if detail.Subscribed["a/#"] != 1 || detail.Registered[1] != "a/b" || detail.LastSeen.IsZero() {
+		t.Fatalf("expected its subscription and topic, got %+v", detail)
+	}
+	if resp, err := http.Get(url + "/clients/nobody"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected an unknown client not found, got %v", err)
+	}
+	var topics []topicInfo
+	getJSON(t, url+"/topics", &topics)
+	if len(topics) != 1 || topics[0] != (topicInfo{1, "a/b", false}) {
+		t.Fatalf("expected topic 1 a/b, got %+v", topics)
+	}
+	var subs map[string][]string
+	getJSON(t, url+"/subscriptions", &subs)
+	if len(subs) != 1 || len(subs["a/#"]) != 1 || subs["a/#"][0] != "fake" {
+		t.Fatalf("expected fake subscribed to a/#, got %v", subs)
+	}
+	if resp, err := http.Post(url+"/topics", "application/json", nil); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected POST refused, got %v", err)
+	}
+}
+
+// A transparent gateway's subscriptions are those of its
+// clients' broker connections
+func Test_admin_subscriptions_transparent(t *testing.T) {
+	tg, c, _ := newTestTGateway(t)
+	f, g := newFakeClient(t), newFakeClient(t)
+	tconnect(t, tg, c, f, "f").Subscribe("a", 0)
+	tconnect(t, tg, c, g, "g").Subscribe("a", 1)
+	if subs := tg.subscriptions(); len(subs) != 1 || strings.Join(subs["a"], ",") != "f,g" {
+		t.Fatalf("expected f and g subscribed to a, got %v", subs)
+	}
+}
+
+func Test_admin_disconnect(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	url := startAdmin(t, ag.admin)
+
+	if resp, err := http.Get(url + "/clients/fake/disconnect"); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected GET refused, got %v", err)
+	}
+	if resp, err := http.Post(url+"/clients/fake/disconnect?ban=soon", "", nil); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected an invalid ban refused, got %v", err)
+	}
+	if resp, err := http.Post(url+"/clients/nobody/disconnect", "", nil); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected an unknown client not found, got %v", err)
+	}
+	if resp, err := http.Post(url+"/clients/fake/disconnect?ban=1h", "", nil); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected the client disconnected, got %v", err)
+	}
+	f.expect(DISCONNECT)
+	if ag.clients.GetClient(f.addr()) != nil {
+		t.Fatalf("expected the client's session ended")
+	}
+
+	// banned by id, and by address whatever the id
+	for _, id := range []string{"fake", "other"} {
+		ag.handle(connectMessage(id, false), client.Conn, f.addr())
+		if ca := f.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != REJ_NOT_SUPORTED {
+			t.Fatalf("expected %s refused while banned, got rc %d", id, ca.ReturnCode)
+		}
+	}
+	if ag.clients.GetClient(f.addr()) != nil {
+		t.Fatalf("expected no client while banned")
+	}
+}
+
+// Without admin-token a listener not on loopback refuses the
+// requests that change anything, and serves the rest
+func Test_admin_no_token(t *testing.T) {
+	f := newFakeClient(t)
+	ag, _ := newTestAGateway(t, f)
+	for _, r := range []struct {
+		address, method, path string
+		status                int
+	}{
+		{":6060", http.MethodGet, "/clients", http.StatusOK},
+		{":6060", http.MethodPost, "/publish", http.StatusForbidden},
+		{":6060", http.MethodPost, "/clients/fake/disconnect", http.StatusForbidden},
+		{":6060", http.MethodPost, "/debug/packets?enable=false", http.StatusForbidden},
+		{":6060", http.MethodPost, "/debug/capture?enable=false", http.StatusForbidden},
+		{":6060", http.MethodPost, "/debug/trace?client=c&enable=false", http.StatusForbidden},
+		{"192.0.2.1:6060", http.MethodPost, "/debug/trace?client=c&enable=false", http.StatusForbidden},
+		{"127.0.0.1:6060", http.MethodPost, "/debug/trace?client=c&enable=false", http.StatusOK},
+		{"localhost:6060", http.MethodPost, "/debug/trace?client=c&enable=false", http.StatusOK},
+	} {
+		ag.admin.address = r.address
+		w := httptest.NewRecorder()
+		ag.admin.authorize(ag.admin.mux).ServeHTTP(w, httptest.NewRequest(r.method, r.path, nil))
+		if w.Code != r.status {
+			t.Errorf("%s %s on %s: expected %d, got %d", r.method, r.path, r.address, r.status, w.Code)
+		}
+	}
+	f.expectNothing()
+	if ag.clients.GetClient(f.addr()) == nil {
+		t.Fatalf("expected the client still connected")
+	}
+}
+
+func Test_bans_expire(t *testing.T) {
+	b := newBans()
+	f, g := newFakeClient(t), newFakeClient6(t)
+	now := time.Now()
+	b.ban("f", f.addr(), now.Add(time.Minute))
+	if !b.banned("f", g.addr(), now) || !b.banned("g", f.addr(), now) || b.banned("g", g.addr(), now) {
+		t.Fatalf("expected f's id and address banned, and nothing else")
+	}
+	if b.banned("f", f.addr(), now.Add(time.Minute)) || len(b.ids) != 0 || len(b.addrs) != 0 {
+		t.Fatalf("expected the ban expired and forgotten")
+	}
+}
+
+// POST body to url as JSON, decoding what it answers into v if
+// it is OK, returning its status
+func postJSON(t *testing.T, url, body string, v interface{}) int {
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("POST %s: %v", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func Test_admin_publish(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.handle_REGISTER(registerMessage("a/b", 1), client)
+	f.expect(REGACK)
+	subscribe(ag, client, "a/#", 1)
+	url := startAdmin(t, ag.admin) + "/publish"
+
+	var answer struct{ Targeted int }
+	if status := postJSON(t, url, `{"topic": "a/b", "payload": "aGk=", "encoding": "base64", "qos": 2}`, &answer); status != http.StatusOK || answer.Targeted != 1 {
+		t.Fatalf("expected 1 client targeted, got %d %+v", status, answer)
+	}
+	if pm := f.expect(PUBLISH).(*PublishMessage); pm.TopicId != 1 || pm.Qos != 1 || string(pm.Data) != "hi" {
+		t.Fatalf("expected hi on topic 1 at the subscription's QoS 1, got %+v", pm)
+	}
+	if status := postJSON(t, url, `{"topic": "c", "payload": "hi"}`, &answer); status != http.StatusOK || answer.Targeted != 0 {
+		t.Fatalf("expected no client targeted, got %d %+v", status, answer)
+	}
+	for _, body := range []string{
+		`{"topic": "a/+", "payload": "hi"}`,
+		`{"topic": "a/#", "payload": "hi"}`,
+		`{"topic": "", "payload": "hi"}`,
+		`{"topic": "a/b", "payload": "hi", "qos": 3}`,
+		`{"topic": "a/b", "payload": "!", "encoding": "base64"}`,
+		`{"topic": "a/b", "payload": "hi", "encoding": "hex"}`,
+		`not json`,
+	} {
+		if status := postJSON(t, url, body, &answer); status != http.StatusBadRequest {
+			t.Fatalf("expected %s refused, got %d", body, status)
+		}
+	}
+	f.expectNothing()
+}
+
+func Test_admin_packet_dump(t *testing.T) {
+	f := newFakeClient(t)
+	ag, _ := newTestAGateway(t, f)
+	url := startAdmin(t, ag.admin) + "/debug/packets"
+	defer setPacketDump(nil)
+
+	var dump packetDumpInfo
+	if status := postJSON(t, url+"?enable=true&client=fake", "", &dump); status != http.StatusOK || dump != (packetDumpInfo{true, "fake", ""}) {
+		t.Fatalf("expected the packets of fake dumped, got %d %+v", status, dump)
+	}
+	getJSON(t, url, &dump)
+	if d := packetDumps.Load(); d == nil || d.clientId != "fake" || !dump.Enabled {
+		t.Fatalf("expected the dump set, got %+v", dump)
+	}
+	if status := postJSON(t, url+"?enable=yes", "", &dump); status != http.StatusBadRequest {
+		t.Fatalf("expected enable=yes refused, got %d", status)
+	}
+	if status := postJSON(t, url+"?enable=false", "", &dump); status != http.StatusOK || dump.Enabled || packetDumps.Load() != nil {
+		t.Fatalf("expected the dump off, got %d %+v", status, dump)
+	}
+}
+
+func Test_admin_pprof(t *testing.T) {
+	f := newFakeClient(t)
+	ag, _ := newTestAGateway(t, f)
+	url := startAdmin(t, ag.admin)
+	if resp, err := http.Get(url + "/debug/pprof/"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected no profiles unless asked for, got %v", err)
+	}
+
+	ag.admin.stop(context.Background())
+	ag.admin.servePprof(5, 0)
+	defer runtime.SetMutexProfileFraction(0)
+	url = startAdmin(t, ag.admin)
+	for _, profile := range []string{"goroutine", "heap", "mutex", "block"} {
+		resp, err := http.Get(url + "/debug/pprof/" + profile + "?debug=1")
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the %s profile, got %v", profile, err)
+		}
+		resp.Body.Close()
+	}
+	if fraction := runtime.SetMutexProfileFraction(-1); fraction != 5 {
+		t.Fatalf("expected the mutex profile fraction 5, got %d", fraction)
+	}
+}
@@ -0,0 +1,835 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// A token that has already completed
+type fakeToken struct {
+	MQTT.Token
+	err            error
+	rc             byte
+	timeout        bool
+	granted        map[string]byte
+	sessionPresent bool
+}
+
+func (t *fakeToken) ReturnCode() byte        { return t.rc }
+func (t *fakeToken) Result() map[string]byte { return t.granted }
+func (t *fakeToken) SessionPresent() bool    { return t.sessionPresent }
+
+func (t *fakeToken) Wait() bool                     { return true }
+func (t *fakeToken) WaitTimeout(time.Duration) bool { return !t.timeout }
+func (t *fakeToken) Error() error                   { return t.err }
+
+// A broker that accepts everything, recording what it is sent
+type fakeBroker struct {
+	connected     bool
+	connectErr    error
+	connectRc     byte
+	connectHangs  bool
+	publishHangs  bool
+	refusals      int // connects refused before connectErr applies
+	published     []fakeMessage
+	subscriptions map[string]MQTT.MessageHandler
+	subscribed    []string // every filter subscribed to, in order
+	subscribeErr  error
+	lost          MQTT.ConnectionLostHandler
+	grant         map[string]byte
+	keptSession   bool
+	retained      map[string][]byte
+}
+
+func (b *fakeBroker) Connect() MQTT.Token {
+	if b.refusals > 0 {
+		b.refusals--
+		return &fakeToken{err: ErrBrokerTimeout}
+	}
+	if b.connectHangs {
+		// a connect never answered fails in the end
+		return &fakeToken{err: ErrBrokerTimeout, timeout: true}
+	}
+	b.connected = b.connectErr == nil
+	return &fakeToken{err: b.connectErr, rc: b.connectRc, sessionPresent: b.keptSession}
+}
+
+func (b *fakeBroker) Disconnect(quiesce uint) {
+	b.connected = false
+}
+
+func (b *fakeBroker) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	b.published = append(b.published, fakeMessage{topic, payload.([]byte), qos})
+	if retained {
+		if b.retained == nil {
+			b.retained = make(map[string][]byte)
+		}
+		if len(payload.([]byte)) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload.([]byte)
+		}
+	}
+	return &fakeToken{timeout: b.publishHangs}
+}
+
+func (b *fakeBroker) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	if b.subscribeErr != nil {
+		return &fakeToken{err: b.subscribeErr}
+	}
+	if b.subscriptions == nil {
+		b.subscriptions = make(map[string]MQTT.MessageHandler)
+	}
+	b.subscribed = append(b.subscribed, topic)
+	if g, ok := b.grant[topic]; ok && g == 0x80 {
+		return &fakeToken{granted: b.grant}
+	}
+	b.subscriptions[topic] = callback
+	return &fakeToken{granted: b.grant}
+}
+
+func (b *fakeBroker) Unsubscribe(topics ...string) MQTT.Token {
+	for _, topic := range topics {
+		delete(b.subscriptions, topic)
+	}
+	return &fakeToken{}
+}
+
+func (b *fakeBroker) IsConnected() bool {
+	return b.connected
+}
+
+// Drop the connection as if the broker had closed it
+func (b *fakeBroker) drop(err error) {
+	b.connected = false
+	b.lost(nil, err)
+}
+
+// Send msg to whoever subscribed to filter
+func (b *fakeBroker) deliver(filter string, msg *fakeMessage) {
+	b.subscriptions[filter](nil, msg)
+}
+
+// Send the retained messages matching filter to whoever just
+// subscribed to it
+func (b *fakeBroker) deliverRetained(filter string) {
+	for topic, payload := range b.retained {
+		if TopicMatches(filter, topic) {
+			b.subscriptions[filter](nil, retainedMessage{&fakeMessage{topic, payload, 0}})
+		}
+	}
+}
+
+// A broker message sent as the retained message of its topic
+type retainedMessage struct {
+	*fakeMessage
+}
+
+func (m retainedMessage) Retained() bool { return true }
+
+func Test_AGateway_Stop(t *testing.T) {
+	before := runtime.NumGoroutine()
+	broker := &fakeBroker{}
+	ag := NewAGateway(&GatewayConfig{disconnectonstop: true})
+	ag.mqttclient = broker
+
+	for i := 0; i < 2; i++ {
+		if err := ag.Start(); err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		f := newFakeClient(t)
+		port := ag.listener.addr().(*net.UDPAddr).Port
+		gw := uAddr{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}
+		if err := (uConn{f.conn, 0, nil}).WriteTo(connectMessage("stopper", false), gw); err != nil {
+			t.Fatalf("WriteTo: %v", err)
+		}
+		f.expect(CONNACK)
+		subscribe(ag, ag.clients.GetClient(f.addr()).(*Client), "a", 1)
+		ag.distribute(&fakeMessage{"a", []byte{1}, 1})
+		f.expect(REGISTER)
+
+		if err := ag.Stop(context.Background()); err != nil {
+			t.Fatalf("Stop: %v", err)
+		}
+		f.expect(DISCONNECT)
+		f.conn.Close()
+		if broker.connected {
+			t.Fatalf("still connected to the broker")
+		}
+		if ag.clients.Len() != 0 {
+			t.Fatalf("%d clients remain", ag.clients.Len())
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("%d goroutines before Start, %d after Stop", before, n)
+	}
+}
+
+// The broker connection's state is followed through a failed
+// start, a start, a lost connection made again and a stop, and
+// a publish the broker does not answer in time is refused
+func Test_AGateway_broker_state(t *testing.T) {
+	defer func(i time.Duration) { reconnectInterval = i }(reconnectInterval)
+	reconnectInterval = 10 * time.Millisecond
+
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1"})
+	broker := &fakeBroker{connectHangs: true}
+	broker.lost = func(c *MQTT.Client, err error) { ag.brokerLost(err) }
+	ag.mqttclient = broker
+	if s := ag.BrokerState(); s.State != BrokerDisconnected || s.LastError != nil {
+		t.Fatalf("expected disconnected before starting, got %+v", s)
+	}
+	if err := ag.Start(); err != ErrBrokerTimeout {
+		t.Fatalf("expected Start to fail with %v, got %v", ErrBrokerTimeout, err)
+	}
+	if s := ag.BrokerState(); s.State != BrokerDisconnected || s.LastError != ErrBrokerTimeout {
+		t.Fatalf("expected disconnected after timing out, got %+v", s)
+	}
+
+	states := make(chan BrokerState, 10)
+	ag.SetHooks(Hooks{OnBrokerState: func(s BrokerState) { states <- s }})
+	broker.connectHangs = false
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	before := ag.BrokerState().Since
+	broker.refusals = 1
+	broker.drop(ErrBrokerUnavailable)
+	for _, want := range []string{BrokerConnecting, BrokerConnected, BrokerConnecting, BrokerConnected} {
+		select {
+		case s := <-states:
+			if s.State != want {
+				t.Fatalf("expected %s, got %+v", want, s)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s, got nothing", want)
+		}
+	}
+	if s := ag.BrokerState(); s.LastError != ErrBrokerTimeout || !s.Since.After(before) {
+		t.Fatalf("expected the refused reconnect as the last error, got %+v", s)
+	}
+
+	f := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("c", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+	f.expect(CONNACK)
+	client := ag.clients.GetClient(f.addr())
+	ag.handle_REGISTER(NewRegisterMessage(0, 1, []byte("a")), client)
+	topicid := f.expect(REGACK).(*RegackMessage).TopicId
+	broker.publishHangs = true
+	ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte{1}, 1, 2, false, false), client)
+	if pa := f.expect(PUBACK).(*PubackMessage); pa.ReturnCode != REJ_CONGESTION {
+		t.Fatalf("expected a publish timing out refused, got rc %d", pa.ReturnCode)
+	}
+
+	if err := ag.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if s := ag.BrokerState(); s.State != BrokerDisconnected {
+		t.Fatalf("expected disconnected after stopping, got %+v", s)
+	}
+}
+
+// A connect that completes when done is closed
+type slowToken struct {
+	fakeToken
+	done chan struct{}
+}
+
+func (t *slowToken) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *slowToken) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// A broker whose connects complete with token, if set, counting
+// the connects and disconnects
+type slowBroker struct {
+	*fakeBroker
+	token       *slowToken
+	connects    int32
+	disconnects int32
+}
+
+func (b *slowBroker) Connect() MQTT.Token {
+	atomic.AddInt32(&b.connects, 1)
+	if b.token == nil {
+		return b.fakeBroker.Connect()
+	}
+	return b.token
+}
+
+func (b *slowBroker) Disconnect(quiesce uint) {
+	atomic.AddInt32(&b.disconnects, 1)
+}
+
+// A connect the gateway stops waiting for is waited for again
+// when reconnecting rather than started over, and disconnected
+// should it connect after the gateway has given up on it
+func Test_AGateway_broker_connect_timeout(t *testing.T) {
+	defer func(i time.Duration) { reconnectInterval = i }(reconnectInterval)
+	reconnectInterval = 10 * time.Millisecond
+
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1", connecttimeout: 20 * time.Millisecond})
+	broker := &slowBroker{fakeBroker: &fakeBroker{}, token: &slowToken{done: make(chan struct{})}}
+	ag.mqttclient = broker
+	if err := ag.Start(); err != ErrBrokerTimeout {
+		t.Fatalf("expected Start to fail with %v, got %v", ErrBrokerTimeout, err)
+	}
+	close(broker.token.done)
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&broker.disconnects) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("late connect not disconnected")
+		}
+	}
+
+	broker.token = nil
+	broker.lost = func(c *MQTT.Client, err error) { ag.brokerLost(err) }
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+	broker.token = &slowToken{done: make(chan struct{})}
+	atomic.StoreInt32(&broker.connects, 0)
+	broker.drop(ErrBrokerUnavailable)
+	time.Sleep(100 * time.Millisecond)
+	close(broker.token.done)
+	for deadline := time.Now().Add(time.Second); ag.BrokerState().State != BrokerConnected; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("not reconnected")
+		}
+	}
+	if n := atomic.LoadInt32(&broker.connects); n != 1 {
+		t.Fatalf("expected the timed out connect waited for again, got %d connects", n)
+	}
+}
+
+func Test_AGateway_Drain(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.mqttclient = &fakeBroker{}
+
+	done := make(chan error)
+	go func() { done <- ag.Drain(5 * time.Second) }()
+	for !ag.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	g := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("g", false), client.Conn, g.addr())
+	if ca := g.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != REJ_CONGESTION {
+		t.Fatalf("expected rc %d, got %d", REJ_CONGESTION, ca.ReturnCode)
+	}
+
+	// existing clients are still served
+	ag.handle_CONNECT(connectMessage("fake", false), client.Conn, f.addr())
+	f.expect(CONNACK)
+
+	ag.handle_DISCONNECT(NewMessage(DISCONNECT).(*DisconnectMessage), ag.clients.GetClient(f.addr()))
+	f.expect(DISCONNECT)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Drain: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Drain did not return once the last client left")
+	}
+	if ag.Draining() {
+		t.Fatalf("still draining after stopping")
+	}
+}
+
+func Test_AGateway_Drain_deadline(t *testing.T) {
+	f := newFakeClient(t)
+	ag, _ := newTestAGateway(t, f)
+	ag.mqttclient = &fakeBroker{}
+
+	if err := ag.Drain(50 * time.Millisecond); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	f.expect(DISCONNECT)
+	if ag.clients.Len() != 0 {
+		t.Fatalf("%d clients remain", ag.clients.Len())
+	}
+}
+
+func Test_AGateway_hooks(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.mqttclient = &fakeBroker{}
+
+	events := make(chan string, 10)
+	ag.SetHooks(Hooks{
+		OnConnect: func(c *Client) error {
+			if c.ClientId == "refused" {
+				return ErrClientIDTooLong
+			}
+			return nil
+		},
+		OnDisconnect: func(c *Client, reason string) {
+			events <- "disconnect " + c.ClientId + " " + reason
+		},
+		OnSubscribe: func(c *Client, filter string, qos byte) {
+			events <- "subscribe " + c.ClientId + " " + filter
+		},
+		OnPublishUpstream: func(topic string, payload []byte) {
+			events <- "publish " + topic + " " + string(payload)
+		},
+		OnDeliver: func(c *Client, topic string) {
+			events <- "deliver " + c.ClientId + " " + topic
+		},
+	})
+	ag.hookq.start()
+	defer ag.hookq.stop()
+	expectEvent := func(want string) {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("expected event %q, got %q", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected event %q, got nothing", want)
+		}
+	}
+
+	g := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("refused", false), client.Conn, g.addr())
+	if ca := g.expect(CONNACK).(*ConnackMessage); ca.ReturnCode == ACCEPTED {
+		t.Fatalf("OnConnect error did not refuse the client")
+	}
+	if ag.clients.GetClient(g.addr()) != nil {
+		t.Fatalf("refused client was kept")
+	}
+
+	ag.handle_CONNECT(connectMessage("g", false), client.Conn, g.addr())
+	g.expect(CONNACK)
+	ag.handle_SUBSCRIBE(subscribeMessage("a", 1, 0), ag.clients.GetClient(g.addr()))
+	g.expect(SUBACK)
+	expectEvent("subscribe g a")
+
+	ag.distribute(&fakeMessage{"a", []byte{1}, 0})
+	g.expect(PUBLISH)
+	expectEvent("deliver g a")
+
+	pm := NewPublishMessage(ag.tIndex.getId("a"), 0x00, []byte("up"), 0, 0, false, false)
+	ag.handle_PUBLISH(pm, ag.clients.GetClient(g.addr()))
+	expectEvent("publish a up")
+
+	ag.handle_DISCONNECT(NewMessage(DISCONNECT).(*DisconnectMessage), ag.clients.GetClient(g.addr()))
+	expectEvent("disconnect g disconnect")
+}
+
+// A lost broker connection is made again, waiting longer after
+// each refusal, subscribing again to every filter and publishing
+// what was held meanwhile before anything else
+func Test_AGateway_reconnect(t *testing.T) {
+	defer func(i, max time.Duration) {
+		reconnectInterval, maxReconnectInterval = i, max
+	}(reconnectInterval, maxReconnectInterval)
+	reconnectInterval, maxReconnectInterval = 10*time.Millisecond, 20*time.Millisecond
+
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1", offlinequeue: 1, offlineackearly: true})
+	broker := &fakeBroker{}
+	broker.lost = func(c *MQTT.Client, err error) { ag.brokerLost(err) }
+	ag.mqttclient = broker
+	events := make(chan bool, 10)
+	ag.SetHooks(Hooks{OnBrokerConnection: func(connected bool) { events <- connected }})
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+
+	f := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("c", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+	f.expect(CONNACK)
+	client := ag.clients.GetClient(f.addr())
+	ag.handle_SUBSCRIBE(subscribeMessage("a/#", 1, 1), client)
+	f.expect(SUBACK)
+	ag.handle_REGISTER(NewRegisterMessage(0, 2, []byte("b")), client)
+	topicid := f.expect(REGACK).(*RegackMessage).TopicId
+
+	// the broker restarts, forgetting the gateway's subscriptions
+	broker.subscriptions = nil
+	broker.refusals = 3
+	broker.drop(ErrBrokerTimeout)
+	if ag.BrokerConnected() {
+		t.Fatalf("expected the broker connection to be down")
+	}
+	for i, rc := range []byte{ACCEPTED, REJ_CONGESTION} {
+		ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte{byte(i)}, 1, uint16(10+i), false, false), client)
+		if pa := f.expect(PUBACK).(*PubackMessage); pa.ReturnCode != rc {
+			t.Fatalf("PUBLISH %d while offline: expected rc %d, got %d", i, rc, pa.ReturnCode)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !ag.BrokerConnected() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !ag.BrokerConnected() || ag.BrokerReconnects() != 1 {
+		t.Fatalf("expected to have reconnected once, connected %v after %d", ag.BrokerConnected(), ag.BrokerReconnects())
+	}
+	if broker.subscriptions["a/#"] == nil {
+		t.Fatalf("expected to have subscribed again, have %v", broker.subscriptions)
+	}
+	if len(broker.published) != 1 || broker.published[0].topic != "b" || broker.published[0].payload[0] != 0 {
+		t.Fatalf("expected the held message to be published, got %v", broker.published)
+	}
+	for _, want := range []bool{false, true} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("expected connected %v, got %v", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected connected %v, got nothing", want)
+		}
+	}
+}
+
+// While the broker is unreachable a QoS 1 PUBLISH is answered
+// once it is published, and QoS 0 ones beyond their own limit
+// are dropped
+func Test_AGateway_offline_queue(t *testing.T) {
+	defer func(i, max time.Duration) {
+		reconnectInterval, maxReconnectInterval = i, max
+	}(reconnectInterval, maxReconnectInterval)
+	reconnectInterval, maxReconnectInterval = 10*time.Millisecond, 10*time.Millisecond
+
+	gc := &GatewayConfig{bindaddress: "127.0.0.1"}
+	if err := gc.parseConfig("broker-offline-queue 4\nbroker-offline-queue-qos0 1"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	broker := &fakeBroker{}
+	broker.lost = func(c *MQTT.Client, err error) { ag.brokerLost(err) }
+	ag.mqttclient = broker
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+
+	f := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("c", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+	f.expect(CONNACK)
+	client := ag.clients.GetClient(f.addr())
+	ag.handle_REGISTER(NewRegisterMessage(0, 1, []byte("b")), client)
+	topicid := f.expect(REGACK).(*RegackMessage).TopicId
+
+	broker.refusals = 30
+	broker.drop(ErrBrokerTimeout)
+	go ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte{0}, 1, 10, false, false), client)
+	for deadline := time.Now().Add(time.Second); ag.OfflineQueueDepth() != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the PUBLISH to be held")
+		}
+	}
+	for i := byte(1); i <= 2; i++ {
+		ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte{i}, 0, 0, false, false), client)
+	}
+	if ag.OfflineQueueDepth() != 2 || ag.OfflineQueueDrops() != 1 {
+		t.Fatalf("expected 2 held and 1 dropped, got %d and %d", ag.OfflineQueueDepth(), ag.OfflineQueueDrops())
+	}
+	f.expectNothing()
+
+	if pa := f.expect(PUBACK).(*PubackMessage); pa.MessageId != 10 || pa.ReturnCode != ACCEPTED {
+		t.Fatalf("expected PUBACK 10 accepted, got %d rc %d", pa.MessageId, pa.ReturnCode)
+	}
+	// the QoS 0 message is published after the PUBACK is sent
+	for deadline := time.Now().Add(time.Second); ag.OfflineQueueDepth() != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected nothing held, got %d", ag.OfflineQueueDepth())
+		}
+	}
+	if len(broker.published) != 2 || broker.published[0].payload[0] != 0 || broker.published[1].payload[0] != 1 {
+		t.Fatalf("expected the held messages published in order, got %v", broker.published)
+	}
+}
+
+// While the broker is unreachable new clients are refused or
+// accepted, and what clients publish held or refused, as the
+// policy says, until the broker is reached again
+func Test_AGateway_offline_connect(t *testing.T) {
+	defer func(i, max time.Duration) {
+		reconnectInterval, maxReconnectInterval = i, max
+	}(reconnectInterval, maxReconnectInterval)
+	reconnectInterval, maxReconnectInterval = 10*time.Millisecond, 10*time.Millisecond
+
+	for policy, rcs := range map[string][2]byte{
+		offlineBuffer:   {ACCEPTED, ACCEPTED},
+		offlineDegraded: {ACCEPTED, REJ_CONGESTION},
+		offlineReject:   {REJ_CONGESTION, ACCEPTED},
+	} {
+		t.Run(policy, func(t *testing.T) {
+			gc := &GatewayConfig{bindaddress: "127.0.0.1"}
+			if err := gc.parseConfig("broker-offline-queue 4\nbroker-offline-ack-early true\nbroker-offline-connect " + policy); err != nil {
+				t.Fatalf("parseConfig: %v", err)
+			}
+			ag := NewAGateway(gc)
+			broker := &fakeBroker{}
+			broker.lost = func(c *MQTT.Client, err error) { ag.brokerLost(err) }
+			ag.mqttclient = broker
+			if err := ag.Start(); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			defer ag.Stop(context.Background())
+			connect := func(id string) byte {
+				f := newFakeClient(t)
+				ag.handle_CONNECT(connectMessage(id, false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+				return f.expect(CONNACK).(*ConnackMessage).ReturnCode
+			}
+
+			f := newFakeClient(t)
+			ag.handle_CONNECT(connectMessage("a", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+			f.expect(CONNACK)
+			client := ag.clients.GetClient(f.addr())
+			ag.handle_REGISTER(NewRegisterMessage(0, 1, []byte("b")), client)
+			topicid := f.expect(REGACK).(*RegackMessage).TopicId
+
+			broker.refusals = 20
+			broker.drop(ErrBrokerTimeout)
+			if !ag.Degraded() {
+				t.Fatalf("expected to be degraded without the broker")
+			}
+			if rc := connect("b"); rc != rcs[0] {
+				t.Fatalf("expected CONNECT answered with rc %d, got %d", rcs[0], rc)
+			}
+			// a client already known connects again as ever
+			ag.handle_CONNECT(connectMessage("a", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+			if rc := f.expect(CONNACK).(*ConnackMessage).ReturnCode; rc != ACCEPTED {
+				t.Fatalf("expected a known client accepted, got rc %d", rc)
+			}
+			ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte{1}, 1, 2, false, false), client)
+			if pa := f.expect(PUBACK).(*PubackMessage); pa.ReturnCode != rcs[1] {
+				t.Fatalf("expected PUBLISH answered with rc %d, got %d", rcs[1], pa.ReturnCode)
+			}
+
+			for deadline := time.Now().Add(time.Second); !ag.BrokerConnected(); time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected to have reconnected")
+				}
+			}
+			if rc := connect("c"); rc != ACCEPTED || ag.Degraded() {
+				t.Fatalf("expected CONNECT accepted once reconnected, got rc %d, degraded %v", rc, ag.Degraded())
+			}
+			if rejects := ag.OfflineConnectRejects(); (rejects == 1) != (policy == offlineReject) || rejects > 1 {
+				t.Fatalf("expected the refused CONNECT counted, got %d", rejects)
+			}
+		})
+	}
+}
+
+// What was acknowledged and held when the gateway stopped is
+// published once it has started again
+func Test_AGateway_offline_queue_file(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "held")
+	gc := &GatewayConfig{bindaddress: "127.0.0.1"}
+	if err := gc.parseConfig("broker-offline-queue 4\nbroker-offline-ack-early true\nbroker-offline-queue-file " + file); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	broker := &fakeBroker{}
+	broker.lost = func(c *MQTT.Client, err error) { ag.brokerLost(err) }
+	ag.mqttclient = broker
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	f := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("c", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+	f.expect(CONNACK)
+	client := ag.clients.GetClient(f.addr())
+	ag.handle_REGISTER(NewRegisterMessage(0, 1, []byte("b")), client)
+	topicid := f.expect(REGACK).(*RegackMessage).TopicId
+
+	broker.refusals = 1000
+	broker.drop(ErrBrokerTimeout)
+	ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte{7}, 1, 10, true, false), client)
+	if pa := f.expect(PUBACK).(*PubackMessage); pa.ReturnCode != ACCEPTED {
+		t.Fatalf("expected PUBACK accepted, got rc %d", pa.ReturnCode)
+	}
+	if err := ag.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if ag.OfflineQueueDrops() != 0 {
+		t.Fatalf("expected the held message to be saved, %d dropped", ag.OfflineQueueDrops())
+	}
+
+	ag = NewAGateway(gc)
+	broker = &fakeBroker{}
+	ag.mqttclient = broker
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+	if len(broker.published) != 1 || broker.published[0].topic != "b" || broker.retained["b"] == nil || broker.published[0].payload[0] != 7 {
+		t.Fatalf("expected the saved message to be published, got %v", broker.published)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("expected the queue file to be removed, got %v", err)
+	}
+}
+
+// A broker that kept the gateway's session is only asked for the
+// subscriptions missing from it, and to drop those no one needs
+// any longer; one that did not is asked for them all again
+func Test_AGateway_session(t *testing.T) {
+	defer func(i time.Duration) { reconnectInterval = i }(reconnectInterval)
+	reconnectInterval = 10 * time.Millisecond
+
+	gc := &GatewayConfig{bindaddress: "127.0.0.1"}
+	if err := gc.parseConfig("mqtt-clean-session false\nmqtt-protocol-version 5"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if c := NewAGateway(gc).mqttclient.(*mqtt5Client); c.opts.cleanSession {
+		t.Fatalf("expected the MQTT v5 session to be kept")
+	}
+	gc.mqttversion = 0
+	ag := NewAGateway(gc)
+	broker := &fakeBroker{keptSession: true}
+	broker.lost = func(c *MQTT.Client, err error) { ag.brokerLost(err) }
+	ag.mqttclient = broker
+	events := make(chan bool, 10)
+	ag.SetHooks(Hooks{OnBrokerConnection: func(connected bool) { events <- connected }})
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	reconnected := func() {
+		for _, want := range []bool{false, true} {
+			select {
+			case got := <-events:
+				if got != want {
+					t.Fatalf("expected connected %v, got %v", want, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("expected connected %v, got nothing", want)
+			}
+		}
+	}
+
+	f := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("c", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+	f.expect(CONNACK)
+	client := ag.clients.GetClient(f.addr())
+	for i, filter := range []string{"a/#", "b"} {
+		ag.handle_SUBSCRIBE(subscribeMessage(filter, uint16(i+1), 1), client)
+		f.expect(SUBACK)
+	}
+	ag.unsubscribeUpstream(client, "b")
+
+	// a subscription the broker failed to take
+	broker.subscribeErr = ErrBrokerTimeout
+	ag.handle_SUBSCRIBE(subscribeMessage("c", 3, 1), client)
+	f.expect(SUBACK)
+	broker.subscribeErr = nil
+
+	broker.subscribed = nil
+	broker.drop(ErrBrokerTimeout)
+	reconnected()
+	if fmt.Sprint(broker.subscribed) != "[c]" || broker.subscriptions["b"] != nil || broker.subscriptions["a/#"] == nil {
+		t.Fatalf("resumed session: subscribed to %v, have %v", broker.subscribed, broker.subscriptions)
+	}
+
+	broker.subscribed = nil
+	broker.keptSession = false
+	broker.drop(ErrBrokerTimeout)
+	reconnected()
+	if sort.Strings(broker.subscribed); fmt.Sprint(broker.subscribed) != "[a/# c]" {
+		t.Fatalf("new session: subscribed to %v", broker.subscribed)
+	}
+
+	// the clients are forgotten, and with them the subscriptions
+	if err := ag.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if len(broker.subscriptions) != 0 {
+		t.Fatalf("expected no subscriptions kept, have %v", broker.subscriptions)
+	}
+}
+
+// The gateway publishes that it is online on starting and on
+// each reconnect, and offline before disconnecting on stopping
+func Test_AGateway_status(t *testing.T) {
+	defer func(i time.Duration) { reconnectInterval = i }(reconnectInterval)
+	reconnectInterval = 10 * time.Millisecond
+
+	gc := &GatewayConfig{bindaddress: "127.0.0.1"}
+	if err := gc.parseConfig("status-topic gateways/gw1/status\nstatus-offline gone\nstatus-qos 0"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if st := gc.status(); *st != (status{"gateways/gw1/status", "online", "gone", 0}) {
+		t.Fatalf("status %+v", st)
+	}
+	ag := NewAGateway(gc)
+	broker := &fakeBroker{}
+	broker.lost = func(c *MQTT.Client, err error) { ag.brokerLost(err) }
+	ag.mqttclient = broker
+	events := make(chan bool, 10)
+	ag.SetHooks(Hooks{OnBrokerConnection: func(connected bool) { events <- connected }})
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	broker.drop(ErrBrokerTimeout)
+	for _, want := range []bool{false, true} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("expected connected %v, got %v", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected connected %v, got nothing", want)
+		}
+	}
+	if err := ag.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	var payloads []string
+	for _, m := range broker.published {
+		if m.topic != "gateways/gw1/status" || m.qos != 0 {
+			t.Fatalf("unexpected publish %+v", m)
+		}
+		payloads = append(payloads, string(m.payload))
+	}
+	if strings.Join(payloads, ",") != "online,online,gone" || broker.connected {
+		t.Fatalf("published %v, connected %v", payloads, broker.connected)
+	}
+
+	for _, bad := range []struct {
+		config string
+		err    error
+	}{
+		{"status-qos 3", ErrInvalidQos},
+		{"status-topic gateways/+/status", ErrTopicNameContainsWildcard},
+	} {
+		if err := gc.parseConfig(bad.config); err != bad.err {
+			t.Errorf("%q: expected %v, got %v", bad.config, bad.err, err)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func subscribeMessage(filter string, msgId uint16, qos byte) *SubscribeMessage {
+	sm := NewMessage(SUBSCRIBE).(*SubscribeMessage)
+	sm.TopicName = []byte(filter)
+	sm.MessageId = msgId
+	sm.Qos = qos
+	return sm
+}
+
+func Test_AGateway_SUBSCRIBE_idempotent(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+
+	var topicid uint16
+	for i := uint16(1); i <= 3; i++ {
+		ag.handle_SUBSCRIBE(subscribeMessage("a/b", i, 1), client)
+		sa := f.expect(SUBACK).(*SubackMessage)
+		if sa.MessageId != i || sa.Qos != 1 || sa.ReturnCode != ACCEPTED {
+			t.Fatalf("unexpected SUBACK %+v", sa)
+		}
+		if i == 1 {
+			topicid = sa.TopicId
+		} else if sa.TopicId != topicid {
+			t.Fatalf("SUBACK %d has topic id %d, expected %d", i, sa.TopicId, topicid)
+		}
+	}
+	if n := len(ag.tTree.root.children["a"].children["b"].clients); n != 1 {
+		t.Fatalf("expected 1 subscriber in the topic tree, got %d", n)
+	}
+
+	ag.distribute(&fakeMessage{"a/b", []byte{1}, 2})
+	if pm := f.expect(PUBLISH).(*PublishMessage); pm.Qos != 1 {
+		t.Fatalf("expected delivery at QoS 1, got %d", pm.Qos)
+	}
+	f.expectNothing()
+}
+
+func Test_AGateway_SUBSCRIBE_updates_qos(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+
+	ag.handle_SUBSCRIBE(subscribeMessage("a/+", 1, 1), client)
+	f.expect(SUBACK)
+	ag.handle_SUBSCRIBE(subscribeMessage("a/+", 2, 0), client)
+	if sa := f.expect(SUBACK).(*SubackMessage); sa.Qos != 0 {
+		t.Fatalf("expected SUBACK granting QoS 0, got %d", sa.Qos)
+	}
+
+	ag.distribute(&fakeMessage{"a/b", []byte{1}, 1})
+	f.expect(REGISTER)
+	if n := len(ag.tTree.root.children["a"].children["+"].clients); n != 1 {
+		t.Fatalf("expected 1 subscriber in the topic tree, got %d", n)
+	}
+	if qos := client.GrantedQos("a/b"); qos != 0 {
+		t.Fatalf("expected granted QoS 0, got %d", qos)
+	}
+}
+
+func connectMessage(clientid string, will bool) *ConnectMessage {
+	cm := NewMessage(CONNECT).(*ConnectMessage)
+	cm.ClientId = []byte(clientid)
+	cm.Will = will
+	cm.CleanSession = true
+	cm.Duration = 60
+	return cm
+}
+
+func Test_AGateway_CONNECT_rejections(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.maxClients = 2
+
+	g := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("", false), client.Conn, g.addr())
+	if ca := g.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("empty client id: expected rc %d, got %d", REJ_NOT_SUPORTED, ca.ReturnCode)
+	}
+	ag.handle_CONNECT(connectMessage("abcdefghijklmnopqrstuvwxyz", false), client.Conn, g.addr())
+	if ca := g.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("long client id: expected rc %d, got %d", REJ_NOT_SUPORTED, ca.ReturnCode)
+	}
+	cm := connectMessage("g", false)
+	cm.ProtocolId = 0x02
+	ag.handle_CONNECT(cm, client.Conn, g.addr())
+	if ca := g.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("bad protocol id: expected rc %d, got %d", REJ_NOT_SUPORTED, ca.ReturnCode)
+	}
+	if ag.clients.GetClient(g.addr()) != nil {
+		t.Fatalf("rejected CONNECT created a client")
+	}
+
+	ag.handle_CONNECT(connectMessage("g", false), client.Conn, g.addr())
+	if ca := g.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != ACCEPTED {
+		t.Fatalf("expected rc %d, got %d", ACCEPTED, ca.ReturnCode)
+	}
+
+	h := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("h", false), client.Conn, h.addr())
+	if ca := h.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != REJ_CONGESTION {
+		t.Fatalf("too many clients: expected rc %d, got %d", REJ_CONGESTION, ca.ReturnCode)
+	}
+
+	// reconnecting from a known address is not a new client
+	ag.handle_CONNECT(connectMessage("g", false), client.Conn, g.addr())
+	if ca := g.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != ACCEPTED {
+		t.Fatalf("reconnect: expected rc %d, got %d", ACCEPTED, ca.ReturnCode)
+	}
+}
+
+func Test_AGateway_CONNECT_will_exchange(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+
+	g := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("g", true), client.Conn, g.addr())
+	g.expect(WILLTOPICREQ)
+
+	wt := NewMessage(WILLTOPIC).(*WillTopicMessage)
+	wt.WillTopic = []byte("g/status")
+	wt.Qos = 1
+	wt.Retain = true
+	ag.handle_WILLTOPIC(wt, ag.clients.GetClient(g.addr()))
+	g.expect(WILLMSGREQ)
+
+	wm := NewMessage(WILLMSG).(*WillMsgMessage)
+	wm.WillMsg = []byte("gone")
+	ag.handle_WILLMSG(wm, ag.clients.GetClient(g.addr()))
+	if ca := g.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != ACCEPTED {
+		t.Fatalf("expected rc %d, got %d", ACCEPTED, ca.ReturnCode)
+	}
+
+	will := ag.clients.GetClient(g.addr()).(*Client).Will()
+	if will == nil || will.Topic != "g/status" || string(will.Data) != "gone" || will.Qos != 1 || !will.Retain {
+		t.Fatalf("unexpected will %+v", will)
+	}
+}
+
+// A client connecting again from the same address starts a new
+// session, the old one's subscriptions ending with it, so that a
+// message for it is delivered once
+func Test_AGateway_CONNECT_again(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	var reasons []string
+	ag.SetHooks(Hooks{OnDisconnect: func(c *Client, reason string) {
+		reasons = append(reasons, reason)
+	}})
+	ag.hookq.start()
+
+	for i := uint16(1); i <= 2; i++ {
+		ag.handle_CONNECT(connectMessage("fake", false), client.Conn, f.addr())
+		f.expect(CONNACK)
+		client = ag.clients.GetClient(f.addr()).(*Client)
+		ag.handle_SUBSCRIBE(subscribeMessage("a/b", i, 0), client)
+		f.expect(SUBACK)
+	}
+	if n := len(ag.tTree.root.children["a"].children["b"].clients); n != 1 {
+		t.Fatalf("expected 1 subscriber in the topic tree, got %d", n)
+	}
+
+	ag.distribute(&fakeMessage{"a/b", []byte{1}, 0})
+	f.expect(PUBLISH)
+	f.expectNothing()
+	ag.hookq.stop()
+	if len(reasons) != 2 || reasons[0] != DisconnectReplaced || reasons[1] != DisconnectReplaced {
+		t.Fatalf("expected both old sessions ended as replaced, got %v", reasons)
+	}
+}
+
+func Test_AGateway_REGISTER_wildcard_rejected(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+
+	for i, topic := range []string{"sensors/+/temp", "sensors/#", "+/temp", "#"} {
+		rm := NewRegisterMessage(0, uint16(i+1), []byte(topic))
+		ag.handle_REGISTER(rm, client)
+		ra := f.expect(REGACK).(*RegackMessage)
+		if ra.ReturnCode != REJ_NOT_SUPORTED || ra.MessageId != uint16(i+1) {
+			t.Fatalf("%s: expected rc %d for msg id %d, got rc %d for %d", topic, REJ_NOT_SUPORTED, i+1, ra.ReturnCode, ra.MessageId)
+		}
+		if ag.tIndex.containsTopic(topic) {
+			t.Fatalf("%s: a topic id was allocated", topic)
+		}
+	}
+
+	rm := NewRegisterMessage(0, 9, []byte("sensors/1/temp"))
+	ag.handle_REGISTER(rm, client)
+	if ra := f.expect(REGACK).(*RegackMessage); ra.ReturnCode != ACCEPTED || ra.TopicId == 0 {
+		t.Fatalf("expected a topic id, got rc %d id %d", ra.ReturnCode, ra.TopicId)
+	}
+}
+
+func Test_AGateway_WILLTOPIC_wildcard_rejected(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+
+	g := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("g", true), client.Conn, g.addr())
+	g.expect(WILLTOPICREQ)
+
+	wt := NewMessage(WILLTOPIC).(*WillTopicMessage)
+	wt.WillTopic = []byte("g/+/status")
+	ag.handle_WILLTOPIC(wt, ag.clients.GetClient(g.addr()))
+	if ca := g.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("expected rc %d, got %d", REJ_NOT_SUPORTED, ca.ReturnCode)
+	}
+	if ag.clients.GetClient(g.addr()) != nil {
+		t.Fatalf("rejected client was kept")
+	}
+}
+
+// A retained PUBLISH with no payload reaches the broker as one,
+// through the upstream transform, clearing the retained message
+// new subscribers would otherwise be sent
+func Test_AGateway_retained_clear(t *testing.T) {
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1"})
+	broker := &fakeBroker{}
+	ag.mqttclient = broker
+	ag.SetUpstreamTransform(CBORToJSON)
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+	connect := func(clientid string) (*fakeClient, *Client) {
+		f := newFakeClient(t)
+		ag.handle_CONNECT(connectMessage(clientid, false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+		f.expect(CONNACK)
+		return f, ag.clients.GetClient(f.addr()).(*Client)
+	}
+
+	pf, publisher := connect("publisher")
+	ag.handle_REGISTER(NewRegisterMessage(0, 1, []byte("a/b")), publisher)
+	topicid := pf.expect(REGACK).(*RegackMessage).TopicId
+	ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte{0x61, 0x76}, 1, 2, true, false), publisher)
+	pf.expect(PUBACK)
+
+	f, client := connect("first")
+	ag.handle_SUBSCRIBE(subscribeMessage("a/+", 1, 1), client)
+	f.expect(SUBACK)
+	broker.deliverRetained("a/+")
+	ag.handle_REGACK(regack(f.expect(REGISTER).(*RegisterMessage)), client)
+	if pm := f.expect(PUBLISH).(*PublishMessage); !pm.Retain || string(pm.Data) != `"v"` {
+		t.Fatalf("expected the retained message, got %q retained %v", pm.Data, pm.Retain)
+	}
+
+	ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte{}, 1, 3, true, false), publisher)
+	if pa := pf.expect(PUBACK).(*PubackMessage); pa.ReturnCode != ACCEPTED {
+		t.Fatalf("expected the clear accepted, got rc %d", pa.ReturnCode)
+	}
+	if m := broker.published[len(broker.published)-1]; m.topic != "a/b" || len(m.payload) != 0 {
+		t.Fatalf("expected an empty publish on a/b, got %+v", m)
+	}
+
+	f, client = connect("second")
+	ag.handle_SUBSCRIBE(subscribeMessage("a/#", 1, 1), client)
+	f.expect(SUBACK)
+	broker.deliverRetained("a/#")
+	f.expectNothing()
+}
+
+// Clients publish and subscribe to pre-defined topics by their
+// ids without registering them, and are sent messages on them
+// with those ids
+func Test_AGateway_predefined_topics(t *testing.T) {
+	gc := &GatewayConfig{bindaddress: "127.0.0.1"}
+	if err := gc.parseConfig("predefined-topic 17=sensors/+/temp\npredefined-topic 18=alarms/fire"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	broker := &fakeBroker{}
+	ag.mqttclient = broker
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+	f := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("predefined", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+	f.expect(CONNACK)
+	client := ag.clients.GetClient(f.addr()).(*Client)
+
+	for id, rc := range map[uint16]byte{18: ACCEPTED, 17: REJ_INVALID_TID, 19: REJ_INVALID_TID} {
+		ag.handle_PUBLISH(NewPublishMessage(id, topicIdPredefined, []byte{1}, 1, id, false, false), client)
+		if pa := f.expect(PUBACK).(*PubackMessage); pa.ReturnCode != rc {
+			t.Fatalf("PUBLISH to %d: expected rc %d, got %d", id, rc, pa.ReturnCode)
+		}
+	}
+	if len(broker.published) != 1 || broker.published[0].topic != "alarms/fire" {
+		t.Fatalf("expected one publish on alarms/fire, got %+v", broker.published)
+	}
+
+	for id, rc := range map[uint16]byte{17: ACCEPTED, 18: ACCEPTED, 19: REJ_INVALID_TID} {
+		sm := subscribeMessage("", id, 1)
+		sm.TopicIdType, sm.TopicId = topicIdPredefined, id
+		ag.handle_SUBSCRIBE(sm, client)
+		if sa := f.expect(SUBACK).(*SubackMessage); sa.ReturnCode != rc || (rc == ACCEPTED && sa.TopicId != id) {
+			t.Fatalf("SUBSCRIBE to %d: expected rc %d, got %+v", id, rc, sa)
+		}
+	}
+	ag.distribute(&fakeMessage{"alarms/fire", []byte{2}, 0})
+	if pm := f.expect(PUBLISH).(*PublishMessage); pm.TopicIdType != topicIdPredefined || pm.TopicId != 18 {
+		t.Fatalf("expected a PUBLISH with predefined id 18, got %+v", pm)
+	}
+	// a topic matching a pre-defined filter is registered
+	ag.distribute(&fakeMessage{"sensors/a/temp", []byte{3}, 0})
+	rm := f.expect(REGISTER).(*RegisterMessage)
+	if rm.TopicId == 17 || rm.TopicId == 18 {
+		t.Fatalf("registered with pre-defined id %d", rm.TopicId)
+	}
+}
@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_allowlist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "clients.allow")
+	os.WriteFile(file, []byte("# the fleet\nsensor-*\n\nprobe-[0-9]\n"), 0644)
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("client-allow gw-1,gw-2\nclient-allow-file " + file); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	a, err := newAllowlist(gc)
+	if err != nil {
+		t.Fatalf("newAllowlist: %v", err)
+	}
+	for id, allowed := range map[string]bool{
+		"gw-1":         true,
+		"gw-2":         true,
+		"gw-3":         false,
+		"sensor-1":     true,
+		"sensor-":      true,
+		"sensor-a/b":   false,
+		"probe-7":      true,
+		"probe-77":     false,
+		"the fleet":    false,
+		"# the fleet":  false,
+		"sensor":       false,
+		"other-sensor": false,
+	} {
+		if a.allows(id) != allowed {
+			t.Errorf("expected %q allowed %v", id, allowed)
+		}
+	}
+	if a, err := newAllowlist(&GatewayConfig{}); a != nil || err != nil || !a.allows("any") {
+		t.Fatalf("expected every id allowed unless configured, got %v, %v", a, err)
+	}
+	if err := gc.parseConfig("client-allow sensor-["); err != ErrInvalidClientAllow {
+		t.Fatalf("expected %v, got %v", ErrInvalidClientAllow, err)
+	}
+	os.WriteFile(file, []byte("sensor-[\n"), 0644)
+	if _, err := newAllowlist(gc); err != ErrInvalidClientAllow {
+		t.Fatalf("expected %v, got %v", ErrInvalidClientAllow, err)
+	}
+}
+
+// A CONNECT from an id not allowed is refused before a session
+// is made, and the file is read again on reload
+func Test_allowlist_CONNECT(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "clients.allow")
+	os.WriteFile(file, []byte("sensor-*\n"), 0644)
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.mqttclient = &fakeBroker{}
+	ag.config.Load().clientallowfile = file
+	if err := ag.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	ag.handle(connectMessage("rogue", false), client.Conn, f.addr())
+	if m := f.expect(CONNACK).(*ConnackMessage); m.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("expected rejected: not supported, got %d", m.ReturnCode)
+	}
+	if ag.clientById("rogue") != nil || ag.NotAllowedConnects() != 1 {
+		t.Fatalf("expected no session and the CONNECT counted, got %d", ag.NotAllowedConnects())
+	}
+	ag.handle(connectMessage("sensor-1", false), client.Conn, f.addr())
+	if m := f.expect(CONNACK).(*ConnackMessage); m.ReturnCode != ACCEPTED {
+		t.Fatalf("expected sensor-1 accepted, got %d", m.ReturnCode)
+	}
+
+	os.WriteFile(file, []byte("rogue\n"), 0644)
+	if err := ag.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	ag.handle(connectMessage("rogue", false), client.Conn, f.addr())
+	if m := f.expect(CONNACK).(*ConnackMessage); m.ReturnCode != ACCEPTED {
+		t.Fatalf("expected rogue allowed once reloaded, got %d", m.ReturnCode)
+	}
+
+	// what is loaded is kept if the file cannot be read
+	os.Remove(file)
+	if err := ag.Reload(); err == nil {
+		t.Fatalf("expected the missing file reported")
+	}
+	if a := ag.allowed.Load(); !a.allows("rogue") || a.allows("sensor-1") {
+		t.Fatalf("expected the allowlist kept")
+	}
+}
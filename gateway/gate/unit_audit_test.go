@@ -0,0 +1,136 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_config_audit(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("audit-file /var/log/gnatt/audit.log\naudit-max-size 1048576"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if lf := gc.auditFile(); lf.path != "/var/log/gnatt/audit.log" || lf.maxSize != 1<<20 || !lf.syncLine {
+		t.Fatalf("expected the audit file synced every line unless configured, got %+v", lf)
+	}
+	if err := gc.parseConfig("audit-sync 5s"); err != nil || gc.auditFile().syncLine || gc.auditFile().syncEvery != 5*time.Second {
+		t.Fatalf("expected the audit file synced every 5s, got %+v, %v", gc.auditFile(), err)
+	}
+	if err := gc.parseConfig("audit-sync sometimes"); err != ErrInvalidAuditSync {
+		t.Fatalf("expected %v, got %v", ErrInvalidAuditSync, err)
+	}
+}
+
+// The entries of the audit file at path
+func auditEntries(t *testing.T, path string) []auditEntry {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer file.Close()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("%q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// A client's session is recorded, as is what the admin API was
+// asked, whatever the log-level, and the latest entries are
+// served
+func Test_audit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1", adminaddress: "127.0.0.1:0", auditfile: path})
+	ag.mqttclient = &fakeBroker{}
+	defer SetLogLevel(LogLevel())
+	SetLogLevel("error")
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	url := "http://" + ag.admin.Addr().String()
+
+	f := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("f", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+	f.expect(CONNACK)
+	ag.handle_SUBSCRIBE(subscribeMessage("a/#", 1, 1), ag.clients.GetClient(f.addr()))
+	f.expect(SUBACK)
+	if status := postJSON(t, url+"/clients/f/disconnect?will=false", "", nil); status != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", status)
+	}
+	f.expect(DISCONNECT)
+
+	var tail []auditEntry
+	for deadline := time.Now().Add(time.Second); len(tail) < 4 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		getJSON(t, url+"/audit?n=10", &tail)
+	}
+	if len(tail) != 4 {
+		t.Fatalf("expected 4 entries, got %+v", tail)
+	}
+	// the hooks and the admin API record apart, in either order
+	admin := tail[2]
+	if admin.Event != auditAdmin {
+		admin = tail[3]
+	}
+	if admin.Event != auditAdmin || admin.Action != "disconnect" || admin.ClientId != "f" || admin.Detail["will"] != false {
+		t.Fatalf("expected the admin's disconnect, got %+v", tail)
+	}
+	latest := tail[3]
+	getJSON(t, url+"/audit?n=1", &tail)
+	if len(tail) != 1 || tail[0].Event != latest.Event {
+		t.Fatalf("expected the latest entry alone, got %+v", tail)
+	}
+
+	if err := ag.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	entries := auditEntries(t, path)
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %+v", entries)
+	}
+	if e := entries[0]; e.Event != eventConnected || e.ClientId != "f" || e.Address != f.addr().String() || time.Since(e.Time) > time.Minute {
+		t.Errorf("expected f connected, got %+v", e)
+	}
+	if e := entries[1]; e.Event != auditSubscribed || e.Filter != "a/#" || e.Qos == nil || *e.Qos != 1 {
+		t.Errorf("expected f subscribed to a/# at QoS 1, got %+v", e)
+	}
+	for _, e := range entries[2:] {
+		if e.Event == eventDisconnected && e.Reason != DisconnectKicked {
+			t.Errorf("expected f disconnected as kicked, got %+v", e)
+		}
+	}
+}
+
+func Test_audit_tail(t *testing.T) {
+	a := newAudit(&GatewayConfig{auditfile: filepath.Join(t.TempDir(), "audit.log"), auditsync: "none"})
+	if err := a.start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	a.stop()
+	if len(a.tail(10)) != 0 {
+		t.Fatalf("expected no entries")
+	}
+	for i := 0; i < auditTail+5; i++ {
+		a.write(auditEntry{ClientId: strconv.Itoa(i)})
+	}
+	tail := a.tail(2)
+	if len(tail) != 2 || tail[0].ClientId != strconv.Itoa(auditTail+3) || tail[1].ClientId != strconv.Itoa(auditTail+4) {
+		t.Fatalf("expected the last 2, oldest first, got %+v", tail)
+	}
+	if all := a.tail(0); len(all) != auditTail || all[0].ClientId != "5" {
+		t.Fatalf("expected the last %d kept, got %d from %+v", auditTail, len(all), all[0])
+	}
+}
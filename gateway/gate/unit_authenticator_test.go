@@ -0,0 +1,127 @@
+package gateway
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// An Authenticator of a function
+type authFunc func(ctx ConnectContext) (Decision, error)
+
+func (f authFunc) Authenticate(ctx ConnectContext) (Decision, error) {
+	return f(ctx)
+}
+
+func Test_RegistryAuthenticator(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "registry")
+	os.WriteFile(file, []byte("# the fleet\nsensor-17 tenant=acme role=admin\n\nsensor-* tenant=acme role=sensor\nprobe\n"), 0644)
+	r, err := NewRegistryAuthenticator(file)
+	if err != nil {
+		t.Fatalf("NewRegistryAuthenticator: %v", err)
+	}
+	for id, role := range map[string]string{
+		"sensor-17": "admin",
+		"sensor-18": "sensor",
+		"probe":     "",
+	} {
+		d, err := r.Authenticate(ConnectContext{ClientId: id})
+		if err != nil || !d.Accept || d.Metadata["role"] != role {
+			t.Errorf("expected %s accepted with role %q, got %+v, %v", id, role, d, err)
+		}
+	}
+	if d, _ := r.Authenticate(ConnectContext{ClientId: "rogue"}); d.Accept || d.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("expected rogue rejected, got %+v", d)
+	}
+	for _, entries := range []string{"sensor-[ role=x", "sensor role", "sensor =x"} {
+		os.WriteFile(file, []byte(entries), 0644)
+		if _, err := NewRegistryAuthenticator(file); err != ErrInvalidRegistry {
+			t.Errorf("expected %q refused, got %v", entries, err)
+		}
+	}
+}
+
+// A CONNECT is refused with the return code the Authenticator
+// gives, as congested if it fails, and a client accepted has
+// its metadata before the OnConnect hook is called
+func Test_authenticator_CONNECT(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.mqttclient = &fakeBroker{}
+	var got ConnectContext
+	ag.SetAuthenticator(authFunc(func(ctx ConnectContext) (Decision, error) {
+		got = ctx
+		switch ctx.ClientId {
+		case "busy":
+			return Reject(REJ_CONGESTION), nil
+		case "broken":
+			return Decision{}, errors.New("registry unreachable")
+		case "nameless":
+			return Reject(ACCEPTED), nil
+		}
+		return Accept(map[string]string{"tenant": "acme"}), nil
+	}))
+	var tenant string
+	ag.SetHooks(Hooks{OnConnect: func(c *Client) error {
+		tenant = c.Metadata("tenant")
+		return nil
+	}})
+
+	for id, rc := range map[string]byte{
+		"busy":     REJ_CONGESTION,
+		"broken":   REJ_CONGESTION,
+		"nameless": REJ_NOT_SUPORTED,
+	} {
+		ag.handle_CONNECT(connectMessage(id, false), client.Conn, f.addr())
+		if m := f.expect(CONNACK).(*ConnackMessage); m.ReturnCode != rc {
+			t.Errorf("expected %s refused with %d, got %d", id, rc, m.ReturnCode)
+		}
+	}
+	if ag.AuthRefused() != 3 || ag.clientById("busy") != nil {
+		t.Fatalf("expected 3 refused without a session, got %d", ag.AuthRefused())
+	}
+
+	ag.handle_CONNECT(connectMessage("sensor-1", false), client.Conn, f.addr())
+	if m := f.expect(CONNACK).(*ConnackMessage); m.ReturnCode != ACCEPTED {
+		t.Fatalf("expected sensor-1 accepted, got %d", m.ReturnCode)
+	}
+	if got.ClientId != "sensor-1" || got.Addr.String() != f.addr().r.String() {
+		t.Fatalf("expected the CONNECT's id and address, got %+v", got)
+	}
+	if tenant != "acme" || ag.clientById("sensor-1").base().info(true).Metadata["tenant"] != "acme" {
+		t.Fatalf("expected the metadata kept, got %q", tenant)
+	}
+}
+
+// auth-registry-file is read at reload, and decides the
+// transparent gateway's CONNECTs too
+func Test_authenticator_registry_TGateway(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "registry")
+	os.WriteFile(file, []byte("f role=sensor\n"), 0644)
+	f, g := newFakeClient(t), newFakeClient(t)
+	tg, c, _ := newTestTGateway(t)
+	tg.config.Load().authregistryfile = file
+	if err := tg.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	if tclient := tconnect(t, tg, c, f, "f"); tclient.Metadata("role") != "sensor" {
+		t.Fatalf("expected the registry's metadata, got %q", tclient.Metadata("role"))
+	}
+	tg.handle_CONNECT(connectMessage("g", false), c, g.addr())
+	if m := g.expect(CONNACK).(*ConnackMessage); m.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("expected g refused, got %d", m.ReturnCode)
+	}
+
+	// what is loaded is kept if the file cannot be read
+	os.Remove(file)
+	if err := tg.Reload(); err == nil {
+		t.Fatalf("expected the missing file reported")
+	}
+	if tg.registry.Load() == nil {
+		t.Fatalf("expected the registry kept")
+	}
+}
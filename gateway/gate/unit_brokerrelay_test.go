@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func Test_brokerRelays(t *testing.T) {
+	if rs := newBrokerRelays(&GatewayConfig{}, nil); rs != nil {
+		t.Fatalf("relays without headers")
+	}
+	var none *brokerRelays
+	if u := none.url("ws://broker:80/mqtt"); u != "ws://broker:80/mqtt" {
+		t.Fatalf("nil relays gave %q", u)
+	}
+	none.close()
+
+	received := make(chan string, 1)
+	ws := httptest.NewServer(websocket.Server{Handler: func(c *websocket.Conn) {
+		var frame []byte
+		websocket.Message.Receive(c, &frame)
+		received <- c.Request().Header.Get("Authorization") + " " + string(frame)
+		websocket.Message.Send(c, []byte("connack"))
+	}})
+	defer ws.Close()
+	broker := "ws" + strings.TrimPrefix(ws.URL, "http") + "/mqtt"
+
+	rs := newBrokerRelays(&GatewayConfig{mqttheaders: http.Header{"Authorization": {"Bearer abc"}}}, nil)
+	if u := rs.url("tcp://broker:1883"); u != "tcp://broker:1883" {
+		t.Fatalf("tcp broker relayed to %q", u)
+	}
+	u := rs.url(broker)
+	if !strings.HasPrefix(u, "tcp://127.0.0.1:") {
+		t.Fatalf("websocket broker relayed to %q", u)
+	}
+	if again := rs.url(broker); again != u {
+		t.Fatalf("second relay %q, first %q", again, u)
+	}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(u, "tcp://"))
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("connect"))
+	if r := <-received; r != "Bearer abc connect" {
+		t.Fatalf("broker received %q", r)
+	}
+	b := make([]byte, 7)
+	if n, err := conn.Read(b); err != nil || string(b[:n]) != "connack" {
+		t.Fatalf("read %q, %v", b[:n], err)
+	}
+
+	rs.close()
+	if _, err := conn.Read(b); err == nil {
+		t.Fatalf("relayed connection open after close")
+	}
+	if _, err := net.Dial("tcp", strings.TrimPrefix(u, "tcp://")); err == nil {
+		t.Fatalf("relay listening after close")
+	}
+}
@@ -0,0 +1,97 @@
+package gateway
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_brokerTLS_config(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brokertls")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	certpem, keypem := ca.issue(t, "gateway")
+	cafile, certfile, keyfile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeFile(t, cafile, ca.pem)
+	writeFile(t, certfile, certpem)
+	writeFile(t, keyfile, keypem)
+
+	gc := &GatewayConfig{}
+	if config, err := gc.brokerTLS().config(); config != nil || err != nil {
+		t.Fatalf("TLS configured by default: %v", err)
+	}
+	if err := gc.parseConfig("mqtt-ca-file " + cafile + "\nmqtt-cert-file " + certfile + "\nmqtt-key-file " + keyfile + "\nmqtt-server-name broker.lab"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	config, err := gc.brokerTLS().config()
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	if config.ServerName != "broker.lab" || config.InsecureSkipVerify || config.RootCAs == nil || len(config.Certificates) != 1 {
+		t.Fatalf("unexpected config %+v", config)
+	}
+	if err := gc.parseConfig("mqtt-insecure-skip-verify sometimes"); err == nil {
+		t.Fatalf("expected an error for a value that is not a boolean")
+	}
+
+	for _, b := range []struct {
+		tls brokerTLS
+		err error
+	}{
+		{brokerTLS{ca: keyfile}, ErrInvalidBrokerCA},
+		{brokerTLS{cert: certfile}, ErrIncompleteBrokerCert},
+		{brokerTLS{key: keyfile}, ErrIncompleteBrokerCert},
+	} {
+		if _, err := b.tls.config(); err != b.err {
+			t.Errorf("%+v: expected %v, got %v", b.tls, b.err, err)
+		}
+	}
+	for _, bad := range []brokerTLS{{ca: filepath.Join(dir, "missing.pem")}, {cert: keyfile, key: certfile}} {
+		if _, err := bad.config(); err == nil {
+			t.Errorf("%+v: expected an error", bad)
+		}
+	}
+}
+
+// Certificates that cannot be loaded stop either gateway
+// starting, and each transparent client's broker connection is
+// secured, and its WebSocket handshake made through a relay
+// sending the headers, as configured
+func Test_Gateway_broker_tls(t *testing.T) {
+	gc := &GatewayConfig{bindaddress: "127.0.0.1", mqttcertfile: "cert.pem"}
+	if _, err := NewTGateway(gc); err != ErrIncompleteBrokerCert {
+		t.Fatalf("NewTGateway: expected %v, got %v", ErrIncompleteBrokerCert, err)
+	}
+	ag := NewAGateway(gc)
+	ag.mqttclient = &fakeBroker{}
+	if err := ag.Start(); err != ErrIncompleteBrokerCert {
+		t.Fatalf("Start: expected %v, got %v", ErrIncompleteBrokerCert, err)
+	}
+
+	tg, c, _ := newTestTGateway(t)
+	tg.tlsConfig, _ = brokerTLS{serverName: "broker.lab"}.config()
+	tg.mqttBroker = "ws://broker.lab/mqtt"
+	tg.relays = newBrokerRelays(&GatewayConfig{mqttheaders: http.Header{"Authorization": {"Bearer abc"}}}, tg.tlsConfig)
+	defer tg.relays.close()
+	var opts *MQTT.ClientOptions
+	tg.newMQTTClient = func(o *MQTT.ClientOptions) mqttClient {
+		opts = o
+		return &fakeBroker{}
+	}
+	f := newFakeClient(t)
+	tg.handle_CONNECT(connectMessage("f", false), c, f.addr())
+	f.expect(CONNACK)
+	if opts == nil || opts.TLSConfig.ServerName != "broker.lab" || opts.Servers[0].Host != strings.TrimPrefix(tg.relays.url(tg.mqttBroker), "tcp://") {
+		t.Fatalf("broker connection not secured as configured")
+	}
+}
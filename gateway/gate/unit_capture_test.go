@@ -0,0 +1,138 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// The IP packets of a pcap file, after checking its header
+func pcapPackets(t *testing.T, path string) [][]byte {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, pcapHeader) {
+		t.Fatalf("expected the pcap header, got % x", b[:24])
+	}
+	var packets [][]byte
+	for b = b[len(pcapHeader):]; len(b) > 0; {
+		n := binary.LittleEndian.Uint32(b[8:])
+		packets = append(packets, b[16:16+n])
+		b = b[16+n:]
+	}
+	return packets
+}
+
+// Each packet is a UDP datagram between the client's address and
+// the gateway's
+func Test_capture_pcap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.pcap")
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	if err := startCapture(captureConfig{path, 1 << 20, 1}, 0); err != nil {
+		t.Fatalf("startCapture: %v", err)
+	}
+	defer stopCapture()
+	onPacket(ag, client, f, NewMessage(PINGREQ))
+	f.expect(PINGRESP)
+	stopCapture()
+
+	packets := pcapPackets(t, path)
+	if len(packets) != 2 {
+		t.Fatalf("expected the PINGREQ and PINGRESP, got %d packets", len(packets))
+	}
+	fa := f.addr().r.(*net.UDPAddr)
+	ga := client.Conn.localAddr().(*net.UDPAddr)
+	for i, expected := range []struct {
+		src, dst *net.UDPAddr
+		data     []byte
+	}{
+		{fa, ga, []byte{2, PINGREQ}},
+		{ga, fa, []byte{2, PINGRESP}},
+	} {
+		p := packets[i]
+		if p[0] != 0x45 || p[9] != 17 || ipChecksum(p[:20]) != 0 {
+			t.Fatalf("expected an IPv4 header of UDP, got % x", p[:20])
+		}
+		src := &net.UDPAddr{IP: net.IP(p[12:16]), Port: int(binary.BigEndian.Uint16(p[20:]))}
+		dst := &net.UDPAddr{IP: net.IP(p[16:20]), Port: int(binary.BigEndian.Uint16(p[22:]))}
+		if src.String() != expected.src.String() || dst.String() != expected.dst.String() || !bytes.Equal(p[28:], expected.data) {
+			t.Fatalf("expected % x from %s to %s, got % x from %s to %s", expected.data, expected.src, expected.dst, p[28:], src, dst)
+		}
+	}
+}
+
+// A file grows to its maximum size before it rolls over, each
+// with its header, those beyond the backups kept removed
+func Test_capture_rolls(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.pcap")
+	if err := startCapture(captureConfig{path, 200, 1}, 0); err != nil {
+		t.Fatalf("startCapture: %v", err)
+	}
+	defer stopCapture()
+	c := captures.Load()
+	from := &net.UDPAddr{IP: net.IPv6loopback, Port: 5000}
+	to := &net.UDPAddr{IP: net.IPv6loopback, Port: 1883}
+	for i := 0; i < 10; i++ {
+		c.packet(from, to, []byte{2, PINGREQ})
+	}
+	stopCapture()
+
+	var n int
+	for _, name := range []string{path, backupName(path, 1)} {
+		for _, p := range pcapPackets(t, name) {
+			if p[0]>>4 != 6 || !bytes.Equal(p[48:], []byte{2, PINGREQ}) {
+				t.Fatalf("expected an IPv6 datagram, got % x", p)
+			}
+			n++
+		}
+	}
+	if _, err := os.Stat(backupName(path, 2)); err == nil || n == 10 {
+		t.Fatalf("expected one file kept of those rolled over, with %d packets of 10", n)
+	}
+}
+
+// Packets the writer has no room for are dropped, not waited on
+func Test_capture_drops(t *testing.T) {
+	c := &capture{packets: make(chan capturedPacket, 1)}
+	c.packet(nil, nil, []byte{2, PINGREQ})
+	c.packet(nil, nil, []byte{2, PINGREQ})
+	if _, dropped := c.counts(); dropped != 1 {
+		t.Fatalf("expected 1 packet dropped, got %d", dropped)
+	}
+}
+
+func Test_admin_capture(t *testing.T) {
+	f := newFakeClient(t)
+	ag, _ := newTestAGateway(t, f)
+	url := startAdmin(t, ag.admin) + "/debug/capture"
+	defer stopCapture()
+
+	var info captureInfo
+	if status := postJSON(t, url+"?enable=true", "", &info); status != http.StatusConflict {
+		t.Fatalf("expected a capture refused without capture-file, got %d", status)
+	}
+	ag.config.Load().capturefile = filepath.Join(t.TempDir(), "gateway.pcap")
+	if status := postJSON(t, url+"?enable=true&duration=100ms", "", &info); status != http.StatusOK || !info.Active || info.Until == nil {
+		t.Fatalf("expected a capture for 100ms, got %d %+v", status, info)
+	}
+	for deadline := time.Now().Add(2 * time.Second); captures.Load() != nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the capture stopped after its duration")
+		}
+	}
+	getJSON(t, url, &info)
+	if info.Active {
+		t.Fatalf("expected no capture, got %+v", info)
+	}
+	pcapPackets(t, ag.config.Load().capturefile)
+}
@@ -0,0 +1,72 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_config_check(t *testing.T) {
+	var looked []string
+	lookupHost = func(host string) ([]string, error) {
+		looked = append(looked, host)
+		if host == "nowhere.invalid" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []string{"192.0.2.1"}, nil
+	}
+	defer func() { lookupHost = net.LookupHost }()
+
+	dir := t.TempDir()
+	creds := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(creds, []byte("sensor1 user secret\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	held := filepath.Join(dir, "held")
+	gc := &GatewayConfig{
+		mqttbroker:       "tcp://broker.example.com:1883",
+		upstreams:        []upstreamConfig{{"b", "tcp://127.0.0.1:1883"}},
+		credentialsfile:  creds,
+		offlinequeuefile: held,
+		aggregating:      true,
+	}
+	var out bytes.Buffer
+	if err := gc.Check(&out); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if len(looked) != 1 || looked[0] != "broker.example.com" {
+		t.Fatalf("expected broker.example.com alone resolved, got %v", looked)
+	}
+	for _, expected := range []string{"mode: aggregating", "upstream broker b: tcp://127.0.0.1:1883", "held PUBLISHes: 0", "configuration OK"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in the summary, got %s", expected, out.String())
+		}
+	}
+	if _, err := os.Stat(held); !os.IsNotExist(err) {
+		t.Fatalf("expected the queue file left alone, got %v", err)
+	}
+
+	gc.mqttbroker = "tcp://nowhere.invalid:1883"
+	gc.credentialsfile = filepath.Join(dir, "missing")
+	gc.dtlsport = 20000
+	gc.dtlspskfile = creds
+	out.Reset()
+	err := gc.Check(&out)
+	var es ConfigErrors
+	if !errors.As(err, &es) || len(es) != 3 {
+		t.Fatalf("expected 3 problems, got %v", err)
+	}
+	for i, key := range []string{"mqtt-broker", "dtls-port", "credentials-file"} {
+		if es[i].Key != key {
+			t.Errorf("expected a problem with %s, got %v", key, es[i])
+		}
+	}
+	if !errors.Is(es[1], ErrInvalidPSK) || out.Len() != 0 {
+		t.Fatalf("expected %v and no summary, got %v and %s", ErrInvalidPSK, es[1], out.String())
+	}
+}
@@ -0,0 +1,556 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func init() {
+	InitLogger(ioutil.Discard, ioutil.Discard)
+}
+
+// A broker message, as handed to distribute()
+type fakeMessage struct {
+	topic   string
+	payload []byte
+	qos     byte
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return m.qos }
+func (m *fakeMessage) Retained() bool    { return false }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+
+// An MQTT-SN device on the loopback interface, receiving
+// whatever the gateway sends to it
+type fakeClient struct {
+	conn *net.UDPConn
+	t    *testing.T
+}
+
+func newFakeClient(t *testing.T) *fakeClient {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	return &fakeClient{conn, t}
+}
+
+// A fakeClient on the IPv6 loopback interface, skipping the
+// test if there is none
+func newFakeClient6(t *testing.T) *fakeClient {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	return &fakeClient{conn, t}
+}
+
+func (f *fakeClient) addr() uAddr {
+	return uAddr{f.conn.LocalAddr().(*net.UDPAddr)}
+}
+
+// Return the next message sent to the client, or nil if
+// nothing arrives within d
+func (f *fakeClient) receive(d time.Duration) Message {
+	buf := make([]byte, 1500)
+	f.conn.SetReadDeadline(time.Now().Add(d))
+	n, _, err := f.conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil
+	}
+	m, err := ReadPacket(bytes.NewBuffer(buf[:n]))
+	if err != nil {
+		f.t.Fatalf("ReadPacket: %v", err)
+	}
+	return m
+}
+
+func (f *fakeClient) expect(msgType byte) Message {
+	m := f.receive(time.Second)
+	if m == nil {
+		f.t.Fatalf("expected %s, got nothing", MessageNames[msgType])
+	}
+	if m.MessageType() != msgType {
+		f.t.Fatalf("expected %s, got %s", MessageNames[msgType], MessageNames[m.MessageType()])
+	}
+	return m
+}
+
+func (f *fakeClient) expectNothing() {
+	if m := f.receive(50 * time.Millisecond); m != nil {
+		f.t.Fatalf("expected nothing, got %s", MessageNames[m.MessageType()])
+	}
+}
+
+// An AGateway with one connected client, backed by f
+func newTestAGateway(t *testing.T, f *fakeClient) (*AGateway, *Client) {
+	gwconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	ag := NewAGateway(&GatewayConfig{})
+	client := NewClient("fake", uConn{gwconn, 0, nil}, f.addr())
+	ag.clients.AddClient(client)
+	// nothing it has sent is resent once the test is over
+	t.Cleanup(client.Close)
+	return ag, client
+}
+
+// Subscribe client to filter as handle_SUBSCRIBE would, without
+// involving the broker
+func subscribe(ag *AGateway, client *Client, filter string, qos byte) {
+	ag.tTree.AddSubscription(client, filter)
+	client.Subscribe(filter, qos)
+}
+
+func regack(rm *RegisterMessage) *RegackMessage {
+	return NewRegackMessage(rm.TopicId, rm.MessageId, ACCEPTED)
+}
+
+func Test_Client_one_REGISTER_per_topic(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	subscribe(ag, client, "a/#", 0)
+
+	for i := 0; i < 3; i++ {
+		ag.distribute(&fakeMessage{"a/1", []byte{byte(i)}, 0})
+	}
+	rm := f.expect(REGISTER).(*RegisterMessage)
+	f.expectNothing()
+
+	ag.handle_REGACK(regack(rm), client)
+	for i := 0; i < 3; i++ {
+		pm := f.expect(PUBLISH).(*PublishMessage)
+		if pm.Data[0] != byte(i) {
+			t.Fatalf("expected message %d, got %d", i, pm.Data[0])
+		}
+	}
+}
+
+// Resend the REGISTER in flight for topicId now rather than
+// after the retry interval
+func retryRegisterNow(client *Client, topicId uint16) {
+	client.Lock()
+	rt := client.registering[topicId]
+	client.Unlock()
+	rt.timer.Reset(0)
+}
+
+// Once the REGISTER has been resent as often as it may be, the
+// messages waiting on it are dropped and the next message for
+// the topic is registered afresh
+func Test_Client_REGISTER_give_up(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	subscribe(ag, client, "a/#", 0)
+
+	for i := 0; i < 3; i++ {
+		ag.distribute(&fakeMessage{"a/1", []byte{byte(i)}, 0})
+	}
+	rm := f.expect(REGISTER).(*RegisterMessage)
+	for i := 0; i < client.timers.retryCount; i++ {
+		retryRegisterNow(client, rm.TopicId)
+		f.expect(REGISTER)
+	}
+	retryRegisterNow(client, rm.TopicId)
+	f.expectNothing()
+	client.RLock()
+	_, inflight := client.registering[rm.TopicId]
+	client.RUnlock()
+	if inflight {
+		t.Fatalf("expected no REGISTER in flight after giving up")
+	}
+
+	ag.distribute(&fakeMessage{"a/1", []byte{3}, 0})
+	rm = f.expect(REGISTER).(*RegisterMessage)
+	ag.handle_REGACK(regack(rm), client)
+	if pm := f.expect(PUBLISH).(*PublishMessage); pm.Data[0] != 3 {
+		t.Fatalf("expected only message 3, got %d", pm.Data[0])
+	}
+	f.expectNothing()
+}
+
+func Test_Client_ordered_flush_after_REGACK(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	subscribe(ag, client, "a/#", 0)
+
+	ag.distribute(&fakeMessage{"a/1", []byte{1}, 0})
+	ag.distribute(&fakeMessage{"a/1", []byte{2}, 0})
+	rm1 := f.expect(REGISTER).(*RegisterMessage)
+	ag.distribute(&fakeMessage{"a/2", []byte{3}, 0})
+	rm2 := f.expect(REGISTER).(*RegisterMessage)
+
+	// a/2 is acknowledged first, but must not overtake a/1
+	ag.handle_REGACK(regack(rm2), client)
+	f.expectNothing()
+
+	ag.handle_REGACK(regack(rm1), client)
+	// arrives mid-drain, goes to the back of the queue
+	ag.distribute(&fakeMessage{"a/1", []byte{4}, 0})
+
+	for i := byte(1); i <= 4; i++ {
+		pm := f.expect(PUBLISH).(*PublishMessage)
+		if pm.Data[0] != i {
+			t.Fatalf("expected message %d, got %d", i, pm.Data[0])
+		}
+	}
+	f.expectNothing()
+}
+
+func Test_Client_inflight_window(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	subscribe(ag, client, "a", 1)
+
+	ag.distribute(&fakeMessage{"a", []byte{1}, 1})
+	rm := f.expect(REGISTER).(*RegisterMessage)
+	ag.distribute(&fakeMessage{"a", []byte{2}, 1})
+	ag.handle_REGACK(regack(rm), client)
+
+	pm := f.expect(PUBLISH).(*PublishMessage)
+	if pm.Data[0] != 1 {
+		t.Fatalf("expected message 1, got %d", pm.Data[0])
+	}
+	// the window is full until the first is acknowledged
+	f.expectNothing()
+	ag.distribute(&fakeMessage{"a", []byte{3}, 0})
+	f.expectNothing()
+
+	pa := NewMessage(PUBACK).(*PubackMessage)
+	pa.MessageId = pm.MessageId
+	ag.handle_PUBACK(pa, client)
+	// QoS 0 does not occupy the window, so 3 follows 2 at once
+	for i := byte(2); i <= 3; i++ {
+		if pm = f.expect(PUBLISH).(*PublishMessage); pm.Data[0] != i {
+			t.Fatalf("expected message %d, got %d", i, pm.Data[0])
+		}
+	}
+	f.expectNothing()
+}
+
+func pingreq(clientid string) *PingreqMessage {
+	pr := NewMessage(PINGREQ).(*PingreqMessage)
+	pr.ClientId = []byte(clientid)
+	return pr
+}
+
+func sleep(ag *AGateway, f *fakeClient) {
+	dm := NewMessage(DISCONNECT).(*DisconnectMessage)
+	dm.Duration = 60
+	ag.handle_DISCONNECT(dm, ag.clients.GetClient(f.addr()))
+	f.expect(DISCONNECT)
+}
+
+func Test_Client_PINGREQ_awake(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+
+	// an active client is answered at once
+	ag.handle_PINGREQ(pingreq(""), client.Conn, f.addr())
+	f.expect(PINGRESP)
+
+	// as is a sleeping one with nothing buffered
+	sleep(ag, f)
+	ag.handle_PINGREQ(pingreq("fake"), client.Conn, f.addr())
+	f.expect(PINGRESP)
+	if client.State() != ASLEEP {
+		t.Fatalf("client did not go back to sleep")
+	}
+}
+
+func Test_Client_PINGRESP_after_buffered(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	subscribe(ag, client, "a/#", 0)
+
+	sleep(ag, f)
+	for i := byte(1); i <= 3; i++ {
+		ag.distribute(&fakeMessage{"a/1", []byte{i}, 0})
+	}
+	f.expectNothing()
+
+	ag.handle_PINGREQ(pingreq("fake"), client.Conn, f.addr())
+	rm := f.expect(REGISTER).(*RegisterMessage)
+	// no PINGRESP while the REGISTER is outstanding
+	f.expectNothing()
+
+	ag.handle_REGACK(regack(rm), client)
+	for i := byte(1); i <= 3; i++ {
+		if pm := f.expect(PUBLISH).(*PublishMessage); pm.Data[0] != i {
+			t.Fatalf("expected message %d, got %d", i, pm.Data[0])
+		}
+	}
+	f.expect(PINGRESP)
+
+	ag.distribute(&fakeMessage{"a/1", []byte{4}, 0})
+	f.expectNothing()
+}
+
+// A client is lost once silent for its keepalive, or its sleep
+// duration while it sleeps, times the grace its timers give
+func Test_Client_supervision_grace(t *testing.T) {
+	c := NewClient("c", uConn{}, uAddr{})
+	c.timers.keepAliveGrace, c.timers.sleepGrace = 2, 3
+	lost := make(chan struct{}, 1)
+	c.Supervise(10*time.Second, func() { lost <- struct{}{} })
+	defer c.Close()
+	if d := c.silence(); d != 20*time.Second {
+		t.Fatalf("expected 20s awake, got %v", d)
+	}
+	c.SetState(ASLEEP)
+	c.SetKeepAlive(time.Minute)
+	if d := c.silence(); d != 3*time.Minute {
+		t.Fatalf("expected 3m asleep, got %v", d)
+	}
+
+	c.SetState(ACTIVE)
+	c.SetKeepAlive(10 * time.Millisecond)
+	select {
+	case <-lost:
+		t.Fatalf("lost before 20ms")
+	case <-time.After(15 * time.Millisecond):
+	}
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatalf("not lost after 20ms")
+	}
+}
+
+func Test_Client_timeout_while_awake(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	client.timers.retryInterval, client.timers.retryCount = 20*time.Millisecond, 0
+	subscribe(ag, client, "a", 1)
+	client.Register(ag.tIndex.putTopic("a"), "a")
+
+	sleep(ag, f)
+	ag.distribute(&fakeMessage{"a", []byte{1}, 1})
+	ag.distribute(&fakeMessage{"a", []byte{2}, 1})
+	ag.handle_PINGREQ(pingreq("fake"), client.Conn, f.addr())
+	f.expect(PUBLISH)
+	// the client falls asleep without acknowledging it
+	f.expectNothing()
+	if client.State() != ASLEEP {
+		t.Fatalf("client is not asleep after timing out")
+	}
+
+	ag.handle_PINGREQ(pingreq("fake"), client.Conn, f.addr())
+	for i := byte(1); i <= 2; i++ {
+		pm := f.expect(PUBLISH).(*PublishMessage)
+		if pm.Data[0] != i {
+			t.Fatalf("expected message %d, got %d", i, pm.Data[0])
+		}
+		pa := NewMessage(PUBACK).(*PubackMessage)
+		pa.MessageId = pm.MessageId
+		ag.handle_PUBACK(pa, client)
+	}
+	f.expect(PINGRESP)
+}
+
+func puback(pm *PublishMessage, rc byte) *PubackMessage {
+	pa := NewMessage(PUBACK).(*PubackMessage)
+	pa.TopicId = pm.TopicId
+	pa.MessageId = pm.MessageId
+	pa.ReturnCode = rc
+	return pa
+}
+
+func Test_Client_PUBACK_invalid_topic_id(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	subscribe(ag, client, "a", 1)
+
+	ag.distribute(&fakeMessage{"a", []byte{1}, 1})
+	ag.handle_REGACK(regack(f.expect(REGISTER).(*RegisterMessage)), client)
+	ag.handle_PUBACK(puback(f.expect(PUBLISH).(*PublishMessage), ACCEPTED), client)
+
+	// the client restarts and forgets its topic ids
+	ag.distribute(&fakeMessage{"a", []byte{2}, 1})
+	ag.distribute(&fakeMessage{"a", []byte{3}, 1})
+	pm := f.expect(PUBLISH).(*PublishMessage)
+	ag.handle_PUBACK(puback(pm, REJ_INVALID_TID), client)
+
+	rm := f.expect(REGISTER).(*RegisterMessage)
+	if string(rm.TopicName) != "a" || rm.TopicId != pm.TopicId {
+		t.Fatalf("unexpected REGISTER of %d for %s", rm.TopicId, rm.TopicName)
+	}
+	f.expectNothing()
+	ag.handle_REGACK(regack(rm), client)
+	for i := byte(2); i <= 3; i++ {
+		pm = f.expect(PUBLISH).(*PublishMessage)
+		if pm.Data[0] != i {
+			t.Fatalf("expected message %d, got %d", i, pm.Data[0])
+		}
+		ag.handle_PUBACK(puback(pm, ACCEPTED), client)
+	}
+	f.expectNothing()
+}
+
+func Test_Client_PUBACK_invalid_topic_id_bounded(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	subscribe(ag, client, "a", 1)
+
+	ag.distribute(&fakeMessage{"a", []byte{1}, 1})
+	rm := f.expect(REGISTER).(*RegisterMessage)
+	for i := 0; i < maxRecoveries; i++ {
+		ag.handle_REGACK(regack(rm), client)
+		ag.handle_PUBACK(puback(f.expect(PUBLISH).(*PublishMessage), REJ_INVALID_TID), client)
+		rm = f.expect(REGISTER).(*RegisterMessage)
+	}
+	ag.handle_REGACK(regack(rm), client)
+	ag.handle_PUBACK(puback(f.expect(PUBLISH).(*PublishMessage), REJ_INVALID_TID), client)
+	// given up on: dropped rather than registered again
+	f.expectNothing()
+}
+
+func Test_Client_Supervise(t *testing.T) {
+	client := NewClient("c", uConn{}, uAddr{})
+	lost := make(chan bool, 1)
+	client.Supervise(20*time.Millisecond, func() { lost <- true })
+	for i := 0; i < 3; i++ {
+		time.Sleep(15 * time.Millisecond)
+		client.Touch()
+	}
+	select {
+	case <-lost:
+		t.Fatalf("lost while being heard from")
+	default:
+	}
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatalf("not lost when quiet")
+	}
+	client.Close()
+}
+
+// A socket to which writes fail as they do once ICMP has
+// reported the client's port unreachable
+type refusingConn struct {
+	replier
+	refuse int32
+}
+
+func (c *refusingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if atomic.LoadInt32(&c.refuse) != 0 {
+		return 0, syscall.ECONNREFUSED
+	}
+	return c.replier.WriteTo(b, addr)
+}
+
+// A client that cannot be written to is lost as soon as a few
+// writes in a row have failed, or one to its own connection has
+func Test_Client_unreachable(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	conn := &refusingConn{client.Conn.c, 0}
+	ag.handle_CONNECT(connectMessage("gone", false), uConn{conn, 0, nil}, f.addr())
+	f.expect(CONNACK)
+	gone := ag.clients.GetClient(f.addr()).(*Client)
+
+	atomic.StoreInt32(&conn.refuse, 1)
+	for i := 1; i <= maxSendFailures; i++ {
+		err := gone.Write(NewMessage(PINGRESP))
+		if se, ok := err.(*SendError); !ok || se.ClientId != "gone" || !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("expected a SendError for \"gone\", got %v", err)
+		}
+		if i < maxSendFailures && ag.clients.GetClient(f.addr()) == nil {
+			t.Fatalf("lost after %d failed writes", i)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for ag.clients.GetClient(f.addr()) != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if ag.clients.GetClient(f.addr()) != nil {
+		t.Fatalf("still a client after %d failed writes", maxSendFailures)
+	}
+
+	// a write that succeeds starts the count again
+	c := NewClient("flaky", uConn{conn, 0, nil}, f.addr())
+	c.onUnreachable = func() { t.Errorf("flaky client taken to be unreachable") }
+	for i := 0; i < 2*maxSendFailures; i++ {
+		atomic.StoreInt32(&conn.refuse, int32(i%2))
+		c.Write(NewMessage(PINGRESP))
+	}
+
+	ours, theirs := net.Pipe()
+	theirs.Close()
+	lost := make(chan struct{})
+	c = NewClient("streamer", uConn{tcpConn{ours}, 0, nil}, uAddr{ours.LocalAddr()})
+	c.onUnreachable = func() { close(lost) }
+	if err := c.Write(NewMessage(PINGRESP)); err == nil {
+		t.Fatalf("wrote to a closed connection")
+	}
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatalf("a client whose connection has closed is not lost")
+	}
+}
+
+// A message too large for a client's own limit is dropped and
+// counted for it, and delivered to the clients it fits unless
+// the policy is to drop it for all of them
+func Test_AGateway_oversize_policy(t *testing.T) {
+	for _, policy := range []string{oversizeFit, oversizeDrop} {
+		t.Run(policy, func(t *testing.T) {
+			small, large := newFakeClient(t), newFakeClient(t)
+			ag, sc := newTestAGateway(t, small)
+			ag.oversizePolicy = policy
+			sc.SetMaxMessageSize(20)
+			lc := NewClient("large", sc.Conn, large.addr())
+			ag.clients.AddClient(lc)
+			subscribe(ag, sc, "a/#", 0)
+			subscribe(ag, lc, "a/#", 0)
+
+			ag.distribute(&fakeMessage{"a/1", bytes.Repeat([]byte("x"), 20), 0})
+			ag.distribute(&fakeMessage{"a/1", bytes.Repeat([]byte("x"), 20), 0})
+			small.expectNothing()
+			if policy == oversizeFit {
+				large.expect(REGISTER)
+			} else {
+				large.expectNothing()
+			}
+			if n := sc.Oversized(); n != 2 {
+				t.Fatalf("expected 2 dropped for the small client, counted %d", n)
+			}
+			if n, want := lc.Oversized(), map[string]uint64{oversizeFit: 0, oversizeDrop: 2}[policy]; n != want {
+				t.Fatalf("expected %d dropped for the large client, counted %d", want, n)
+			}
+
+			ag.distribute(&fakeMessage{"a/2", []byte{1}, 0})
+			small.expect(REGISTER)
+		})
+	}
+}
+
+// A listener's limit on what is sent applies to its clients as
+// well as the connection's own maximum
+func Test_uConn_listener_outbound(t *testing.T) {
+	conn := newMemConn(1)
+	l := newListenerCounters("udp", conn.addr)
+	c := uConn{conn, 64, l}
+	pm := NewPublishMessage(1, 0, bytes.Repeat([]byte("x"), 30), 0, 0, false, false)
+	if !c.fits(pm, uAddr{conn.addr}) {
+		t.Fatalf("expected a PUBLISH within the maximum to fit")
+	}
+	l.setOutbound(32)
+	if c.fits(pm, uAddr{conn.addr}) || c.WriteTo(pm, uAddr{conn.addr}) != ErrMessageTooLarge {
+		t.Fatalf("expected a PUBLISH beyond the listener's limit not to be sent")
+	}
+}
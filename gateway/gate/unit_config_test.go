@@ -0,0 +1,878 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_config_bind_address(t *testing.T) {
+	for _, b := range []struct {
+		config   string
+		expected string
+	}{
+		{"port 1884", ":1884"},
+		{"port 1884\nbind-address 10.0.3.1", "10.0.3.1:1884"},
+		{"port 1884\nbind-address 10.0.3.1:1885", "10.0.3.1:1885"},
+		{"bind-address ::1", "[::1]:0"},
+		{"bind-address [::1]:1884", "[::1]:1884"},
+		{"bind-address fe80::1%eth0", "[fe80::1%eth0]:0"},
+		{"bind-address [fe80::1%eth0]:1884", "[fe80::1%eth0]:1884"},
+	} {
+		gc := &GatewayConfig{}
+		if err := gc.parseConfig(b.config); err != nil {
+			t.Errorf("%q: %v", b.config, err)
+		} else if addr := gc.listenAddress(); addr != b.expected {
+			t.Errorf("%q: expected %s, got %s", b.config, b.expected, addr)
+		}
+	}
+	for _, bad := range []string{"sensors.local", "sensors.local:1884", "10.0.3.1:port", "10.0.3.1:"} {
+		gc := &GatewayConfig{}
+		if err := gc.parseConfig("bind-address " + bad); err != ErrInvalidBindAddress {
+			t.Errorf("%s: expected %v, got %v", bad, ErrInvalidBindAddress, err)
+		}
+	}
+}
+
+func Test_config_dtls_address(t *testing.T) {
+	for _, b := range []struct {
+		config   string
+		expected string
+	}{
+		{"port 1884", ""},
+		{"port 1884\ndtls-port 1885", ":1885"},
+		{"dtls-port 1885\nbind-address 10.0.3.1", "10.0.3.1:1885"},
+		{"dtls-port 1885\nbind-address 10.0.3.1:1884", "10.0.3.1:1885"},
+		{"dtls-port 1885\nbind-address [::1]:1884", "[::1]:1885"},
+	} {
+		gc := &GatewayConfig{}
+		if err := gc.parseConfig(b.config); err != nil {
+			t.Errorf("%q: %v", b.config, err)
+		} else if addr := gc.dtlsAddress(); addr != b.expected {
+			t.Errorf("%q: expected %q, got %q", b.config, b.expected, addr)
+		}
+	}
+}
+
+func Test_network(t *testing.T) {
+	for addr, expected := range map[string]string{
+		":1884":               "udp",
+		"10.0.3.1:1884":       "udp4",
+		"[::1]:1884":          "udp6",
+		"[fe80::1%eth0]:1884": "udp6",
+		"[::ffff:10.0.3.1]:0": "udp4",
+	} {
+		if nw := network(addr); nw != expected {
+			t.Errorf("%s: expected %s, got %s", addr, expected, nw)
+		}
+	}
+}
+
+func Test_Gateway_bind_address(t *testing.T) {
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1:0"})
+	ag.mqttclient = &fakeBroker{}
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+	if !strings.HasPrefix(ag.Addr(), "127.0.0.1:") || ag.Port() == 0 {
+		t.Fatalf("expected to be bound to 127.0.0.1, got %s", ag.Addr())
+	}
+
+	// an address that is not the gateway's own
+	tg, _ := NewTGateway(&GatewayConfig{bindaddress: "192.0.2.1:1884"})
+	if err := tg.Start(); err == nil || !strings.Contains(err.Error(), "192.0.2.1:1884") {
+		t.Fatalf("expected an error naming the address, got %v", err)
+	}
+}
+
+func Test_config_unix_socket_mode(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("unix-socket /run/gnatt.sock"); err != nil || gc.unixSocketMode() != 0660 {
+		t.Fatalf("default mode %o, %v", gc.unixSocketMode(), err)
+	}
+	if err := gc.parseConfig("unix-socket-mode 0600"); err != nil || gc.unixSocketMode() != 0600 {
+		t.Fatalf("mode %o, %v", gc.unixSocketMode(), err)
+	}
+	for _, bad := range []string{"rw-rw----", "0680", "01777"} {
+		if err := gc.parseConfig("unix-socket-mode " + bad); err != ErrInvalidFileMode {
+			t.Errorf("%s: expected %v, got %v", bad, ErrInvalidFileMode, err)
+		}
+	}
+}
+
+func Test_config_max_message_size(t *testing.T) {
+	gc := &GatewayConfig{}
+	if gc.maxMessageSize() != 1400 {
+		t.Fatalf("default size %d", gc.maxMessageSize())
+	}
+	if err := gc.parseConfig("max-message-size 512"); err != nil || gc.maxMessageSize() != 512 {
+		t.Fatalf("size %d, %v", gc.maxMessageSize(), err)
+	}
+	for _, bad := range []string{"7", "65536"} {
+		if err := gc.parseConfig("max-message-size " + bad); err != ErrInvalidMessageSize {
+			t.Errorf("%s: expected %v, got %v", bad, ErrInvalidMessageSize, err)
+		}
+	}
+}
+
+func Test_config_oversize_policy(t *testing.T) {
+	gc := &GatewayConfig{}
+	if gc.oversizePolicy() != oversizeFit {
+		t.Fatalf("default policy %s", gc.oversizePolicy())
+	}
+	if err := gc.parseConfig("oversize-policy drop\nmax-outbound-size 100"); err != nil || gc.oversizePolicy() != oversizeDrop || gc.maxoutbound != 100 {
+		t.Fatalf("policy %s, max outbound size %d, %v", gc.oversizePolicy(), gc.maxoutbound, err)
+	}
+	if err := gc.parseConfig("oversize-policy truncate"); err != ErrInvalidOversizePolicy {
+		t.Fatalf("expected %v, got %v", ErrInvalidOversizePolicy, err)
+	}
+}
+
+func Test_config_broker_timeouts(t *testing.T) {
+	gc := &GatewayConfig{}
+	if gc.brokerKeepAlive() != defaultMQTTKeepAlive || gc.brokerConnectTimeout() != defaultConnectTimeout || gc.publishTimeout() != brokerTimeout {
+		t.Fatalf("defaults %v, %v, %v", gc.brokerKeepAlive(), gc.brokerConnectTimeout(), gc.publishTimeout())
+	}
+	if err := gc.parseConfig("mqtt-timeout 300\nconnect-timeout 10\npublish-timeout 3"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if gc.brokerKeepAlive() != 300*time.Second || gc.brokerConnectTimeout() != 10*time.Second || gc.publishTimeout() != 3*time.Second {
+		t.Fatalf("got %v, %v, %v", gc.brokerKeepAlive(), gc.brokerConnectTimeout(), gc.publishTimeout())
+	}
+	if err := gc.parseConfig("mqtt-keepalive 30"); err != nil || gc.brokerKeepAlive() != 30*time.Second {
+		t.Fatalf("keepalive %v, %v", gc.brokerKeepAlive(), err)
+	}
+}
+
+// Times are durations, bare numbers still taken in the units the
+// options were once given in, but warned of
+func Test_config_durations(t *testing.T) {
+	var warnings strings.Builder
+	InitLogger(ioutil.Discard, &warnings)
+	defer InitLogger(ioutil.Discard, ioutil.Discard)
+
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("mqtt-protocol-version 5\nconnect-timeout 1m30s\ndrain-timeout 2m\nadvertise-interval 1h\nkeepalive-max 10m\nmqtt-session-expiry 24h\nmqtt-message-expiry a/#=90s"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if gc.brokerConnectTimeout() != 90*time.Second || gc.DrainTimeout() != 2*time.Minute || gc.advertiseInterval() != time.Hour || gc.keepalivemax != 10*time.Minute {
+		t.Fatalf("got %v, %v, %v, %v", gc.brokerConnectTimeout(), gc.DrainTimeout(), gc.advertiseInterval(), gc.keepalivemax)
+	}
+	if m := gc.mqtt5(); m.sessionExpiry != 86400 || m.messageExpiry[0].seconds != 90 {
+		t.Fatalf("expected expiries of 86400 and 90 seconds, got %+v", m)
+	}
+	if warnings.Len() != 0 {
+		t.Fatalf("expected no warnings, got %s", warnings.String())
+	}
+
+	if err := gc.parseConfig("publish-timeout 3\nfault-delay 20"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if gc.publishTimeout() != 3*time.Second || gc.faultdelay != 20*time.Millisecond {
+		t.Fatalf("got %v, %v", gc.publishTimeout(), gc.faultdelay)
+	}
+	if w := warnings.String(); !strings.Contains(w, `"publish-timeout" given as a bare number`) || !strings.Contains(w, `"20ms"`) {
+		t.Fatalf("expected the bare numbers warned of, got %s", w)
+	}
+
+	if err := gc.parseConfig("connect-timeout soon"); err != ErrInvalidDuration {
+		t.Fatalf("expected %v, got %v", ErrInvalidDuration, err)
+	}
+	if err := gc.parseConfig("mqtt-session-expiry 500ms"); err != ErrInvalidExpiry {
+		t.Fatalf("expected %v, got %v", ErrInvalidExpiry, err)
+	}
+	gc = &GatewayConfig{mqttbroker: "tcp://b:1883"}
+	if err := gc.parseConfig("connection-idle-timeout -1m"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	var ce *ConfigError
+	if err := gc.Validate(); !errors.As(err, &ce) || ce.Key != "connection-idle-timeout" || !errors.Is(err, ErrNegative) {
+		t.Fatalf("expected connection-idle-timeout %v, got %v", ErrNegative, err)
+	}
+}
+
+func Test_config_faults(t *testing.T) {
+	gc := &GatewayConfig{}
+	if gc.faults() != nil {
+		t.Fatalf("faults injected by default")
+	}
+	if err := gc.parseConfig("fault-loss 0.1\nfault-delay 20\nfault-jitter 5\nfault-reorder 2\nfault-seed 7"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	want := Faults{0.1, 0, 20 * time.Millisecond, 5 * time.Millisecond, 2, 7}
+	if f := gc.faults(); f == nil || *f != want {
+		t.Fatalf("expected %+v, got %+v", want, f)
+	}
+	for _, bad := range []string{"-0.1", "1.5", "often"} {
+		if err := gc.parseConfig("fault-duplicate " + bad); err != ErrInvalidProbability {
+			t.Errorf("%s: expected %v, got %v", bad, ErrInvalidProbability, err)
+		}
+	}
+}
+
+func Test_config_listener(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("listener udp://192.168.1.10:1884\nlistener unix:///run/gnatt.sock"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if len(gc.listeners) != 2 || gc.listeners[0].String() != "udp://192.168.1.10:1884" || gc.listeners[1].address != "/run/gnatt.sock" {
+		t.Fatalf("listeners %v", gc.listeners)
+	}
+	if err := gc.parseConfig("listener udp://[fd00::1]:1884?max-outbound-size=100"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if lc := gc.listeners[2]; lc.address != "[fd00::1]:1884" || lc.outbound != 100 {
+		t.Fatalf("listener %v, max outbound size %d", lc, lc.outbound)
+	}
+	if err := gc.parseConfig("listener dtls://:8883?psk-file=site.psk&max-message-size=512&allow-qos-minus-one=true\nlistener unixgram:///run/gw.sock?mode=0600\nlistener serial:///dev/ttyS0?baud=9600"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if lc := gc.listeners[3]; lc.dtls.psk != "site.psk" || lc.maxSize != 512 || !lc.qosMinusOne {
+		t.Fatalf("expected the DTLS listener's own options, got %+v", lc)
+	}
+	if lc := gc.listeners[4]; lc.kind != "unix" || lc.mode != 0600 || gc.listeners[5].baud != 9600 {
+		t.Fatalf("expected the unix and serial listeners' own options, got %+v", gc.listeners[4:])
+	}
+	for _, bad := range []string{"udp:1884", "http://:80", "dtls://", "udp://:1884?mtu=100", "udp://:1884?baud=9600", "tcp://:1884?psk-file=a.psk", "unix:///a.sock?mode=999"} {
+		if err := gc.parseConfig("listener " + bad); err != ErrInvalidListener && err != ErrInvalidFileMode {
+			t.Errorf("%s: expected %v, got %v", bad, ErrInvalidListener, err)
+		}
+	}
+}
+
+// Two listeners on the same address, flat or not, are refused
+func Test_config_duplicate_listeners(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig(`mqtt-broker tcp://b:1883
+port 1884
+tcp-port 1885
+unix-socket /run/gw.sock
+listener udp://0.0.0.0:1884
+listener dtls://:1885
+listener tcp://127.0.0.1:1885
+listener tcp://127.0.0.1:1886
+listener unix:///run/../run/gw.sock
+listener udp://:0
+listener udp6://127.0.0.1:1887
+listener udp://:0`); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	var es ConfigErrors
+	if err := gc.Validate(); !errors.As(err, &es) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	var keys []string
+	for _, e := range es {
+		keys = append(keys, e.Key)
+	}
+	if fmt.Sprint(keys) != "[listeners[6] listeners[0] listeners[4]]" {
+		t.Fatalf("expected the duplicates and the IPv4 udp6 listener, got %v", es)
+	}
+}
+
+func Test_config_broker_websocket(t *testing.T) {
+	gc := &GatewayConfig{}
+	for _, uri := range []string{"tcp://broker:1883", "tcps://broker:8883", "ws://broker:80/mqtt", "wss://broker:443/mqtt"} {
+		if err := gc.parseConfig("mqtt-broker " + uri); err != nil || gc.mqttbroker != uri {
+			t.Errorf("%s: broker %q, %v", uri, gc.mqttbroker, err)
+		}
+	}
+	for _, bad := range []string{"broker:1883", "http://broker/mqtt", "ws:/"} {
+		if err := gc.parseConfig("mqtt-broker " + bad); err != ErrNoTransportSpecified {
+			t.Errorf("%s: expected %v, got %v", bad, ErrNoTransportSpecified, err)
+		}
+	}
+	if err := gc.parseConfig("mqtt-header Authorization=Bearer%20abc\nmqtt-header X-Site=north\nmqtt-header X-Site=south"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if gc.mqttheaders.Get("Authorization") != "Bearer abc" || len(gc.mqttheaders["X-Site"]) != 2 {
+		t.Fatalf("headers %v", gc.mqttheaders)
+	}
+	for _, bad := range []string{"Authorization", "=abc", "X-Site=%zz"} {
+		if err := gc.parseConfig("mqtt-header " + bad); err != ErrInvalidBrokerHeader {
+			t.Errorf("%s: expected %v, got %v", bad, ErrInvalidBrokerHeader, err)
+		}
+	}
+}
+
+// The default configuration printed is read back as no options
+// at all, and set as it would be unset
+func Test_config_print_default(t *testing.T) {
+	var b strings.Builder
+	if err := PrintDefaultConfig(&b); err != nil {
+		t.Fatalf("PrintDefaultConfig: %v", err)
+	}
+	printed := b.String()
+	gc := &GatewayConfig{}
+	if err := gc.parseYAML([]byte(printed)); err != nil || !reflect.DeepEqual(gc, &GatewayConfig{}) {
+		t.Fatalf("expected the default configuration, got %+v, %v", gc, err)
+	}
+	for _, o := range configOptions {
+		if !strings.Contains(printed, "\n#"+o.name+":") {
+			t.Errorf("%s not printed", o.name)
+		}
+	}
+
+	// uncommented, the defaults change nothing
+	set := regexp.MustCompile(`(?m)^#([a-z0-9-]+: .+)$`).ReplaceAllString(printed, "$1")
+	if err := gc.parseYAML([]byte(set)); err != nil {
+		t.Fatalf("parseYAML: %v", err)
+	}
+	def := &GatewayConfig{}
+	gc.statustopic, def.statustopic = "status", "status"
+	for _, v := range [][2]interface{}{
+		{gc.IsAggregating(), def.IsAggregating()},
+		{gc.DrainTimeout(), def.DrainTimeout()},
+		{gc.advertiseInterval(), def.advertiseInterval()},
+		{gc.unixSocketMode(), def.unixSocketMode()},
+		{gc.serialBaud(), def.serialBaud()},
+		{gc.tcpIdleTimeout(), def.tcpIdleTimeout()},
+		{gc.connectionIdleTimeout(), def.connectionIdleTimeout()},
+		{gc.maxConnections(), def.maxConnections()},
+		{gc.maxMessageSize(), def.maxMessageSize()},
+		{gc.brokerKeepAlive(), def.brokerKeepAlive()},
+		{gc.brokerConnectTimeout(), def.brokerConnectTimeout()},
+		{gc.publishTimeout(), def.publishTimeout()},
+		{gc.offlineConnects(), def.offlineConnects()},
+		{gc.echoPolicy(), def.echoPolicy()},
+		{gc.oversizePolicy(), def.oversizePolicy()},
+		{*gc.status(), *def.status()},
+		{gc.mqttsession, def.mqttsession},
+	} {
+		if v[0] != v[1] {
+			t.Errorf("expected %v, got %v", v[1], v[0])
+		}
+	}
+}
+
+// Pre-defined topic ids are from 1 to 65534, each given once
+func Test_config_predefined_topics(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("predefined-topic 17=sensors/+/temp\npredefined-topic 65534=a/b"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if len(gc.predefined) != 2 || gc.predefined[0] != (predefinedTopic{17, "sensors/+/temp"}) {
+		t.Fatalf("expected the topics, got %+v", gc.predefined)
+	}
+	for _, bad := range []string{"17=other", "0=a", "65535=a", "x=a", "18=", "18=a/#/b", "=a"} {
+		if err := gc.setOption("predefined-topic", bad); err != ErrInvalidPredefinedTopic {
+			t.Errorf("%s: expected %v, got %v", bad, ErrInvalidPredefinedTopic, err)
+		}
+	}
+}
+
+// Later files override earlier ones, included or given in turn,
+// merging the named entries and adding to other lists
+func Test_config_include(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, config string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(config), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		return file
+	}
+	write("base.cfg", `port 1883
+mqtt-broker tcp://base:1883
+mqtt-header X-Site=base
+upstream-broker cloud=tcp://cloud:1883
+upstream-broker backup=tcp://backup:1883
+predefined-topic 17=a/b
+predefined-topic 18=c/d
+listener tcp://:1884`)
+	site := write("site.json", `{
+	"include": "base.cfg",
+	"port": 1885,
+	"mqtt-header": "X-Site=north",
+	"upstream-brokers": {"cloud": "tcp://other:1883"},
+	"predefined-topics": {"17": "e/f"},
+	"listeners": [{"type": "tcp", "address": ":1886"}]
+}`)
+	gc, err := ParseConfigFile(site)
+	if err != nil {
+		t.Fatalf("ParseConfigFile: %v", err)
+	}
+	if gc.port != 1885 || gc.mqttbroker != "tcp://base:1883" || fmt.Sprint(gc.mqttheaders["X-Site"]) != "[north]" {
+		t.Fatalf("expected the site's options over the base's, got %+v", gc)
+	}
+	if fmt.Sprint(gc.upstreams) != "[{backup tcp://backup:1883} {cloud tcp://other:1883}]" {
+		t.Fatalf("expected the upstreams merged, got %v", gc.upstreams)
+	}
+	if fmt.Sprint(gc.predefined) != "[{18 c/d} {17 e/f}]" {
+		t.Fatalf("expected the predefined topics merged, got %v", gc.predefined)
+	}
+	if len(gc.listeners) != 2 {
+		t.Fatalf("expected the listeners added to, got %v", gc.listeners)
+	}
+
+	override := write("override.cfg", "upstream-broker backup=tcp://spare:1883\nupstream-broker backup=tcp://again:1883")
+	if _, err := LoadConfig([]string{site, override}, "", nil); err != ErrInvalidUpstream {
+		t.Fatalf("expected a file's own duplicate refused, got %v", err)
+	}
+	override = write("override.cfg", "upstream-broker backup=tcp://spare:1883\nport 1887")
+	if gc, err := LoadConfig([]string{site, override}, "", nil); err != nil || gc.port != 1887 || gc.upstreams[1].broker != "tcp://spare:1883" {
+		t.Fatalf("expected the override applied, got %+v, %v", gc, err)
+	}
+
+	a := write("a.cfg", "port 1883\ninclude b.cfg")
+	write("b.cfg", "include a.cfg")
+	var ie *IncludeError
+	if _, err := ParseConfigFile(a); !errors.As(err, &ie) || !errors.Is(err, ErrIncludeCycle) || len(ie.Files) != 3 {
+		t.Fatalf("expected %v naming the files, got %v", ErrIncludeCycle, err)
+	}
+	missing := write("missing.cfg", "port 1883\ninclude nowhere.cfg")
+	if _, err := ParseConfigFile(missing); !errors.As(err, &ie) || ie.Files[1] != filepath.Join(dir, "nowhere.cfg") {
+		t.Fatalf("expected an error naming the missing file, got %v", err)
+	}
+}
+
+// What the sample structured files configure, on lines
+const sampleConfig = `mode aggregating
+port 1883
+mqtt-broker tcp://localhost:1883
+mqtt-user agateway
+mqtt-password wasspord
+mqtt-clientid AGGW
+mqtt-keepalive 300
+listener tcp://:1884?max-outbound-size=4096
+listener unix:///run/gnatt/gateway.sock?mode=0660
+upstream-broker cloud=tcps://cloud.example.com:8883
+upstream-route telemetry/=cloud
+upstream-route telemetry/local/=default
+predefined-topic 17=sensors/+/temp
+predefined-topic 18=alarms/fire
+upstream-qos-topic alarms/=2
+upstream-qos-topic telemetry/=0`
+
+// The sample JSON and YAML files configure what the same options
+// would on lines, and the sample plain file is still read as lines
+func Test_config_structured(t *testing.T) {
+	expected := &GatewayConfig{}
+	if err := expected.parseConfig(sampleConfig); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	for _, file := range []string{"../samples/aggregating.json", "../samples/aggregating.yaml"} {
+		gc, err := ParseConfigFile(file)
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if !reflect.DeepEqual(gc, expected) {
+			t.Fatalf("%s: expected %+v, got %+v", file, expected, gc)
+		}
+	}
+	if gc, err := ParseConfigFile("../samples/aggregating.cfg"); err != nil || !gc.IsAggregating() || gc.mqttclientid != "AGGW" {
+		t.Fatalf("expected the plain sample read, got %+v, %v", gc, err)
+	}
+	if gc, err := ParseConfigFileFormat("../samples/aggregating.json", "yaml"); err != nil || !reflect.DeepEqual(gc, expected) {
+		t.Fatalf("expected JSON read as YAML, got %+v, %v", gc, err)
+	}
+	if _, err := ParseConfigFileFormat("../samples/aggregating.cfg", "toml"); err != ErrInvalidConfigFormat {
+		t.Fatalf("expected %v, got %v", ErrInvalidConfigFormat, err)
+	}
+}
+
+// Errors in a JSON file name the option they are in
+func Test_config_json_errors(t *testing.T) {
+	for config, expected := range map[string]struct {
+		key string
+		err error
+	}{
+		`{"port": "x"}`:                            {"port", ErrNotANumber},
+		`{"mqtt-brokr": "tcp://b:1883"}`:           {"mqtt-brokr", ErrUnknownConfigOption},
+		`{"port": null}`:                           {"port", ErrMissingValueForConfigOption},
+		`{"port": {"udp": 1883}}`:                  {"port", ErrInvalidConfigValue},
+		`{"upstream-qos-topic": ["a/=1", "b/=3"]}`: {"upstream-qos-topic[1]", ErrInvalidQos},
+		`{"listeners": [{"type": "udp", "address": ":1"}, {"type": "http", "address": ":80"}]}`: {"listeners[1]", ErrInvalidListener},
+		`{"listeners": [{"type": "udp", "adress": ":1"}]}`:                                      {"listeners[0].adress", ErrUnknownConfigOption},
+		`{"listeners": {"type": "udp"}}`:                                                        {"listeners", ErrInvalidConfigValue},
+		`{"upstream-routes": {"diag/": "local"}}`:                                               {"upstream-routes.diag/", ErrInvalidRoute},
+		`{"upstream-brokers": {"default": "tcp://b:1883"}}`:                                     {"upstream-brokers.default", ErrInvalidUpstream},
+		`{"predefined-topics": {"1": "a", "65535": "b"}}`:                                       {"predefined-topics.65535", ErrInvalidPredefinedTopic},
+	} {
+		gc := &GatewayConfig{}
+		err := gc.UnmarshalJSON([]byte(config))
+		var ce *ConfigError
+		if !errors.As(err, &ce) || ce.Key != expected.key || !errors.Is(err, expected.err) {
+			t.Errorf("%s: expected %v in %s, got %v", config, expected.err, expected.key, err)
+		}
+	}
+	for _, bad := range []string{`["port", 1883]`, `{"port": 1883`, `{"port": 1883} {}`} {
+		gc := &GatewayConfig{}
+		if err := gc.UnmarshalJSON([]byte(bad)); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+	// json.Unmarshal decodes a GatewayConfig the same way
+	var gc GatewayConfig
+	if err := json.Unmarshal([]byte(`{"mode": "aggregating", "port": 1884}`), &gc); err != nil || !gc.aggregating || gc.port != 1884 {
+		t.Fatalf("expected the options set, got %+v, %v", gc, err)
+	}
+}
+
+// A YAML file is refused an unknown option or a second document
+func Test_config_yaml_errors(t *testing.T) {
+	for config, expected := range map[string]struct {
+		key string
+		err error
+	}{
+		"mqtt_brokr: tcp://b:1883":                     {"mqtt_brokr", ErrUnknownConfigOption},
+		"port: 1883\nmqtt-clean-session: maybe":        {"mqtt-clean-session", ErrNotABool},
+		"listeners:\n  - type: tcp\n    adress: :1884": {"listeners[0].adress", ErrUnknownConfigOption},
+		"upstream-brokers:\n  cloud:\n":                {"upstream-brokers.cloud", ErrMissingValueForConfigOption},
+	} {
+		gc := &GatewayConfig{}
+		err := gc.parseYAML([]byte(config))
+		var ce *ConfigError
+		if !errors.As(err, &ce) || ce.Key != expected.key || !errors.Is(err, expected.err) {
+			t.Errorf("%q: expected %v in %s, got %v", config, expected.err, expected.key, err)
+		}
+	}
+	gc := &GatewayConfig{}
+	if err := gc.parseYAML([]byte("port: 1883\n---\nport: 1884\n")); err != ErrMultipleDocuments {
+		t.Fatalf("expected %v, got %v", ErrMultipleDocuments, err)
+	}
+	if err := gc.parseYAML([]byte("- port\n- 1883\n")); err != ErrInvalidConfigFile {
+		t.Fatalf("expected %v, got %v", ErrInvalidConfigFile, err)
+	}
+}
+
+// The environment overrides the file, which overrides the
+// defaults
+func Test_config_env(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gateway.json")
+	if err := ioutil.WriteFile(file, []byte(`{
+		"port": 1883,
+		"mqtt-broker": "tcp://file:1883",
+		"mqtt-clean-session": true,
+		"upstream-qos-topic": ["a/=1"],
+		"listeners": [{"type": "tcp", "address": ":1884", "max-outbound-size": 512}],
+		"upstream-brokers": {"cloud": "tcp://cloud:1883"}
+	}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"GNATT_PORT":                   "1884",
+		"GNATT_MQTT_PASSWORD":          "secret",
+		"GNATT_MQTT_CLEAN_SESSION":     "false",
+		"GNATT_UPSTREAM_QOS_TOPIC":     "b/=2",
+		"GNATT_LISTENERS_0_ADDRESS":    "127.0.0.1:1885",
+		"GNATT_UPSTREAM_BROKERS_CLOUD": "tcps://cloud:8883",
+		"GNATT_UPSTREAM_BROKERS_EDGE":  "tcp://edge:1883",
+	} {
+		t.Setenv(k, v)
+	}
+	gc, err := ParseConfigFile(file)
+	if err != nil {
+		t.Fatalf("ParseConfigFile: %v", err)
+	}
+	if gc.port != 1884 || gc.mqttbroker != "tcp://file:1883" || gc.mqttpassword != "secret" || !gc.mqttsession || gc.maxMessageSize() != defaultMaxMessageSize {
+		t.Fatalf("expected the environment over the file over the defaults, got %+v", gc)
+	}
+	if gc.upstreamqos.upstream("a/x", 0) != 1 || gc.upstreamqos.upstream("b/x", 0) != 2 {
+		t.Fatalf("expected a repeated option added to, got %v", gc.upstreamqos)
+	}
+	if lc := gc.listeners[0]; lc.String() != "tcp://127.0.0.1:1885" || lc.outbound != 512 {
+		t.Fatalf("listener %v, max outbound size %d", lc, lc.outbound)
+	}
+	if fmt.Sprint(gc.upstreams) != "[{cloud tcps://cloud:8883} {edge tcp://edge:1883}]" {
+		t.Fatalf("upstreams %v", gc.upstreams)
+	}
+
+	for env, expected := range map[string]error{
+		"GNATT_PORT=x":                  ErrNotANumber,
+		"GNATT_MQTT_BROKR=tcp://b:1883": ErrUnknownConfigOption,
+		"GNATT_LISTENERS_1_ADDRESS=:1":  ErrUnknownConfigOption,
+		"GNATT_LISTENERS_0_TYPE=http":   ErrInvalidListener,
+	} {
+		err := gc.setEnv([]string{"HOME=/root", env})
+		var ce *ConfigError
+		if !errors.As(err, &ce) || ce.Key != env[:strings.Index(env, "=")] || !errors.Is(err, expected) {
+			t.Errorf("%s: expected %v, got %v", env, expected, err)
+		}
+	}
+}
+
+// Every option setOption knows, and every field of GatewayConfig,
+// is in configOptions, so the flags and the printed default
+// configuration have them all
+func Test_config_options_complete(t *testing.T) {
+	names, fields := map[string]bool{}, map[string]bool{}
+	for _, o := range configOptions {
+		names[o.name], fields[o.field] = true, true
+	}
+
+	// the include directive and the older name of mqtt-keepalive
+	// are left out, as is what a configuration is layered from
+	f, err := parser.ParseFile(token.NewFileSet(), "config.go", nil, 0)
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+	keys := 0
+	for _, d := range f.Decls {
+		if fn, ok := d.(*ast.FuncDecl); !ok || fn.Name.Name != "setOption" {
+			continue
+		}
+		ast.Inspect(d, func(n ast.Node) bool {
+			if c, ok := n.(*ast.CaseClause); ok {
+				for _, e := range c.List {
+					key, _ := strconv.Unquote(e.(*ast.BasicLit).Value)
+					if keys++; !names[key] && key != "include" && key != "mqtt-timeout" {
+						t.Errorf("option %s not in configOptions", key)
+					}
+				}
+			}
+			return true
+		})
+	}
+	if keys < len(configOptions) {
+		t.Fatalf("expected setOption's options, found %d", keys)
+	}
+	gc := reflect.TypeOf(GatewayConfig{})
+	for i := 0; i < gc.NumField(); i++ {
+		if name := gc.Field(i).Name; !fields[name] && name != "layers" {
+			t.Errorf("field %s not in configOptions", name)
+		}
+	}
+}
+
+// Flags override the environment and the file, and may be all
+// the configuration there is
+func Test_config_flags(t *testing.T) {
+	for _, o := range configOptions {
+		if err := (&GatewayConfig{}).setOption(o.name, "x"); err == ErrUnknownConfigOption {
+			t.Errorf("%s: expected a known option", o.name)
+		}
+		if !reflect.ValueOf(GatewayConfig{}).FieldByName(o.field).IsValid() {
+			t.Errorf("%s: no field %s", o.name, o.field)
+		}
+	}
+	file := filepath.Join(t.TempDir(), "gateway.cfg")
+	if err := ioutil.WriteFile(file, []byte("port 1883\nmqtt-broker tcp://file:1883\nmqtt-user file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GNATT_PORT", "1884")
+	t.Setenv("GNATT_MQTT_USER", "env")
+	fs := flag.NewFlagSet("gateway", flag.ContinueOnError)
+	flags := NewConfigFlags(fs)
+	if err := fs.Parse([]string{"-port", "1885", "-upstream-qos-topic", "a/=1", "-upstream-qos-topic=b/=2"}); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	gc, err := ParseConfigFile(file)
+	if err == nil {
+		err = flags.Apply(gc)
+	}
+	if err != nil {
+		t.Fatalf("expected the flags applied, got %v", err)
+	}
+	if gc.port != 1885 || gc.mqttuser != "env" || gc.mqttbroker != "tcp://file:1883" || gc.upstreamqos.upstream("a/x", 0) != 1 || gc.upstreamqos.upstream("b/x", 0) != 2 {
+		t.Fatalf("expected the flags over the environment over the file, got %+v", gc)
+	}
+
+	gc = &GatewayConfig{}
+	if gc.isUsable() {
+		t.Fatalf("expected no configuration unusable")
+	}
+	fs = flag.NewFlagSet("gateway", flag.ContinueOnError)
+	flags = NewConfigFlags(fs)
+	if err := fs.Parse([]string{"-mqtt-broker", "tcp://b:1883", "-port", "x"}); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var ce *ConfigError
+	if err := flags.Apply(gc); !errors.As(err, &ce) || ce.Key != "-port" || !errors.Is(err, ErrNotANumber) {
+		t.Fatalf("expected %v in -port, got %v", ErrNotANumber, err)
+	}
+	if err := gc.setOption("port", "1883"); err != nil || !gc.isUsable() {
+		t.Fatalf("expected a broker and port usable, got %v", err)
+	}
+}
+
+// Every problem of a configuration is reported at once, each
+// naming its option
+func Test_config_validate(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig(`port 70000
+tcp-port -1
+mqtt-keepalive -5
+listener udp://localhost
+listener tcp://:99999
+listener unix:///run/gnatt.sock
+upstream-broker cloud=cloud:1883
+dtls-port 1885
+mqtt-cert-file client.pem`); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	err := gc.Validate()
+	es, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	var problems []string
+	for _, e := range es {
+		problems = append(problems, e.Key+": "+e.Err.Error())
+	}
+	expected := []string{
+		"mqtt-broker: " + ErrMissingValueForConfigOption.Error(),
+		"upstream-broker cloud: " + ErrNoTransportSpecified.Error(),
+		"port: " + ErrOutOfRange.Error(),
+		"tcp-port: " + ErrOutOfRange.Error(),
+		"listeners[0]: " + ErrInvalidListener.Error(),
+		"listeners[1]: " + ErrInvalidListener.Error(),
+		"mqtt-keepalive: " + ErrNegative.Error(),
+		"dtls-port: " + ErrNoDTLSCredentials.Error(),
+		"mqtt-cert-file: " + ErrIncompleteBrokerCert.Error(),
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Fatalf("expected %q, got %q", expected, problems)
+	}
+	if !errors.Is(err, ErrOutOfRange) || !strings.Contains(err.Error(), "9 problem(s)") {
+		t.Fatalf("expected one error of them all, got %v", err)
+	}
+
+	for _, bad := range []string{"tcp://", "ws:///mqtt"} {
+		if err := (&GatewayConfig{mqttbroker: bad}).Validate(); !errors.Is(err, ErrInvalidBrokerURL) {
+			t.Errorf("%s: expected %v, got %v", bad, ErrInvalidBrokerURL, err)
+		}
+	}
+	if err := (&GatewayConfig{mqttbroker: "tcp://b:1883", port: 1883}).Validate(); err != nil {
+		t.Fatalf("expected a broker and port valid, got %v", err)
+	}
+	if _, err := LoadConfig(nil, "", nil); err != ErrNoConfiguration {
+		t.Fatalf("expected %v, got %v", ErrNoConfiguration, err)
+	}
+	file := filepath.Join(t.TempDir(), "gateway.cfg")
+	if err := ioutil.WriteFile(file, []byte("port 1883"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseConfigFile(file); !errors.Is(err, ErrMissingValueForConfigOption) {
+		t.Fatalf("expected the file's missing broker reported, got %v", err)
+	}
+}
+
+// Logging is configured by the log- options, or a logging block
+// or variables naming its fields, json lines never going to syslog
+func Test_config_logging(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.UnmarshalJSON([]byte(`{"logging": {"level": "debug", "format": "json", "destination": "stderr"}}`)); err != nil {
+		t.Fatalf("UnmarshalJSON: %v", err)
+	}
+	if gc.logLevel() != levelDebug || gc.logFormat() != logJSON || gc.logDestination() != logStderr {
+		t.Fatalf("expected the logging block, got %+v", gc)
+	}
+	if err := gc.setEnv([]string{"GNATT_LOGGING_LEVEL=warn", "GNATT_LOG_FORMAT=text"}); err != nil {
+		t.Fatalf("setEnv: %v", err)
+	}
+	if gc.logLevel() != levelWarn || gc.logFormat() != logText {
+		t.Fatalf("expected the environment, got %+v", gc)
+	}
+	if def := (&GatewayConfig{}); def.logLevel() != levelInfo || def.logFormat() != logText || def.logDestination() != logStdout {
+		t.Fatalf("expected info as text to stdout, got %s, %s, %s", def.logLevel(), def.logFormat(), def.logDestination())
+	}
+
+	for _, b := range []struct {
+		config   string
+		expected error
+	}{
+		{`{"log-level": "verbose"}`, ErrInvalidLogLevel},
+		{`{"log-format": "xml"}`, ErrInvalidLogFormat},
+		{`{"logging": {"syslog-address": "logs.example.com:514"}}`, ErrInvalidSyslogAddress},
+		{`{"logging": {"colour": "red"}}`, ErrUnknownConfigOption},
+	} {
+		if err := (&GatewayConfig{}).UnmarshalJSON([]byte(b.config)); !errors.Is(err, b.expected) {
+			t.Errorf("%s: expected %v, got %v", b.config, b.expected, err)
+		}
+	}
+
+	gc = &GatewayConfig{}
+	if err := gc.parseConfig("mqtt-broker tcp://localhost:1883\nlog-destination syslog\nlog-format json"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	var es ConfigErrors
+	if err := gc.Validate(); !errors.As(err, &es) || len(es) != 1 || es[0].Key != "log-format" || es[0].Err != ErrSyslogFormat {
+		t.Fatalf("expected json refused for syslog, got %v", err)
+	}
+}
+
+// The timers are the specification's unless configured, in a
+// timers section or otherwise, and only sane ones are accepted
+func Test_config_timers(t *testing.T) {
+	if timers := (&GatewayConfig{}).protocolTimers(); timers != defaultTimers() || timers.retryInterval != 10*time.Second || timers.retryCount != 3 {
+		t.Fatalf("expected the default timers, got %+v", timers)
+	}
+	gc := &GatewayConfig{}
+	if err := gc.parseYAML([]byte("timers:\n  retry-interval: 30s\n  retry-count: 5\n  advertise-interval: 60\n  keepalive-grace: 2\n  searchgw-delay: 250ms")); err != nil {
+		t.Fatalf("parseYAML: %v", err)
+	}
+	if err := gc.setEnv([]string{"GNATT_TIMERS_SLEEP_GRACE=3", "GNATT_RETRY_COUNT=4"}); err != nil {
+		t.Fatalf("setEnv: %v", err)
+	}
+	if timers := gc.protocolTimers(); timers != (protocolTimers{30 * time.Second, 4, 2, 3}) {
+		t.Fatalf("expected the configured timers, got %+v", timers)
+	}
+	if gc.advertiseInterval() != time.Minute || newDiscovery(gc).searchDelay != 250*time.Millisecond {
+		t.Fatalf("expected the advertise interval and searchgw delay, got %+v", gc)
+	}
+	if err := gc.setOption("retry-interval", "45"); err != nil || gc.retryinterval != 45*time.Second {
+		t.Fatalf("expected a number of seconds, got %v, %v", gc.retryinterval, err)
+	}
+
+	for _, b := range []struct {
+		option, value string
+		expected      error
+	}{
+		{"retry-interval", "0s", ErrOutOfRange},
+		{"retry-interval", "-1s", ErrInvalidDuration},
+		{"retry-interval", "soon", ErrInvalidDuration},
+		{"retry-count", "0", ErrOutOfRange},
+		{"keepalive-grace", "0.5", ErrOutOfRange},
+		{"sleep-grace", "NaN", ErrOutOfRange},
+		{"searchgw-delay", "5 s", ErrInvalidDuration},
+	} {
+		if err := gc.setOption(b.option, b.value); err != b.expected {
+			t.Errorf("%s %s: expected %v, got %v", b.option, b.value, b.expected, err)
+		}
+	}
+	if err := gc.parseYAML([]byte("timers:\n  retries: 2")); !errors.Is(err, ErrUnknownConfigOption) {
+		t.Fatalf("expected %v, got %v", ErrUnknownConfigOption, err)
+	}
+}
+
+// Profiles are served on a loopback admin listener alone, unless
+// admin-pprof-public allows another
+func Test_config_admin_pprof(t *testing.T) {
+	for _, c := range []struct {
+		config string
+		err    error
+	}{
+		{"admin-pprof true", ErrNoAdminAddress},
+		{"admin-address 127.0.0.1:6060\nadmin-pprof true", nil},
+		{"admin-address [::1]:6060\nadmin-pprof true", nil},
+		{"admin-address localhost:6060\nadmin-pprof true", nil},
+		{"admin-address :6060\nadmin-pprof true", ErrPprofNotLoopback},
+		{"admin-address 10.0.0.1:6060\nadmin-pprof true", ErrPprofNotLoopback},
+		{"admin-address 10.0.0.1:6060\nadmin-pprof true\nadmin-pprof-public true", nil},
+		{"admin-address :6060", nil},
+		{"admin-pprof-block-rate -1", ErrNegative},
+	} {
+		gc := &GatewayConfig{mqttbroker: "tcp://b:1883", port: 1883}
+		if err := gc.parseConfig(c.config); err != nil {
+			t.Fatalf("parseConfig: %v", err)
+		}
+		if err := gc.Validate(); (c.err == nil) != (err == nil) || !errors.Is(err, c.err) {
+			t.Errorf("%q: expected %v, got %v", c.config, c.err, err)
+		}
+	}
+}
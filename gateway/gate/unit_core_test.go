@@ -0,0 +1,144 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// The same exchanges, packet in and packet out, against both
+// gateways
+func Test_core_protocol(t *testing.T) {
+	gwconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	ag := NewAGateway(&GatewayConfig{})
+	ag.mqttclient = &fakeBroker{}
+	tg, tconn, _ := newTestTGateway(t)
+
+	for _, g := range []struct {
+		name string
+		gw   Gateway
+		c    uConn
+	}{
+		{"aggregating", ag, uConn{gwconn, 0, nil}},
+		{"transparent", tg, tconn},
+	} {
+		t.Run(g.name, func(t *testing.T) {
+			f := newFakeClient(t)
+			protocol(t, f, func(m Message) {
+				var buf bytes.Buffer
+				m.Write(&buf)
+				g.gw.OnPacket(buf.Len(), buf.Bytes(), g.c, f.addr())
+			})
+		})
+	}
+}
+
+// The same over IPv6, through the gateways' own listeners
+func Test_core_protocol_IPv6(t *testing.T) {
+	ag := NewAGateway(&GatewayConfig{bindaddress: "::1"})
+	ag.mqttclient = &fakeBroker{}
+	tg, _, _ := newTestTGateway(t)
+	tg.address = "[::1]:0"
+
+	for _, g := range []struct {
+		name string
+		gw   Gateway
+	}{
+		{"aggregating", ag},
+		{"transparent", tg},
+	} {
+		t.Run(g.name, func(t *testing.T) {
+			f := newFakeClient6(t)
+			if err := g.gw.Start(); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			defer g.gw.Stop(context.Background())
+			gwaddr, err := net.ResolveUDPAddr("udp6", g.gw.Addr())
+			if err != nil {
+				t.Fatalf("gateway address %s: %v", g.gw.Addr(), err)
+			}
+			protocol(t, f, func(m Message) {
+				if err := (uConn{f.conn, 0, nil}).WriteTo(m, uAddr{gwaddr}); err != nil {
+					t.Fatalf("WriteTo: %v", err)
+				}
+			})
+		})
+	}
+}
+
+// Exchange packets with a gateway as client f, sending them
+// with send
+func protocol(t *testing.T, f *fakeClient, send func(Message)) {
+	send(NewMessage(SEARCHGW))
+	if gi := f.expect(GWINFO).(*GwInfoMessage); gi.GatewayId != 1 {
+		t.Fatalf("SEARCHGW: gateway id %d", gi.GatewayId)
+	}
+
+	// a client the gateway does not know is told to connect
+	send(NewPublishMessage(1, 0x00, []byte("up"), 1, 1, false, false))
+	f.expect(DISCONNECT)
+
+	send(connectMessage("p", false))
+	if ca := f.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != ACCEPTED {
+		t.Fatalf("CONNECT: rc %d", ca.ReturnCode)
+	}
+
+	send(NewRegisterMessage(0, 1, []byte("a/b")))
+	ra := f.expect(REGACK).(*RegackMessage)
+	if ra.ReturnCode != ACCEPTED || ra.TopicId == 0 {
+		t.Fatalf("REGISTER: rc %d topic id %d", ra.ReturnCode, ra.TopicId)
+	}
+	send(NewRegisterMessage(0, 2, []byte("a/+")))
+	if ra := f.expect(REGACK).(*RegackMessage); ra.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("REGISTER with a wildcard: rc %d", ra.ReturnCode)
+	}
+
+	send(NewPublishMessage(ra.TopicId, 0x00, []byte("up"), 1, 3, false, false))
+	if pa := f.expect(PUBACK).(*PubackMessage); pa.MessageId != 3 || pa.ReturnCode != ACCEPTED {
+		t.Fatalf("QoS 1 PUBLISH: msg id %d rc %d", pa.MessageId, pa.ReturnCode)
+	}
+	send(NewPublishMessage(ra.TopicId+100, 0x00, []byte("up"), 1, 4, false, false))
+	if pa := f.expect(PUBACK).(*PubackMessage); pa.ReturnCode != REJ_INVALID_TID {
+		t.Fatalf("PUBLISH to an unknown topic id: rc %d", pa.ReturnCode)
+	}
+	send(NewPublishMessage(ra.TopicId, 0x00, []byte("up"), 2, 5, false, false))
+	if pr := f.expect(PUBREC).(*PubrecMessage); pr.MessageId != 5 {
+		t.Fatalf("QoS 2 PUBLISH: PUBREC for msg id %d", pr.MessageId)
+	}
+	rel := NewMessage(PUBREL).(*PubrelMessage)
+	rel.MessageId = 5
+	send(rel)
+	if pc := f.expect(PUBCOMP).(*PubcompMessage); pc.MessageId != 5 {
+		t.Fatalf("PUBREL: PUBCOMP for msg id %d", pc.MessageId)
+	}
+
+	send(subscribeMessage("c", 6, 1))
+	if sa := f.expect(SUBACK).(*SubackMessage); sa.ReturnCode != ACCEPTED || sa.MessageId != 6 || sa.TopicId == 0 {
+		t.Fatalf("SUBSCRIBE: %+v", sa)
+	}
+	send(subscribeMessage("c/#/d", 7, 1))
+	if sa := f.expect(SUBACK).(*SubackMessage); sa.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("SUBSCRIBE to an invalid filter: rc %d", sa.ReturnCode)
+	}
+	um := NewMessage(UNSUBSCRIBE).(*UnsubscribeMessage)
+	um.TopicName = []byte("c")
+	um.MessageId = 8
+	send(um)
+	if ua := f.expect(UNSUBACK).(*UnsubackMessage); ua.MessageId != 8 {
+		t.Fatalf("UNSUBSCRIBE: UNSUBACK for msg id %d", ua.MessageId)
+	}
+
+	send(NewMessage(PINGREQ))
+	f.expect(PINGRESP)
+
+	send(NewMessage(DISCONNECT))
+	f.expect(DISCONNECT)
+	send(NewPublishMessage(ra.TopicId, 0x00, []byte("up"), 1, 9, false, false))
+	f.expect(DISCONNECT)
+}
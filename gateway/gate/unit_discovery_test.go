@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// An interface that is up and can multicast, skipping the test
+// if there is none
+func multicastInterface(t *testing.T) *net.Interface {
+	ifis, _ := net.Interfaces()
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 {
+			return &ifi
+		}
+	}
+	t.Skip("no multicast interface")
+	return nil
+}
+
+// Wait for a message of msgType on conn, passing over others
+// (a client on the group hears its own SEARCHGW)
+func expectOn(t *testing.T, conn *net.UDPConn, msgType byte) Message {
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("expected %s, got %v", MessageNames[msgType], err)
+		}
+		if m, err := ReadPacket(bytes.NewBuffer(buf[:n])); err == nil && m.MessageType() == msgType {
+			return m
+		}
+	}
+}
+
+// A gateway 7 on a multicast group of its own and a client on
+// the group, skipping the test if either cannot join it
+func multicastGateway(t *testing.T, gc *GatewayConfig) (*net.UDPConn, *net.UDPAddr) {
+	ifi := multicastInterface(t)
+	// a port of its own, so other runs do not interfere
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 77, 77), Port: probe.LocalAddr().(*net.UDPAddr).Port}
+	probe.Close()
+
+	gc.bindaddress = "127.0.0.1"
+	gc.gatewayid = 7
+	gc.multicastgroup = group.String()
+	gc.multicastinterface = ifi.Name
+	gc.multicastloopback = true
+	ag := NewAGateway(gc)
+	ag.mqttclient = &fakeBroker{}
+
+	client, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		t.Skipf("cannot join %v on %s: %v", group, ifi.Name, err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if err := ipv4.NewPacketConn(client).SetMulticastLoopback(true); err != nil {
+		t.Fatalf("SetMulticastLoopback: %v", err)
+	}
+
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { ag.Stop(context.Background()) })
+	if ag.discovery.conn == nil {
+		t.Skipf("gateway could not join %v on %s", group, ifi.Name)
+	}
+	return client, group
+}
+
+func Test_discovery_multicast(t *testing.T) {
+	client, group := multicastGateway(t, &GatewayConfig{})
+
+	adv := expectOn(t, client, ADVERTISE).(*AdvertiseMessage)
+	if adv.GatewayId != 7 || adv.Duration != uint16(defaultAdvertiseInterval/time.Second) {
+		t.Fatalf("unexpected ADVERTISE %+v", adv)
+	}
+	if err := (uConn{client, 0, nil}).WriteTo(NewMessage(SEARCHGW), uAddr{group}); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if gi := expectOn(t, client, GWINFO).(*GwInfoMessage); gi.GatewayId != 7 {
+		t.Fatalf("GWINFO from gateway %d", gi.GatewayId)
+	}
+}
+
+// Held back, the answer to a SEARCHGW is given up on when another
+// gateway answers first, and otherwise given within the delay
+func Test_discovery_searchgw_delay(t *testing.T) {
+	client, group := multicastGateway(t, &GatewayConfig{searchgwdelay: 2 * time.Second})
+	// whether the gateway answers before the deadline
+	answered := func(deadline time.Duration) bool {
+		buf := make([]byte, 1500)
+		client.SetReadDeadline(time.Now().Add(deadline))
+		for {
+			n, _, err := client.ReadFromUDP(buf)
+			if err != nil {
+				return false
+			}
+			m, _ := ReadPacket(bytes.NewBuffer(buf[:n]))
+			if gi, ok := m.(*GwInfoMessage); ok && gi.GatewayId == 7 {
+				return true
+			}
+		}
+	}
+
+	other := NewMessage(GWINFO).(*GwInfoMessage)
+	other.GatewayId = 9
+	for _, m := range []Message{NewMessage(SEARCHGW), other} {
+		if err := (uConn{client, 0, nil}).WriteTo(m, uAddr{group}); err != nil {
+			t.Fatalf("WriteTo: %v", err)
+		}
+	}
+	if answered(500 * time.Millisecond) {
+		t.Fatalf("the gateway answered after another had")
+	}
+
+	if err := (uConn{client, 0, nil}).WriteTo(NewMessage(SEARCHGW), uAddr{group}); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if !answered(3 * time.Second) {
+		t.Fatalf("the gateway did not answer")
+	}
+}
+
+func Test_config_discovery(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("gateway-id 9\nmulticast-group 225.1.1.1:1883\nmulticast-group [ff02::1]:1883"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if d := newDiscovery(gc); d.gatewayId != 9 || d.group.String() != "[ff02::1]:1883" || d.interval != defaultAdvertiseInterval {
+		t.Fatalf("unexpected discovery %+v", d)
+	}
+	for _, bad := range []string{"10.0.0.1:1883", "225.1.1.1", "group:1883"} {
+		if err := gc.parseConfig("multicast-group " + bad); err != ErrInvalidMulticastGroup {
+			t.Errorf("%s: expected %v, got %v", bad, ErrInvalidMulticastGroup, err)
+		}
+	}
+	for _, bad := range []int{0, 256} {
+		if err := gc.parseConfig(fmt.Sprintf("gateway-id %d", bad)); err != ErrInvalidGatewayId {
+			t.Errorf("%d: expected %v, got %v", bad, ErrInvalidGatewayId, err)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func pskFile(t *testing.T, contents string) string {
+	file, err := ioutil.TempFile("", "psk")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	file.WriteString(contents)
+	file.Close()
+	t.Cleanup(func() { os.Remove(file.Name()) })
+	return file.Name()
+}
+
+func Test_loadPSKs(t *testing.T) {
+	keys, err := loadPSKs(pskFile(t, "# identity key\n\nsensor1 0102ff\n  sensor2   AABB  \n"))
+	if err != nil {
+		t.Fatalf("loadPSKs: %v", err)
+	}
+	if len(keys) != 2 || !bytes.Equal(keys["sensor1"], []byte{1, 2, 0xff}) || !bytes.Equal(keys["sensor2"], []byte{0xaa, 0xbb}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	for _, bad := range []string{"sensor1\n", "sensor1 0102 03\n", "sensor1 xyz\n", "sensor1 012\n"} {
+		if _, err := loadPSKs(pskFile(t, bad)); err != ErrInvalidPSK {
+			t.Fatalf("%q: expected %v, got %v", bad, ErrInvalidPSK, err)
+		}
+	}
+}
+
+// A client with a DTLS session with the gateway
+type dtlsClient struct {
+	conn *dtls.Conn
+	t    *testing.T
+}
+
+func dialDTLS(t *testing.T, addr net.Addr, identity string, key []byte) (*dtlsClient, error) {
+	return dialDTLSConfig(t, addr, &dtls.Config{
+		PSK: func([]byte) ([]byte, error) {
+			return key, nil
+		},
+		PSKIdentityHint: []byte(identity),
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+	})
+}
+
+func dialDTLSConfig(t *testing.T, addr net.Addr, config *dtls.Config) (*dtlsClient, error) {
+	// a refused handshake may simply go unanswered
+	config.ConnectContextMaker = func() (context.Context, func()) {
+		return context.WithTimeout(context.Background(), 500*time.Millisecond)
+	}
+	conn, err := dtls.Dial("udp", addr.(*net.UDPAddr), config)
+	if err != nil {
+		return nil, err
+	}
+	return &dtlsClient{conn, t}, nil
+}
+
+func (d *dtlsClient) send(m Message) {
+	var buf bytes.Buffer
+	m.Write(&buf)
+	if _, err := d.conn.Write(buf.Bytes()); err != nil {
+		d.t.Fatalf("Write: %v", err)
+	}
+}
+
+func (d *dtlsClient) expect(msgType byte) Message {
+	buf := make([]byte, 1500)
+	d.conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := d.conn.Read(buf)
+	if err != nil {
+		d.t.Fatalf("expected %s, got %v", MessageNames[msgType], err)
+	}
+	m, err := ReadPacket(bytes.NewBuffer(buf[:n]))
+	if err != nil {
+		d.t.Fatalf("ReadPacket: %v", err)
+	}
+	if m.MessageType() != msgType {
+		d.t.Fatalf("expected %s, got %s", MessageNames[msgType], MessageNames[m.MessageType()])
+	}
+	return m
+}
+
+// Clients of either gateway can use DTLS and plain UDP side by
+// side, and a client goes when its DTLS session does
+func Test_DTLS(t *testing.T) {
+	psks := pskFile(t, "sensor1 000102030405060708090a0b0c0d0e0f\n")
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1", dtlspskfile: psks})
+	ag.mqttclient = &fakeBroker{}
+	tg, _, _ := newTestTGateway(t)
+	tg.address = "127.0.0.1:0"
+	tg.dtlsFiles.psk = psks
+
+	for _, g := range []struct {
+		name    string
+		gw      Gateway
+		clients *Clients
+		dtls    func() *dtlsListener
+	}{
+		{"aggregating", ag, &ag.clients, func() *dtlsListener { return ag.dtls }},
+		{"transparent", tg, &tg.clients, func() *dtlsListener { return tg.dtls }},
+	} {
+		t.Run(g.name, func(t *testing.T) {
+			ag.dtlsAddress, tg.dtlsAddress = "127.0.0.1:0", "127.0.0.1:0"
+			if err := g.gw.Start(); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			defer g.gw.Stop(context.Background())
+			dtlsaddr := g.dtls().ln.Addr()
+
+			if _, err := dialDTLS(t, dtlsaddr, "sensor1", []byte("wrong key")); err == nil {
+				t.Fatalf("handshake with the wrong key succeeded")
+			}
+			if _, err := dialDTLS(t, dtlsaddr, "nobody", []byte{0}); err == nil {
+				t.Fatalf("handshake with an unknown identity succeeded")
+			}
+
+			d, err := dialDTLS(t, dtlsaddr, "sensor1", []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15})
+			if err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+			d.send(connectMessage("secure", false))
+			if ca := d.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != ACCEPTED {
+				t.Fatalf("CONNECT over DTLS: rc %d", ca.ReturnCode)
+			}
+			d.send(NewMessage(PINGREQ))
+			d.expect(PINGRESP)
+
+			f := newFakeClient(t)
+			gwaddr, _ := net.ResolveUDPAddr("udp", g.gw.Addr())
+			(uConn{f.conn, 0, nil}).WriteTo(connectMessage("plain", false), uAddr{gwaddr})
+			f.expect(CONNACK)
+			if g.clients.Len() != 2 {
+				t.Fatalf("expected 2 clients, have %d", g.clients.Len())
+			}
+
+			d.conn.Close()
+			deadline := time.Now().Add(time.Second)
+			for g.clients.Len() != 1 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if g.clients.Len() != 1 {
+				t.Fatalf("expected the DTLS client to go with its session, %d clients remain", g.clients.Len())
+			}
+		})
+	}
+}
+
+// A certificate authority issuing certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Issue a certificate for cn and dnsnames, returning it and its
+// key in PEM
+func (ca *testCA) issue(t *testing.T, cn string, dnsnames ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsnames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder})
+}
+
+// A DTLS client config presenting a certificate for cn issued
+// by ca, trusting the gateway's certificates from gwca
+func (ca *testCA) clientConfig(t *testing.T, gwca *testCA, cn string, dnsnames ...string) *dtls.Config {
+	certpem, keypem := ca.issue(t, cn, dnsnames...)
+	cert, err := tls.X509KeyPair(certpem, keypem)
+	if err != nil {
+		t.Fatalf("X509KeyPair: %v", err)
+	}
+	return &dtls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      gwca.pool(),
+		ServerName:   "gateway",
+	}
+}
+
+func writeFile(t *testing.T, file string, data []byte) {
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+// Clients must present a certificate from the CA, and a hook
+// can bind their client ids to it. New certificates are picked
+// up on reload without ending the sessions there are.
+func Test_DTLS_certificates(t *testing.T) {
+	ca, rogue := newTestCA(t), newTestCA(t)
+	dir := t.TempDir()
+	files := dtlsFiles{
+		"",
+		filepath.Join(dir, "gateway.pem"),
+		filepath.Join(dir, "gateway.key"),
+		filepath.Join(dir, "ca.pem"),
+		true,
+	}
+	certpem, keypem := ca.issue(t, "gateway 1", "gateway")
+	writeFile(t, files.cert, certpem)
+	writeFile(t, files.key, keypem)
+	writeFile(t, files.clientCA, ca.pem)
+
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1"})
+	ag.mqttclient = &fakeBroker{}
+	ag.dtlsAddress, ag.dtlsFiles = "127.0.0.1:0", files
+	ag.SetHooks(Hooks{
+		OnConnect: func(c *Client) error {
+			for _, name := range c.PeerNames() {
+				if name == c.ClientId {
+					return nil
+				}
+			}
+			return ErrNoCredentials
+		},
+	})
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+	dtlsaddr := ag.dtls.ln.Addr()
+
+	if _, err := dialDTLSConfig(t, dtlsaddr, &dtls.Config{RootCAs: ca.pool(), ServerName: "gateway"}); err == nil {
+		t.Fatalf("handshake without a client certificate succeeded")
+	}
+	if _, err := dialDTLSConfig(t, dtlsaddr, rogue.clientConfig(t, ca, "sensor1")); err == nil {
+		t.Fatalf("handshake with a certificate from another CA succeeded")
+	}
+
+	d, err := dialDTLSConfig(t, dtlsaddr, ca.clientConfig(t, ca, "sensor1", "sensor1.example"))
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	defer d.conn.Close()
+	d.send(connectMessage("sensor1", false))
+	if connack := d.expect(CONNACK).(*ConnackMessage); connack.ReturnCode != ACCEPTED {
+		t.Fatalf("CONNECT with the certificate's name: rc %d", connack.ReturnCode)
+	}
+	client := ag.clients.GetClient(uAddr{d.conn.LocalAddr().(*net.UDPAddr)}).(*Client)
+	if names := client.PeerNames(); !reflect.DeepEqual(names, []string{"sensor1", "sensor1.example"}) {
+		t.Fatalf("unexpected peer names %v", names)
+	}
+
+	e, err := dialDTLSConfig(t, dtlsaddr, ca.clientConfig(t, ca, "sensor2"))
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	defer e.conn.Close()
+	e.send(connectMessage("sensor1", false))
+	if connack := e.expect(CONNACK).(*ConnackMessage); connack.ReturnCode == ACCEPTED {
+		t.Fatalf("CONNECT with another certificate's name accepted")
+	}
+
+	certpem, keypem = ca.issue(t, "gateway 2", "gateway")
+	writeFile(t, files.cert, certpem)
+	writeFile(t, files.key, keypem)
+	if err := ag.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	d.send(NewMessage(PINGREQ))
+	d.expect(PINGRESP)
+	gatewayCN := func() string {
+		f, err := dialDTLSConfig(t, dtlsaddr, ca.clientConfig(t, ca, "sensor3"))
+		if err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+		defer f.conn.Close()
+		cert, _ := x509.ParseCertificate(f.conn.ConnectionState().PeerCertificates[0])
+		return cert.Subject.CommonName
+	}
+	if cn := gatewayCN(); cn != "gateway 2" {
+		t.Fatalf("expected the reloaded certificate, got %q", cn)
+	}
+
+	writeFile(t, files.key, []byte("not a key"))
+	if err := ag.Reload(); err == nil {
+		t.Fatalf("Reload of a bad key succeeded")
+	}
+	if cn := gatewayCN(); cn != "gateway 2" {
+		t.Fatalf("expected the certificate already loaded, got %q", cn)
+	}
+}
+
+func Test_dtlsFiles_config(t *testing.T) {
+	if _, err := (dtlsFiles{}).config(); err != ErrNoDTLSCredentials {
+		t.Fatalf("expected %v, got %v", ErrNoDTLSCredentials, err)
+	}
+	psks := pskFile(t, "sensor1 00\n")
+	if _, err := (dtlsFiles{psk: psks, clientCertRequired: true}).config(); err != ErrNoClientCA {
+		t.Fatalf("expected %v, got %v", ErrNoClientCA, err)
+	}
+	if _, err := (dtlsFiles{psk: psks, clientCA: psks}).config(); err != ErrInvalidClientCA {
+		t.Fatalf("expected %v, got %v", ErrInvalidClientCA, err)
+	}
+}
+
+func Test_failureLog(t *testing.T) {
+	f := newFailureLog()
+	now := time.Now()
+	var logged int
+	for i := 0; i < 100; i++ {
+		if f.log(now, "probe %d\n", i) {
+			logged++
+		}
+	}
+	if logged != dtlsFailureBurst || f.suppressed != 100-dtlsFailureBurst {
+		t.Fatalf("%d logged, %d suppressed", logged, f.suppressed)
+	}
+	if !f.log(now.Add(time.Second), "probe\n") || f.suppressed != 0 {
+		t.Fatalf("a failure a second later was not logged")
+	}
+}
@@ -0,0 +1,119 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_echoes(t *testing.T) {
+	defer func(w time.Duration) { echoWindow = w }(echoWindow)
+	echoWindow = 20 * time.Millisecond
+
+	if newEchoes(echoDeliver) != nil {
+		t.Fatalf("expected no echoes looked for")
+	}
+	e := newEchoes(echoOthers)
+	a, b := &Client{}, &Client{}
+	e.published(a, "t", []byte{1})
+	e.published(b, "t", []byte{1})
+	e.published(a, "$t", []byte{1})
+	if _, echo := e.echo("t", []byte{2}); echo {
+		t.Fatalf("expected a different payload not to be an echo")
+	}
+	if _, echo := e.echo("$t", []byte{1}); echo {
+		t.Fatalf("expected the broker's own topics never to be echoes")
+	}
+	for _, want := range []*Client{a, b} {
+		if publisher, echo := e.echo("t", []byte{1}); !echo || publisher != want {
+			t.Fatalf("expected an echo of %p, got %p, %v", want, publisher, echo)
+		}
+	}
+	if _, echo := e.echo("t", []byte{1}); echo {
+		t.Fatalf("expected each publish echoed once")
+	}
+
+	e.published(a, "u", nil)
+	time.Sleep(2 * echoWindow)
+	if _, echo := e.echo("u", nil); echo {
+		t.Fatalf("expected what was published too long ago to be forgotten")
+	}
+	e.published(a, "v", nil)
+	if len(e.sent) != 1 || e.suppressed != 2 {
+		t.Fatalf("expected the rest swept, have %d, suppressed %d", len(e.sent), e.suppressed)
+	}
+}
+
+func Test_config_echoes(t *testing.T) {
+	gc := &GatewayConfig{}
+	if gc.echoPolicy() != echoOthers {
+		t.Fatalf("expected %s by default, got %s", echoOthers, gc.echoPolicy())
+	}
+	for _, policy := range []string{echoDeliver, echoOthers, echoDrop} {
+		if err := gc.parseConfig("upstream-echoes " + policy); err != nil || gc.echoPolicy() != policy {
+			t.Errorf("%s: got %s, %v", policy, gc.echoPolicy(), err)
+		}
+	}
+	if err := gc.parseConfig("upstream-echoes loop"); err != ErrInvalidEchoPolicy {
+		t.Fatalf("expected %v, got %v", ErrInvalidEchoPolicy, err)
+	}
+	gc = &GatewayConfig{mqttversion: 5, upstreamechoes: echoDrop}
+	if c := NewAGateway(gc).mqttclient.(*mqtt5Client); !c.opts.noLocal {
+		t.Fatalf("expected No Local subscriptions on an MQTT v5 broker")
+	}
+}
+
+// What a client publishes comes back from the broker to its
+// subscription, and to another client's, as each policy says
+func Test_AGateway_echoes(t *testing.T) {
+	for policy, expected := range map[string][2]bool{
+		echoDeliver: {true, true},
+		echoOthers:  {false, true},
+		echoDrop:    {false, false},
+	} {
+		t.Run(policy, func(t *testing.T) {
+			gc := &GatewayConfig{bindaddress: "127.0.0.1", topicprefix: "site42/", upstreamechoes: policy}
+			ag := NewAGateway(gc)
+			broker := &fakeBroker{}
+			ag.mqttclient = broker
+			if err := ag.Start(); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			defer ag.Stop(context.Background())
+
+			var clients [2]*fakeClient
+			for i, id := range []string{"a", "b"} {
+				f := newFakeClient(t)
+				ag.handle_CONNECT(connectMessage(id, false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+				f.expect(CONNACK)
+				ag.handle_SUBSCRIBE(subscribeMessage("t/#", 1, 0), ag.clients.GetClient(f.addr()))
+				f.expect(SUBACK)
+				clients[i] = f
+			}
+			a := ag.clients.GetClient(clients[0].addr())
+			ag.handle_REGISTER(NewRegisterMessage(0, 2, []byte("t/x")), a)
+			topicid := clients[0].expect(REGACK).(*RegackMessage).TopicId
+			ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte{1}, 0, 0, false, false), a)
+
+			broker.deliver("site42/t/#", &fakeMessage{"site42/t/x", []byte{1}, 0})
+			if expected[0] {
+				if pm := clients[0].expect(PUBLISH).(*PublishMessage); pm.Data[0] != 1 {
+					t.Fatalf("expected the echo, got %v", pm.Data)
+				}
+			} else {
+				clients[0].expectNothing()
+			}
+			// the other client has yet to learn the topic's id
+			if expected[1] {
+				clients[1].expect(REGISTER)
+			} else {
+				clients[1].expectNothing()
+			}
+			// another message is no echo
+			broker.deliver("site42/t/#", &fakeMessage{"site42/t/x", []byte{2}, 0})
+			clients[0].expect(PUBLISH)
+		})
+	}
+}
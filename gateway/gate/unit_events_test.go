@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// Each event is published after the embedder's hook has it, and
+// those beyond the rate are dropped
+func Test_events(t *testing.T) {
+	gwconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	ag := NewAGateway(&GatewayConfig{eventstopic: "gw/events", eventsqos: 1, eventsrate: 3})
+	broker := &fakeBroker{}
+	ag.mqttclient = broker
+	var embedded []string
+	ag.SetHooks(Hooks{OnDisconnect: func(client *Client, reason string) {
+		embedded = append(embedded, reason)
+		if len(broker.published) != 2 {
+			t.Errorf("expected the embedder's hook called first")
+		}
+	}})
+	ag.hookq.start()
+
+	f := newFakeClient(t)
+	conn := uConn{gwconn, 0, nil}
+	ag.handle_CONNECT(connectMessage("f", false), conn, f.addr())
+	f.expect(CONNACK)
+	sleep(ag, f)
+	ag.lost(ag.clients.GetClient(f.addr()))
+	ag.handle_CONNECT(connectMessage("f", false), conn, f.addr())
+	f.expect(CONNACK)
+	ag.hookq.stop()
+
+	if len(embedded) != 1 || embedded[0] != DisconnectLost {
+		t.Fatalf("expected the embedder told of the loss, got %v", embedded)
+	}
+	if len(broker.published) != 3 {
+		t.Fatalf("expected 3 events published, the 4th beyond the rate, got %d", len(broker.published))
+	}
+	for i, want := range []string{eventConnected, eventAsleep, eventLost} {
+		m := broker.published[i]
+		var e clientEvent
+		if err := json.Unmarshal(m.payload, &e); err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		if m.topic != "gw/events" || m.qos != 1 || e.Version != eventsVersion || e.ClientId != "f" || e.Event != want || e.Address != f.addr().String() || time.Since(e.Time) > time.Minute {
+			t.Errorf("expected %s for f on gw/events, got %+v on %s", want, e, m.topic)
+		}
+	}
+	if published, dropped := ag.events.counts(); published != 3 || dropped != 1 {
+		t.Fatalf("expected 3 published and 1 dropped, got %d and %d", published, dropped)
+	}
+}
+
+func Test_events_reason(t *testing.T) {
+	e := newEvents(&GatewayConfig{eventstopic: "gw/events"})
+	var payload []byte
+	e.publish = func(p []byte) { payload = p }
+	e.hooks().OnDisconnect(NewClient("c", uConn{}, uAddr{}), DisconnectKicked)
+	var ce clientEvent
+	if err := json.Unmarshal(payload, &ce); err != nil || ce.Event != eventDisconnected || ce.Reason != DisconnectKicked {
+		t.Fatalf("expected disconnected for being kicked, got %s, %v", payload, err)
+	}
+	if h := (*events)(nil).hooks(); h.OnDisconnect != nil {
+		t.Fatalf("expected no hooks without events-topic")
+	}
+	if (&GatewayConfig{}).parseConfig("events-topic gw/+") == nil {
+		t.Fatalf("expected a wildcard refused")
+	}
+}
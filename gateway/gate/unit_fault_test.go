@@ -0,0 +1,270 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// Send count numbered packets from a through faults and return
+// the numbers b receives, in the order it receives them
+func throughFaults(t *testing.T, f Faults, count int) []byte {
+	n := NewMemNetwork()
+	a, _ := n.Listen("a")
+	b, _ := n.Listen("b")
+	ft := NewFaultyTransport(a, f)
+	defer ft.Close()
+	received := make(chan byte, 2*count)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, _, err := b.ReadFrom(buf); err != nil {
+				return
+			}
+			received <- buf[0]
+		}
+	}()
+	defer b.Close()
+	for i := 0; i < count; i++ {
+		ft.WriteTo([]byte{byte(i)}, b.LocalAddr())
+	}
+	var got []byte
+	for {
+		select {
+		case i := <-received:
+			got = append(got, i)
+		case <-time.After(2 * faultReorderHold):
+			return got
+		}
+	}
+}
+
+func Test_FaultyTransport_seed(t *testing.T) {
+	f := Faults{Loss: 0.3, Duplicate: 0.2, Seed: 42}
+	first := throughFaults(t, f, 100)
+	if again := throughFaults(t, f, 100); !bytes.Equal(first, again) {
+		t.Fatalf("the same seed made different faults:\n%v\n%v", first, again)
+	}
+	lost, duplicated := 100, 0
+	seen := make(map[byte]bool)
+	for _, i := range first {
+		if seen[i] {
+			duplicated++
+		} else {
+			lost--
+		}
+		seen[i] = true
+	}
+	if lost < 15 || lost > 45 || duplicated < 5 || duplicated > 35 {
+		t.Fatalf("%d lost and %d duplicated of 100", lost, duplicated)
+	}
+	f.Seed++
+	if other := throughFaults(t, f, 100); bytes.Equal(first, other) {
+		t.Fatalf("another seed made the same faults")
+	}
+}
+
+func Test_FaultyTransport_reorder_delay(t *testing.T) {
+	start := time.Now()
+	got := throughFaults(t, Faults{Reorder: 3, Delay: 5 * time.Millisecond, Jitter: time.Millisecond, Seed: 1}, 20)
+	if time.Since(start) < 5*time.Millisecond {
+		t.Fatalf("packets were not delayed")
+	}
+	if len(got) != 20 {
+		t.Fatalf("expected every packet, got %v", got)
+	}
+	sorted := true
+	seen := make(map[byte]bool)
+	for i, p := range got {
+		seen[p] = true
+		if i > 0 && got[i-1] > p {
+			sorted = false
+		}
+	}
+	if sorted || len(seen) != 20 {
+		t.Fatalf("expected every packet out of order, got %v", got)
+	}
+}
+
+// A client on a MemNetwork that resends until it is answered,
+// as a client on a lossy network must
+type lossyClient struct {
+	*memClient
+	in      chan Message
+	resends int
+}
+
+func newLossyClient(t *testing.T, n *MemNetwork, name string, gw MemAddr) *lossyClient {
+	c := &lossyClient{newMemClient(t, n, name, gw), make(chan Message, 100), 0}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := c.tr.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if m, err := ReadPacket(bytes.NewBuffer(buf[:n])); err == nil {
+				c.in <- m
+			}
+		}
+	}()
+	return c
+}
+
+func messageId(m Message) uint16 {
+	switch m := m.(type) {
+	case *PublishMessage:
+		return m.MessageId
+	case *PubackMessage:
+		return m.MessageId
+	case *PubrecMessage:
+		return m.MessageId
+	case *PubrelMessage:
+		return m.MessageId
+	case *PubcompMessage:
+		return m.MessageId
+	case *RegisterMessage:
+		return m.MessageId
+	case *RegackMessage:
+		return m.MessageId
+	case *SubscribeMessage:
+		return m.MessageId
+	case *SubackMessage:
+		return m.MessageId
+	}
+	return 0
+}
+
+// Send m until its reply comes, ignoring anything else
+func (c *lossyClient) exchange(m Message, reply byte) Message {
+	for i := 0; i < 50; i++ {
+		if i > 0 {
+			c.resends++
+		}
+		c.send(m)
+		timeout := time.After(50 * time.Millisecond)
+	wait:
+		for {
+			select {
+			case r := <-c.in:
+				if r.MessageType() == reply && messageId(r) == messageId(m) {
+					return r
+				}
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+	c.t.Fatalf("no %s for %s", MessageNames[reply], MessageNames[m.MessageType()])
+	return nil
+}
+
+// Acknowledge what the gateway sends until every one of want
+// has been published to the client and nothing remains for it
+func (c *lossyClient) receive(client *Client, want map[string]bool) {
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case m := <-c.in:
+			var ack Message
+			switch m := m.(type) {
+			case *RegisterMessage:
+				ack = NewRegackMessage(m.TopicId, m.MessageId, ACCEPTED)
+			case *PublishMessage:
+				delete(want, string(m.Data))
+				if m.Qos == 1 {
+					pa := NewMessage(PUBACK).(*PubackMessage)
+					pa.TopicId, pa.MessageId = m.TopicId, m.MessageId
+					ack = pa
+				} else if m.Qos == 2 {
+					pr := NewMessage(PUBREC).(*PubrecMessage)
+					pr.MessageId = m.MessageId
+					ack = pr
+				}
+			case *PubrelMessage:
+				pc := NewMessage(PUBCOMP).(*PubcompMessage)
+				pc.MessageId = m.MessageId
+				ack = pc
+			}
+			if ack != nil {
+				c.send(ack)
+			}
+		case <-time.After(20 * time.Millisecond):
+			client.Lock()
+			done := len(want) == 0 && len(client.inflight) == 0 && len(client.outbound) == 0
+			client.Unlock()
+			if done {
+				return
+			}
+		case <-deadline:
+			c.t.Fatalf("messages never delivered: %v", want)
+		}
+	}
+}
+
+// QoS 1 and 2 in both directions converge when a tenth of the
+// packets to and from the gateway are lost, QoS 2 PUBLISHes
+// still reaching the broker once
+func Test_QoS_under_loss(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		t.Run(fmt.Sprint("seed ", seed), func(t *testing.T) {
+			n := NewMemNetwork()
+			gwtr, _ := n.Listen("gateway")
+			broker := &fakeBroker{}
+			ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1", retryinterval: 20 * time.Millisecond, retrycount: 50})
+			ag.mqttclient = broker
+			if err := ag.Start(); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			ag.Serve(NewFaultyTransport(gwtr, Faults{Loss: 0.1, Seed: seed}))
+
+			c := newLossyClient(t, n, "client", "gateway")
+			c.exchange(connectMessage("client", false), CONNACK)
+			sa := c.exchange(subscribeMessage("a/b", 1, 2), SUBACK).(*SubackMessage)
+			ra := c.exchange(NewRegisterMessage(0, 2, []byte("a/b")), REGACK).(*RegackMessage)
+			if sa.ReturnCode != ACCEPTED || ra.ReturnCode != ACCEPTED {
+				t.Fatalf("SUBACK rc %d, REGACK rc %d", sa.ReturnCode, ra.ReturnCode)
+			}
+
+			for i := uint16(10); i < 30; i++ {
+				qos := byte(1 + i%2)
+				payload := []byte(fmt.Sprint("up ", i))
+				c.exchange(NewPublishMessage(ra.TopicId, 0, payload, qos, i, false, false), []byte{0, PUBACK, PUBREC}[qos])
+				if qos == 2 {
+					pr := NewMessage(PUBREL).(*PubrelMessage)
+					pr.MessageId = i
+					c.exchange(pr, PUBCOMP)
+				}
+			}
+
+			want := make(map[string]bool)
+			for i := 0; i < 20; i++ {
+				payload := fmt.Sprint("down ", i)
+				want[payload] = true
+				broker.deliver("a/b", &fakeMessage{"a/b", []byte(payload), byte(1 + i%2)})
+			}
+			c.receive(ag.clients.GetClient(uAddr{MemAddr("client")}).(*Client), want)
+
+			ag.Stop(context.Background())
+			if c.resends == 0 {
+				t.Fatalf("nothing was lost")
+			}
+			published := make(map[string]int)
+			for _, m := range broker.published {
+				published[string(m.payload)]++
+			}
+			for i := 10; i < 30; i++ {
+				if got := published[fmt.Sprint("up ", i)]; got == 0 || i%2 == 1 && got != 1 {
+					t.Fatalf("QoS %d PUBLISH %d reached the broker %d times", 1+i%2, i, got)
+				}
+			}
+			if len(published) != 20 {
+				t.Fatalf("the broker was sent %v", published)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_floodGuard(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("unconnected-packet-rate 2\nunconnected-address-rate 2"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	f := newFloodGuard(gc)
+	now := time.Now()
+	a, b, c := udpAddr("192.0.2.1", 1), udpAddr("192.0.2.2", 1), udpAddr("192.0.2.3", 1)
+	if !f.allow(a, now) || !f.allow(b, now) || f.allow(a, now) {
+		t.Fatalf("expected a burst of 2 packets")
+	}
+	later := now.Add(time.Second)
+	if !f.allow(a, later) || !f.allow(b, later) || f.allow(c, later.Add(time.Second/2)) {
+		t.Fatalf("expected the addresses of a second limited")
+	}
+	if !f.allow(c, now.Add(2*time.Second)) {
+		t.Fatalf("expected another address the next second")
+	}
+	if s := f.snapshot(); s.Packets != 7 || s.OverPacketRate != 1 || s.OverAddressRate != 1 {
+		t.Fatalf("expected 7 packets, 1 over each rate, got %+v", s)
+	}
+
+	if !f.disconnect(a, now) || f.disconnect(a, now.Add(time.Second)) || !f.disconnect(b, now) {
+		t.Fatalf("expected a DISCONNECT to each address")
+	}
+	if !f.disconnect(a, now.Add(defaultUnknownDisconnectInterval)) {
+		t.Fatalf("expected another DISCONNECT once the interval is past")
+	}
+	f.forget(b)
+	if !f.disconnect(b, now.Add(time.Second)) {
+		t.Fatalf("expected another DISCONNECT once the address has connected")
+	}
+	if s := f.snapshot(); s.Disconnects != 4 || s.SuppressedDisconnect != 1 {
+		t.Fatalf("expected 4 DISCONNECTs and 1 held back, got %+v", s)
+	}
+
+	if err := gc.parseConfig("unknown-disconnect-interval 0s"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	f = newFloodGuard(gc)
+	if !f.disconnect(a, now) || !f.disconnect(a, now) {
+		t.Fatalf("expected a DISCONNECT every time given 0s")
+	}
+	if newFloodGuard(&GatewayConfig{}).disconnectInterval != defaultUnknownDisconnectInterval {
+		t.Fatalf("expected the default interval unless configured")
+	}
+}
+
+// Packets from an address with no session beyond the budget are
+// dropped, while a client's are not counted against it
+func Test_listener_unconnected_budget(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("unconnected-packet-rate 1"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	conn, known := newMemConn(10), newMemConn(10)
+	known.addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 2000}
+	ag.clients.AddClient(NewClient("c", uConn{known, 0, nil}, uAddr{known.addr}))
+	l := newListener(ag, defaultMaxMessageSize, conn, known)
+
+	for i := 0; i < 3; i++ {
+		conn.in <- packet(NewMessage(PINGREQ))
+		known.in <- packet(NewMessage(PINGREQ))
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-known.replies:
+		case <-time.After(time.Second):
+			t.Fatalf("the client's PINGREQ %d was not answered", i+1)
+		}
+	}
+	l.stop(context.Background())
+	if n := len(conn.replies); n != 1 {
+		t.Fatalf("expected 1 packet from the address with no session answered, got %d", n)
+	}
+	if s := ag.Flood(); s.Packets != 3 || s.OverPacketRate != 2 {
+		t.Fatalf("expected 3 packets, 2 dropped, got %+v", s)
+	}
+}
+
+// An address with no session is told to connect once in a while
+func Test_unknown_client_DISCONNECT(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.mqttclient = &fakeBroker{}
+	ag.clients.RemoveClient(client.Address)
+
+	for i := 0; i < 3; i++ {
+		ag.handle(NewPublishMessage(1, 0, []byte("x"), 1, 1, false, false), client.Conn, f.addr())
+	}
+	f.expect(DISCONNECT)
+	f.expectNothing()
+	ag.handle(connectMessage("fake", false), client.Conn, f.addr())
+	f.expect(CONNACK)
+	ag.clients.RemoveClient(f.addr())
+	ag.handle(NewPublishMessage(1, 0, []byte("x"), 1, 2, false, false), client.Conn, f.addr())
+	f.expect(DISCONNECT)
+	if s := ag.Flood(); s.Disconnects != 2 || s.SuppressedDisconnect != 2 {
+		t.Fatalf("expected 2 DISCONNECTs and 2 held back, got %+v", s)
+	}
+}
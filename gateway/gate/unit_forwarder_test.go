@@ -0,0 +1,78 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// A forwarder relaying for the node with id
+func (f *fakeClient) relay(gw uAddr, id byte, m Message) {
+	if err := (uConn{f.conn, 0, nil}).WriteTo(NewEncapsulatedMessage([]byte{id}, 1, m), gw); err != nil {
+		f.t.Fatalf("WriteTo: %v", err)
+	}
+}
+
+// The message for the node with id, relayed to the forwarder
+func (f *fakeClient) expectRelayed(id byte, msgType byte) Message {
+	e, ok := f.expect(ENCMSG).(*EncapsulatedMessage)
+	if !ok || len(e.WirelessNodeId) != 1 || e.WirelessNodeId[0] != id || e.Radius != 1 {
+		f.t.Fatalf("expected a message for node %d, got %+v", id, e)
+	}
+	if e.Message == nil || e.Message.MessageType() != msgType {
+		f.t.Fatalf("expected %s for node %d, got %+v", MessageNames[msgType], id, e.Message)
+	}
+	return e.Message
+}
+
+// Nodes behind forwarders are clients of their own, known by
+// their forwarder and node id, and answered through the
+// forwarder
+func Test_forwarder_nodes(t *testing.T) {
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1"})
+	ag.mqttclient = &fakeBroker{}
+	tg, _, _ := newTestTGateway(t)
+	tg.address = "127.0.0.1:0"
+
+	for _, g := range []struct {
+		name    string
+		gw      Gateway
+		clients *Clients
+	}{
+		{"aggregating", ag, &ag.clients},
+		{"transparent", tg, &tg.clients},
+	} {
+		t.Run(g.name, func(t *testing.T) {
+			if err := g.gw.Start(); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			defer g.gw.Stop(context.Background())
+			gwaddr := uAddr{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: g.gw.Port()}}
+
+			forwarders := []*fakeClient{newFakeClient(t), newFakeClient(t)}
+			for i, f := range forwarders {
+				for _, id := range []byte{1, 2} {
+					f.relay(gwaddr, id, connectMessage(fmt.Sprintf("node-%d-%d", i, id), false))
+					if ca := f.expectRelayed(id, CONNACK).(*ConnackMessage); ca.ReturnCode != ACCEPTED {
+						t.Fatalf("CONNECT of node %d: rc %d", id, ca.ReturnCode)
+					}
+				}
+			}
+			if g.clients.Len() != 4 {
+				t.Fatalf("expected 4 clients, have %d", g.clients.Len())
+			}
+			forwarders[1].relay(gwaddr, 2, NewMessage(PINGREQ))
+			forwarders[1].expectRelayed(2, PINGRESP)
+			node := uAddr{nodeAddr{forwarders[0].conn.LocalAddr(), "\x01", 1}}
+			if sc := g.clients.GetClient(node); sc == nil || sc.base().ClientId != "node-0-1" {
+				t.Fatalf("node 1 of the first forwarder is %v", sc)
+			}
+			if g.clients.GetClient(forwarders[0].addr()) != nil {
+				t.Fatalf("expected the forwarder not to be a client")
+			}
+		})
+	}
+}
@@ -9,6 +9,8 @@ func new_topicNames() *topicNames {
 	t := &topicNames{
 		sync.RWMutex{},
 		make(map[uint16]string),
+		make(map[uint16]string),
+		0,
 		0,
 	}
 	return t
@@ -68,6 +70,27 @@ func Test_topicName_putTopic(t *testing.T) {
 	}
 }
 
+func Test_topicName_predefined(t *testing.T) {
+	topics := new_topicNames()
+	topics.putTopic("foo")
+	taken := topics.addPredefined([]predefinedTopic{{1, "a"}, {2, "b/+"}, {3, "c"}})
+	if len(taken) != 1 || taken[0].id != 1 {
+		t.Errorf("expected id 1 taken, got %v", taken)
+	}
+	if i := topics.putTopic("bar"); i != 4 {
+		t.Errorf("expected pre-defined ids skipped, got %d", i)
+	}
+	if topics.getPredefined(2) != "b/+" || topics.getPredefined(1) != "" || topics.getPredefinedId("c") != 3 {
+		t.Errorf("topicNames has unexpected pre-defined topics")
+	}
+	if id, idType := topics.publishId("c"); id != 3 || idType != topicIdPredefined {
+		t.Errorf("expected c published with pre-defined id 3, got %d type %d", id, idType)
+	}
+	if id, idType := topics.publishId("foo"); id != 1 || idType != topicIdNormal {
+		t.Errorf("expected foo published with id 1, got %d type %d", id, idType)
+	}
+}
+
 func Test_topicName_get(t *testing.T) {
 	topics := new_topicNames()
 
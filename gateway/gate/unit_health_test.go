@@ -0,0 +1,102 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// GET the health check at url, returning its status and reason
+func health(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	var h healthInfo
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	return resp.StatusCode, h.Reason
+}
+
+// The health checks follow the gateway as it starts, loses its
+// broker, drains and stops, needing no token
+func Test_health_AGateway(t *testing.T) {
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1", adminaddress: "127.0.0.1:0", admintoken: "secret"})
+	ag.mqttclient = &fakeBroker{}
+	if reason := ag.notAlive(); reason != "not started" {
+		t.Fatalf("expected not started, got %q", reason)
+	}
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	url := "http://" + ag.admin.Addr().String()
+
+	for _, path := range []string{healthzPath, readyzPath} {
+		if status, reason := health(t, url+path); status != http.StatusOK {
+			t.Fatalf("%s: expected 200 once started, got %d %q", path, status, reason)
+		}
+	}
+
+	ag.brokerState(ag.upstream, BrokerDisconnected, nil)
+	if status, reason := health(t, url+readyzPath); status != http.StatusServiceUnavailable || reason != "the broker is disconnected" {
+		t.Fatalf("expected not ready without the broker, got %d %q", status, reason)
+	}
+	if status, _ := health(t, url+healthzPath); status != http.StatusOK {
+		t.Fatalf("expected alive without the broker, got %d", status)
+	}
+	ag.config.Load().adminreadyany = true
+	if status, reason := health(t, url+readyzPath); status != http.StatusOK {
+		t.Fatalf("expected ready without the broker given admin-ready-broker false, got %d %q", status, reason)
+	}
+	ag.brokerState(ag.upstream, BrokerConnected, nil)
+
+	f := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("f", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+	f.expect(CONNACK)
+	stopping := make(chan int, 1)
+	ag.SetHooks(Hooks{OnDisconnect: func(client *Client, reason string) {
+		if reason == DisconnectStopped {
+			status, _ := health(t, url+healthzPath)
+			stopping <- status
+		}
+	}})
+	done := make(chan error)
+	go func() { done <- ag.Drain(50 * time.Millisecond) }()
+	for !ag.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+	for _, path := range []string{healthzPath, readyzPath} {
+		if status, reason := health(t, url+path); status != http.StatusServiceUnavailable || reason != "draining" {
+			t.Fatalf("%s: expected 503 draining, got %d %q", path, status, reason)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	f.expect(DISCONNECT)
+	if status := <-stopping; status != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while stopping, got %d", status)
+	}
+	if ag.admin.Addr() != nil {
+		t.Fatalf("expected the admin listener stopped")
+	}
+}
+
+func Test_health_TGateway(t *testing.T) {
+	tg, _, _ := newTestTGateway(t)
+	tg.address, tg.admin.address = "127.0.0.1:0", "127.0.0.1:0"
+	if err := tg.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer tg.Stop(context.Background())
+	url := "http://" + tg.admin.Addr().String()
+	if status, reason := health(t, url+readyzPath); status != http.StatusOK {
+		t.Fatalf("expected ready once started, got %d %q", status, reason)
+	}
+}
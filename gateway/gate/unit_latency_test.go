@@ -0,0 +1,68 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_histogram(t *testing.T) {
+	all := &histogram{}
+	h := &histogram{parent: all}
+	for _, d := range []time.Duration{50 * time.Microsecond, 3 * time.Millisecond, 3 * time.Millisecond, time.Minute} {
+		h.observe(d)
+	}
+	s := h.snapshot()
+	if s.Count != 4 || s.Sum < 60 || all.snapshot().Count != 4 {
+		t.Fatalf("expected 4 durations, over a minute in all, counted in the parent too, got %+v", s)
+	}
+	for _, b := range []struct {
+		le    float64
+		count uint64
+	}{{0.0001, 1}, {0.0025, 1}, {0.005, 3}, {5, 3}} {
+		for _, bc := range s.Buckets {
+			if bc.Le == b.le && bc.Count != b.count {
+				t.Errorf("expected %d up to %vs, got %d", b.count, b.le, bc.Count)
+			}
+		}
+	}
+}
+
+func Test_latency_handle(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	onPacket(ag, client, f, NewMessage(PINGREQ))
+	f.expect(PINGRESP)
+
+	handle := ag.latency.snapshot()["handle"].(map[string]histogramSnapshot)
+	if len(handle) != 1 || handle["PINGREQ"].Count != 1 {
+		t.Fatalf("expected one PINGREQ timed, got %+v", handle)
+	}
+	if _, ok := ag.latency.snapshot()["register_rtt"]; ok {
+		t.Fatalf("expected REGISTERs not timed unless asked")
+	}
+}
+
+func Test_latency_register_rtt(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.latency.registerRTT = true
+	ag.configureClient(client)
+	subscribe(ag, client, "a/#", 0)
+
+	ag.distribute(&fakeMessage{"a/1", []byte{1}, 0})
+	rm := f.expect(REGISTER).(*RegisterMessage)
+	ag.handle_REGACK(regack(rm), client)
+	f.expect(PUBLISH)
+
+	if ci := client.info(true); ci.RegisterRTT == nil || ci.RegisterRTT.Count != 1 {
+		t.Fatalf("expected the client's REGISTER timed, got %+v", ci.RegisterRTT)
+	}
+	if s := ag.latency.snapshot()["register_rtt"].(histogramSnapshot); s.Count != 1 {
+		t.Fatalf("expected the REGISTER timed in all, got %+v", s)
+	}
+	if s := ag.latency.distribute.snapshot(); s.Count != 1 {
+		t.Fatalf("expected the message's distribution timed, got %+v", s)
+	}
+}
@@ -0,0 +1,160 @@
+package gateway
+
+import (
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func registerMessage(topic string, msgId uint16) *RegisterMessage {
+	rm := NewMessage(REGISTER).(*RegisterMessage)
+	rm.TopicName = []byte(topic)
+	rm.MessageId = msgId
+	return rm
+}
+
+func Test_limits_section(t *testing.T) {
+	gc := &GatewayConfig{}
+	if l := gc.clientLimits(); l != (clientLimits{1000, 0, 1}) {
+		t.Fatalf("expected the default client limits, got %+v", l)
+	}
+	if err := gc.parseYAML([]byte("limits:\n  clients: 10\n  topics: 100\n  client-queue: 50\n  client-queue-bytes: 4096\n  client-inflight: 4\n  upstream-queue: 64\n  broker-connections: 5")); err != nil {
+		t.Fatalf("parseYAML: %v", err)
+	}
+	if gc.maxclients != 10 || gc.maxtopics != 100 || gc.upstreamqueue != 64 || gc.maxbrokerconns != 5 {
+		t.Fatalf("expected the configured limits, got %+v", gc)
+	}
+	if l := gc.clientLimits(); l != (clientLimits{50, 4096, 4}) {
+		t.Fatalf("expected the configured client limits, got %+v", l)
+	}
+	gc.clientqueue = -1
+	if err := gc.Validate(); err == nil {
+		t.Fatalf("expected a negative client-queue to be refused")
+	}
+}
+
+func Test_limits_max_clients_transparent(t *testing.T) {
+	tg, c, _ := newTestTGateway(t)
+	tg.maxClients = 1
+	f, g := newFakeClient(t), newFakeClient(t)
+	tconnect(t, tg, c, f, "f")
+
+	tg.handle_CONNECT(connectMessage("g", false), c, g.addr())
+	if ca := g.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != REJ_CONGESTION {
+		t.Fatalf("expected rc %d, got %d", REJ_CONGESTION, ca.ReturnCode)
+	}
+	if tg.clients.GetClient(g.addr()) != nil {
+		t.Fatalf("refused client was kept")
+	}
+}
+
+func Test_limits_max_topics(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.tIndex.max = 2
+
+	for i, topic := range []string{"a", "b"} {
+		ag.handle_REGISTER(registerMessage(topic, uint16(i+1)), client)
+		if ra := f.expect(REGACK).(*RegackMessage); ra.ReturnCode != ACCEPTED {
+			t.Fatalf("%s: expected rc %d, got %d", topic, ACCEPTED, ra.ReturnCode)
+		}
+	}
+	// a topic registered already is not another
+	ag.handle_REGISTER(registerMessage("a", 3), client)
+	if ra := f.expect(REGACK).(*RegackMessage); ra.ReturnCode != ACCEPTED || ra.TopicId != 1 {
+		t.Fatalf("expected topic id 1 accepted, got %d rc %d", ra.TopicId, ra.ReturnCode)
+	}
+	ag.handle_REGISTER(registerMessage("c", 4), client)
+	if ra := f.expect(REGACK).(*RegackMessage); ra.ReturnCode != REJ_CONGESTION || ra.TopicId != 0 {
+		t.Fatalf("expected rc %d, got %d for topic id %d", REJ_CONGESTION, ra.ReturnCode, ra.TopicId)
+	}
+
+	// nor is one given an id for a broker message
+	subscribe(ag, client, "#", 0)
+	ag.distribute(&fakeMessage{"d", []byte{1}, 0})
+	f.expectNothing()
+	if n := ag.tIndex.len(); n != 2 {
+		t.Fatalf("expected 2 topics, got %d", n)
+	}
+}
+
+func Test_limits_client_queue(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	client.limits.queue = 2
+	subscribe(ag, client, "a", 0)
+	ag.tIndex.putTopic("a")
+	sleep(ag, f)
+
+	for i := 0; i < 3; i++ {
+		ag.distribute(&fakeMessage{"a", []byte{byte(i)}, 0})
+	}
+	if queued, _, _ := client.usage(); queued != 2 || client.QueueDrops() != 1 {
+		t.Fatalf("expected 2 queued and 1 dropped, got %d and %d", queued, client.QueueDrops())
+	}
+}
+
+func Test_limits_client_queue_bytes(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	client.limits.queueBytes = 4
+	subscribe(ag, client, "a", 0)
+	ag.tIndex.putTopic("a")
+	sleep(ag, f)
+
+	ag.distribute(&fakeMessage{"a", []byte{1, 2}, 0})
+	ag.distribute(&fakeMessage{"a", []byte{3, 4}, 0})
+	ag.distribute(&fakeMessage{"a", []byte{5}, 0})
+	if _, n, _ := client.usage(); n != 4 || client.QueueDrops() != 1 {
+		t.Fatalf("expected 4 bytes queued and 1 dropped, got %d and %d", n, client.QueueDrops())
+	}
+}
+
+func Test_limits_client_inflight(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	client.limits.inflight = 2
+	subscribe(ag, client, "a", 1)
+	client.Register(ag.tIndex.putTopic("a"), "a")
+
+	for i := byte(1); i <= 3; i++ {
+		ag.distribute(&fakeMessage{"a", []byte{i}, 1})
+	}
+	pm := f.expect(PUBLISH).(*PublishMessage)
+	f.expect(PUBLISH)
+	f.expectNothing()
+	if _, _, inflight := client.usage(); inflight != 2 {
+		t.Fatalf("expected 2 in flight, got %d", inflight)
+	}
+
+	ag.handle_PUBACK(puback(pm, ACCEPTED), client)
+	if pm = f.expect(PUBLISH).(*PublishMessage); pm.Data[0] != 3 {
+		t.Fatalf("expected message 3, got %d", pm.Data[0])
+	}
+}
+
+func Test_limits_usage(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.setLimits(&GatewayConfig{maxclients: 5, maxtopics: 10})
+	ag.tIndex.putTopic("a")
+	client.limits.queue = 10
+	subscribe(ag, client, "a", 0)
+	sleep(ag, f)
+	ag.distribute(&fakeMessage{"a", []byte{1, 2, 3}, 0})
+
+	usage := make(map[string]LimitUsage)
+	for _, u := range ag.Limits() {
+		usage[u.Name] = u
+	}
+	for _, expected := range []LimitUsage{
+		{"max-clients", 5, 1},
+		{"max-topics", 10, 1},
+		{"client-queue", 1000, 1},
+		{"client-queue-bytes", 0, 3},
+	} {
+		if u := usage[expected.Name]; u != expected {
+			t.Errorf("expected %+v, got %+v", expected, u)
+		}
+	}
+}
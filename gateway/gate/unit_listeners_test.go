@@ -0,0 +1,194 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// One gateway listening on several sockets, its clients tagged
+// with the listener each came through
+func Test_listeners(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gw.sock")
+	gc := &GatewayConfig{bindaddress: "127.0.0.1"}
+	if err := gc.parseConfig("listener udp://127.0.0.1:0\nlistener unix://" + path); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	broker := &fakeBroker{}
+	ag := NewAGateway(gc)
+	ag.mqttclient = broker
+	// only forwarders on the unix socket may publish
+	ag.Use(func(next PacketHandler) PacketHandler {
+		return func(msg Message, c uConn, a uAddr) {
+			if msg.MessageType() == PUBLISH && c.Listener() != "unixgram://"+path {
+				return
+			}
+			next(msg, c, a)
+		}
+	})
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	second := ag.transports.more[0].(*listener).addr()
+
+	lan, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer lan.Close()
+	local := newUnixClient(t, filepath.Join(filepath.Dir(path), "client.sock"))
+	for _, c := range []struct {
+		conn     net.PacketConn
+		gw       net.Addr
+		listener string
+	}{
+		{lan, second, "udp://" + second.String()},
+		{local, &net.UnixAddr{Name: path, Net: "unixgram"}, "unixgram://" + path},
+	} {
+		(uConn{c.conn, 0, nil}).WriteTo(connectMessage(c.conn.LocalAddr().Network(), false), uAddr{c.gw})
+		if ca := unixExpect(t, c.conn, CONNACK).(*ConnackMessage); ca.ReturnCode != ACCEPTED {
+			t.Fatalf("CONNECT through %s: rc %d", c.listener, ca.ReturnCode)
+		}
+		(uConn{c.conn, 0, nil}).WriteTo(NewRegisterMessage(0, 1, []byte("a")), uAddr{c.gw})
+		ra := unixExpect(t, c.conn, REGACK).(*RegackMessage)
+		if client := ag.clients.GetClient(uAddr{c.conn.LocalAddr()}); client == nil || client.base().Listener() != c.listener {
+			t.Fatalf("client of %s tagged %q", c.listener, client.base().Listener())
+		}
+		(uConn{c.conn, 0, nil}).WriteTo(NewPublishMessage(ra.TopicId, 0, []byte(c.listener), 1, 2, false, false), uAddr{c.gw})
+		if c.conn == lan {
+			// read after the PUBLISH, which was dropped
+			(uConn{c.conn, 0, nil}).WriteTo(NewMessage(PINGREQ), uAddr{c.gw})
+			unixExpect(t, c.conn, PINGRESP)
+		} else {
+			unixExpect(t, c.conn, PUBACK)
+		}
+	}
+
+	stats := ag.Listeners()
+	if len(stats) != 3 || stats[0].Name != "udp://"+ag.Addr() || stats[0].PacketsIn != 0 || stats[0].Clients != 0 {
+		t.Fatalf("listener stats %+v", stats)
+	}
+	for _, s := range stats[1:] {
+		if s.Clients != 1 || s.PacketsOut != 3 || s.PacketsIn < 3 || s.BytesIn == 0 || s.BytesOut == 0 {
+			t.Fatalf("stats of %s: %+v", s.Name, s)
+		}
+	}
+
+	if err := ag.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if len(broker.published) != 1 || string(broker.published[0].payload) != "unixgram://"+path {
+		t.Fatalf("the broker was sent %+v", broker.published)
+	}
+	if len(ag.Listeners()) != 0 {
+		t.Fatalf("listening after Stop: %+v", ag.Listeners())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file left behind: %v", err)
+	}
+	if c, err := net.ListenUDP("udp", second.(*net.UDPAddr)); err != nil {
+		t.Fatalf("second UDP socket not closed: %v", err)
+	} else {
+		c.Close()
+	}
+}
+
+// Listeners configured with port 0 are bound to ports the system
+// chooses, reported once Start returns, when clients can connect
+// to them at once
+func Test_listeners_ephemeral_ports(t *testing.T) {
+	gc := &GatewayConfig{bindaddress: "127.0.0.1"}
+	if err := gc.parseConfig("listener tcp://127.0.0.1:0\nlistener udp://127.0.0.1:0"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	tg, _, _ := newTestTGateway(t)
+	tg.address = "127.0.0.1:0"
+	tg.transports.configs = gc.listeners
+	if err := tg.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer tg.Stop(context.Background())
+
+	addrs := tg.Addrs()
+	if len(addrs) != 3 {
+		t.Fatalf("expected 3 addresses, got %v", addrs)
+	}
+	for _, addr := range addrs {
+		if addrPort(addr.String()) == 0 {
+			t.Fatalf("expected a port to have been chosen, got %v", addr)
+		}
+	}
+	if addrs[0].String() != tg.Addr() || addrPort(tg.Addr()) != tg.Port() {
+		t.Fatalf("expected %v first, at port %d, got %v", tg.Addr(), tg.Port(), addrs)
+	}
+	c := dialTCP(t, addrs[1])
+	c.send(connectMessage("ephemeral", false))
+	c.expect(CONNACK)
+}
+
+// A fakeBroker published to by packets handled at once
+type lockedBroker struct {
+	sync.Mutex
+	*fakeBroker
+}
+
+func (b *lockedBroker) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	b.Lock()
+	defer b.Unlock()
+	return b.fakeBroker.Publish(topic, qos, retained, payload)
+}
+
+// Clients publish at QoS -1 without connecting through the
+// listeners allowing it alone
+func Test_listeners_qos_minus_one(t *testing.T) {
+	gc := &GatewayConfig{bindaddress: "127.0.0.1"}
+	if err := gc.parseConfig("predefined-topic 5=a/b\npredefined-topic 6=a/+\nlistener udp://127.0.0.1:0?allow-qos-minus-one=true"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	broker := &lockedBroker{fakeBroker: &fakeBroker{}}
+	ag := NewAGateway(gc)
+	ag.mqttclient = broker
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	allowed := ag.transports.more[0].(*listener).addr()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer conn.Close()
+	for _, p := range []struct {
+		gw      net.Addr
+		id      uint16
+		idType  byte
+		payload string
+	}{
+		{allowed, 5, topicIdPredefined, "predefined"},
+		{allowed, 'x'<<8 | 'y', topicIdShort, "short"},
+		{allowed, 6, topicIdPredefined, "wildcard"},
+		{allowed, 7, topicIdPredefined, "unknown"},
+		{allowed, 5, topicIdNormal, "normal"},
+		{ag.listener.conns[0].LocalAddr(), 5, topicIdPredefined, "not allowed"},
+	} {
+		(uConn{conn, 0, nil}).WriteTo(NewPublishMessage(p.id, p.idType, []byte(p.payload), 3, 0, false, false), uAddr{p.gw})
+		// nothing is answered, nor a DISCONNECT sent
+		(uConn{conn, 0, nil}).WriteTo(NewMessage(PINGREQ), uAddr{p.gw})
+		unixExpect(t, conn, PINGRESP)
+	}
+
+	if err := ag.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	broker.Lock()
+	defer broker.Unlock()
+	if len(broker.published) != 2 || broker.published[0].topic != "a/b" || broker.published[1].topic != "xy" {
+		t.Fatalf("the broker was sent %+v", broker.published)
+	}
+}
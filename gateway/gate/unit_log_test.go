@@ -0,0 +1,193 @@
+package gateway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// Logging to a file as JSON, only the levels up to the one
+// configured, which may be changed while logging
+func Test_log_configure(t *testing.T) {
+	defer InitLogger(ioutil.Discard, ioutil.Discard)
+	file := filepath.Join(t.TempDir(), "gateway.log")
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("log-level warn\nlog-format json\nlog-destination " + file); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	info, errors := INFO, ERROR
+	if err := ConfigureLogger(gc); err != nil {
+		t.Fatalf("ConfigureLogger: %v", err)
+	}
+	if INFO != info || ERROR != errors {
+		t.Fatalf("expected the loggers to be kept")
+	}
+	ERROR.Println("an error")
+	WARN.Printf("a %s", "warning")
+	INFO.Println("not logged")
+	if err := SetLogLevel(levelDebug); err != nil {
+		t.Fatalf("SetLogLevel: %v", err)
+	}
+	DEBUG.Println("now logged")
+	if err := SetLogLevel("verbose"); err != ErrInvalidLogLevel {
+		t.Fatalf("expected %v, got %v", ErrInvalidLogLevel, err)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var l struct{ Time, Level, Msg string }
+		if err := json.Unmarshal([]byte(line), &l); err != nil || l.Time == "" {
+			t.Fatalf("expected a JSON line, got %q, %v", line, err)
+		}
+		got = append(got, l.Level+" "+l.Msg)
+	}
+	if strings.Join(got, ",") != "error an error,warn a warning,debug now logged" {
+		t.Fatalf("expected the error, warning and debug lines, got %q", got)
+	}
+}
+
+// Formatted each time it is logged
+type formatCount int
+
+func (f *formatCount) String() string {
+	*f++
+	return "formatted"
+}
+
+// Lines of levels not logged are neither formatted nor written,
+// nor cost an allocation
+func Test_log_levels(t *testing.T) {
+	var out strings.Builder
+	InitLogger(&out, &out)
+	defer InitLogger(ioutil.Discard, ioutil.Discard)
+
+	var f formatCount
+	DEBUG.Printf("packet %v", &f)
+	DEBUG.Println(&f)
+	libraryLogger(3).Println(&f)
+	if f != 1 || out.Len() != 0 || DEBUG.Enabled() || LogLevel() != levelInfo {
+		t.Fatalf("expected only the library's line formatted, and nothing logged, got %d and %q", f, out.String())
+	}
+	if allocs := testing.AllocsPerRun(100, func() { DEBUG.Printf("packet %v", &f) }); allocs != 0 {
+		t.Fatalf("expected no allocations, got %v", allocs)
+	}
+
+	if err := SetLogLevel(levelDebug); err != nil {
+		t.Fatalf("SetLogLevel: %v", err)
+	}
+	DEBUG.Printf("packet %v", &f)
+	libraryLogger(3).Println("from a library")
+	if lines := strings.Split(out.String(), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[0], "DEBUG: ") ||
+		!strings.HasSuffix(lines[0], " packet formatted") || !strings.HasSuffix(lines[1], " from a library") {
+		t.Fatalf("expected the debug lines, got %q", out.String())
+	}
+
+	out.Reset()
+	SetLogLevel(levelError)
+	INFO.Println("not logged")
+	WARN.Println("not logged")
+	ERROR.Println("logged")
+	if !strings.HasPrefix(out.String(), "ERROR: ") || !strings.HasSuffix(out.String(), " logged\n") || strings.Contains(out.String(), "not logged") {
+		t.Fatalf("expected the error alone, got %q", out.String())
+	}
+}
+
+// Structured lines keep the component, client, address, packet
+// type, topic and msgid apart from the message, and text puts
+// them after it
+func Test_log_fields(t *testing.T) {
+	var out strings.Builder
+	InitLogger(&out, &out)
+	defer InitLogger(ioutil.Discard, ioutil.Discard)
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1884}
+	c := &Client{ClientId: "sensor 1"}
+
+	INFO.Log("received", coreLog, logMsgType(PUBLISH), logClient(c), logRemote(addr), logMsgId(7))
+	if line := out.String(); !strings.HasSuffix(line, `received component=core msg_type=PUBLISH client_id="sensor 1" remote_addr=192.0.2.1:1884 msgid=7`+"\n") {
+		t.Fatalf("expected the fields after the message, got %q", line)
+	}
+
+	// as ConfigureLogger has them for structured lines
+	for _, l := range loggers() {
+		l.SetPrefix("")
+		l.SetFlags(0)
+	}
+	out.Reset()
+	logFormatting.Store(logLogfmt)
+	ERROR.Log("queue full", clientLog, logClient(c), logTopic("a/b"))
+	line := out.String()
+	if !strings.HasPrefix(line, "time=") || !strings.HasSuffix(line, ` level=error component=client msg="queue full" client_id="sensor 1" topic=a/b`+"\n") {
+		t.Fatalf("expected a logfmt line, got %q", line)
+	}
+
+	out.Reset()
+	logFormatting.Store(logJSON)
+	WARN.Log("resending", logMsgId(7), Field{"will", true})
+	var l map[string]interface{}
+	if err := json.Unmarshal([]byte(out.String()), &l); err != nil {
+		t.Fatalf("expected a JSON line, got %q, %v", out.String(), err)
+	}
+	if l["level"] != "warn" || l["component"] != defaultComponent || l["msg"] != "resending" || l["msgid"] != 7.0 || l["will"] != true || l["time"] == nil {
+		t.Fatalf("expected the fields kept, got %v", l)
+	}
+}
+
+// With log-packets, the packets of the client asked for are
+// logged a line each, received and sent, whatever the level
+func Test_log_packets(t *testing.T) {
+	var out strings.Builder
+	InitLogger(&out, &out)
+	defer InitLogger(ioutil.Discard, ioutil.Discard)
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("log-packets true\nlog-packets-client fake"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	setPacketDump(gc.packetDump())
+	defer setPacketDump(nil)
+
+	f, g := newFakeClient(t), newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	other := NewClient("g", client.Conn, g.addr())
+	ag.clients.AddClient(other)
+	onPacket(ag, client, f, NewMessage(PINGREQ))
+	f.expect(PINGRESP)
+	onPacket(ag, other, g, NewMessage(PINGREQ))
+	g.expect(PINGRESP)
+
+	expected := []string{
+		" in component=dump remote_addr=" + f.addr().String() + ` msg_type=PINGREQ bytes=2 hex="02 16"`,
+		" out component=dump remote_addr=" + f.addr().String() + ` msg_type=PINGRESP bytes=2 hex="02 17"`,
+	}
+	var lines []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(line, "component=dump") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "DEBUG: ") || !strings.HasSuffix(line, expected[i]) {
+			t.Fatalf("expected %q, got %q", expected[i], line)
+		}
+	}
+
+	// of an address, whatever its client
+	out.Reset()
+	setPacketDump(newPacketDump("", g.addr().host()))
+	onPacket(ag, other, g, NewMessage(PINGREQ))
+	g.expect(PINGRESP)
+	if n := strings.Count(out.String(), "component=dump"); n != 2 {
+		t.Fatalf("expected g's packets logged, got %q", out.String())
+	}
+}
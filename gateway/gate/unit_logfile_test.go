@@ -0,0 +1,161 @@
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, path string) []byte {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The words of the file at path, lines of one word being its
+// lines
+func fileLines(t *testing.T, path string) []string {
+	return strings.Fields(string(readFile(t, path)))
+}
+
+func Test_logfile_options(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseYAML([]byte("logging:\n  destination: /var/log/gnatt.log\n  max-size: 1048576\n  max-backups: 3\n  max-age: 24h\n  sync: 5s")); err != nil {
+		t.Fatalf("parseYAML: %v", err)
+	}
+	expected := logFileConfig{"/var/log/gnatt.log", 1 << 20, 3, 24 * time.Hour, false, 5 * time.Second}
+	if lf := gc.logFile(); lf != expected {
+		t.Fatalf("expected %+v, got %+v", expected, lf)
+	}
+	for _, value := range []string{"always", "0s", "-1s"} {
+		if _, err := checkLogSync(value); err != ErrInvalidLogSync {
+			t.Errorf("%s: expected %v, got %v", value, ErrInvalidLogSync, err)
+		}
+	}
+}
+
+// Lines written from many goroutines while the file rotates are
+// all kept, in as many files as are kept
+func Test_logfile_rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.log")
+	f, err := openLogFile(logFileConfig{path: path, maxSize: 100})
+	if err != nil {
+		t.Fatalf("openLogFile: %v", err)
+	}
+	defer f.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				fmt.Fprintf(f, "line-%d-%02d\n", g, i)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	files, _ := filepath.Glob(path + "*")
+	for _, name := range files {
+		lines := fileLines(t, name)
+		if len(lines) > 10 {
+			t.Fatalf("expected %s rotated at 100 bytes, got %d lines", name, len(lines))
+		}
+		for _, l := range lines {
+			seen[l] = true
+		}
+	}
+	if len(seen) != 200 {
+		t.Fatalf("expected 200 lines kept, got %d in %d files", len(seen), len(files))
+	}
+}
+
+// Backups beyond those kept, or older than kept, are removed
+func Test_logfile_backups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.log")
+	f, err := openLogFile(logFileConfig{path: path, maxSize: 10, maxBackups: 2})
+	if err != nil {
+		t.Fatalf("openLogFile: %v", err)
+	}
+	defer f.Close()
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(f, "line %d...\n", i)
+	}
+	if l := fileLines(t, backupName(path, 1)); l[1] != "3..." {
+		t.Fatalf("expected line 3 in the latest backup, got %v", l)
+	}
+	if _, err := os.Stat(backupName(path, 3)); !os.IsNotExist(err) {
+		t.Fatalf("expected 2 backups kept, got %v", err)
+	}
+
+	f.conf.maxBackups, f.conf.maxAge = 0, time.Hour
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(backupName(path, 2), old, old)
+	fmt.Fprintln(f, "line 5...")
+	if _, err := os.Stat(backupName(path, 3)); !os.IsNotExist(err) {
+		t.Fatalf("expected the old backup removed, got %v", err)
+	}
+	if _, err := os.Stat(backupName(path, 2)); err != nil {
+		t.Fatalf("expected the recent backups kept, got %v", err)
+	}
+}
+
+// Once logrotate has moved the file, lines go to a new one at
+// its path, after ReopenLog, and those that cannot be written
+// are counted
+func Test_logfile_reopen(t *testing.T) {
+	defer InitLogger(ioutil.Discard, ioutil.Discard)
+	path := filepath.Join(t.TempDir(), "gateway.log")
+	gc := &GatewayConfig{logdestination: path}
+	if err := ConfigureLogger(gc); err != nil {
+		t.Fatalf("ConfigureLogger: %v", err)
+	}
+	INFO.Println("before")
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	INFO.Println("moved")
+	if err := ReopenLog(); err != nil {
+		t.Fatalf("ReopenLog: %v", err)
+	}
+	INFO.Println("after")
+	for name, expected := range map[string]string{path + ".moved": "before moved", path: "after"} {
+		var msgs []string
+		for _, line := range strings.Split(strings.TrimSpace(string(readFile(t, name))), "\n") {
+			msgs = append(msgs, line[strings.LastIndex(line, " ")+1:])
+		}
+		if strings.Join(msgs, " ") != expected {
+			t.Fatalf("expected %q in %s, got %q", expected, name, msgs)
+		}
+	}
+
+	logging.Lock()
+	f := logging.closer.(*logFile)
+	logging.Unlock()
+	f.Lock()
+	f.file.Close()
+	f.Unlock()
+	dropped := LogDropped()
+	done := make(chan struct{})
+	go func() {
+		ERROR.Println("lost")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the line dropped rather than waited on")
+	}
+	if n := LogDropped(); n != dropped+1 {
+		t.Fatalf("expected 1 line dropped, got %d", n-dropped)
+	}
+}
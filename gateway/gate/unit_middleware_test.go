@@ -0,0 +1,118 @@
+package gateway
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// Hand m to ag as if it had been read from f
+func onPacket(ag *AGateway, client *Client, f *fakeClient, m Message) {
+	var buf bytes.Buffer
+	m.Write(&buf)
+	ag.OnPacket(buf.Len(), buf.Bytes(), client.Conn, f.addr())
+}
+
+func Test_Middleware_order(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+
+	var order []string
+	record := func(name string) Middleware {
+		return func(next PacketHandler) PacketHandler {
+			return func(msg Message, c uConn, a uAddr) {
+				order = append(order, name)
+				next(msg, c, a)
+			}
+		}
+	}
+	ag.Use(record("first"))
+	ag.Use(record("second"))
+
+	onPacket(ag, client, f, NewMessage(PINGREQ))
+	f.expect(PINGRESP)
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Fatalf("middlewares ran in order %v", order)
+	}
+}
+
+func Test_Middleware_short_circuit(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+
+	reached := false
+	ag.Use(func(next PacketHandler) PacketHandler {
+		return func(msg Message, c uConn, a uAddr) {
+			if msg.MessageType() == PINGREQ {
+				return
+			}
+			next(msg, c, a)
+		}
+	})
+	ag.Use(func(next PacketHandler) PacketHandler {
+		return func(msg Message, c uConn, a uAddr) {
+			reached = true
+			next(msg, c, a)
+		}
+	})
+
+	onPacket(ag, client, f, NewMessage(PINGREQ))
+	f.expectNothing()
+	if reached {
+		t.Fatalf("dropped packet reached the next middleware")
+	}
+}
+
+func Test_Middleware_replace(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+
+	ag.Use(func(next PacketHandler) PacketHandler {
+		return func(msg Message, c uConn, a uAddr) {
+			if msg.MessageType() == SEARCHGW {
+				msg = NewMessage(PINGREQ)
+			}
+			next(msg, c, a)
+		}
+	})
+
+	onPacket(ag, client, f, NewMessage(SEARCHGW))
+	f.expect(PINGRESP)
+}
+
+func Test_RateLimit(t *testing.T) {
+	f := newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	ag.Use(RateLimit(0.001, 2))
+
+	for i := 0; i < 3; i++ {
+		onPacket(ag, client, f, NewMessage(PINGREQ))
+	}
+	f.expect(PINGRESP)
+	f.expect(PINGRESP)
+	f.expectNothing()
+
+	// other addresses have their own allowance
+	g := newFakeClient(t)
+	onPacket(ag, client, g, NewMessage(PINGREQ))
+	g.expect(PINGRESP)
+}
+
+func Test_rateLimiter_refill(t *testing.T) {
+	rl := &rateLimiter{rate: 10, burst: 1, buckets: make(map[string]*bucket)}
+	now := time.Now()
+	if !rl.allow("a", now) {
+		t.Fatalf("first packet refused")
+	}
+	if rl.allow("a", now.Add(50*time.Millisecond)) {
+		t.Fatalf("packet allowed before the bucket refilled")
+	}
+	if !rl.allow("a", now.Add(150*time.Millisecond)) {
+		t.Fatalf("packet refused after the bucket refilled")
+	}
+	if rl.allow("a", now.Add(160*time.Millisecond)) {
+		t.Fatalf("burst exceeded")
+	}
+}
@@ -0,0 +1,216 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/websocket"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_config_mqtt5(t *testing.T) {
+	gc := &GatewayConfig{}
+	if gc.mqtt5() != nil {
+		t.Fatalf("MQTT v5 by default")
+	}
+	if err := gc.parseConfig("mqtt-protocol-version 5"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if m := gc.mqtt5(); m == nil || m.sessionExpiry != defaultSessionExpiry || m.topicAliases != defaultTopicAliases {
+		t.Fatalf("defaults %+v", m)
+	}
+	if err := gc.parseConfig("mqtt-session-expiry 600\nmqtt-topic-aliases 0\nmqtt-message-expiry sensors/+/temp=60\nmqtt-message-expiry sensors/#=3600"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	m := gc.mqtt5()
+	if m.sessionExpiry != 600 || m.topicAliases != 0 {
+		t.Fatalf("config %+v", m)
+	}
+	for topic, expected := range map[string]uint32{
+		"sensors/a/temp":     60,
+		"sensors/a/humidity": 3600,
+		"actuators/a":        0,
+	} {
+		if s := m.expiry(topic); s != expected {
+			t.Errorf("%s: expected expiry %d, got %d", topic, expected, s)
+		}
+	}
+
+	for _, bad := range []struct {
+		config string
+		err    error
+	}{
+		{"mqtt-protocol-version 6", ErrInvalidProtocolVersion},
+		{"mqtt-session-expiry 0", ErrInvalidExpiry},
+		{"mqtt-session-expiry 4294967296", ErrInvalidExpiry},
+		{"mqtt-topic-aliases 65536", ErrInvalidTopicAliases},
+		{"mqtt-message-expiry sensors/#", ErrInvalidExpiry},
+		{"mqtt-message-expiry =60", ErrInvalidExpiry},
+		{"mqtt-message-expiry sensors/#/temp=60", ErrTopicFilterInvalidWildcard},
+	} {
+		if err := gc.parseConfig(bad.config); err != bad.err {
+			t.Errorf("%q: expected %v, got %v", bad.config, bad.err, err)
+		}
+	}
+}
+
+// A session the client keeps expires as configured, and its
+// will as messages on its topic do
+func Test_mqtt5_connect(t *testing.T) {
+	conf := &mqtt5Config{600, 0, []expiryRule{{"status/#", 30}}}
+	o := mqtt5Options{mqtt5Config: conf, clientID: "c", username: "u", password: "p", cleanSession: true, keepAlive: time.Minute}
+	cp := o.connectPacket()
+	if !cp.CleanStart || cp.Properties.SessionExpiryInterval != nil || cp.KeepAlive != 60 || !cp.UsernameFlag || string(cp.Password) != "p" || cp.WillMessage != nil {
+		t.Fatalf("clean session CONNECT %+v", cp)
+	}
+	o.cleanSession = false
+	o.will = &Will{"status/c", []byte("gone"), 1, true}
+	cp = o.connectPacket()
+	if cp.CleanStart || cp.Properties.SessionExpiryInterval == nil || *cp.Properties.SessionExpiryInterval != 600 {
+		t.Fatalf("kept session CONNECT %+v", cp)
+	}
+	if w := cp.WillMessage; w == nil || w.Topic != "status/c" || string(w.Payload) != "gone" || w.QoS != 1 || !w.Retain {
+		t.Fatalf("will %+v", w)
+	}
+	if cp.WillProperties == nil || *cp.WillProperties.MessageExpiry != 30 {
+		t.Fatalf("will properties %+v", cp.WillProperties)
+	}
+}
+
+// Each topic's alias is sent with its name once, then alone,
+// until the aliases the broker allows run out
+func Test_mqtt5_topic_aliases(t *testing.T) {
+	c := newMQTT5Client(mqtt5Options{mqtt5Config: &mqtt5Config{0, 2, []expiryRule{{"a", 10}}}})
+	c.aliases.reset(2)
+
+	p, setup := c.publishPacket("a", 1, false, []byte{1})
+	if setup == nil || p.Topic != "a" || *p.Properties.TopicAlias != 1 || *p.Properties.MessageExpiry != 10 {
+		t.Fatalf("first publish %+v, %+v", p, setup)
+	}
+	// still being sent, so not yet the broker's
+	if p, s := c.publishPacket("a", 1, false, nil); s != nil || p.Topic != "a" || p.Properties.TopicAlias != nil {
+		t.Fatalf("publish while the alias is pending %+v", p)
+	}
+	setup.pending, setup.sent = false, true
+	if p, s := c.publishPacket("a", 1, false, nil); s != nil || p.Topic != "" || *p.Properties.TopicAlias != 1 {
+		t.Fatalf("publish with the alias %+v", p)
+	}
+
+	// failing to tell the broker tells it again
+	p, setup = c.publishPacket("b", 0, false, nil)
+	setup.pending = false
+	if p, s := c.publishPacket("b", 0, false, nil); s != setup || p.Topic != "b" || *p.Properties.TopicAlias != 2 || p.Properties.MessageExpiry != nil {
+		t.Fatalf("publish after the alias failed %+v", p)
+	}
+	if p, s := c.publishPacket("c", 0, false, nil); s != nil || p.Properties.TopicAlias != nil {
+		t.Fatalf("alias beyond the broker's maximum %+v", p)
+	}
+
+	c.aliases.reset(0)
+	if p, s := c.publishPacket("a", 0, false, nil); s != nil || p.Topic != "a" || p.Properties.TopicAlias != nil {
+		t.Fatalf("alias on a broker allowing none %+v", p)
+	}
+}
+
+func Test_mqtt5_deliver(t *testing.T) {
+	var got []string
+	handler := func(name string) MQTT.MessageHandler {
+		return func(c *MQTT.Client, m MQTT.Message) {
+			got = append(got, name+" "+m.Topic())
+		}
+	}
+	c := newMQTT5Client(mqtt5Options{mqtt5Config: &mqtt5Config{}, defaultHandler: handler("default")})
+	c.setHandler("a/+", handler("a/+"))
+	c.setHandler("a/#", handler("a/#"))
+	c.setHandler("a/+", handler("replaced"))
+	for _, topic := range []string{"a/b", "a/b/c", "b"} {
+		c.deliver(&paho.Publish{Topic: topic})
+	}
+	c.removeHandler("a/+")
+	c.deliver(&paho.Publish{Topic: "a/b"})
+	if strings.Join(got, ",") != "replaced a/b,a/# a/b/c,default b,a/# a/b" {
+		t.Fatalf("delivered %v", got)
+	}
+
+	// nothing to do without a connection
+	if token := c.Publish("a", 0, false, []byte{1}); !token.WaitTimeout(time.Second) || token.Error() != ErrBrokerUnavailable {
+		t.Fatalf("publish while disconnected: %v", token.Error())
+	}
+	if c.IsConnected() {
+		t.Fatalf("connected without connecting")
+	}
+}
+
+func Test_mqtt5_reason_codes(t *testing.T) {
+	for rc, expected := range map[byte]byte{
+		0x00: REJ_CONGESTION,
+		0x03: REJ_CONGESTION,
+		0x05: REJ_NOT_SUPORTED,
+		0x86: REJ_NOT_SUPORTED,
+		0x87: REJ_NOT_SUPORTED,
+		0x89: REJ_CONGESTION,
+		0x97: REJ_CONGESTION,
+		0x9f: REJ_CONGESTION,
+	} {
+		if code := mqttConnackCode(rc); code != expected {
+			t.Errorf("0x%02x: expected %d, got %d", rc, expected, code)
+		}
+	}
+	if s := (&reasonError{0x87, "no"}).Error(); s != "reason code 0x87 (not authorized): no" {
+		t.Fatalf("error %q", s)
+	}
+}
+
+// Brokers are dialed over TCP, or a WebSocket carrying the
+// configured headers and the MQTT subprotocol
+func Test_dialBroker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Write([]byte{0x20})
+			c.Close()
+		}
+	}()
+	conn, err := dialBroker(context.Background(), "tcp://"+l.Addr().String(), nil, nil)
+	if err != nil {
+		t.Fatalf("dialBroker: %v", err)
+	}
+	b := make([]byte, 1)
+	if _, err := conn.Read(b); err != nil || b[0] != 0x20 {
+		t.Fatalf("read %x, %v", b, err)
+	}
+	conn.Close()
+
+	received := make(chan string, 1)
+	ws := httptest.NewServer(websocket.Server{Handler: func(c *websocket.Conn) {
+		var frame []byte
+		websocket.Message.Receive(c, &frame)
+		received <- c.Request().Header.Get("Authorization") + " " + strings.Join(c.Config().Protocol, ",") + " " + string(frame)
+	}})
+	defer ws.Close()
+	headers := map[string][]string{"Authorization": {"Bearer abc"}}
+	conn, err = dialBroker(context.Background(), "ws"+strings.TrimPrefix(ws.URL, "http")+"/mqtt", nil, headers)
+	if err != nil {
+		t.Fatalf("dialBroker: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("mqtt"))
+	if r := <-received; r != "Bearer abc mqtt mqtt" {
+		t.Fatalf("server received %q", r)
+	}
+
+	if _, err := dialBroker(context.Background(), "http://broker", nil, nil); err != ErrNoTransportSpecified {
+		t.Fatalf("expected %v, got %v", ErrNoTransportSpecified, err)
+	}
+}
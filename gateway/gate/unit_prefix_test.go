@@ -0,0 +1,82 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_config_topic_prefix(t *testing.T) {
+	gc := &GatewayConfig{}
+	for value, expected := range map[string]string{"site42": "site42/", "sites/42/": "sites/42/"} {
+		if err := gc.parseConfig("topic-prefix " + value); err != nil || gc.topicprefix != expected {
+			t.Errorf("%q: expected %q, got %q, %v", value, expected, gc.topicprefix, err)
+		}
+	}
+	for _, bad := range []string{"site+", "sites/#", "$site42", "/"} {
+		if err := gc.parseConfig("topic-prefix " + bad); err != ErrInvalidTopicPrefix {
+			t.Errorf("%q: expected %v, got %v", bad, ErrInvalidTopicPrefix, err)
+		}
+	}
+}
+
+func Test_topicPrefix(t *testing.T) {
+	p := topicPrefix("site42/")
+	for topic, expected := range map[string]string{"a/b": "site42/a/b", "#": "site42/#", "+/b": "site42/+/b", "$SYS/#": "$SYS/#"} {
+		if up := p.upstream(topic); up != expected {
+			t.Errorf("%q: expected %q upstream, got %q", topic, expected, up)
+		}
+	}
+	for topic, expected := range map[string]string{"site42/a/b": "a/b", "site42/$b": "$b", "$SYS/a": "$SYS/a", "site4/a": "", "site42/": ""} {
+		if down, ok := p.downstream(topic); down != expected || ok != (expected != "") {
+			t.Errorf("%q: expected %q downstream, got %q, %v", topic, expected, down, ok)
+		}
+	}
+	if up, _ := topicPrefix("").downstream("a"); up != "a" || topicPrefix("").upstream("a") != "a" {
+		t.Fatalf("expected no prefix by default")
+	}
+}
+
+// The clients' topics are under the prefix on the broker, and
+// the broker's own are not
+func Test_AGateway_topic_prefix(t *testing.T) {
+	gc := &GatewayConfig{bindaddress: "127.0.0.1"}
+	if err := gc.parseConfig("topic-prefix site42"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	broker := &fakeBroker{}
+	ag.mqttclient = broker
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+
+	f := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("c", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+	f.expect(CONNACK)
+	client := ag.clients.GetClient(f.addr())
+	for i, filter := range []string{"a/#", "$SYS/#"} {
+		ag.handle_SUBSCRIBE(subscribeMessage(filter, uint16(i+1), 0), client)
+		f.expect(SUBACK)
+	}
+	if broker.subscriptions["site42/a/#"] == nil || broker.subscriptions["$SYS/#"] == nil {
+		t.Fatalf("subscribed to %v", broker.subscriptions)
+	}
+
+	ag.handle_REGISTER(NewRegisterMessage(0, 3, []byte("b")), client)
+	topicid := f.expect(REGACK).(*RegackMessage).TopicId
+	ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte{1}, 1, 4, true, false), client)
+	f.expect(PUBACK)
+	if len(broker.published) != 1 || broker.published[0].topic != "site42/b" {
+		t.Fatalf("published %v", broker.published)
+	}
+
+	ag.distribute(&fakeMessage{"site7/a/c", []byte{2}, 0})
+	f.expectNothing()
+	broker.deliver("site42/a/#", &fakeMessage{"site42/a/c", []byte{3}, 0})
+	if rm := f.expect(REGISTER).(*RegisterMessage); string(rm.TopicName) != "a/c" {
+		t.Fatalf("expected REGISTER for a/c, got %q", rm.TopicName)
+	}
+}
@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_publishLimits(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("client-publish-rate 10\nclient-publish-limit sensor-1?=1/0\nclient-publish-limit sensor-*=2/512\nclient-publish-limit gw-*=0/0"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	p := gc.publishLimits()
+	for id, limit := range map[string]publishLimit{
+		"sensor-17": {"sensor-1?", 1, 0},
+		"sensor-2":  {"sensor-*", 2, 512},
+		"other":     {"", 10, 0},
+	} {
+		if l, ok := p.of(id); !ok || l != limit {
+			t.Errorf("expected %s limited to %v, got %v, %v", id, limit, l, ok)
+		}
+	}
+	if _, ok := p.of("gw-1"); ok {
+		t.Fatalf("expected gw-1 not limited")
+	}
+	for _, value := range []string{"sensor-*=2", "sensor-*", "=1/1", "sensor-[=1/1", "sensor-*=-1/0", "sensor-*=a/b"} {
+		if err := gc.parseConfig("client-publish-limit " + value); err != ErrInvalidPublishLimit {
+			t.Errorf("expected %q refused, got %v", value, err)
+		}
+	}
+}
+
+func Test_publishBucket(t *testing.T) {
+	now := time.Now()
+	b := newPublishBucket(publishLimit{"", 2, 100}, now)
+	if !b.take(10, now) || !b.take(10, now) || b.take(10, now) {
+		t.Fatalf("expected a burst of 2 PUBLISHes")
+	}
+	if !b.take(10, now.Add(500*time.Millisecond)) || b.take(10, now.Add(500*time.Millisecond)) {
+		t.Fatalf("expected another PUBLISH half a second later")
+	}
+
+	// a PUBLISH larger than a second's worth goes once the bucket
+	// is full, leaving it in debt
+	b = newPublishBucket(publishLimit{"", 0, 100}, now)
+	if !b.take(150, now) || b.take(1, now.Add(400*time.Millisecond)) || !b.take(1, now.Add(time.Second)) {
+		t.Fatalf("expected the bytes limited, got %+v", b)
+	}
+	if info := b.info(now.Add(2 * time.Second)); info.Limited != 1 || info.Bytes != 100 || info.ByteTokens != 100 {
+		t.Fatalf("expected 1 limited and the bucket full again, got %+v", info)
+	}
+}
+
+// A QoS 1 PUBLISH over the limit is refused with congestion, a
+// QoS 0 one dropped, and the client disconnected once it has
+// gone over client-publish-violations times
+func Test_AGateway_publish_limit(t *testing.T) {
+	gc := &GatewayConfig{bindaddress: "127.0.0.1"}
+	if err := gc.parseConfig("client-publish-rate 1\nclient-publish-violations 3"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	broker := &fakeBroker{}
+	ag.mqttclient = broker
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+
+	f := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("c", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+	f.expect(CONNACK)
+	client := ag.clients.GetClient(f.addr())
+	ag.handle_REGISTER(NewRegisterMessage(0, 1, []byte("a")), client)
+	topicid := f.expect(REGACK).(*RegackMessage).TopicId
+
+	ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte("x"), 1, 2, false, false), client)
+	if pa := f.expect(PUBACK).(*PubackMessage); pa.ReturnCode != ACCEPTED {
+		t.Fatalf("expected the PUBLISH accepted, got rc %d", pa.ReturnCode)
+	}
+	ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte("x"), 1, 3, false, false), client)
+	if pa := f.expect(PUBACK).(*PubackMessage); pa.ReturnCode != REJ_CONGESTION || pa.MessageId != 3 {
+		t.Fatalf("expected the PUBLISH refused with congestion, got %+v", pa)
+	}
+	ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte("x"), 0, 0, false, false), client)
+	f.expectNothing()
+	if len(broker.published) != 1 || ag.PublishLimited() != 2 {
+		t.Fatalf("expected one published and 2 limited, got %d and %d", len(broker.published), ag.PublishLimited())
+	}
+	if info := client.base().info(false).RateLimit; info == nil || info.Rate != 1 || info.Limited != 2 {
+		t.Fatalf("expected the allowance in the snapshot, got %+v", info)
+	}
+
+	ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte("x"), 1, 4, false, false), client)
+	f.expect(PUBACK)
+	f.expect(DISCONNECT)
+	if ag.clients.GetClient(f.addr()) != nil {
+		t.Fatalf("expected the client disconnected")
+	}
+}
@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_qosMap(t *testing.T) {
+	gc := &GatewayConfig{}
+	q := gc.qosMap()
+	for sn, expected := range map[byte]byte{0: 0, 1: 1, 2: 2, 3: 0} {
+		if qos := q.upstream("a", sn); qos != expected {
+			t.Errorf("default for %d: expected %d, got %d", sn, expected, qos)
+		}
+	}
+
+	config := "upstream-qos 2=1\nupstream-qos -1=1\nupstream-qos-topic alarms/=2\nupstream-qos-topic alarms/test/=0\nupstream-qos-topic alarms/=1"
+	if err := gc.parseConfig(config); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	q = gc.qosMap()
+	for _, c := range []struct {
+		topic    string
+		sn       byte
+		expected byte
+	}{
+		{"telemetry/a", 0, 0},
+		{"telemetry/a", 1, 1},
+		{"telemetry/a", 2, 1},
+		{"telemetry/a", 3, 1},
+		{"alarms/a", 0, 1},
+		{"alarms/test/a", 2, 0},
+		{"alarms", 2, 1},
+	} {
+		if qos := q.upstream(c.topic, c.sn); qos != c.expected {
+			t.Errorf("%s at %d: expected %d, got %d", c.topic, c.sn, c.expected, qos)
+		}
+	}
+
+	for _, bad := range []string{"upstream-qos 1", "upstream-qos 3=1", "upstream-qos 1=-1", "upstream-qos-topic =2", "upstream-qos-topic a/=3"} {
+		if err := gc.parseConfig(bad); err != ErrInvalidQos {
+			t.Errorf("%q: expected %v, got %v", bad, ErrInvalidQos, err)
+		}
+	}
+}
+
+// The broker is sent each PUBLISH at the QoS mapped from the
+// client's
+func Test_AGateway_upstream_qos(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("upstream-qos 1=0\nupstream-qos-topic alarms/=2"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	broker := &fakeBroker{}
+	ag.mqttclient = broker
+	for _, topic := range []string{"telemetry/a", "alarms/a"} {
+		if err := ag.publishBroker(topic, NewPublishMessage(1, 0, []byte{1}, 1, 1, false, false)); err != nil {
+			t.Fatalf("publishBroker: %v", err)
+		}
+	}
+	if len(broker.published) != 2 || broker.published[0].qos != 0 || broker.published[1].qos != 2 {
+		t.Fatalf("published %+v", broker.published)
+	}
+}
@@ -0,0 +1,308 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_configChanges(t *testing.T) {
+	config := "port 1883\nmqtt-broker tcp://b:1883\nmqtt-header X-Site=north\nupstream-qos-topic a/=1\nsource-rate-exempt 10.0.0.0/8\nlistener tcp://:1884"
+	old, same := &GatewayConfig{}, &GatewayConfig{}
+	for _, gc := range []*GatewayConfig{old, same} {
+		if err := gc.parseConfig(config); err != nil {
+			t.Fatalf("parseConfig: %v", err)
+		}
+	}
+	if reload, restart := configChanges(old, same); reload != nil || restart != nil {
+		t.Fatalf("expected no changes, got %v and %v", reload, restart)
+	}
+	if err := same.parseConfig("port 1884\nmqtt-header X-Site=south\nsource-rate-exempt 192.168.0.0/16\nadvertise-interval 60\nlog-level debug\nlog-format json"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	reload, restart := configChanges(old, same)
+	if fmt.Sprint(reload) != "[source-rate-exempt advertise-interval log-level log-format]" || fmt.Sprint(restart) != "[port mqtt-header]" {
+		t.Fatalf("expected the changes, got %v and %v", reload, restart)
+	}
+}
+
+// A reload changes the source limits of a gateway handling
+// packets, and how long it drains, leaving what needs a restart
+// as it is
+func Test_AGateway_reload_config(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("mqtt-broker tcp://b:1883\nsource-rate-limit 1\nsource-rate-burst 2"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	conn := newMemConn(20)
+	l := newListener(ag, defaultMaxMessageSize, conn)
+	defer l.stop(context.Background())
+
+	pings := func(sent, answered int) {
+		for i := 0; i < sent; i++ {
+			conn.in <- packet(NewMessage(PINGREQ))
+		}
+		for i := 0; i < answered; i++ {
+			select {
+			case <-conn.replies:
+			case <-time.After(time.Second):
+				t.Fatalf("expected %d PINGRESPs, got %d", answered, i)
+			}
+		}
+		select {
+		case <-conn.replies:
+			t.Fatalf("a packet over the limit was answered")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	pings(5, 2)
+	if d := ag.DrainTimeout(); d != time.Minute {
+		t.Fatalf("expected the default drain timeout, got %v", d)
+	}
+
+	reloaded := &GatewayConfig{}
+	if err := reloaded.parseConfig("mqtt-broker tcp://other:1883\nsource-rate-limit 1000\nsource-rate-burst 10\ndrain-timeout 2m"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if err := ag.ReloadConfig(reloaded); err != nil {
+		t.Fatalf("ReloadConfig: %v", err)
+	}
+	pings(10, 10)
+	running := ag.config.Load()
+	if running.sourcerate != 1000 || running.mqttbroker != "tcp://b:1883" || ag.DrainTimeout() != 2*time.Minute {
+		t.Fatalf("expected the limits applied and the broker left, got %+v", running)
+	}
+	// a broker that still differs is logged again, nothing else
+	if reload, restart := configChanges(running, reloaded); reload != nil || fmt.Sprint(restart) != "[mqtt-broker]" {
+		t.Fatalf("expected the broker still to change, got %v and %v", reload, restart)
+	}
+
+	// removing the limit stops limiting
+	if err := ag.ReloadConfig(&GatewayConfig{mqttbroker: "tcp://b:1883"}); err != nil {
+		t.Fatalf("ReloadConfig: %v", err)
+	}
+	if ag.sources.Load() != nil {
+		t.Fatalf("expected no limits")
+	}
+}
+
+// Changing the advertise interval sends an ADVERTISE with the
+// new one at once
+func Test_discovery_set_interval(t *testing.T) {
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer client.Close()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	d := newDiscovery(&GatewayConfig{})
+	d.setInterval(time.Minute)
+	d.group, d.conn, d.done = client.LocalAddr().(*net.UDPAddr), conn, make(chan struct{})
+	d.wg.Add(1)
+	go d.advertise()
+	defer d.stop()
+
+	if adv := expectOn(t, client, ADVERTISE).(*AdvertiseMessage); adv.Duration != 60 {
+		t.Fatalf("expected a duration of 60, got %d", adv.Duration)
+	}
+	d.setInterval(30 * time.Second)
+	if adv := expectOn(t, client, ADVERTISE).(*AdvertiseMessage); adv.Duration != 30 {
+		t.Fatalf("expected a duration of 30, got %d", adv.Duration)
+	}
+}
+
+// Pre-defined topics added are used at once; those removed or
+// changed stay until a restart, as do those whose ids are taken
+func Test_AGateway_reload_predefined(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("mqtt-broker tcp://b:1883\npredefined-topic 17=a/b\npredefined-topic 18=c/d"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	ag.tIndex.putTopic("x") // id 1
+
+	reloaded := &GatewayConfig{}
+	if err := reloaded.parseConfig("mqtt-broker tcp://b:1883\npredefined-topic 17=a/b\npredefined-topic 18=other\npredefined-topic 1=y\npredefined-topic 20=e/f"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if err := ag.ReloadConfig(reloaded); err != nil {
+		t.Fatalf("ReloadConfig: %v", err)
+	}
+	for id, topic := range map[uint16]string{17: "a/b", 18: "c/d", 1: "", 20: "e/f"} {
+		if got := ag.tIndex.getPredefined(id); got != topic {
+			t.Errorf("expected %d to be %q, got %q", id, topic, got)
+		}
+	}
+	if running := ag.config.Load().predefined; fmt.Sprint(running) != "[{17 a/b} {18 c/d} {20 e/f}]" {
+		t.Fatalf("expected the running topics, got %v", running)
+	}
+}
+
+// A reload reads every file it names, and opens the log, before
+// it applies anything; one that cannot be leaves it all as it was
+func Test_AGateway_reload_all_or_nothing(t *testing.T) {
+	dir := t.TempDir()
+	allow := filepath.Join(dir, "clients.allow")
+	os.WriteFile(allow, []byte("sensor-*\n"), 0644)
+	os.WriteFile(allow+".new", []byte("rogue\n"), 0644)
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("mqtt-broker tcp://b:1883\nclient-allow-file " + allow); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	if err := ag.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	for _, bad := range []string{
+		"acl-file " + filepath.Join(dir, "missing.acl"),
+		"log-destination " + filepath.Join(dir, "missing", "gateway.log"),
+	} {
+		reloaded := &GatewayConfig{}
+		if err := reloaded.parseConfig("mqtt-broker tcp://b:1883\nsource-rate-limit 10\nclient-allow-file " + allow + ".new\n" + bad); err != nil {
+			t.Fatalf("parseConfig: %v", err)
+		}
+		if err := ag.ReloadConfig(reloaded); err == nil {
+			t.Fatalf("%s: expected the reload refused", bad)
+		}
+		if a := ag.allowed.Load(); !a.allows("sensor-1") || a.allows("rogue") {
+			t.Fatalf("%s: expected the allowlist kept", bad)
+		}
+		if running := ag.config.Load(); running.clientallowfile != allow || running.sourcerate != 0 || ag.sources.Load() != nil {
+			t.Fatalf("%s: expected the configuration kept, got %+v", bad, running)
+		}
+	}
+}
+
+// The log is opened again where a reload has it, its lines in
+// the format it has; the format alone changes only that
+func Test_AGateway_reload_log(t *testing.T) {
+	// the loggers are changed in place, as a reload does
+	discard := [4]io.Writer{ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard}
+	defer setLogOutput(&logOutput{writers: discard}, &GatewayConfig{})
+	path := filepath.Join(t.TempDir(), "gateway.log")
+	ag := NewAGateway(&GatewayConfig{mqttbroker: "tcp://b:1883"})
+	for _, c := range []struct {
+		config, line, prefix, expected string
+	}{
+		{"log-destination " + path + "\nlog-format json", "json", "{", `"msg":"json"`},
+		{"log-destination " + path, "text", "INFO:  ", " text"},
+	} {
+		reloaded := &GatewayConfig{}
+		if err := reloaded.parseConfig("mqtt-broker tcp://b:1883\n" + c.config); err != nil {
+			t.Fatalf("parseConfig: %v", err)
+		}
+		if err := ag.ReloadConfig(reloaded); err != nil {
+			t.Fatalf("ReloadConfig: %v", err)
+		}
+		INFO.Log(c.line, coreLog)
+		lines := strings.Split(strings.TrimSpace(string(readFile(t, path))), "\n")
+		if last := lines[len(lines)-1]; !strings.HasPrefix(last, c.prefix) || !strings.Contains(last, c.expected) {
+			t.Fatalf("expected %s logged to the file, got %q", c.expected, last)
+		}
+	}
+}
+
+// Reloads while clients, the admin API and the health checks are
+// served, for -race to find what is read as it changes
+func Test_AGateway_reload_while_serving(t *testing.T) {
+	defer setLogOutput(nil, &GatewayConfig{})
+	allow := filepath.Join(t.TempDir(), "clients.allow")
+	os.WriteFile(allow, []byte("*\n"), 0644)
+	var configs [2]*GatewayConfig
+	for i, options := range []string{"source-rate-limit 1000\nlog-format json", "unconnected-packet-rate 1000\nadmin-ready-broker false"} {
+		configs[i] = &GatewayConfig{}
+		if err := configs[i].parseConfig("bind-address 127.0.0.1\nadmin-address 127.0.0.1:0\nclient-allow-file " + allow + "\n" + options); err != nil {
+			t.Fatalf("parseConfig: %v", err)
+		}
+	}
+	ag := NewAGateway(configs[1])
+	ag.mqttclient = &fakeBroker{}
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+	url := "http://" + ag.admin.Addr().String()
+
+	// each served over and over until the reloads are done, which
+	// go on until each has been a few times
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var served []*int32
+	serve := func(f func()) {
+		n := new(int32)
+		served = append(served, n)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					f()
+					atomic.AddInt32(n, 1)
+				}
+			}
+		}()
+	}
+	// a connection left unused would hold up the admin listener's
+	// stopping
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+	defer wg.Wait()
+	defer close(done)
+	c := dialUDP(t, ag)
+	defer c.Close()
+	buf := make([]byte, 64)
+	serve(func() {
+		c.Write(packet(NewMessage(PINGREQ)))
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		c.Read(buf)
+	})
+	request := func(method, path string) func() {
+		return func() {
+			req, _ := http.NewRequest(method, url+path, nil)
+			if resp, err := client.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}
+	serve(request(http.MethodGet, readyzPath))
+	serve(request(http.MethodGet, "/clients"))
+	serve(request(http.MethodPost, "/debug/capture?enable=true"))
+	serve(request(http.MethodPost, "/debug/trace?client=c&enable=false"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; ; i++ {
+		if err := ag.ReloadConfig(configs[i%2]); err != nil {
+			t.Fatalf("ReloadConfig: %v", err)
+		}
+		least := atomic.LoadInt32(served[0])
+		for _, n := range served[1:] {
+			if v := atomic.LoadInt32(n); v < least {
+				least = v
+			}
+		}
+		if least >= 20 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,154 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_config_routes(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("upstream-broker cloud=tcps://cloud:8883/?a=b\nupstream-route telemetry/=cloud\nupstream-route telemetry/local/=default"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if len(gc.upstreams) != 1 || gc.upstreams[0] != (upstreamConfig{"cloud", "tcps://cloud:8883/?a=b"}) {
+		t.Fatalf("upstreams %v", gc.upstreams)
+	}
+	if len(gc.routes) != 2 || gc.routes[0] != (routeConfig{"telemetry/", "cloud"}) || gc.routes[1] != (routeConfig{"telemetry/local/", "default"}) {
+		t.Fatalf("routes %v", gc.routes)
+	}
+	for _, bad := range []string{"cloud=tcp://other:1883", "default=tcp://b:1883", "=tcp://b:1883", "edge=", "edge"} {
+		if err := gc.parseConfig("upstream-broker " + bad); err != ErrInvalidUpstream {
+			t.Errorf("%q: expected %v, got %v", bad, ErrInvalidUpstream, err)
+		}
+	}
+	for _, bad := range []string{"diag/=local", "=cloud", "diag/"} {
+		if err := gc.parseConfig("upstream-route " + bad); err != ErrInvalidRoute {
+			t.Errorf("%q: expected %v, got %v", bad, ErrInvalidRoute, err)
+		}
+	}
+}
+
+func Test_routing(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("upstream-broker cloud=tcp://cloud:1883\nupstream-broker local=tcp://local:1883\nupstream-route telemetry/=cloud\nupstream-route telemetry/local/=default\nupstream-route diag/=local"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	own, cloud, local := ag.upstream, ag.routing.upstreams[0], ag.routing.upstreams[1]
+	if cloud.name != "cloud" || local.name != "local" || cloud.client == nil || cloud.file != "" {
+		t.Fatalf("expected the named brokers, got %v and %v", cloud, local)
+	}
+	for topic, expected := range map[string]*upstream{
+		"telemetry/a":       cloud,
+		"telemetry/local/a": own,
+		"diag/a":            local,
+		"diagnostics":       own,
+		"other":             own,
+	} {
+		if u := ag.upstreamOf(topic); u != expected {
+			t.Errorf("%s: expected %v, got %v", topic, expected, u)
+		}
+	}
+	for filter, expected := range map[string][]*upstream{
+		"telemetry/#":       {cloud, own},
+		"telemetry/local/#": {own},
+		"telemetry/+/a":     {cloud, own},
+		"diag/+/a":          {local},
+		"other/#":           {own},
+		"#":                 {own, cloud, local},
+		"+/a":               {own, cloud, local},
+		"telemetry/a":       {cloud},
+	} {
+		us := ag.upstreamsOf(filter)
+		ok := len(us) == len(expected)
+		for i := 0; ok && i < len(us); i++ {
+			ok = us[i] == expected[i]
+		}
+		if !ok {
+			t.Errorf("%s: expected %v, got %v", filter, expected, us)
+		}
+	}
+}
+
+// Each topic is published to the broker it is routed to, filters
+// are subscribed to on every broker the topics they match may be
+// published to, and one broker being lost leaves the others be
+func Test_AGateway_routing(t *testing.T) {
+	defer func(i, max time.Duration) {
+		reconnectInterval, maxReconnectInterval = i, max
+	}(reconnectInterval, maxReconnectInterval)
+	reconnectInterval, maxReconnectInterval = 10*time.Millisecond, 10*time.Millisecond
+
+	gc := &GatewayConfig{bindaddress: "127.0.0.1"}
+	if err := gc.parseConfig("upstream-broker cloud=tcp://cloud:1883\nupstream-route telemetry/=cloud\nbroker-offline-queue 4\nbroker-offline-ack-early true"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	own, cloud := &fakeBroker{}, &fakeBroker{}
+	u := ag.routing.upstreams[0]
+	own.lost = func(c *MQTT.Client, err error) { ag.brokerLost(err) }
+	cloud.lost = func(c *MQTT.Client, err error) { ag.upstreamLost(u, err) }
+	ag.mqttclient, u.client = own, cloud
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+	if !own.connected || !cloud.connected {
+		t.Fatalf("expected both brokers connected")
+	}
+
+	f := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("c", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+	f.expect(CONNACK)
+	client := ag.clients.GetClient(f.addr())
+	ag.handle_SUBSCRIBE(subscribeMessage("#", 1, 0), client)
+	f.expect(SUBACK)
+	if own.subscriptions["#"] == nil || cloud.subscriptions["#"] == nil {
+		t.Fatalf("expected # subscribed to on both brokers, have %v and %v", own.subscriptions, cloud.subscriptions)
+	}
+	topicids := make(map[string]uint16)
+	for i, topic := range []string{"telemetry/a", "diag/b"} {
+		ag.handle_REGISTER(NewRegisterMessage(0, uint16(i+1), []byte(topic)), client)
+		topicids[topic] = f.expect(REGACK).(*RegackMessage).TopicId
+		ag.handle_PUBLISH(NewPublishMessage(topicids[topic], 0, []byte{byte(i)}, 1, uint16(10+i), false, false), client)
+		f.expect(PUBACK)
+	}
+	if len(cloud.published) != 1 || cloud.published[0].topic != "telemetry/a" || len(own.published) != 1 || own.published[0].topic != "diag/b" {
+		t.Fatalf("expected each topic published to its broker, got %v and %v", cloud.published, own.published)
+	}
+	cloud.deliver("#", &fakeMessage{"telemetry/a", []byte{7}, 0})
+	if pm := f.expect(PUBLISH).(*PublishMessage); pm.Data[0] != 7 {
+		t.Fatalf("expected the message from the cloud broker, got %v", pm.Data)
+	}
+
+	cloud.subscriptions = nil
+	cloud.refusals = 2
+	cloud.drop(ErrBrokerTimeout)
+	if !ag.Degraded() || !ag.BrokerConnected() {
+		t.Fatalf("expected only the cloud broker down")
+	}
+	ag.handle_PUBLISH(NewPublishMessage(topicids["diag/b"], 0, []byte{2}, 1, 12, false, false), client)
+	f.expect(PUBACK)
+	ag.handle_PUBLISH(NewPublishMessage(topicids["telemetry/a"], 0, []byte{3}, 1, 13, false, false), client)
+	f.expect(PUBACK)
+	if len(own.published) != 2 || ag.OfflineQueueDepth() != 1 {
+		t.Fatalf("expected the cloud's message held and the other published, got %v, %d held", own.published, ag.OfflineQueueDepth())
+	}
+	for deadline := time.Now().Add(time.Second); ag.BrokerStates()[1].State != BrokerConnected; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the cloud broker reconnected")
+		}
+	}
+	if len(cloud.published) != 2 || cloud.published[1].payload[0] != 3 || cloud.subscriptions["#"] == nil {
+		t.Fatalf("expected the held message published and # subscribed to again, got %v and %v", cloud.published, cloud.subscriptions)
+	}
+	states := ag.BrokerStates()
+	if ag.Degraded() || len(states) != 2 || states[1].Upstream != "cloud" || states[1].State != BrokerConnected || states[1].LastError != ErrBrokerTimeout {
+		t.Fatalf("states %+v", states)
+	}
+}
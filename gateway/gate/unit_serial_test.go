@@ -0,0 +1,121 @@
+//go:build linux
+// +build linux
+
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// A pseudo-terminal standing in for a radio bridge: the gateway
+// opens the returned device, the test talks on the master
+func openPty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %v", err)
+	}
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		t.Skipf("cannot unlock pseudo-terminal: %v", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		t.Skipf("no pseudo-terminal number: %v", err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+// Relay m for the node with id and wait for the reply, trying
+// again until the gateway is listening on the line
+func ptyExchange(t *testing.T, master *os.File, id byte, m Message, msgType byte) Message {
+	var buf bytes.Buffer
+	NewEncapsulatedMessage([]byte{id}, 0, m).Write(&buf)
+	frames := make(chan *EncapsulatedMessage, 1)
+	go func() {
+		r := bufio.NewReader(master)
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+			frame, err := ReadFrame(r)
+			if err != nil {
+				// until the gateway has the other end open
+				time.Sleep(10 * time.Millisecond)
+				r.Reset(master)
+				continue
+			}
+			if e, err := ReadPacket(bytes.NewBuffer(frame)); err == nil {
+				if e, ok := e.(*EncapsulatedMessage); ok {
+					frames <- e
+					return
+				}
+			}
+		}
+	}()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		master.Write(buf.Bytes())
+		select {
+		case e := <-frames:
+			if e.WirelessNodeId[0] != id || e.Message == nil || e.Message.MessageType() != msgType {
+				t.Fatalf("expected %s for node %d, got %+v", MessageNames[msgType], id, e)
+			}
+			return e.Message
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	t.Fatalf("no %s for node %d", MessageNames[msgType], id)
+	return nil
+}
+
+// Nodes behind a radio bridge on a serial port are clients of
+// their own, and the port is reopened when it comes back
+func Test_serial(t *testing.T) {
+	link := filepath.Join(t.TempDir(), "ttyUSB0")
+	master, pts := openPty(t)
+	if err := os.Symlink(pts, link); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1", serialdevice: link})
+	ag.mqttclient = &fakeBroker{}
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+	ag.transports.serial.conns[0].(*serialTransport).retry = 20 * time.Millisecond
+
+	for _, id := range []byte{1, 2} {
+		ca := ptyExchange(t, master, id, connectMessage(fmt.Sprintf("node-%d", id), false), CONNACK)
+		if ca.(*ConnackMessage).ReturnCode != ACCEPTED {
+			t.Fatalf("CONNECT of node %d: rc %d", id, ca.(*ConnackMessage).ReturnCode)
+		}
+	}
+	if ag.clients.Len() != 2 {
+		t.Fatalf("expected 2 clients, have %d", ag.clients.Len())
+	}
+
+	// unplugged, and plugged in again as another device
+	master.Close()
+	master, pts = openPty(t)
+	defer master.Close()
+	os.Remove(link)
+	if err := os.Symlink(pts, link); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	ptyExchange(t, master, 2, NewMessage(PINGREQ), PINGRESP)
+}
+
+func Test_serial_bad_baud(t *testing.T) {
+	_, pts := openPty(t)
+	if _, err := openSerialTransport(pts, 12345); err == nil {
+		t.Fatalf("opened a serial port at 12345 baud")
+	}
+}
@@ -0,0 +1,104 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	"github.com/eclipse/paho.golang/paho"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_config_sharing(t *testing.T) {
+	gc := &GatewayConfig{}
+	if gc.sharing() != nil {
+		t.Fatalf("shared subscriptions by default")
+	}
+	if err := gc.parseConfig("upstream-share-group gateways\nupstream-share-topic sensors/\nupstream-share-topic alarms"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	s := gc.sharing()
+	for filter, expected := range map[string]bool{
+		"sensors/#":   true,
+		"alarms/+/a":  true,
+		"config/#":    false,
+		"$SYS/#":      false,
+		"sensors2/+":  false,
+		"alarmsystem": true,
+	} {
+		if shared := s.shares(filter); shared != expected {
+			t.Errorf("%s: expected shared %v, got %v", filter, expected, shared)
+		}
+	}
+	if s := (&sharing{"g", nil}); !s.shares("#") || s.shares("$SYS/#") {
+		t.Fatalf("expected every filter shared but the broker's own")
+	}
+	for _, bad := range []string{"a/b", "a+", "#"} {
+		if err := gc.parseConfig("upstream-share-group " + bad); err != ErrInvalidShareGroup {
+			t.Errorf("%q: expected %v, got %v", bad, ErrInvalidShareGroup, err)
+		}
+	}
+
+	for filter, expected := range map[string]string{"$share/g/a/#": "a/#", "a/#": "a/#", "$share/g": "$share/g", "$SYS/a": "$SYS/a"} {
+		if f := unshared(filter); f != expected {
+			t.Errorf("%s: expected %s unshared, got %s", filter, expected, f)
+		}
+	}
+}
+
+// Shared filters are subscribed to in the group, under the topic
+// prefix, and unsubscribed from the same way, while clients
+// subscribe to them as ever
+func Test_AGateway_shared_subscriptions(t *testing.T) {
+	gc := &GatewayConfig{bindaddress: "127.0.0.1"}
+	if err := gc.parseConfig("topic-prefix site42\nupstream-share-group gw\nupstream-share-topic sensors/\nmqtt-clean-session false"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	broker := &fakeBroker{}
+	ag.mqttclient = broker
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	f := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("c", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+	f.expect(CONNACK)
+	client := ag.clients.GetClient(f.addr())
+	for i, filter := range []string{"sensors/#", "config/#"} {
+		ag.handle_SUBSCRIBE(subscribeMessage(filter, uint16(i+1), 0), client)
+		f.expect(SUBACK)
+	}
+	if len(broker.subscriptions) != 2 || broker.subscriptions["$share/gw/site42/sensors/#"] == nil || broker.subscriptions["site42/config/#"] == nil {
+		t.Fatalf("subscribed to %v", broker.subscriptions)
+	}
+	if filters := ag.tTree.Filters(); len(filters) != 2 || filters[0] != "config/#" || filters[1] != "sensors/#" {
+		t.Fatalf("expected the clients' filters in the topic tree, got %v", filters)
+	}
+	broker.deliver("$share/gw/site42/sensors/#", &fakeMessage{"site42/sensors/a", []byte{1}, 0})
+	if rm := f.expect(REGISTER).(*RegisterMessage); string(rm.TopicName) != "sensors/a" {
+		t.Fatalf("expected REGISTER for sensors/a, got %q", rm.TopicName)
+	}
+
+	if err := ag.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if len(broker.subscriptions) != 0 {
+		t.Fatalf("expected to have unsubscribed, have %v", broker.subscriptions)
+	}
+}
+
+// The MQTT v5 client delivers the messages of a shared
+// subscription to its handler
+func Test_mqtt5_shared_deliver(t *testing.T) {
+	var got string
+	c := newMQTT5Client(mqtt5Options{mqtt5Config: &mqtt5Config{}})
+	c.setHandler("$share/g/a/+", func(c *MQTT.Client, m MQTT.Message) {
+		got = m.Topic()
+	})
+	c.deliver(&paho.Publish{Topic: "a/b"})
+	if got != "a/b" {
+		t.Fatalf("delivered %q", got)
+	}
+}
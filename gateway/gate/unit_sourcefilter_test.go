@@ -0,0 +1,104 @@
+package gateway
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_sourceFilter(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("source-allow 10.20.0.0/16,10.21.0.5,2001:db8:20::/48\nsource-deny 10.20.99.0/24\nsource-deny 2001:db8:20:bad::/64"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	f := newSourceFilter(gc)
+	for ip, allowed := range map[string]bool{
+		"10.20.1.1":          true,
+		"10.20.99.1":         false,
+		"10.21.0.5":          true,
+		"10.21.0.6":          false,
+		"192.0.2.1":          false,
+		"::ffff:10.20.1.1":   true,
+		"2001:db8:20::1":     true,
+		"2001:db8:20:bad::1": false,
+		"2001:db8:21::1":     false,
+		"2001:db8:20:bae::1": true,
+	} {
+		if f.allows(udpAddr(ip, 1884)) != allowed {
+			t.Errorf("expected %s allowed %v", ip, allowed)
+		}
+	}
+	if !f.allows(uAddr{serialAddr("/dev/ttyUSB0")}) {
+		t.Errorf("expected an address without an IP allowed")
+	}
+
+	hits := make(map[string]uint64)
+	for _, h := range f.hits() {
+		hits[h.Rule+" "+h.Network] = h.Hits
+	}
+	expected := map[string]uint64{
+		"deny 10.20.99.0/24":        1,
+		"deny 2001:db8:20:bad::/64": 1,
+		"allow 10.20.0.0/16":        2,
+		"allow 10.21.0.5/32":        1,
+		"allow 2001:db8:20::/48":    2,
+		"not-allowed ":              3,
+	}
+	if len(hits) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, hits)
+	}
+	for rule, n := range expected {
+		if hits[rule] != n {
+			t.Errorf("expected %s to have matched %d, got %d", rule, n, hits[rule])
+		}
+	}
+	if f.droppedCount() != 5 {
+		t.Fatalf("expected 5 dropped, got %d", f.droppedCount())
+	}
+	if newSourceFilter(&GatewayConfig{}) != nil {
+		t.Fatalf("expected no filter unless configured")
+	}
+}
+
+// Only a denied source's packets are dropped when nothing is
+// allowed, and one in every source-deny-log is logged
+func Test_listener_source_filter(t *testing.T) {
+	var out strings.Builder
+	InitLogger(&out, &out)
+	defer InitLogger(ioutil.Discard, ioutil.Discard)
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("source-deny 127.0.0.1\nsource-deny-log 2"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	conn, other := newMemConn(10), newMemConn(10)
+	other.addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 2000}
+	l := newListener(ag, defaultMaxMessageSize, conn, other)
+
+	for i := 0; i < 3; i++ {
+		conn.in <- packet(NewMessage(PINGREQ))
+	}
+	other.in <- packet(NewMessage(PINGREQ))
+	select {
+	case <-other.replies:
+	case <-time.After(time.Second):
+		t.Fatalf("another source was not answered")
+	}
+	select {
+	case <-conn.replies:
+		t.Fatalf("a packet from a denied source was answered")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.stop(context.Background())
+	if n := ag.filter.Load().droppedCount(); n != 3 {
+		t.Fatalf("expected 3 dropped, got %d", n)
+	}
+	if n := strings.Count(out.String(), "source denied by 127.0.0.1/32, packet dropped"); n != 2 {
+		t.Fatalf("expected the 1st and 3rd logged, got %q", out.String())
+	}
+}
@@ -0,0 +1,110 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func udpAddr(ip string, port int) uAddr {
+	return uAddr{&net.UDPAddr{IP: net.ParseIP(ip), Port: port}}
+}
+
+// Packets over a source's limit are dropped at the listener,
+// before they reach the gateway, other sources being served
+func Test_listener_source_limit(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("source-rate-limit 1\nsource-rate-burst 2"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	ag := NewAGateway(gc)
+	conn, other := newMemConn(10), newMemConn(10)
+	other.addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2000}
+	l := newListener(ag, defaultMaxMessageSize, conn, other)
+	defer l.stop(context.Background())
+
+	for i := 0; i < 5; i++ {
+		conn.in <- packet(NewMessage(PINGREQ))
+	}
+	other.in <- packet(NewMessage(PINGREQ))
+	select {
+	case <-other.replies:
+	case <-time.After(time.Second):
+		t.Fatalf("another source was not answered")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-conn.replies:
+		case <-time.After(time.Second):
+			t.Fatalf("expected 2 PINGRESPs, got %d", i)
+		}
+	}
+	select {
+	case <-conn.replies:
+		t.Fatalf("a packet over the limit was answered")
+	case <-time.After(50 * time.Millisecond):
+	}
+	dropped := ag.RateLimitedSources()
+	if len(dropped) != 1 || dropped["127.0.0.1:1884"] != 3 {
+		t.Fatalf("expected 3 packets dropped from 127.0.0.1:1884, got %v", dropped)
+	}
+}
+
+func Test_sourceLimiter(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("source-rate-limit 10\nsource-rate-burst 1\nsource-rate-addresses 2\nsource-rate-exempt 10.0.0.0/8,::1"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	s := newSourceLimiter(gc)
+	now := time.Now()
+	a, b, c := udpAddr("192.168.0.1", 1), udpAddr("192.168.0.2", 1), udpAddr("192.168.0.3", 1)
+	if !s.allow(a, now) || s.allow(a, now.Add(50*time.Millisecond)) {
+		t.Fatalf("burst exceeded")
+	}
+	if !s.allow(a, now.Add(150*time.Millisecond)) {
+		t.Fatalf("packet refused after the bucket refilled")
+	}
+
+	// a third address pushes out the one heard from longest ago
+	s.allow(b, now)
+	s.allow(c, now)
+	if s.recent.Len() != 2 || s.sources[a.String()] != nil {
+		t.Fatalf("tracking %d addresses, %s among them: %v", s.recent.Len(), a, s.sources[a.String()] != nil)
+	}
+	if !s.allow(a, now.Add(150*time.Millisecond)) {
+		t.Fatalf("a forgotten address starts with a full bucket")
+	}
+
+	for i := 0; i < 10; i++ {
+		for _, e := range []uAddr{udpAddr("10.1.2.3", i), udpAddr("::1", i)} {
+			if !s.allow(e, now) {
+				t.Fatalf("exempt address %v limited", e)
+			}
+		}
+	}
+	if s.sources["[::1]:0"] != nil {
+		t.Fatalf("exempt address tracked")
+	}
+}
+
+func Test_config_source_rate_exempt(t *testing.T) {
+	gc := &GatewayConfig{}
+	if newSourceLimiter(gc) != nil {
+		t.Fatalf("limited by default")
+	}
+	for _, bad := range []string{"10.0.0.0/33", "host", "10.0.0.1,"} {
+		if err := gc.parseConfig("source-rate-exempt " + bad); err != ErrInvalidNetwork {
+			t.Errorf("%s: expected %v, got %v", bad, ErrInvalidNetwork, err)
+		}
+	}
+	if err := gc.parseConfig("source-rate-exempt 10.0.0.1\nsource-rate-exempt fd00::/8"); err != nil || len(gc.sourceexempt) != 2 {
+		t.Fatalf("exempt %v, %v", gc.sourceexempt, err)
+	}
+	if fmt.Sprint(gc.sourceexempt) != "[10.0.0.1/32 fd00::/8]" {
+		t.Fatalf("exempt %v", gc.sourceexempt)
+	}
+}
@@ -0,0 +1,127 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package gateway
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A remote syslog daemon over tcp, passing on the lines it
+// receives
+type fakeSyslog struct {
+	sync.Mutex
+	l     net.Listener
+	conns []net.Conn
+	lines chan string
+}
+
+func newFakeSyslog(t *testing.T, addr string) *fakeSyslog {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := &fakeSyslog{l: l, lines: make(chan string, 1000)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.Lock()
+			s.conns = append(s.conns, c)
+			s.Unlock()
+			go func() {
+				scanner := bufio.NewScanner(c)
+				for scanner.Scan() {
+					s.lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *fakeSyslog) close() {
+	s.l.Close()
+	s.Lock()
+	defer s.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *fakeSyslog) expect(t *testing.T) string {
+	select {
+	case line := <-s.lines:
+		return line
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected a line")
+		return ""
+	}
+}
+
+// Each level is sent at its severity, of the daemon facility,
+// tagged as configured
+func Test_syslog_severities(t *testing.T) {
+	s := newFakeSyslog(t, "127.0.0.1:0")
+	defer s.close()
+	writers, closer, err := openSyslog("tcp://"+s.l.Addr().String(), "sensor-gw")
+	if err != nil {
+		t.Fatalf("openSyslog: %v", err)
+	}
+	defer closer.Close()
+
+	// daemon (3) << 3 | err (3), warning (4), info (6), debug (7)
+	for i, pri := range []int{27, 28, 30, 31} {
+		level := logLevels[i]
+		fmt.Fprintf(writers[i], "a line at %s\n", level)
+		line := s.expect(t)
+		priority := fmt.Sprintf("<%d>", pri)
+		if !strings.HasPrefix(line, priority) || !strings.Contains(line, " sensor-gw[") || !strings.HasSuffix(line, "a line at "+level) {
+			t.Fatalf("expected a %s line at %s tagged sensor-gw, got %q", level, priority, line)
+		}
+	}
+}
+
+// While the daemon cannot be reached, lines are held and tried
+// again, those beyond the buffer dropped and counted, without
+// logging waiting; once it is back they reach it
+func Test_syslog_reconnect(t *testing.T) {
+	s := newFakeSyslog(t, "127.0.0.1:0")
+	addr := s.l.Addr().String()
+	writers, closer, err := openSyslog("tcp://"+addr, "gnatt")
+	if err != nil {
+		t.Fatalf("openSyslog: %v", err)
+	}
+	defer closer.Close()
+	fmt.Fprintln(writers[2], "before")
+	if line := s.expect(t); !strings.HasSuffix(line, "before") {
+		t.Fatalf("expected before, got %q", line)
+	}
+
+	s.close()
+	dropped := LogDropped()
+	start := time.Now()
+	for i := 0; i < syslogBuffer+100; i++ {
+		fmt.Fprintf(writers[0], "held %d\n", i)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("expected logging not to wait on syslog")
+	}
+	if LogDropped() == dropped {
+		t.Fatalf("expected lines beyond the buffer dropped")
+	}
+
+	s = newFakeSyslog(t, addr)
+	defer s.close()
+	if line := s.expect(t); !strings.Contains(line, "held ") {
+		t.Fatalf("expected a held line once reconnected, got %q", line)
+	}
+}
@@ -0,0 +1,84 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_config_sys(t *testing.T) {
+	gc := &GatewayConfig{}
+	if gc.sysPrefix() != "$SYS/gateway" {
+		t.Fatalf("expected the default prefix $SYS/gateway, got %q", gc.sysPrefix())
+	}
+	if err := gc.parseConfig("sys-interval 10s\nsys-prefix site/stats/"); err != nil || gc.sysinterval != 10*time.Second || gc.sysPrefix() != "site/stats" {
+		t.Fatalf("expected every 10s under site/stats, got %v under %q, %v", gc.sysinterval, gc.sysPrefix(), err)
+	}
+	for _, bad := range []string{"$SYS/+", "stats/#", "/"} {
+		if err := gc.parseConfig("sys-prefix " + bad); err != ErrInvalidSysPrefix {
+			t.Errorf("%q: expected %v, got %v", bad, ErrInvalidSysPrefix, err)
+		}
+	}
+}
+
+// The statistics reach the clients subscribed to them, and
+// neither their subscriptions nor their PUBLISHes reach the
+// broker
+func Test_AGateway_sys_topics(t *testing.T) {
+	f, g := newFakeClient(t), newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	other := NewClient("g", client.Conn, g.addr())
+	ag.clients.AddClient(other)
+	ag.sys.interval = 20 * time.Millisecond
+	ag.handle_REGISTER(registerMessage("$SYS/gateway/clients", 1), client)
+	f.expect(REGACK)
+	subscribe(ag, client, "$SYS/gateway/clients", 0)
+	subscribe(ag, other, "#", 0)
+
+	if us := ag.upstreamsOf("$SYS/gateway/#"); len(us) != 0 {
+		t.Fatalf("expected the gateway's own topics published to no broker, got %v", us)
+	}
+	if us := ag.upstreamsOf("$SYS/#"); len(us) != 1 {
+		t.Fatalf("expected the broker's $SYS subscribed to, got %v", us)
+	}
+
+	ag.sys.start(ag.sysStats(), ag.deliver)
+	defer ag.sys.stop()
+	if pm := f.expect(PUBLISH).(*PublishMessage); pm.TopicId != 1 || string(pm.Data) != "2" {
+		t.Fatalf("expected 2 clients on topic 1, got %+v", pm)
+	}
+	// # does not match the topics beginning with $
+	g.expectNothing()
+
+	ag.handle_PUBLISH(NewPublishMessage(1, 0, []byte("0"), 1, 2, false, false), client)
+	for {
+		m := f.receive(time.Second)
+		if m == nil {
+			t.Fatalf("expected a PUBACK")
+		}
+		if pa, ok := m.(*PubackMessage); ok {
+			if pa.ReturnCode != REJ_NOT_SUPORTED {
+				t.Fatalf("expected the PUBLISH refused, got rc %d", pa.ReturnCode)
+			}
+			break
+		}
+	}
+}
+
+func Test_TGateway_sys_topics(t *testing.T) {
+	tg, c, brokers := newTestTGateway(t)
+	tg.sys.interval = 20 * time.Millisecond
+	f := newFakeClient(t)
+	fc := tconnect(t, tg, c, f, "f")
+	tg.handle_SUBSCRIBE(subscribeMessage("$SYS/gateway/broker/connections", 0, 0), fc)
+	if sa := f.expect(SUBACK).(*SubackMessage); sa.ReturnCode != ACCEPTED || (*brokers)[0].subscriptions["$SYS/gateway/broker/connections"] != nil {
+		t.Fatalf("expected the subscription the gateway's alone, got %+v", sa)
+	}
+
+	tg.sys.start(tg.sysStats(), tg.inject)
+	defer tg.sys.stop()
+	if pm := f.expect(PUBLISH).(*PublishMessage); string(pm.Data) != "1" {
+		t.Fatalf("expected 1 broker connection, got %+v", pm)
+	}
+}
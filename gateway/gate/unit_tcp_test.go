@@ -0,0 +1,158 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// A client with a TCP connection to the gateway
+type tcpClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	t    *testing.T
+}
+
+func dialTCP(t *testing.T, addr net.Addr) *tcpClient {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	return &tcpClient{conn, bufio.NewReader(conn), t}
+}
+
+// Send the messages in one write, as a stream may deliver them
+func (c *tcpClient) send(ms ...Message) {
+	var buf bytes.Buffer
+	for _, m := range ms {
+		m.Write(&buf)
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		c.t.Fatalf("Write: %v", err)
+	}
+}
+
+func (c *tcpClient) expect(msgType byte) Message {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	frame, err := ReadFrame(c.r)
+	if err != nil {
+		c.t.Fatalf("expected %s, got %v", MessageNames[msgType], err)
+	}
+	m, err := ReadPacket(bytes.NewBuffer(frame))
+	if err != nil {
+		c.t.Fatalf("ReadPacket: %v", err)
+	}
+	if m.MessageType() != msgType {
+		c.t.Fatalf("expected %s, got %s", MessageNames[msgType], MessageNames[m.MessageType()])
+	}
+	return m
+}
+
+// Clients of either gateway can use TCP, a client being lost
+// when its connection closes, and idle connections are closed
+func Test_TCP(t *testing.T) {
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1"})
+	ag.mqttclient = &fakeBroker{}
+	tg, _, brokers := newTestTGateway(t)
+	tg.address = "127.0.0.1:0"
+
+	for _, g := range []struct {
+		name    string
+		gw      Gateway
+		ts      *transports
+		clients *Clients
+	}{
+		{"aggregating", ag, &ag.transports, &ag.clients},
+		{"transparent", tg, &tg.transports, &tg.clients},
+	} {
+		t.Run(g.name, func(t *testing.T) {
+			g.ts.tcpAddress, g.ts.tcpIdle = "127.0.0.1:0", 200*time.Millisecond
+			if err := g.gw.Start(); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			defer g.gw.Stop(context.Background())
+			tcpaddr := g.ts.tcp.ln.Addr()
+
+			c := dialTCP(t, tcpaddr)
+			c.send(connectMessage("streamer", false), NewMessage(PINGREQ))
+			if ca := c.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != ACCEPTED {
+				t.Fatalf("CONNECT over TCP: rc %d", ca.ReturnCode)
+			}
+			c.expect(PINGRESP)
+			register := NewRegisterMessage(0, 1, bytes.Repeat([]byte("t"), 300))
+			c.send(register)
+			if ra := c.expect(REGACK).(*RegackMessage); ra.ReturnCode != ACCEPTED {
+				t.Fatalf("REGISTER of a long topic: rc %d", ra.ReturnCode)
+			}
+			// larger than the maximum message size, dropped
+			c.send(NewRegisterMessage(0, 2, bytes.Repeat([]byte("t"), 2000)), NewMessage(PINGREQ))
+			c.expect(PINGRESP)
+			if g.clients.GetClient(uAddr{c.conn.LocalAddr()}) == nil || g.clients.GetClient(uAddr{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: c.conn.LocalAddr().(*net.TCPAddr).Port}}) != nil {
+				t.Fatalf("expected the client to be known by its connection")
+			}
+
+			c.conn.Close()
+			deadline := time.Now().Add(time.Second)
+			for (g.clients.Len() != 0 || tg.BrokerConnections() != 0) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if g.clients.Len() != 0 || tg.BrokerConnections() != 0 {
+				t.Fatalf("expected the client to be lost with its connection")
+			}
+
+			idle := dialTCP(t, tcpaddr)
+			idle.conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := idle.r.ReadByte(); err == nil {
+				t.Fatalf("expected an idle connection to be closed")
+			}
+			if cs := g.ts.Connections(); cs.IdleTimeouts == 0 {
+				t.Fatalf("expected the idle connection to be counted, got %+v", cs)
+			}
+		})
+	}
+	if len(*brokers) != 1 {
+		t.Fatalf("expected one broker connection, %d made", len(*brokers))
+	}
+}
+
+// Connections beyond the most that may be open are refused, and
+// closing one makes room for another
+func Test_TCP_max_connections(t *testing.T) {
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1", maxconnections: 1})
+	ag.mqttclient = &fakeBroker{}
+	ag.tcpAddress = "127.0.0.1:0"
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+	tcpaddr := ag.tcp.ln.Addr()
+
+	c := dialTCP(t, tcpaddr)
+	c.send(connectMessage("first", false))
+	c.expect(CONNACK)
+	refused := dialTCP(t, tcpaddr)
+	refused.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := refused.r.ReadByte(); err == nil {
+		t.Fatalf("expected a connection beyond the limit to be closed")
+	}
+	if cs := ag.Connections(); cs.Open != 1 || cs.Refused != 1 {
+		t.Fatalf("expected 1 open and 1 refused, got %+v", cs)
+	}
+
+	c.conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for (ag.clients.Len() != 0 || ag.Connections().Open != 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ag.clients.Len() != 0 || ag.Connections().Open != 0 {
+		t.Fatalf("expected the client to be lost with its connection")
+	}
+	next := dialTCP(t, tcpaddr)
+	next.send(connectMessage("second", false))
+	next.expect(CONNACK)
+}
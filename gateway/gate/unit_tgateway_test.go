@@ -0,0 +1,800 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// A TGateway whose broker connections are fakeBrokers, along
+// with the connection its packets are sent on
+func newTestTGateway(t *testing.T) (*TGateway, uConn, *[]*fakeBroker) {
+	gwconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	tg, _ := NewTGateway(&GatewayConfig{})
+	brokers := &[]*fakeBroker{}
+	tg.newMQTTClient = func(opts *MQTT.ClientOptions) mqttClient {
+		b := &fakeBroker{lost: opts.OnConnectionLost}
+		*brokers = append(*brokers, b)
+		return b
+	}
+	return tg, uConn{gwconn, 0, nil}, brokers
+}
+
+func tconnect(t *testing.T, tg *TGateway, c uConn, f *fakeClient, clientid string) *TClient {
+	tg.handle_CONNECT(connectMessage(clientid, false), c, f.addr())
+	if ca := f.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != ACCEPTED {
+		t.Fatalf("expected rc %d, got %d", ACCEPTED, ca.ReturnCode)
+	}
+	return tg.clients.GetClient(f.addr()).(*TClient)
+}
+
+func Test_TGateway_connection_per_client(t *testing.T) {
+	tg, c, brokers := newTestTGateway(t)
+	f, g := newFakeClient(t), newFakeClient(t)
+	fc := tconnect(t, tg, c, f, "f")
+	gc := tconnect(t, tg, c, g, "g")
+	if len(*brokers) != 2 || fc.mqttClient == gc.mqttClient {
+		t.Fatalf("expected a broker connection per client")
+	}
+	fb, gb := (*brokers)[0], (*brokers)[1]
+
+	tg.handle_SUBSCRIBE(subscribeMessage("a", 1, 0), fc)
+	sa := f.expect(SUBACK).(*SubackMessage)
+	if sa.ReturnCode != ACCEPTED || fb.subscriptions["a"] == nil || gb.subscriptions["a"] != nil {
+		t.Fatalf("subscription not made on the client's own connection")
+	}
+
+	// broker messages reach the subscriber alone
+	fb.deliver("a", &fakeMessage{"a", []byte("hi"), 0})
+	if pm := f.expect(PUBLISH).(*PublishMessage); pm.TopicId != sa.TopicId || string(pm.Data) != "hi" {
+		t.Fatalf("unexpected PUBLISH %d %s", pm.TopicId, pm.Data)
+	}
+	g.expectNothing()
+
+	// and a client's PUBLISH goes over its own connection
+	rm := NewRegisterMessage(0, 2, []byte("b"))
+	tg.handle_REGISTER(rm, gc)
+	ra := g.expect(REGACK).(*RegackMessage)
+	pm := NewPublishMessage(ra.TopicId, 0x00, []byte("up"), 1, 3, false, false)
+	tg.handle_PUBLISH(pm, gc)
+	if pa := g.expect(PUBACK).(*PubackMessage); pa.MessageId != 3 || pa.ReturnCode != ACCEPTED {
+		t.Fatalf("unexpected PUBACK %d rc %d", pa.MessageId, pa.ReturnCode)
+	}
+	if len(gb.published) != 1 || gb.published[0].topic != "b" || len(fb.published) != 0 {
+		t.Fatalf("PUBLISH not made on the client's own connection")
+	}
+
+	um := NewMessage(UNSUBSCRIBE).(*UnsubscribeMessage)
+	um.TopicName = []byte("a")
+	um.MessageId = 4
+	tg.handle_UNSUBSCRIBE(um, fc)
+	if ua := f.expect(UNSUBACK).(*UnsubackMessage); ua.MessageId != 4 {
+		t.Fatalf("unexpected UNSUBACK for %d", ua.MessageId)
+	}
+	if fb.subscriptions["a"] != nil {
+		t.Fatalf("still subscribed on the broker")
+	}
+}
+
+func Test_TGateway_unknown_topic_id(t *testing.T) {
+	tg, c, _ := newTestTGateway(t)
+	f := newFakeClient(t)
+	fc := tconnect(t, tg, c, f, "f")
+
+	tg.handle_PUBLISH(NewPublishMessage(42, 0x00, []byte("up"), 1, 3, false, false), fc)
+	if pa := f.expect(PUBACK).(*PubackMessage); pa.ReturnCode != REJ_INVALID_TID {
+		t.Fatalf("expected rc %d, got %d", REJ_INVALID_TID, pa.ReturnCode)
+	}
+}
+
+func Test_TGateway_teardown(t *testing.T) {
+	tg, c, brokers := newTestTGateway(t)
+	f := newFakeClient(t)
+
+	// SN DISCONNECT closes the broker connection
+	fc := tconnect(t, tg, c, f, "f")
+	tg.handle_DISCONNECT(NewMessage(DISCONNECT).(*DisconnectMessage), fc)
+	f.expect(DISCONNECT)
+	if (*brokers)[0].connected || tg.clients.GetClient(f.addr()) != nil {
+		t.Fatalf("session survived DISCONNECT")
+	}
+
+	// losing the broker connection ends the SN session
+	fc = tconnect(t, tg, c, f, "f")
+	tg.lostMQTT(fc, errors.New("connection reset"))
+	f.expect(DISCONNECT)
+	if tg.clients.GetClient(f.addr()) != nil {
+		t.Fatalf("session survived losing the broker")
+	}
+
+	// and no broker means no session
+	tg.newMQTTClient = func(opts *MQTT.ClientOptions) mqttClient {
+		return &fakeBroker{connectErr: errors.New("connection refused")}
+	}
+	tg.handle_CONNECT(connectMessage("f", false), c, f.addr())
+	if ca := f.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != REJ_CONGESTION {
+		t.Fatalf("expected rc %d, got %d", REJ_CONGESTION, ca.ReturnCode)
+	}
+	if tg.clients.GetClient(f.addr()) != nil {
+		t.Fatalf("client kept without a broker connection")
+	}
+}
+
+func Test_TGateway_will_on_broker_connection(t *testing.T) {
+	tg, c, _ := newTestTGateway(t)
+	var opts *MQTT.ClientOptions
+	tg.newMQTTClient = func(o *MQTT.ClientOptions) mqttClient {
+		opts = o
+		return &fakeBroker{}
+	}
+	f := newFakeClient(t)
+	tg.handle_CONNECT(connectMessage("f", true), c, f.addr())
+	f.expect(WILLTOPICREQ)
+	fc := tg.clients.GetClient(f.addr()).(*TClient)
+
+	wt := NewMessage(WILLTOPIC).(*WillTopicMessage)
+	wt.WillTopic = []byte("f/status")
+	tg.handle_WILLTOPIC(wt, fc)
+	f.expect(WILLMSGREQ)
+	if opts != nil {
+		t.Fatalf("connected to the broker before the will was complete")
+	}
+	wm := NewMessage(WILLMSG).(*WillMsgMessage)
+	wm.WillMsg = []byte("gone")
+	tg.handle_WILLMSG(wm, fc)
+	f.expect(CONNACK)
+	if opts == nil || !opts.WillEnabled || opts.WillTopic != "f/status" || string(opts.WillPayload) != "gone" {
+		t.Fatalf("will not set on the broker connection")
+	}
+}
+
+func Test_mqttClientId(t *testing.T) {
+	long := "abcdefghijklmnopqrstuvw" // 23
+	for _, c := range []struct {
+		prefix, id string
+		max        int
+		overflow   string
+		expected   string
+		err        error
+	}{
+		{"", "sensor1", 0, "", "sensor1", nil},
+		{"sn-", "sensor1", 0, "", "sn-sensor1", nil},
+		{"sn-", long, 0, "", "", ErrClientIDTooLong},
+		{"sn-", long, 0, overflowReject, "", ErrClientIDTooLong},
+		{"sn-", long, 0, overflowTruncate, "sn-abcdefghijklmnopqrst", nil},
+		{"sn-", long, 30, overflowTruncate, "sn-" + long, nil},
+		{"sn-", "abcdefgh", 6, overflowTruncate, "sn-abc", nil},
+	} {
+		id, err := mqttClientId(c.prefix, c.id, c.max, c.overflow)
+		if id != c.expected || err != c.err {
+			t.Errorf("%q %q %d %q: expected %q %v, got %q %v", c.prefix, c.id, c.max, c.overflow, c.expected, c.err, id, err)
+		}
+	}
+
+	// hashing keeps ids that share a long prefix apart
+	a, _ := mqttClientId("sn-", long+"1", 0, overflowHash)
+	b, _ := mqttClientId("sn-", long+"2", 0, overflowHash)
+	if len(a) != defaultClientIdMaxLen || len(b) != defaultClientIdMaxLen || a == b || a[:15] != "sn-abcdefghijkl" {
+		t.Errorf("unexpected hashed ids %q %q", a, b)
+	}
+}
+
+func Test_TGateway_client_id_passthrough(t *testing.T) {
+	tg, c, _ := newTestTGateway(t)
+	tg.clientIdPrefix = "sn-"
+	var opts *MQTT.ClientOptions
+	broker := &fakeBroker{}
+	tg.newMQTTClient = func(o *MQTT.ClientOptions) mqttClient {
+		opts = o
+		return broker
+	}
+	f := newFakeClient(t)
+	tconnect(t, tg, c, f, "sensor1")
+	if opts.ClientID != "sn-sensor1" {
+		t.Fatalf("expected MQTT client id %q, got %q", "sn-sensor1", opts.ClientID)
+	}
+
+	// identifier rejected
+	broker.connectErr, broker.connectRc = errors.New("identifier rejected"), 0x02
+	g := newFakeClient(t)
+	tg.handle_CONNECT(connectMessage("sensor1", false), c, g.addr())
+	if ca := g.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("expected rc %d, got %d", REJ_NOT_SUPORTED, ca.ReturnCode)
+	}
+
+	// too long once prefixed
+	tg.handle_CONNECT(connectMessage("abcdefghijklmnopqrstuvw", false), c, g.addr())
+	if ca := g.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("expected rc %d, got %d", REJ_NOT_SUPORTED, ca.ReturnCode)
+	}
+}
+
+func Test_TGateway_persistent_session(t *testing.T) {
+	tg, c, _ := newTestTGateway(t)
+	var opts *MQTT.ClientOptions
+	tg.newMQTTClient = func(o *MQTT.ClientOptions) mqttClient {
+		opts = o
+		return &fakeBroker{}
+	}
+	f := newFakeClient(t)
+	cm := connectMessage("f", false)
+	cm.CleanSession = false
+	tg.handle_CONNECT(cm, c, f.addr())
+	f.expect(CONNACK)
+	if opts.CleanSession {
+		t.Fatalf("broker session is clean")
+	}
+	fc := tg.clients.GetClient(f.addr()).(*TClient)
+	tg.handle_SUBSCRIBE(subscribeMessage("a", 1, 0), fc)
+	a := f.expect(SUBACK).(*SubackMessage).TopicId
+	tg.handle_SUBSCRIBE(subscribeMessage("b/#", 2, 0), fc)
+	f.expect(SUBACK)
+	tg.handle_DISCONNECT(NewMessage(DISCONNECT).(*DisconnectMessage), fc)
+	f.expect(DISCONNECT)
+
+	// back from another address
+	g := newFakeClient(t)
+	tg.handle_CONNECT(cm, c, g.addr())
+	g.expect(CONNACK)
+	gc := tg.clients.GetClient(g.addr()).(*TClient)
+	if !gc.Subscribed("a") || !gc.Subscribed("b/#") {
+		t.Fatalf("subscriptions not resumed")
+	}
+
+	// what the broker queued meanwhile
+	opts.DefaultPublishHander(nil, &fakeMessage{"a", []byte{1}, 0})
+	if pm := g.expect(PUBLISH).(*PublishMessage); pm.TopicId != a {
+		t.Fatalf("expected topic id %d, got %d", a, pm.TopicId)
+	}
+	opts.DefaultPublishHander(nil, &fakeMessage{"b/1", []byte{2}, 0})
+	rm := g.expect(REGISTER).(*RegisterMessage)
+	tg.handle_REGACK(regack(rm), gc)
+	if pm := g.expect(PUBLISH).(*PublishMessage); pm.Data[0] != 2 {
+		t.Fatalf("expected message 2, got %d", pm.Data[0])
+	}
+
+	// the topic id registered before is still good for publishing
+	tg.handle_PUBLISH(NewPublishMessage(a, 0x00, []byte("up"), 1, 3, false, false), gc)
+	if pa := g.expect(PUBACK).(*PubackMessage); pa.ReturnCode != ACCEPTED {
+		t.Fatalf("expected rc %d, got %d", ACCEPTED, pa.ReturnCode)
+	}
+
+	// a clean session forgets it all
+	tg.handle_DISCONNECT(NewMessage(DISCONNECT).(*DisconnectMessage), gc)
+	g.expect(DISCONNECT)
+	gc = tconnect(t, tg, c, g, "f")
+	if gc.Subscribed("a") || gc.Registered(a) {
+		t.Fatalf("clean session resumed the old one")
+	}
+}
+
+func Test_TGateway_will_published_when_client_lost(t *testing.T) {
+	tg, c, brokers := newTestTGateway(t)
+	f := newFakeClient(t)
+	tg.handle_CONNECT(connectMessage("f", true), c, f.addr())
+	f.expect(WILLTOPICREQ)
+	fc := tg.clients.GetClient(f.addr()).(*TClient)
+	wt := NewMessage(WILLTOPIC).(*WillTopicMessage)
+	wt.WillTopic = []byte("f/status")
+	tg.handle_WILLTOPIC(wt, fc)
+	f.expect(WILLMSGREQ)
+	wm := NewMessage(WILLMSG).(*WillMsgMessage)
+	wm.WillMsg = []byte("gone")
+	tg.handle_WILLMSG(wm, fc)
+	f.expect(CONNACK)
+
+	tg.lostClient(fc)
+	b := (*brokers)[0]
+	if len(b.published) != 1 || b.published[0].topic != "f/status" || string(b.published[0].payload) != "gone" {
+		t.Fatalf("will not published, got %v", b.published)
+	}
+	if b.connected || tg.clients.GetClient(f.addr()) != nil {
+		t.Fatalf("lost client's session not ended")
+	}
+}
+
+// A writer the loggers can share
+type lockedBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.String()
+}
+
+// A will the broker does not take in time is logged as not
+// published
+func Test_TGateway_will_publish_timeout(t *testing.T) {
+	var logged lockedBuffer
+	defer setLogOutput(nil, &GatewayConfig{})
+	setLogOutput(&logOutput{writers: [4]io.Writer{&logged, &logged, &logged, &logged}}, &GatewayConfig{})
+	tg, c, brokers := newTestTGateway(t)
+	f := newFakeClient(t)
+	fc := tconnect(t, tg, c, f, "f")
+	fc.SetWillTopic("f/status", 0, false)
+	fc.SetWillMessage([]byte("gone"))
+	(*brokers)[0].publishHangs = true
+	tg.publishWill(fc)
+	if s := logged.String(); !strings.Contains(s, "error publishing the will: "+ErrPublishTimeout.Error()) || strings.Contains(s, "published the will") {
+		t.Fatalf("expected the will timing out logged, got %q", s)
+	}
+}
+
+func Test_TGateway_will_update(t *testing.T) {
+	tg, c, brokers := newTestTGateway(t)
+	var opts *MQTT.ClientOptions
+	tg.newMQTTClient = func(o *MQTT.ClientOptions) mqttClient {
+		opts = o
+		b := &fakeBroker{lost: opts.OnConnectionLost}
+		*brokers = append(*brokers, b)
+		return b
+	}
+	f := newFakeClient(t)
+	fc := tconnect(t, tg, c, f, "f")
+	tg.handle_SUBSCRIBE(subscribeMessage("a", 1, 1), fc)
+	f.expect(SUBACK)
+
+	wu := NewMessage(WILLTOPICUPD).(*WillTopicUpdateMessage)
+	wu.WillTopic = []byte("f/status")
+	wu.Qos = 1
+	tg.handle_WILLTOPICUPD(wu, fc)
+	if wr := f.expect(WILLTOPICRESP).(*WillTopicRespMessage); wr.ReturnCode != ACCEPTED {
+		t.Fatalf("expected rc %d, got %d", ACCEPTED, wr.ReturnCode)
+	}
+	mu := NewMessage(WILLMSGUPD).(*WillMsgUpdateMessage)
+	mu.WillMsg = []byte("gone")
+	tg.handle_WILLMSGUPD(mu, fc)
+	if wr := f.expect(WILLMSGRESP).(*WillMsgRespMessage); wr.ReturnCode != ACCEPTED {
+		t.Fatalf("expected rc %d, got %d", ACCEPTED, wr.ReturnCode)
+	}
+
+	if len(*brokers) != 3 || (*brokers)[0].connected || (*brokers)[1].connected {
+		t.Fatalf("expected a new broker connection per update")
+	}
+	if !opts.WillEnabled || opts.WillTopic != "f/status" || opts.WillQos != 1 || string(opts.WillPayload) != "gone" {
+		t.Fatalf("will not updated on the broker connection")
+	}
+	if (*brokers)[2].subscriptions["a"] == nil {
+		t.Fatalf("subscription not carried over to the new connection")
+	}
+
+	// an empty topic removes the will
+	tg.handle_WILLTOPICUPD(NewMessage(WILLTOPICUPD).(*WillTopicUpdateMessage), fc)
+	f.expect(WILLTOPICRESP)
+	if opts.WillEnabled {
+		t.Fatalf("will not removed")
+	}
+}
+
+func Test_TGateway_credentials(t *testing.T) {
+	file, err := ioutil.TempFile("", "credentials")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# client username password\nsensor1 alice secret1\nsensor* bob secret2\nsens* carol secret3\n")
+	file.Close()
+
+	tg, c, _ := newTestTGateway(t)
+	if tg.credentials, err = loadCredentials(file.Name()); err != nil {
+		t.Fatalf("loadCredentials: %v", err)
+	}
+	tg.mqttuser, tg.mqttpassword = "default", "secret0"
+	var opts *MQTT.ClientOptions
+	tg.newMQTTClient = func(o *MQTT.ClientOptions) mqttClient {
+		opts = o
+		return &fakeBroker{}
+	}
+
+	f := newFakeClient(t)
+	for _, c1 := range []struct{ clientid, username, password string }{
+		{"sensor1", "alice", "secret1"},
+		{"sensor2", "bob", "secret2"},
+		{"sens", "carol", "secret3"},
+		{"other", "default", "secret0"},
+	} {
+		tconnect(t, tg, c, f, c1.clientid)
+		if opts.Username != c1.username || opts.Password != c1.password {
+			t.Errorf("%s: expected %s/%s, got %s/%s", c1.clientid, c1.username, c1.password, opts.Username, opts.Password)
+		}
+	}
+
+	tg.credsRequired = true
+	tg.handle_CONNECT(connectMessage("other", false), c, f.addr())
+	if ca := f.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != REJ_NOT_SUPORTED {
+		t.Fatalf("expected rc %d, got %d", REJ_NOT_SUPORTED, ca.ReturnCode)
+	}
+
+	// reloading picks up new entries, and keeps the old ones on error
+	ioutil.WriteFile(file.Name(), []byte("other dave secret4\n"), 0600)
+	if err := tg.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	tconnect(t, tg, c, f, "other")
+	if opts.Username != "dave" {
+		t.Fatalf("expected dave, got %s", opts.Username)
+	}
+	ioutil.WriteFile(file.Name(), []byte("broken line\n"), 0600)
+	if err := tg.Reload(); err != ErrInvalidCredentials {
+		t.Fatalf("expected %v, got %v", ErrInvalidCredentials, err)
+	}
+	tconnect(t, tg, c, f, "other")
+	if opts.Username != "dave" {
+		t.Fatalf("expected dave, got %s", opts.Username)
+	}
+}
+
+func Test_TGateway_broker_refusals(t *testing.T) {
+	tg, c, _ := newTestTGateway(t)
+	f := newFakeClient(t)
+	for _, r := range []struct {
+		broker *fakeBroker
+		rc     byte
+	}{
+		{&fakeBroker{connectErr: errors.New("connection refused")}, REJ_CONGESTION},
+		{&fakeBroker{connectErr: errors.New("server unavailable"), connectRc: 0x03}, REJ_CONGESTION},
+		{&fakeBroker{connectErr: errors.New("unacceptable protocol version"), connectRc: 0x01}, REJ_NOT_SUPORTED},
+		{&fakeBroker{connectErr: errors.New("identifier rejected"), connectRc: 0x02}, REJ_NOT_SUPORTED},
+		{&fakeBroker{connectErr: errors.New("bad user name or password"), connectRc: 0x04}, REJ_NOT_SUPORTED},
+		{&fakeBroker{connectErr: errors.New("not authorized"), connectRc: 0x05}, REJ_NOT_SUPORTED},
+		{&fakeBroker{connectHangs: true}, REJ_CONGESTION},
+	} {
+		broker := r.broker
+		tg.newMQTTClient = func(o *MQTT.ClientOptions) mqttClient { return broker }
+		tg.handle_CONNECT(connectMessage("f", false), c, f.addr())
+		if ca := f.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != r.rc {
+			t.Errorf("%v (rc %d): expected %d, got %d", broker.connectErr, broker.connectRc, r.rc, ca.ReturnCode)
+		}
+		if tg.clients.GetClient(f.addr()) != nil {
+			t.Errorf("%v (rc %d): refused client was kept", broker.connectErr, broker.connectRc)
+		}
+	}
+}
+
+func Test_TGateway_broker_connection_limit(t *testing.T) {
+	tg, c, _ := newTestTGateway(t)
+	tg.brokerConns = newBrokerConns(1, 0, false)
+	f, g := newFakeClient(t), newFakeClient(t)
+	fc := tconnect(t, tg, c, f, "f")
+	tg.handle_CONNECT(connectMessage("g", false), c, g.addr())
+	if ca := g.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != REJ_CONGESTION {
+		t.Fatalf("expected rc %d at the limit, got %d", REJ_CONGESTION, ca.ReturnCode)
+	}
+	if n := tg.BrokerConnections(); n != 1 {
+		t.Fatalf("expected 1 broker connection, got %d", n)
+	}
+	tg.handle_DISCONNECT(NewMessage(DISCONNECT).(*DisconnectMessage), fc)
+	f.expect(DISCONNECT)
+	if n := tg.BrokerConnections(); n != 0 {
+		t.Fatalf("expected no broker connections, got %d", n)
+	}
+	tconnect(t, tg, c, g, "g")
+}
+
+func Test_TGateway_broker_connection_queue(t *testing.T) {
+	tg, c, _ := newTestTGateway(t)
+	tg.brokerConns = newBrokerConns(1, 0, true)
+	f, g := newFakeClient(t), newFakeClient(t)
+	fc := tconnect(t, tg, c, f, "f")
+	go tg.handle_CONNECT(connectMessage("g", false), c, g.addr())
+	g.expectNothing()
+	tg.handle_DISCONNECT(NewMessage(DISCONNECT).(*DisconnectMessage), fc)
+	if ca := g.expect(CONNACK).(*ConnackMessage); ca.ReturnCode != ACCEPTED {
+		t.Fatalf("expected the queued client to be accepted, got rc %d", ca.ReturnCode)
+	}
+	if n := tg.BrokerConnections(); n != 1 {
+		t.Fatalf("expected 1 broker connection, got %d", n)
+	}
+}
+
+func Test_brokerConns_rate(t *testing.T) {
+	b := newBrokerConns(0, 2, false)
+	if !b.acquire(time.Second) || !b.acquire(time.Second) {
+		t.Fatalf("expected a burst of 2 connections")
+	}
+	if b.acquire(time.Second) {
+		t.Fatalf("expected the third connection to be refused")
+	}
+	b.queue = true
+	if !b.acquire(time.Second) {
+		t.Fatalf("expected a queued connection once the rate allows")
+	}
+}
+
+func Test_TGateway_broker_drops_client(t *testing.T) {
+	tg, c, brokers := newTestTGateway(t)
+	f := newFakeClient(t)
+	tconnect(t, tg, c, f, "f")
+	(*brokers)[0].drop(errors.New("not authorized"))
+	f.expect(DISCONNECT)
+	if tg.clients.GetClient(f.addr()) != nil || tg.BrokerConnections() != 0 {
+		t.Fatalf("session survived the broker dropping it")
+	}
+}
+
+func Test_TGateway_broker_reconnects(t *testing.T) {
+	defer func(d time.Duration) { reconnectInterval = d }(reconnectInterval)
+	reconnectInterval = 10 * time.Millisecond
+	tg, c, brokers := newTestTGateway(t)
+	tg.brokerReconnects = 1
+	f := newFakeClient(t)
+	fc := tconnect(t, tg, c, f, "f")
+	tg.handle_SUBSCRIBE(subscribeMessage("a", 1, 0), fc)
+	f.expect(SUBACK)
+
+	(*brokers)[0].drop(errors.New("broker restarting"))
+	f.expectNothing()
+	if len(*brokers) != 2 || !(*brokers)[1].connected {
+		t.Fatalf("expected a new broker connection")
+	}
+	if _, ok := (*brokers)[1].subscriptions["a"]; !ok {
+		t.Fatalf("expected the new broker connection to be subscribed")
+	}
+	if tg.clients.GetClient(f.addr()) != SNClient(fc) || tg.BrokerConnections() != 1 {
+		t.Fatalf("expected the session to survive a reconnect")
+	}
+
+	tg.newMQTTClient = func(opts *MQTT.ClientOptions) mqttClient {
+		return &fakeBroker{connectErr: errors.New("connection refused")}
+	}
+	(*brokers)[1].drop(errors.New("broker stopped"))
+	f.expect(DISCONNECT)
+	if tg.clients.GetClient(f.addr()) != nil || tg.BrokerConnections() != 0 {
+		t.Fatalf("session survived failing to reconnect")
+	}
+}
+
+func Test_mqttKeepAlive(t *testing.T) {
+	for _, k := range []struct {
+		d          uint16
+		multiplier int
+		ceiling    time.Duration
+		def        time.Duration
+		expected   time.Duration
+	}{
+		{60, 0, 0, 0, 60 * time.Second},
+		{60, 2, 0, 0, 120 * time.Second},
+		{60, 2, 90 * time.Second, 0, 90 * time.Second},
+		{65535, 2, 0, 0, maxMQTTKeepAlive},
+		{0, 2, 0, 0, defaultMQTTKeepAlive},
+		{0, 2, 0, 30 * time.Second, 30 * time.Second},
+	} {
+		if ka := mqttKeepAlive(k.d, k.multiplier, k.ceiling, k.def); ka != k.expected {
+			t.Errorf("mqttKeepAlive(%d, %d, %v, %v): expected %v, got %v", k.d, k.multiplier, k.ceiling, k.def, k.expected, ka)
+		}
+	}
+}
+
+func Test_TGateway_keepalive(t *testing.T) {
+	tg, c, _ := newTestTGateway(t)
+	tg.keepAliveFactor = 2
+	tg.keepAliveDefault = 30 * time.Second
+	var keepAlive time.Duration
+	tg.newMQTTClient = func(opts *MQTT.ClientOptions) mqttClient {
+		keepAlive = opts.KeepAlive
+		return &fakeBroker{}
+	}
+	f := newFakeClient(t)
+	tconnect(t, tg, c, f, "f")
+	if keepAlive != 120*time.Second {
+		t.Fatalf("expected a broker keepalive of 120s, got %v", keepAlive)
+	}
+	cm := connectMessage("f", false)
+	cm.Duration = 0
+	tg.handle_CONNECT(cm, c, f.addr())
+	f.expect(CONNACK)
+	if keepAlive != 30*time.Second {
+		t.Fatalf("expected the default broker keepalive of 30s, got %v", keepAlive)
+	}
+}
+
+func Test_TGateway_QoS_upstream(t *testing.T) {
+	tg, c, brokers := newTestTGateway(t)
+	f := newFakeClient(t)
+	fc := tconnect(t, tg, c, f, "f")
+	fb := (*brokers)[0]
+	tg.handle_REGISTER(NewRegisterMessage(0, 1, []byte("a")), fc)
+	ra := f.expect(REGACK).(*RegackMessage)
+
+	// a PUBLISH is sent again as if its acknowledgement was lost,
+	// except at QoS 0 which has none
+	for qos, expected := range []int{1, 2, 1} {
+		fb.published = nil
+		sends := 2
+		if qos == 0 {
+			sends = 1
+		}
+		for i := 0; i < sends; i++ {
+			pm := NewPublishMessage(ra.TopicId, 0x00, []byte("up"), byte(qos), 7, false, i > 0)
+			tg.handle_PUBLISH(pm, fc)
+			switch qos {
+			case 1:
+				f.expect(PUBACK)
+			case 2:
+				if pr := f.expect(PUBREC).(*PubrecMessage); pr.MessageId != 7 {
+					t.Fatalf("unexpected PUBREC for msg id %d", pr.MessageId)
+				}
+			}
+		}
+		if len(fb.published) != expected {
+			t.Fatalf("QoS %d: expected %d broker publishes, got %d", qos, expected, len(fb.published))
+		}
+		if fb.published[0].qos != byte(qos) {
+			t.Fatalf("QoS %d: published at QoS %d", qos, fb.published[0].qos)
+		}
+	}
+
+	// a PUBREL resent because its PUBCOMP was lost is answered again
+	for i := 0; i < 2; i++ {
+		pr := NewMessage(PUBREL).(*PubrelMessage)
+		pr.MessageId = 7
+		tg.handle_PUBREL(pr, fc)
+		if pc := f.expect(PUBCOMP).(*PubcompMessage); pc.MessageId != 7 {
+			t.Fatalf("unexpected PUBCOMP for msg id %d", pc.MessageId)
+		}
+	}
+
+	// once released the msg id can be used again
+	tg.handle_PUBLISH(NewPublishMessage(ra.TopicId, 0x00, []byte("up"), 2, 7, false, false), fc)
+	f.expect(PUBREC)
+	if len(fb.published) != 2 {
+		t.Fatalf("expected a new QoS 2 PUBLISH to be published")
+	}
+}
+
+// A PUBLISH the broker does not answer in time is refused
+func Test_TGateway_publish_timeout(t *testing.T) {
+	tg, c, brokers := newTestTGateway(t)
+	f := newFakeClient(t)
+	fc := tconnect(t, tg, c, f, "f")
+	tg.handle_REGISTER(NewRegisterMessage(0, 1, []byte("a")), fc)
+	ra := f.expect(REGACK).(*RegackMessage)
+	(*brokers)[0].publishHangs = true
+	tg.handle_PUBLISH(NewPublishMessage(ra.TopicId, 0x00, []byte("up"), 1, 7, false, false), fc)
+	if pa := f.expect(PUBACK).(*PubackMessage); pa.ReturnCode != REJ_CONGESTION {
+		t.Fatalf("expected a publish timing out refused, got rc %d", pa.ReturnCode)
+	}
+}
+
+func Test_TGateway_QoS_downstream(t *testing.T) {
+	tg, c, brokers := newTestTGateway(t)
+	tg.timers.retryInterval = 20 * time.Millisecond
+	f := newFakeClient(t)
+	fc := tconnect(t, tg, c, f, "f")
+	fb := (*brokers)[0]
+	tg.handle_SUBSCRIBE(subscribeMessage("a", 1, 2), fc)
+	f.expect(SUBACK)
+
+	// the first PUBLISH is lost, the client answers the second
+	fb.deliver("a", &fakeMessage{"a", []byte("q1"), 1})
+	first := f.expect(PUBLISH).(*PublishMessage)
+	pm := f.expect(PUBLISH).(*PublishMessage)
+	if pm.Qos != 1 || !pm.Dup || pm.MessageId != first.MessageId {
+		t.Fatalf("expected the QoS 1 PUBLISH to be resent, got %+v", pm)
+	}
+	tg.handle_PUBACK(puback(pm, ACCEPTED), fc)
+	f.expectNothing()
+
+	// as for a QoS 2 PUBLISH, and its PUBREL
+	fb.deliver("a", &fakeMessage{"a", []byte("q2"), 2})
+	first = f.expect(PUBLISH).(*PublishMessage)
+	pm = f.expect(PUBLISH).(*PublishMessage)
+	if pm.Qos != 2 || !pm.Dup || pm.MessageId != first.MessageId {
+		t.Fatalf("expected the QoS 2 PUBLISH to be resent, got %+v", pm)
+	}
+	pr := NewMessage(PUBREC).(*PubrecMessage)
+	pr.MessageId = pm.MessageId
+	tg.handle_PUBREC(pr, fc)
+	f.expect(PUBREL)
+	if rl := f.expect(PUBREL).(*PubrelMessage); rl.MessageId != pm.MessageId {
+		t.Fatalf("unexpected PUBREL for msg id %d", rl.MessageId)
+	}
+	pc := NewMessage(PUBCOMP).(*PubcompMessage)
+	pc.MessageId = pm.MessageId
+	tg.handle_PUBCOMP(pc, fc)
+	f.expectNothing()
+}
+
+func Test_TGateway_SUBACK_granted_qos(t *testing.T) {
+	tg, c, _ := newTestTGateway(t)
+	tg.newMQTTClient = func(opts *MQTT.ClientOptions) mqttClient {
+		return &fakeBroker{grant: map[string]byte{"a": 1, "b/#": 0, "c": 0x80}}
+	}
+	f := newFakeClient(t)
+	fc := tconnect(t, tg, c, f, "f")
+	for i, s := range []struct {
+		filter string
+		qos    byte
+		rc     byte
+	}{
+		{"a", 1, ACCEPTED},
+		{"b/#", 0, ACCEPTED},
+		{"c", 0, REJ_NOT_SUPORTED},
+		{"d", 2, ACCEPTED},
+	} {
+		tg.handle_SUBSCRIBE(subscribeMessage(s.filter, uint16(i+1), 2), fc)
+		sa := f.expect(SUBACK).(*SubackMessage)
+		if sa.ReturnCode != s.rc || sa.ReturnCode == ACCEPTED && sa.Qos != s.qos {
+			t.Errorf("%s: expected qos %d rc %d, got qos %d rc %d", s.filter, s.qos, s.rc, sa.Qos, sa.ReturnCode)
+		}
+	}
+	if fc.Subscribed("c") || fc.GrantedQos("a") != 1 {
+		t.Fatalf("client's subscriptions do not match the broker's")
+	}
+}
+
+// Disconnected by the gateway, the client's will is published
+// unless it is to be suppressed
+func Test_TGateway_kick(t *testing.T) {
+	for _, will := range []bool{true, false} {
+		tg, c, brokers := newTestTGateway(t)
+		f := newFakeClient(t)
+		tg.handle_CONNECT(connectMessage("f", true), c, f.addr())
+		f.expect(WILLTOPICREQ)
+		fc := tg.clients.GetClient(f.addr()).(*TClient)
+		wt := NewMessage(WILLTOPIC).(*WillTopicMessage)
+		wt.WillTopic = []byte("f/status")
+		tg.handle_WILLTOPIC(wt, fc)
+		f.expect(WILLMSGREQ)
+		wm := NewMessage(WILLMSG).(*WillMsgMessage)
+		wm.WillMsg = []byte("gone")
+		tg.handle_WILLMSG(wm, fc)
+		f.expect(CONNACK)
+
+		if !tg.kickById("f", will, 0) {
+			t.Fatalf("expected f found")
+		}
+		f.expect(DISCONNECT)
+		b := (*brokers)[0]
+		if published := len(b.published) == 1; published != will {
+			t.Fatalf("expected the will published %v, got %v", will, b.published)
+		}
+		if b.connected || tg.clients.GetClient(f.addr()) != nil {
+			t.Fatalf("kicked client's session not ended")
+		}
+	}
+}
+
+// A message published from the admin API reaches the clients
+// subscribed to it, at no more than their subscription's QoS
+func Test_TGateway_inject(t *testing.T) {
+	tg, c, _ := newTestTGateway(t)
+	f, g := newFakeClient(t), newFakeClient(t)
+	fc := tconnect(t, tg, c, f, "f")
+	tg.handle_SUBSCRIBE(subscribeMessage("a/+", 0, 0), fc)
+	f.expect(SUBACK)
+	tconnect(t, tg, c, g, "g")
+
+	if n := tg.inject(injectedMessage{"a/b", []byte("hi"), 1, false}); n != 1 {
+		t.Fatalf("expected 1 client targeted, got %d", n)
+	}
+	rm := f.expect(REGISTER).(*RegisterMessage)
+	tg.handle_REGACK(regack(rm), fc)
+	if pm := f.expect(PUBLISH).(*PublishMessage); pm.TopicId != rm.TopicId || pm.Qos != 0 || string(pm.Data) != "hi" {
+		t.Fatalf("expected hi at QoS 0, got %+v", pm)
+	}
+	g.expectNothing()
+}
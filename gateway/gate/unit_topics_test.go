@@ -32,7 +32,7 @@ func Test_ContainsWildcard(t *testing.T) {
 	for topic, exp := range topics {
 		res := ContainsWildcard(topic)
 		if res != exp {
-			t.Errorf("ContainsWildcard expected \"%s\", got \"%s\"", exp, res)
+			t.Errorf("ContainsWildcard expected \"%v\", got \"%v\"", exp, res)
 		}
 	}
 }
@@ -75,6 +75,39 @@ func Benchmark_ContainsWildcard(b *testing.B) {
 	}
 }
 
+func Test_TopicMatches(t *testing.T) {
+	matches := []struct {
+		filter, topic string
+		exp           bool
+	}{
+		{"a", "a", true},
+		{"a", "b", false},
+		{"a/b", "a", false},
+		{"a", "a/b", false},
+		{"+", "a", true},
+		{"+", "/a", false},
+		{"/+", "/a", true},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b/c", false},
+		{"a//b", "a//b", true},
+		{"a/+/b", "a//b", true},
+		{"#", "$SYS/a", false},
+		{"+/a", "$SYS/a", false},
+		{"$SYS/#", "$SYS/a", true},
+		{"a/#", "a/$b", true},
+	}
+
+	for _, m := range matches {
+		if res := TopicMatches(m.filter, m.topic); res != m.exp {
+			t.Errorf("TopicMatches(\"%s\", \"%s\") expected %v, got %v", m.filter, m.topic, m.exp, res)
+		}
+	}
+}
+
 func Test_ValidateTopicFilter(t *testing.T) {
 	topics := map[string]bool{
 		"":         false,
@@ -634,3 +634,42 @@ func Test_RemoveSubscription_rs3(t *testing.T) {
 	alen(0, elen(tt.SubscribersOf("/alpha/beta/gamma")), 16, t)
 	alen(0, elen(tt.SubscribersOf("/alpha")), 17, t)
 }
+
+func Test_TopicTree_Filters(t *testing.T) {
+	var conn uConn
+	var addr uAddr
+	c1, c2 := NewClient("c1", conn, addr), NewClient("c2", conn, addr)
+	tt := NewTopicTree()
+	for _, f := range []string{"a/b", "a/#", "+/c", "/d"} {
+		_, e := tt.AddSubscription(c1, f)
+		eok(e, t)
+	}
+	_, e := tt.AddSubscription(c2, "a/b")
+	eok(e, t)
+	eok(tt.RemoveSubscription(c1, "+/c"), t)
+	eok(tt.RemoveSubscription(c1, "a/b"), t)
+
+	fs := tt.Filters()
+	if len(fs) != 3 || fs[0] != "/d" || fs[1] != "a/#" || fs[2] != "a/b" {
+		t.Fatalf("expected [/d a/# a/b], got %v", fs)
+	}
+}
+
+// Filters beginning with a wildcard do not match topics
+// beginning with $
+func Test_SubscribersOf_dollar(t *testing.T) {
+	var conn uConn
+	var addr uAddr
+	c := NewClient("so_1", conn, addr)
+	tt := NewTopicTree()
+
+	tt.AddSubscription(c, "#")
+	tt.AddSubscription(c, "+/a")
+	tt.AddSubscription(c, "$SYS/#")
+	tt.AddSubscription(c, "$SYS")
+
+	alen(2, elen(tt.SubscribersOf("b/a")), 1, t)
+	alen(1, elen(tt.SubscribersOf("$SYS/a")), 2, t)
+	alen(1, elen(tt.SubscribersOf("$SYS")), 3, t)
+	alen(0, elen(tt.SubscribersOf("$other/a")), 4, t)
+}
@@ -0,0 +1,120 @@
+package gateway
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_config_trace(t *testing.T) {
+	gc := &GatewayConfig{}
+	if err := gc.parseConfig("log-trace-client a,b\nlog-trace-client c"); err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if strings.Join(gc.tracedclients, " ") != "a b c" || gc.traceDuration() != defaultTraceDuration {
+		t.Fatalf("expected a, b and c traced for %v, got %v for %v", defaultTraceDuration, gc.tracedclients, gc.traceDuration())
+	}
+	gc.parseConfig("log-trace-duration 10m")
+	traces.configure(gc)
+	defer traces.reset()
+	if list := traces.list(); len(list) != 3 || list[0].Client != "a" || time.Until(list[0].Until) > 10*time.Minute {
+		t.Fatalf("expected a, b and c traced for 10m, got %+v", list)
+	}
+}
+
+// The lines and packets of a client traced are logged at INFO
+// whatever the level, tagged, and no others are
+func Test_trace(t *testing.T) {
+	var out strings.Builder
+	InitLogger(&out, &out)
+	defer InitLogger(ioutil.Discard, ioutil.Discard)
+	SetLogLevel("error")
+	traces.set("fake", time.Minute)
+	defer traces.reset()
+
+	f, g := newFakeClient(t), newFakeClient(t)
+	ag, client := newTestAGateway(t, f)
+	other := NewClient("g", client.Conn, g.addr())
+	ag.clients.AddClient(other)
+	onPacket(ag, client, f, NewMessage(PINGREQ))
+	f.expect(PINGRESP)
+	onPacket(ag, other, g, NewMessage(PINGREQ))
+	g.expect(PINGRESP)
+	client.SetState(ASLEEP)
+	other.SetState(ASLEEP)
+
+	addr := f.addr().String()
+	expected := []string{
+		" new client component=client client_id=fake remote_addr=" + addr + " trace=true",
+		" in component=trace client_id=fake remote_addr=" + addr + ` msg_type=PINGREQ bytes=2 hex="02 16" trace=true`,
+		" decoded component=core msg_type=PINGREQ remote_addr=" + addr + " trace=true",
+		" received component=core msg_type=PINGREQ remote_addr=" + addr + " trace=true",
+		" out component=trace client_id=fake remote_addr=" + addr + ` msg_type=PINGRESP bytes=2 hex="02 17" trace=true`,
+		" sent component=core msg_type=PINGRESP remote_addr=" + addr + " trace=true",
+		" state component=client client_id=fake from=active to=asleep trace=true",
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, lines)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "INFO:  ") || !strings.HasSuffix(line, expected[i]) {
+			t.Fatalf("expected %q, got %q", expected[i], line)
+		}
+	}
+
+	// its address forgotten with it, and another's learned
+	traces.clear("fake")
+	traces.set("g", time.Minute)
+	onPacket(ag, other, g, NewMessage(PINGREQ))
+	g.expect(PINGRESP)
+	if traces.matches([]Field{logRemote(f.addr())}) || !traces.matches([]Field{logRemote(g.addr())}) {
+		t.Fatalf("expected g traced alone")
+	}
+}
+
+func Test_trace_expiry(t *testing.T) {
+	defer traces.reset()
+	until := traces.set("x", time.Hour)
+	if time.Until(until) < 59*time.Minute {
+		t.Fatalf("expected x traced for an hour, until %v", until)
+	}
+	traces.set("x", 10*time.Millisecond)
+	for deadline := time.Now().Add(time.Second); traces.active() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if traces.active() || len(traces.list()) != 0 {
+		t.Fatalf("expected the trace expired, got %+v", traces.list())
+	}
+}
+
+func Test_admin_trace(t *testing.T) {
+	f := newFakeClient(t)
+	ag, _ := newTestAGateway(t, f)
+	url := startAdmin(t, ag.admin) + "/debug/trace"
+	defer traces.reset()
+
+	var list []traceInfo
+	if status := postJSON(t, url+"?client=fake&enable=true&duration=30m", "", &list); status != http.StatusOK || len(list) != 1 || list[0].Client != "fake" {
+		t.Fatalf("expected fake traced, got %d %+v", status, list)
+	}
+	if d := time.Until(list[0].Until); d > 30*time.Minute || d < 29*time.Minute {
+		t.Fatalf("expected fake traced for 30m, until %v", list[0].Until)
+	}
+	getJSON(t, url, &list)
+	if len(list) != 1 || list[0].Client != "fake" {
+		t.Fatalf("expected fake listed, got %+v", list)
+	}
+	for _, query := range []string{"?enable=true", "?client=fake&enable=yes", "?client=fake&enable=true&duration=-1m"} {
+		if status := postJSON(t, url+query, "", &list); status != http.StatusBadRequest {
+			t.Fatalf("expected %s refused, got %d", query, status)
+		}
+	}
+	if status := postJSON(t, url+"?client=fake&enable=false", "", &list); status != http.StatusOK || len(list) != 0 || traces.active() {
+		t.Fatalf("expected fake no longer traced, got %d %+v", status, list)
+	}
+}
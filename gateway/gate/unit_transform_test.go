@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+func Test_CBORToJSON(t *testing.T) {
+	for in, expected := range map[string]string{
+		"a26174f94d60626f6bf5": `{"ok":true,"t":21.5}`,
+		"8301203903e7":         `[1,-1,-1000]`,
+		"a10102":               `{"1":2}`,
+		"420102":               `"AQI="`,
+		"c11a514b67b0":         `1363896240`,
+		"fb3ff199999999999a":   `1.1`,
+		"fa3fc00000":           `1.5`,
+		"f6":                   `null`,
+		"1bffffffffffffffff":   `18446744073709551615`,
+		"6568656c6c6f":         `"hello"`,
+		"a1616183f4f6a0":       `{"a":[false,null,{}]}`,
+	} {
+		b, _ := hex.DecodeString(in)
+		topic, j, err := CBORToJSON("t", b)
+		if err != nil || topic != "t" || string(j) != expected {
+			t.Errorf("%s: expected %s, got %s, %v", in, expected, j, err)
+		}
+	}
+	for _, bad := range []string{"18", "0000", "bf6161ff", "9bffffffffffffffff", "a1f502", "62ff", "f97c00", "1c", strings.Repeat("81", 40) + "00"} {
+		b, _ := hex.DecodeString(bad)
+		if _, _, err := CBORToJSON("t", b); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+// Transforms rewrite what passes through the gateway; the
+// clients' topic ids are for the topics they see, and clients'
+// subscriptions match the rewritten topics
+func Test_AGateway_transform(t *testing.T) {
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1"})
+	broker := &fakeBroker{}
+	ag.mqttclient = broker
+	bad := errors.New("bad")
+	ag.SetUpstreamTransform(func(topic string, payload []byte) (string, []byte, error) {
+		if string(payload) == "bad" {
+			return "", nil, bad
+		}
+		return topic + "/json", []byte(strings.ToUpper(string(payload))), nil
+	})
+	ag.SetDownstreamTransform(func(topic string, payload []byte) (string, []byte, error) {
+		switch {
+		case string(payload) == "bad":
+			return "", nil, bad
+		case string(payload) == "move":
+			return "other/" + topic, payload, nil
+		case string(payload) == "wild":
+			return topic + "/#", payload, nil
+		}
+		return topic + "/json", payload, nil
+	})
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+
+	f := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("c", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+	f.expect(CONNACK)
+	client := ag.clients.GetClient(f.addr())
+	ag.handle_REGISTER(NewRegisterMessage(0, 1, []byte("a")), client)
+	topicid := f.expect(REGACK).(*RegackMessage).TopicId
+	ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte("x"), 1, 2, false, false), client)
+	if pa := f.expect(PUBACK).(*PubackMessage); pa.ReturnCode != ACCEPTED {
+		t.Fatalf("expected the PUBLISH accepted, got rc %d", pa.ReturnCode)
+	}
+	if len(broker.published) != 1 || broker.published[0].topic != "a/json" || string(broker.published[0].payload) != "X" {
+		t.Fatalf("published %v", broker.published)
+	}
+	if ag.tIndex.getId("a/json") != 0 {
+		t.Fatalf("expected the broker's topic not to be indexed")
+	}
+	ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte("bad"), 1, 3, false, false), client)
+	if pa := f.expect(PUBACK).(*PubackMessage); pa.ReturnCode != REJ_NOT_SUPORTED || len(broker.published) != 1 {
+		t.Fatalf("expected the PUBLISH refused, got rc %d", pa.ReturnCode)
+	}
+
+	ag.handle_SUBSCRIBE(subscribeMessage("dev/#", 4, 0), client)
+	f.expect(SUBACK)
+	for _, payload := range []string{"move", "bad", "wild"} {
+		broker.deliver("dev/#", &fakeMessage{"dev/1", []byte(payload), 0})
+	}
+	f.expectNothing()
+	broker.deliver("dev/#", &fakeMessage{"dev/1", []byte("y"), 0})
+	if rm := f.expect(REGISTER).(*RegisterMessage); string(rm.TopicName) != "dev/1/json" {
+		t.Fatalf("expected REGISTER for dev/1/json, got %q", rm.TopicName)
+	}
+	if ag.tIndex.getId("dev/1/json") == 0 || ag.tIndex.getId("dev/1") != 0 {
+		t.Fatalf("expected only the rewritten topic indexed")
+	}
+	if d := ag.TransformDrops(); d != 3 {
+		t.Fatalf("expected 3 messages dropped, got %d", d)
+	}
+}
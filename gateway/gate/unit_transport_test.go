@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// An MQTT-SN client on a MemNetwork
+type memClient struct {
+	t  *testing.T
+	tr *MemTransport
+	gw MemAddr
+}
+
+func newMemClient(t *testing.T, n *MemNetwork, name string, gw MemAddr) *memClient {
+	tr, err := n.Listen(name)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { tr.Close() })
+	return &memClient{t, tr, gw}
+}
+
+func (c *memClient) send(m Message) {
+	if err := (uConn{c.tr, 0, nil}).WriteTo(m, uAddr{c.gw}); err != nil {
+		c.t.Fatalf("WriteTo: %v", err)
+	}
+}
+
+func (c *memClient) expect(msgType byte) Message {
+	buf := make([]byte, 1500)
+	read := make(chan int, 1)
+	go func() {
+		n, _, _ := c.tr.ReadFrom(buf)
+		read <- n
+	}()
+	select {
+	case n := <-read:
+		m, err := ReadPacket(bytes.NewBuffer(buf[:n]))
+		if err != nil || m.MessageType() != msgType {
+			c.t.Fatalf("expected %s, got %v, %v", MessageNames[msgType], m, err)
+		}
+		return m
+	case <-time.After(time.Second):
+		c.t.Fatalf("expected %s, got nothing", MessageNames[msgType])
+		return nil
+	}
+}
+
+func Test_MemNetwork(t *testing.T) {
+	n := NewMemNetwork()
+	a, _ := n.Listen("a")
+	if _, err := n.Listen("a"); err != ErrMemAddrInUse {
+		t.Fatalf("expected %v, got %v", ErrMemAddrInUse, err)
+	}
+	b, _ := n.Listen("b")
+	if _, err := a.WriteTo([]byte("hello"), MemAddr("nobody")); err != nil {
+		t.Fatalf("a packet to nobody should be dropped, got %v", err)
+	}
+	a.WriteTo([]byte("hello"), b.LocalAddr())
+	buf := make([]byte, 3)
+	if n, from, err := b.ReadFrom(buf); err != nil || string(buf[:n]) != "hel" || from != a.LocalAddr() {
+		t.Fatalf("read %q from %v, %v", buf[:n], from, err)
+	}
+	b.Close()
+	if _, _, err := b.ReadFrom(buf); err != ErrTransportClosed {
+		t.Fatalf("expected %v, got %v", ErrTransportClosed, err)
+	}
+	if _, err := n.Listen("b"); err != nil {
+		t.Fatalf("a closed transport's name should be free: %v", err)
+	}
+}
+
+// A subscriber and a publisher, entirely in process: what one
+// publishes reaches the broker, and what the broker sends
+// reaches the other
+func Test_end_to_end_in_memory(t *testing.T) {
+	n := NewMemNetwork()
+	gwtr, _ := n.Listen("gateway")
+	broker := &fakeBroker{}
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1"})
+	ag.mqttclient = broker
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+	ag.Serve(gwtr)
+
+	subscriber := newMemClient(t, n, "subscriber", "gateway")
+	subscriber.send(connectMessage("subscriber", false))
+	subscriber.expect(CONNACK)
+	subscriber.send(subscribeMessage("a/b", 1, 1))
+	sa := subscriber.expect(SUBACK).(*SubackMessage)
+	if sa.ReturnCode != ACCEPTED {
+		t.Fatalf("SUBSCRIBE: rc %d", sa.ReturnCode)
+	}
+
+	publisher := newMemClient(t, n, "publisher", "gateway")
+	publisher.send(connectMessage("publisher", false))
+	publisher.expect(CONNACK)
+	publisher.send(NewRegisterMessage(0, 1, []byte("a/b")))
+	ra := publisher.expect(REGACK).(*RegackMessage)
+	publisher.send(NewPublishMessage(ra.TopicId, 0, []byte("hello"), 1, 2, false, false))
+	publisher.expect(PUBACK)
+	if len(broker.published) != 1 || broker.published[0].topic != "a/b" || string(broker.published[0].payload) != "hello" {
+		t.Fatalf("the broker was sent %+v", broker.published)
+	}
+
+	broker.deliver("a/b", &broker.published[0])
+	pm := subscriber.expect(PUBLISH).(*PublishMessage)
+	if pm.TopicId != sa.TopicId || string(pm.Data) != "hello" {
+		t.Fatalf("delivered %+v", pm)
+	}
+	if ag.clients.GetClient(uAddr{MemAddr("subscriber")}) == nil {
+		t.Fatalf("expected the subscriber to be known by its name")
+	}
+}
@@ -0,0 +1,307 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// An in-memory net.PacketConn: the datagrams sent on in are
+// read from it, from addr, and each reply written to it is
+// signalled on replies
+type memConn struct {
+	in      chan []byte
+	replies chan struct{}
+	addr    net.Addr
+	closed  chan struct{}
+}
+
+func newMemConn(replies int) *memConn {
+	return &memConn{
+		make(chan []byte),
+		make(chan struct{}, replies),
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1884},
+		make(chan struct{}),
+	}
+}
+
+func (c *memConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.in:
+		return copy(b, p), c.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *memConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.replies <- struct{}{}
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr                { return c.addr }
+func (c *memConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func packet(m Message) []byte {
+	var buf bytes.Buffer
+	m.Write(&buf)
+	return buf.Bytes()
+}
+
+// Read buffers are reused once a packet has been handled, so
+// nothing decoded from one may refer to it
+func Test_listener_buffer_reuse(t *testing.T) {
+	ag := NewAGateway(&GatewayConfig{})
+	ag.mqttclient = &fakeBroker{}
+	conn := newMemConn(100)
+	l := newListener(ag, defaultMaxMessageSize, conn)
+	defer l.stop(context.Background())
+
+	for i := 0; i < 10; i++ {
+		conn.addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2000 + i}
+		conn.in <- packet(connectMessage(fmt.Sprintf("client-%d", i), false))
+		<-conn.replies
+	}
+	for i := 0; i < 10; i++ {
+		addr := uAddr{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2000 + i}}
+		sc := ag.clients.GetClient(addr)
+		if sc == nil || sc.base().ClientId != fmt.Sprintf("client-%d", i) {
+			t.Fatalf("client at %v: %v", addr, sc)
+		}
+	}
+}
+
+// A datagram larger than the maximum message size is dropped
+// whole rather than read cut short
+func Test_listener_oversized(t *testing.T) {
+	ag := NewAGateway(&GatewayConfig{})
+	conn := newMemConn(1)
+	l := newListener(ag, 64, conn)
+	defer l.stop(context.Background())
+
+	conn.in <- packet(NewPublishMessage(1, 0, bytes.Repeat([]byte("x"), 58), 0, 0, false, false))
+	conn.in <- packet(NewMessage(PINGREQ))
+	<-conn.replies
+	if n := ag.OversizedPackets(); n != 1 {
+		t.Fatalf("expected 1 oversized packet, counted %d", n)
+	}
+}
+
+// Nothing larger than the maximum message size is sent, a
+// PUBLISH too large for a client not even being queued
+func Test_uConn_max(t *testing.T) {
+	conn := newMemConn(1)
+	c := uConn{conn, 64, nil}
+	big := NewPublishMessage(1, 0, bytes.Repeat([]byte("x"), 58), 0, 0, false, false)
+	if err := c.WriteTo(big, uAddr{conn.addr}); err != ErrMessageTooLarge {
+		t.Fatalf("expected %v, got %v", ErrMessageTooLarge, err)
+	}
+	client := NewClient("c", c, uAddr{conn.addr})
+	client.registeredTopics[1] = "t"
+	client.Deliver(big, "t")
+	if len(client.outbound) != 0 || len(conn.replies) != 0 {
+		t.Fatalf("a PUBLISH too large was queued or sent")
+	}
+	client.Deliver(NewPublishMessage(1, 0, bytes.Repeat([]byte("x"), 57), 0, 0, false, false), "t")
+	if len(conn.replies) != 1 {
+		t.Fatalf("expected a PUBLISH that fits to be sent")
+	}
+}
+
+// PINGREQs through the listener and core, to measure what each
+// packet allocates
+func Benchmark_listener_PINGREQ(b *testing.B) {
+	ag := NewAGateway(&GatewayConfig{})
+	conn := newMemConn(1)
+	l := newListener(ag, defaultMaxMessageSize, conn)
+	defer l.stop(context.Background())
+	pingreq := packet(NewMessage(PINGREQ))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.in <- pingreq
+		<-conn.replies
+	}
+}
+
+// A UDP client of gw's listener
+func dialUDP(t testing.TB, gw Gateway) *net.UDPConn {
+	raddr, _ := net.ResolveUDPAddr("udp", gw.Addr())
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	return c
+}
+
+func pingUDP(t testing.TB, c *net.UDPConn, pingreq []byte) {
+	buf := make([]byte, 64)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Write(pingreq); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n, err := c.Read(buf); err != nil || n != 2 || buf[1] != PINGRESP {
+		t.Fatalf("expected PINGRESP, got % x, %v", buf[:n], err)
+	}
+}
+
+// Several readers share the port, each client being answered
+// from it
+func Test_listener_readers(t *testing.T) {
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1", udpreaders: 4})
+	ag.mqttclient = &fakeBroker{}
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+	if n := len(ag.listener.conns); runtime.GOOS == "linux" && n != 4 {
+		t.Fatalf("expected 4 sockets, have %d", n)
+	}
+
+	pingreq := packet(NewMessage(PINGREQ))
+	for i := 0; i < 20; i++ {
+		c := dialUDP(t, ag)
+		for j := 0; j < 3; j++ {
+			pingUDP(t, c, pingreq)
+		}
+		c.Close()
+	}
+}
+
+// PINGREQs from many clients at once over loopback UDP, with 1,
+// 4 and 8 readers
+func Benchmark_listener_readers(b *testing.B) {
+	pingreq := packet(NewMessage(PINGREQ))
+	for _, readers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("%d", readers), func(b *testing.B) {
+			ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1", udpreaders: readers})
+			ag.mqttclient = &fakeBroker{}
+			if err := ag.Start(); err != nil {
+				b.Fatalf("Start: %v", err)
+			}
+			defer ag.Stop(context.Background())
+
+			b.SetParallelism(4)
+			b.RunParallel(func(pb *testing.PB) {
+				c := dialUDP(b, ag)
+				defer c.Close()
+				for pb.Next() {
+					pingUDP(b, c, pingreq)
+				}
+			})
+		})
+	}
+}
+
+// A listener bound to every address answers each client from
+// the address it sent to, not whichever the kernel would choose
+func Test_listener_reply_source(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs every loopback address, as only Linux has")
+	}
+	ag := NewAGateway(&GatewayConfig{})
+	ag.mqttclient = &fakeBroker{}
+	l, err := listen("0.0.0.0:0", 1, defaultMaxMessageSize, nil, ag)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.stop(context.Background())
+	if _, ok := l.conns[0].(*pktinfoConn); !ok {
+		t.Fatalf("expected the source of replies to be set, have %T", l.conns[0])
+	}
+
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer c.Close()
+	buf := make([]byte, 64)
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 3)} {
+		gw := &net.UDPAddr{IP: ip, Port: l.port()}
+		if _, err := c.WriteTo(packet(NewMessage(PINGREQ)), gw); err != nil {
+			t.Fatalf("WriteTo: %v", err)
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := c.ReadFrom(buf)
+		if err != nil || n != 2 || buf[1] != PINGRESP {
+			t.Fatalf("expected PINGRESP, got % x, %v", buf[:n], err)
+		}
+		if !from.(*net.UDPAddr).IP.Equal(ip) {
+			t.Fatalf("expected a reply from %v, got one from %v", gw, from)
+		}
+	}
+}
+
+// A Gateway recording the packets it is handed by the address
+// they are from, each taking a moment to handle, and the first
+// from 127.0.0.1 blocking until block is closed
+type orderGateway struct {
+	Gateway
+	sync.Mutex
+	handled map[string][]byte
+	block   chan struct{}
+}
+
+func (g *orderGateway) admit(uAddr) bool { return true }
+
+func (g *orderGateway) OnPacket(n int, b []byte, c uConn, a uAddr) {
+	if b[0] == 0 && a.String() == "127.0.0.1:1884" {
+		<-g.block
+	}
+	time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+	g.Lock()
+	g.handled[a.String()] = append(g.handled[a.String()], b[0])
+	g.Unlock()
+}
+
+func (g *orderGateway) from(a string) []byte {
+	defer g.Unlock()
+	g.Lock()
+	return append([]byte(nil), g.handled[a]...)
+}
+
+// A burst of packets from one address is handled in the order it
+// was read, without holding up those from another
+func Test_listener_source_order(t *testing.T) {
+	g := &orderGateway{handled: make(map[string][]byte), block: make(chan struct{})}
+	a, b := newMemConn(0), newMemConn(0)
+	b.addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1884}
+	l := newListener(g, defaultMaxMessageSize, a, b)
+	for i := 0; i < 50; i++ {
+		a.in <- []byte{byte(i)}
+	}
+	b.in <- []byte{1}
+	for deadline := time.Now().Add(time.Second); len(g.from(b.addr.String())) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("127.0.0.2 held up behind 127.0.0.1")
+		}
+	}
+	close(g.block)
+	l.stop(context.Background())
+
+	handled := g.from(a.addr.String())
+	if len(handled) != 50 {
+		t.Fatalf("expected 50 packets handled, got %d", len(handled))
+	}
+	for i, p := range handled {
+		if p != byte(i) {
+			t.Fatalf("expected packet %d handled in turn, got %v", i, handled)
+		}
+	}
+}
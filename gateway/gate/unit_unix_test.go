@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// A forwarder with a unix datagram socket of its own at path
+func newUnixClient(t *testing.T, path string) *net.UnixConn {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("no unix datagram sockets: %v", err)
+	}
+	t.Cleanup(func() { conn.Close(); os.Remove(path) })
+	return conn
+}
+
+func unixExpect(t *testing.T, conn net.PacketConn, msgType byte) Message {
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("expected %s, got %v", MessageNames[msgType], err)
+	}
+	m, err := ReadPacket(bytes.NewBuffer(buf[:n]))
+	if err != nil {
+		t.Fatalf("ReadPacket: %v", err)
+	}
+	if m.MessageType() != msgType {
+		t.Fatalf("expected %s, got %s", MessageNames[msgType], MessageNames[m.MessageType()])
+	}
+	return m
+}
+
+// Forwarders can reach either gateway over a unix socket, whose
+// file is set up and cleaned up by the gateway
+func Test_unix_socket(t *testing.T) {
+	dir := t.TempDir()
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1"})
+	ag.mqttclient = &fakeBroker{}
+	tg, _, _ := newTestTGateway(t)
+	tg.address = "127.0.0.1:0"
+
+	for _, g := range []struct {
+		name    string
+		gw      Gateway
+		ts      *transports
+		clients *Clients
+	}{
+		{"aggregating", ag, &ag.transports, &ag.clients},
+		{"transparent", tg, &tg.transports, &tg.clients},
+	} {
+		t.Run(g.name, func(t *testing.T) {
+			path := filepath.Join(dir, g.name+".sock")
+			g.ts.unixPath, g.ts.unixMode = path, 0640
+
+			// left by a gateway that did not stop cleanly
+			stale, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+			if err != nil {
+				t.Skipf("no unix datagram sockets: %v", err)
+			}
+			stale.Close()
+
+			if err := g.gw.Start(); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			if fi, err := os.Stat(path); err != nil || fi.Mode()&os.ModePerm != 0640 {
+				t.Fatalf("socket file %v, %v", fi, err)
+			}
+
+			c := newUnixClient(t, filepath.Join(dir, g.name+".client"))
+			gwaddr := &net.UnixAddr{Name: path, Net: "unixgram"}
+			if err := (uConn{c, 0, nil}).WriteTo(connectMessage("forwarder", false), uAddr{gwaddr}); err != nil {
+				t.Fatalf("WriteTo: %v", err)
+			}
+			if ca := unixExpect(t, c, CONNACK).(*ConnackMessage); ca.ReturnCode != ACCEPTED {
+				t.Fatalf("CONNECT over a unix socket: rc %d", ca.ReturnCode)
+			}
+			(uConn{c, 0, nil}).WriteTo(NewMessage(PINGREQ), uAddr{gwaddr})
+			unixExpect(t, c, PINGRESP)
+			if g.clients.Len() != 1 {
+				t.Fatalf("expected 1 client, have %d", g.clients.Len())
+			}
+
+			if l, err := listenUnix(path, 0600, defaultMaxMessageSize, g.gw); err == nil {
+				l.stop(context.Background())
+				t.Fatalf("listened on a socket in use")
+			}
+			if err := g.gw.Stop(context.Background()); err != nil {
+				t.Fatalf("Stop: %v", err)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Fatalf("socket file left behind: %v", err)
+			}
+		})
+	}
+}
+
+func Test_unix_socket_not_a_socket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1", unixsocket: path})
+	ag.mqttclient = &fakeBroker{}
+	if err := ag.Start(); err == nil {
+		ag.Stop(context.Background())
+		t.Fatalf("started on a file that is not a socket")
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "data" {
+		t.Fatalf("the file was replaced")
+	}
+}
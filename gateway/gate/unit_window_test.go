@@ -0,0 +1,194 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// A window whose publishes complete when released, recording
+// the order they are answered in
+type testWindow struct {
+	*publishWindow
+	sync.Mutex
+	issued   chan string
+	release  map[string]chan error
+	answered []string
+}
+
+func newTestWindow(size, queue int) *testWindow {
+	tw := &testWindow{issued: make(chan string, 10), release: make(map[string]chan error)}
+	tw.publishWindow = newPublishWindow(size, queue, func(topic string, m *PublishMessage) (func() error, bool) {
+		tw.Lock()
+		c := make(chan error, 1)
+		tw.release[topic] = c
+		tw.Unlock()
+		tw.issued <- topic
+		return func() error { return <-c }, !strings.HasPrefix(topic, "held")
+	})
+	return tw
+}
+
+func (tw *testWindow) submit(client *Client, topic string) {
+	tw.publishWindow.submit(client, topic, &PublishMessage{}, func(err error) {
+		tw.Lock()
+		tw.answered = append(tw.answered, fmt.Sprintf("%s %v", topic, err))
+		tw.Unlock()
+	})
+}
+
+func (tw *testWindow) complete(topic string, err error) {
+	tw.Lock()
+	c := tw.release[topic]
+	tw.Unlock()
+	c <- err
+}
+
+func (tw *testWindow) expectIssued(t *testing.T, topics ...string) {
+	for _, want := range topics {
+		select {
+		case got := <-tw.issued:
+			if got != want {
+				t.Fatalf("expected %s issued, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s issued", want)
+		}
+	}
+}
+
+func (tw *testWindow) expectAnswered(t *testing.T, answers ...string) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		tw.Lock()
+		got := fmt.Sprint(tw.answered)
+		tw.Unlock()
+		if got == fmt.Sprint(answers) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v answered, got %s", answers, got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Publishes are in flight together, but each client's are
+// answered in the order it sent them
+func Test_publishWindow_order(t *testing.T) {
+	tw := newTestWindow(3, 0)
+	tw.start()
+	defer tw.stop()
+	a, b := &Client{}, &Client{}
+	tw.submit(a, "a1")
+	tw.submit(a, "a2")
+	tw.submit(b, "b1")
+	tw.expectIssued(t, "a1", "a2", "b1")
+
+	tw.complete("a2", nil)
+	tw.complete("b1", nil)
+	tw.expectAnswered(t, "b1 <nil>")
+	tw.complete("a1", ErrBrokerTimeout)
+	tw.expectAnswered(t, "b1 <nil>", "a1 "+ErrBrokerTimeout.Error(), "a2 <nil>")
+}
+
+// Beyond the window publishes are queued, and beyond the queue
+// refused, in their turn
+func Test_publishWindow_full(t *testing.T) {
+	tw := newTestWindow(1, 1)
+	tw.start()
+	a := &Client{}
+	tw.submit(a, "1")
+	tw.expectIssued(t, "1")
+	tw.submit(a, "2")
+	tw.submit(a, "3")
+	tw.expectAnswered(t)
+
+	tw.complete("1", nil)
+	tw.expectIssued(t, "2")
+	tw.expectAnswered(t, "1 <nil>")
+	tw.submit(a, "4")
+	tw.complete("2", nil)
+	tw.expectAnswered(t, "1 <nil>", "2 <nil>", "3 "+ErrWindowFull.Error())
+
+	// stopping answers what is queued, once in flight is done
+	tw.expectIssued(t, "4")
+	tw.submit(a, "5")
+	go tw.complete("4", nil)
+	tw.stop()
+	tw.expectAnswered(t, "1 <nil>", "2 <nil>", "3 "+ErrWindowFull.Error(), "4 <nil>", "5 "+ErrBrokerUnavailable.Error())
+}
+
+// Publishes held for the broker wait without taking up the
+// window
+func Test_publishWindow_held(t *testing.T) {
+	tw := newTestWindow(1, 0)
+	tw.start()
+	defer tw.stop()
+	a := &Client{}
+	tw.submit(a, "held1")
+	tw.submit(a, "held2")
+	tw.submit(a, "1")
+	tw.expectIssued(t, "held1", "held2", "1")
+	tw.complete("1", nil)
+	tw.complete("held2", nil)
+	tw.expectAnswered(t)
+	tw.complete("held1", nil)
+	tw.expectAnswered(t, "held1 <nil>", "held2 <nil>", "1 <nil>")
+}
+
+func Test_AGateway_upstream_window(t *testing.T) {
+	ag := NewAGateway(&GatewayConfig{bindaddress: "127.0.0.1", upstreaminflight: 4})
+	broker := &fakeBroker{}
+	ag.mqttclient = broker
+	if err := ag.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer ag.Stop(context.Background())
+
+	f := newFakeClient(t)
+	ag.handle_CONNECT(connectMessage("c", false), uConn{ag.listener.conns[0], 0, nil}, f.addr())
+	f.expect(CONNACK)
+	client := ag.clients.GetClient(f.addr())
+	ag.handle_REGISTER(NewRegisterMessage(0, 1, []byte("a")), client)
+	topicid := f.expect(REGACK).(*RegackMessage).TopicId
+	for i := uint16(1); i <= 3; i++ {
+		ag.handle_PUBLISH(NewPublishMessage(topicid, 0, []byte{byte(i)}, 1, i, false, false), client)
+	}
+	for i := uint16(1); i <= 3; i++ {
+		if pa := f.expect(PUBACK).(*PubackMessage); pa.MessageId != i || pa.ReturnCode != ACCEPTED {
+			t.Fatalf("expected PUBACK %d accepted, got %d rc %d", i, pa.MessageId, pa.ReturnCode)
+		}
+	}
+}
+
+// Publishes through windows of 1 to 64 to a broker taking a
+// millisecond to answer each
+func Benchmark_publishWindow(b *testing.B) {
+	for _, size := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			w := newPublishWindow(size, b.N, func(string, *PublishMessage) (func() error, bool) {
+				done := time.After(time.Millisecond)
+				return func() error {
+					<-done
+					return nil
+				}, true
+			})
+			w.start()
+			defer w.stop()
+			var wg sync.WaitGroup
+			wg.Add(b.N)
+			client := &Client{}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.submit(client, "a", &PublishMessage{}, func(error) { wg.Done() })
+			}
+			wg.Wait()
+		})
+	}
+}
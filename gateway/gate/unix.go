@@ -0,0 +1,82 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// A unix datagram socket feeding packets to a Gateway, for
+// forwarders on the same host. Each forwarder must bind a
+// socket of its own to be answered. The socket file is removed
+// when the listener stops.
+type unixListener struct {
+	*listener
+	path string
+}
+
+// Listen on a unix datagram socket at path with the given
+// file mode, for packets of up to size bytes. A socket left at path by a gateway that did not
+// stop cleanly is removed; one in use, or any other file, is
+// an error.
+func listenUnix(path string, mode os.FileMode, size int, g Gateway) (*unixListener, error) {
+	if conn, err := inheritedUnix(path); err != nil {
+		return nil, err
+	} else if conn != nil {
+		// systemd made the socket, and removes it
+		INFO.Printf("listening on unix socket %s, passed by systemd\n", path)
+		l := newListener(g, size, conn)
+		l.inherited = true
+		return &unixListener{l, path}, nil
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %s: %v", path, err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		conn.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	INFO.Printf("listening on unix socket %s\n", path)
+	return &unixListener{newListener(g, size, conn), path}, nil
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("cannot listen on %s: %v", path, ErrNotASocket)
+	}
+	if conn, err := net.Dial("unixgram", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("cannot listen on %s: %v", path, ErrSocketInUse)
+	} else if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	INFO.Printf("removing stale unix socket %s\n", path)
+	return os.Remove(path)
+}
+
+// Stop listening and remove the socket file, unless systemd
+// made it
+func (l *unixListener) stop(ctx context.Context) error {
+	err := l.listener.stop(ctx)
+	if l.inherited {
+		return err
+	}
+	if rerr := os.Remove(l.path); rerr != nil && !os.IsNotExist(rerr) {
+		ERROR.Println(rerr)
+	}
+	return err
+}
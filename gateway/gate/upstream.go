@@ -0,0 +1,592 @@
+package gateway
+
+import (
+	"encoding/gob"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// The longest the aggregating gateway waits between attempts to
+// connect to the broker again; a variable so tests can shorten
+// it
+var maxReconnectInterval = time.Minute
+
+// What is done while the broker is unreachable with a CONNECT
+// from a new client, and with what clients publish
+const (
+	offlineBuffer   = "buffer"   // accept it, holding what is published
+	offlineDegraded = "degraded" // accept it, refusing what is published
+	offlineReject   = "reject"   // refuse it with congestion, holding what is published
+)
+
+// The states of the aggregating gateway's broker connection
+const (
+	BrokerDisconnected = "disconnected" // not started, or stopped
+	BrokerConnecting   = "connecting"   // starting, or connecting again
+	BrokerConnected    = "connected"
+)
+
+// The state of one of the aggregating gateway's broker
+// connections, since when it has been in it, and the last error
+// it had, if any. Upstream is the name of the broker, empty for
+// the gateway's own.
+type BrokerState struct {
+	State     string
+	Since     time.Time
+	LastError error
+	Upstream  string
+}
+
+// The aggregating gateway's connection to the broker, which is
+// connected again whenever it is lost, and the PUBLISHes from
+// clients held while it is down: up to maxHeld at QoS 1 and 2,
+// and maxHeldQos0 at QoS 0 and -1. Once connected again what is
+// held is published in order, inflight at a time. If
+// keepSession the broker keeps the gateway's session, and what
+// its subscriptions match, while it is disconnected; session
+// holds the filters the gateway is subscribed to in it.
+type upstream struct {
+	sync.Mutex
+	offline     bool
+	held        []*heldPublish
+	heldQos0    int
+	maxHeld     int
+	maxHeldQos0 int
+	ackEarly    bool
+	connects    string
+	rejects     uint64
+	inflight    int
+	file        string
+	drops       uint64
+	reconnects  uint64
+	state       BrokerState
+	keepSession bool
+	session     map[string]bool
+	done        chan struct{}
+	wg          sync.WaitGroup
+
+	connectTimeout time.Duration
+	publishTimeout time.Duration
+	name           string
+	client         mqttClient // nil for the gateway's own broker
+}
+
+// A PUBLISH from a client for the broker, held until the
+// gateway is connected to it again. Unless the client has been
+// answered already, the outcome is sent on published.
+type heldPublish struct {
+	topic     string
+	m         *PublishMessage
+	published chan error
+}
+
+func newUpstream(gc *GatewayConfig) *upstream {
+	u := &upstream{
+		maxHeld:     gc.offlinequeue,
+		maxHeldQos0: gc.offlinequeue / 4,
+		ackEarly:    gc.offlineackearly,
+		connects:    gc.offlineConnects(),
+		state:       BrokerState{State: BrokerDisconnected, Since: time.Now()},
+		inflight:    1,
+		file:        gc.offlinequeuefile,
+		keepSession: gc.mqttsession,
+		session:     make(map[string]bool),
+
+		connectTimeout: gc.brokerConnectTimeout(),
+		publishTimeout: gc.publishTimeout(),
+	}
+	if gc.offlinequeueqos0 > 0 {
+		u.maxHeldQos0 = gc.offlinequeueqos0
+	}
+	if gc.upstreaminflight > 1 {
+		u.inflight = gc.upstreaminflight
+	}
+	return u
+}
+
+// Whether the gateway is connected to the broker
+func (ag *AGateway) BrokerConnected() bool {
+	defer ag.upstream.Unlock()
+	ag.upstream.Lock()
+	return !ag.upstream.offline
+}
+
+// The state of the broker connection
+func (ag *AGateway) BrokerState() BrokerState {
+	return ag.upstream.brokerState()
+}
+
+// The state of the connection to every broker, the gateway's own
+// first, then those named by upstream-broker
+func (ag *AGateway) BrokerStates() []BrokerState {
+	var states []BrokerState
+	for _, u := range ag.upstreams() {
+		states = append(states, u.brokerState())
+	}
+	return states
+}
+
+func (u *upstream) brokerState() BrokerState {
+	defer u.Unlock()
+	u.Lock()
+	s := u.state
+	s.Upstream = u.name
+	return s
+}
+
+// Move u's broker connection to state, noting err if not nil,
+// and tell the OnBrokerState hook if the state changed
+func (ag *AGateway) brokerState(u *upstream, state string, err error) {
+	u.Lock()
+	changed := u.state.State != state
+	if changed {
+		u.state.State, u.state.Since = state, time.Now()
+	}
+	if err != nil {
+		u.state.LastError = err
+	}
+	s := u.state
+	s.Upstream = u.name
+	u.Unlock()
+	if changed && ag.hooks.OnBrokerState != nil {
+		ag.hookq.push(func() { ag.hooks.OnBrokerState(s) })
+	}
+}
+
+// Whether the gateway is serving its clients without one of its
+// brokers, for health checks
+func (ag *AGateway) Degraded() bool {
+	for _, u := range ag.upstreams() {
+		u.Lock()
+		offline := u.offline
+		u.Unlock()
+		if offline {
+			return true
+		}
+	}
+	return false
+}
+
+// What u is called in the log
+func (u *upstream) String() string {
+	if u.name == "" {
+		return "the broker"
+	}
+	return "the " + u.name + " broker"
+}
+
+// Connect to u's broker as the gateway starts
+func (ag *AGateway) connectUpstream(u *upstream) error {
+	ag.brokerState(u, BrokerConnecting, nil)
+	token := ag.brokerOf(u).Connect()
+	if !token.WaitTimeout(u.connectTimeout) {
+		abandonConnect(ag.brokerOf(u), token)
+		ag.brokerState(u, BrokerDisconnected, ErrBrokerTimeout)
+		return ErrBrokerTimeout
+	} else if err := token.Error(); err != nil {
+		ag.brokerState(u, BrokerDisconnected, err)
+		return err
+	}
+	ag.brokerState(u, BrokerConnected, nil)
+	if sessionPresent(token) {
+		// what the gateway was subscribed to before it started
+		// is not known, and goes undelivered
+		INFO.Printf("resumed the session on %s\n", u)
+	}
+	return nil
+}
+
+func (ag *AGateway) disconnectUpstreams(us []*upstream) {
+	for _, u := range us {
+		ag.brokerOf(u).Disconnect(500)
+		ag.brokerState(u, BrokerDisconnected, nil)
+	}
+}
+
+// How many CONNECTs from new clients were refused for the broker
+// being unreachable
+func (ag *AGateway) OfflineConnectRejects() uint64 {
+	return atomic.LoadUint64(&ag.upstream.rejects)
+}
+
+// ErrBrokerOffline if a new client is not to be accepted, the
+// broker being unreachable
+func (u *upstream) admit() error {
+	defer u.Unlock()
+	u.Lock()
+	if u.offline && u.connects == offlineReject {
+		atomic.AddUint64(&u.rejects, 1)
+		return ErrBrokerOffline
+	}
+	return nil
+}
+
+// How many times the gateway has connected to its brokers again
+// after losing its connection
+func (ag *AGateway) BrokerReconnects() uint64 {
+	var n uint64
+	for _, u := range ag.upstreams() {
+		n += atomic.LoadUint64(&u.reconnects)
+	}
+	return n
+}
+
+// How many PUBLISHes are held until their broker can be reached
+func (ag *AGateway) OfflineQueueDepth() int {
+	n := 0
+	for _, u := range ag.upstreams() {
+		u.Lock()
+		n += len(u.held)
+		u.Unlock()
+	}
+	return n
+}
+
+// How many PUBLISHes have been dropped for their broker being
+// unreachable: those beyond what can be held, and those held
+// when the gateway stopped
+func (ag *AGateway) OfflineQueueDrops() uint64 {
+	var n uint64
+	for _, u := range ag.upstreams() {
+		n += atomic.LoadUint64(&u.drops)
+	}
+	return n
+}
+
+// Start watching for the broker connection being lost, the
+// gateway having just connected
+func (u *upstream) start() {
+	u.Lock()
+	u.offline = false
+	u.done = make(chan struct{})
+	u.Unlock()
+}
+
+// Stop connecting again, dropping whatever is held, or saving
+// what has been acknowledged to the queue file if there is one
+func (u *upstream) stop() {
+	u.Lock()
+	if u.done != nil {
+		close(u.done)
+		u.done = nil
+	}
+	var saved []*heldPublish
+	for _, h := range u.held {
+		if h.published == nil && u.file != "" {
+			saved = append(saved, h)
+			continue
+		}
+		atomic.AddUint64(&u.drops, 1)
+		if h.published != nil {
+			h.published <- ErrBrokerUnavailable
+		}
+	}
+	if dropped := len(u.held) - len(saved); dropped > 0 {
+		ERROR.Printf("dropping %d messages held for the broker\n", dropped)
+	}
+	if len(saved) > 0 {
+		if err := saveHeld(u.file, saved); err != nil {
+			atomic.AddUint64(&u.drops, uint64(len(saved)))
+			ERROR.Printf("could not save %d messages held for the broker: %v\n", len(saved), err)
+		}
+	}
+	u.held, u.heldQos0 = nil, 0
+	u.Unlock()
+	u.wg.Wait()
+}
+
+// The broker connection has been lost
+func (ag *AGateway) brokerLost(err error) {
+	ag.upstreamLost(ag.upstream, err)
+}
+
+// The connection to u's broker has been lost. The gateway
+// connects again, waiting twice as long after each failure up to
+// maxReconnectInterval, until it succeeds or is stopped.
+func (ag *AGateway) upstreamLost(u *upstream, err error) {
+	ERROR.Printf("lost the connection to %s: %v\n", u, err)
+	u.Lock()
+	if u.done == nil || u.offline {
+		u.Unlock()
+		return
+	}
+	u.offline = true
+	done := u.done
+	u.wg.Add(1)
+	u.Unlock()
+	ag.brokerState(u, BrokerConnecting, err)
+	if u == ag.upstream {
+		ag.brokerConnection(false)
+	}
+	go ag.reconnect(u, done)
+}
+
+func (ag *AGateway) reconnect(u *upstream, done chan struct{}) {
+	defer u.wg.Done()
+	interval := reconnectInterval
+	var token MQTT.Token
+	for {
+		select {
+		case <-done:
+			if token != nil {
+				abandonConnect(ag.brokerOf(u), token)
+			}
+			return
+		case <-time.After(interval):
+		}
+		// a connect that timed out is still trying, and is waited
+		// for again rather than started over
+		if token == nil {
+			token = ag.brokerOf(u).Connect()
+		}
+		err := ErrBrokerTimeout
+		if token.WaitTimeout(u.connectTimeout) {
+			if err = token.Error(); err == nil {
+				break
+			}
+			token = nil
+		}
+		ERROR.Printf("could not reconnect to %s: %v\n", u, err)
+		ag.brokerState(u, BrokerConnecting, err)
+		if interval *= 2; interval > maxReconnectInterval {
+			interval = maxReconnectInterval
+		}
+	}
+	present := sessionPresent(token)
+	if present {
+		INFO.Printf("reconnected to %s, resuming the session\n", u)
+	} else {
+		INFO.Printf("reconnected to %s\n", u)
+	}
+	atomic.AddUint64(&u.reconnects, 1)
+	select {
+	case <-done:
+		return
+	default:
+	}
+	ag.resubscribe(u, present)
+	if !ag.releaseHeld(u, done) {
+		return
+	}
+	ag.brokerState(u, BrokerConnected, nil)
+	if u == ag.upstream {
+		ag.announce(true)
+		ag.brokerConnection(true)
+	}
+}
+
+// Subscribe again to every filter that has a subscriber, as a
+// broker that has restarted has forgotten them. If the broker
+// resumed the session instead, only the filters missing from it
+// are subscribed to, and those in it no one is subscribed to any
+// longer are unsubscribed from.
+func (ag *AGateway) resubscribe(u *upstream, present bool) {
+	kept := u.takeSession()
+	if !present {
+		kept = nil
+	}
+	wanted := make(map[string]bool)
+	for _, filter := range ag.tTree.Filters() {
+		if !containsUpstream(ag.upstreamsOf(filter), u) {
+			continue
+		}
+		wanted[filter] = true
+		if kept[filter] {
+			u.subscribed(filter)
+		} else if err := ag.subscribeBroker(u, filter); err != nil {
+			ERROR.Printf("could not subscribe to \"%s\" again: %v\n", filter, err)
+		}
+	}
+	var stale []string
+	for filter := range kept {
+		if !wanted[filter] {
+			stale = append(stale, filter)
+		}
+	}
+	ag.unsubscribeBroker(u, stale)
+}
+
+// Publish what was held while the broker was unreachable, in
+// the order it arrived, then let publishes through again,
+// unless the gateway has stopped meanwhile
+func (ag *AGateway) releaseHeld(u *upstream, done chan struct{}) bool {
+	defer u.Unlock()
+	u.Lock()
+	if u.done != done {
+		return false
+	}
+	ag.publishHeld(u, u.held)
+	u.held, u.heldQos0 = nil, 0
+	u.offline = false
+	return true
+}
+
+// Publish held in order, with up to u's inflight at a time
+// waiting for its broker, answering the clients waiting on them
+func (ag *AGateway) publishHeld(u *upstream, held []*heldPublish) {
+	type issued struct {
+		h    *heldPublish
+		wait func() error
+	}
+	var pending []issued
+	complete := func() {
+		p := pending[0]
+		pending = pending[1:]
+		err := p.wait()
+		if err != nil {
+			ERROR.Printf("could not publish a held message on \"%s\": %v\n", p.h.topic, err)
+		}
+		if p.h.published != nil {
+			p.h.published <- err
+		}
+	}
+	for _, h := range held {
+		if len(pending) == u.inflight {
+			complete()
+		}
+		pending = append(pending, issued{h, ag.issueBroker(h.topic, h.m)})
+	}
+	for len(pending) > 0 {
+		complete()
+	}
+}
+
+// Hold m while the broker is unreachable, returning false if it
+// is reachable, or the gateway stopped. What is returned waits
+// for m to be published, unless it is acknowledged at once: at
+// QoS 0 or -1, or if acknowledging early. It is
+// ErrBrokerUnavailable if no more can be held, or nothing is
+// while degraded.
+func (u *upstream) hold(topic string, m *PublishMessage) (func() error, bool) {
+	defer u.Unlock()
+	u.Lock()
+	if !u.offline || u.done == nil {
+		return nil, false
+	}
+	qos0 := m.Qos == 0 || m.Qos == 3
+	if u.connects == offlineDegraded || qos0 && u.heldQos0 >= u.maxHeldQos0 || !qos0 && len(u.held)-u.heldQos0 >= u.maxHeld {
+		atomic.AddUint64(&u.drops, 1)
+		return func() error { return ErrBrokerUnavailable }, true
+	}
+	h := &heldPublish{topic: topic, m: m}
+	u.held = append(u.held, h)
+	if qos0 {
+		u.heldQos0++
+		return func() error { return nil }, true
+	} else if u.ackEarly {
+		return func() error { return nil }, true
+	}
+	h.published = make(chan error, 1)
+	return func() error { return <-h.published }, true
+}
+
+// Whether the broker resumed the session it kept for the
+// gateway, which it only does if asked to keep it
+func sessionPresent(token MQTT.Token) bool {
+	sp, ok := token.(interface {
+		SessionPresent() bool
+	})
+	return ok && sp.SessionPresent()
+}
+
+// The gateway is subscribed to filter in its broker session
+func (u *upstream) subscribed(filter string) {
+	u.Lock()
+	u.session[filter] = true
+	u.Unlock()
+}
+
+// The filters in the gateway's broker session, forgetting them
+func (u *upstream) takeSession() map[string]bool {
+	defer u.Unlock()
+	u.Lock()
+	session := u.session
+	u.session = make(map[string]bool)
+	return session
+}
+
+// Tell the OnBrokerConnection hook the broker connection is up
+// or down
+func (ag *AGateway) brokerConnection(up bool) {
+	if ag.hooks.OnBrokerConnection != nil {
+		ag.hookq.push(func() { ag.hooks.OnBrokerConnection(up) })
+	}
+}
+
+// A held PUBLISH as it is saved to the queue file
+type savedPublish struct {
+	Topic  string
+	Qos    byte
+	Retain bool
+	Data   []byte
+}
+
+// Write held to file, replacing it whole
+func saveHeld(file string, held []*heldPublish) error {
+	saved := make([]savedPublish, len(held))
+	for i, h := range held {
+		saved[i] = savedPublish{h.topic, h.m.Qos, h.m.Retain, h.m.Data}
+	}
+	f, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(saved)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file + ".tmp")
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// Read what was saved to file, none if it does not exist
+func loadHeld(file string) ([]*heldPublish, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var saved []savedPublish
+	if err := gob.NewDecoder(f).Decode(&saved); err != nil {
+		return nil, err
+	}
+	held := make([]*heldPublish, len(saved))
+	for i, s := range saved {
+		m := NewMessage(PUBLISH).(*PublishMessage)
+		m.Qos, m.Retain, m.Data = s.Qos, s.Retain, s.Data
+		held[i] = &heldPublish{topic: s.Topic, m: m}
+	}
+	return held, nil
+}
+
+// Publish what was saved to the queue file when the gateway last
+// stopped, then remove it
+func (ag *AGateway) publishSaved() {
+	file := ag.upstream.file
+	if file == "" {
+		return
+	}
+	held, err := loadHeld(file)
+	if err != nil {
+		ERROR.Printf("could not read the messages saved for the broker: %v\n", err)
+		return
+	}
+	if len(held) > 0 {
+		INFO.Printf("publishing %d messages saved for the broker\n", len(held))
+		ag.publishHeld(ag.upstream, held)
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		ERROR.Println(err)
+	}
+}
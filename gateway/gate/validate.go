@@ -0,0 +1,262 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every problem a configuration has
+type ConfigErrors []*ConfigError
+
+func (es ConfigErrors) Error() string {
+	s := make([]string, len(es))
+	for i, e := range es {
+		s[i] = e.Error()
+	}
+	return fmt.Sprintf("Invalid configuration, %d problem(s): %s", len(es), strings.Join(s, "; "))
+}
+
+func (es ConfigErrors) Unwrap() []error {
+	errs := make([]error, len(es))
+	for i, e := range es {
+		errs[i] = e
+	}
+	return errs
+}
+
+// Check gc as a whole, as its options are each checked as they
+// are set, returning every problem it has as ConfigErrors: a
+// missing or unusable broker, ports out of range, listen
+// addresses that do not parse, negative timers, options needing
+// others that are not given, and options that cannot be given
+// together
+func (gc *GatewayConfig) Validate() error {
+	var es ConfigErrors
+	problem := func(key string, err error) {
+		es = append(es, &ConfigError{key, err})
+	}
+
+	if gc.mqttbroker == "" {
+		problem("mqtt-broker", ErrMissingValueForConfigOption)
+	} else if err := checkBrokerURL(gc.mqttbroker); err != nil {
+		problem("mqtt-broker", err)
+	}
+	for _, uc := range gc.upstreams {
+		if _, err := checkURI(uc.broker); err != nil {
+			problem("upstream-broker "+uc.name, err)
+		} else if err := checkBrokerURL(uc.broker); err != nil {
+			problem("upstream-broker "+uc.name, err)
+		}
+	}
+
+	for _, p := range []struct {
+		key  string
+		port int
+	}{
+		{"port", gc.port},
+		{"dtls-port", gc.dtlsport},
+		{"tcp-port", gc.tcpport},
+	} {
+		if p.port < 0 || p.port > 65535 {
+			problem(p.key, ErrOutOfRange)
+		}
+	}
+	for i, lc := range gc.listeners {
+		if err := checkListenAddress(lc); err != nil {
+			problem(fmt.Sprintf("listeners[%d]", i), err)
+		}
+	}
+	for _, key := range gc.duplicateListeners() {
+		problem(key, ErrDuplicateListener)
+	}
+
+	for _, t := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"mqtt-keepalive", gc.mqtttimeout},
+		{"connect-timeout", gc.connecttimeout},
+		{"publish-timeout", gc.publishtimeout},
+		{"drain-timeout", gc.draintimeout},
+		{"tcp-idle-timeout", gc.tcpidletimeout},
+		{"connection-idle-timeout", gc.idletimeout},
+		{"advertise-interval", gc.advertiseinterval},
+		{"keepalive-max", gc.keepalivemax},
+		{"keepalive-default", gc.keepalivedefault},
+		{"fault-delay", gc.faultdelay},
+		{"fault-jitter", gc.faultjitter},
+		{"log-max-age", gc.logmaxage},
+		{"sys-interval", gc.sysinterval},
+		{"log-trace-duration", gc.traceduration},
+	} {
+		if t.value < 0 {
+			problem(t.key, ErrNegative)
+		}
+	}
+	for _, t := range []struct {
+		key   string
+		value int
+	}{
+		{"keepalive-multiplier", gc.keepalivemultiplier},
+		{"max-clients", gc.maxclients},
+		{"max-topics", gc.maxtopics},
+		{"client-queue", gc.clientqueue},
+		{"client-queue-bytes", gc.clientbytes},
+		{"client-inflight", gc.clientwindow},
+		{"client-publish-rate", gc.publishrate},
+		{"client-publish-bytes", gc.publishbytes},
+		{"client-publish-violations", gc.violations},
+		{"max-connections", gc.maxconnections},
+		{"max-broker-connections", gc.maxbrokerconns},
+		{"upstream-inflight", gc.upstreaminflight},
+		{"upstream-queue", gc.upstreamqueue},
+		{"broker-offline-queue", gc.offlinequeue},
+		{"broker-offline-queue-qos0", gc.offlinequeueqos0},
+		{"log-max-size", gc.logmaxsize},
+		{"log-max-backups", gc.logmaxbackups},
+		{"admin-pprof-mutex-fraction", gc.adminpprofmutex},
+		{"admin-pprof-block-rate", gc.adminpprofblock},
+		{"capture-max-size", gc.capturemaxsize},
+		{"capture-max-backups", gc.capturemaxbackups},
+		{"events-rate", gc.eventsrate},
+		{"source-deny-log", gc.sourcedenylog},
+		{"unconnected-packet-rate", gc.unconnectedrate},
+		{"unconnected-address-rate", gc.unconnectedaddrs},
+		{"audit-max-size", gc.auditmaxsize},
+		{"audit-max-backups", gc.auditmaxbackups},
+	} {
+		if t.value < 0 {
+			problem(t.key, ErrNegative)
+		}
+	}
+
+	if gc.dtlsport != 0 && gc.dtlspskfile == "" && gc.dtlscertfile == "" {
+		problem("dtls-port", ErrNoDTLSCredentials)
+	}
+	if gc.dtlsclientcertrequired && gc.dtlsclientcafile == "" {
+		problem("dtls-client-cert-required", ErrNoClientCA)
+	}
+	if (gc.mqttcertfile == "") != (gc.mqttkeyfile == "") {
+		problem("mqtt-cert-file", ErrIncompleteBrokerCert)
+	}
+	if gc.adminpprof {
+		if gc.adminaddress == "" {
+			problem("admin-pprof", ErrNoAdminAddress)
+		} else if !gc.adminpprofpublic && !loopback(gc.adminaddress) {
+			problem("admin-pprof", ErrPprofNotLoopback)
+		}
+	}
+	if gc.capture && gc.capturefile == "" {
+		problem("capture-enabled", ErrNoCaptureFile)
+	}
+	if gc.logDestination() == logSyslog {
+		if !syslogSupported {
+			problem("log-destination", ErrNoSyslog)
+		} else if gc.logFormat() != logText {
+			problem("log-format", ErrSyslogFormat)
+		}
+	}
+
+	if len(es) > 0 {
+		ERROR.Println(es)
+		return es
+	}
+	return nil
+}
+
+// Whether address, host:port, is bound to the loopback
+// interface alone
+func loopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := parseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// A broker URL must name a host as well as its transport
+func checkBrokerURL(broker string) error {
+	u, err := url.Parse(broker)
+	if err != nil || u.Host == "" {
+		return ErrInvalidBrokerURL
+	}
+	return nil
+}
+
+// The address of a udp, dtls or tcp listener must be host:port,
+// that of a unix or serial one a path
+func checkListenAddress(lc listenerConfig) error {
+	switch lc.kind {
+	case "unix", "serial":
+		return nil
+	}
+	host, port, err := net.SplitHostPort(lc.address)
+	if err == nil {
+		_, err = strconv.ParseUint(port, 10, 16)
+	}
+	if err != nil {
+		return ErrInvalidListener
+	}
+	if lc.kind == "udp6" && host != "" && (parseIP(host) == nil || parseIP(host).To4() != nil) {
+		return ErrInvalidListener
+	}
+	return nil
+}
+
+// The options of the listeners listening where one before them
+// does: on the same port of the same host over UDP, as UDP and
+// DTLS listeners both do, or TCP, or on the same socket path or
+// serial device. Ports chosen by the system are never the same.
+func (gc *GatewayConfig) duplicateListeners() []string {
+	type listening struct {
+		network, address string
+	}
+	seen := make(map[listening]bool)
+	var dups []string
+	add := func(key, kind, address string) {
+		if address == "" {
+			return
+		}
+		l := listening{kind, address}
+		switch kind {
+		case "udp", "udp6", "dtls", "tcp":
+			host, port, err := net.SplitHostPort(address)
+			if err != nil || port == "0" {
+				return
+			}
+			if host == "0.0.0.0" {
+				host = ""
+			}
+			l = listening{"udp", net.JoinHostPort(host, port)}
+			if kind == "tcp" {
+				l.network = "tcp"
+			}
+		case "unix", "serial":
+			l.address = filepath.Clean(address)
+		}
+		if seen[l] {
+			dups = append(dups, key)
+		}
+		seen[l] = true
+	}
+	if gc.port != 0 {
+		add("port", "udp", gc.listenAddress())
+	}
+	add("dtls-port", "dtls", gc.dtlsAddress())
+	add("tcp-port", "tcp", gc.tcpAddress())
+	add("unix-socket", "unix", gc.unixsocket)
+	add("serial-device", "serial", gc.serialdevice)
+	for i, lc := range gc.listeners {
+		add(fmt.Sprintf("listeners[%d]", i), lc.kind, lc.address)
+	}
+	return dups
+}
@@ -0,0 +1,176 @@
+package gateway
+
+import (
+	"sync"
+
+	. "github.com/alsm/gnatt/packets"
+)
+
+// The most PUBLISHes queued for the window unless configured,
+// beyond which clients are told of congestion
+const defaultWindowQueue = 256
+
+// PUBLISHes from clients being sent to the broker up to size at
+// a time, in the order they arrived, the rest queued. Each is
+// answered when the broker has it, but never before the same
+// client's earlier ones.
+type publishWindow struct {
+	sync.Mutex
+	slots   chan struct{}
+	queue   chan *windowed
+	pending map[*Client]*clientWindow
+	issue   func(topic string, m *PublishMessage) (func() error, bool)
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// A client's PUBLISHes in the window, in the order they
+// arrived, and whether they are being answered
+type clientWindow struct {
+	published []*windowed
+	answering bool
+}
+
+// A PUBLISH in the window, and what to answer its client with
+// once it and those before it are complete
+type windowed struct {
+	client   *Client
+	topic    string
+	m        *PublishMessage
+	answer   func(error)
+	complete bool
+	err      error
+}
+
+// A window of size, which sends a PUBLISH with issue, returning
+// what waits for the broker to have it and whether it is in
+// flight; one that is not (held while the broker is unreachable)
+// waits without taking up the window
+func newPublishWindow(size, queue int, issue func(string, *PublishMessage) (func() error, bool)) *publishWindow {
+	if queue <= 0 {
+		queue = defaultWindowQueue
+	}
+	return &publishWindow{
+		slots:   make(chan struct{}, size),
+		queue:   make(chan *windowed, queue),
+		pending: make(map[*Client]*clientWindow),
+		issue:   issue,
+	}
+}
+
+// The PUBLISHes in flight and those queued
+func (w *publishWindow) usage() (inflight, queued int) {
+	return len(w.slots), len(w.queue)
+}
+
+func (w *publishWindow) start() {
+	w.done = make(chan struct{})
+	w.wg.Add(1)
+	go w.dispatch(w.done)
+}
+
+// Stop sending, answering what is queued with
+// ErrBrokerUnavailable, and wait for what is in flight
+func (w *publishWindow) stop() {
+	if w.done == nil {
+		return
+	}
+	close(w.done)
+	w.done = nil
+	w.wg.Wait()
+	for {
+		select {
+		case p := <-w.queue:
+			w.completed(p, ErrBrokerUnavailable)
+		default:
+			return
+		}
+	}
+}
+
+// Queue m for the broker, answer being called with the outcome.
+// If the queue is full it is answered with ErrWindowFull, in its
+// turn.
+func (w *publishWindow) submit(client *Client, topic string, m *PublishMessage, answer func(error)) {
+	p := &windowed{client: client, topic: topic, m: m, answer: answer}
+	w.Lock()
+	cw := w.pending[client]
+	if cw == nil {
+		cw = &clientWindow{}
+		w.pending[client] = cw
+	}
+	cw.published = append(cw.published, p)
+	w.Unlock()
+	select {
+	case w.queue <- p:
+	default:
+		w.completed(p, ErrWindowFull)
+	}
+}
+
+// Send what is queued, in order, as slots free up. A slot is
+// taken before a PUBLISH, so that those waiting for one stay in
+// the queue.
+func (w *publishWindow) dispatch(done chan struct{}) {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-done:
+			return
+		case w.slots <- struct{}{}:
+		}
+		select {
+		case <-done:
+			return
+		case p := <-w.queue:
+			wait, inflight := w.issue(p.topic, p.m)
+			if !inflight {
+				<-w.slots
+			}
+			w.wg.Add(1)
+			go func() {
+				defer w.wg.Done()
+				err := wait()
+				if inflight {
+					<-w.slots
+				}
+				w.completed(p, err)
+			}()
+		}
+	}
+}
+
+// p is complete; answer it, and whatever of its client's was
+// waiting on it, unless something before it is not. Only one
+// completion answers a client at a time, so that the answers
+// go in order.
+func (w *publishWindow) completed(p *windowed, err error) {
+	w.Lock()
+	p.complete, p.err = true, err
+	cw := w.pending[p.client]
+	if cw.answering {
+		// it will answer p too
+		w.Unlock()
+		return
+	}
+	cw.answering = true
+	for {
+		var ready []*windowed
+		for len(cw.published) > 0 && cw.published[0].complete {
+			ready, cw.published = append(ready, cw.published[0]), cw.published[1:]
+		}
+		if len(ready) == 0 {
+			cw.answering = false
+			if len(cw.published) == 0 {
+				delete(w.pending, p.client)
+			}
+			w.Unlock()
+			return
+		}
+		w.Unlock()
+		for _, r := range ready {
+			r.answer(r.err)
+		}
+		w.Lock()
+	}
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	G "github.com/alsm/gnatt/gateway/gate"
 )
@@ -11,53 +17,157 @@ import (
 func main() {
 	var gateway G.Gateway
 	stopsig := registerSignals()
-	gatewayconf := setup()
-
-	G.InitLogger(os.Stdout, os.Stderr) // todo: configurable
+	// logging as configured once the configuration is read
+	G.InitLogger(os.Stdout, os.Stderr)
+	load, check := setup()
+	gatewayconf, err := load()
+	if check {
+		os.Exit(checkConfig(gatewayconf, err))
+	}
+	if err != nil {
+		G.ERROR.Fatal(err)
+	}
+	if err := G.ConfigureLogger(gatewayconf); err != nil {
+		G.ERROR.Fatal(err)
+	}
 
 	if gatewayconf.IsAggregating() {
 		G.INFO.Println("GNATT Gateway starting in aggregating mode")
-		gateway = initAggregating(gatewayconf, stopsig)
+		gateway = initAggregating(gatewayconf)
 	} else {
 		G.INFO.Println("GNATT Gateway starting in transparent mode")
-		gateway = initTransparent(gatewayconf, stopsig)
+		gateway = initTransparent(gatewayconf)
 	}
 
-	gateway.Start()
+	if err := gateway.Start(); err != nil {
+		G.ERROR.Fatal(err)
+	}
+
+	sig := <-stopsig
+	for ; sig == syscall.SIGHUP || sig == syscall.SIGUSR1; sig = <-stopsig {
+		if sig == syscall.SIGUSR1 {
+			// logrotate has moved the log file away
+			if err := G.ReopenLog(); err != nil {
+				G.ERROR.Println(err)
+			}
+			continue
+		}
+		// a configuration that cannot be read leaves the
+		// running one as it is
+		if r, ok := gateway.(reloader); ok {
+			if gc, err := load(); err != nil {
+				G.ERROR.Println(err)
+			} else if err := r.ReloadConfig(gc); err != nil {
+				G.ERROR.Println(err)
+			}
+		}
+	}
+	if sig == syscall.SIGUSR2 {
+		if d, ok := gateway.(drainer); ok {
+			if err := d.Drain(d.DrainTimeout()); err != nil {
+				G.ERROR.Println(err)
+			}
+			return
+		}
+		G.ERROR.Println("this gateway cannot drain, stopping")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := gateway.Stop(ctx); err != nil {
+		G.ERROR.Println(err)
+	}
 }
 
-func setup() *G.GatewayConfig {
-	var configFile string
-	var port int
+// A gateway that can reload parts of its configuration
+type reloader interface {
+	ReloadConfig(gc *G.GatewayConfig) error
+}
+
+// A gateway that can be drained of clients before stopping, for
+// the drain-timeout it runs with, as last reloaded
+type drainer interface {
+	Drain(deadline time.Duration) error
+	DrainTimeout() time.Duration
+}
 
-	flag.StringVar(&configFile, "c", "", "Configuration File")
-	flag.IntVar(&port, "port", 0, "MQTT-G UDP Listening Port")
+// Parse the flags, returning what loads the configuration of the
+// files given by -c, if any, each overriding those before it,
+// overridden by the environment and then by the flags, which may
+// be all of it if they give a broker and port, and validated, and
+// whether it is only to be checked
+func setup() (func() (*G.GatewayConfig, error), bool) {
+	var configFiles files
+	var format string
+	var printDefaults bool
+	var check bool
+
+	flag.Var(&configFiles, "c", "Configuration File, given again for each file overriding those before it")
+	flag.StringVar(&format, "format", "", "Configuration File format: plain, json or yaml (by its name unless given)")
+	flag.BoolVar(&printDefaults, "print-default-config", false, "Print every option with its default, as YAML, and exit")
+	flag.BoolVar(&check, "check", false, "Check the configuration and what it refers to, print a summary or its problems, and exit")
+	flags := G.NewConfigFlags(flag.CommandLine)
 	flag.Parse()
 
-	if configFile != "" {
-		if gc, err := G.ParseConfigFile(configFile); err != nil {
+	if printDefaults {
+		if err := G.PrintDefaultConfig(os.Stdout); err != nil {
 			G.ERROR.Fatal(err)
-		} else {
-			return gc
 		}
+		os.Exit(0)
+	}
+
+	return func() (*G.GatewayConfig, error) {
+		return G.LoadConfig(configFiles, format, flags)
+	}, check
+}
+
+// Check the configuration loaded, or not as err says, without
+// serving it, printing a summary or each problem found, and
+// returning the status to exit with
+func checkConfig(gc *G.GatewayConfig, err error) int {
+	if err == nil {
+		err = gc.Check(os.Stdout)
+	}
+	if err == nil {
+		return 0
+	}
+	var es G.ConfigErrors
+	if errors.As(err, &es) {
+		for _, e := range es {
+			fmt.Fprintln(os.Stderr, e)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, err)
 	}
+	return 1
+}
+
+// The files given by a flag given more than once
+type files []string
 
-	G.ERROR.Fatal("-configuration <file> must be specified")
+func (f *files) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *files) Set(file string) error {
+	*f = append(*f, file)
 	return nil
 }
 
-func initAggregating(c *G.GatewayConfig, stopsig chan os.Signal) *G.AGateway {
-	a := G.NewAGateway(c, stopsig)
+func initAggregating(c *G.GatewayConfig) *G.AGateway {
+	a := G.NewAGateway(c)
 	return a
 }
 
-func initTransparent(c *G.GatewayConfig, stopsig chan os.Signal) *G.TGateway {
-	t := G.NewTGateway(c, stopsig)
+func initTransparent(c *G.GatewayConfig) *G.TGateway {
+	t, err := G.NewTGateway(c)
+	if err != nil {
+		G.ERROR.Fatal(err)
+	}
 	return t
 }
 
 func registerSignals() chan os.Signal {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
 	return c
 }
@@ -0,0 +1,50 @@
+package packets
+
+import (
+	"io"
+)
+
+// A message relayed by a forwarder, wrapped with the id of the
+// wireless node it is from or for
+type EncapsulatedMessage struct {
+	Header
+	Radius         byte
+	WirelessNodeId []byte
+	Message        Message
+}
+
+func NewEncapsulatedMessage(WirelessNodeId []byte, Radius byte, Message Message) *EncapsulatedMessage {
+	return &EncapsulatedMessage{
+		Header:         Header{MessageType: ENCMSG},
+		Radius:         Radius,
+		WirelessNodeId: WirelessNodeId,
+		Message:        Message,
+	}
+}
+
+func (e *EncapsulatedMessage) MessageType() byte {
+	return ENCMSG
+}
+
+// The length covers the encapsulation alone, the message follows
+func (e *EncapsulatedMessage) Write(w io.Writer) error {
+	e.Header.Length = uint16(len(e.WirelessNodeId) + 3)
+	packet := e.Header.pack()
+	packet.WriteByte(ENCMSG)
+	packet.WriteByte(e.Radius & 0x03)
+	packet.Write(e.WirelessNodeId)
+	if _, err := packet.WriteTo(w); err != nil {
+		return err
+	}
+	return e.Message.Write(w)
+}
+
+// Message is nil if the message encapsulated cannot be decoded
+func (e *EncapsulatedMessage) Unpack(b io.Reader) {
+	e.Radius = readByte(b) & 0x03
+	if e.Header.Length > 3 {
+		e.WirelessNodeId = make([]byte, e.Header.Length-3)
+		b.Read(e.WirelessNodeId)
+	}
+	e.Message, _ = ReadPacket(b)
+}
@@ -0,0 +1,32 @@
+package packets
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"reflect"
+	"testing"
+)
+
+func TestEncapsulatedStruct(t *testing.T) {
+	msg := NewEncapsulatedMessage([]byte{0x0a, 0x0b}, 1, NewMessage(PINGREQ))
+
+	if assert.NotNil(t, msg, "New message should not be nil") {
+		assert.Equal(t, "*packets.EncapsulatedMessage", reflect.TypeOf(msg).String(), "Type should be EncapsulatedMessage")
+		assert.Equal(t, byte(ENCMSG), msg.MessageType(), "MessageType() should return ENCMSG")
+	}
+}
+
+func TestEncapsulatedRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	NewEncapsulatedMessage([]byte{0x0a, 0x0b}, 1, NewMessage(PINGREQ)).Write(&buf)
+	assert.Equal(t, []byte{0x05, ENCMSG, 0x01, 0x0a, 0x0b, 0x02, PINGREQ}, buf.Bytes(), "the encapsulation should precede the message")
+
+	m, err := ReadPacket(&buf)
+	assert.Nil(t, err, "ReadPacket should read the encapsulated message")
+	em := m.(*EncapsulatedMessage)
+	assert.Equal(t, byte(1), em.Radius, "Radius should be 1")
+	assert.Equal(t, []byte{0x0a, 0x0b}, em.WirelessNodeId, "WirelessNodeId should be 0a0b")
+	if assert.NotNil(t, em.Message, "the message should be decoded") {
+		assert.Equal(t, byte(PINGREQ), em.Message.MessageType(), "the message should be a PINGREQ")
+	}
+}
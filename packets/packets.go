@@ -25,11 +25,17 @@ type Header struct {
 	MessageType byte
 }
 
+// Decode a packet from r, which holds it whole, or from one
+// read of r, a datagram, of up to 1500 bytes. The message
+// copies what it keeps of it.
 func ReadPacket(r io.Reader) (m Message, err error) {
 	var h Header
-	packet := make([]byte, 1500)
-	r.Read(packet)
-	packetBuf := bytes.NewBuffer(packet)
+	packetBuf, ok := r.(*bytes.Buffer)
+	if !ok {
+		packet := make([]byte, 1500)
+		r.Read(packet)
+		packetBuf = bytes.NewBuffer(packet)
+	}
 	h.unpack(packetBuf)
 	m = NewMessageWithHeader(h)
 	if m == nil {
@@ -39,10 +45,46 @@ func ReadPacket(r io.Reader) (m Message, err error) {
 	return m, nil
 }
 
+// Read the bytes of one packet from a stream, in which packets
+// follow each other rather than coming a datagram each, by its
+// length: one byte, or three starting 0x01 for longer packets.
+// The length counts the length bytes themselves. An
+// encapsulated message's length covers only the encapsulation,
+// so the message it holds is read with it.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	frame := make([]byte, 3)
+	if _, err := io.ReadFull(r, frame[:1]); err != nil {
+		return nil, err
+	}
+	length, header := int(frame[0]), 1
+	if frame[0] == 0x01 {
+		if _, err := io.ReadFull(r, frame[1:3]); err != nil {
+			return nil, err
+		}
+		length, header = int(binary.BigEndian.Uint16(frame[1:3])), 3
+	}
+	if length <= header {
+		return nil, errors.New("Bad packet length")
+	}
+	frame = append(frame[:header], make([]byte, length-header)...)
+	if _, err := io.ReadFull(r, frame[header:]); err != nil {
+		return nil, err
+	}
+	if frame[header] == ENCMSG {
+		inner, err := ReadFrame(r)
+		if err != nil {
+			return nil, err
+		}
+		frame = append(frame, inner...)
+	}
+	return frame, nil
+}
+
 func (h *Header) unpack(b io.Reader) {
 	lengthCheck := readByte(b)
 	if lengthCheck == 0x01 {
-		h.Length = readUint16(b)
+		// less the two extra length bytes, as pack adds them
+		h.Length = readUint16(b) - 2
 	} else {
 		h.Length = uint16(lengthCheck)
 	}
@@ -51,7 +93,7 @@ func (h *Header) unpack(b io.Reader) {
 
 func (h *Header) pack() bytes.Buffer {
 	var header bytes.Buffer
-	if h.Length > 256 {
+	if h.Length > 255 {
 		h.Length += 2
 		header.WriteByte(0x01)
 		header.Write(encodeUint16(h.Length))
@@ -117,6 +159,8 @@ func NewMessage(msgType byte) (m Message) {
 		m = &WillMsgUpdateMessage{Header: Header{MessageType: WILLMSGUPD}}
 	case WILLMSGRESP:
 		m = &WillMsgRespMessage{Header: Header{MessageType: WILLMSGRESP, Length: 3}}
+	case ENCMSG:
+		m = &EncapsulatedMessage{Header: Header{MessageType: ENCMSG, Length: 3}}
 	}
 	return
 }
@@ -177,6 +221,8 @@ func NewMessageWithHeader(h Header) (m Message) {
 		m = &WillMsgUpdateMessage{Header: h}
 	case WILLMSGRESP:
 		m = &WillMsgRespMessage{Header: h}
+	case ENCMSG:
+		m = &EncapsulatedMessage{Header: h}
 	}
 	return
 }
@@ -250,7 +296,7 @@ const (
 	// 0x11 is reserved
 	// 0x19 is reserved
 	// 0x1E - 0xFD is reserved
-	// 0xFE - Encapsulated message
+	ENCMSG = 0xFE
 	// 0xFF is reserved
 )
 
@@ -282,4 +328,5 @@ var MessageNames = map[byte]string{
 	WILLTOPICRESP: "WILLTOPICRESP",
 	WILLMSGUPD:    "WILLMSGUPD",
 	WILLMSGRESP:   "WILLMSGRESP",
+	ENCMSG:        "ENCMSG",
 }
@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -34,3 +35,57 @@ func TestMessageTypeValues(t *testing.T) {
 	assert.Equal(t, 0x1C, WILLMSGUPD, "WILLMSGUPDshould be 0x1C")
 	assert.Equal(t, 0x1D, WILLMSGRESP, "WILLMSGRESPshould be 0x1D")
 }
+
+func TestReadFrame(t *testing.T) {
+	var stream bytes.Buffer
+	NewMessage(PINGREQ).Write(&stream)
+	long := NewPublishMessage(1, 0x00, make([]byte, 300), 0, 0, false, false)
+	long.Write(&stream)
+	stream.Write([]byte{0x02, PINGREQ, 0x05})
+
+	frame, err := ReadFrame(&stream)
+	assert.Nil(t, err, "ReadFrame should read the PINGREQ")
+	assert.Equal(t, []byte{0x02, PINGREQ}, frame, "frame should be the PINGREQ")
+
+	frame, err = ReadFrame(&stream)
+	assert.Nil(t, err, "ReadFrame should read the long PUBLISH")
+	assert.Equal(t, 309, len(frame), "frame should be the whole PUBLISH")
+
+	frame, err = ReadFrame(&stream)
+	assert.Nil(t, err, "ReadFrame should read the second PINGREQ")
+	assert.Equal(t, []byte{0x02, PINGREQ}, frame, "frame should be the second PINGREQ")
+
+	_, err = ReadFrame(&stream)
+	assert.NotNil(t, err, "ReadFrame should fail on a truncated packet")
+	_, err = ReadFrame(bytes.NewBuffer([]byte{0x01, 0x00, 0x03}))
+	assert.NotNil(t, err, "ReadFrame should fail on a length too short")
+
+	var encapsulated bytes.Buffer
+	NewEncapsulatedMessage([]byte{0x0a}, 0, NewMessage(PINGREQ)).Write(&encapsulated)
+	frame, err = ReadFrame(&encapsulated)
+	assert.Nil(t, err, "ReadFrame should read the encapsulated PINGREQ")
+	assert.Equal(t, []byte{0x04, ENCMSG, 0x00, 0x0a, 0x02, PINGREQ}, frame, "frame should hold the encapsulated message")
+}
+
+func TestReadPacketLong(t *testing.T) {
+	var buf bytes.Buffer
+	NewPublishMessage(1, 0x00, make([]byte, 2000), 0, 0, false, false).Write(&buf)
+	m, err := ReadPacket(&buf)
+	assert.Nil(t, err, "ReadPacket should read the long PUBLISH")
+	assert.Equal(t, 2000, len(m.(*PublishMessage).Data), "the payload should be whole")
+}
+
+func TestReadPacketLengthBoundary(t *testing.T) {
+	for _, size := range []int{248, 249, 250} {
+		var buf bytes.Buffer
+		NewPublishMessage(1, 0x00, make([]byte, size), 0, 0, false, false).Write(&buf)
+		if size == 248 {
+			assert.Equal(t, []byte{0xff, PUBLISH}, buf.Bytes()[:2], "a 255 byte packet should have a one byte length")
+		} else {
+			assert.Equal(t, []byte{0x01, 0x01, byte(size + 9 - 256), PUBLISH}, buf.Bytes()[:4], "a longer packet should have a three byte length")
+		}
+		m, err := ReadPacket(&buf)
+		assert.Nil(t, err, "ReadPacket should read the PUBLISH")
+		assert.Equal(t, size, len(m.(*PublishMessage).Data), "the payload should be whole")
+	}
+}
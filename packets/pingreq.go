@@ -27,6 +27,7 @@ func (p *PingreqMessage) Write(w io.Writer) error {
 
 func (p *PingreqMessage) Unpack(b io.Reader) {
 	if p.Header.Length > 2 {
+		p.ClientId = make([]byte, p.Header.Length-2)
 		b.Read(p.ClientId)
 	}
 }
@@ -13,6 +13,7 @@ type RegackMessage struct {
 
 func NewRegackMessage(TopicId uint16, MessageId uint16, rc byte) *RegackMessage {
 	return &RegackMessage{
+		Header:     Header{MessageType: REGACK, Length: 7},
 		TopicId:    TopicId,
 		MessageId:  MessageId,
 		ReturnCode: rc,
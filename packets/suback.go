@@ -14,6 +14,7 @@ type SubackMessage struct {
 
 func NewSubackMessage(TopicId uint16, MessageId uint16, Qos byte, rc byte) *SubackMessage {
 	return &SubackMessage{
+		Header:     Header{MessageType: SUBACK, Length: 8},
 		Qos:        Qos,
 		ReturnCode: rc,
 		TopicId:    TopicId,
@@ -53,6 +53,7 @@ func (u *UnsubscribeMessage) Unpack(b io.Reader) {
 	u.MessageId = readUint16(b)
 	switch u.TopicIdType {
 	case 0x00, 0x02:
+		u.TopicName = make([]byte, u.Header.Length-5)
 		b.Read(u.TopicName)
 	case 0x01:
 		u.TopicId = readUint16(b)
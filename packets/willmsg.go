@@ -24,5 +24,6 @@ func (wm *WillMsgMessage) Write(w io.Writer) error {
 }
 
 func (wm *WillMsgMessage) Unpack(b io.Reader) {
+	wm.WillMsg = make([]byte, wm.Header.Length-2)
 	b.Read(wm.WillMsg)
 }
@@ -24,5 +24,6 @@ func (wm *WillMsgUpdateMessage) Write(w io.Writer) error {
 }
 
 func (wm *WillMsgUpdateMessage) Unpack(b io.Reader) {
+	wm.WillMsg = make([]byte, wm.Header.Length-2)
 	b.Read(wm.WillMsg)
 }
@@ -50,6 +50,7 @@ func (wt *WillTopicMessage) Write(w io.Writer) error {
 func (wt *WillTopicMessage) Unpack(b io.Reader) {
 	if wt.Header.Length > 2 {
 		wt.decodeFlags(readByte(b))
+		wt.WillTopic = make([]byte, wt.Header.Length-3)
 		b.Read(wt.WillTopic)
 	}
 }